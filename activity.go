@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// Limits on the number of activity entries listed per request. The feed is
+// shown a few entries at a time, so the limits are lower than the audit log's.
+const (
+	defaultActivityLimit = 20
+	maxActivityLimit     = 100
+)
+
+// ActivityEntry is a write to a user's data in their activity feed, e.g.
+// "preferences updated". Keys lists the top-level keys of the document that
+// was written, or of the one that was deleted.
+type ActivityEntry struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Module string    `json:"module"`
+	Action string    `json:"action"`
+	BagID  string    `json:"bag_id,omitempty"`
+	Keys   []string  `json:"keys,omitempty"`
+}
+
+// activityEntry returns the activity feed entry for the audit entry, leaving
+// out the details that only matter to administrators, such as the API key
+// that made the write.
+func activityEntry(entry *AuditEntry) ActivityEntry {
+	activity := ActivityEntry{
+		ID:     entry.ID,
+		Time:   entry.Time,
+		Module: entry.Module,
+		Action: entry.Action,
+		BagID:  entry.BagID,
+	}
+	switch {
+	case entry.After != nil:
+		activity.Keys = entry.After.Keys
+	case entry.Before != nil:
+		activity.Keys = entry.Before.Keys
+	}
+	return activity
+}
+
+// ActivityApp serves users' activity feeds: the writes to their preferences,
+// sessions, saved searches, bags, and other data recorded in the audit log,
+// for showing users what they've done recently. Writes made while audit.enabled
+// is off aren't recorded, so they don't appear in the feed.
+type ActivityApp struct {
+	audit  *AuditDB
+	users  *UsersDB
+	bags   *BagsApp
+	router *mux.Router
+}
+
+// NewActivityApp returns a new *ActivityApp. bags is used to add the user
+// domain to usernames for the bags tables, since writes to bags are recorded
+// under that username.
+func NewActivityApp(audit *AuditDB, users *UsersDB, bags *BagsApp, router *mux.Router) *ActivityApp {
+	activityApp := &ActivityApp{
+		audit:  audit,
+		users:  users,
+		bags:   bags,
+		router: moduleRouter(router, "activity", "/activity"),
+	}
+	activityApp.router.HandleFunc("/{username}", activityApp.GetRequest).Methods(http.MethodGet)
+	return activityApp
+}
+
+// GetRequest returns a page of the user's activity feed, newest first. The
+// module query parameter limits it to one kind of data, e.g. bags, and since
+// and until to a range of time.
+func (a *ActivityApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, a.users.isUser)
+	if !ok {
+		return
+	}
+
+	var (
+		err    error
+		params = r.URL.Query()
+		filter = &AuditFilter{
+			Usernames: []string{username, a.bags.AddUsernameSuffix(r.Context(), username)},
+			Module:    params.Get("module"),
+		}
+	)
+	if err = parseTimeRange(params, &filter.Since, &filter.Until); err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+	if filter.Page, err = httpapi.ParsePage(r, defaultActivityLimit, maxActivityLimit); err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	entries, total, err := a.audit.listEntries(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing the activity of user %s: %s", username, err))
+		return
+	}
+
+	activity := make([]ActivityEntry, len(entries))
+	for i := range entries {
+		activity[i] = activityEntry(&entries[i])
+	}
+	httpapi.WritePage(writer, r, filter.Page, activity, total)
+}
@@ -1,46 +1,129 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
-func badRequest(writer http.ResponseWriter, msg string) {
-	http.Error(writer, msg, http.StatusBadRequest)
-	log.Error(msg)
+// identifierPattern matches the IDs that clients choose for the things they
+// store, such as tours and feedback forms, e.g. "data-window" or
+// "onboarding.step-2".
+var identifierPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+// maxResourceIDLength is the longest ID of a resource elsewhere in the DE, such
+// as an app, analysis, or folder, that users can refer to. IDs can be paths,
+// so they're only limited in length.
+const maxResourceIDLength = 1024
+
+// validResourceID returns what's wrong with the ID of a resource, or "" if
+// nothing is.
+func validResourceID(id string) string {
+	if id == "" || len(id) > maxResourceIDLength {
+		return fmt.Sprintf("IDs must be from 1 to %d bytes long", maxResourceIDLength)
+	}
+	return ""
+}
+
+// maxNameLength is the longest name users can give the things they make, such
+// as tags.
+const maxNameLength = 128
+
+// validName returns what's wrong with the name of something a user made, or ""
+// if nothing is.
+func validName(name string) string {
+	switch {
+	case strings.TrimSpace(name) != name:
+		return "names can't start or end with spaces"
+	case name == "" || utf8.RuneCountInString(name) > maxNameLength:
+		return fmt.Sprintf("names must be from 1 to %d characters long", maxNameLength)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return "names can't have control characters"
+	}
+	return ""
 }
 
-func errored(writer http.ResponseWriter, msg string) {
-	http.Error(writer, msg, http.StatusInternalServerError)
-	log.Error(msg)
+// uuidVar returns the UUID in the request's URL variable named key, responding
+// with a 400 and returning false if it isn't a UUID. what names the thing the
+// UUID identifies in the error.
+func uuidVar(writer http.ResponseWriter, r *http.Request, key, what string) (string, bool) {
+	id := mux.Vars(r)[key]
+	if _, err := uuid.Parse(id); err != nil {
+		httpapi.BadRequest(writer, fmt.Sprintf("invalid %s ID: %q", what, id))
+		return "", false
+	}
+	return id, true
 }
 
-func notFound(writer http.ResponseWriter, msg string) {
-	http.Error(writer, msg, http.StatusNotFound)
-	log.Error(msg)
+// writeFailed responds to an error from writing to the database with a 409 if
+// the write conflicts with data that's already stored, or a 500 otherwise.
+func writeFailed(writer http.ResponseWriter, err error, msg string) {
+	if isConflict(err) {
+		httpapi.Error(writer, msg, http.StatusConflict)
+		log.Error(msg)
+		return
+	}
+	httpapi.Errored(writer, msg)
 }
 
-func handleNonUser(writer http.ResponseWriter, username string) {
-	var (
-		retval []byte
-		err    error
-	)
+// existingUser returns the username in the request's URL. It responds with an
+// error and returns false if the username is missing or isUser says the user
+// doesn't exist.
+func existingUser(writer http.ResponseWriter, r *http.Request, isUser func(context.Context, string) (bool, error)) (string, bool) {
+	username, ok := mux.Vars(r)["username"]
+	if !ok {
+		httpapi.BadRequest(writer, "Missing username in URL")
+		return "", false
+	}
 
-	retval, err = json.Marshal(map[string]string{
-		"user": username,
-	})
+	userExists, err := isUser(r.Context(), username)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error generating json for non-user %s", err))
-		return
+		httpapi.Errored(writer, fmt.Sprintf("error checking for username %s: %s", username, err))
+		return "", false
+	}
+	if !userExists {
+		httpapi.UserNotFound(writer, username)
+		return "", false
 	}
 
-	notFound(writer, string(retval))
+	return username, true
+}
+
+// parseTimeRange reads the since and until query parameters, which are RFC 3339
+// timestamps, into since and until. Missing parameters leave them unchanged.
+func parseTimeRange(params url.Values, since, until *time.Time) error {
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{
+		{"since", since},
+		{"until", until},
+	} {
+		if value := params.Get(p.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return fmt.Errorf("%s must be an RFC 3339 timestamp: %s", p.name, value)
+			}
+			*p.dest = t
+		}
+	}
+	return nil
 }
 
 func fixAddr(addr string) string {
@@ -50,6 +133,34 @@ func fixAddr(addr string) string {
 	return addr
 }
 
+// unixPrefix marks a listen address as the path to a Unix domain socket.
+const unixPrefix = "unix:"
+
+// listen returns a listener for the given address, which is either a TCP port
+// or "unix:" followed by the path to a Unix domain socket. A stale socket file
+// left behind at the path is removed first, but anything else there is left
+// alone and is an error, so that a mistyped path can't delete a file.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", fixAddr(addr))
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	info, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	case info.Mode()&fs.ModeSocket == 0:
+		return nil, fmt.Errorf("can't listen on %s: it already exists and isn't a socket", path)
+	default:
+		if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
 var (
 	gitref  string
 	appver  string
@@ -69,9 +180,39 @@ func AppVersion() {
 	}
 }
 
-func makeRouter() *mux.Router {
+// moduleRouter returns a subrouter for the routes of the named module, which
+// are all under the path prefix. The middleware runs for the module's routes
+// only, in order, after the middleware of the router itself; more can be added
+// later with Use. The module's name is added to the log entry for each request,
+// and the module's routes respond with an error while moduleFlags has it turned
+// off.
+func moduleRouter(router *mux.Router, name, prefix string, middleware ...mux.MiddlewareFunc) *mux.Router {
+	module := router.PathPrefix(prefix).Subrouter()
+	module.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+			setLogField(r.Context(), "module", name)
+			next.ServeHTTP(writer, r)
+		})
+	})
+	module.Use(moduleFlags.Middleware(name))
+	module.Use(middleware...)
+	return module
+}
+
+// makeRouter returns a new *mux.Router with the service's middleware and base
+// routes. Any middleware passed in runs after the request logger.
+func makeRouter(middleware ...mux.MiddlewareFunc) *mux.Router {
 	router := mux.NewRouter()
 	router.Use(otelmux.Middleware(serviceName))
+	router.Use(requestLogger)
+	router.Use(spanAttributes)
+	router.Use(middleware...)
+	router.NotFoundHandler = http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		httpapi.Error(writer, fmt.Sprintf("no route for %s", r.URL.Path), http.StatusNotFound)
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		httpapi.Error(writer, fmt.Sprintf("%s is not allowed for %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+	})
 	router.Handle("/debug/vars", http.DefaultServeMux)
 	router.HandleFunc("/", func(writer http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(writer, "Hello from user-info.\n")
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits on the number of audit entries listed per request.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditLogger records every mutation it observes in the audit log. Entries are
+// queued by Observe and written by Run, so writes aren't slowed by auditing.
+type AuditLogger struct {
+	audit *AuditDB
+	queue chan AuditEntry
+}
+
+// NewAuditLogger returns a new *AuditLogger that can queue up to queueSize
+// entries.
+func NewAuditLogger(audit *AuditDB, queueSize int) *AuditLogger {
+	return &AuditLogger{
+		audit: audit,
+		queue: make(chan AuditEntry, queueSize),
+	}
+}
+
+// Observe queues an audit entry for the mutation, taking the actor, the
+// impersonator, and the request ID from the request context. The entry is logged and dropped if the queue is
+// full.
+func (a *AuditLogger) Observe(ctx context.Context, m Mutation) {
+	entry := AuditEntry{
+		Time:         time.Now().UTC(),
+		Module:       m.Module,
+		Action:       m.Action,
+		Username:     m.Username,
+		BagID:        m.BagID,
+		Actor:        apiKeyName(ctx),
+		Impersonator: impersonator(ctx),
+		RequestID:    requestID(ctx),
+		Before:       m.Before,
+		After:        m.After,
+	}
+
+	select {
+	case a.queue <- entry:
+	default:
+		log.WithFields(log.Fields{
+			"module":       entry.Module,
+			"action":       entry.Action,
+			"username":     entry.Username,
+			"bag_id":       entry.BagID,
+			"actor":        entry.Actor,
+			"impersonator": entry.Impersonator,
+			"request_id":   entry.RequestID,
+		}).Error("audit queue is full, dropping entry")
+	}
+}
+
+// Run writes queued entries to the audit log until the context is canceled.
+func (a *AuditLogger) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry := <-a.queue:
+			if err := a.audit.addEntry(ctx, &entry); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// AuditApp handles the admin requests for reading the audit log.
+type AuditApp struct {
+	audit  *AuditDB
+	router *mux.Router
+}
+
+// NewAuditApp returns a new *AuditApp. The router should be the admin router
+// returned by newAdminRouter.
+func NewAuditApp(db *AuditDB, router *mux.Router) *AuditApp {
+	auditApp := &AuditApp{
+		audit:  db,
+		router: moduleRouter(router, "audit", "/audit"),
+	}
+	auditApp.router.HandleFunc("", auditApp.ListEntries).Methods(http.MethodGet)
+	return auditApp
+}
+
+// auditFilter parses the audit log filter from the request's query parameters.
+func auditFilter(r *http.Request) (*AuditFilter, error) {
+	var (
+		err    error
+		params = r.URL.Query()
+		filter = &AuditFilter{
+			Username:     params.Get("username"),
+			Module:       params.Get("module"),
+			Action:       params.Get("action"),
+			Actor:        params.Get("actor"),
+			Impersonator: params.Get("impersonator"),
+			RequestID:    params.Get("request_id"),
+		}
+	)
+
+	if err = parseTimeRange(params, &filter.Since, &filter.Until); err != nil {
+		return nil, err
+	}
+
+	if filter.Page, err = httpapi.ParsePage(r, defaultAuditLimit, maxAuditLimit); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// ListEntries returns a page of the audit entries matching the query
+// parameters, newest first.
+func (a *AuditApp) ListEntries(writer http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	entries, total, err := a.audit.listEntries(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing audit entries: %s", err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, filter.Page, entries, total)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/lib/pq"
+)
+
+// AuditEntry is a record of a single write to a user's data. Actor is the
+// name of the API key used for the write, if any, and Impersonator is the user
+// who made the write while impersonating Username, if anyone did.
+type AuditEntry struct {
+	ID           string           `json:"id"`
+	Time         time.Time        `json:"time"`
+	Module       string           `json:"module"`
+	Action       string           `json:"action"`
+	Username     string           `json:"username"`
+	BagID        string           `json:"bag_id,omitempty"`
+	Actor        string           `json:"actor,omitempty"`
+	Impersonator string           `json:"impersonator,omitempty"`
+	RequestID    string           `json:"request_id,omitempty"`
+	Before       *DocumentSummary `json:"before,omitempty"`
+	After        *DocumentSummary `json:"after,omitempty"`
+}
+
+// AuditFilter selects the page of audit entries to list. Empty fields match
+// every entry. Usernames matches the entries for any of the users, along with
+// Username.
+type AuditFilter struct {
+	Username     string
+	Usernames    []string
+	Module       string
+	Action       string
+	Actor        string
+	Impersonator string
+	RequestID    string
+	Since        time.Time
+	Until        time.Time
+	httpapi.Page
+}
+
+// query returns the query for the entries matching the filter, without its
+// page.
+func (f *AuditFilter) query() *selectQuery {
+	q := selectFrom("audit_log", "id", "created_at", "module", "action", "username", "bag_id", "actor", "impersonator", "request_id", "before", "after")
+
+	for _, field := range []struct {
+		column string
+		value  string
+	}{
+		{"username", f.Username},
+		{"module", f.Module},
+		{"action", f.Action},
+		{"actor", f.Actor},
+		{"impersonator", f.Impersonator},
+		{"request_id", f.RequestID},
+	} {
+		if field.value != "" {
+			q.Where(field.column+" = ?", field.value)
+		}
+	}
+
+	if len(f.Usernames) > 0 {
+		q.Where("username = ANY(?)", pq.Array(f.Usernames))
+	}
+
+	if !f.Since.IsZero() {
+		q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q.Where("created_at < ?", f.Until)
+	}
+
+	return q
+}
+
+// AuditDB stores the audit log.
+type AuditDB struct {
+	db *retryingDB
+}
+
+// NewAuditDB returns a newly created *AuditDB.
+func NewAuditDB(db *sql.DB) *AuditDB {
+	return &AuditDB{db: withRetries(db)}
+}
+
+// nullString returns a NULL for empty strings.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// summaryJSON encodes a summary for a jsonb column, returning a NULL for a nil
+// summary. It's encoded as a string since lib/pq sends []byte as bytea.
+func summaryJSON(summary *DocumentSummary) (sql.NullString, error) {
+	if summary == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(summary)
+	return sql.NullString{String: string(b), Valid: true}, err
+}
+
+// addEntry records an audit entry.
+func (a *AuditDB) addEntry(ctx context.Context, entry *AuditEntry) error {
+	query := `INSERT INTO audit_log (created_at, module, action, username, bag_id, actor, impersonator, request_id, before, after)
+                   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	before, err := summaryJSON(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := summaryJSON(entry.After)
+	if err != nil {
+		return err
+	}
+
+	if _, err = a.db.ExecContext(ctx, query,
+		entry.Time,
+		entry.Module,
+		entry.Action,
+		entry.Username,
+		nullString(entry.BagID),
+		nullString(entry.Actor),
+		nullString(entry.Impersonator),
+		nullString(entry.RequestID),
+		before,
+		after,
+	); err != nil {
+		return fmt.Errorf("error recording %s.%s audit entry for %s: %w", entry.Module, entry.Action, entry.Username, dbError(err))
+	}
+	return nil
+}
+
+// listEntries returns the audit entries matching the filter, newest first,
+// along with the total number of matching entries.
+func (a *AuditDB) listEntries(ctx context.Context, filter *AuditFilter) ([]AuditEntry, int64, error) {
+	var total int64
+
+	q := filter.query()
+
+	countQuery, countArgs := q.Count().SQL()
+	if err := a.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	query, args := q.OrderBy("created_at DESC", "id").Page(filter.Page).SQL()
+	rows, err := a.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, dbError(err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var (
+			entry                                 AuditEntry
+			bagID, actor, impersonator, requestID sql.NullString
+			before, after                         []byte
+		)
+
+		if err = rows.Scan(&entry.ID, &entry.Time, &entry.Module, &entry.Action, &entry.Username, &bagID, &actor, &impersonator, &requestID, &before, &after); err != nil {
+			return nil, 0, err
+		}
+		entry.BagID, entry.Actor, entry.Impersonator, entry.RequestID = bagID.String, actor.String, impersonator.String, requestID.String
+
+		if before != nil {
+			if err = json.Unmarshal(before, &entry.Before); err != nil {
+				return nil, 0, err
+			}
+		}
+		if after != nil {
+			if err = json.Unmarshal(after, &entry.After); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, total, dbError(rows.Err())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiKeyScheme is the Authorization scheme used by callers presenting an API
+// key, as in "Authorization: ApiKey <key>". Other schemes are left alone so
+// that they can be handled elsewhere.
+const apiKeyScheme = "ApiKey"
+
+type apiKeyNameKey struct{}
+
+// apiKeyName returns the name of the API key that authenticated the request the
+// context belongs to, or an empty string if no key was used.
+func apiKeyName(ctx context.Context) string {
+	name, _ := ctx.Value(apiKeyNameKey{}).(string)
+	return name
+}
+
+// APIKeyAuth checks the API keys that internal services present in the
+// Authorization header.
+type APIKeyAuth struct {
+	keys     map[string]string // name -> key
+	required bool
+}
+
+// NewAPIKeyAuth returns a new *APIKeyAuth for the given keys, which map each
+// key's name to its value. If required is true, requests without a valid key
+// are rejected.
+func NewAPIKeyAuth(keys map[string]string, required bool) *APIKeyAuth {
+	return &APIKeyAuth{
+		keys:     keys,
+		required: required,
+	}
+}
+
+// lookup returns the name of the given key and whether it's a known key. Every
+// configured key is compared so the time taken doesn't depend on which one
+// matched.
+func (a *APIKeyAuth) lookup(key string) (string, bool) {
+	var found string
+	for name, value := range a.keys {
+		if value != "" && subtle.ConstantTimeCompare([]byte(key), []byte(value)) == 1 {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// apiKey returns the API key in the Authorization header of the request and
+// whether the header used the API key scheme.
+func apiKey(r *http.Request) (string, bool) {
+	scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, apiKeyScheme) {
+		return "", false
+	}
+	return strings.TrimSpace(key), true
+}
+
+func unauthorized(writer http.ResponseWriter, msg string) {
+	writer.Header().Set("WWW-Authenticate", apiKeyScheme)
+	httpapi.Error(writer, msg, http.StatusUnauthorized)
+	log.Error(msg)
+}
+
+// Middleware records the name of the API key presented with each request in
+// the request context and the request log. Requests presenting an unknown key
+// are rejected, as are requests without a key if keys are required.
+func (a *APIKeyAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		key, ok := apiKey(r)
+		if !ok {
+			if a.required {
+				unauthorized(writer, "an API key is required")
+				return
+			}
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		name, ok := a.lookup(key)
+		if !ok {
+			unauthorized(writer, "invalid API key")
+			return
+		}
+
+		setLogField(r.Context(), "api_key", name)
+		next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), apiKeyNameKey{}, name)))
+	})
+}
+
+// newAdminRouter returns a subrouter for the routes under /admin. Requests to
+// them must present one of the named API keys; if no names are given, the
+// routes are available to every caller the API key middleware lets through.
+func newAdminRouter(router *mux.Router, adminKeys []string) *mux.Router {
+	admin := moduleRouter(router, "admin", "/admin")
+	if len(adminKeys) == 0 {
+		return admin
+	}
+
+	allowed := make(map[string]bool, len(adminKeys))
+	for _, name := range adminKeys {
+		allowed[name] = true
+	}
+
+	admin.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+			name := apiKeyName(r.Context())
+			if name == "" {
+				unauthorized(writer, "an admin API key is required")
+				return
+			}
+			if !allowed[name] {
+				httpapi.Error(writer, "the API key is not allowed to use admin endpoints", http.StatusForbidden)
+				log.WithContext(r.Context()).Errorf("API key %s is not an admin key", name)
+				return
+			}
+			next.ServeHTTP(writer, r)
+		})
+	})
+	return admin
+}
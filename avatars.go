@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// avatarTypes are the content types of the images that can be uploaded as
+// avatars. The type is sniffed from the image rather than taken from the
+// request's Content-Type header.
+var avatarTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// AvatarsApp serves users' avatars.
+type AvatarsApp struct {
+	avatars *AvatarsDB
+	maxSize int64
+	maxAge  time.Duration
+	router  *mux.Router
+}
+
+// NewAvatarsApp returns a new *AvatarsApp. Uploaded images can't be larger
+// than maxSize bytes, and clients are told they can cache avatars for maxAge.
+func NewAvatarsApp(db *AvatarsDB, maxSize int64, maxAge time.Duration, router *mux.Router) *AvatarsApp {
+	avatarsApp := &AvatarsApp{
+		avatars: db,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		router:  moduleRouter(router, "avatars", "/avatars"),
+	}
+	avatarsApp.router.HandleFunc("/{username}", avatarsApp.GetRequest).Methods(http.MethodGet)
+	avatarsApp.router.HandleFunc("/{username}", avatarsApp.PutRequest).Methods(http.MethodPut)
+	avatarsApp.router.HandleFunc("/{username}", avatarsApp.DeleteRequest).Methods(http.MethodDelete)
+	return avatarsApp
+}
+
+// avatarETag returns the entity tag of the image.
+func avatarETag(image []byte) string {
+	sum := sha256.Sum256(image)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// GetRequest responds with the user's avatar image, or redirects to it if the
+// avatar is an external URL. Conditional requests get a 304 when the client's
+// copy is current.
+func (a *AvatarsApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, a.avatars.isUser)
+	if !ok {
+		return
+	}
+
+	avatar, err := a.avatars.getAvatar(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the avatar for user %s: %s", username, err))
+		return
+	}
+	if avatar == nil {
+		httpapi.NotFound(writer, fmt.Sprintf("no avatar is stored for user %s", username))
+		return
+	}
+
+	writer.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(a.maxAge.Seconds())))
+	if avatar.URL != "" {
+		http.Redirect(writer, r, avatar.URL, http.StatusFound)
+		return
+	}
+
+	writer.Header().Set("Content-Type", avatar.ContentType)
+	writer.Header().Set("ETag", avatarETag(avatar.Image))
+	http.ServeContent(writer, r, "", avatar.UpdatedAt, bytes.NewReader(avatar.Image))
+}
+
+// readAvatar reads the avatar from the request body, which is either the image
+// or a JSON object with the url of an external image. Returns nil if it
+// responded with an error.
+func (a *AvatarsApp) readAvatar(writer http.ResponseWriter, r *http.Request) *Avatar {
+	if a.maxSize > 0 {
+		r.Body = http.MaxBytesReader(writer, r.Body, a.maxSize)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpapi.ReadBodyError(writer, err)
+		return nil
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var external struct {
+			URL string `json:"url"`
+		}
+		if err = json.Unmarshal(body, &external); err != nil {
+			httpapi.BadRequest(writer, fmt.Sprintf("error parsing the avatar: %s", err))
+			return nil
+		}
+
+		parsed, err := url.Parse(external.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			httpapi.BadRequest(writer, fmt.Sprintf("the avatar url must be an absolute http or https URL: %q", external.URL))
+			return nil
+		}
+		return &Avatar{URL: parsed.String()}
+	}
+
+	if len(body) == 0 {
+		httpapi.BadRequest(writer, "the avatar image is empty")
+		return nil
+	}
+
+	contentType := http.DetectContentType(body)
+	for _, allowed := range avatarTypes {
+		if contentType == allowed {
+			return &Avatar{ContentType: contentType, Size: len(body), Image: body}
+		}
+	}
+
+	msg := fmt.Sprintf("avatars must be PNG, JPEG, GIF or WebP images, not %s", contentType)
+	httpapi.WriteProblem(writer, http.StatusUnsupportedMediaType, httpapi.CodeUnsupportedMediaType, msg, map[string]interface{}{
+		"allowed": avatarTypes,
+	})
+	return nil
+}
+
+// PutRequest stores the user's avatar. The body is either a PNG, JPEG, GIF or
+// WebP image, or a JSON object with the url of an image stored elsewhere. The
+// response describes the stored avatar, with a 201 if the user didn't have one
+// before.
+func (a *AvatarsApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, a.avatars.isUser)
+	if !ok {
+		return
+	}
+
+	avatar := a.readAvatar(writer, r)
+	if avatar == nil {
+		return
+	}
+	avatar.User = username
+
+	created, err := a.avatars.setAvatar(r.Context(), username, avatar)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error storing the avatar for user %s: %s", username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, avatar)
+}
+
+// DeleteRequest deletes the user's avatar.
+func (a *AvatarsApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, a.avatars.isUser)
+	if !ok {
+		return
+	}
+
+	deleted, err := a.avatars.deleteAvatar(r.Context(), username)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting the avatar for user %s: %s", username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("no avatar is stored for user %s", username))
+	}
+}
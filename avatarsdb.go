@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/queries"
+)
+
+// Avatar is a user's avatar, which is either an image stored in the database or
+// the URL of an image stored elsewhere.
+type Avatar struct {
+	User        string    `json:"user"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int       `json:"size,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Image       []byte    `json:"-"`
+}
+
+// AvatarsDB handles interacting with the user_avatars table.
+type AvatarsDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewAvatarsDB returns a newly created *AvatarsDB. Only the user lookups are
+// cached in cache, which may be nil to disable caching, since the images are
+// cached by the clients instead.
+func NewAvatarsDB(db *sql.DB, cache Cache) *AvatarsDB {
+	return &AvatarsDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// isUser returns whether or not the user is present in the database.
+func (a *AvatarsDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, a.cache, a.db, username)
+}
+
+// getAvatar returns the user's avatar, or nil if they don't have one.
+func (a *AvatarsDB) getAvatar(ctx context.Context, username string) (*Avatar, error) {
+	query, args := userRows("user_avatars", "a", username, "a.content_type", "a.image", "a.url", "a.updated_at").SQL()
+
+	var (
+		avatar      = Avatar{User: username}
+		contentType sql.NullString
+		url         sql.NullString
+	)
+	err := a.db.QueryRowContext(ctx, query, args...).Scan(&contentType, &avatar.Image, &url, &avatar.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	avatar.ContentType = contentType.String
+	avatar.URL = url.String
+	avatar.Size = len(avatar.Image)
+	return &avatar, nil
+}
+
+// setAvatar stores the avatar for the user, replacing the one they had.
+// Either the image and its content type or the URL must be set. Returns
+// whether the user didn't have an avatar before, and sets the avatar's
+// UpdatedAt.
+func (a *AvatarsDB) setAvatar(ctx context.Context, username string, avatar *Avatar) (bool, error) {
+	query := `INSERT INTO user_avatars (user_id, content_type, image, url)
+                   VALUES ($1, $2, $3, $4)
+              ON CONFLICT (user_id) DO UPDATE
+                      SET content_type = EXCLUDED.content_type,
+                          image = EXCLUDED.image,
+                          url = EXCLUDED.url,
+                          updated_at = now()
+                RETURNING (xmax = 0) AS created, updated_at`
+
+	userID, err := queries.UserID(ctx, a.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	// A nil interface is sent as NULL, which a nil []byte might not be.
+	var image interface{}
+	if len(avatar.Image) > 0 {
+		image = avatar.Image
+	}
+	contentType := sql.NullString{String: avatar.ContentType, Valid: avatar.ContentType != ""}
+	url := sql.NullString{String: avatar.URL, Valid: avatar.URL != ""}
+
+	var created bool
+	if err = a.db.QueryRowContext(ctx, query, userID, contentType, image, url).Scan(&created, &avatar.UpdatedAt); err != nil {
+		return false, dbError(err)
+	}
+
+	action := actionUpdated
+	if created {
+		action = actionCreated
+	}
+	a.notify(ctx, Mutation{Module: "avatars", Action: action, Username: username, After: &DocumentSummary{Bytes: len(avatar.Image) + len(avatar.URL)}})
+	return created, nil
+}
+
+// deleteAvatar deletes the user's avatar. Returns whether they had one.
+func (a *AvatarsDB) deleteAvatar(ctx context.Context, username string) (bool, error) {
+	query := `DELETE FROM ONLY user_avatars WHERE user_id = $1`
+
+	userID, err := queries.UserID(ctx, a.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := a.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		a.notify(ctx, Mutation{Module: "avatars", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// BackupApp handles the admin requests for backing up and restoring the users'
+// data, for migrating a deployment or recovering a single user's rows.
+type BackupApp struct {
+	backups *BackupDB
+	router  *mux.Router
+}
+
+// NewBackupApp returns a new *BackupApp. The router should be the admin router
+// returned by newAdminRouter.
+func NewBackupApp(db *BackupDB, router *mux.Router) *BackupApp {
+	backupApp := &BackupApp{
+		backups: db,
+		router:  router,
+	}
+	backupApp.router.HandleFunc("/backup", backupApp.BackupRequest).Methods(http.MethodGet)
+	backupApp.router.HandleFunc("/restore", backupApp.RestoreRequest).Methods(http.MethodPost)
+	return backupApp
+}
+
+// BackupRequest streams a backup of the users' data as a JSON object with the
+// rows of each table. The username query parameter, which may be repeated,
+// limits the backup to those users. If an error occurs after the response has
+// started, it's cut short, leaving an invalid document.
+func (b *BackupApp) BackupRequest(writer http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	usernames := r.URL.Query()["username"]
+
+	export, err := writeExport(func(fn exportFunc) error {
+		return b.backups.backup(ctx, usernames, fn)
+	}, func() exportWriter {
+		filename := fmt.Sprintf("user-info-backup-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		return &jsonExport{w: writer}
+	})
+
+	if err != nil {
+		if export == nil {
+			httpapi.Errored(writer, fmt.Sprintf("Error backing up the users' data: %s", err))
+			return
+		}
+		log.WithContext(ctx).Errorf("error streaming the backup: %s", err)
+		return
+	}
+
+	if err = export.close(); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// RestoreRequest restores a backup from the request body. Everything stored
+// for each user in the backup is replaced with the user's rows in the backup,
+// in one transaction. The username query parameter, which may be repeated,
+// limits the restore to those users. The response lists the number of rows
+// restored to each table.
+func (b *BackupApp) RestoreRequest(writer http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	usernames := r.URL.Query()["username"]
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpapi.ReadBodyError(writer, err)
+		return
+	}
+
+	if _, ok := httpapi.ReadObject(writer, body); !ok {
+		return
+	}
+
+	var backup map[string][]json.RawMessage
+	if err = json.Unmarshal(body, &backup); err != nil {
+		httpapi.BadRequest(writer, "each table in the backup must be an array of rows")
+		return
+	}
+
+	known := make(map[string]bool, len(exportTables))
+	for _, table := range exportTables {
+		known[table.name] = true
+	}
+	for table := range backup {
+		if !known[table] {
+			httpapi.BadRequest(writer, fmt.Sprintf("the backup has an unknown table: %s", table))
+			return
+		}
+	}
+
+	report, err := b.backups.restore(ctx, backup, usernames)
+	if err != nil {
+		var backupErr *backupError
+		if errors.As(err, &backupErr) {
+			httpapi.BadRequest(writer, err.Error())
+			return
+		}
+		writeFailed(writer, err, fmt.Sprintf("Error restoring the backup: %s", err))
+		return
+	}
+
+	log.WithContext(ctx).Infof("restored a backup: %v", report)
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{
+		"restored": report,
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// BackupDB reads and writes backups of the users' data. A backup is a JSON
+// object with the rows of each table in exportTables, in the same format as a
+// user data export with format=json, so an export can be restored as well.
+// Team preferences, webhook subscriptions, the audit log, idempotency keys, and
+// the tables in usernameTables aren't included; rows for those tables in a
+// restored export are ignored.
+type BackupDB struct {
+	db    *retryingDB
+	cache Cache
+}
+
+// NewBackupDB returns a newly created *BackupDB. Entries for restored users are
+// removed from cache, which may be nil.
+func NewBackupDB(db *sql.DB, cache Cache) *BackupDB {
+	return &BackupDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// backupQuery returns the query for the rows of the table, optionally limited
+// to the users whose usernames are passed in as $1.
+func backupQuery(table string, filtered bool) string {
+	switch {
+	case table == "users" && filtered:
+		return `SELECT row_to_json(t) FROM users t WHERE t.username = ANY($1) ORDER BY t.username`
+	case table == "users":
+		return `SELECT row_to_json(t) FROM users t ORDER BY t.username`
+	case filtered:
+		return fmt.Sprintf(`SELECT row_to_json(t) FROM %s t WHERE t.user_id IN (SELECT id FROM users WHERE username = ANY($1)) ORDER BY t.user_id`, table)
+	default:
+		return fmt.Sprintf(`SELECT row_to_json(t) FROM %s t ORDER BY t.user_id`, table)
+	}
+}
+
+// backup calls fn for each table in exportTables with a function that iterates
+// over its rows as JSON. The rows are read in a single read-only transaction
+// so that the backup is consistent. If any usernames are given, only the rows
+// for those users are included.
+func (b *BackupDB) backup(ctx context.Context, usernames []string, fn exportFunc) error {
+	tx, err := b.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	for _, table := range exportTables {
+		if table.byUsername {
+			continue
+		}
+
+		var args []interface{}
+		if len(usernames) > 0 {
+			args = append(args, pq.Array(usernames))
+		}
+
+		rows := queryRows(ctx, tx, backupQuery(table.name, len(usernames) > 0), args...)
+		if err = fn(table.name, rows); err != nil {
+			return fmt.Errorf("error backing up %s: %w", table.name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// backupUser is the part of a users row that a restore needs.
+type backupUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// restore replaces everything stored for the users in the backup with the rows
+// in the backup, in one transaction, and returns the number of rows restored
+// to each table. If any usernames are given, only those users are restored.
+// Users that already exist keep their IDs; the user_id of each restored row is
+// changed to match.
+func (b *BackupDB) restore(ctx context.Context, backup map[string][]json.RawMessage, usernames []string) (map[string]int64, error) {
+	only := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		only[username] = true
+	}
+
+	var users []backupUser
+	for i, row := range backup["users"] {
+		var user backupUser
+		if err := json.Unmarshal(row, &user); err != nil || user.ID == "" || user.Username == "" {
+			return nil, &backupError{fmt.Sprintf("users row %d must have an id and a username", i)}
+		}
+		if len(only) == 0 || only[user.Username] {
+			users = append(users, user)
+		}
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	report := make(map[string]int64, len(exportTables))
+
+	// Maps the user IDs in the backup to the IDs in the database.
+	userIDs := make(map[string]string, len(users))
+	for _, user := range users {
+		var id string
+		query := `INSERT INTO users (id, username) VALUES ($1, $2)
+                  ON CONFLICT (username) DO UPDATE SET username = EXCLUDED.username
+                  RETURNING id`
+		if err = tx.QueryRowContext(ctx, query, user.ID, user.Username).Scan(&id); err != nil {
+			return nil, fmt.Errorf("error restoring user %s: %w", user.Username, dbError(err))
+		}
+		userIDs[user.ID] = id
+		report["users"]++
+	}
+
+	ids := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		ids = append(ids, id)
+	}
+	for _, table := range userTables {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE user_id = ANY($1)`, table.name)
+		if _, err = tx.ExecContext(ctx, query, pq.Array(ids)); err != nil {
+			return nil, fmt.Errorf("error clearing %s: %w", table.name, dbError(err))
+		}
+	}
+
+	// userTables is in the order that rows can be deleted, so it's walked
+	// backwards to insert rows before the ones that reference them.
+	for i := len(userTables) - 1; i >= 0; i-- {
+		table := userTables[i].name
+
+		var rows []map[string]interface{}
+		for j, raw := range backup[table] {
+			var row map[string]interface{}
+			if err = json.Unmarshal(raw, &row); err != nil {
+				return nil, &backupError{fmt.Sprintf("%s row %d must be an object", table, j)}
+			}
+			userID, _ := row["user_id"].(string)
+			if id, ok := userIDs[userID]; ok {
+				row["user_id"] = id
+				rows = append(rows, row)
+			} else if len(only) == 0 {
+				return nil, &backupError{fmt.Sprintf("%s row %d belongs to a user that isn't in the backup", table, j)}
+			}
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		encoded, err := json.Marshal(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		// lib/pq sends []byte as bytea, so the rows are sent as a string.
+		query := fmt.Sprintf(`INSERT INTO %[1]s SELECT * FROM json_populate_recordset(NULL::%[1]s, $1)`, table)
+		result, err := tx.ExecContext(ctx, query, string(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("error restoring %s: %w", table, dbError(err))
+		}
+		if report[table], err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, dbError(err)
+	}
+
+	for _, user := range users {
+		cacheInvalidate(ctx, b.cache,
+			userExistsKey(user.Username),
+			hasPreferencesKey(user.Username), preferencesKey(user.Username),
+			hasSessionsKey(user.Username), sessionsKey(user.Username),
+			hasSavedSearchesKey(user.Username), savedSearchesKey(user.Username),
+			bagCountKey(user.Username), hasDefaultBagKey(user.Username),
+			toursKey(user.Username), notificationPrefsKey(user.Username), pinsKey(user.Username),
+			userWebhooksKey(user.Username), dashboardKey(user.Username), digestScheduleKey(user.Username),
+			localeKey(user.Username),
+		)
+	}
+	cacheInvalidatePrefix(ctx, b.cache, cacheKey("bags", ""))
+
+	return report, nil
+}
+
+// backupError is returned by restore for backups that can't be restored
+// because they're malformed.
+type backupError struct {
+	msg string
+}
+
+func (e *backupError) Error() string {
+	return e.msg
+}
@@ -8,49 +8,114 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/cyverse-de/queries"
+	"github.com/cyverse-de/user-info/internal/httpapi"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
 // BagsApp contains the routing and request handling code for bags.
 type BagsApp struct {
-	api        *BagsAPI
-	router     *mux.Router
-	userDomain string
+	api               *BagsAPI
+	router            *mux.Router
+	domainMu          sync.RWMutex
+	domains           userDomains
+	autoCreateDefault bool
+	paths             pathChecker
 }
 
-// NewBagsApp creates a new BagsApp instance.
-func NewBagsApp(db *sql.DB, router *mux.Router, userDomain string) *BagsApp {
+// NewBagsApp creates a new BagsApp instance. autoCreateDefault determines
+// whether requests for a user's default bag create one when it doesn't exist
+// and the request doesn't say otherwise. The results of user and bag existence
+// checks are stored in cache, which may be nil to disable caching. If paths is
+// not nil, the paths of items stored in bags are checked against the data store
+// before the bags are saved.
+func NewBagsApp(db *sql.DB, router *mux.Router, userDomain string, autoCreateDefault bool, cache Cache, paths pathChecker) *BagsApp {
 	bagsApp := &BagsApp{
-		api: &BagsAPI{
-			db: db,
-		},
-		router:     router,
-		userDomain: userDomain,
-	}
-	bagsApp.router.HandleFunc("/bags/", bagsApp.Greeting).Methods(http.MethodGet)
-	bagsApp.router.HandleFunc("/bags/{username}", bagsApp.HasBags).Methods(http.MethodHead)
-	bagsApp.router.HandleFunc("/bags/{username}/default", bagsApp.GetDefaultBag).Methods(http.MethodGet)
-	bagsApp.router.HandleFunc("/bags/{username}/default", bagsApp.UpdateDefaultBag).Methods(http.MethodPost)
-	bagsApp.router.HandleFunc("/bags/{username}/default", bagsApp.DeleteDefaultBag).Methods(http.MethodDelete)
-	bagsApp.router.HandleFunc("/bags/{username}", bagsApp.GetBags).Methods(http.MethodGet)
-	bagsApp.router.HandleFunc("/bags/{username}/{bagID}", bagsApp.GetBag).Methods(http.MethodGet)
-	bagsApp.router.HandleFunc("/bags/{username}", bagsApp.AddBag).Methods(http.MethodPut)
-	bagsApp.router.HandleFunc("/bags/{username}/{bagID}", bagsApp.UpdateBag).Methods(http.MethodPost)
-	bagsApp.router.HandleFunc("/bags/{username}/{bagID}", bagsApp.DeleteBag).Methods(http.MethodDelete)
-	bagsApp.router.HandleFunc("/bags/{username}", bagsApp.DeleteAllBags).Methods(http.MethodDelete)
+		api:               NewBagsAPI(db, cache),
+		router:            moduleRouter(router, "bags", "/bags"),
+		domains:           newUserDomains(userDomain, nil),
+		autoCreateDefault: autoCreateDefault,
+		paths:             paths,
+	}
+	bagsApp.router.HandleFunc("/", bagsApp.Greeting).Methods(http.MethodGet)
+	bagsApp.router.HandleFunc("/{username}", bagsApp.HasBags).Methods(http.MethodHead)
+	bagsApp.router.HandleFunc("/{username}/default", bagsApp.GetDefaultBag).Methods(http.MethodGet)
+	bagsApp.router.HandleFunc("/{username}/default", bagsApp.UpdateDefaultBag).Methods(http.MethodPost)
+	bagsApp.router.HandleFunc("/{username}/default", bagsApp.DeleteDefaultBag).Methods(http.MethodDelete)
+	bagsApp.router.HandleFunc("/{username}", bagsApp.GetBags).Methods(http.MethodGet)
+	bagsApp.router.HandleFunc("/{username}/{bagID}", bagsApp.GetBag).Methods(http.MethodGet)
+	bagsApp.router.HandleFunc("/{username}", bagsApp.AddBag).Methods(http.MethodPut)
+	bagsApp.router.HandleFunc("/{username}/import", bagsApp.ImportBag).Methods(http.MethodPost)
+	bagsApp.router.HandleFunc("/{username}/{bagID}", bagsApp.UpdateBag).Methods(http.MethodPost)
+	bagsApp.router.HandleFunc("/{username}/{bagID}/diff", bagsApp.DiffBag).Methods(http.MethodPost)
+	bagsApp.router.HandleFunc("/{username}/{bagID}", bagsApp.DeleteBag).Methods(http.MethodDelete)
+	bagsApp.router.HandleFunc("/{username}", bagsApp.DeleteAllBags).Methods(http.MethodDelete)
 	return bagsApp
 }
 
+// SetUserDomains changes the domain appended to usernames and the other
+// domains that usernames may keep.
+func (b *BagsApp) SetUserDomains(userDomain string, accepted []string) {
+	b.domainMu.Lock()
+	defer b.domainMu.Unlock()
+	b.domains = newUserDomains(userDomain, accepted)
+}
+
 // AddUsernameSuffix appends the user domain string to the
-// username if it's not already there.
-func (b *BagsApp) AddUsernameSuffix(username string) string {
+// username if it's not already there. Usernames in any of the
+// accepted domains keep their domain. The user domain may be
+// overridden for the request the context belongs to.
+func (b *BagsApp) AddUsernameSuffix(ctx context.Context, username string) string {
+	b.domainMu.RLock()
+	defer b.domainMu.RUnlock()
+
+	return b.domains.forContext(ctx).bagsUsername(username)
+}
+
+// addUserDomain replaces any domain in the username with userDomain.
+func addUserDomain(username, userDomain string) string {
 	re, _ := regexp.Compile(`@.*$`)
-	return fmt.Sprintf("%s@%s", re.ReplaceAllString(username, ""), strings.Trim(b.userDomain, "@"))
+	return fmt.Sprintf("%s@%s", re.ReplaceAllString(username, ""), strings.Trim(userDomain, "@"))
+}
+
+// checkItemPaths makes sure that the paths of the items in the bag contents in
+// body exist in the data store. If they don't, or they can't be checked, an error
+// response is written and false is returned. A report listing each path is sent
+// when any path is missing.
+func (b *BagsApp) checkItemPaths(ctx context.Context, writer http.ResponseWriter, username string, body []byte) bool {
+	var contents BagContents
+
+	if b.paths == nil {
+		return true
+	}
+
+	if err := json.Unmarshal(body, &contents); err != nil {
+		httpapi.BadRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		return false
+	}
+
+	report, valid, err := validateBagContents(ctx, b.paths, username, contents)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error validating bag items for %s: %s", username, err))
+		return false
+	}
+
+	if valid {
+		return true
+	}
+
+	httpapi.WriteProblem(writer, http.StatusBadRequest, httpapi.CodeInvalidBagItems, "some bag items are not valid paths", map[string]interface{}{
+		"items": report,
+	})
+	return false
 }
 
 // Greeting prints out a greeting for the bags endpoints.
@@ -58,6 +123,26 @@ func (b *BagsApp) Greeting(writer http.ResponseWriter, request *http.Request) {
 	fmt.Fprintf(writer, "Hello from the bags handler")
 }
 
+// nonUserError is returned by getUser for users that don't exist.
+type nonUserError struct {
+	username string
+}
+
+func (e *nonUserError) Error() string {
+	return fmt.Sprintf("user %s does not exist", e.username)
+}
+
+// userError responds to an error returned by getUser.
+func userError(writer http.ResponseWriter, err error, status int) {
+	var nonUser *nonUserError
+	if errors.As(err, &nonUser) {
+		httpapi.UserNotFound(writer, nonUser.username)
+		return
+	}
+	httpapi.Error(writer, err.Error(), status)
+	log.Error(err)
+}
+
 func (b *BagsApp) getUser(ctx context.Context, vars map[string]string) (string, int, error) {
 	var (
 		username       string
@@ -68,49 +153,71 @@ func (b *BagsApp) getUser(ctx context.Context, vars map[string]string) (string,
 		return "", http.StatusBadRequest, errors.New("missing username in the URL")
 	}
 
-	username = b.AddUsernameSuffix(username)
+	username = b.AddUsernameSuffix(ctx, username)
 
-	if userExists, err = queries.IsUser(ctx, b.api.db, username); err != nil {
+	if userExists, err = cachedIsUser(ctx, b.api.cache, b.api.stmts, username); err != nil {
 		return "", http.StatusInternalServerError, fmt.Errorf("error checking for bags %s: %s", username, err)
 	}
 
 	if !userExists {
-		return "", http.StatusNotFound, fmt.Errorf("user %s does not exist", username)
+		return "", http.StatusNotFound, &nonUserError{username: vars["username"]}
 	}
 
 	return username, http.StatusOK, nil
 }
 
-// GetBags returns a listing of the bags for the user.
+// GetBags returns a listing of the bags for the user. The bags are streamed to the
+// client as they're read from the database rather than being collected first. If an
+// error occurs after the listing has started, the response is cut short, leaving
+// invalid JSON for the client to detect.
 func (b *BagsApp) GetBags(writer http.ResponseWriter, request *http.Request) {
 	var (
 		username string
-		bags     []BagRecord
 		err      error
 		status   int
+		started  bool
 		vars     = mux.Vars(request)
 		ctx      = request.Context()
+		encoder  = json.NewEncoder(writer)
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
 		return
 	}
 
-	if bags, err = b.api.GetBags(ctx, username); err != nil {
-		http.Error(writer, fmt.Sprintf("error getting bags for %s: %s", username, err), http.StatusInternalServerError)
-		return
+	writeElement := func(record BagRecord) error {
+		separator := ","
+		if !started {
+			writer.Header().Set("Content-Type", "application/json")
+			separator = `{"bags":[`
+			started = true
+		}
+		if _, err := io.WriteString(writer, separator); err != nil {
+			return err
+		}
+		return encoder.Encode(record)
 	}
 
-	jsonBytes, err := json.Marshal(map[string][]BagRecord{"bags": bags})
-	if err != nil {
-		http.Error(writer, fmt.Sprintf("error JSON encoding result for %s: %s", username, err), http.StatusInternalServerError)
+	if err = b.api.EachBag(ctx, username, writeElement); err != nil {
+		if !started {
+			httpapi.Error(writer, fmt.Sprintf("error getting bags for %s: %s", username, err), http.StatusInternalServerError)
+			return
+		}
+		log.WithContext(ctx).Errorf("error streaming bags for %s: %s", username, err)
 		return
 	}
 
-	writer.Header().Set("Content-Type", "application/json")
-	if _, err = writer.Write(jsonBytes); err != nil {
-		log.Error(err)
+	if !started {
+		writer.Header().Set("Content-Type", "application/json")
+		if _, err = io.WriteString(writer, `{"bags":[`); err != nil {
+			log.WithContext(ctx).Error(err)
+			return
+		}
+	}
+
+	if _, err = io.WriteString(writer, "]}"); err != nil {
+		log.WithContext(ctx).Error(err)
 	}
 }
 
@@ -123,83 +230,102 @@ func (b *BagsApp) GetBag(writer http.ResponseWriter, request *http.Request) {
 		ok              bool
 		status          int
 		vars            = mux.Vars(request)
-		jsonBytes       []byte
 		ctx             = request.Context()
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
 	}
 
 	if bagID, ok = vars["bagID"]; !ok {
-		badRequest(writer, "missing bagID in the URL")
+		httpapi.BadRequest(writer, "missing bagID in the URL")
 		return
 	}
 
 	if ok, err = b.api.HasBag(ctx, username, bagID); err != nil {
-		badRequest(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
 		return
 	}
 
 	if !ok {
-		http.Error(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username), http.StatusNotFound)
+		httpapi.NotFound(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username))
 		return
 	}
 
 	if bag, err = b.api.GetBag(ctx, username, bagID); err != nil {
-		http.Error(writer, fmt.Sprintf("error getting bags for %s: %s", username, err), http.StatusInternalServerError)
-		return
-	}
-
-	if jsonBytes, err = json.Marshal(bag); err != nil {
-		http.Error(writer, fmt.Sprintf("error JSON encoding result for %s: %s", username, err), http.StatusInternalServerError)
+		httpapi.Error(writer, fmt.Sprintf("error getting bags for %s: %s", username, err), http.StatusInternalServerError)
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
-	if _, err = writer.Write(jsonBytes); err != nil {
-		log.Error(err)
+	if err = json.NewEncoder(writer).Encode(bag); err != nil {
+		log.WithContext(ctx).Error(err)
 	}
 }
 
-// GetDefaultBag will return the default bag for the user, creating a new one and setting it as the default if no default is
-// already set.
+// GetDefaultBag will return the default bag for the user. If no default is set, a new one is created and set as
+// the default unless the "create" query parameter is false (or auto-creation is disabled and the parameter isn't
+// true), in which case a 404 is returned.
 func (b *BagsApp) GetDefaultBag(writer http.ResponseWriter, request *http.Request) {
 	var (
 		username  string
 		bag       BagRecord
 		err       error
 		status    int
+		create    = b.autoCreateDefault
 		jsonBytes []byte
 		vars      = mux.Vars(request)
 		ctx       = request.Context()
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
+	}
+
+	if createParam := request.URL.Query().Get("create"); createParam != "" {
+		if create, err = strconv.ParseBool(createParam); err != nil {
+			httpapi.BadRequest(writer, fmt.Sprintf("invalid value for create: %s", createParam))
+			return
+		}
+	}
+
+	if create {
+		bag, err = b.api.GetDefaultBag(ctx, username)
+	} else {
+		bag, err = b.api.FindDefaultBag(ctx, username)
+	}
+
+	if errors.Is(err, ErrNoDefaultBag) {
+		httpapi.NotFound(writer, fmt.Sprintf("default bag not found for user %s", username))
+		return
 	}
 
-	if bag, err = b.api.GetDefaultBag(ctx, username); err != nil {
-		http.Error(writer, fmt.Sprintf("error getting default bag for %s: %s", username, err), http.StatusInternalServerError)
+	if err != nil {
+		httpapi.Error(writer, fmt.Sprintf("error getting default bag for %s: %s", username, err), http.StatusInternalServerError)
 		return
 	}
 
 	if jsonBytes, err = json.Marshal(bag); err != nil {
-		http.Error(writer, fmt.Sprintf("error JSON encoding result for %s: %s", username, err), http.StatusInternalServerError)
+		httpapi.Error(writer, fmt.Sprintf("error JSON encoding result for %s: %s", username, err), http.StatusInternalServerError)
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(jsonBytes); err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 	}
 }
 
-// AddBag adds an additional bag to the list for the user.
+// AddBag adds an additional bag to the list for the user. If the body contains an
+// "expires_at" field, it's removed from the stored contents and used as the time at
+// which the bag expires.
 func (b *BagsApp) AddBag(writer http.ResponseWriter, request *http.Request) {
 	var (
 		username, bagID string
 		bag             BagRecord
+		contents        BagContents
 		err             error
 		body            []byte
 		retval          []byte
@@ -209,32 +335,59 @@ func (b *BagsApp) AddBag(writer http.ResponseWriter, request *http.Request) {
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
 	}
 
 	if body, err = io.ReadAll(request.Body); err != nil {
-		errored(writer, fmt.Sprintf("error reading body: %s", err))
+		httpapi.ReadBodyError(writer, err)
+		return
+	}
+
+	if _, ok := httpapi.ReadObject(writer, body); !ok {
 		return
 	}
 
 	if err = json.Unmarshal(body, &bag); err != nil {
-		badRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		httpapi.BadRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
 		return
 	}
 
-	if bagID, err = b.api.AddBag(ctx, username, string(body)); err != nil {
-		errored(writer, fmt.Sprintf("failed to add bag for %s: %s", username, err))
+	if bag.ExpiresAt != nil {
+		if !bag.ExpiresAt.After(time.Now()) {
+			httpapi.BadRequest(writer, fmt.Sprintf("expires_at must be in the future: %s", bag.ExpiresAt.Format(time.RFC3339)))
+			return
+		}
+
+		if err = json.Unmarshal(body, &contents); err != nil {
+			httpapi.BadRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+			return
+		}
+		delete(contents, "expires_at")
+
+		if body, err = json.Marshal(contents); err != nil {
+			httpapi.Errored(writer, fmt.Sprintf("failed to JSON encode bag contents: %s", err))
+			return
+		}
+	}
+
+	if !b.checkItemPaths(ctx, writer, username, body) {
+		return
+	}
+
+	if bagID, err = b.api.AddBag(ctx, username, string(body), bag.ExpiresAt); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("failed to add bag for %s: %s", username, err))
 		return
 	}
 
 	if retval, err = json.Marshal(map[string]string{"id": bagID}); err != nil {
-		errored(writer, fmt.Sprintf("failed to JSON encode response body: %s", err))
+		httpapi.Errored(writer, fmt.Sprintf("failed to JSON encode response body: %s", err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(retval); err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 	}
 }
 
@@ -252,40 +405,242 @@ func (b *BagsApp) UpdateBag(writer http.ResponseWriter, request *http.Request) {
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
 	}
 
 	if bagID, ok = vars["bagID"]; !ok {
-		badRequest(writer, "missing bagID in the URL")
+		httpapi.BadRequest(writer, "missing bagID in the URL")
 		return
 	}
 
 	if ok, err = b.api.HasBag(ctx, username, bagID); err != nil {
-		badRequest(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
 		return
 	}
 
 	if !ok {
-		http.Error(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username), http.StatusNotFound)
+		httpapi.NotFound(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username))
 		return
 	}
 
 	if body, err = io.ReadAll(request.Body); err != nil {
-		errored(writer, fmt.Sprintf("error reading body: %s", err))
+		httpapi.ReadBodyError(writer, err)
+		return
+	}
+
+	if _, ok := httpapi.ReadObject(writer, body); !ok {
 		return
 	}
 
 	if err = json.Unmarshal(body, &bag); err != nil {
-		errored(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		httpapi.BadRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		return
+	}
+
+	if !b.checkItemPaths(ctx, writer, username, body) {
 		return
 	}
 
 	if err = b.api.UpdateBag(ctx, username, bagID, string(body)); err != nil {
-		errored(writer, fmt.Sprintf("error updating bag for user %s: %s", username, err))
+		writeFailed(writer, err, fmt.Sprintf("error updating bag for user %s: %s", username, err))
 		return
 	}
 }
 
+// BagDiffEntry describes a value that was added to or removed from a bag's
+// contents. Field is the top-level key in the contents. Key identifies the item
+// within a list-valued field and is empty when the entire field was added or
+// removed.
+type BagDiffEntry struct {
+	Field string      `json:"field"`
+	Key   string      `json:"key,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// BagItemChange describes a value that is present in both the stored and the
+// candidate contents of a bag, but differs between them. Key is empty when the
+// change applies to a whole top-level field rather than an item in a list.
+type BagItemChange struct {
+	Field  string      `json:"field"`
+	Key    string      `json:"key,omitempty"`
+	Stored interface{} `json:"stored"`
+	New    interface{} `json:"new"`
+}
+
+// BagDiff describes how a set of candidate bag contents differs from the
+// contents currently stored for the bag. All three lists are ordered by field
+// name, then by the position of the value within that field: the candidate's
+// order for Added and Changed, and the stored order for Removed.
+type BagDiff struct {
+	Added   []BagDiffEntry  `json:"added"`
+	Removed []BagDiffEntry  `json:"removed"`
+	Changed []BagItemChange `json:"changed"`
+}
+
+// bagItemKey returns the key used to match up an item between two versions of
+// a list in a bag's contents. Items are matched by their "id" field, falling
+// back to their "path" field, and finally to their JSON encoding. The key is
+// prefixed with its source so that values from different sources never match.
+func bagItemKey(item interface{}) string {
+	if m, ok := item.(map[string]interface{}); ok {
+		for _, field := range []string{"id", "path"} {
+			if key, ok := m[field].(string); ok && key != "" {
+				return fmt.Sprintf("%s:%s", field, key)
+			}
+		}
+	}
+	encoded, _ := json.Marshal(item)
+	return fmt.Sprintf("json:%s", encoded)
+}
+
+// diffBagItems compares two versions of a list-valued field in a bag's
+// contents. Items sharing a key are paired up in the order they appear, so
+// duplicated items are reported individually rather than collapsed.
+func diffBagItems(diff *BagDiff, field string, stored, candidate []interface{}) {
+	storedIndexes := make(map[string][]int)
+	for i, item := range stored {
+		key := bagItemKey(item)
+		storedIndexes[key] = append(storedIndexes[key], i)
+	}
+
+	matched := make([]bool, len(stored))
+	for _, item := range candidate {
+		key := bagItemKey(item)
+		indexes := storedIndexes[key]
+		if len(indexes) == 0 {
+			diff.Added = append(diff.Added, BagDiffEntry{Field: field, Key: key, Value: item})
+			continue
+		}
+
+		storedIndexes[key] = indexes[1:]
+		matched[indexes[0]] = true
+		if !reflect.DeepEqual(stored[indexes[0]], item) {
+			diff.Changed = append(diff.Changed, BagItemChange{
+				Field:  field,
+				Key:    key,
+				Stored: stored[indexes[0]],
+				New:    item,
+			})
+		}
+	}
+
+	for i, item := range stored {
+		if !matched[i] {
+			diff.Removed = append(diff.Removed, BagDiffEntry{Field: field, Key: bagItemKey(item), Value: item})
+		}
+	}
+}
+
+// diffBagContents compares the candidate contents against the stored contents.
+// Every top-level field is compared; fields holding a list in both versions are
+// compared item by item.
+func diffBagContents(stored, candidate BagContents) BagDiff {
+	diff := BagDiff{
+		Added:   []BagDiffEntry{},
+		Removed: []BagDiffEntry{},
+		Changed: []BagItemChange{},
+	}
+
+	fields := []string{}
+	for field := range stored {
+		fields = append(fields, field)
+	}
+	for field := range candidate {
+		if _, ok := stored[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		storedValue, inStored := stored[field]
+		candidateValue, inCandidate := candidate[field]
+
+		switch {
+		case !inStored:
+			diff.Added = append(diff.Added, BagDiffEntry{Field: field, Value: candidateValue})
+		case !inCandidate:
+			diff.Removed = append(diff.Removed, BagDiffEntry{Field: field, Value: storedValue})
+		default:
+			storedList, storedIsList := storedValue.([]interface{})
+			candidateList, candidateIsList := candidateValue.([]interface{})
+			if storedIsList && candidateIsList {
+				diffBagItems(&diff, field, storedList, candidateList)
+			} else if !reflect.DeepEqual(storedValue, candidateValue) {
+				diff.Changed = append(diff.Changed, BagItemChange{
+					Field:  field,
+					Stored: storedValue,
+					New:    candidateValue,
+				})
+			}
+		}
+	}
+
+	return diff
+}
+
+// DiffBag compares the contents in the request body against the stored contents
+// of the indicated bag without modifying anything.
+func (b *BagsApp) DiffBag(writer http.ResponseWriter, request *http.Request) {
+	var (
+		username, bagID string
+		bag             BagRecord
+		candidate       BagContents
+		err             error
+		ok              bool
+		body            []byte
+		retval          []byte
+		status          int
+		vars            = mux.Vars(request)
+		ctx             = request.Context()
+	)
+
+	if username, status, err = b.getUser(ctx, vars); err != nil {
+		userError(writer, err, status)
+		return
+	}
+
+	if bagID, ok = vars["bagID"]; !ok {
+		httpapi.BadRequest(writer, "missing bagID in the URL")
+		return
+	}
+
+	if ok, err = b.api.HasBag(ctx, username, bagID); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
+		return
+	}
+
+	if !ok {
+		httpapi.NotFound(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username))
+		return
+	}
+
+	if body, err = io.ReadAll(request.Body); err != nil {
+		httpapi.ReadBodyError(writer, err)
+		return
+	}
+
+	if candidate, ok = httpapi.ReadObject(writer, body); !ok {
+		return
+	}
+
+	if bag, err = b.api.GetBag(ctx, username, bagID); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting bag %s for %s: %s", bagID, username, err))
+		return
+	}
+
+	if retval, err = json.Marshal(diffBagContents(bag.Contents, candidate)); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("failed to JSON encode response body: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err = writer.Write(retval); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
 // UpdateDefaultBag sets new contents for the user's default bag.
 func (b *BagsApp) UpdateDefaultBag(writer http.ResponseWriter, request *http.Request) {
 	var (
@@ -300,37 +655,46 @@ func (b *BagsApp) UpdateDefaultBag(writer http.ResponseWriter, request *http.Req
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
 	}
 
 	if body, err = io.ReadAll(request.Body); err != nil {
-		errored(writer, fmt.Sprintf("error reading body: %s", err))
+		httpapi.ReadBodyError(writer, err)
+		return
+	}
+
+	if _, ok := httpapi.ReadObject(writer, body); !ok {
 		return
 	}
 
 	if err = json.Unmarshal(body, &bag); err != nil {
-		errored(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		httpapi.BadRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		return
+	}
+
+	if !b.checkItemPaths(ctx, writer, username, body) {
 		return
 	}
 
 	if err = b.api.UpdateDefaultBag(ctx, username, string(body)); err != nil {
-		errored(writer, fmt.Sprintf("error updating default bag for user %s: %s", username, err))
+		writeFailed(writer, err, fmt.Sprintf("error updating default bag for user %s: %s", username, err))
 		return
 	}
 
 	if newBag, err = b.api.GetDefaultBag(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
 		return
 	}
 
 	if retval, err = json.Marshal(newBag); err != nil {
-		errored(writer, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(retval); err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 	}
 }
 
@@ -346,16 +710,27 @@ func (b *BagsApp) DeleteBag(writer http.ResponseWriter, request *http.Request) {
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
 	}
 
 	if bagID, ok = vars["bagID"]; !ok {
-		badRequest(writer, "missing bagID in the URL")
+		httpapi.BadRequest(writer, "missing bagID in the URL")
+		return
+	}
+
+	if ok, err = b.api.HasBag(ctx, username, bagID); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
+		return
+	}
+
+	if !ok {
+		httpapi.NotFound(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username))
 		return
 	}
 
 	if err = b.api.DeleteBag(ctx, username, bagID); err != nil {
-		errored(writer, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
+		writeFailed(writer, err, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
 		return
 	}
 }
@@ -373,72 +748,100 @@ func (b *BagsApp) DeleteDefaultBag(writer http.ResponseWriter, request *http.Req
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
 	}
 
 	if err = b.api.DeleteDefaultBag(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error deleting default bag for user %s: %s", username, err))
+		writeFailed(writer, err, fmt.Sprintf("error deleting default bag for user %s: %s", username, err))
 		return
 	}
 
 	if newBag, err = b.api.GetDefaultBag(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
 		return
 	}
 
 	if retval, err = json.Marshal(newBag); err != nil {
-		errored(writer, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(retval); err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 	}
 
 }
 
-// DeleteAllBags deletes all bags for a user
+// DeleteAllBags deletes all bags for a user. Returns a 404 if the user has no
+// bags.
 func (b *BagsApp) DeleteAllBags(writer http.ResponseWriter, request *http.Request) {
 	var (
 		username string
 		err      error
+		count    int64
 		status   int
 		vars     = mux.Vars(request)
 		ctx      = request.Context()
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
+	}
+
+	if count, err = b.api.CountBags(ctx, username); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error looking for bags for %s: %s", username, err))
+		return
+	}
+
+	if count == 0 {
+		httpapi.NotFound(writer, fmt.Sprintf("no bags found for user %s", username))
+		return
 	}
 
 	if err = b.api.DeleteAllBags(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
+		writeFailed(writer, err, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
 		return
 	}
 }
 
-// HasBags returns true if the user has at least a single bag in the database.
+// HasBags returns true if the user has at least a single bag in the database. The
+// number of bags is returned in the X-Total-Count header, and the ID of the user's
+// default bag, if there is one, is returned in the X-Default-Bag-ID header.
 func (b *BagsApp) HasBags(writer http.ResponseWriter, request *http.Request) {
 	var (
-		username string
-		err      error
-		hasBags  bool
-		status   int
-		vars     = mux.Vars(request)
-		ctx      = request.Context()
+		username     string
+		err          error
+		count        int64
+		defaultBagID string
+		status       int
+		vars         = mux.Vars(request)
+		ctx          = request.Context()
 	)
 
 	if username, status, err = b.getUser(ctx, vars); err != nil {
-		http.Error(writer, err.Error(), status)
+		userError(writer, err, status)
+		return
 	}
 
-	if hasBags, err = b.api.HasBags(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error looking for bags for %s: %s", username, err))
+	if count, err = b.api.CountBags(ctx, username); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error looking for bags for %s: %s", username, err))
 		return
 	}
 
-	if !hasBags {
+	if defaultBagID, err = b.api.DefaultBagID(ctx, username); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error looking for the default bag for %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set(httpapi.TotalCountHeader, strconv.FormatInt(count, 10))
+	if defaultBagID != "" {
+		writer.Header().Set("X-Default-Bag-ID", defaultBagID)
+	}
+
+	if count == 0 {
 		writer.WriteHeader(http.StatusNotFound)
 	} else {
 		writer.WriteHeader(http.StatusOK)
@@ -7,22 +7,66 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/cyverse-de/queries"
 )
 
+// ErrNoDefaultBag is returned when a user doesn't have a default bag and one
+// wasn't created on their behalf.
+var ErrNoDefaultBag = errors.New("no default bag")
+
 // BagsAPI provides an API for interacting with bags.
 type BagsAPI struct {
-	db *sql.DB
+	mutationNotifier
+
+	db    *retryingDB
+	stmts *stmtCache
+
+	// Caches the results of the existence checks. Any write through the
+	// BagsAPI invalidates the entries for the affected user.
+	cache Cache
+}
+
+// NewBagsAPI returns a new *BagsAPI. The results of the existence checks are
+// stored in cache, which may be nil to disable caching.
+func NewBagsAPI(db *sql.DB, cache Cache) *BagsAPI {
+	return &BagsAPI{
+		db:    withRetries(db),
+		stmts: newStmtCache(withRetries(db)),
+		cache: cache,
+	}
+}
+
+func bagCountKey(username string) string {
+	return cacheKey("bags", "count", username)
+}
+
+func hasDefaultBagKey(username string) string {
+	return cacheKey("bags", "has-default", username)
+}
+
+// invalidate clears the cached existence checks for the user.
+func (b *BagsAPI) invalidate(ctx context.Context, username string) {
+	cacheInvalidate(ctx, b.cache, bagCountKey(username), hasDefaultBagKey(username))
 }
 
 // BagRecord represents a bag as stored in the database.
 type BagRecord struct {
-	ID       string      `json:"id"`
-	Contents BagContents `json:"contents"`
-	UserID   string      `json:"user_id"`
+	ID        string      `json:"id"`
+	Contents  BagContents `json:"contents"`
+	UserID    string      `json:"user_id"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
 }
 
+// notExpired is the condition used to hide expired bags from queries against
+// the bags table aliased as b.
+const notExpired = `(b.expires_at IS NULL OR b.expires_at > now())`
+
+// bagColumns are the columns scanned into a BagRecord from the bags table
+// aliased as b.
+var bagColumns = []string{"b.id", "b.contents", "b.user_id", "b.expires_at"}
+
 // BagContents represents a bag's contents stored in the database.
 type BagContents map[string]interface{}
 
@@ -42,94 +86,127 @@ func (b *BagContents) Scan(value interface{}) error {
 
 // HasBags returns true if the user has bags and false otherwise.
 func (b *BagsAPI) HasBags(ctx context.Context, username string) (bool, error) {
-	query := `SELECT count(*)
-				FROM bags b,
-					 users u
-			   WHERE b.user_id = u.id
-				 AND u.username = $1`
-	var count int64
-	if err := b.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
-		return false, fmt.Errorf("error checking if %s has any bags: %w", username, err)
+	count, err := b.CountBags(ctx, username)
+	if err != nil {
+		return false, err
 	}
 	return count > 0, nil
 }
 
+// CountBags returns the number of bags the user has.
+func (b *BagsAPI) CountBags(ctx context.Context, username string) (int64, error) {
+	if count, ok := cacheGet[int64](ctx, b.cache, bagCountKey(username)); ok {
+		return count, nil
+	}
+
+	query, args := userRows("bags", "b", username, "count(*)").Where(notExpired).SQL()
+	var count int64
+	if err := b.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error checking if %s has any bags: %w", username, dbError(err))
+	}
+	cacheSet(ctx, b.cache, bagCountKey(username), count)
+	return count, nil
+}
+
+// DefaultBagID returns the ID of the user's default bag, or an empty string if the
+// user doesn't have a default bag.
+func (b *BagsAPI) DefaultBagID(ctx context.Context, username string) (string, error) {
+	query, args := selectFrom("default_bags d", "d.bag_id").
+		Join("users u", "d.user_id = u.id").
+		Where("u.username = ?", username).
+		SQL()
+	var bagID string
+	err := b.db.QueryRowContext(ctx, query, args...).Scan(&bagID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error getting the default bag ID for %s: %w", username, err)
+	}
+	return bagID, nil
+}
+
 // HasDefaultBag returns true if the user has a default bag.
 func (b *BagsAPI) HasDefaultBag(ctx context.Context, username string) (bool, error) {
-	query := `SELECT count(*)
-				FROM default_bags d,
-					 users u
-			   WHERE d.user_id = u.id
-				 AND u.username = $1`
+	if hasDefault, ok := cacheGet[bool](ctx, b.cache, hasDefaultBagKey(username)); ok {
+		return hasDefault, nil
+	}
+
+	query, args := userRows("default_bags", "d", username, "count(*)").SQL()
 	var count int64
-	if err := b.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
-		return false, fmt.Errorf("error checking if %s has a default bag: %w", username, err)
+	if err := b.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("error checking if %s has a default bag: %w", username, dbError(err))
 	}
+	cacheSet(ctx, b.cache, hasDefaultBagKey(username), count > 0)
 	return count > 0, nil
-
 }
 
 // HasBag returns true if the specified bag exists in the database.
 func (b *BagsAPI) HasBag(ctx context.Context, username, bagID string) (bool, error) {
-	query := `SELECT count(*)
-				FROM bags b,
-					 users u
-			   WHERE b.user_id = u.id
-				 AND u.username = $1
-				 AND b.id = $2`
+	query, args := userRows("bags", "b", username, "count(*)").
+		Where("b.id = ?", bagID).
+		Where(notExpired).
+		SQL()
 	var count int64
-	if err := b.db.QueryRowContext(ctx, query, username, bagID).Scan(&count); err != nil {
-		return false, fmt.Errorf("error checking for bag %s for %s: %w", bagID, username, err)
+	if err := b.stmts.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("error checking for bag %s for %s: %w", bagID, username, dbError(err))
 	}
 	return count > 0, nil
 }
 
 // GetBags returns all of the bags for the provided user.
 func (b *BagsAPI) GetBags(ctx context.Context, username string) ([]BagRecord, error) {
-	query := `SELECT b.id,
-					 b.contents,
-					 b.user_id
-				FROM bags b,
-					 users u
-			   WHERE b.user_id = u.id
-				 AND u.username = $1`
-
-	rows, err := b.db.QueryContext(ctx, query, username)
+	bagList := []BagRecord{}
+	err := b.EachBag(ctx, username, func(record BagRecord) error {
+		bagList = append(bagList, record)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error getting all bags for %s: %w", username, err)
+		return nil, err
 	}
+	return bagList, nil
+}
+
+// EachBag calls fn with each of the bags for the provided user as they're read from
+// the database, without holding the full list of bags in memory. Iteration stops at
+// the first error returned by fn.
+func (b *BagsAPI) EachBag(ctx context.Context, username string, fn func(BagRecord) error) error {
+	query, args := userRows("bags", "b", username, bagColumns...).Where(notExpired).SQL()
+
+	rows, err := b.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("error getting all bags for %s: %w", username, dbError(err))
+	}
+	defer rows.Close()
 
-	bagList := []BagRecord{}
 	for rows.Next() {
 		record := BagRecord{}
-		err = rows.Scan(&record.ID, &record.Contents, &record.UserID)
+		err = rows.Scan(&record.ID, &record.Contents, &record.UserID, &record.ExpiresAt)
 		if err != nil {
-			return nil, fmt.Errorf("error scanning record while getting bags for %s: %w", username, err)
+			return fmt.Errorf("error scanning record while getting bags for %s: %w", username, err)
 		}
 
-		bagList = append(bagList, record)
+		if err = fn(record); err != nil {
+			return err
+		}
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error from rows object while getting bags for %s: %w", username, err)
+		return fmt.Errorf("error from rows object while getting bags for %s: %w", username, dbError(err))
 	}
-	return bagList, nil
+	return nil
 }
 
 // GetBag returns the specified bag for the specified user according to the specified specifier for the
 // bag record.
 func (b *BagsAPI) GetBag(ctx context.Context, username, bagID string) (BagRecord, error) {
-	query := `SELECT b.id,
-					 b.contents,
-					 b.user_id
-				FROM bags b,
-					 users u
-			   WHERE b.user_id = u.id
-				 AND u.username = $2
-				 AND b.id = $1`
+	query, args := userRows("bags", "b", username, bagColumns...).
+		Where("b.id = ?", bagID).
+		Where(notExpired).
+		SQL()
 	var record BagRecord
-	err := b.db.QueryRowContext(ctx, query, bagID, username).Scan(&record.ID, &record.Contents, &record.UserID)
+	err := b.db.QueryRowContext(ctx, query, args...).Scan(&record.ID, &record.Contents, &record.UserID, &record.ExpiresAt)
 	if err != nil {
-		return record, fmt.Errorf("error getting bag id %s for %s: %w", bagID, username, err)
+		return record, fmt.Errorf("error getting bag id %s for %s: %w", bagID, username, dbError(err))
 	}
 	return record, nil
 
@@ -150,7 +227,7 @@ func (b *BagsAPI) createDefaultBag(ctx context.Context, username string) (BagRec
 		return record, fmt.Errorf("error marshaling default bag: %w", err)
 	}
 
-	if newBagID, err = b.AddBag(ctx, username, string(newContents)); err != nil {
+	if newBagID, err = b.AddBag(ctx, username, string(newContents), nil); err != nil {
 		return record, fmt.Errorf("error adding bag for user %s: %w", username, err)
 	}
 
@@ -169,33 +246,49 @@ func (b *BagsAPI) createDefaultBag(ctx context.Context, username string) (BagRec
 	return record, err
 }
 
-// GetDefaultBag returns the specified bag for the indicated user.
+// GetDefaultBag returns the default bag for the indicated user, creating a new one if the
+// user doesn't have one yet.
 func (b *BagsAPI) GetDefaultBag(ctx context.Context, username string) (BagRecord, error) {
+	record, err := b.FindDefaultBag(ctx, username)
+
+	// if the user doesn't have a default bag, add bag and set it as the default, then return it.
+	if errors.Is(err, ErrNoDefaultBag) {
+		return b.createDefaultBag(ctx, username)
+	}
+
+	return record, err
+}
+
+// FindDefaultBag returns the default bag for the indicated user without creating one.
+// Returns ErrNoDefaultBag if the user doesn't have a default bag or it has expired.
+func (b *BagsAPI) FindDefaultBag(ctx context.Context, username string) (BagRecord, error) {
 	var (
 		err        error
 		hasDefault bool
 		record     BagRecord
 	)
 
-	// if the user doesn't have a default bag, add bag and set it as the default, then return it.
 	if hasDefault, err = b.HasDefaultBag(ctx, username); err != nil {
-		return record, fmt.Errorf("error from HasDefaultBag in GetDefaultBag for %s: %w", username, err)
+		return record, fmt.Errorf("error from HasDefaultBag in FindDefaultBag for %s: %w", username, err)
 	}
 
 	if !hasDefault {
-		return b.createDefaultBag(ctx, username)
+		return record, ErrNoDefaultBag
 	}
 
-	query := `SELECT b.id,
-					 b.contents,
-					 b.user_id
-				FROM bags b
-				JOIN default_bags d ON b.id = d.bag_id
-				JOIN users u ON d.user_id = u.id
-			   WHERE u.username = $1`
+	query, args := selectFrom("bags b", bagColumns...).
+		Join("default_bags d", "b.id = d.bag_id").
+		Join("users u", "d.user_id = u.id").
+		Where("u.username = ?", username).
+		Where(notExpired).
+		SQL()
 
-	if err = b.db.QueryRowContext(ctx, query, username).Scan(&record.ID, &record.Contents, &record.UserID); err != nil {
-		return record, fmt.Errorf("error getting default bag for %s from the database: %w", username, err)
+	err = b.db.QueryRowContext(ctx, query, args...).Scan(&record.ID, &record.Contents, &record.UserID, &record.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, ErrNoDefaultBag
+	}
+	if err != nil {
+		return record, fmt.Errorf("error getting default bag for %s from the database: %w", username, dbError(err))
 	}
 
 	return record, nil
@@ -212,28 +305,35 @@ func (b *BagsAPI) SetDefaultBag(ctx context.Context, username, bagID string) err
 		return fmt.Errorf("error getting user ID for %s while setting default bag: %w", username, err)
 	}
 
+	defer b.invalidate(ctx, username)
+
 	query := `INSERT INTO default_bags VALUES ( $1, $2 ) ON CONFLICT (user_id) DO UPDATE SET bag_id = $2`
 	if _, err = b.db.ExecContext(ctx, query, userID, bagID); err != nil {
-		return fmt.Errorf("error setting the default bag for %s: %w", username, err)
+		return fmt.Errorf("error setting the default bag for %s: %w", username, dbError(err))
 	}
-	return nil
 
+	b.notify(ctx, Mutation{Module: "bags", Action: actionUpdated, Username: username, BagID: bagID})
+	return nil
 }
 
 // AddBag adds (not updates) a new bag for the user. Returns the ID of the new bag record in the database.
-func (b *BagsAPI) AddBag(ctx context.Context, username, contents string) (string, error) {
-	query := `INSERT INTO bags (contents, user_id) VALUES ($1, $2) RETURNING id`
+// The bag never expires if expiresAt is nil.
+func (b *BagsAPI) AddBag(ctx context.Context, username, contents string, expiresAt *time.Time) (string, error) {
+	query := `INSERT INTO bags (contents, user_id, expires_at) VALUES ($1, $2, $3) RETURNING id`
 
 	userID, err := queries.UserID(ctx, b.db, username)
 	if err != nil {
 		return "", fmt.Errorf("error from queries.UserID in AddBag for %s: %w", username, err)
 	}
 
+	defer b.invalidate(ctx, username)
+
 	var bagID string
-	if err = b.db.QueryRowContext(ctx, query, contents, userID).Scan(&bagID); err != nil {
-		return "", fmt.Errorf("error adding bag for %s: %w", username, err)
+	if err = b.db.QueryRowContext(ctx, query, contents, userID, expiresAt).Scan(&bagID); err != nil {
+		return "", fmt.Errorf("error adding bag for %s: %w", username, dbError(err))
 	}
 
+	b.notify(ctx, Mutation{Module: "bags", Action: actionCreated, Username: username, BagID: bagID, After: summarizeDocument(contents)})
 	return bagID, nil
 }
 
@@ -246,10 +346,12 @@ func (b *BagsAPI) UpdateBag(ctx context.Context, username, bagID, contents strin
 		return fmt.Errorf("error from queries.UserID in UpdateBag for %s: %w", username, err)
 	}
 
+	before := b.previous(ctx, bagID, userID)
 	if _, err = b.db.ExecContext(ctx, query, contents, bagID, userID); err != nil {
-		return fmt.Errorf("error updating bag %s for %s: %w", bagID, username, err)
+		return fmt.Errorf("error updating bag %s for %s: %w", bagID, username, dbError(err))
 	}
 
+	b.notify(ctx, Mutation{Module: "bags", Action: actionUpdated, Username: username, BagID: bagID, Before: before, After: summarizeDocument(contents)})
 	return nil
 }
 
@@ -276,13 +378,26 @@ func (b *BagsAPI) DeleteBag(ctx context.Context, username, bagID string) error {
 		return fmt.Errorf("error from queries.UserID in DeleteBag for %s: %w", username, err)
 	}
 
+	defer b.invalidate(ctx, username)
+
+	before := b.previous(ctx, bagID, userID)
 	if _, err = b.db.ExecContext(ctx, query, bagID, userID); err != nil {
-		return fmt.Errorf("error deleting bag %s for %s: %w", bagID, username, err)
+		return fmt.Errorf("error deleting bag %s for %s: %w", bagID, username, dbError(err))
 	}
 
+	b.notify(ctx, Mutation{Module: "bags", Action: actionDeleted, Username: username, BagID: bagID, Before: before})
 	return nil
 }
 
+// previous summarizes the contents of a bag about to be replaced if anything
+// is observing the writes.
+func (b *BagsAPI) previous(ctx context.Context, bagID, userID string) *DocumentSummary {
+	if !b.observed() {
+		return nil
+	}
+	return readSummary(ctx, b.db, `SELECT contents FROM ONLY bags WHERE id = $1 and user_id = $2`, bagID, userID)
+}
+
 // DeleteDefaultBag deletes the default bag for the user. It will get
 // recreated with nothing in it the next time it is retrieved through
 // GetDefaultBag.
@@ -308,9 +423,32 @@ func (b *BagsAPI) DeleteAllBags(ctx context.Context, username string) error {
 		return fmt.Errorf("error from queries.UserID for %s: %w", username, err)
 	}
 
+	defer b.invalidate(ctx, username)
+
 	if _, err = b.db.ExecContext(ctx, query, userID); err != nil {
-		return fmt.Errorf("error deleting all bags for %s: %w", username, err)
+		return fmt.Errorf("error deleting all bags for %s: %w", username, dbError(err))
 	}
 
+	b.notify(ctx, Mutation{Module: "bags", Action: actionDeleted, Username: username})
 	return nil
 }
+
+// PurgeExpiredBags deletes every bag whose expiration time has passed. Returns the
+// number of bags deleted.
+func (b *BagsAPI) PurgeExpiredBags(ctx context.Context) (int64, error) {
+	query := `DELETE FROM ONLY bags WHERE expires_at IS NOT NULL AND expires_at <= now()`
+
+	defer cacheInvalidatePrefix(ctx, b.cache, cacheKey("bags", ""))
+
+	result, err := b.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("error purging expired bags: %w", dbError(err))
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error counting purged bags: %w", err)
+	}
+
+	return count, nil
+}
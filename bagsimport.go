@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxImportMemory is the amount of an uploaded file that's kept in memory while
+// parsing a multipart import request. The rest is spooled to disk.
+const maxImportMemory = 32 << 20
+
+// ImportRowError describes a problem with a single row of an imported file. Rows
+// are numbered starting at 1, not counting the header row of a CSV file.
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// validateImportedItem makes sure that an imported item can be matched up with
+// other items, which requires a non-empty "id" or "path" field.
+func validateImportedItem(item map[string]interface{}) error {
+	for _, field := range []string{"id", "path"} {
+		if value, ok := item[field].(string); ok && value != "" {
+			return nil
+		}
+	}
+	return errors.New("item must have a non-empty id or path")
+}
+
+// parseCSVItems reads bag items from CSV. The first row is a header containing
+// the field names of the items, which must include id or path.
+func parseCSVItems(r io.Reader) ([]interface{}, []ImportRowError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading the CSV header: %w", err)
+	}
+
+	items := []interface{}{}
+	rowErrors := []ImportRowError{}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading CSV row %d: %w", row, err)
+		}
+
+		if len(record) != len(header) {
+			rowErrors = append(rowErrors, ImportRowError{
+				Row:   row,
+				Error: fmt.Sprintf("expected %d fields but found %d", len(header), len(record)),
+			})
+			continue
+		}
+
+		item := make(map[string]interface{})
+		for i, field := range header {
+			item[field] = record[i]
+		}
+
+		if err = validateImportedItem(item); err != nil {
+			rowErrors = append(rowErrors, ImportRowError{Row: row, Error: err.Error()})
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	return items, rowErrors, nil
+}
+
+// parseJSONItems reads bag items from JSON, which may either be a list of items
+// or an object with the list of items in its "items" field.
+func parseJSONItems(r io.Reader) ([]interface{}, []ImportRowError, error) {
+	var (
+		parsed interface{}
+		list   []interface{}
+		ok     bool
+	)
+
+	if err := json.NewDecoder(r).Decode(&parsed); err != nil {
+		return nil, nil, fmt.Errorf("error parsing JSON: %w", err)
+	}
+
+	switch value := parsed.(type) {
+	case []interface{}:
+		list = value
+	case map[string]interface{}:
+		if list, ok = value["items"].([]interface{}); !ok {
+			return nil, nil, errors.New("the JSON object does not contain a list of items")
+		}
+	default:
+		return nil, nil, errors.New("the JSON must be a list of items or an object containing a list of items")
+	}
+
+	items := []interface{}{}
+	rowErrors := []ImportRowError{}
+	for i, element := range list {
+		item, ok := element.(map[string]interface{})
+		if !ok {
+			rowErrors = append(rowErrors, ImportRowError{Row: i + 1, Error: "item must be a JSON object"})
+			continue
+		}
+
+		if err := validateImportedItem(item); err != nil {
+			rowErrors = append(rowErrors, ImportRowError{Row: i + 1, Error: err.Error()})
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	return items, rowErrors, nil
+}
+
+// importFormat determines the format of an uploaded file from the format query
+// parameter, falling back to the file's extension.
+func importFormat(request *http.Request, filename string) (string, error) {
+	format := strings.ToLower(request.URL.Query().Get("format"))
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+
+	switch format {
+	case "csv", "json":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported import format '%s'; use csv or json", format)
+	}
+}
+
+// ImportBag creates a new bag from the items listed in a CSV or JSON file
+// uploaded in the "file" field of a multipart form.
+func (b *BagsApp) ImportBag(writer http.ResponseWriter, request *http.Request) {
+	var (
+		username, bagID string
+		format          string
+		items           []interface{}
+		rowErrors       []ImportRowError
+		contents        []byte
+		retval          []byte
+		err             error
+		status          int
+		vars            = mux.Vars(request)
+		ctx             = request.Context()
+	)
+
+	if username, status, err = b.getUser(ctx, vars); err != nil {
+		userError(writer, err, status)
+		return
+	}
+
+	if err = request.ParseMultipartForm(maxImportMemory); err != nil {
+		if httpapi.RequestTooLarge(writer, err) {
+			return
+		}
+		httpapi.BadRequest(writer, fmt.Sprintf("error parsing multipart form: %s", err))
+		return
+	}
+
+	file, header, err := request.FormFile("file")
+	if err != nil {
+		httpapi.BadRequest(writer, fmt.Sprintf("missing file upload: %s", err))
+		return
+	}
+	defer file.Close()
+
+	if format, err = importFormat(request, header.Filename); err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	if format == "csv" {
+		items, rowErrors, err = parseCSVItems(file)
+	} else {
+		items, rowErrors, err = parseJSONItems(file)
+	}
+	if err != nil {
+		httpapi.BadRequest(writer, fmt.Sprintf("error reading %s: %s", header.Filename, err))
+		return
+	}
+
+	if len(rowErrors) > 0 {
+		httpapi.WriteProblem(writer, http.StatusBadRequest, httpapi.CodeInvalidImportRows, fmt.Sprintf("%s has invalid rows", header.Filename), map[string]interface{}{
+			"errors": rowErrors,
+		})
+		return
+	}
+
+	if contents, err = json.Marshal(BagContents{"items": items}); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("failed to JSON encode bag contents: %s", err))
+		return
+	}
+
+	if !b.checkItemPaths(ctx, writer, username, contents) {
+		return
+	}
+
+	if bagID, err = b.api.AddBag(ctx, username, string(contents), nil); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("failed to add bag for %s: %s", username, err))
+		return
+	}
+
+	if retval, err = json.Marshal(map[string]string{"id": bagID}); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("failed to JSON encode response body: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err = writer.Write(retval); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// The states of a CircuitBreaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitOpenError is returned for database calls that aren't made because the
+// circuit breaker is open.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e circuitOpenError) Error() string {
+	return fmt.Sprintf("the database is unavailable; retry in %s", e.retryAfter)
+}
+
+// CircuitBreaker stops database calls from being made once threshold calls in
+// a row have failed with transient errors or timed out, so that requests fail
+// fast instead of waiting on a database that's down. After the cooldown a
+// single call is let through to probe the database; the breaker closes if it
+// succeeds and opens again if it fails. A CircuitBreaker with a non-positive
+// threshold never opens.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+
+	vars     *expvar.Map
+	trips    *expvar.Int
+	rejected *expvar.Int
+}
+
+// NewCircuitBreaker returns a new *CircuitBreaker that opens after threshold
+// failures in a row and stays open for the cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+		vars:      new(expvar.Map).Init(),
+		trips:     new(expvar.Int),
+		rejected:  new(expvar.Int),
+	}
+
+	b.vars.Set("state", expvar.Func(func() interface{} {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.state
+	}))
+	b.vars.Set("consecutive_failures", expvar.Func(func() interface{} {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.failures
+	}))
+	b.vars.Set("trips", b.trips)
+	b.vars.Set("rejected", b.rejected)
+	return b
+}
+
+// Publish adds the breaker's state and counters to the expvar variables under
+// the name. It panics if the name is already in use, like expvar.Publish.
+func (b *CircuitBreaker) Publish(name string) {
+	expvar.Publish(name, b.vars)
+}
+
+// dbBreaker guards every call made through dbRetrier. main replaces it with
+// one configured from the db.circuit_breaker settings.
+var dbBreaker = NewCircuitBreaker(0, 0)
+
+// circuitBreakerFromConfig returns a *CircuitBreaker configured from the
+// db.circuit_breaker settings.
+func circuitBreakerFromConfig(cfg *viper.Viper) (*CircuitBreaker, error) {
+	if !cfg.GetBool("db.circuit_breaker.enabled") {
+		return NewCircuitBreaker(0, 0), nil
+	}
+
+	cooldown, err := time.ParseDuration(cfg.GetString("db.circuit_breaker.cooldown"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid db.circuit_breaker.cooldown: %w", err)
+	}
+
+	return NewCircuitBreaker(cfg.GetInt("db.circuit_breaker.failure_threshold"), cooldown), nil
+}
+
+// retryAfter returns how long callers should wait before trying again, or zero
+// if calls are being let through.
+func (b *CircuitBreaker) retryAfter(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retryAfterLocked(now)
+}
+
+func (b *CircuitBreaker) retryAfterLocked(now time.Time) time.Duration {
+	switch {
+	case b.state == breakerOpen:
+		if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+			return wait
+		}
+		return 0
+	case b.state == breakerHalfOpen && b.probing:
+		// The probe should finish soon, so callers are told to wait a second.
+		return time.Second
+	default:
+		return 0
+	}
+}
+
+// allow returns nil if a call may be made, or a circuitOpenError if not. Every
+// call that's allowed must be followed by a call to record.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if wait := b.retryAfterLocked(time.Now()); wait > 0 {
+		b.rejected.Add(1)
+		return circuitOpenError{retryAfter: wait}
+	}
+
+	if b.state != breakerClosed {
+		b.state = breakerHalfOpen
+		b.probing = true
+	}
+	return nil
+}
+
+// isBreakerFailure returns whether the error counts toward opening the breaker.
+func isBreakerFailure(err error) bool {
+	return isTransient(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// record records the outcome of a call that was allowed.
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	// Calls canceled by the caller don't say anything about the database.
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if !isBreakerFailure(err) {
+		if b.state != breakerClosed {
+			log.Info("the database circuit breaker is closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.threshold > 0 && (b.state == breakerHalfOpen || b.failures >= b.threshold) {
+		if b.state != breakerOpen {
+			log.Errorf("the database circuit breaker is open for %s after %d failures: %s", b.cooldown, b.failures, err)
+			b.trips.Add(1)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// breakerExempt returns whether the request is served without the database, so
+// it's handled even while the breaker is open.
+func breakerExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/", "/debug/vars", "/openapi.json", "/docs":
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/admin"+pprofPrefix)
+}
+
+// Middleware rejects requests with a 503 and a Retry-After header saying how
+// many seconds to wait while the breaker is open, rather than letting them
+// wait on the database.
+func (b *CircuitBreaker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if breakerExempt(r) {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		if wait := b.retryAfter(time.Now()); wait > 0 {
+			b.rejected.Add(1)
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpapi.Error(writer, "the database is unavailable", http.StatusServiceUnavailable)
+			log.WithContext(r.Context()).Errorf("rejected %s %s while the database circuit breaker is open", r.Method, r.URL.Path)
+			return
+		}
+
+		next.ServeHTTP(writer, r)
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Cache stores encoded values for a limited time. The *DB types use it to cache
+// existence checks and reads, and invalidate the entries for a user whenever
+// they write on that user's behalf. A Cache with a non-positive TTL holds
+// nothing.
+type Cache interface {
+	// Get returns the value stored under key and whether it was found.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+
+	// Set stores value under key.
+	Set(ctx context.Context, key string, value []byte) error
+
+	// Delete removes the entries for the keys.
+	Delete(ctx context.Context, keys ...string) error
+
+	// DeletePrefix removes every entry whose key starts with prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// SetTTL changes how long new entries live.
+	SetTTL(ttl time.Duration)
+}
+
+// cacheFromConfig returns the Cache described by the cache.* settings.
+// cache.type is "memory" (the default), "redis", or "none".
+func cacheFromConfig(cfg *viper.Viper, ttl time.Duration) (Cache, error) {
+	switch cfg.GetString("cache.type") {
+	case "", "memory":
+		return newMemoryCache(ttl), nil
+	case "redis":
+		addr := cfg.GetString("cache.redis.addr")
+		if addr == "" {
+			return nil, fmt.Errorf("cache.redis.addr must be set to use the redis cache")
+		}
+		client := redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: cfg.GetString("cache.redis.password"),
+			DB:       cfg.GetInt("cache.redis.db"),
+		})
+		return newRedisCache(client, cfg.GetString("cache.redis.namespace"), ttl), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown cache.type: %s", cfg.GetString("cache.type"))
+	}
+}
+
+// cacheKey joins the parts of a cache key, e.g. cacheKey("bags", "count", username).
+func cacheKey(parts ...string) string {
+	return strings.Join(parts, ":")
+}
+
+// userExistsKey is the key for cached user existence checks, which are shared
+// by all of the *DB types.
+func userExistsKey(username string) string {
+	return cacheKey("users", "exists", username)
+}
+
+// cachedIsUser returns whether the user exists. Only positive answers are
+// cached, so users created after a miss are found right away.
+func cachedIsUser(ctx context.Context, c Cache, db queries.DBAccessor, username string) (bool, error) {
+	if _, ok := cacheGet[bool](ctx, c, userExistsKey(username)); ok {
+		return true, nil
+	}
+
+	exists, err := queries.IsUser(ctx, db, username)
+	if err == nil && exists {
+		cacheSet(ctx, c, userExistsKey(username), true)
+	}
+	return exists, err
+}
+
+// cacheGet returns the cached value for key and whether it was found. Errors
+// are logged and treated as misses so that a broken cache never breaks a
+// request.
+func cacheGet[V any](ctx context.Context, c Cache, key string) (V, bool) {
+	var value V
+	if c == nil {
+		return value, false
+	}
+
+	encoded, ok, err := c.Get(ctx, key)
+	if err != nil {
+		log.WithContext(ctx).Errorf("error reading %s from the cache: %s", key, err)
+		return value, false
+	}
+	if !ok {
+		return value, false
+	}
+
+	if err = json.Unmarshal(encoded, &value); err != nil {
+		log.WithContext(ctx).Errorf("error decoding %s from the cache: %s", key, err)
+		return value, false
+	}
+	return value, true
+}
+
+// cacheSet stores value under key, logging any errors.
+func cacheSet[V any](ctx context.Context, c Cache, key string, value V) {
+	if c == nil {
+		return
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		log.WithContext(ctx).Errorf("error encoding %s for the cache: %s", key, err)
+		return
+	}
+
+	if err = c.Set(ctx, key, encoded); err != nil {
+		log.WithContext(ctx).Errorf("error writing %s to the cache: %s", key, err)
+	}
+}
+
+// cacheInvalidate removes the entries for the keys, logging any errors.
+func cacheInvalidate(ctx context.Context, c Cache, keys ...string) {
+	if c == nil {
+		return
+	}
+
+	if err := c.Delete(ctx, keys...); err != nil {
+		log.WithContext(ctx).Errorf("error invalidating %s in the cache: %s", strings.Join(keys, ", "), err)
+	}
+}
+
+// cacheInvalidatePrefix removes the entries whose keys start with prefix,
+// logging any errors.
+func cacheInvalidatePrefix(ctx context.Context, c Cache, prefix string) {
+	if c == nil {
+		return
+	}
+
+	if err := c.DeletePrefix(ctx, prefix); err != nil {
+		log.WithContext(ctx).Errorf("error invalidating %s* in the cache: %s", prefix, err)
+	}
+}
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryCache is a Cache that keeps its entries in process.
+type memoryCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+// newMemoryCache returns a new *memoryCache whose entries live for ttl.
+func newMemoryCache(ttl time.Duration) *memoryCache {
+	return &memoryCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// Get returns the value stored under key if it hasn't expired.
+func (c *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 {
+		return nil, false, nil
+	}
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Set stores value under key.
+func (c *memoryCache) Set(_ context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 {
+		return nil
+	}
+
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+	return nil
+}
+
+// Delete removes the entries for the keys.
+func (c *memoryCache) Delete(_ context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+	return nil
+}
+
+// DeletePrefix removes every entry whose key starts with prefix.
+func (c *memoryCache) DeletePrefix(_ context.Context, prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+	return nil
+}
+
+// SetTTL changes how long entries live. Existing entries are dropped so that
+// none of them outlive the new TTL.
+func (c *memoryCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+	c.entries = make(map[string]cacheEntry)
+}
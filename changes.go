@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// syncedModules are the kinds of data that the changes endpoint reports on. A
+// purge of the user's data, recorded under the users module, changes all of
+// them.
+var syncedModules = []string{"preferences", "sessions", "searches", "bags"}
+
+// ChangesApp tells clients which of a user's data has changed since they last
+// fetched it.
+type ChangesApp struct {
+	changes *ChangesDB
+	bags    *BagsApp
+	router  *mux.Router
+}
+
+// NewChangesApp returns a new *ChangesApp. bags is used to add the user domain
+// to usernames for the bags tables.
+func NewChangesApp(db *ChangesDB, bags *BagsApp, router *mux.Router) *ChangesApp {
+	changesApp := &ChangesApp{
+		changes: db,
+		bags:    bags,
+		router:  moduleRouter(router, "users", "/users"),
+	}
+	changesApp.router.HandleFunc("/{username}/changes", changesApp.GetChanges).Methods(http.MethodGet)
+	return changesApp
+}
+
+// changeCursor is the point that changes are listed since: either a token
+// returned by an earlier request, or an RFC 3339 timestamp.
+type changeCursor struct {
+	version int64
+	time    time.Time
+}
+
+// parseChangeCursor parses the since query parameter. An empty value lists
+// every change.
+func parseChangeCursor(since string) (*changeCursor, error) {
+	if since == "" {
+		return &changeCursor{}, nil
+	}
+	if version, err := strconv.ParseInt(since, 10, 64); err == nil && version >= 0 {
+		return &changeCursor{version: version}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return &changeCursor{time: t}, nil
+	}
+	return nil, fmt.Errorf("since must be a token returned by an earlier request or an RFC 3339 timestamp: %s", since)
+}
+
+// after returns whether the change was made after the cursor.
+func (c *changeCursor) after(change userChange) bool {
+	if !c.time.IsZero() {
+		return change.ChangedAt.After(c.time)
+	}
+	return change.Version > c.version
+}
+
+// GetChanges lists the kinds of the user's data that have changed since the
+// token or timestamp in the since query parameter, along with a token to pass
+// as since next time. Without since, everything that has ever changed is
+// listed.
+func (c *ChangesApp) GetChanges(writer http.ResponseWriter, r *http.Request) {
+	var (
+		username string
+		ok       bool
+		v        = mux.Vars(r)
+		ctx      = r.Context()
+	)
+
+	if username, ok = v["username"]; !ok {
+		httpapi.BadRequest(writer, "Missing username in URL")
+		return
+	}
+
+	cursor, err := parseChangeCursor(r.URL.Query().Get("since"))
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	changes, err := c.changes.changes(ctx, username, c.bags.AddUsernameSuffix(ctx, username))
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("Error listing changes for user %s: %s", username, err))
+		return
+	}
+
+	token := cursor.version
+	changed := make(map[string]bool)
+	for _, change := range changes {
+		if change.Version > token {
+			token = change.Version
+		}
+		if !cursor.after(change) {
+			continue
+		}
+		if change.Module == "users" {
+			for _, module := range syncedModules {
+				changed[module] = true
+			}
+		} else {
+			changed[change.Module] = true
+		}
+	}
+
+	modules := make([]string, 0, len(changed))
+	for module := range changed {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{
+		"user":    username,
+		"changed": modules,
+		"token":   strconv.FormatInt(token, 10),
+	})
+}
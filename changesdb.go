@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// userChange is the most recent change to one kind of data stored for a user.
+// Version increases with every change to any user's data.
+type userChange struct {
+	Module    string
+	Version   int64
+	ChangedAt time.Time
+}
+
+// ChangesDB records when each kind of data stored for a user last changed, so
+// that clients can find out what to fetch again instead of refetching
+// everything.
+type ChangesDB struct {
+	db *retryingDB
+}
+
+// NewChangesDB returns a newly created *ChangesDB.
+func NewChangesDB(db *sql.DB) *ChangesDB {
+	return &ChangesDB{
+		db: withRetries(db),
+	}
+}
+
+// Observe records the mutation as the latest change to its module for the
+// user. Unlike most observers it writes to the database right away, since a
+// client that made the write may ask for changes as soon as it's done. Purges
+// aren't recorded, since purging a user deletes their changes too.
+func (c *ChangesDB) Observe(ctx context.Context, m Mutation) {
+	if m.Action == actionPurged {
+		return
+	}
+	if err := c.record(ctx, m.Username, m.Module); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// record records a change to the module for the user.
+func (c *ChangesDB) record(ctx context.Context, username, module string) error {
+	query := `INSERT INTO user_changes (username, module) VALUES ($1, $2)
+              ON CONFLICT (username, module) DO UPDATE
+              SET version = nextval('user_changes_version_seq'), changed_at = now()`
+
+	if _, err := c.db.ExecContext(ctx, query, username, module); err != nil {
+		return fmt.Errorf("error recording a change to %s for %s: %w", module, username, dbError(err))
+	}
+	return nil
+}
+
+// changes returns the latest change to each module for the users, who are
+// usually a user and the same user with the bags user domain.
+func (c *ChangesDB) changes(ctx context.Context, usernames ...string) ([]userChange, error) {
+	query := `SELECT module, version, changed_at FROM user_changes WHERE username = ANY($1)`
+
+	rows, err := c.db.QueryContext(ctx, query, pq.Array(usernames))
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var changes []userChange
+	for rows.Next() {
+		var change userChange
+		if err = rows.Scan(&change.Module, &change.Version, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+
+	return changes, nil
+}
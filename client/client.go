@@ -0,0 +1,282 @@
+// Package client is a Go client for the user-info API. Requests are retried
+// when the service is unavailable or rate limits them, and carry the trace
+// context of the context they're made with.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer that creates the client's spans.
+const tracerName = "github.com/cyverse-de/user-info/client"
+
+// Client makes requests to the user-info API.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the *http.Client used to make requests. The default is
+// http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithAPIKey sets the API key presented in the Authorization header.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithRetries sets how many times each request is tried, and how long to wait
+// before the first retry. The wait doubles before each retry after that, up
+// to maxBackoff. The default is three attempts, starting at 100ms and waiting
+// no more than 5s.
+func WithRetries(attempts int, backoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.attempts = attempts
+		c.backoff = backoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+type impersonateKey struct{}
+
+// Impersonating returns a copy of the context whose requests act on the data
+// of the user instead of the one they name, with the X-Impersonate-User header.
+// The user they name is recorded in the audit log as the impersonator. Only
+// clients with an admin API key may impersonate users.
+func Impersonating(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, impersonateKey{}, username)
+}
+
+// New returns a new *Client for the service at baseURL, e.g.
+// "http://user-info".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %s: %w", baseURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %s: the scheme and host are required", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		attempts:   3,
+		backoff:    100 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.attempts < 1 {
+		c.attempts = 1
+	}
+	return c, nil
+}
+
+// Error is returned for responses with error statuses. The fields come from
+// the problem details in the body of the response.
+type Error struct {
+	StatusCode int    `json:"status"`
+	Code       string `json:"code"`
+	Detail     string `json:"detail"`
+	RequestID  string `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("user-info returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// IsNotFound returns whether err is an *Error for a user, or data belonging to
+// a user, that doesn't exist.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// IsDeactivated returns whether err is an *Error for a write to the data of a
+// user whose account is deactivated.
+func IsDeactivated(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == "user_deactivated"
+}
+
+// retryable returns whether a request that got the status should be tried
+// again.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter returns the wait requested by the Retry-After header, or zero if
+// there isn't one.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// do makes a request and decodes the JSON response into out, unless out is nil.
+// The body, if any, is encoded as JSON. POST and PUT requests are sent with an
+// Idempotency-Key header, so they can be retried safely.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) (err error) {
+	var encoded []byte
+	if body != nil {
+		if encoded, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("error encoding the request body: %w", err)
+		}
+	}
+
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "user-info "+method, trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String("http.method", method), attribute.String("http.url", u.String()))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	var idempotencyKey string
+	if method == http.MethodPost || method == http.MethodPut {
+		idempotencyKey = uuid.NewString()
+	}
+
+	limit := c.backoff
+	for attempt := 1; ; attempt++ {
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(encoded)); err != nil {
+			return err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Accept", "application/json")
+		if c.apiKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+		}
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		if username, _ := ctx.Value(impersonateKey{}).(string); username != "" {
+			req.Header.Set("X-Impersonate-User", username)
+		}
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		var (
+			resp *http.Response
+			wait time.Duration
+		)
+		resp, err = c.httpClient.Do(req)
+		if err == nil {
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			if !retryable(resp.StatusCode) || attempt >= c.attempts {
+				return decodeResponse(resp, out)
+			}
+			wait = retryAfter(resp)
+			resp.Body.Close()
+		} else if attempt >= c.attempts || ctx.Err() != nil {
+			return err
+		}
+
+		if wait == 0 && limit > 0 {
+			wait = time.Duration(rand.Int63n(int64(limit)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if limit *= 2; limit > c.maxBackoff {
+			limit = c.maxBackoff
+		}
+	}
+}
+
+// decodeResponse decodes a successful response into out, or returns an *Error
+// for an error response. The body is closed.
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		e := &Error{}
+		body, err := io.ReadAll(resp.Body)
+		if err == nil && json.Unmarshal(body, e) != nil {
+			e.Detail = strings.TrimSpace(string(body))
+		}
+		e.StatusCode = resp.StatusCode
+		if e.RequestID == "" {
+			e.RequestID = resp.Header.Get("X-Request-ID")
+		}
+		return e
+	}
+
+	if out == nil {
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding the response: %w", err)
+	}
+	return nil
+}
+
+// userPath returns the path for a user's data under the prefix, with each
+// element escaped.
+func userPath(prefix, username string, elems ...string) string {
+	path := prefix + "/" + url.PathEscape(username)
+	for _, elem := range elems {
+		path += "/" + url.PathEscape(elem)
+	}
+	return path
+}
@@ -0,0 +1,641 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c, err := New(server.URL, WithAPIKey("test-key"), WithRetries(3, time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNewInvalidURL(t *testing.T) {
+	if _, err := New("user-info"); err == nil {
+		t.Error("expected an error for a URL without a scheme")
+	}
+}
+
+func TestGetPreferences(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/preferences/test@example.org" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "ApiKey test-key" {
+			t.Errorf("Authorization was %q", got)
+		}
+		writer.Write([]byte(`{"theme":"dark"}`)) // nolint:errcheck
+	})
+
+	prefs, err := c.GetPreferences(context.Background(), "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs["theme"] != "dark" {
+		t.Errorf("unexpected preferences: %v", prefs)
+	}
+}
+
+func TestGetChanges(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/test@example.org/changes" || r.URL.Query().Get("since") != "3" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"changed":["bags"],"token":"7"}`)) // nolint:errcheck
+	})
+
+	changes, err := c.GetChanges(context.Background(), "test@example.org", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Changed) != 1 || changes.Changed[0] != "bags" || changes.Token != "7" {
+		t.Errorf("unexpected changes: %+v", changes)
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/profile/test@example.org" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"user":"test@example.org","id":"user-1","name":"Test User","email":"test@example.org"}`)) // nolint:errcheck
+	})
+
+	profile, err := c.GetProfile(context.Background(), "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.ID != "user-1" || profile.Name != "Test User" || profile.Email != "test@example.org" {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+}
+
+func TestSetAvatarURL(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if r.Method != http.MethodPut || r.URL.Path != "/avatars/test@example.org" || body["url"] != "https://example.org/me.png" {
+			t.Errorf("unexpected request: %s %s %v", r.Method, r.URL, body)
+		}
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write([]byte(`{"user":"test@example.org","url":"https://example.org/me.png","updated_at":"2024-01-01T00:00:00Z"}`)) // nolint:errcheck
+	})
+
+	avatar, err := c.SetAvatarURL(context.Background(), "test@example.org", "https://example.org/me.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avatar.URL != "https://example.org/me.png" || avatar.UpdatedAt.IsZero() {
+		t.Errorf("unexpected avatar: %+v", avatar)
+	}
+}
+
+func TestGetCompletedTours(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tours/test@example.org" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"tours":[{"tour_id":"data-window","completed_at":"2024-01-01T00:00:00Z"}]}`)) // nolint:errcheck
+	})
+
+	tours, err := c.GetCompletedTours(context.Background(), "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tours) != 1 || tours[0].TourID != "data-window" || tours[0].CompletedAt.IsZero() {
+		t.Errorf("unexpected tours: %+v", tours)
+	}
+}
+
+func TestQueryNotificationPrefs(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Usernames []string `json:"usernames"`
+			EventType string   `json:"event_type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/notification-prefs/query" || len(body.Usernames) != 1 || body.EventType != "analysis.completed" {
+			t.Errorf("unexpected request: %s %s %+v", r.Method, r.URL, body)
+		}
+		writer.Write([]byte(`{"users":{"test@example.org":{"channels":{"email":true},"events":{},"deliver":["email"]}}}`)) // nolint:errcheck
+	})
+
+	users, err := c.QueryNotificationPrefs(context.Background(), []string{"test@example.org"}, "analysis.completed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs := users["test@example.org"]
+	if !prefs.Channels["email"] || len(prefs.Deliver) != 1 || prefs.Deliver[0] != "email" {
+		t.Errorf("unexpected settings: %+v", users)
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/feedback/test":
+			var body struct {
+				FormID  string   `json:"form_id"`
+				Answers Document `json:"answers"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.FormID != "nps" || body.Answers["score"] != float64(9) {
+				t.Errorf("unexpected submission: %+v", body)
+			}
+			writer.WriteHeader(http.StatusCreated)
+			writer.Write([]byte(`{"id":"f1","username":"test","form_id":"nps","answers":{"score":9},"submitted_at":"2024-01-02T03:04:05Z"}`)) // nolint:errcheck
+		case r.Method == http.MethodGet && r.URL.Path == "/feedback/test":
+			if query := r.URL.Query(); query.Get("form_id") != "nps" || query.Get("limit") != "10" || query.Get("offset") != "0" {
+				t.Errorf("unexpected query: %s", r.URL.RawQuery)
+			}
+			writer.Write([]byte(`{"items":[{"id":"f1","username":"test","form_id":"nps","answers":{"score":9},"submitted_at":"2024-01-02T03:04:05Z"}],"total":1,"limit":10,"offset":0,"next":null}`)) // nolint:errcheck
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+
+	feedback, err := c.SubmitFeedback(context.Background(), "test", "nps", Document{"score": 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feedback.ID != "f1" || feedback.SubmittedAt.IsZero() {
+		t.Errorf("unexpected submission: %+v", feedback)
+	}
+
+	submissions, total, err := c.ListFeedback(context.Background(), "test", "nps", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(submissions) != 1 || string(submissions[0].Answers) != `{"score":9}` {
+		t.Errorf("unexpected submissions: %d %+v", total, submissions)
+	}
+}
+
+func TestPins(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/pins/test/folder":
+			var body struct {
+				ID string `json:"id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.ID != "/iplant/home/test" {
+				t.Errorf("unexpected ID: %s", body.ID)
+			}
+			writer.WriteHeader(http.StatusCreated)
+			writer.Write([]byte(`{"id":"/iplant/home/test","position":1,"pinned_at":"2024-01-02T03:04:05Z"}`)) // nolint:errcheck
+		case r.Method == http.MethodDelete && r.URL.Path == "/pins/test/folder":
+			if id := r.URL.Query().Get("id"); id != "/iplant/home/test" {
+				t.Errorf("unexpected ID: %s", id)
+			}
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+
+	pin, err := c.PinItem(context.Background(), "test", "folder", "/iplant/home/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin.ID != "/iplant/home/test" || pin.Position != 1 {
+		t.Errorf("unexpected pin: %+v", pin)
+	}
+
+	if err = c.UnpinItem(context.Background(), "test", "folder", "/iplant/home/test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/tags/test/tag-1/resources":
+			var body struct {
+				IDs []string `json:"ids"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.IDs) != 2 || body.IDs[1] != "/iplant/home/test/b" {
+				t.Errorf("unexpected IDs: %v", body.IDs)
+			}
+			writer.Write([]byte(`{"attached":2}`)) // nolint:errcheck
+		case r.Method == http.MethodDelete && r.URL.Path == "/tags/test/tag-1/resources":
+			if ids := r.URL.Query()["id"]; len(ids) != 2 || ids[0] != "/iplant/home/test/a" {
+				t.Errorf("unexpected IDs: %v", ids)
+			}
+			writer.Write([]byte(`{"detached":1}`)) // nolint:errcheck
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+
+	ids := []string{"/iplant/home/test/a", "/iplant/home/test/b"}
+	attached, err := c.TagResources(context.Background(), "test", "tag-1", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attached != 2 {
+		t.Errorf("unexpected attached count: %d", attached)
+	}
+
+	detached, err := c.UntagResources(context.Background(), "test", "tag-1", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detached != 1 {
+		t.Errorf("unexpected detached count: %d", detached)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/tokens/verify" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		switch body["token"] {
+		case "deut_good":
+			if body["scope"] != "read" {
+				t.Errorf("unexpected scope: %s", body["scope"])
+			}
+			writer.Write([]byte(`{"active":true,"username":"test","id":"token-1","name":"script","scopes":["read"],"created_at":"2024-01-02T03:04:05Z","expires_at":null,"last_used_at":null}`)) // nolint:errcheck
+		default:
+			writer.Write([]byte(`{"active":false,"reason":"unknown"}`)) // nolint:errcheck
+		}
+	})
+
+	verification, err := c.VerifyToken(context.Background(), "deut_good", "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verification.Active || verification.Username != "test" || verification.Token == nil || verification.ID != "token-1" {
+		t.Errorf("unexpected verification: %+v", verification)
+	}
+
+	verification, err = c.VerifyToken(context.Background(), "deut_bad", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verification.Active || verification.Reason != "unknown" || verification.Token != nil {
+		t.Errorf("unexpected verification: %+v", verification)
+	}
+}
+
+func TestGetResolvedPreferences(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/team-preferences/iplant:labs:test/resolved/test" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"theme":"light","lang":"en"}`)) // nolint:errcheck
+	})
+
+	prefs, err := c.GetResolvedPreferences(context.Background(), "iplant:labs:test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs["theme"] != "light" || prefs["lang"] != "en" {
+		t.Errorf("unexpected preferences: %v", prefs)
+	}
+}
+
+func TestGetWebhooks(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/webhooks/test" || r.URL.Query().Get("topic") != "data.shared" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"webhooks":[{"id":"webhook-1","url":"https://example.com/hook","type":"custom","topics":[],"created_at":"2024-01-02T03:04:05Z","updated_at":"2024-01-02T03:04:05Z"}]}`)) // nolint:errcheck
+	})
+
+	webhooks, err := c.GetWebhooks(context.Background(), "test", "data.shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 || webhooks[0].ID != "webhook-1" || webhooks[0].Type != "custom" {
+		t.Errorf("unexpected webhooks: %+v", webhooks)
+	}
+}
+
+func TestSaveDashboard(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/dashboard/test" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := `{"widgets":[{"id":"recent-analyses","column":1,"row":0,"collapsed":true}]}`; string(body) != expected {
+			t.Errorf("body was %s instead of %s", body, expected)
+		}
+		writer.Write([]byte(`{"widgets":[{"id":"recent-analyses","column":1,"row":0,"collapsed":true,"updated_at":"2024-01-02T03:04:05Z"}]}`)) // nolint:errcheck
+	})
+
+	widgets, err := c.SaveDashboard(context.Background(), "test", []DashboardWidget{
+		{ID: "recent-analyses", Column: 1, Collapsed: true, UpdatedAt: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(widgets) != 1 || widgets[0].ID != "recent-analyses" || widgets[0].UpdatedAt.IsZero() {
+		t.Errorf("unexpected widgets: %+v", widgets)
+	}
+}
+
+func TestGetConsentHistory(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Method != http.MethodGet || r.URL.Path != "/consents/test/history" || query.Get("purpose") != "analytics" || query.Get("limit") != "10" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"items":[{"id":"record-1","username":"test","purpose":"analytics","granted":false,"source":"settings","recorded_at":"2024-01-02T03:04:05Z"}],"total":3,"limit":10,"offset":0,"next":null}`)) // nolint:errcheck
+	})
+
+	records, total, err := c.GetConsentHistory(context.Background(), "test", "analytics", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(records) != 1 || records[0].Granted || records[0].Source != "settings" {
+		t.Errorf("unexpected records: %d %+v", total, records)
+	}
+}
+
+func TestGetIdentityBySubject(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/identity/by-subject/f:realm:test" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"subject":"f:realm:test","username":"test@example.org","created_at":"2024-01-02T03:04:05Z"}`)) // nolint:errcheck
+	})
+
+	identity, err := c.GetIdentityBySubject(context.Background(), "f:realm:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "test@example.org" {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestImpersonating(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/preferences/support" || r.Header.Get("X-Impersonate-User") != "test" {
+			t.Errorf("unexpected request: %s %s impersonating %q", r.Method, r.URL, r.Header.Get("X-Impersonate-User"))
+		}
+		writer.Write([]byte(`{"preferences":{"theme":"dark"}}`)) // nolint:errcheck
+	})
+
+	if _, err := c.GetPreferences(Impersonating(context.Background(), "test"), "support"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetActivity(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Method != http.MethodGet || r.URL.Path != "/activity/test" || query.Get("module") != "bags" || query.Get("offset") != "20" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		writer.Write([]byte(`{"items":[{"id":"entry-1","time":"2024-01-02T03:04:05Z","module":"bags","action":"updated","bag_id":"bag-1","keys":["apps"]}],"total":21,"limit":20,"offset":20,"next":null}`)) // nolint:errcheck
+	})
+
+	entries, total, err := c.GetActivity(context.Background(), "test", "bags", 20, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 21 || len(entries) != 1 || entries[0].BagID != "bag-1" || len(entries[0].Keys) != 1 {
+		t.Errorf("unexpected entries: %d %+v", total, entries)
+	}
+}
+
+func TestSaveDigestSchedule(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.URL.Path != "/digests/test" ||
+			string(body) != `{"channels":["email"],"day":1,"frequency":"weekly","hour":9,"timezone":"America/Phoenix"}` {
+			t.Errorf("unexpected request: %s %s %s", r.Method, r.URL, body)
+		}
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write([]byte(`{"username":"test","frequency":"weekly","day":1,"hour":9,"timezone":"America/Phoenix","channels":["email"],"last_sent_at":null,"updated_at":"2024-01-02T03:04:05Z"}`)) // nolint:errcheck
+	})
+
+	day := 1
+	schedule, err := c.SaveDigestSchedule(context.Background(), "test", &DigestSchedule{
+		Frequency: "weekly",
+		Day:       &day,
+		Hour:      9,
+		Timezone:  "America/Phoenix",
+		Channels:  []string{"email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule.Username != "test" || schedule.Day == nil || *schedule.Day != 1 || schedule.LastSentAt != nil || schedule.UpdatedAt.IsZero() {
+		t.Errorf("unexpected schedule: %+v", schedule)
+	}
+}
+
+func TestDueDigests(t *testing.T) {
+	at := time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/digests/due":
+			if query := r.URL.Query(); query.Get("at") != "2024-01-02T09:00:00Z" || query.Get("limit") != "100" {
+				t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			}
+			writer.Write([]byte(`{"items":[{"username":"test","frequency":"daily","day":null,"hour":9,"timezone":"UTC","channels":["email"],"last_sent_at":null,"updated_at":"2024-01-01T00:00:00Z"}],"total":1,"limit":100,"offset":0,"next":null}`)) // nolint:errcheck
+		case r.Method == http.MethodPost && r.URL.Path == "/digests/sent":
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != `{"sent_at":"2024-01-02T09:00:00Z","usernames":["test"]}` {
+				t.Errorf("unexpected body: %s", body)
+			}
+			writer.Write([]byte(`{"updated":1}`)) // nolint:errcheck
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+
+	schedules, total, err := c.DueDigests(context.Background(), at, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(schedules) != 1 || schedules[0].Username != "test" || schedules[0].Day != nil {
+		t.Errorf("unexpected schedules: %d %+v", total, schedules)
+	}
+
+	updated, err := c.MarkDigestsSent(context.Background(), []string{"test"}, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 1 {
+		t.Errorf("%d schedules were updated instead of 1", updated)
+	}
+}
+
+func TestSaveLocale(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.URL.Path != "/locale/test" || string(body) != `{"locale":"en_gb","timezone":"Europe/London"}` {
+			t.Errorf("unexpected request: %s %s %s", r.Method, r.URL, body)
+		}
+		writer.Write([]byte(`{"username":"test","timezone":"Europe/London","locale":"en-GB","updated_at":"2024-01-02T03:04:05Z"}`)) // nolint:errcheck
+	})
+
+	locale, err := c.SaveLocale(context.Background(), "test", "Europe/London", "en_gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locale.Locale != "en-GB" || locale.UpdatedAt == nil {
+		t.Errorf("unexpected locale: %+v", locale)
+	}
+}
+
+func TestDeactivateUser(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Path != "/users/test/deactivate" || string(body) != `{"purge_at":"2030-01-02T03:04:05Z","reason":"left"}` {
+			t.Errorf("unexpected request: %s %s %s", r.Method, r.URL, body)
+		}
+		writer.Write([]byte(`{"username":"test","deactivated":true,"deactivated_at":"2029-12-03T03:04:05Z","reason":"left","purge_at":"2030-01-02T03:04:05Z"}`)) // nolint:errcheck
+	})
+
+	purgeAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	deactivation, err := c.DeactivateUser(context.Background(), "test", "left", &purgeAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deactivation.Deactivated || deactivation.PurgeAt == nil || !deactivation.PurgeAt.Equal(purgeAt) {
+		t.Errorf("unexpected deactivation: %+v", deactivation)
+	}
+}
+
+func TestIsDeactivated(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		writer.Header().Set("Content-Type", "application/problem+json")
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte(`{"status":403,"code":"user_deactivated","detail":"the account of user test is deactivated"}`)) // nolint:errcheck
+	})
+
+	if err := c.SavePreferences(context.Background(), "test", Document{}); !IsDeactivated(err) {
+		t.Errorf("expected a deactivated error, got %v", err)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		writer.Header().Set("Content-Type", "application/problem+json")
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte(`{"status":404,"code":"user_not_found","detail":"user test does not exist","request_id":"request-1"}`)) // nolint:errcheck
+	})
+
+	_, err := c.GetSession(context.Background(), "test")
+	if !IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+
+	e := err.(*Error)
+	if e.Code != "user_not_found" || e.RequestID != "request-1" {
+		t.Errorf("unexpected error: %+v", e)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var (
+		attempts int
+		keys     []string
+	)
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		attempts++
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if attempts < 3 {
+			writer.Header().Set("Retry-After", "0")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.Write([]byte(`{"id":"bag-1"}`)) // nolint:errcheck
+	})
+
+	id, err := c.AddBag(context.Background(), "test", Document{"items": []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "bag-1" {
+		t.Errorf("bag ID was %s", id)
+	}
+	if attempts != 3 {
+		t.Errorf("the request was tried %d times", attempts)
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Errorf("the idempotency key changed between attempts: %v", keys)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	var attempts int
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		attempts++
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	err := c.DeleteBag(context.Background(), "test", "bag-1")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 error, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("the request was tried %d times", attempts)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	saved := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(saved) })
+
+	var traceparent string
+	c := newTestClient(t, func(writer http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		json.NewEncoder(writer).Encode(map[string]interface{}{"bags": []interface{}{}}) // nolint:errcheck
+	})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	if _, err := c.ListBags(ctx, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(traceparent, traceID.String()) {
+		t.Errorf("traceparent was %q", traceparent)
+	}
+}
@@ -0,0 +1,1033 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Document is a JSON object stored for a user, such as their preferences or
+// session.
+type Document map[string]interface{}
+
+// GetPreferences returns the user's preferences.
+func (c *Client) GetPreferences(ctx context.Context, username string) (Document, error) {
+	var prefs Document
+	err := c.do(ctx, http.MethodGet, userPath("/preferences", username), nil, nil, &prefs)
+	return prefs, err
+}
+
+// SavePreferences replaces the user's preferences.
+func (c *Client) SavePreferences(ctx context.Context, username string, prefs Document) error {
+	return c.do(ctx, http.MethodPost, userPath("/preferences", username), nil, prefs, nil)
+}
+
+// DeletePreferences deletes the user's preferences.
+func (c *Client) DeletePreferences(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/preferences", username), nil, nil, nil)
+}
+
+// GetTeamPreferences returns the preferences shared by the team.
+func (c *Client) GetTeamPreferences(ctx context.Context, teamID string) (Document, error) {
+	var prefs Document
+	err := c.do(ctx, http.MethodGet, userPath("/team-preferences", teamID), nil, nil, &prefs)
+	return prefs, err
+}
+
+// SaveTeamPreferences replaces the preferences shared by the team.
+func (c *Client) SaveTeamPreferences(ctx context.Context, teamID string, prefs Document) error {
+	return c.do(ctx, http.MethodPut, userPath("/team-preferences", teamID), nil, prefs, nil)
+}
+
+// DeleteTeamPreferences deletes the preferences shared by the team.
+func (c *Client) DeleteTeamPreferences(ctx context.Context, teamID string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/team-preferences", teamID), nil, nil, nil)
+}
+
+// GetResolvedPreferences returns the preferences that apply to the user as a
+// member of the team: the team's preferences with the user's own merged over
+// them.
+func (c *Client) GetResolvedPreferences(ctx context.Context, teamID, username string) (Document, error) {
+	var prefs Document
+	err := c.do(ctx, http.MethodGet, userPath("/team-preferences", teamID, "resolved", username), nil, nil, &prefs)
+	return prefs, err
+}
+
+// GetSession returns the user's session.
+func (c *Client) GetSession(ctx context.Context, username string) (Document, error) {
+	var session Document
+	err := c.do(ctx, http.MethodGet, userPath("/sessions", username), nil, nil, &session)
+	return session, err
+}
+
+// SaveSession replaces the user's session.
+func (c *Client) SaveSession(ctx context.Context, username string, session Document) error {
+	return c.do(ctx, http.MethodPost, userPath("/sessions", username), nil, session, nil)
+}
+
+// DeleteSession deletes the user's session.
+func (c *Client) DeleteSession(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/sessions", username), nil, nil, nil)
+}
+
+// GetSavedSearches returns the user's saved searches as a JSON object.
+func (c *Client) GetSavedSearches(ctx context.Context, username string) (json.RawMessage, error) {
+	var searches json.RawMessage
+	err := c.do(ctx, http.MethodGet, userPath("/searches", username), nil, nil, &searches)
+	return searches, err
+}
+
+// SaveSavedSearches replaces the user's saved searches.
+func (c *Client) SaveSavedSearches(ctx context.Context, username string, searches json.RawMessage) error {
+	return c.do(ctx, http.MethodPost, userPath("/searches", username), nil, searches, nil)
+}
+
+// DeleteSavedSearches deletes the user's saved searches.
+func (c *Client) DeleteSavedSearches(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/searches", username), nil, nil, nil)
+}
+
+// Bag is one of a user's bags.
+type Bag struct {
+	ID        string     `json:"id"`
+	Contents  Document   `json:"contents"`
+	UserID    string     `json:"user_id"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ListBags returns the user's bags.
+func (c *Client) ListBags(ctx context.Context, username string) ([]Bag, error) {
+	var listing struct {
+		Bags []Bag `json:"bags"`
+	}
+	err := c.do(ctx, http.MethodGet, userPath("/bags", username), nil, nil, &listing)
+	return listing.Bags, err
+}
+
+// GetBag returns one of the user's bags.
+func (c *Client) GetBag(ctx context.Context, username, bagID string) (*Bag, error) {
+	var bag Bag
+	if err := c.do(ctx, http.MethodGet, userPath("/bags", username, bagID), nil, nil, &bag); err != nil {
+		return nil, err
+	}
+	return &bag, nil
+}
+
+// AddBag adds a bag with the contents for the user and returns its ID. An
+// expires_at member in the contents sets when the bag expires.
+func (c *Client) AddBag(ctx context.Context, username string, contents Document) (string, error) {
+	var added struct {
+		ID string `json:"id"`
+	}
+	err := c.do(ctx, http.MethodPut, userPath("/bags", username), nil, contents, &added)
+	return added.ID, err
+}
+
+// UpdateBag replaces the contents of one of the user's bags.
+func (c *Client) UpdateBag(ctx context.Context, username, bagID string, contents Document) error {
+	return c.do(ctx, http.MethodPost, userPath("/bags", username, bagID), nil, contents, nil)
+}
+
+// DeleteBag deletes one of the user's bags.
+func (c *Client) DeleteBag(ctx context.Context, username, bagID string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/bags", username, bagID), nil, nil, nil)
+}
+
+// DeleteAllBags deletes all of the user's bags.
+func (c *Client) DeleteAllBags(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/bags", username), nil, nil, nil)
+}
+
+// GetDefaultBag returns the user's default bag. If create is true, a default
+// bag is created if the user doesn't have one yet; otherwise an *Error with a
+// 404 status is returned.
+func (c *Client) GetDefaultBag(ctx context.Context, username string, create bool) (*Bag, error) {
+	var bag Bag
+	query := url.Values{"create": []string{strconv.FormatBool(create)}}
+	if err := c.do(ctx, http.MethodGet, userPath("/bags", username, "default"), query, nil, &bag); err != nil {
+		return nil, err
+	}
+	return &bag, nil
+}
+
+// UpdateDefaultBag replaces the contents of the user's default bag.
+func (c *Client) UpdateDefaultBag(ctx context.Context, username string, contents Document) error {
+	return c.do(ctx, http.MethodPost, userPath("/bags", username, "default"), nil, contents, nil)
+}
+
+// DeleteDefaultBag deletes the user's default bag.
+func (c *Client) DeleteDefaultBag(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/bags", username, "default"), nil, nil, nil)
+}
+
+// DeleteUser deletes everything stored for the user.
+func (c *Client) DeleteUser(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/users", username), nil, nil, nil)
+}
+
+// Deactivation is whether a user's account is deactivated. PurgeAt is when
+// everything stored for the user is scheduled to be purged, if it is.
+type Deactivation struct {
+	Username      string     `json:"username"`
+	Deactivated   bool       `json:"deactivated"`
+	DeactivatedAt *time.Time `json:"deactivated_at"`
+	Reason        string     `json:"reason"`
+	PurgeAt       *time.Time `json:"purge_at"`
+}
+
+// GetDeactivation returns whether the user's account is deactivated.
+func (c *Client) GetDeactivation(ctx context.Context, username string) (*Deactivation, error) {
+	var deactivation Deactivation
+	if err := c.do(ctx, http.MethodGet, userPath("/users", username, "deactivation"), nil, nil, &deactivation); err != nil {
+		return nil, err
+	}
+	return &deactivation, nil
+}
+
+// DeactivateUser deactivates the user's account, after which writes to their
+// data fail with an error that IsDeactivated recognizes. If purgeAt isn't nil,
+// everything stored for the user is purged at that time unless the account is
+// reactivated first.
+func (c *Client) DeactivateUser(ctx context.Context, username, reason string, purgeAt *time.Time) (*Deactivation, error) {
+	var deactivation Deactivation
+	body := map[string]interface{}{"reason": reason}
+	if purgeAt != nil {
+		body["purge_at"] = purgeAt
+	}
+	if err := c.do(ctx, http.MethodPost, userPath("/users", username, "deactivate"), nil, body, &deactivation); err != nil {
+		return nil, err
+	}
+	return &deactivation, nil
+}
+
+// ReactivateUser reactivates the user's account and cancels any scheduled
+// purge.
+func (c *Client) ReactivateUser(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodPost, userPath("/users", username, "reactivate"), nil, nil, nil)
+}
+
+// Changes lists the kinds of a user's data that have changed, e.g.
+// "preferences" or "bags". Token is passed to GetChanges to list the changes
+// made after this list.
+type Changes struct {
+	Changed []string `json:"changed"`
+	Token   string   `json:"token"`
+}
+
+// GetChanges returns the kinds of the user's data that have changed since the
+// token from an earlier call, so that only those need to be fetched again. An
+// empty token lists everything that has ever changed.
+func (c *Client) GetChanges(ctx context.Context, username, since string) (*Changes, error) {
+	var changes Changes
+	var query url.Values
+	if since != "" {
+		query = url.Values{"since": []string{since}}
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/users", username, "changes"), query, nil, &changes); err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+// Profile is a user's ID in the service along with their attributes from the
+// identity provider. ID is empty if nothing is stored for the user.
+type Profile struct {
+	User        string `json:"user"`
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Institution string `json:"institution,omitempty"`
+}
+
+// GetProfile returns the user's profile.
+func (c *Client) GetProfile(ctx context.Context, username string) (*Profile, error) {
+	var profile Profile
+	if err := c.do(ctx, http.MethodGet, userPath("/profile", username), nil, nil, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// Avatar describes a user's stored avatar. The image itself is served by GET
+// /avatars/{username}, which browsers can load directly.
+type Avatar struct {
+	User        string    `json:"user"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int       `json:"size,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SetAvatarURL sets the user's avatar to an image stored elsewhere.
+func (c *Client) SetAvatarURL(ctx context.Context, username, avatarURL string) (*Avatar, error) {
+	var avatar Avatar
+	body := map[string]string{"url": avatarURL}
+	if err := c.do(ctx, http.MethodPut, userPath("/avatars", username), nil, body, &avatar); err != nil {
+		return nil, err
+	}
+	return &avatar, nil
+}
+
+// DeleteAvatar deletes the user's avatar.
+func (c *Client) DeleteAvatar(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/avatars", username), nil, nil, nil)
+}
+
+// CompletedTour records that a user finished a product tour or onboarding
+// step.
+type CompletedTour struct {
+	TourID      string    `json:"tour_id"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// GetCompletedTours returns the tours the user has completed, oldest first.
+func (c *Client) GetCompletedTours(ctx context.Context, username string) ([]CompletedTour, error) {
+	var result struct {
+		Tours []CompletedTour `json:"tours"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/tours", username), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Tours, nil
+}
+
+// CompleteTour records that the user completed the tour. Completing a tour
+// again keeps the original completion time.
+func (c *Client) CompleteTour(ctx context.Context, username, tourID string) (*CompletedTour, error) {
+	var tour CompletedTour
+	if err := c.do(ctx, http.MethodPut, userPath("/tours", username, tourID), nil, nil, &tour); err != nil {
+		return nil, err
+	}
+	return &tour, nil
+}
+
+// ResetTour forgets that the user completed the tour, so that it's shown
+// again.
+func (c *Client) ResetTour(ctx context.Context, username, tourID string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/tours", username, tourID), nil, nil, nil)
+}
+
+// ResetTours forgets every tour the user completed.
+func (c *Client) ResetTours(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/tours", username), nil, nil, nil)
+}
+
+// NotificationPrefs are a user's notification settings. Channels says whether
+// the user opted in to each delivery channel, and Events turns notifications
+// of each event type on or off. Event types that aren't listed are on.
+type NotificationPrefs struct {
+	Channels map[string]bool `json:"channels"`
+	Events   map[string]bool `json:"events"`
+}
+
+// GetNotificationPrefs returns the user's notification settings, with the
+// defaults filled in.
+func (c *Client) GetNotificationPrefs(ctx context.Context, username string) (*NotificationPrefs, error) {
+	var prefs NotificationPrefs
+	if err := c.do(ctx, http.MethodGet, userPath("/notification-prefs", username), nil, nil, &prefs); err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+// SaveNotificationPrefs replaces the user's notification settings.
+func (c *Client) SaveNotificationPrefs(ctx context.Context, username string, prefs *NotificationPrefs) error {
+	return c.do(ctx, http.MethodPut, userPath("/notification-prefs", username), nil, prefs, nil)
+}
+
+// DeleteNotificationPrefs deletes the user's notification settings, so that
+// the defaults apply again.
+func (c *Client) DeleteNotificationPrefs(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/notification-prefs", username), nil, nil, nil)
+}
+
+// UserNotificationPrefs are a user's notification settings returned by
+// QueryNotificationPrefs. Deliver lists the channels that a notification of
+// the queried event type should be sent through.
+type UserNotificationPrefs struct {
+	NotificationPrefs
+	Deliver []string `json:"deliver,omitempty"`
+}
+
+// QueryNotificationPrefs returns the notification settings of up to 1000
+// users, keyed by username. The usernames must include the user domain. If
+// eventType isn't empty, the results also say which channels to send a
+// notification of that type through.
+func (c *Client) QueryNotificationPrefs(ctx context.Context, usernames []string, eventType string) (map[string]UserNotificationPrefs, error) {
+	body := map[string]interface{}{"usernames": usernames}
+	if eventType != "" {
+		body["event_type"] = eventType
+	}
+
+	var result struct {
+		Users map[string]UserNotificationPrefs `json:"users"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/notification-prefs/query", nil, body, &result); err != nil {
+		return nil, err
+	}
+	return result.Users, nil
+}
+
+// Feedback is a user's response to a feedback form or survey.
+type Feedback struct {
+	ID          string          `json:"id"`
+	Username    string          `json:"username"`
+	FormID      string          `json:"form_id"`
+	Answers     json.RawMessage `json:"answers"`
+	SubmittedAt time.Time       `json:"submitted_at"`
+}
+
+// SubmitFeedback stores the user's answers to the form and returns the stored
+// submission.
+func (c *Client) SubmitFeedback(ctx context.Context, username, formID string, answers Document) (*Feedback, error) {
+	var feedback Feedback
+	body := map[string]interface{}{"form_id": formID, "answers": answers}
+	if err := c.do(ctx, http.MethodPost, userPath("/feedback", username), nil, body, &feedback); err != nil {
+		return nil, err
+	}
+	return &feedback, nil
+}
+
+// ListFeedback returns up to limit of the user's submissions, newest first,
+// after skipping offset of them, along with the total number of submissions.
+// An empty formID lists the responses to every form.
+func (c *Client) ListFeedback(ctx context.Context, username, formID string, limit, offset int) ([]Feedback, int64, error) {
+	query := url.Values{
+		"limit":  []string{strconv.Itoa(limit)},
+		"offset": []string{strconv.Itoa(offset)},
+	}
+	if formID != "" {
+		query.Set("form_id", formID)
+	}
+
+	var page struct {
+		Items []Feedback `json:"items"`
+		Total int64      `json:"total"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/feedback", username), query, nil, &page); err != nil {
+		return nil, 0, err
+	}
+	return page.Items, page.Total, nil
+}
+
+// Pin is an item that a user pinned, such as an app, folder, or analysis.
+// Position is the item's place among the pinned items of its type, from 0.
+type Pin struct {
+	ID       string    `json:"id"`
+	Position int       `json:"position"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// GetPins returns the user's pinned items keyed by type, in order.
+func (c *Client) GetPins(ctx context.Context, username string) (map[string][]Pin, error) {
+	var result struct {
+		Pins map[string][]Pin `json:"pins"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/pins", username), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Pins, nil
+}
+
+// PinItem pins the item after the user's other pinned items of the type. An
+// item that's already pinned keeps its place.
+func (c *Client) PinItem(ctx context.Context, username, itemType, id string) (*Pin, error) {
+	var pin Pin
+	body := map[string]string{"id": id}
+	if err := c.do(ctx, http.MethodPost, userPath("/pins", username, itemType), nil, body, &pin); err != nil {
+		return nil, err
+	}
+	return &pin, nil
+}
+
+// ReorderPins puts the user's pinned items of the type in the order of ids,
+// which must list each of them once.
+func (c *Client) ReorderPins(ctx context.Context, username, itemType string, ids []string) ([]Pin, error) {
+	var result struct {
+		Pins []Pin `json:"pins"`
+	}
+	body := map[string][]string{"ids": ids}
+	if err := c.do(ctx, http.MethodPut, userPath("/pins", username, itemType), nil, body, &result); err != nil {
+		return nil, err
+	}
+	return result.Pins, nil
+}
+
+// UnpinItem unpins the item.
+func (c *Client) UnpinItem(ctx context.Context, username, itemType, id string) error {
+	query := url.Values{"id": []string{id}}
+	return c.do(ctx, http.MethodDelete, userPath("/pins", username, itemType), query, nil, nil)
+}
+
+// UnpinAll unpins all of the user's items.
+func (c *Client) UnpinAll(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/pins", username), nil, nil, nil)
+}
+
+// Tag is a label a user made for grouping resources, such as files, apps, or
+// analyses.
+type Tag struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TaggedResource is a resource a tag is attached to.
+type TaggedResource struct {
+	ID         string    `json:"id"`
+	AttachedAt time.Time `json:"attached_at"`
+}
+
+// GetTags returns the user's tags, sorted by name.
+func (c *Client) GetTags(ctx context.Context, username string) ([]Tag, error) {
+	var result struct {
+		Tags []Tag `json:"tags"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/tags", username), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Tags, nil
+}
+
+// CreateTag creates a tag with the name for the user.
+func (c *Client) CreateTag(ctx context.Context, username, name string) (*Tag, error) {
+	var tag Tag
+	body := map[string]string{"name": name}
+	if err := c.do(ctx, http.MethodPost, userPath("/tags", username), nil, body, &tag); err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// DeleteTag deletes one of the user's tags, detaching it from every resource.
+func (c *Client) DeleteTag(ctx context.Context, username, tagID string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/tags", username, tagID), nil, nil, nil)
+}
+
+// GetTaggedResources returns the resources the user's tag is attached to,
+// oldest first.
+func (c *Client) GetTaggedResources(ctx context.Context, username, tagID string) ([]TaggedResource, error) {
+	var result struct {
+		Resources []TaggedResource `json:"resources"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/tags", username, tagID, "resources"), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Resources, nil
+}
+
+// TagResources attaches the user's tag to the resources, returning the number
+// it was newly attached to.
+func (c *Client) TagResources(ctx context.Context, username, tagID string, ids []string) (int64, error) {
+	var result struct {
+		Attached int64 `json:"attached"`
+	}
+	body := map[string][]string{"ids": ids}
+	if err := c.do(ctx, http.MethodPost, userPath("/tags", username, tagID, "resources"), nil, body, &result); err != nil {
+		return 0, err
+	}
+	return result.Attached, nil
+}
+
+// UntagResources detaches the user's tag from the resources, returning the
+// number it was detached from.
+func (c *Client) UntagResources(ctx context.Context, username, tagID string, ids []string) (int64, error) {
+	var result struct {
+		Detached int64 `json:"detached"`
+	}
+	query := url.Values{"id": ids}
+	if err := c.do(ctx, http.MethodDelete, userPath("/tags", username, tagID, "resources"), query, nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Detached, nil
+}
+
+// Token is a personal access token, without its secret. A nil ExpiresAt means
+// the token doesn't expire.
+type Token struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreatedToken is a newly created personal access token with its secret,
+// which can't be retrieved again.
+type CreatedToken struct {
+	Token
+	Secret string `json:"token"`
+}
+
+// TokenVerification is the result of verifying a personal access token. If the
+// token isn't active, Reason says why and Token is nil.
+type TokenVerification struct {
+	Active   bool   `json:"active"`
+	Reason   string `json:"reason"`
+	Username string `json:"username"`
+	*Token
+}
+
+// GetTokens returns the user's personal access tokens, oldest first.
+func (c *Client) GetTokens(ctx context.Context, username string) ([]Token, error) {
+	var result struct {
+		Tokens []Token `json:"tokens"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/tokens", username), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Tokens, nil
+}
+
+// CreateToken creates a personal access token for the user with the scopes.
+// If expiresAt is nil, the token expires after the longest lifetime the
+// service allows, if any.
+func (c *Client) CreateToken(ctx context.Context, username, name string, scopes []string, expiresAt *time.Time) (*CreatedToken, error) {
+	var token CreatedToken
+	body := map[string]interface{}{"name": name, "scopes": scopes}
+	if expiresAt != nil {
+		body["expires_at"] = expiresAt
+	}
+	if err := c.do(ctx, http.MethodPost, userPath("/tokens", username), nil, body, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RevokeToken revokes one of the user's personal access tokens.
+func (c *Client) RevokeToken(ctx context.Context, username, tokenID string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/tokens", username, tokenID), nil, nil, nil)
+}
+
+// RevokeAllTokens revokes all of the user's personal access tokens.
+func (c *Client) RevokeAllTokens(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/tokens", username), nil, nil, nil)
+}
+
+// VerifyToken checks a personal access token that was presented to the caller.
+// If scope isn't empty, the token must have it to be active.
+func (c *Client) VerifyToken(ctx context.Context, token, scope string) (*TokenVerification, error) {
+	var result TokenVerification
+	body := map[string]string{"token": token}
+	if scope != "" {
+		body["scope"] = scope
+	}
+	if err := c.do(ctx, http.MethodPost, "/tokens/verify", nil, body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Webhook is a URL that a user registered to receive their notifications. An
+// empty Topics receives notifications on every topic.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Type      string    `json:"type"`
+	Topics    []string  `json:"topics"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is the result of sending a test notification to a webhook.
+// Status is the webhook's response status, if it responded.
+type WebhookDelivery struct {
+	Delivered bool   `json:"delivered"`
+	Status    int    `json:"status"`
+	Error     string `json:"error"`
+}
+
+// GetWebhooks returns the user's notification webhooks, oldest first. If topic
+// isn't empty, only the webhooks that receive notifications on it are
+// returned.
+func (c *Client) GetWebhooks(ctx context.Context, username, topic string) ([]Webhook, error) {
+	var result struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	var query url.Values
+	if topic != "" {
+		query = url.Values{"topic": []string{topic}}
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/webhooks", username), query, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Webhooks, nil
+}
+
+// AddWebhook registers a webhook of the type that receives the user's
+// notifications on the topics, or on every topic if there are none.
+func (c *Client) AddWebhook(ctx context.Context, username, webhookURL, webhookType string, topics []string) (*Webhook, error) {
+	var webhook Webhook
+	body := map[string]interface{}{"url": webhookURL, "type": webhookType, "topics": topics}
+	if err := c.do(ctx, http.MethodPost, userPath("/webhooks", username), nil, body, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// UpdateWebhook replaces the URL, type, and topics of one of the user's
+// webhooks.
+func (c *Client) UpdateWebhook(ctx context.Context, username, webhookID, webhookURL, webhookType string, topics []string) (*Webhook, error) {
+	var webhook Webhook
+	body := map[string]interface{}{"url": webhookURL, "type": webhookType, "topics": topics}
+	if err := c.do(ctx, http.MethodPut, userPath("/webhooks", username, webhookID), nil, body, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// DeleteWebhook deletes one of the user's webhooks.
+func (c *Client) DeleteWebhook(ctx context.Context, username, webhookID string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/webhooks", username, webhookID), nil, nil, nil)
+}
+
+// DeleteAllWebhooks deletes all of the user's webhooks.
+func (c *Client) DeleteAllWebhooks(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/webhooks", username), nil, nil, nil)
+}
+
+// TestWebhook sends a test notification to one of the user's webhooks. A
+// notification that wasn't delivered isn't an error; the result says what
+// went wrong.
+func (c *Client) TestWebhook(ctx context.Context, username, webhookID string) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	if err := c.do(ctx, http.MethodPost, userPath("/webhooks", username, webhookID, "test"), nil, nil, &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// DashboardWidget is a widget on a user's dashboard and the grid cell it's in.
+type DashboardWidget struct {
+	ID        string    `json:"id"`
+	Column    int       `json:"column"`
+	Row       int       `json:"row"`
+	Collapsed bool      `json:"collapsed"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// GetDashboard returns the widgets on the user's dashboard, by column and then
+// by row. The list is empty if the user hasn't laid out their dashboard.
+func (c *Client) GetDashboard(ctx context.Context, username string) ([]DashboardWidget, error) {
+	var result struct {
+		Widgets []DashboardWidget `json:"widgets"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/dashboard", username), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Widgets, nil
+}
+
+// SaveDashboard replaces the layout of the user's dashboard and returns it.
+// The widgets' UpdatedAt fields are ignored.
+func (c *Client) SaveDashboard(ctx context.Context, username string, widgets []DashboardWidget) ([]DashboardWidget, error) {
+	type placement struct {
+		ID        string `json:"id"`
+		Column    int    `json:"column"`
+		Row       int    `json:"row"`
+		Collapsed bool   `json:"collapsed"`
+	}
+	body := struct {
+		Widgets []placement `json:"widgets"`
+	}{Widgets: make([]placement, len(widgets))}
+	for i, widget := range widgets {
+		body.Widgets[i] = placement{ID: widget.ID, Column: widget.Column, Row: widget.Row, Collapsed: widget.Collapsed}
+	}
+
+	var result struct {
+		Widgets []DashboardWidget `json:"widgets"`
+	}
+	if err := c.do(ctx, http.MethodPut, userPath("/dashboard", username), nil, body, &result); err != nil {
+		return nil, err
+	}
+	return result.Widgets, nil
+}
+
+// PlaceWidget adds a widget to the user's dashboard, or moves it if it's
+// already there, without changing the other widgets.
+func (c *Client) PlaceWidget(ctx context.Context, username, widgetID string, column, row int, collapsed bool) (*DashboardWidget, error) {
+	var widget DashboardWidget
+	body := map[string]interface{}{"column": column, "row": row, "collapsed": collapsed}
+	if err := c.do(ctx, http.MethodPut, userPath("/dashboard", username, widgetID), nil, body, &widget); err != nil {
+		return nil, err
+	}
+	return &widget, nil
+}
+
+// RemoveWidget removes a widget from the user's dashboard.
+func (c *Client) RemoveWidget(ctx context.Context, username, widgetID string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/dashboard", username, widgetID), nil, nil, nil)
+}
+
+// ResetDashboard removes every widget from the user's dashboard, so that the
+// default layout applies again.
+func (c *Client) ResetDashboard(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/dashboard", username), nil, nil, nil)
+}
+
+// ConsentRecord is an entry in the ledger of a user's consents.
+type ConsentRecord struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Purpose    string    `json:"purpose"`
+	Granted    bool      `json:"granted"`
+	Source     string    `json:"source"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// Consent is the current state of a user's consent to a purpose. WithdrawnAt
+// is only set if the consent is withdrawn, and GrantedAt is nil if it was
+// never granted.
+type Consent struct {
+	Purpose     string     `json:"purpose"`
+	Granted     bool       `json:"granted"`
+	GrantedAt   *time.Time `json:"granted_at"`
+	WithdrawnAt *time.Time `json:"withdrawn_at"`
+	Source      string     `json:"source"`
+}
+
+// GetConsents returns the current state of the user's consents, by purpose.
+func (c *Client) GetConsents(ctx context.Context, username string) ([]Consent, error) {
+	var result struct {
+		Consents []Consent `json:"consents"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/consents", username), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Consents, nil
+}
+
+// RecordConsent records that the user granted or withdrew their consent to the
+// purpose through the source, e.g. "signup-form", and returns the record.
+func (c *Client) RecordConsent(ctx context.Context, username, purpose string, granted bool, source string) (*ConsentRecord, error) {
+	var record ConsentRecord
+	body := map[string]interface{}{"purpose": purpose, "granted": granted, "source": source}
+	if err := c.do(ctx, http.MethodPost, userPath("/consents", username), nil, body, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// GetConsentHistory returns up to limit of the user's consent records, newest
+// first, after skipping offset of them, along with the total number of
+// records. An empty purpose lists the records for every purpose.
+func (c *Client) GetConsentHistory(ctx context.Context, username, purpose string, limit, offset int) ([]ConsentRecord, int64, error) {
+	query := url.Values{
+		"limit":  []string{strconv.Itoa(limit)},
+		"offset": []string{strconv.Itoa(offset)},
+	}
+	if purpose != "" {
+		query.Set("purpose", purpose)
+	}
+
+	var page struct {
+		Items []ConsentRecord `json:"items"`
+		Total int64           `json:"total"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/consents", username, "history"), query, nil, &page); err != nil {
+		return nil, 0, err
+	}
+	return page.Items, page.Total, nil
+}
+
+// Identity maps the subject of a user's OIDC tokens, the sub claim, to their
+// username.
+type Identity struct {
+	Subject   string    `json:"subject"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetIdentityBySubject returns the mapping of the OIDC subject to a user. The
+// error is one that IsNotFound recognizes if the subject isn't mapped.
+func (c *Client) GetIdentityBySubject(ctx context.Context, subject string) (*Identity, error) {
+	var identity Identity
+	if err := c.do(ctx, http.MethodGet, userPath("/identity", "by-subject", subject), nil, nil, &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// GetIdentities returns the OIDC subjects mapped to the user, oldest first.
+func (c *Client) GetIdentities(ctx context.Context, username string) ([]Identity, error) {
+	var result struct {
+		Identities []Identity `json:"identities"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/identity", username), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Identities, nil
+}
+
+// MapSubject maps the OIDC subject to the user and returns the mapping. It
+// fails with a conflict if the subject is mapped to another user.
+func (c *Client) MapSubject(ctx context.Context, username, subject string) (*Identity, error) {
+	var identity Identity
+	if err := c.do(ctx, http.MethodPut, userPath("/identity", username, subject), nil, nil, &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// UnmapSubject removes the mapping of the OIDC subject to the user.
+func (c *Client) UnmapSubject(ctx context.Context, username, subject string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/identity", username, subject), nil, nil, nil)
+}
+
+// ActivityEntry is a write to a user's data in their activity feed. Keys lists
+// the top-level keys of the document that was written, or of the one that was
+// deleted.
+type ActivityEntry struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Module string    `json:"module"`
+	Action string    `json:"action"`
+	BagID  string    `json:"bag_id,omitempty"`
+	Keys   []string  `json:"keys,omitempty"`
+}
+
+// GetActivity returns up to limit of the entries in the user's activity feed,
+// newest first, after skipping offset of them, along with the total number of
+// entries. An empty module lists the writes to every kind of data.
+func (c *Client) GetActivity(ctx context.Context, username, module string, limit, offset int) ([]ActivityEntry, int64, error) {
+	query := url.Values{
+		"limit":  []string{strconv.Itoa(limit)},
+		"offset": []string{strconv.Itoa(offset)},
+	}
+	if module != "" {
+		query.Set("module", module)
+	}
+
+	var page struct {
+		Items []ActivityEntry `json:"items"`
+		Total int64           `json:"total"`
+	}
+	if err := c.do(ctx, http.MethodGet, userPath("/activity", username), query, nil, &page); err != nil {
+		return nil, 0, err
+	}
+	return page.Items, page.Total, nil
+}
+
+// DigestSchedule is when and how a user's notification digest is sent: at the
+// hour, in the IANA timezone, every day, every week on the day of the week (0
+// is Sunday), or every month on the day of the month. Day is nil for daily
+// digests.
+type DigestSchedule struct {
+	Username   string     `json:"username"`
+	Frequency  string     `json:"frequency"`
+	Day        *int       `json:"day"`
+	Hour       int        `json:"hour"`
+	Timezone   string     `json:"timezone"`
+	Channels   []string   `json:"channels"`
+	LastSentAt *time.Time `json:"last_sent_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// GetDigestSchedule returns the user's digest schedule. The error is one that
+// IsNotFound recognizes if the user doesn't have one.
+func (c *Client) GetDigestSchedule(ctx context.Context, username string) (*DigestSchedule, error) {
+	var schedule DigestSchedule
+	if err := c.do(ctx, http.MethodGet, userPath("/digests", username), nil, nil, &schedule); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// SaveDigestSchedule replaces the user's digest schedule and returns it as
+// it's stored.
+func (c *Client) SaveDigestSchedule(ctx context.Context, username string, schedule *DigestSchedule) (*DigestSchedule, error) {
+	body := map[string]interface{}{
+		"frequency": schedule.Frequency,
+		"day":       schedule.Day,
+		"hour":      schedule.Hour,
+		"timezone":  schedule.Timezone,
+		"channels":  schedule.Channels,
+	}
+
+	var saved DigestSchedule
+	if err := c.do(ctx, http.MethodPut, userPath("/digests", username), nil, body, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// DeleteDigestSchedule deletes the user's digest schedule, so that they're no
+// longer sent digests.
+func (c *Client) DeleteDigestSchedule(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath("/digests", username), nil, nil, nil)
+}
+
+// DueDigests returns up to limit of the digest schedules due at the time, by
+// username, after skipping offset of them, along with the total number that
+// are due. A zero time lists the ones due now.
+func (c *Client) DueDigests(ctx context.Context, at time.Time, limit, offset int) ([]DigestSchedule, int64, error) {
+	query := url.Values{
+		"limit":  []string{strconv.Itoa(limit)},
+		"offset": []string{strconv.Itoa(offset)},
+	}
+	if !at.IsZero() {
+		query.Set("at", at.Format(time.RFC3339))
+	}
+
+	var page struct {
+		Items []DigestSchedule `json:"items"`
+		Total int64            `json:"total"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/digests/due", query, nil, &page); err != nil {
+		return nil, 0, err
+	}
+	return page.Items, page.Total, nil
+}
+
+// MarkDigestsSent records that the digests of up to 1000 users were sent at
+// the time, or now if it's zero, and returns the number of schedules updated.
+// The usernames must include the user domain.
+func (c *Client) MarkDigestsSent(ctx context.Context, usernames []string, sentAt time.Time) (int64, error) {
+	body := map[string]interface{}{"usernames": usernames}
+	if !sentAt.IsZero() {
+		body["sent_at"] = sentAt
+	}
+
+	var result struct {
+		Updated int64 `json:"updated"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/digests/sent", nil, body, &result); err != nil {
+		return 0, err
+	}
+	return result.Updated, nil
+}
+
+// Locale is a user's IANA timezone and BCP 47 locale. UpdatedAt is nil if the
+// user hasn't set them, in which case they're the service's defaults.
+type Locale struct {
+	Username  string     `json:"username"`
+	Timezone  string     `json:"timezone"`
+	Locale    string     `json:"locale"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// GetLocale returns the user's timezone and locale, or the defaults if they
+// haven't set them.
+func (c *Client) GetLocale(ctx context.Context, username string) (*Locale, error) {
+	var locale Locale
+	if err := c.do(ctx, http.MethodGet, userPath("/locale", username), nil, nil, &locale); err != nil {
+		return nil, err
+	}
+	return &locale, nil
+}
+
+// SaveLocale replaces the user's timezone, e.g. "America/Phoenix", and locale,
+// e.g. "en-US", and returns them as they're stored, with the locale in its
+// canonical form.
+func (c *Client) SaveLocale(ctx context.Context, username, timezone, locale string) (*Locale, error) {
+	var saved Locale
+	body := map[string]string{"timezone": timezone, "locale": locale}
+	if err := c.do(ctx, http.MethodPut, userPath("/locale", username), nil, body, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
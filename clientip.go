@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers that proxies use to pass along the address of the client.
+const (
+	forwardedForHeader = "X-Forwarded-For"
+	realIPHeader       = "X-Real-IP"
+)
+
+type clientIPKey struct{}
+
+// TrustedProxies works out the address of the client that made each request.
+// When the service runs behind an ingress controller or load balancer, the
+// remote address of every request is the proxy's, so the address in the
+// X-Forwarded-For or X-Real-IP header is used instead, but only for requests
+// that come from a trusted proxy; anyone else could set the headers to
+// whatever they like.
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies returns a new *TrustedProxies that trusts the proxies in
+// the given networks, which are CIDR blocks or single IP addresses. With no
+// networks, the headers are ignored.
+func NewTrustedProxies(networks []string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid http.trusted_proxies entry: %q is not an IP address or CIDR block", network)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			network = fmt.Sprintf("%s/%d", network, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http.trusted_proxies entry: %w", err)
+		}
+		p.networks = append(p.networks, ipNet)
+	}
+	return p, nil
+}
+
+// trusted returns whether the address belongs to a trusted proxy.
+func (p *TrustedProxies) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of the request's remote address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientAddr returns the address of the client that made the request. The
+// X-Forwarded-For header is read from right to left, since each proxy appends
+// the address it received the request from, and the first address that isn't
+// a trusted proxy is the client's. X-Real-IP is used if there's no
+// X-Forwarded-For header.
+func (p *TrustedProxies) clientAddr(r *http.Request) string {
+	addr := remoteHost(r)
+	if !p.trusted(addr) {
+		return addr
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values(forwardedForHeader) {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				forwarded = append(forwarded, hop)
+			}
+		}
+	}
+
+	if len(forwarded) == 0 {
+		if realIP := strings.TrimSpace(r.Header.Get(realIPHeader)); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+		return addr
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			// Anything to the left of a malformed entry can't be trusted,
+			// so the request is attributed to the last trusted proxy.
+			return addr
+		}
+		addr = forwarded[i]
+		if !p.trusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// Middleware records the address of the client in the request context, where
+// clientIP finds it, and in the client_ip field of the request's log entries.
+func (p *TrustedProxies) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		addr := p.clientAddr(r)
+		setLogField(r.Context(), "client_ip", addr)
+		next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, addr)))
+	})
+}
+
+// clientIP returns the address of the client that made the request, as
+// recorded by TrustedProxies.Middleware, or the host part of the remote address
+// if it hasn't run.
+func clientIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return addr
+	}
+	return remoteHost(r)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// commandsUsage describes the subcommands in the usage message.
+const commandsUsage = `
+Commands:
+  serve
+        Serve the API. This is the default.
+  migrate [up|down|version]
+        Apply, roll back, or report the database migrations.
+  purge-user <username>
+        Delete everything stored for the user.
+  export-user [-format zip|json] [-output path] <username>
+        Export everything stored for the user.
+  prune-sessions -older-than <duration>
+        Delete the sessions that haven't been updated within the duration.
+`
+
+// maintenanceCommands lists the subcommands that run a maintenance task and
+// exit, instead of serving the API.
+var maintenanceCommands = map[string]bool{
+	"migrate":        true,
+	"purge-user":     true,
+	"export-user":    true,
+	"prune-sessions": true,
+}
+
+// runCommand runs one of the maintenanceCommands with the rest of the
+// command line's arguments, writing its output to stdout.
+func runCommand(ctx context.Context, command string, args []string, cfg *viper.Viper, settings *tunables, db *sql.DB, stdout io.Writer) error {
+	if command == "migrate" {
+		return runMigrateCommand(db, args)
+	}
+
+	cache, err := cacheFromConfig(cfg, settings.cacheTTL)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "purge-user":
+		return runPurgeUserCommand(ctx, NewUsersDB(db, cache), newUserDomains(settings.userDomain, settings.userDomains), args, stdout)
+	case "export-user":
+		return runExportUserCommand(ctx, NewUsersDB(db, cache), newUserDomains(settings.userDomain, settings.userDomains), args, stdout)
+	case "prune-sessions":
+		return runPruneSessionsCommand(ctx, NewSessionsDB(db, cache), args, stdout)
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+}
+
+// commandUsername returns the single username argument of a subcommand.
+func commandUsername(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		return "", fmt.Errorf("%s takes a single username", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+// runPurgeUserCommand runs the purge-user subcommand, which deletes everything
+// stored for a user and prints the number of rows deleted from each table.
+func runPurgeUserCommand(ctx context.Context, users *UsersDB, domains userDomains, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("purge-user", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	username, err := commandUsername(fs)
+	if err != nil {
+		return err
+	}
+
+	exists, err := users.isUser(ctx, username)
+	if err != nil {
+		return fmt.Errorf("error checking for username %s: %w", username, err)
+	}
+	if !exists {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	report, err := users.purgeUser(ctx, username, domains.bagsUsername(username))
+	if err != nil {
+		return fmt.Errorf("error purging data for user %s: %w", username, err)
+	}
+
+	log.Infof("purged data for user %s: %v", username, report)
+
+	return json.NewEncoder(stdout).Encode(map[string]interface{}{
+		"user":    username,
+		"deleted": report,
+	})
+}
+
+// runExportUserCommand runs the export-user subcommand, which writes
+// everything stored for a user to a file, or to stdout if no output file is
+// given. The output file is removed if the export fails.
+func runExportUserCommand(ctx context.Context, users *UsersDB, domains userDomains, args []string, stdout io.Writer) (err error) {
+	fs := flag.NewFlagSet("export-user", flag.ContinueOnError)
+	format := fs.String("format", "zip", "The export format, zip or json")
+	output := fs.String("output", "", "The file to write the export to, instead of stdout")
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != "zip" && *format != "json" {
+		return fmt.Errorf("unsupported export format '%s'; use zip or json", *format)
+	}
+
+	username, err := commandUsername(fs)
+	if err != nil {
+		return err
+	}
+
+	exists, err := users.isUser(ctx, username)
+	if err != nil {
+		return fmt.Errorf("error checking for username %s: %w", username, err)
+	}
+	if !exists {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	w := stdout
+	if *output != "" {
+		var f *os.File
+		if f, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(*output) // nolint:errcheck
+			}
+		}()
+		w = f
+	}
+
+	export, err := streamExport(ctx, users, username, domains.bagsUsername(username), func() exportWriter {
+		if *format == "json" {
+			return &jsonExport{w: w}
+		}
+		return &zipExport{zw: zip.NewWriter(w)}
+	})
+	if err != nil {
+		return fmt.Errorf("error exporting data for user %s: %w", username, err)
+	}
+
+	return export.close()
+}
+
+// runPruneSessionsCommand runs the prune-sessions subcommand, which deletes the
+// sessions that haven't been updated recently and prints how many were
+// deleted.
+func runPruneSessionsCommand(ctx context.Context, sessions *SessionsDB, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("prune-sessions", flag.ContinueOnError)
+	olderThan := fs.Duration("older-than", 0, "Delete the sessions that haven't been updated within this duration, e.g. 720h")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return errors.New("prune-sessions doesn't take any arguments")
+	}
+	if *olderThan <= 0 {
+		return errors.New("-older-than must be set to a positive duration")
+	}
+
+	usernames, err := sessions.pruneSessions(ctx, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+
+	log.Infof("pruned the sessions of %d users", len(usernames))
+
+	_, err = fmt.Fprintf(stdout, "pruned %d sessions\n", len(usernames))
+	return err
+}
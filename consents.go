@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// Limits on the number of consent records listed per request.
+const (
+	defaultConsentLimit = 100
+	maxConsentLimit     = 1000
+)
+
+// ConsentsApp keeps the ledger of the consents users grant and withdraw, such
+// as consent to be emailed about new features, for compliance audits. Records
+// can only be added; the current state of a user's consents is derived from
+// their latest records.
+type ConsentsApp struct {
+	consents    *ConsentsDB
+	purposes    []string
+	router      *mux.Router
+	adminRouter *mux.Router
+}
+
+// NewConsentsApp returns a new *ConsentsApp. If purposes isn't empty, consent
+// can only be recorded for those purposes. The adminRouter should be the admin
+// router returned by newAdminRouter.
+func NewConsentsApp(db *ConsentsDB, purposes []string, router, adminRouter *mux.Router) *ConsentsApp {
+	consentsApp := &ConsentsApp{
+		consents:    db,
+		purposes:    purposes,
+		router:      moduleRouter(router, "consents", "/consents"),
+		adminRouter: moduleRouter(adminRouter, "consents", "/consents"),
+	}
+	consentsApp.router.HandleFunc("/{username}", consentsApp.GetRequest).Methods(http.MethodGet)
+	consentsApp.router.HandleFunc("/{username}", consentsApp.PostRequest).Methods(http.MethodPost)
+	consentsApp.router.HandleFunc("/{username}/history", consentsApp.HistoryRequest).Methods(http.MethodGet)
+	consentsApp.adminRouter.HandleFunc("", consentsApp.ListRequest).Methods(http.MethodGet)
+	return consentsApp
+}
+
+// consentFilter parses the consent record filter from the request's query
+// parameters.
+func consentFilter(r *http.Request) (*ConsentFilter, error) {
+	var (
+		err    error
+		params = r.URL.Query()
+		filter = &ConsentFilter{
+			Username: params.Get("username"),
+			Purpose:  params.Get("purpose"),
+		}
+	)
+
+	if err = parseTimeRange(params, &filter.Since, &filter.Until); err != nil {
+		return nil, err
+	}
+
+	if filter.Page, err = httpapi.ParsePage(r, defaultConsentLimit, maxConsentLimit); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// GetRequest returns the current state of the user's consents, by purpose, as
+// {"consents": [...]}. Purposes the user has no records for aren't listed.
+func (c *ConsentsApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, c.consents.isUser)
+	if !ok {
+		return
+	}
+
+	consents, err := c.consents.getConsents(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the consents of user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"consents": consents})
+}
+
+// PostRequest records that the user granted or withdrew their consent. The
+// body is {"purpose": ..., "granted": ..., "source": ...}, where source says
+// where the user made the choice, e.g. "signup-form". The response is the
+// stored record.
+func (c *ConsentsApp) PostRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, c.consents.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Purpose string `json:"purpose"`
+		Granted *bool  `json:"granted"`
+		Source  string `json:"source"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+
+	invalid := make(map[string]string)
+	switch {
+	case !identifierPattern.MatchString(body.Purpose):
+		invalid["purpose"] = "purposes are up to 128 letters, digits, dots, colons, underscores, and hyphens"
+	case len(c.purposes) > 0 && !slices.Contains(c.purposes, body.Purpose):
+		invalid["purpose"] = fmt.Sprintf("must be one of %s", strings.Join(c.purposes, ", "))
+	}
+	if body.Granted == nil {
+		invalid["granted"] = "whether consent was granted or withdrawn is required"
+	}
+	if !identifierPattern.MatchString(body.Source) {
+		invalid["source"] = "sources are up to 128 letters, digits, dots, colons, underscores, and hyphens"
+	}
+	if len(invalid) > 0 {
+		httpapi.InvalidFields(writer, invalid)
+		return
+	}
+
+	record := ConsentRecord{Purpose: body.Purpose, Granted: *body.Granted, Source: body.Source}
+	if err := c.consents.addRecord(r.Context(), username, &record); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error recording the consent of user %s to %s: %s", username, body.Purpose, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusCreated, &record)
+}
+
+// HistoryRequest returns a page of the user's consent records, newest first.
+// The purpose query parameter limits it to the records for one purpose, and
+// since and until to the records from a range of time.
+func (c *ConsentsApp) HistoryRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, c.consents.isUser)
+	if !ok {
+		return
+	}
+
+	filter, err := consentFilter(r)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+	filter.Username = username
+
+	records, total, err := c.consents.listRecords(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing the consent records of user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, filter.Page, records, total)
+}
+
+// ListRequest returns a page of the consent records of every user matching
+// the query parameters, newest first.
+func (c *ConsentsApp) ListRequest(writer http.ResponseWriter, r *http.Request) {
+	filter, err := consentFilter(r)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	records, total, err := c.consents.listRecords(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing consent records: %s", err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, filter.Page, records, total)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/cyverse-de/user-info/internal/httpapi"
+)
+
+// ConsentRecord is an entry in the ledger of a user's consents: the user
+// granted or withdrew their consent to a purpose, through the source, e.g. the
+// sign-up form. Records are never changed once they're stored.
+type ConsentRecord struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Purpose    string    `json:"purpose"`
+	Granted    bool      `json:"granted"`
+	Source     string    `json:"source"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// Consent is the current state of a user's consent to a purpose, as of their
+// latest record for it. WithdrawnAt is only set if the consent is withdrawn,
+// and GrantedAt is nil if it was never granted. Source is where the latest
+// record came from.
+type Consent struct {
+	Purpose     string     `json:"purpose"`
+	Granted     bool       `json:"granted"`
+	GrantedAt   *time.Time `json:"granted_at"`
+	WithdrawnAt *time.Time `json:"withdrawn_at"`
+	Source      string     `json:"source"`
+}
+
+// currentConsents returns the current state of the consents in the records,
+// which must be oldest first, sorted by purpose.
+func currentConsents(records []ConsentRecord) []Consent {
+	byPurpose := make(map[string]*Consent)
+	for i := range records {
+		record := &records[i]
+		consent, ok := byPurpose[record.Purpose]
+		if !ok {
+			consent = &Consent{Purpose: record.Purpose}
+			byPurpose[record.Purpose] = consent
+		}
+
+		consent.Granted, consent.Source = record.Granted, record.Source
+		if record.Granted {
+			consent.GrantedAt, consent.WithdrawnAt = &record.RecordedAt, nil
+		} else {
+			consent.WithdrawnAt = &record.RecordedAt
+		}
+	}
+
+	consents := make([]Consent, 0, len(byPurpose))
+	for _, consent := range byPurpose {
+		consents = append(consents, *consent)
+	}
+	sort.Slice(consents, func(i, j int) bool { return consents[i].Purpose < consents[j].Purpose })
+	return consents
+}
+
+// ConsentFilter selects the consent records to list. Empty fields match every
+// record.
+type ConsentFilter struct {
+	Username string
+	Purpose  string
+	Since    time.Time
+	Until    time.Time
+	httpapi.Page
+}
+
+// query returns the query for the records matching the filter, without its
+// sort order or page.
+func (f *ConsentFilter) query() *selectQuery {
+	q := selectFrom("user_consents c", "c.id", "u.username", "c.purpose", "c.granted", "c.source", "c.recorded_at").
+		Join("users u", "c.user_id = u.id")
+
+	if f.Username != "" {
+		q.Where("u.username = ?", f.Username)
+	}
+	if f.Purpose != "" {
+		q.Where("c.purpose = ?", f.Purpose)
+	}
+	if !f.Since.IsZero() {
+		q.Where("c.recorded_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q.Where("c.recorded_at < ?", f.Until)
+	}
+
+	return q
+}
+
+// ConsentsDB handles interacting with the user_consents table, which is only
+// ever appended to, apart from purging users.
+type ConsentsDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewConsentsDB returns a newly created *ConsentsDB. Only user lookups are
+// cached in cache, which may be nil to disable caching.
+func NewConsentsDB(db *sql.DB, cache Cache) *ConsentsDB {
+	return &ConsentsDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// isUser returns whether or not the user is present in the database.
+func (c *ConsentsDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, c.cache, c.db, username)
+}
+
+// addRecord appends a record to the user's ledger, filling in its ID and the
+// time it was recorded.
+func (c *ConsentsDB) addRecord(ctx context.Context, username string, record *ConsentRecord) error {
+	query := `INSERT INTO user_consents (user_id, purpose, granted, source)
+                   VALUES ($1, $2, $3, $4)
+                RETURNING id, recorded_at`
+
+	userID, err := queries.UserID(ctx, c.db, username)
+	if err != nil {
+		return err
+	}
+
+	if err = c.db.QueryRowContext(ctx, query, userID, record.Purpose, record.Granted, record.Source).Scan(&record.ID, &record.RecordedAt); err != nil {
+		return dbError(err)
+	}
+	record.Username = username
+
+	c.notify(ctx, Mutation{Module: "consents", Action: actionCreated, Username: username})
+	return nil
+}
+
+// scanConsentRecords reads the records returned by a query built by
+// ConsentFilter.query.
+func scanConsentRecords(rows *sql.Rows) ([]ConsentRecord, error) {
+	defer rows.Close()
+
+	records := []ConsentRecord{}
+	for rows.Next() {
+		var record ConsentRecord
+		if err := rows.Scan(&record.ID, &record.Username, &record.Purpose, &record.Granted, &record.Source, &record.RecordedAt); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, dbError(rows.Err())
+}
+
+// getConsents returns the current state of the user's consents, by purpose.
+func (c *ConsentsDB) getConsents(ctx context.Context, username string) ([]Consent, error) {
+	filter := ConsentFilter{Username: username}
+	query, args := filter.query().OrderBy("c.recorded_at", "c.id").SQL()
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	records, err := scanConsentRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+	return currentConsents(records), nil
+}
+
+// listRecords returns the page of the records matching the filter, newest
+// first, along with the total number of matching records.
+func (c *ConsentsDB) listRecords(ctx context.Context, filter *ConsentFilter) ([]ConsentRecord, int64, error) {
+	var total int64
+
+	q := filter.query()
+
+	countQuery, countArgs := q.Count().SQL()
+	if err := c.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	query, args := q.OrderBy("c.recorded_at DESC", "c.id").Page(filter.Page).SQL()
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	records, err := scanConsentRecords(rows)
+	return records, total, err
+}
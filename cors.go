@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/handlers"
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete}
+	defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", httpapi.RequestIDHeader}
+)
+
+// corsHandler returns middleware that adds CORS headers to responses for the
+// allowed origins and answers preflight requests. It wraps the whole router
+// rather than being added with router.Use() so that OPTIONS requests are
+// handled even though no routes are registered for them.
+func corsHandler(origins, methods, headers []string) func(http.Handler) http.Handler {
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+
+	return handlers.CORS(
+		handlers.AllowedOrigins(origins),
+		handlers.AllowedMethods(methods),
+		handlers.AllowedHeaders(headers),
+		handlers.ExposedHeaders([]string{httpapi.RequestIDHeader, "Retry-After", httpapi.TotalCountHeader, "X-Default-Bag-ID"}),
+	)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// maxDashboardWidgets is the most widgets a dashboard can have, which is also
+// the number of rows each column has.
+const maxDashboardWidgets = 100
+
+// DashboardApp manages the layout of users' dashboards: which widgets they
+// show, where, and whether they're collapsed. The layout is kept apart from
+// the preferences so that single widgets can be moved without rewriting the
+// rest.
+type DashboardApp struct {
+	dashboard *DashboardDB
+	widgets   map[string]bool
+	columns   int
+	router    *mux.Router
+}
+
+// NewDashboardApp returns a new *DashboardApp. Dashboards have the number of
+// columns, and if widgets isn't empty, can only show those widgets.
+func NewDashboardApp(db *DashboardDB, widgets []string, columns int, router *mux.Router) *DashboardApp {
+	d := &DashboardApp{
+		dashboard: db,
+		widgets:   make(map[string]bool, len(widgets)),
+		columns:   columns,
+		router:    moduleRouter(router, "dashboard", "/dashboard"),
+	}
+	for _, widget := range widgets {
+		d.widgets[widget] = true
+	}
+	d.router.HandleFunc("/{username}", d.GetRequest).Methods(http.MethodGet)
+	d.router.HandleFunc("/{username}", d.PutRequest).Methods(http.MethodPut)
+	d.router.HandleFunc("/{username}", d.DeleteRequest).Methods(http.MethodDelete)
+	d.router.HandleFunc("/{username}/{widgetID}", d.PutWidgetRequest).Methods(http.MethodPut)
+	d.router.HandleFunc("/{username}/{widgetID}", d.DeleteWidgetRequest).Methods(http.MethodDelete)
+	return d
+}
+
+// validID returns what's wrong with the widget ID, if anything.
+func (d *DashboardApp) validID(id string) string {
+	if !identifierPattern.MatchString(id) {
+		return fmt.Sprintf("invalid widget ID: %q", id)
+	}
+	if len(d.widgets) > 0 && !d.widgets[id] {
+		return fmt.Sprintf("unknown widget: %q", id)
+	}
+	return ""
+}
+
+// placementProblems returns what's wrong with the column and row a widget is
+// placed in, keyed by field. Either may be nil if it's missing.
+func (d *DashboardApp) placementProblems(column, row *int) map[string]string {
+	problems := make(map[string]string)
+	switch {
+	case column == nil:
+		problems["column"] = "a column is required"
+	case *column < 0 || *column >= d.columns:
+		problems["column"] = fmt.Sprintf("must be from 0 to %d", d.columns-1)
+	}
+	switch {
+	case row == nil:
+		problems["row"] = "a row is required"
+	case *row < 0 || *row >= maxDashboardWidgets:
+		problems["row"] = fmt.Sprintf("must be from 0 to %d", maxDashboardWidgets-1)
+	}
+	return problems
+}
+
+// dashboardWidgetBody is a widget in the body of a request to lay out a
+// dashboard.
+type dashboardWidgetBody struct {
+	ID        string `json:"id"`
+	Column    *int   `json:"column"`
+	Row       *int   `json:"row"`
+	Collapsed bool   `json:"collapsed"`
+}
+
+// validLayout returns the widgets in the body and what's wrong with them, if
+// anything, keyed by field, e.g. "widgets[2].row".
+func (d *DashboardApp) validLayout(body []dashboardWidgetBody) ([]DashboardWidget, map[string]string) {
+	problems := make(map[string]string)
+	if body == nil {
+		problems["widgets"] = "a list of widgets is required"
+		return nil, problems
+	}
+	if len(body) > maxDashboardWidgets {
+		problems["widgets"] = fmt.Sprintf("at most %d widgets are allowed", maxDashboardWidgets)
+		return nil, problems
+	}
+
+	widgets := make([]DashboardWidget, 0, len(body))
+	ids := make(map[string]bool, len(body))
+	cells := make(map[[2]int]string, len(body))
+	for i, widget := range body {
+		field := fmt.Sprintf("widgets[%d]", i)
+		if problem := d.validID(widget.ID); problem != "" {
+			problems[field+".id"] = problem
+		} else if ids[widget.ID] {
+			problems[field+".id"] = fmt.Sprintf("widget %s is listed more than once", widget.ID)
+		}
+		ids[widget.ID] = true
+
+		placement := d.placementProblems(widget.Column, widget.Row)
+		for name, problem := range placement {
+			problems[field+"."+name] = problem
+		}
+		if len(placement) > 0 {
+			continue
+		}
+
+		cell := [2]int{*widget.Column, *widget.Row}
+		if other, ok := cells[cell]; ok {
+			problems[field] = fmt.Sprintf("widget %s is in the same cell", other)
+		}
+		cells[cell] = widget.ID
+		widgets = append(widgets, DashboardWidget{ID: widget.ID, Column: *widget.Column, Row: *widget.Row, Collapsed: widget.Collapsed})
+	}
+	return widgets, problems
+}
+
+// GetRequest returns the widgets on the user's dashboard, by column and then
+// by row, as {"widgets": [...]}. The list is empty if the user hasn't laid out
+// their dashboard.
+func (d *DashboardApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.dashboard.isUser)
+	if !ok {
+		return
+	}
+
+	widgets, err := d.dashboard.getLayout(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the dashboard of user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"widgets": widgets})
+}
+
+// PutRequest replaces the layout of the user's dashboard with the one in the
+// body, {"widgets": [{"id": ..., "column": ..., "row": ..., "collapsed": ...}]},
+// and responds with it, with a 201 if the user had no layout before.
+func (d *DashboardApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.dashboard.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Widgets []dashboardWidgetBody `json:"widgets"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+	widgets, problems := d.validLayout(body.Widgets)
+	if len(problems) > 0 {
+		httpapi.InvalidFields(writer, problems)
+		return
+	}
+
+	created, err := d.dashboard.setLayout(r.Context(), username, widgets)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error storing the dashboard of user %s: %s", username, err))
+		return
+	}
+	if widgets, err = d.dashboard.getLayout(r.Context(), username); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the dashboard of user %s: %s", username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, map[string]interface{}{"widgets": widgets})
+}
+
+// DeleteRequest removes every widget from the user's dashboard, so that the
+// default layout applies again.
+func (d *DashboardApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.dashboard.isUser)
+	if !ok {
+		return
+	}
+
+	deleted, err := d.dashboard.deleteLayout(r.Context(), username)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting the dashboard of user %s: %s", username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("no dashboard layout is stored for user %s", username))
+	}
+}
+
+// PutWidgetRequest places a widget on the user's dashboard from the body,
+// {"column": ..., "row": ..., "collapsed": ...}, moving it if it's already
+// there, and responds with it. The response is a 201 if the widget is new to
+// the dashboard, and a 409 if another widget is in the cell.
+func (d *DashboardApp) PutWidgetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.dashboard.isUser)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["widgetID"]
+	if problem := d.validID(id); problem != "" {
+		httpapi.BadRequest(writer, problem)
+		return
+	}
+
+	var body struct {
+		Column    *int `json:"column"`
+		Row       *int `json:"row"`
+		Collapsed bool `json:"collapsed"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+	if problems := d.placementProblems(body.Column, body.Row); len(problems) > 0 {
+		httpapi.InvalidFields(writer, problems)
+		return
+	}
+
+	widget := DashboardWidget{ID: id, Column: *body.Column, Row: *body.Row, Collapsed: body.Collapsed}
+	created, err := d.dashboard.putWidget(r.Context(), username, &widget)
+	if err != nil {
+		msg := fmt.Sprintf("error placing widget %s on the dashboard of user %s: %s", id, username, err)
+		if isConflict(err) {
+			msg = fmt.Sprintf("another widget is in column %d, row %d of the dashboard of user %s", widget.Column, widget.Row, username)
+		}
+		writeFailed(writer, err, msg)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, widget)
+}
+
+// DeleteWidgetRequest removes a widget from the user's dashboard.
+func (d *DashboardApp) DeleteWidgetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.dashboard.isUser)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["widgetID"]
+	if !identifierPattern.MatchString(id) {
+		httpapi.BadRequest(writer, fmt.Sprintf("invalid widget ID: %q", id))
+		return
+	}
+
+	deleted, err := d.dashboard.deleteWidget(r.Context(), username, id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error removing widget %s from the dashboard of user %s: %s", id, username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("widget %s isn't on the dashboard of user %s", id, username))
+	}
+}
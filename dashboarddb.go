@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/lib/pq"
+)
+
+// DashboardWidget is a widget on a user's dashboard and where it's placed.
+// Widgets are laid out on a grid, and no two widgets can share a cell.
+type DashboardWidget struct {
+	ID        string    `json:"id"`
+	Column    int       `json:"column"`
+	Row       int       `json:"row"`
+	Collapsed bool      `json:"collapsed"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DashboardDB handles interacting with the user_dashboard_widgets table.
+type DashboardDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewDashboardDB returns a newly created *DashboardDB. Reads are cached in
+// cache, which may be nil to disable caching.
+func NewDashboardDB(db *sql.DB, cache Cache) *DashboardDB {
+	return &DashboardDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func dashboardKey(username string) string {
+	return cacheKey("dashboard", "widgets", username)
+}
+
+// isUser returns whether or not the user is present in the database.
+func (d *DashboardDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, d.cache, d.db, username)
+}
+
+// getLayout returns the widgets on the user's dashboard, by column and then by
+// row.
+func (d *DashboardDB) getLayout(ctx context.Context, username string) ([]DashboardWidget, error) {
+	if widgets, ok := cacheGet[[]DashboardWidget](ctx, d.cache, dashboardKey(username)); ok {
+		return widgets, nil
+	}
+
+	query, args := userRows("user_dashboard_widgets", "w", username, "w.widget_id", "w.grid_column", "w.grid_row", "w.collapsed", "w.updated_at").
+		OrderBy("w.grid_column", "w.grid_row").
+		SQL()
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	widgets := []DashboardWidget{}
+	for rows.Next() {
+		var widget DashboardWidget
+		if err = rows.Scan(&widget.ID, &widget.Column, &widget.Row, &widget.Collapsed, &widget.UpdatedAt); err != nil {
+			return nil, err
+		}
+		widgets = append(widgets, widget)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cacheSet(ctx, d.cache, dashboardKey(username), widgets)
+	return widgets, nil
+}
+
+// setLayout replaces the widgets on the user's dashboard. Returns whether the
+// user had no layout before.
+func (d *DashboardDB) setLayout(ctx context.Context, username string, widgets []DashboardWidget) (bool, error) {
+	defer cacheInvalidate(ctx, d.cache, dashboardKey(username))
+
+	userID, err := queries.UserID(ctx, d.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	ids := make([]string, len(widgets))
+	columns := make([]int64, len(widgets))
+	rows := make([]int64, len(widgets))
+	collapsed := make([]bool, len(widgets))
+	for i, widget := range widgets {
+		ids[i], columns[i], rows[i], collapsed[i] = widget.ID, int64(widget.Column), int64(widget.Row), widget.Collapsed
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, dbError(err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM ONLY user_dashboard_widgets WHERE user_id = $1`, userID)
+	if err != nil {
+		return false, dbError(err)
+	}
+	replaced, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	query := `INSERT INTO user_dashboard_widgets (user_id, widget_id, grid_column, grid_row, collapsed)
+                   SELECT $1, w.widget_id, w.grid_column, w.grid_row, w.collapsed
+                     FROM unnest($2::text[], $3::integer[], $4::integer[], $5::boolean[]) AS w(widget_id, grid_column, grid_row, collapsed)`
+	if _, err = tx.ExecContext(ctx, query, userID, pq.Array(ids), pq.Array(columns), pq.Array(rows), pq.Array(collapsed)); err != nil {
+		return false, dbError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, dbError(err)
+	}
+
+	action := actionUpdated
+	if replaced == 0 {
+		action = actionCreated
+	}
+	d.notify(ctx, Mutation{Module: "dashboard", Action: action, Username: username})
+	return replaced == 0, nil
+}
+
+// putWidget adds the widget to the user's dashboard, or replaces its
+// placement if it's already there. Placing it in a cell another widget is in
+// is a conflict. Returns whether the widget is new.
+func (d *DashboardDB) putWidget(ctx context.Context, username string, widget *DashboardWidget) (bool, error) {
+	defer cacheInvalidate(ctx, d.cache, dashboardKey(username))
+
+	query := `INSERT INTO user_dashboard_widgets (user_id, widget_id, grid_column, grid_row, collapsed)
+                   VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (user_id, widget_id) DO UPDATE
+                      SET grid_column = EXCLUDED.grid_column,
+                          grid_row = EXCLUDED.grid_row,
+                          collapsed = EXCLUDED.collapsed,
+                          updated_at = now()
+                RETURNING (xmax = 0) AS created, updated_at`
+
+	userID, err := queries.UserID(ctx, d.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	var created bool
+	if err = d.db.QueryRowContext(ctx, query, userID, widget.ID, widget.Column, widget.Row, widget.Collapsed).
+		Scan(&created, &widget.UpdatedAt); err != nil {
+		return false, dbError(err)
+	}
+
+	action := actionUpdated
+	if created {
+		action = actionCreated
+	}
+	d.notify(ctx, Mutation{Module: "dashboard", Action: action, Username: username})
+	return created, nil
+}
+
+// deleteWidget removes a widget from the user's dashboard. Returns whether
+// the widget was on it.
+func (d *DashboardDB) deleteWidget(ctx context.Context, username, widgetID string) (bool, error) {
+	defer cacheInvalidate(ctx, d.cache, dashboardKey(username))
+
+	query := `DELETE FROM ONLY user_dashboard_widgets w
+                    USING users u
+                    WHERE w.user_id = u.id AND w.widget_id = $1 AND u.username = $2`
+
+	result, err := d.db.ExecContext(ctx, query, widgetID, username)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		d.notify(ctx, Mutation{Module: "dashboard", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
+
+// deleteLayout removes every widget from the user's dashboard, so that the
+// default layout applies again. Returns whether the user had a layout.
+func (d *DashboardDB) deleteLayout(ctx context.Context, username string) (bool, error) {
+	defer cacheInvalidate(ctx, d.cache, dashboardKey(username))
+
+	userID, err := queries.UserID(ctx, d.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := d.db.ExecContext(ctx, `DELETE FROM ONLY user_dashboard_widgets WHERE user_id = $1`, userID)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		d.notify(ctx, Mutation{Module: "dashboard", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
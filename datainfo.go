@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// pathChecker checks whether paths exist in the data store.
+type pathChecker interface {
+	pathsExist(ctx context.Context, username string, paths []string) (map[string]bool, error)
+}
+
+// DataInfoClient checks for paths in the data store through the data-info service.
+type DataInfoClient struct {
+	baseURL *url.URL
+	client  *http.Client
+}
+
+// NewDataInfoClient returns a new *DataInfoClient that sends requests to the
+// data-info service at baseURL.
+func NewDataInfoClient(baseURL string, timeout time.Duration) (*DataInfoClient, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the data-info base URL %s: %w", baseURL, err)
+	}
+
+	return &DataInfoClient{
+		baseURL: parsed,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// pathsExist asks data-info which of the paths exist and are visible to the user.
+// The username may be qualified with a domain; data-info expects it without one.
+func (d *DataInfoClient) pathsExist(ctx context.Context, username string, paths []string) (map[string]bool, error) {
+	var result struct {
+		Paths map[string]bool `json:"paths"`
+	}
+
+	body, err := json.Marshal(map[string][]string{"paths": paths})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := d.baseURL.JoinPath("existence-marker")
+	endpoint.RawQuery = url.Values{"user": []string{regexp.MustCompile(`@.*$`).ReplaceAllString(username, "")}}.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error checking paths with data-info: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("data-info returned status %d while checking paths", response.StatusCode)
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding the response from data-info: %w", err)
+	}
+
+	return result.Paths, nil
+}
+
+// BagItemValidation reports whether the path of an item in a bag exists in the
+// data store. Index is the position of the item within the list in Field.
+type BagItemValidation struct {
+	Field  string `json:"field"`
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+// bagItemPaths returns an entry for every item with a path in the list-valued
+// fields of the bag contents, ordered by field and then by index.
+func bagItemPaths(contents BagContents) []BagItemValidation {
+	fields := make([]string, 0, len(contents))
+	for field := range contents {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	refs := []BagItemValidation{}
+	for _, field := range fields {
+		list, ok := contents[field].([]interface{})
+		if !ok {
+			continue
+		}
+		for i, element := range list {
+			item, ok := element.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if path, ok := item["path"].(string); ok && path != "" {
+				refs = append(refs, BagItemValidation{Field: field, Index: i, Path: path})
+			}
+		}
+	}
+	return refs
+}
+
+// validateBagContents checks every item path in the contents against the data
+// store. The returned bool is true if every path exists.
+func validateBagContents(ctx context.Context, checker pathChecker, username string, contents BagContents) ([]BagItemValidation, bool, error) {
+	refs := bagItemPaths(contents)
+	if len(refs) == 0 {
+		return refs, true, nil
+	}
+
+	paths := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		paths = append(paths, ref.Path)
+	}
+
+	exists, err := checker.pathsExist(ctx, username, paths)
+	if err != nil {
+		return nil, false, err
+	}
+
+	valid := true
+	for i := range refs {
+		refs[i].Exists = exists[refs[i].Path]
+		valid = valid && refs[i].Exists
+	}
+	return refs, valid, nil
+}
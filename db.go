@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// dbDriverName returns the database/sql driver name for the db.driver setting.
+// "pq" (the default) uses lib/pq; "pgx" uses pgx through its database/sql
+// adapter, which cancels queries on the server when their contexts are done.
+func dbDriverName(driver string) (string, error) {
+	switch strings.ToLower(driver) {
+	case "", "pq", "postgres":
+		return "postgres", nil
+	case "pgx":
+		return "pgx", nil
+	default:
+		return "", fmt.Errorf("unsupported database driver: %s", driver)
+	}
+}
+
+// schemaNamePattern matches the names accepted for db.schema. They're
+// unquoted identifiers, so they're limited to the characters that don't need
+// quoting, in lower case since PostgreSQL folds unquoted names to lower case.
+var schemaNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// withSearchPath sets the search_path run-time parameter in the database URI
+// to the schema, so that the unqualified table names in the service's queries
+// and migrations refer to the tables in that schema instead of public. An
+// empty schema leaves the URI as it is.
+func withSearchPath(uri, schema string) (string, error) {
+	if schema == "" {
+		return uri, nil
+	}
+	if !schemaNamePattern.MatchString(schema) {
+		return "", fmt.Errorf("invalid db.schema %q: must be a lower case identifier", schema)
+	}
+	return withRuntimeParam(uri, "search_path", schema)
+}
+
+// createSchema creates the schema if it doesn't already exist, so that
+// migrations can create the service's tables in it.
+func createSchema(ctx context.Context, db *sql.DB, schema string) error {
+	if _, err := db.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+schema); err != nil {
+		return fmt.Errorf("error creating schema %s: %w", schema, dbError(err))
+	}
+	return nil
+}
+
+// dbError adds the detail, hint, and constraint name reported by PostgreSQL to
+// err, whichever driver produced it. Other errors are returned as they are.
+func dbError(err error) error {
+	var detail, hint, constraint string
+
+	var pgErr *pgconn.PgError
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pgErr):
+		detail, hint, constraint = pgErr.Detail, pgErr.Hint, pgErr.ConstraintName
+	case errors.As(err, &pqErr):
+		detail, hint, constraint = pqErr.Detail, pqErr.Hint, pqErr.Constraint
+	default:
+		return err
+	}
+
+	var parts []string
+	if detail != "" {
+		parts = append(parts, "detail: "+detail)
+	}
+	if hint != "" {
+		parts = append(parts, "hint: "+hint)
+	}
+	if constraint != "" {
+		parts = append(parts, "constraint: "+constraint)
+	}
+	if len(parts) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%w (%s)", err, strings.Join(parts, "; "))
+}
+
+// isConflict returns whether err is a PostgreSQL error saying the write
+// conflicts with data that's already stored, such as a unique constraint
+// violation.
+func isConflict(err error) bool {
+	var code string
+
+	var pgErr *pgconn.PgError
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pgErr):
+		code = pgErr.Code
+	case errors.As(err, &pqErr):
+		code = string(pqErr.Code)
+	default:
+		return false
+	}
+
+	// unique_violation and exclusion_violation.
+	return code == "23505" || code == "23P01"
+}
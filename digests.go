@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// maxDigestSentUsers is the most users whose digests can be marked as sent in
+// one request.
+const maxDigestSentUsers = 1000
+
+// Limits on the number of due schedules listed per request.
+const (
+	defaultDigestLimit = 100
+	maxDigestLimit     = 1000
+)
+
+// DigestsApp manages when users are sent digests of their notifications. The
+// digest sender lists the schedules that are due every hour, sends them, and
+// marks them as sent.
+type DigestsApp struct {
+	digests  *DigestsDB
+	channels []string
+	router   *mux.Router
+}
+
+// NewDigestsApp returns a new *DigestsApp. channels are the delivery channels
+// that digests can be sent through.
+func NewDigestsApp(db *DigestsDB, channels []string, router *mux.Router) *DigestsApp {
+	d := &DigestsApp{
+		digests:  db,
+		channels: channels,
+		router:   moduleRouter(router, "digests", "/digests"),
+	}
+	d.router.HandleFunc("/due", d.DueRequest).Methods(http.MethodGet)
+	d.router.HandleFunc("/sent", d.SentRequest).Methods(http.MethodPost)
+	d.router.HandleFunc("/{username}", d.GetRequest).Methods(http.MethodGet)
+	d.router.HandleFunc("/{username}", d.PutRequest).Methods(http.MethodPut)
+	d.router.HandleFunc("/{username}", d.DeleteRequest).Methods(http.MethodDelete)
+	return d
+}
+
+// validate returns what's wrong with each invalid field in the schedule.
+func (d *DigestsApp) validate(schedule *DigestSchedule) map[string]string {
+	invalid := make(map[string]string)
+
+	switch schedule.Frequency {
+	case digestDaily:
+		if schedule.Day != nil {
+			invalid["day"] = "daily digests don't have a day"
+		}
+	case digestWeekly:
+		if schedule.Day == nil || *schedule.Day < 0 || *schedule.Day > 6 {
+			invalid["day"] = "weekly digests need a day of the week from 0 (Sunday) to 6 (Saturday)"
+		}
+	case digestMonthly:
+		if schedule.Day == nil || *schedule.Day < 1 || *schedule.Day > 28 {
+			invalid["day"] = "monthly digests need a day of the month from 1 to 28"
+		}
+	default:
+		invalid["frequency"] = fmt.Sprintf("must be one of %s, %s, %s", digestDaily, digestWeekly, digestMonthly)
+	}
+
+	if schedule.Hour < 0 || schedule.Hour > 23 {
+		invalid["hour"] = "must be from 0 to 23"
+	}
+	if !validTimezone(schedule.Timezone) {
+		invalid["timezone"] = "must be an IANA timezone, e.g. America/Phoenix"
+	}
+
+	if len(schedule.Channels) == 0 {
+		invalid["channels"] = "at least one channel is required"
+	}
+	for i, channel := range schedule.Channels {
+		switch {
+		case !slices.Contains(d.channels, channel):
+			invalid["channels"] = fmt.Sprintf("unknown channel %q; expected one of %s", channel, strings.Join(d.channels, ", "))
+		case slices.Contains(schedule.Channels[:i], channel):
+			invalid["channels"] = fmt.Sprintf("channel %q is listed more than once", channel)
+		}
+	}
+
+	return invalid
+}
+
+// GetRequest returns the user's digest schedule, or a 404 if they don't have
+// one.
+func (d *DigestsApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.digests.isUser)
+	if !ok {
+		return
+	}
+
+	schedule, err := d.digests.getSchedule(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the digest schedule of user %s: %s", username, err))
+		return
+	}
+	if schedule == nil {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s doesn't have a digest schedule", username))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, schedule)
+}
+
+// PutRequest replaces the user's digest schedule and responds with it, with a
+// 201 if the user had none before. The body is {"frequency": ..., "day": ...,
+// "hour": ..., "timezone": ..., "channels": [...]}; changing the schedule
+// doesn't change when the digest was last sent.
+func (d *DigestsApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.digests.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Frequency string   `json:"frequency"`
+		Day       *int     `json:"day"`
+		Hour      *int     `json:"hour"`
+		Timezone  string   `json:"timezone"`
+		Channels  []string `json:"channels"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+
+	schedule := &DigestSchedule{
+		Frequency: body.Frequency,
+		Day:       body.Day,
+		Timezone:  body.Timezone,
+		Channels:  body.Channels,
+	}
+	if body.Hour != nil {
+		schedule.Hour = *body.Hour
+	}
+	invalid := d.validate(schedule)
+	if body.Hour == nil {
+		invalid["hour"] = "the hour to send digests at is required"
+	}
+	if len(invalid) > 0 {
+		httpapi.InvalidFields(writer, invalid)
+		return
+	}
+
+	created, err := d.digests.setSchedule(r.Context(), username, schedule)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error storing the digest schedule of user %s: %s", username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, schedule)
+}
+
+// DeleteRequest deletes the user's digest schedule, so that they're no longer
+// sent digests.
+func (d *DigestsApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, d.digests.isUser)
+	if !ok {
+		return
+	}
+
+	deleted, err := d.digests.deleteSchedule(r.Context(), username)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting the digest schedule of user %s: %s", username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s doesn't have a digest schedule", username))
+	}
+}
+
+// DueRequest returns a page of the schedules whose digests are due, by
+// username. The at query parameter is an RFC 3339 timestamp to list the
+// schedules due at instead of now. Schedules stay due until they're marked as
+// sent or their hour is over.
+func (d *DigestsApp) DueRequest(writer http.ResponseWriter, r *http.Request) {
+	at := time.Now()
+	if value := r.URL.Query().Get("at"); value != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			httpapi.BadRequest(writer, fmt.Sprintf("at must be an RFC 3339 timestamp: %s", value))
+			return
+		}
+	}
+
+	page, err := httpapi.ParsePage(r, defaultDigestLimit, maxDigestLimit)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	schedules, total, err := d.digests.dueSchedules(r.Context(), at, page)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing the digest schedules due at %s: %s", at.Format(time.RFC3339), err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, page, schedules, total)
+}
+
+// SentRequest records that the users' digests were sent, so that they're no
+// longer due. The body is {"usernames": [...], "sent_at": ...}, where the
+// usernames are as they're stored, with their user domains, and sent_at
+// defaults to now. The response is {"updated": n}, the number of schedules
+// marked as sent; users without a schedule are skipped.
+func (d *DigestsApp) SentRequest(writer http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Usernames []string   `json:"usernames"`
+		SentAt    *time.Time `json:"sent_at"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+	if len(body.Usernames) == 0 || len(body.Usernames) > maxDigestSentUsers {
+		httpapi.InvalidFields(writer, map[string]string{
+			"usernames": fmt.Sprintf("from 1 to %d usernames are required", maxDigestSentUsers),
+		})
+		return
+	}
+
+	sentAt := time.Now()
+	if body.SentAt != nil {
+		sentAt = *body.SentAt
+	}
+
+	updated, err := d.digests.markSent(r.Context(), body.Usernames, sentAt)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error marking digests as sent: %s", err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]int64{"updated": updated})
+}
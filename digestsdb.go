@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/lib/pq"
+)
+
+// The frequencies that notification digests can be sent at.
+const (
+	digestDaily   = "daily"
+	digestWeekly  = "weekly"
+	digestMonthly = "monthly"
+)
+
+// DigestSchedule is when and how a user's notification digest is sent. Digests
+// are sent at the hour, in the timezone, every day, every week on the day of
+// the week (0 is Sunday), or every month on the day of the month. Day is nil
+// for daily digests. LastSentAt is when the digest was last sent, if ever.
+type DigestSchedule struct {
+	Username   string     `json:"username"`
+	Frequency  string     `json:"frequency"`
+	Day        *int       `json:"day"`
+	Hour       int        `json:"hour"`
+	Timezone   string     `json:"timezone"`
+	Channels   []string   `json:"channels"`
+	LastSentAt *time.Time `json:"last_sent_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// digestColumns are the columns that scanDigestSchedule reads, with the
+// schedules table aliased as d.
+var digestColumns = []string{"u.username", "d.frequency", "d.day", "d.hour", "d.timezone", "d.channels", "d.last_sent_at", "d.updated_at"}
+
+// scanDigestSchedule reads a schedule selected with digestColumns.
+func scanDigestSchedule(row interface{ Scan(...interface{}) error }) (*DigestSchedule, error) {
+	var (
+		schedule DigestSchedule
+		day      sql.NullInt64
+	)
+	if err := row.Scan(&schedule.Username, &schedule.Frequency, &day, &schedule.Hour, &schedule.Timezone,
+		pq.Array(&schedule.Channels), &schedule.LastSentAt, &schedule.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if day.Valid {
+		d := int(day.Int64)
+		schedule.Day = &d
+	}
+	return &schedule, nil
+}
+
+// DigestsDB handles interacting with the user_digest_schedules table.
+type DigestsDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewDigestsDB returns a newly created *DigestsDB. Reads of a single user's
+// schedule are cached in cache, which may be nil to disable caching.
+func NewDigestsDB(db *sql.DB, cache Cache) *DigestsDB {
+	return &DigestsDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func digestScheduleKey(username string) string {
+	return cacheKey("digests", "schedule", username)
+}
+
+// isUser returns whether or not the user is present in the database.
+func (d *DigestsDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, d.cache, d.db, username)
+}
+
+// getSchedule returns the user's digest schedule, or nil if they don't have
+// one.
+func (d *DigestsDB) getSchedule(ctx context.Context, username string) (*DigestSchedule, error) {
+	if schedule, ok := cacheGet[*DigestSchedule](ctx, d.cache, digestScheduleKey(username)); ok {
+		return schedule, nil
+	}
+
+	query, args := userRows("user_digest_schedules", "d", username, digestColumns...).SQL()
+	schedule, err := scanDigestSchedule(d.db.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		schedule, err = nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	cacheSet(ctx, d.cache, digestScheduleKey(username), schedule)
+	return schedule, nil
+}
+
+// setSchedule stores the user's digest schedule, filling in when it was
+// updated and last sent. Returns whether the user had no schedule before.
+func (d *DigestsDB) setSchedule(ctx context.Context, username string, schedule *DigestSchedule) (bool, error) {
+	defer cacheInvalidate(ctx, d.cache, digestScheduleKey(username))
+
+	query := `INSERT INTO user_digest_schedules (user_id, frequency, day, hour, timezone, channels)
+                   VALUES ($1, $2, $3, $4, $5, $6)
+              ON CONFLICT (user_id) DO UPDATE
+                      SET frequency = EXCLUDED.frequency,
+                          day = EXCLUDED.day,
+                          hour = EXCLUDED.hour,
+                          timezone = EXCLUDED.timezone,
+                          channels = EXCLUDED.channels,
+                          updated_at = now()
+                RETURNING (xmax = 0) AS created, last_sent_at, updated_at`
+
+	userID, err := queries.UserID(ctx, d.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		created bool
+		day     sql.NullInt64
+	)
+	if schedule.Day != nil {
+		day = sql.NullInt64{Int64: int64(*schedule.Day), Valid: true}
+	}
+	if err = d.db.QueryRowContext(ctx, query, userID, schedule.Frequency, day, schedule.Hour, schedule.Timezone, pq.Array(schedule.Channels)).
+		Scan(&created, &schedule.LastSentAt, &schedule.UpdatedAt); err != nil {
+		return false, dbError(err)
+	}
+	schedule.Username = username
+
+	action := actionUpdated
+	if created {
+		action = actionCreated
+	}
+	d.notify(ctx, Mutation{Module: "digests", Action: action, Username: username})
+	return created, nil
+}
+
+// deleteSchedule removes the user's digest schedule, so that they aren't sent
+// digests. Returns whether they had a schedule.
+func (d *DigestsDB) deleteSchedule(ctx context.Context, username string) (bool, error) {
+	defer cacheInvalidate(ctx, d.cache, digestScheduleKey(username))
+
+	query := `DELETE FROM ONLY user_digest_schedules d
+                    USING users u
+                    WHERE d.user_id = u.id AND u.username = $1`
+
+	result, err := d.db.ExecContext(ctx, query, username)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		d.notify(ctx, Mutation{Module: "digests", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
+
+// dueSchedules returns the page of the schedules whose digests are due at the
+// time, by username, along with the total number that are due. A digest is due
+// when the time falls in its hour on one of its days, in its timezone, and it
+// hasn't been sent since that hour started.
+func (d *DigestsDB) dueSchedules(ctx context.Context, at time.Time, page httpapi.Page) ([]DigestSchedule, int64, error) {
+	var total int64
+
+	q := selectFrom("user_digest_schedules d", digestColumns...).
+		Join("users u", "d.user_id = u.id").
+		Where("d.hour = extract(hour FROM ?::timestamptz AT TIME ZONE d.timezone)", at).
+		Where("(d.frequency = 'daily'"+
+			" OR (d.frequency = 'weekly' AND d.day = extract(dow FROM ?::timestamptz AT TIME ZONE d.timezone))"+
+			" OR (d.frequency = 'monthly' AND d.day = extract(day FROM ?::timestamptz AT TIME ZONE d.timezone)))", at, at).
+		Where("(d.last_sent_at IS NULL OR d.last_sent_at AT TIME ZONE d.timezone < date_trunc('hour', ?::timestamptz AT TIME ZONE d.timezone))", at)
+
+	countQuery, countArgs := q.Count().SQL()
+	if err := d.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	query, args := q.OrderBy("u.username").Page(page).SQL()
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, dbError(err)
+	}
+	defer rows.Close()
+
+	schedules := []DigestSchedule{}
+	for rows.Next() {
+		schedule, err := scanDigestSchedule(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		schedules = append(schedules, *schedule)
+	}
+	return schedules, total, dbError(rows.Err())
+}
+
+// markSent records that the users' digests were sent at the time. Users
+// without a schedule are skipped. Returns the number of schedules updated.
+func (d *DigestsDB) markSent(ctx context.Context, usernames []string, sentAt time.Time) (int64, error) {
+	keys := make([]string, len(usernames))
+	for i, username := range usernames {
+		keys[i] = digestScheduleKey(username)
+	}
+	defer cacheInvalidate(ctx, d.cache, keys...)
+
+	query := `UPDATE ONLY user_digest_schedules d
+                 SET last_sent_at = $1
+                FROM users u
+               WHERE d.user_id = u.id AND u.username = ANY($2)`
+
+	result, err := d.db.ExecContext(ctx, query, sentAt, pq.Array(usernames))
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/cyverse-de/queries"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mutation actions.
+const (
+	actionCreated = "created"
+	actionUpdated = "updated"
+	actionDeleted = "deleted"
+	actionPurged  = "purged"
+
+	actionDeactivated = "deactivated"
+	actionReactivated = "reactivated"
+)
+
+// Mutation describes a committed write to the data stored for a user.
+// Module is the kind of data that was written, e.g. "preferences" or "bags",
+// and BagID is set for writes to a single bag. Before and After summarize the
+// document that was replaced and the one that was written, when there was one.
+// Before is only looked up when observers are registered.
+type Mutation struct {
+	Module   string
+	Action   string
+	Username string
+	BagID    string
+	Before   *DocumentSummary
+	After    *DocumentSummary
+}
+
+// DocumentSummary describes a stored JSON document without including its
+// contents.
+type DocumentSummary struct {
+	Bytes int      `json:"bytes"`
+	Keys  []string `json:"keys,omitempty"`
+}
+
+// summarizeDocument returns a summary of the document, listing its top-level
+// keys if it's a JSON object. Returns nil for an empty document.
+func summarizeDocument(doc string) *DocumentSummary {
+	if doc == "" {
+		return nil
+	}
+
+	summary := &DocumentSummary{Bytes: len(doc)}
+
+	var object map[string]json.RawMessage
+	if json.Unmarshal([]byte(doc), &object) == nil {
+		for key := range object {
+			summary.Keys = append(summary.Keys, key)
+		}
+		sort.Strings(summary.Keys)
+	}
+
+	return summary
+}
+
+// readSummary runs a query that returns a single document and summarizes it.
+// It returns nil if there's no document or the query fails, since the summary
+// is informational and shouldn't stop the write it describes.
+func readSummary(ctx context.Context, db queries.DBAccessor, query string, args ...interface{}) *DocumentSummary {
+	var doc string
+	if err := db.QueryRowContext(ctx, query, args...).Scan(&doc); err != nil {
+		if err != sql.ErrNoRows {
+			log.WithContext(ctx).Errorf("error reading the document being replaced: %s", err)
+		}
+		return nil
+	}
+	return summarizeDocument(doc)
+}
+
+// EventType returns the name of the mutation's event, e.g. "bags.updated".
+func (m Mutation) EventType() string {
+	return m.Module + "." + m.Action
+}
+
+// MutationObserver is notified after data is written on behalf of a user.
+// Observe must not block; the context belongs to the request that made the
+// write, when there was one.
+type MutationObserver interface {
+	Observe(ctx context.Context, m Mutation)
+}
+
+// mutationSource is implemented by the types that notify observers of their
+// writes.
+type mutationSource interface {
+	AddObserver(o MutationObserver)
+}
+
+// mutationNotifier is embedded in the *DB types to let observers register for
+// their writes.
+type mutationNotifier struct {
+	mu        sync.RWMutex
+	observers []MutationObserver
+}
+
+// AddObserver registers an observer for the writes made through the type.
+func (n *mutationNotifier) AddObserver(o MutationObserver) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.observers = append(n.observers, o)
+}
+
+// observed returns whether any observers are registered, so that writes can
+// skip looking up details that only observers use.
+func (n *mutationNotifier) observed() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.observers) > 0
+}
+
+// notify tells the observers about a write.
+func (n *mutationNotifier) notify(ctx context.Context, m Mutation) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, o := range n.observers {
+		o.Observe(ctx, m)
+	}
+}
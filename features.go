@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// The states that a module can be set to in the modules settings.
+const (
+	// moduleEnabled serves the module's routes. It's the default.
+	moduleEnabled = "enabled"
+
+	// moduleDisabled responds to the module's routes with a 404, for
+	// deployments that don't use the module.
+	moduleDisabled = "disabled"
+
+	// moduleOffline responds to the module's routes with a 503, for taking a
+	// module offline during an incident.
+	moduleOffline = "offline"
+)
+
+// ModuleFlags turns the modules of the HTTP API on and off at runtime. Every
+// router returned by moduleRouter checks the state of its module before
+// handling a request.
+type ModuleFlags struct {
+	mu     sync.RWMutex
+	states map[string]string
+	known  map[string]bool
+}
+
+// NewModuleFlags returns a new *ModuleFlags with every module enabled.
+func NewModuleFlags() *ModuleFlags {
+	return &ModuleFlags{
+		states: make(map[string]string),
+		known:  make(map[string]bool),
+	}
+}
+
+// moduleFlags holds the state of every module. main sets the states from the
+// modules settings.
+var moduleFlags = NewModuleFlags()
+
+// moduleStatesFromConfig returns the states of the modules in the modules
+// settings, e.g. modules.bags: disabled.
+func moduleStatesFromConfig(cfg *viper.Viper) (map[string]string, error) {
+	states := make(map[string]string)
+	for name, state := range cfg.GetStringMapString("modules") {
+		state = strings.ToLower(strings.TrimSpace(state))
+		switch state {
+		case moduleEnabled, moduleDisabled, moduleOffline:
+			states[name] = state
+		default:
+			return nil, fmt.Errorf("invalid modules.%s: %q; use %s, %s, or %s", name, state, moduleEnabled, moduleDisabled, moduleOffline)
+		}
+	}
+	return states, nil
+}
+
+// SetStates replaces the states of the modules. Modules that aren't listed are
+// enabled. A warning is logged for modules that no router has been registered
+// for, since they're probably misspelled.
+func (f *ModuleFlags) SetStates(states map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.states = make(map[string]string, len(states))
+	var unknown []string
+	for name, state := range states {
+		f.states[name] = state
+		if !f.known[name] {
+			unknown = append(unknown, name)
+		}
+		if state != moduleEnabled {
+			log.Warnf("the %s module is %s", name, state)
+		}
+	}
+
+	if len(unknown) > 0 && len(f.known) > 0 {
+		sort.Strings(unknown)
+		log.Warnf("the modules settings name unknown modules: %s", strings.Join(unknown, ", "))
+	}
+}
+
+// state returns the state of the named module.
+func (f *ModuleFlags) state(name string) string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if state, ok := f.states[name]; ok {
+		return state
+	}
+	return moduleEnabled
+}
+
+// Middleware returns middleware that responds to requests for the named module
+// with a 404 while it's disabled, or a 503 while it's offline.
+func (f *ModuleFlags) Middleware(name string) mux.MiddlewareFunc {
+	f.mu.Lock()
+	f.known[name] = true
+	f.mu.Unlock()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+			var status int
+			switch f.state(name) {
+			case moduleDisabled:
+				status = http.StatusNotFound
+			case moduleOffline:
+				status = http.StatusServiceUnavailable
+			default:
+				next.ServeHTTP(writer, r)
+				return
+			}
+
+			msg := fmt.Sprintf("the %s module is %s", name, f.state(name))
+			httpapi.WriteProblem(writer, status, httpapi.CodeModuleDisabled, msg, map[string]interface{}{
+				"module": name,
+			})
+			log.WithContext(r.Context()).Error(msg)
+		})
+	}
+}
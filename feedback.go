@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits on the number of feedback submissions listed per request.
+const (
+	defaultFeedbackLimit = 100
+	maxFeedbackLimit     = 1000
+)
+
+// feedbackColumns are the columns of the CSV export that come before the
+// answers.
+var feedbackColumns = []string{"id", "username", "form_id", "submitted_at"}
+
+// FeedbackApp stores users' responses to feedback forms and surveys, and lets
+// admins list and export them.
+type FeedbackApp struct {
+	feedback    *FeedbackDB
+	router      *mux.Router
+	adminRouter *mux.Router
+}
+
+// NewFeedbackApp returns a new *FeedbackApp. The adminRouter should be the
+// admin router returned by newAdminRouter.
+func NewFeedbackApp(db *FeedbackDB, router, adminRouter *mux.Router) *FeedbackApp {
+	feedbackApp := &FeedbackApp{
+		feedback:    db,
+		router:      moduleRouter(router, "feedback", "/feedback"),
+		adminRouter: moduleRouter(adminRouter, "feedback", "/feedback"),
+	}
+	feedbackApp.router.HandleFunc("/{username}", feedbackApp.GetRequest).Methods(http.MethodGet)
+	feedbackApp.router.HandleFunc("/{username}", feedbackApp.PostRequest).Methods(http.MethodPost)
+	feedbackApp.adminRouter.HandleFunc("", feedbackApp.ListRequest).Methods(http.MethodGet)
+	feedbackApp.adminRouter.HandleFunc("/export", feedbackApp.ExportRequest).Methods(http.MethodGet)
+	return feedbackApp
+}
+
+// feedbackFilter parses the feedback filter from the request's query
+// parameters.
+func feedbackFilter(r *http.Request) (*FeedbackFilter, error) {
+	var (
+		err    error
+		params = r.URL.Query()
+		filter = &FeedbackFilter{
+			Username: params.Get("username"),
+			FormID:   params.Get("form_id"),
+		}
+	)
+
+	if err = parseTimeRange(params, &filter.Since, &filter.Until); err != nil {
+		return nil, err
+	}
+
+	if filter.Page, err = httpapi.ParsePage(r, defaultFeedbackLimit, maxFeedbackLimit); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// GetRequest returns a page of the user's submissions, newest first. The
+// form_id query parameter limits it to the responses to one form.
+func (f *FeedbackApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, f.feedback.isUser)
+	if !ok {
+		return
+	}
+
+	filter, err := feedbackFilter(r)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+	filter.Username = username
+
+	submissions, total, err := f.feedback.listFeedback(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing the feedback from user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, filter.Page, submissions, total)
+}
+
+// PostRequest stores a submission from the user. The body is a JSON object
+// with the form_id and the answers, which must be a JSON object. The response
+// is the stored submission.
+func (f *FeedbackApp) PostRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, f.feedback.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		FormID  string          `json:"form_id"`
+		Answers json.RawMessage `json:"answers"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+
+	invalid := make(map[string]string)
+	if !identifierPattern.MatchString(body.FormID) {
+		invalid["form_id"] = "form IDs are up to 128 letters, digits, dots, colons, underscores, and hyphens"
+	}
+	if trimmed := bytes.TrimSpace(body.Answers); len(trimmed) == 0 || trimmed[0] != '{' {
+		invalid["answers"] = "the answers must be a JSON object"
+	}
+	if len(invalid) > 0 {
+		httpapi.InvalidFields(writer, invalid)
+		return
+	}
+
+	feedback := Feedback{FormID: body.FormID, Answers: body.Answers}
+	if err := f.feedback.addFeedback(r.Context(), username, &feedback); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error storing feedback from user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusCreated, &feedback)
+}
+
+// ListRequest returns a page of the submissions matching the query
+// parameters, newest first.
+func (f *FeedbackApp) ListRequest(writer http.ResponseWriter, r *http.Request) {
+	filter, err := feedbackFilter(r)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	submissions, total, err := f.feedback.listFeedback(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing feedback: %s", err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, filter.Page, submissions, total)
+}
+
+// feedbackCSV returns the rows of the CSV export of the submissions, starting
+// with the header. Each top-level answer gets a column, sorted by name after
+// the fixed columns. String answers are written as is and other answers as
+// JSON; answers a submission doesn't have are left empty.
+func feedbackCSV(submissions []Feedback) ([][]string, error) {
+	answers := make([]map[string]json.RawMessage, len(submissions))
+	seen := make(map[string]bool)
+	var keys []string
+	for i, feedback := range submissions {
+		if err := json.Unmarshal(feedback.Answers, &answers[i]); err != nil {
+			return nil, fmt.Errorf("error parsing the answers of submission %s: %w", feedback.ID, err)
+		}
+		for key := range answers[i] {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	records := [][]string{append(append([]string{}, feedbackColumns...), keys...)}
+	for i, feedback := range submissions {
+		record := []string{feedback.ID, feedback.Username, feedback.FormID, feedback.SubmittedAt.UTC().Format(time.RFC3339)}
+		for _, key := range keys {
+			var s string
+			value, ok := answers[i][key]
+			switch {
+			case !ok || string(value) == "null":
+			case json.Unmarshal(value, &s) == nil:
+			default:
+				s = string(value)
+			}
+			record = append(record, s)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// ExportRequest responds with every submission matching the query parameters
+// as a CSV file, oldest first. The limit and offset parameters are ignored.
+func (f *FeedbackApp) ExportRequest(writer http.ResponseWriter, r *http.Request) {
+	filter, err := feedbackFilter(r)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	submissions, err := f.feedback.exportFeedback(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error exporting feedback: %s", err))
+		return
+	}
+
+	records, err := feedbackCSV(submissions)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error exporting feedback: %s", err))
+		return
+	}
+
+	filename := fmt.Sprintf("feedback-%s.csv", time.Now().UTC().Format("20060102T150405Z"))
+	writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if err = csv.NewWriter(writer).WriteAll(records); err != nil {
+		log.WithContext(r.Context()).Errorf("error writing the feedback export: %s", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/cyverse-de/user-info/internal/httpapi"
+)
+
+// Feedback is a user's response to a feedback form or survey. Answers is the
+// JSON object that was submitted, which is stored as is.
+type Feedback struct {
+	ID          string          `json:"id"`
+	Username    string          `json:"username"`
+	FormID      string          `json:"form_id"`
+	Answers     json.RawMessage `json:"answers"`
+	SubmittedAt time.Time       `json:"submitted_at"`
+}
+
+// FeedbackFilter selects the feedback to list or export. Empty fields match
+// every submission.
+type FeedbackFilter struct {
+	Username string
+	FormID   string
+	Since    time.Time
+	Until    time.Time
+	httpapi.Page
+}
+
+// query returns the query for the submissions matching the filter, without
+// its sort order or page.
+func (f *FeedbackFilter) query() *selectQuery {
+	q := selectFrom("user_feedback f", "f.id", "u.username", "f.form_id", "f.answers", "f.submitted_at").
+		Join("users u", "f.user_id = u.id")
+
+	if f.Username != "" {
+		q.Where("u.username = ?", f.Username)
+	}
+	if f.FormID != "" {
+		q.Where("f.form_id = ?", f.FormID)
+	}
+	if !f.Since.IsZero() {
+		q.Where("f.submitted_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q.Where("f.submitted_at < ?", f.Until)
+	}
+
+	return q
+}
+
+// FeedbackDB handles interacting with the user_feedback table.
+type FeedbackDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewFeedbackDB returns a newly created *FeedbackDB. Only user lookups are
+// cached in cache, which may be nil to disable caching.
+func NewFeedbackDB(db *sql.DB, cache Cache) *FeedbackDB {
+	return &FeedbackDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// isUser returns whether or not the user is present in the database.
+func (f *FeedbackDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, f.cache, f.db, username)
+}
+
+// addFeedback stores a submission from the user, filling in its ID and
+// submission time.
+func (f *FeedbackDB) addFeedback(ctx context.Context, username string, feedback *Feedback) error {
+	query := `INSERT INTO user_feedback (user_id, form_id, answers)
+                   VALUES ($1, $2, $3)
+                RETURNING id, submitted_at`
+
+	userID, err := queries.UserID(ctx, f.db, username)
+	if err != nil {
+		return err
+	}
+
+	// The answers are sent as a string since lib/pq sends []byte as bytea.
+	if err = f.db.QueryRowContext(ctx, query, userID, feedback.FormID, string(feedback.Answers)).Scan(&feedback.ID, &feedback.SubmittedAt); err != nil {
+		return dbError(err)
+	}
+	feedback.Username = username
+
+	f.notify(ctx, Mutation{Module: "feedback", Action: actionCreated, Username: username})
+	return nil
+}
+
+// scanFeedback reads the submissions returned by a query built by
+// FeedbackFilter.query.
+func scanFeedback(rows *sql.Rows) ([]Feedback, error) {
+	defer rows.Close()
+
+	submissions := []Feedback{}
+	for rows.Next() {
+		var (
+			feedback Feedback
+			answers  []byte
+		)
+		if err := rows.Scan(&feedback.ID, &feedback.Username, &feedback.FormID, &answers, &feedback.SubmittedAt); err != nil {
+			return nil, err
+		}
+		feedback.Answers = answers
+		submissions = append(submissions, feedback)
+	}
+
+	return submissions, dbError(rows.Err())
+}
+
+// listFeedback returns the page of the submissions matching the filter, newest
+// first, along with the total number of matching submissions.
+func (f *FeedbackDB) listFeedback(ctx context.Context, filter *FeedbackFilter) ([]Feedback, int64, error) {
+	var total int64
+
+	q := filter.query()
+
+	countQuery, countArgs := q.Count().SQL()
+	if err := f.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	query, args := q.OrderBy("f.submitted_at DESC", "f.id").Page(filter.Page).SQL()
+	rows, err := f.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	submissions, err := scanFeedback(rows)
+	return submissions, total, err
+}
+
+// exportFeedback returns every submission matching the filter, ignoring its
+// page, oldest first.
+func (f *FeedbackDB) exportFeedback(ctx context.Context, filter *FeedbackFilter) ([]Feedback, error) {
+	query, args := filter.query().OrderBy("f.submitted_at", "f.id").SQL()
+	rows, err := f.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return scanFeedback(rows)
+}
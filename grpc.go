@@ -0,0 +1,604 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative userinfopb/userinfo.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/user-info/userinfopb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCServer implements the UserInfo gRPC service on top of the same apps and
+// database layer as the HTTP endpoints.
+type GRPCServer struct {
+	userinfopb.UnimplementedUserInfoServer
+
+	prefs    *UserPreferencesApp
+	sessions *UserSessionsApp
+	searches *SavedSearchesApp
+	bags     *BagsApp
+}
+
+// NewGRPCServer returns a new *GRPCServer that uses the given apps.
+func NewGRPCServer(prefs *UserPreferencesApp, sessions *UserSessionsApp, searches *SavedSearchesApp, bags *BagsApp) *GRPCServer {
+	return &GRPCServer{
+		prefs:    prefs,
+		sessions: sessions,
+		searches: searches,
+		bags:     bags,
+	}
+}
+
+// newGRPCServer returns a *grpc.Server with the UserInfo service registered.
+// API keys are checked and usernames are normalized the same way as they are
+// for HTTP requests, using the request metadata, and requests get the same
+// deadline. Usernames are left alone if usernames is nil, and requests get no
+// deadline if timeout is nil. The server uses TLS if tlsConfig isn't nil.
+func newGRPCServer(srv *GRPCServer, auth *APIKeyAuth, usernames *UsernameNormalizer, timeout *QueryTimeout, tlsConfig *tls.Config) *grpc.Server {
+	interceptors := []grpc.UnaryServerInterceptor{auth.UnaryInterceptor}
+	if usernames != nil {
+		interceptors = append(interceptors, usernames.UnaryInterceptor)
+	}
+	if timeout != nil {
+		interceptors = append(interceptors, timeout.UnaryInterceptor)
+	}
+
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(interceptors...)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(opts...)
+	userinfopb.RegisterUserInfoServer(server, srv)
+	return server
+}
+
+// UnaryInterceptor is the gRPC equivalent of Middleware. Keys are read from
+// the authorization metadata, as in "authorization: ApiKey <key>".
+func (a *APIKeyAuth) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			header = values[0]
+		}
+	}
+
+	scheme, key, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, apiKeyScheme) {
+		if a.required {
+			return nil, status.Error(codes.Unauthenticated, "an API key is required")
+		}
+		return handler(ctx, req)
+	}
+
+	name, ok := a.lookup(strings.TrimSpace(key))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+
+	log.WithFields(log.Fields{"api_key": name, "method": info.FullMethod}).Debug("handling gRPC request")
+	return handler(context.WithValue(ctx, apiKeyNameKey{}, name), req)
+}
+
+// grpcInternal logs the error and returns it with the INTERNAL code.
+func grpcInternal(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	log.Error(msg)
+	return status.Error(codes.Internal, msg)
+}
+
+// checkGRPCUser returns an error with the appropriate code if the username is
+// missing or doesn't belong to an existing user.
+func checkGRPCUser(ctx context.Context, isUser func(context.Context, string) (bool, error), username string) error {
+	if username == "" {
+		return status.Error(codes.InvalidArgument, "missing username")
+	}
+
+	exists, err := isUser(ctx, username)
+	if err != nil {
+		return grpcInternal("error checking for username %s: %s", username, err)
+	}
+	if !exists {
+		return status.Errorf(codes.NotFound, "user %s does not exist", username)
+	}
+	return nil
+}
+
+// jsonToValue converts a JSON document to a *structpb.Value.
+func jsonToValue(doc []byte) (*structpb.Value, error) {
+	var value structpb.Value
+	if err := protojson.Unmarshal(doc, &value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// documentJSON returns the content of the document, which must be an object, as
+// JSON.
+func documentJSON(doc *userinfopb.Document) (string, error) {
+	content := doc.GetContent()
+	if content == nil {
+		return "", status.Error(codes.InvalidArgument, "missing content")
+	}
+	if _, ok := content.GetKind().(*structpb.Value_StructValue); !ok {
+		return "", status.Error(codes.InvalidArgument, "content must be an object")
+	}
+
+	encoded, err := protojson.Marshal(content)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid content: %s", err)
+	}
+	return string(encoded), nil
+}
+
+// newDocument returns a *userinfopb.Document with the JSON document as its
+// content.
+func newDocument(username string, doc []byte) (*userinfopb.Document, error) {
+	content, err := jsonToValue(doc)
+	if err != nil {
+		return nil, grpcInternal("error converting the document for %s: %s", username, err)
+	}
+	return &userinfopb.Document{Username: username, Content: content}, nil
+}
+
+// GetPreferences returns the user's preferences.
+func (s *GRPCServer) GetPreferences(ctx context.Context, req *userinfopb.UserRequest) (*userinfopb.Document, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.prefs.prefs.isUser, username); err != nil {
+		return nil, err
+	}
+
+	jsoned, err := s.prefs.getUserPreferencesForRequest(ctx, username, false)
+	if err != nil {
+		return nil, grpcInternal("%s", err)
+	}
+	return newDocument(username, jsoned)
+}
+
+// SetPreferences replaces the user's preferences.
+func (s *GRPCServer) SetPreferences(ctx context.Context, req *userinfopb.Document) (*userinfopb.Document, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.prefs.prefs.isUser, username); err != nil {
+		return nil, err
+	}
+
+	doc, err := documentJSON(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hasPrefs, err := s.prefs.prefs.hasPreferences(ctx, username)
+	if err != nil {
+		return nil, grpcInternal("error checking preferences for user %s: %s", username, err)
+	}
+
+	upsert := s.prefs.prefs.insertPreferences
+	if hasPrefs {
+		upsert = s.prefs.prefs.updatePreferences
+	}
+	if err = upsert(ctx, username, doc); err != nil {
+		return nil, grpcInternal("error storing preferences for user %s: %s", username, err)
+	}
+
+	return s.GetPreferences(ctx, &userinfopb.UserRequest{Username: username})
+}
+
+// DeletePreferences deletes the user's preferences.
+func (s *GRPCServer) DeletePreferences(ctx context.Context, req *userinfopb.UserRequest) (*emptypb.Empty, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.prefs.prefs.isUser, username); err != nil {
+		return nil, err
+	}
+
+	if err := s.prefs.prefs.deletePreferences(ctx, username); err != nil {
+		return nil, grpcInternal("error deleting preferences for user %s: %s", username, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// GetSession returns the user's session.
+func (s *GRPCServer) GetSession(ctx context.Context, req *userinfopb.UserRequest) (*userinfopb.Document, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.sessions.sessions.isUser, username); err != nil {
+		return nil, err
+	}
+
+	jsoned, err := s.sessions.getUserSessionForRequest(ctx, username, false)
+	if err != nil {
+		return nil, grpcInternal("%s", err)
+	}
+	return newDocument(username, jsoned)
+}
+
+// SetSession replaces the user's session.
+func (s *GRPCServer) SetSession(ctx context.Context, req *userinfopb.Document) (*userinfopb.Document, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.sessions.sessions.isUser, username); err != nil {
+		return nil, err
+	}
+
+	doc, err := documentJSON(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hasSession, err := s.sessions.sessions.hasSessions(ctx, username)
+	if err != nil {
+		return nil, grpcInternal("error checking session for user %s: %s", username, err)
+	}
+
+	upsert := s.sessions.sessions.insertSession
+	if hasSession {
+		upsert = s.sessions.sessions.updateSession
+	}
+	if err = upsert(ctx, username, doc); err != nil {
+		return nil, grpcInternal("error storing session for user %s: %s", username, err)
+	}
+
+	return s.GetSession(ctx, &userinfopb.UserRequest{Username: username})
+}
+
+// DeleteSession deletes the user's session.
+func (s *GRPCServer) DeleteSession(ctx context.Context, req *userinfopb.UserRequest) (*emptypb.Empty, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.sessions.sessions.isUser, username); err != nil {
+		return nil, err
+	}
+
+	if err := s.sessions.sessions.deleteSession(ctx, username); err != nil {
+		return nil, grpcInternal("error deleting session for user %s: %s", username, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// GetSavedSearches returns the user's saved searches.
+func (s *GRPCServer) GetSavedSearches(ctx context.Context, req *userinfopb.UserRequest) (*userinfopb.Document, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.searches.searches.isUser, username); err != nil {
+		return nil, err
+	}
+
+	searches, err := s.searches.searches.getSavedSearches(ctx, username)
+	if err != nil {
+		return nil, grpcInternal("error getting saved searches for user %s: %s", username, err)
+	}
+
+	doc := "{}"
+	if len(searches) > 0 {
+		doc = searches[0]
+	}
+	return newDocument(username, []byte(doc))
+}
+
+// SetSavedSearches replaces the user's saved searches.
+func (s *GRPCServer) SetSavedSearches(ctx context.Context, req *userinfopb.Document) (*userinfopb.Document, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.searches.searches.isUser, username); err != nil {
+		return nil, err
+	}
+
+	doc, err := documentJSON(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hasSearches, err := s.searches.searches.hasSavedSearches(ctx, username)
+	if err != nil {
+		return nil, grpcInternal("error checking saved searches for user %s: %s", username, err)
+	}
+
+	upsert := s.searches.searches.insertSavedSearches
+	if hasSearches {
+		upsert = s.searches.searches.updateSavedSearches
+	}
+	if err = upsert(ctx, username, doc); err != nil {
+		return nil, grpcInternal("error storing saved searches for user %s: %s", username, err)
+	}
+
+	return &userinfopb.Document{Username: username, Content: req.GetContent()}, nil
+}
+
+// DeleteSavedSearches deletes the user's saved searches.
+func (s *GRPCServer) DeleteSavedSearches(ctx context.Context, req *userinfopb.UserRequest) (*emptypb.Empty, error) {
+	username := req.GetUsername()
+	if err := checkGRPCUser(ctx, s.searches.searches.isUser, username); err != nil {
+		return nil, err
+	}
+
+	if err := s.searches.searches.deleteSavedSearches(ctx, username); err != nil {
+		return nil, grpcInternal("error deleting saved searches for user %s: %s", username, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// bagUser adds the user domain to the username and checks that the user
+// exists.
+func (s *GRPCServer) bagUser(ctx context.Context, username string) (string, error) {
+	if username == "" {
+		return "", status.Error(codes.InvalidArgument, "missing username")
+	}
+
+	isUser := func(ctx context.Context, username string) (bool, error) {
+		return cachedIsUser(ctx, s.bags.api.cache, s.bags.api.stmts, username)
+	}
+
+	username = s.bags.AddUsernameSuffix(ctx, username)
+	if err := checkGRPCUser(ctx, isUser, username); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// bagContents returns the contents as JSON after checking the paths of the
+// items in them, if path validation is enabled.
+func (s *GRPCServer) bagContents(ctx context.Context, username string, contents *structpb.Struct) (string, error) {
+	if contents == nil {
+		return "", status.Error(codes.InvalidArgument, "missing contents")
+	}
+
+	if s.bags.paths != nil {
+		report, valid, err := validateBagContents(ctx, s.bags.paths, username, contents.AsMap())
+		if err != nil {
+			return "", grpcInternal("error validating bag items for %s: %s", username, err)
+		}
+		if !valid {
+			var missing []string
+			for _, item := range report {
+				if !item.Exists {
+					missing = append(missing, item.Path)
+				}
+			}
+			return "", status.Errorf(codes.InvalidArgument, "bag items refer to paths that don't exist: %s", strings.Join(missing, ", "))
+		}
+	}
+
+	encoded, err := protojson.Marshal(contents)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid contents: %s", err)
+	}
+	return string(encoded), nil
+}
+
+// newBag converts a BagRecord to a *userinfopb.Bag.
+func newBag(record BagRecord) (*userinfopb.Bag, error) {
+	encoded, err := json.Marshal(record.Contents)
+	if err != nil {
+		return nil, grpcInternal("error encoding bag %s: %s", record.ID, err)
+	}
+
+	var contents structpb.Struct
+	if err = protojson.Unmarshal(encoded, &contents); err != nil {
+		return nil, grpcInternal("error converting bag %s: %s", record.ID, err)
+	}
+
+	bag := &userinfopb.Bag{
+		Id:       record.ID,
+		UserId:   record.UserID,
+		Contents: &contents,
+	}
+	if record.ExpiresAt != nil {
+		bag.ExpiresAt = timestamppb.New(*record.ExpiresAt)
+	}
+	return bag, nil
+}
+
+// requireBag returns an error if the bag doesn't exist.
+func (s *GRPCServer) requireBag(ctx context.Context, username, bagID string) error {
+	if bagID == "" {
+		return status.Error(codes.InvalidArgument, "missing bag id")
+	}
+
+	ok, err := s.bags.api.HasBag(ctx, username, bagID)
+	if err != nil {
+		return grpcInternal("error checking database for bag %s for %s: %s", bagID, username, err)
+	}
+	if !ok {
+		return status.Errorf(codes.NotFound, "bag %s not found for user %s", bagID, username)
+	}
+	return nil
+}
+
+// getBag returns the bag as a *userinfopb.Bag.
+func (s *GRPCServer) getBag(ctx context.Context, username, bagID string) (*userinfopb.Bag, error) {
+	record, err := s.bags.api.GetBag(ctx, username, bagID)
+	if err != nil {
+		return nil, grpcInternal("error getting bag %s for %s: %s", bagID, username, err)
+	}
+	return newBag(record)
+}
+
+// ListBags returns the user's bags.
+func (s *GRPCServer) ListBags(ctx context.Context, req *userinfopb.UserRequest) (*userinfopb.BagList, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := s.bags.api.GetBags(ctx, username)
+	if err != nil {
+		return nil, grpcInternal("error getting bags for %s: %s", username, err)
+	}
+
+	list := &userinfopb.BagList{}
+	for _, record := range records {
+		bag, err := newBag(record)
+		if err != nil {
+			return nil, err
+		}
+		list.Bags = append(list.Bags, bag)
+	}
+	return list, nil
+}
+
+// GetBag returns one of the user's bags.
+func (s *GRPCServer) GetBag(ctx context.Context, req *userinfopb.BagRequest) (*userinfopb.Bag, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.requireBag(ctx, username, req.GetId()); err != nil {
+		return nil, err
+	}
+	return s.getBag(ctx, username, req.GetId())
+}
+
+// AddBag adds a bag for the user.
+func (s *GRPCServer) AddBag(ctx context.Context, req *userinfopb.AddBagRequest) (*userinfopb.Bag, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	var expiresAt *time.Time
+	if req.GetExpiresAt() != nil {
+		t := req.GetExpiresAt().AsTime()
+		if !t.After(time.Now()) {
+			return nil, status.Errorf(codes.InvalidArgument, "expires_at must be in the future: %s", t.Format(time.RFC3339))
+		}
+		expiresAt = &t
+	}
+
+	contents, err := s.bagContents(ctx, username, req.GetContents())
+	if err != nil {
+		return nil, err
+	}
+
+	bagID, err := s.bags.api.AddBag(ctx, username, contents, expiresAt)
+	if err != nil {
+		return nil, grpcInternal("failed to add bag for %s: %s", username, err)
+	}
+	return s.getBag(ctx, username, bagID)
+}
+
+// UpdateBag replaces the contents of one of the user's bags.
+func (s *GRPCServer) UpdateBag(ctx context.Context, req *userinfopb.UpdateBagRequest) (*userinfopb.Bag, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.requireBag(ctx, username, req.GetId()); err != nil {
+		return nil, err
+	}
+
+	contents, err := s.bagContents(ctx, username, req.GetContents())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.bags.api.UpdateBag(ctx, username, req.GetId(), contents); err != nil {
+		return nil, grpcInternal("error updating bag for user %s: %s", username, err)
+	}
+	return s.getBag(ctx, username, req.GetId())
+}
+
+// DeleteBag deletes one of the user's bags.
+func (s *GRPCServer) DeleteBag(ctx context.Context, req *userinfopb.BagRequest) (*emptypb.Empty, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing bag id")
+	}
+
+	if err = s.bags.api.DeleteBag(ctx, username, req.GetId()); err != nil {
+		return nil, grpcInternal("error deleting bag for user %s: %s", username, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// DeleteAllBags deletes all of the user's bags.
+func (s *GRPCServer) DeleteAllBags(ctx context.Context, req *userinfopb.UserRequest) (*emptypb.Empty, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.bags.api.DeleteAllBags(ctx, username); err != nil {
+		return nil, grpcInternal("error deleting bags for user %s: %s", username, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// GetDefaultBag returns the user's default bag, creating it if requested.
+func (s *GRPCServer) GetDefaultBag(ctx context.Context, req *userinfopb.DefaultBagRequest) (*userinfopb.Bag, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	create := s.bags.autoCreateDefault
+	if req.Create != nil {
+		create = req.GetCreate()
+	}
+
+	var record BagRecord
+	if create {
+		record, err = s.bags.api.GetDefaultBag(ctx, username)
+	} else {
+		record, err = s.bags.api.FindDefaultBag(ctx, username)
+	}
+
+	if errors.Is(err, ErrNoDefaultBag) {
+		return nil, status.Errorf(codes.NotFound, "default bag not found for user %s", username)
+	}
+	if err != nil {
+		return nil, grpcInternal("error getting default bag for %s: %s", username, err)
+	}
+	return newBag(record)
+}
+
+// UpdateDefaultBag replaces the contents of the user's default bag.
+func (s *GRPCServer) UpdateDefaultBag(ctx context.Context, req *userinfopb.UpdateDefaultBagRequest) (*userinfopb.Bag, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := s.bagContents(ctx, username, req.GetContents())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.bags.api.UpdateDefaultBag(ctx, username, contents); err != nil {
+		return nil, grpcInternal("error updating default bag for user %s: %s", username, err)
+	}
+
+	record, err := s.bags.api.GetDefaultBag(ctx, username)
+	if err != nil {
+		return nil, grpcInternal("error getting new bag value for user %s: %s", username, err)
+	}
+	return newBag(record)
+}
+
+// DeleteDefaultBag deletes the user's default bag.
+func (s *GRPCServer) DeleteDefaultBag(ctx context.Context, req *userinfopb.UserRequest) (*emptypb.Empty, error) {
+	username, err := s.bagUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.bags.api.DeleteDefaultBag(ctx, username); err != nil {
+		return nil, grpcInternal("error deleting default bag for user %s: %s", username, err)
+	}
+	return &emptypb.Empty{}, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers used for idempotent requests. Responses replayed for a repeated key
+// include the replayed header.
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLength is the longest idempotency key that's accepted.
+const maxIdempotencyKeyLength = 255
+
+// unreplayableRoutes are the routes whose responses are never stored for
+// replay, because they contain secrets that must only be returned once, such
+// as the plaintext of a new personal access token. Idempotency-Key headers
+// are ignored for them.
+var unreplayableRoutes = map[string]bool{
+	"POST /tokens/{username}": true,
+}
+
+// Idempotency replays the original response to POST and PUT requests that are
+// retried with the same Idempotency-Key header within the window. Keys are
+// scoped to the API key that made the request, and a key can't be reused for a
+// different request. Responses with 5xx statuses aren't stored, so those
+// requests can be retried.
+type Idempotency struct {
+	keys   *IdempotencyDB
+	window time.Duration
+}
+
+// NewIdempotency returns a new *Idempotency that remembers keys for the window.
+func NewIdempotency(keys *IdempotencyDB, window time.Duration) *Idempotency {
+	return &Idempotency{
+		keys:   keys,
+		window: window,
+	}
+}
+
+// idempotencyRecorder sends a response to the client while keeping a copy of
+// it to store.
+type idempotencyRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+// Write keeps a copy of the body before sending it.
+func (i *idempotencyRecorder) Write(b []byte) (int, error) {
+	i.body.Write(b)
+	return i.statusRecorder.Write(b)
+}
+
+// fingerprint identifies a request body, so that a key reused for a different
+// request can be detected.
+func fingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Middleware handles requests that include an Idempotency-Key header.
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut) || unreplayableRoutes[routeKey(r)] {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			httpapi.BadRequest(writer, fmt.Sprintf("%s must be at most %d characters long", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			httpapi.ReadBodyError(writer, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		rec := &idempotencyRecord{
+			Key:         key,
+			Actor:       apiKeyName(ctx),
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Fingerprint: fingerprint(body),
+		}
+
+		claimed, err := i.claim(ctx, rec)
+		if err != nil {
+			httpapi.Errored(writer, err.Error())
+			return
+		}
+
+		if !claimed {
+			i.replay(writer, r, rec)
+			return
+		}
+
+		recorder := &idempotencyRecorder{statusRecorder: statusRecorder{ResponseWriter: writer}}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		// The request's context may be canceled once the response is sent, so
+		// the outcome is recorded without it.
+		if recorder.status >= http.StatusInternalServerError {
+			err = i.keys.release(context.WithoutCancel(ctx), key, rec.Actor)
+		} else {
+			headers := recorder.Header().Clone()
+			headers.Del(httpapi.RequestIDHeader)
+			err = i.keys.complete(context.WithoutCancel(ctx), key, rec.Actor, recorder.status, headers, recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+// claim records the key for the request. A key recorded before the window is
+// forgotten and claimed again. Returns false if the key is already in use.
+func (i *Idempotency) claim(ctx context.Context, rec *idempotencyRecord) (bool, error) {
+	claimed, err := i.keys.claim(ctx, rec)
+	if err != nil || claimed {
+		return claimed, err
+	}
+
+	existing, err := i.keys.lookup(ctx, rec.Key, rec.Actor)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil && time.Since(existing.CreatedAt) < i.window {
+		return false, nil
+	}
+
+	if err = i.keys.release(ctx, rec.Key, rec.Actor); err != nil {
+		return false, err
+	}
+	return i.keys.claim(ctx, rec)
+}
+
+// replay responds to a request whose key is already in use with the stored
+// response, if the key was used for the same request and it has been handled.
+func (i *Idempotency) replay(writer http.ResponseWriter, r *http.Request, rec *idempotencyRecord) {
+	stored, err := i.keys.lookup(r.Context(), rec.Key, rec.Actor)
+	if err != nil {
+		httpapi.Errored(writer, err.Error())
+		return
+	}
+
+	switch {
+	case stored == nil:
+		// The key was released after the claim failed, e.g. because the
+		// original request failed, so the client should retry.
+		msg := fmt.Sprintf("the request for %s %s was released, retry it", idempotencyKeyHeader, rec.Key)
+		httpapi.WriteProblem(writer, http.StatusConflict, httpapi.CodeIdempotencyInProgress, msg, nil)
+		log.Error(msg)
+	case stored.Method != rec.Method || stored.Path != rec.Path || stored.Fingerprint != rec.Fingerprint:
+		msg := fmt.Sprintf("%s %s was already used for a different request", idempotencyKeyHeader, rec.Key)
+		httpapi.WriteProblem(writer, http.StatusUnprocessableEntity, httpapi.CodeIdempotencyKeyReused, msg, nil)
+		log.Error(msg)
+	case stored.Status == 0:
+		msg := fmt.Sprintf("the request for %s %s is still being handled", idempotencyKeyHeader, rec.Key)
+		httpapi.WriteProblem(writer, http.StatusConflict, httpapi.CodeIdempotencyInProgress, msg, nil)
+		log.Error(msg)
+	default:
+		for name, values := range stored.Headers {
+			writer.Header()[name] = values
+		}
+		writer.Header().Set(idempotencyReplayedHeader, "true")
+		writer.WriteHeader(stored.Status)
+		if _, err = writer.Write(stored.Body); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// purgeExpired deletes the keys recorded before the window. It's run by the
+// Scheduler.
+func (i *Idempotency) purgeExpired(ctx context.Context) (int64, error) {
+	return i.keys.purge(ctx, time.Now().Add(-i.window))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// idempotencyRecord is a request made with an Idempotency-Key header and, once
+// it has been handled, the response that was sent for it. Status is zero while
+// the request is still being handled.
+type idempotencyRecord struct {
+	Key         string
+	Actor       string
+	Method      string
+	Path        string
+	Fingerprint string
+	Status      int
+	Headers     http.Header
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// IdempotencyDB stores the responses for requests made with idempotency keys.
+type IdempotencyDB struct {
+	db *retryingDB
+}
+
+// NewIdempotencyDB returns a newly created *IdempotencyDB.
+func NewIdempotencyDB(db *sql.DB) *IdempotencyDB {
+	return &IdempotencyDB{db: withRetries(db)}
+}
+
+// claim records that a request with the key is being handled. Returns false if
+// the key was already recorded for the actor.
+func (i *IdempotencyDB) claim(ctx context.Context, rec *idempotencyRecord) (bool, error) {
+	query := `INSERT INTO idempotency_keys (key, actor, method, path, fingerprint)
+                   VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (key, actor) DO NOTHING`
+
+	result, err := i.db.ExecContext(ctx, query, rec.Key, rec.Actor, rec.Method, rec.Path, rec.Fingerprint)
+	if err != nil {
+		return false, fmt.Errorf("error recording idempotency key %s: %w", rec.Key, dbError(err))
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// lookup returns the record for the key, or nil if there isn't one.
+func (i *IdempotencyDB) lookup(ctx context.Context, key, actor string) (*idempotencyRecord, error) {
+	query := `SELECT method, path, fingerprint, status, headers, body, created_at
+                FROM idempotency_keys
+               WHERE key = $1 AND actor = $2`
+
+	var (
+		rec     = &idempotencyRecord{Key: key, Actor: actor}
+		status  sql.NullInt64
+		headers []byte
+	)
+
+	err := i.db.QueryRowContext(ctx, query, key, actor).Scan(&rec.Method, &rec.Path, &rec.Fingerprint, &status, &headers, &rec.Body, &rec.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up idempotency key %s: %w", key, dbError(err))
+	}
+
+	rec.Status = int(status.Int64)
+	if headers != nil {
+		if err = json.Unmarshal(headers, &rec.Headers); err != nil {
+			return nil, fmt.Errorf("error decoding the headers stored for idempotency key %s: %w", key, err)
+		}
+	}
+
+	return rec, nil
+}
+
+// complete stores the response sent for the key.
+func (i *IdempotencyDB) complete(ctx context.Context, key, actor string, status int, headers http.Header, body []byte) error {
+	query := `UPDATE ONLY idempotency_keys
+                 SET status = $3, headers = $4, body = $5
+               WHERE key = $1 AND actor = $2`
+
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	if _, err = i.db.ExecContext(ctx, query, key, actor, status, string(encoded), body); err != nil {
+		return fmt.Errorf("error storing the response for idempotency key %s: %w", key, dbError(err))
+	}
+	return nil
+}
+
+// release forgets the key so that the request can be retried.
+func (i *IdempotencyDB) release(ctx context.Context, key, actor string) error {
+	query := `DELETE FROM ONLY idempotency_keys WHERE key = $1 AND actor = $2`
+
+	if _, err := i.db.ExecContext(ctx, query, key, actor); err != nil {
+		return fmt.Errorf("error releasing idempotency key %s: %w", key, dbError(err))
+	}
+	return nil
+}
+
+// purge deletes the keys recorded before the given time. Returns the number of
+// keys deleted.
+func (i *IdempotencyDB) purge(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM ONLY idempotency_keys WHERE created_at < $1`
+
+	result, err := i.db.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("error purging idempotency keys: %w", dbError(err))
+	}
+	return result.RowsAffected()
+}
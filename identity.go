@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// subjectPattern matches OIDC subjects, which are at most 255 printable ASCII
+// characters. Slashes aren't allowed, since subjects are used in paths.
+var subjectPattern = regexp.MustCompile(`^[!-.0-~]{1,255}$`)
+
+// IdentityApp maps the subjects of users' OIDC tokens to their usernames, so
+// that services authenticating users with the identity provider can find the
+// users' records without deriving usernames from other claims.
+type IdentityApp struct {
+	identities *IdentityDB
+	router     *mux.Router
+}
+
+// NewIdentityApp returns a new *IdentityApp.
+func NewIdentityApp(db *IdentityDB, router *mux.Router) *IdentityApp {
+	identityApp := &IdentityApp{
+		identities: db,
+		router:     moduleRouter(router, "identity", "/identity"),
+	}
+	identityApp.router.HandleFunc("/by-subject/{subject}", identityApp.BySubjectRequest).Methods(http.MethodGet)
+	identityApp.router.HandleFunc("/{username}", identityApp.GetRequest).Methods(http.MethodGet)
+	identityApp.router.HandleFunc("/{username}/{subject}", identityApp.PutRequest).Methods(http.MethodPut)
+	identityApp.router.HandleFunc("/{username}/{subject}", identityApp.DeleteRequest).Methods(http.MethodDelete)
+	return identityApp
+}
+
+// subjectVar returns the subject in the request's URL. It responds with a 400
+// and returns false if the subject isn't valid.
+func subjectVar(writer http.ResponseWriter, r *http.Request) (string, bool) {
+	subject := mux.Vars(r)["subject"]
+	if !subjectPattern.MatchString(subject) {
+		httpapi.BadRequest(writer, fmt.Sprintf("invalid subject: %q", subject))
+		return "", false
+	}
+	return subject, true
+}
+
+// BySubjectRequest returns the identity with the subject, including the
+// username it's mapped to.
+func (i *IdentityApp) BySubjectRequest(writer http.ResponseWriter, r *http.Request) {
+	subject, ok := subjectVar(writer, r)
+	if !ok {
+		return
+	}
+
+	identity, err := i.identities.identityBySubject(r.Context(), subject)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error looking up subject %s: %s", subject, err))
+		return
+	}
+	if identity == nil {
+		httpapi.NotFound(writer, fmt.Sprintf("subject %s isn't mapped to a user", subject))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, identity)
+}
+
+// GetRequest lists the subjects mapped to the user, oldest first, as
+// {"identities": [...]}.
+func (i *IdentityApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, i.identities.isUser)
+	if !ok {
+		return
+	}
+
+	identities, err := i.identities.getIdentities(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the identities of user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"identities": identities})
+}
+
+// PutRequest maps the subject to the user and responds with the mapping, with
+// a 201 if it's new. The response is a 409 if the subject is mapped to another
+// user; that mapping has to be deleted first.
+func (i *IdentityApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, i.identities.isUser)
+	if !ok {
+		return
+	}
+	subject, ok := subjectVar(writer, r)
+	if !ok {
+		return
+	}
+
+	identity, created, err := i.identities.addIdentity(r.Context(), username, subject)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error mapping subject %s to user %s: %s", subject, username, err))
+		return
+	}
+	if identity.Username != username {
+		httpapi.Error(writer, fmt.Sprintf("subject %s is mapped to another user", subject), http.StatusConflict)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, identity)
+}
+
+// DeleteRequest removes the mapping of the subject to the user.
+func (i *IdentityApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, i.identities.isUser)
+	if !ok {
+		return
+	}
+	subject, ok := subjectVar(writer, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := i.identities.deleteIdentity(r.Context(), username, subject)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error unmapping subject %s from user %s: %s", subject, username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("subject %s isn't mapped to user %s", subject, username))
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/queries"
+)
+
+// Identity maps the subject of a user's OIDC tokens, the sub claim, to their
+// username.
+type Identity struct {
+	Subject   string    `json:"subject"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IdentityDB handles interacting with the user_identities table.
+type IdentityDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewIdentityDB returns a newly created *IdentityDB. Only user lookups are
+// cached in cache, which may be nil to disable caching.
+func NewIdentityDB(db *sql.DB, cache Cache) *IdentityDB {
+	return &IdentityDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// isUser returns whether or not the user is present in the database.
+func (i *IdentityDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, i.cache, i.db, username)
+}
+
+// getIdentities returns the subjects mapped to the user, oldest first.
+func (i *IdentityDB) getIdentities(ctx context.Context, username string) ([]Identity, error) {
+	query, args := userRows("user_identities", "i", username, "i.subject", "u.username", "i.created_at").
+		OrderBy("i.created_at", "i.subject").
+		SQL()
+
+	rows, err := i.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		if err = rows.Scan(&identity.Subject, &identity.Username, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// identityBySubject returns the identity with the subject, or nil if the
+// subject isn't mapped to a user.
+func (i *IdentityDB) identityBySubject(ctx context.Context, subject string) (*Identity, error) {
+	query, args := selectFrom("user_identities i", "i.subject", "u.username", "i.created_at").
+		Join("users u", "i.user_id = u.id").
+		Where("i.subject = ?", subject).
+		SQL()
+
+	var identity Identity
+	err := i.db.QueryRowContext(ctx, query, args...).Scan(&identity.Subject, &identity.Username, &identity.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &identity, nil
+}
+
+// addIdentity maps the subject to the user. Returns the mapping and whether
+// it's new; if the subject is already mapped to another user, that mapping is
+// returned instead and nothing changes.
+func (i *IdentityDB) addIdentity(ctx context.Context, username, subject string) (*Identity, bool, error) {
+	// The no-op update returns the existing row, so that the caller can tell
+	// whether it belongs to someone else.
+	query := `INSERT INTO user_identities (subject, user_id)
+                   VALUES ($1, $2)
+              ON CONFLICT (subject) DO UPDATE SET subject = EXCLUDED.subject
+                RETURNING (SELECT username FROM users WHERE id = user_identities.user_id), created_at, (xmax = 0) AS created`
+
+	userID, err := queries.UserID(ctx, i.db, username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	identity := Identity{Subject: subject}
+	var created bool
+	if err = i.db.QueryRowContext(ctx, query, subject, userID).Scan(&identity.Username, &identity.CreatedAt, &created); err != nil {
+		return nil, false, dbError(err)
+	}
+
+	if created {
+		i.notify(ctx, Mutation{Module: "identity", Action: actionCreated, Username: username})
+	}
+	return &identity, created, nil
+}
+
+// deleteIdentity removes the mapping of the subject to the user. Returns
+// whether the subject was mapped to the user.
+func (i *IdentityDB) deleteIdentity(ctx context.Context, username, subject string) (bool, error) {
+	query := `DELETE FROM ONLY user_identities i
+                    USING users u
+                    WHERE i.user_id = u.id AND i.subject = $1 AND u.username = $2`
+
+	result, err := i.db.ExecContext(ctx, query, subject, username)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		i.notify(ctx, Mutation{Module: "identity", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
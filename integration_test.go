@@ -0,0 +1,1103 @@
+//go:build integration
+
+package main
+
+// The integration tests run the API against a real PostgreSQL database, since
+// the sqlmock expectations in main_test.go can't tell whether the queries work.
+// Run them with:
+//
+//	go test -tags integration ./...
+//
+// They use the database at $USER_INFO_TEST_DB_URI, or start a PostgreSQL
+// container with docker if it isn't set. Each run applies the migrations to a
+// schema of its own and drops it afterward. The tests are skipped if there's
+// no database to use.
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/user-info/client"
+)
+
+// integrationImage is the PostgreSQL image started when no database is given.
+const integrationImage = "postgres:16-alpine"
+
+// integrationDB is the database used by the integration tests, or nil if
+// there isn't one.
+var integrationDB *sql.DB
+
+func TestMain(m *testing.M) {
+	cleanup, err := setUpIntegrationDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skipping the integration tests: %s\n", err)
+	}
+
+	code := m.Run()
+	if cleanup != nil {
+		cleanup()
+	}
+	os.Exit(code)
+}
+
+// setUpIntegrationDB connects to the test database, creates a schema for the
+// run, and applies the migrations to it. The returned function drops the
+// schema and stops the container, if one was started.
+func setUpIntegrationDB() (func(), error) {
+	var stops []func()
+	cleanup := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	uri := os.Getenv("USER_INFO_TEST_DB_URI")
+	if uri == "" {
+		containerURI, stop, err := startPostgresContainer()
+		if err != nil {
+			return nil, err
+		}
+		uri = containerURI
+		stops = append(stops, stop)
+	}
+
+	admin, err := waitForDB(uri)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	stops = append(stops, func() { admin.Close() })
+
+	schema := fmt.Sprintf("user_info_it_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("error creating schema %s: %w", schema, err)
+	}
+	stops = append(stops, func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			fmt.Fprintf(os.Stderr, "error dropping schema %s: %s\n", schema, err)
+		}
+	})
+
+	if uri, err = withSearchPath(uri, schema); err != nil {
+		cleanup()
+		return nil, err
+	}
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	stops = append(stops, func() { db.Close() })
+
+	if err = migrateUp(db); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("error applying the migrations: %w", err)
+	}
+
+	integrationDB = db
+	return cleanup, nil
+}
+
+// startPostgresContainer starts a PostgreSQL container listening on a random
+// local port and returns its URI and a function that removes it.
+func startPostgresContainer() (string, func(), error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return "", nil, fmt.Errorf("USER_INFO_TEST_DB_URI isn't set and docker isn't available")
+	}
+
+	out, err := exec.Command("docker", "run", "-d", "--rm",
+		"-e", "POSTGRES_PASSWORD=user-info",
+		"-e", "POSTGRES_DB=de",
+		"-p", "127.0.0.1::5432",
+		integrationImage,
+	).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("error starting %s: %w", integrationImage, err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop := func() {
+		exec.Command("docker", "rm", "-f", id).Run() // nolint:errcheck
+	}
+
+	out, err = exec.Command("docker", "port", id, "5432/tcp").Output()
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("error finding the port of container %s: %w", id, err)
+	}
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+
+	return fmt.Sprintf("postgres://postgres:user-info@%s/de?sslmode=disable", addr), stop, nil
+}
+
+// waitForDB connects to the database, waiting up to a minute for it to start
+// accepting connections.
+func waitForDB(uri string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		if err = db.Ping(); err == nil {
+			return db, nil
+		}
+		if time.Now().After(deadline) {
+			db.Close()
+			return nil, fmt.Errorf("the database didn't start: %w", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// routeRecorder records the routes that requests are made to.
+type routeRecorder struct {
+	mu     sync.Mutex
+	routes map[string]bool
+}
+
+func (rr *routeRecorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		rr.mu.Lock()
+		rr.routes[routeKey(r)] = true
+		rr.mu.Unlock()
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// newIntegrationServer serves the API the way serve does, using the test
+// database.
+func newIntegrationServer(t *testing.T, routes *routeRecorder) *httptest.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	db := integrationDB
+	apiKeyAuth := NewAPIKeyAuth(map[string]string{"integration": "integration-key"}, true)
+	usernames := NewUsernameNormalizer(IplantSuffix, nil)
+	usernames.AllowImpersonation([]string{"integration"})
+	idempotency := NewIdempotency(NewIdempotencyDB(db), time.Hour)
+	usageDB := NewUsageDB(db)
+	usageRecorder := NewUsageRecorder(usageDB)
+	go usageRecorder.Run(ctx, 50*time.Millisecond)
+
+	router := makeRouter(routes.Middleware, apiKeyAuth.Middleware, dbBreaker.Middleware, NewQueryTimeout(30*time.Second).Middleware,
+		NewBodySizeLimit(1<<20).Middleware, usernames.Middleware, usageRecorder.Middleware, requireContentType, idempotency.Middleware)
+
+	prefsDB := NewPrefsDB(db, nil)
+	prefsApp := NewPrefsApp(prefsDB, router)
+	sessionsDB := NewSessionsDB(db, nil)
+	sessionsApp := NewSessionsApp(sessionsDB, router)
+	searchesDB := NewSearchesDB(db, nil)
+	searchesApp := NewSearchesApp(searchesDB, router)
+	bagsApp := NewBagsApp(db, router, IplantSuffix, true, nil, nil)
+	NewUserSummaryApp(prefsApp, sessionsApp, searchesApp, bagsApp, router)
+	usersDB := NewUsersDB(db, nil)
+	usersApp := NewUsersApp(usersDB, bagsApp, router)
+	router.Use(usersApp.RejectDeactivated)
+	changesDB := NewChangesDB(db)
+	NewChangesApp(changesDB, bagsApp, router)
+	NewProfileApp(db, nil, nil, router)
+	avatarsDB := NewAvatarsDB(db, nil)
+	NewAvatarsApp(avatarsDB, 1<<20, time.Minute, router)
+	toursDB := NewToursDB(db, nil)
+	NewToursApp(toursDB, router)
+	notificationPrefsDB := NewNotificationPrefsDB(db, nil)
+	NewNotificationPrefsApp(notificationPrefsDB, []string{"email", "in_app", "webhook"}, []string{"email", "in_app"}, nil, router)
+	feedbackDB := NewFeedbackDB(db, nil)
+	pinsDB := NewPinsDB(db, nil)
+	NewPinsApp(pinsDB, map[string]int{"app": 2, "folder": 2}, router)
+	tagsDB := NewTagsDB(db, nil)
+	NewTagsApp(tagsDB, router)
+	NewTeamPrefsApp(NewTeamPrefsDB(db, nil), prefsDB, router)
+	tokensDB := NewTokensDB(db, nil)
+	NewTokensApp(tokensDB, []string{"read", "write"}, 24*time.Hour, router)
+	userWebhooksDB := NewUserWebhooksDB(db, nil)
+	NewUserWebhooksApp(userWebhooksDB, []string{"slack", "custom"}, nil, newUserWebhookClient(10*time.Second, true), router)
+	dashboardDB := NewDashboardDB(db, nil)
+	NewDashboardApp(dashboardDB, nil, 3, router)
+	consentsDB := NewConsentsDB(db, nil)
+	identityDB := NewIdentityDB(db, nil)
+	NewIdentityApp(identityDB, router)
+	digestsDB := NewDigestsDB(db, nil)
+	NewDigestsApp(digestsDB, []string{"email", "in_app", "webhook"}, router)
+	localeDB := NewLocaleDB(db, nil)
+	NewLocaleApp(localeDB, "UTC", "en-US", router)
+
+	adminRouter := newAdminRouter(router, []string{"integration"})
+	NewWebhooksApp(NewWebhooksDB(db), adminRouter)
+	auditDB := NewAuditDB(db)
+	NewAuditApp(auditDB, adminRouter)
+	NewUsageApp(usageDB, adminRouter)
+	NewActivityApp(auditDB, usersDB, bagsApp, router)
+	NewBackupApp(NewBackupDB(db, nil), adminRouter)
+	NewFeedbackApp(feedbackDB, router, adminRouter)
+	NewConsentsApp(consentsDB, []string{"marketing-email", "analytics"}, router, adminRouter)
+	registerPprof(adminRouter)
+	registerOpenAPI(router, true)
+
+	auditLogger := NewAuditLogger(auditDB, 100)
+	go auditLogger.Run(ctx)
+
+	for _, observed := range []mutationSource{prefsDB, sessionsDB, searchesDB, bagsApp.api, usersDB, avatarsDB, toursDB, notificationPrefsDB, feedbackDB, pinsDB, tagsDB, tokensDB, userWebhooksDB, dashboardDB, consentsDB, identityDB, digestsDB, localeDB} {
+		observed.AddObserver(auditLogger)
+		observed.AddObserver(changesDB)
+	}
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// integrationRequest makes a request to the server with the integration API
+// key and fails the test unless the response has the expected status. The
+// response body is returned.
+func integrationRequest(t *testing.T, server *httptest.Server, method, path, contentType string, body io.Reader, expected int) []byte {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", apiKeyScheme+" integration-key")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != expected {
+		t.Fatalf("%s %s returned %d instead of %d: %s", method, path, resp.StatusCode, expected, respBody)
+	}
+	return respBody
+}
+
+func TestIntegrationEndpoints(t *testing.T) {
+	if integrationDB == nil {
+		t.Skip("no database for the integration tests")
+	}
+
+	routes := &routeRecorder{routes: make(map[string]bool)}
+	server := newIntegrationServer(t, routes)
+
+	c, err := client.New(server.URL, client.WithAPIKey("integration-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const username = "integration-user"
+	qualified := username + "@" + IplantSuffix
+	if _, err = integrationDB.Exec("INSERT INTO users (username) VALUES ($1)", qualified); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	t.Run("status", func(t *testing.T) {
+		for _, path := range []string{"/", "/preferences/", "/sessions/", "/searches/", "/bags/", "/debug/vars", "/openapi.json", "/docs", "/admin/debug/pprof/"} {
+			integrationRequest(t, server, http.MethodGet, path, "", nil, http.StatusOK)
+		}
+	})
+
+	t.Run("preferences", func(t *testing.T) {
+		if err := c.SavePreferences(ctx, username, client.Document{"theme": "dark"}); err != nil {
+			t.Fatal(err)
+		}
+		integrationRequest(t, server, http.MethodPut, "/preferences/"+username, "application/json", strings.NewReader(`{"theme":"light"}`), http.StatusOK)
+
+		prefs, err := c.GetPreferences(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefs["theme"] != "light" {
+			t.Errorf("preferences were %v", prefs)
+		}
+	})
+
+	t.Run("team-preferences", func(t *testing.T) {
+		team := "iplant:labs:integration"
+		if err := c.SaveTeamPreferences(ctx, team, client.Document{"theme": "dark", "data": client.Document{"view": "grid", "page_size": 50}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SavePreferences(ctx, username, client.Document{"theme": "light", "data": client.Document{"view": "list"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		prefs, err := c.GetTeamPreferences(ctx, team)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefs["theme"] != "dark" {
+			t.Errorf("team preferences were %v", prefs)
+		}
+
+		resolved, err := c.GetResolvedPreferences(ctx, team, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := resolved["data"].(map[string]interface{})
+		if resolved["theme"] != "light" || data["view"] != "list" || data["page_size"] != float64(50) {
+			t.Errorf("resolved preferences were %v", resolved)
+		}
+
+		if err = c.DeleteTeamPreferences(ctx, team); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.DeleteTeamPreferences(ctx, team); !client.IsNotFound(err) {
+			t.Errorf("deleting missing team preferences returned %v", err)
+		}
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		if err := c.SaveSession(ctx, username, client.Document{"page": "data"}); err != nil {
+			t.Fatal(err)
+		}
+		integrationRequest(t, server, http.MethodPut, "/sessions/"+username, "application/json", strings.NewReader(`{"page":"apps"}`), http.StatusOK)
+
+		session, err := c.GetSession(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session["page"] != "apps" {
+			t.Errorf("session was %v", session)
+		}
+	})
+
+	t.Run("searches", func(t *testing.T) {
+		if err := c.SaveSavedSearches(ctx, username, json.RawMessage(`{"recent":["a"]}`)); err != nil {
+			t.Fatal(err)
+		}
+		integrationRequest(t, server, http.MethodPut, "/searches/"+username, "application/json", strings.NewReader(`{"recent":["b"]}`), http.StatusOK)
+
+		searches, err := c.GetSavedSearches(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(searches, []byte(`"b"`)) {
+			t.Errorf("saved searches were %s", searches)
+		}
+	})
+
+	t.Run("summary and export", func(t *testing.T) {
+		changes, err := c.GetChanges(ctx, username, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(changes.Changed, []string{"preferences", "searches", "sessions"}) {
+			t.Errorf("changes were %v", changes.Changed)
+		}
+		if changes, err = c.GetChanges(ctx, username, changes.Token); err != nil {
+			t.Fatal(err)
+		}
+		if len(changes.Changed) != 0 {
+			t.Errorf("changes since the last token were %v", changes.Changed)
+		}
+
+		integrationRequest(t, server, http.MethodGet, "/users/"+username+"/summary", "", nil, http.StatusOK)
+		integrationRequest(t, server, http.MethodGet, "/users/"+username+"/export?format=json", "", nil, http.StatusOK)
+
+		profile, err := c.GetProfile(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile.ID == "" {
+			t.Errorf("the profile has no user ID: %+v", profile)
+		}
+	})
+
+	t.Run("bags", func(t *testing.T) {
+		bagID, err := c.AddBag(ctx, username, client.Document{"items": []interface{}{map[string]interface{}{"path": "/a"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		integrationRequest(t, server, http.MethodHead, "/bags/"+username, "", nil, http.StatusOK)
+
+		bags, err := c.ListBags(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bags) != 1 || bags[0].ID != bagID {
+			t.Errorf("bags were %+v", bags)
+		}
+
+		updated := client.Document{"items": []interface{}{map[string]interface{}{"path": "/b"}}}
+		if err = c.UpdateBag(ctx, username, bagID, updated); err != nil {
+			t.Fatal(err)
+		}
+		bag, err := c.GetBag(ctx, username, bagID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(fmt.Sprint(bag.Contents), "/b") {
+			t.Errorf("bag contents were %v", bag.Contents)
+		}
+		integrationRequest(t, server, http.MethodPost, "/bags/"+username+"/"+bagID+"/diff", "application/json", strings.NewReader(`{"items":[{"path":"/c"}]}`), http.StatusOK)
+
+		if _, err = c.GetDefaultBag(ctx, username, true); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.UpdateDefaultBag(ctx, username, updated); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.DeleteDefaultBag(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+
+		var form bytes.Buffer
+		mw := multipart.NewWriter(&form)
+		fw, err := mw.CreateFormFile("file", "items.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, "path\n/d\n/e\n") // nolint:errcheck
+		mw.Close()
+		integrationRequest(t, server, http.MethodPost, "/bags/"+username+"/import", mw.FormDataContentType(), &form, http.StatusOK)
+
+		if err = c.DeleteBag(ctx, username, bagID); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.DeleteAllBags(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		integrationRequest(t, server, http.MethodHead, "/bags/"+username, "", nil, http.StatusNotFound)
+	})
+
+	t.Run("avatars", func(t *testing.T) {
+		if _, err := c.SetAvatarURL(ctx, username, "https://example.org/avatar.png"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.DeleteAvatar(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+
+		// The image is left in place so that the backup includes it.
+		png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+		integrationRequest(t, server, http.MethodPut, "/avatars/"+username, "image/png", bytes.NewReader(png), http.StatusCreated)
+		if body := integrationRequest(t, server, http.MethodGet, "/avatars/"+username, "", nil, http.StatusOK); !bytes.Equal(body, png) {
+			t.Errorf("the avatar was %q instead of %q", body, png)
+		}
+	})
+
+	t.Run("tours", func(t *testing.T) {
+		first, err := c.CompleteTour(ctx, username, "data-window")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := c.CompleteTour(ctx, username, "data-window")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !again.CompletedAt.Equal(first.CompletedAt) {
+			t.Errorf("completing the tour again moved its completion time from %s to %s", first.CompletedAt, again.CompletedAt)
+		}
+
+		tours, err := c.GetCompletedTours(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tours) != 1 || tours[0].TourID != "data-window" {
+			t.Errorf("unexpected tours: %+v", tours)
+		}
+
+		if err = c.ResetTour(ctx, username, "data-window"); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.ResetTours(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("notification prefs", func(t *testing.T) {
+		prefs := &client.NotificationPrefs{
+			Channels: map[string]bool{"email": false, "webhook": true},
+			Events:   map[string]bool{"analysis.completed": false},
+		}
+		if err := c.SaveNotificationPrefs(ctx, username, prefs); err != nil {
+			t.Fatal(err)
+		}
+
+		saved, err := c.GetNotificationPrefs(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]bool{"email": false, "in_app": true, "webhook": true}
+		if !reflect.DeepEqual(saved.Channels, expected) || saved.Events["analysis.completed"] {
+			t.Errorf("unexpected settings: %+v", saved)
+		}
+
+		users, err := c.QueryNotificationPrefs(ctx, []string{qualified}, "data.shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deliver := users[qualified].Deliver; !reflect.DeepEqual(deliver, []string{"in_app", "webhook"}) {
+			t.Errorf("a data.shared notification would be delivered through %v", deliver)
+		}
+
+		if err = c.DeleteNotificationPrefs(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("pins", func(t *testing.T) {
+		for _, id := range []string{"/iplant/home/" + username, "/iplant/home/shared"} {
+			if _, err := c.PinItem(ctx, username, "folder", id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := c.PinItem(ctx, username, "folder", "/iplant/home/other")
+		if limited, ok := err.(*client.Error); !ok || limited.Code != "limit_reached" {
+			t.Errorf("pinning more than the limit returned %v", err)
+		}
+
+		reordered, err := c.ReorderPins(ctx, username, "folder", []string{"/iplant/home/shared", "/iplant/home/" + username})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reordered) != 2 || reordered[0].ID != "/iplant/home/shared" {
+			t.Errorf("unexpected pins: %+v", reordered)
+		}
+
+		if err = c.UnpinItem(ctx, username, "folder", "/iplant/home/shared"); err != nil {
+			t.Fatal(err)
+		}
+		integrationRequest(t, server, http.MethodGet, "/pins/"+username+"/folder", "", nil, http.StatusOK)
+
+		pins, err := c.GetPins(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if folders := pins["folder"]; len(folders) != 1 || folders[0].Position != 0 || len(pins["app"]) != 0 {
+			t.Errorf("unexpected pins: %+v", pins)
+		}
+
+		if err = c.UnpinAll(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		tag, err := c.CreateTag(ctx, username, "integration")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.CreateTag(ctx, username, "integration")
+		if duplicate, ok := err.(*client.Error); !ok || duplicate.Code != "conflict" {
+			t.Errorf("creating a duplicate tag returned %v", err)
+		}
+
+		ids := []string{"/iplant/home/" + username + "/a", "/iplant/home/" + username + "/b"}
+		attached, err := c.TagResources(ctx, username, tag.ID, append(ids, ids[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attached != 2 {
+			t.Errorf("unexpected attached count: %d", attached)
+		}
+
+		detached, err := c.UntagResources(ctx, username, tag.ID, ids[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detached != 1 {
+			t.Errorf("unexpected detached count: %d", detached)
+		}
+
+		resources, err := c.GetTaggedResources(ctx, username, tag.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != 1 || resources[0].ID != ids[1] {
+			t.Errorf("unexpected resources: %+v", resources)
+		}
+
+		tags, err := c.GetTags(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 1 || tags[0].ID != tag.ID {
+			t.Errorf("unexpected tags: %+v", tags)
+		}
+
+		if err = c.DeleteTag(ctx, username, tag.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.GetTaggedResources(ctx, username, tag.ID); !client.IsNotFound(err) {
+			t.Errorf("getting the resources of a deleted tag returned %v", err)
+		}
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		created, err := c.CreateToken(ctx, username, "integration", []string{"write", "read"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.Secret == "" || created.ExpiresAt == nil || len(created.Scopes) != 2 || created.Scopes[0] != "read" {
+			t.Errorf("unexpected token: %+v", created)
+		}
+
+		_, err = c.CreateToken(ctx, username, "integration", []string{"read"}, nil)
+		if duplicate, ok := err.(*client.Error); !ok || duplicate.Code != "conflict" {
+			t.Errorf("creating a duplicate token returned %v", err)
+		}
+		if _, err = c.CreateToken(ctx, username, "admin", []string{"admin"}, nil); err == nil {
+			t.Error("creating a token with an unknown scope succeeded")
+		}
+
+		verification, err := c.VerifyToken(ctx, created.Secret, "read")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verification.Active || verification.Username != username || verification.ID != created.ID {
+			t.Errorf("unexpected verification: %+v", verification)
+		}
+
+		tokens, err := c.GetTokens(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+			t.Errorf("unexpected tokens: %+v", tokens)
+		}
+
+		if err = c.RevokeToken(ctx, username, created.ID); err != nil {
+			t.Fatal(err)
+		}
+		if verification, err = c.VerifyToken(ctx, created.Secret, ""); err != nil || verification.Active {
+			t.Errorf("verifying a revoked token returned %+v, %v", verification, err)
+		}
+
+		if err = c.RevokeAllTokens(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("webhooks", func(t *testing.T) {
+		target := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Webhook-Event") != "test" {
+				writer.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+		defer target.Close()
+
+		webhook, err := c.AddWebhook(ctx, username, target.URL, "custom", []string{"data.shared"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.AddWebhook(ctx, username, target.URL, "slack", nil)
+		if duplicate, ok := err.(*client.Error); !ok || duplicate.Code != "conflict" {
+			t.Errorf("registering a duplicate webhook returned %v", err)
+		}
+
+		if webhook, err = c.UpdateWebhook(ctx, username, webhook.ID, target.URL, "custom", []string{"analysis.completed"}); err != nil {
+			t.Fatal(err)
+		}
+		webhooks, err := c.GetWebhooks(ctx, username, "analysis.completed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(webhooks) != 1 || webhooks[0].ID != webhook.ID {
+			t.Errorf("unexpected webhooks: %+v", webhooks)
+		}
+		if webhooks, err = c.GetWebhooks(ctx, username, "data.shared"); err != nil || len(webhooks) != 0 {
+			t.Errorf("unexpected webhooks for data.shared: %+v, %v", webhooks, err)
+		}
+
+		delivery, err := c.TestWebhook(ctx, username, webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !delivery.Delivered || delivery.Status != http.StatusOK {
+			t.Errorf("unexpected delivery: %+v", delivery)
+		}
+
+		if err = c.DeleteWebhook(ctx, username, webhook.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.DeleteWebhook(ctx, username, webhook.ID); !client.IsNotFound(err) {
+			t.Errorf("deleting a deleted webhook returned %v", err)
+		}
+		if err = c.DeleteAllWebhooks(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("dashboard", func(t *testing.T) {
+		widgets, err := c.SaveDashboard(ctx, username, []client.DashboardWidget{
+			{ID: "news", Column: 1, Row: 0, Collapsed: true},
+			{ID: "recent-analyses", Column: 0, Row: 0},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(widgets) != 2 || widgets[0].ID != "recent-analyses" || !widgets[1].Collapsed {
+			t.Errorf("unexpected widgets: %+v", widgets)
+		}
+
+		_, err = c.PlaceWidget(ctx, username, "apps", 0, 0, false)
+		if occupied, ok := err.(*client.Error); !ok || occupied.Code != "conflict" {
+			t.Errorf("placing a widget in an occupied cell returned %v", err)
+		}
+		if _, err = c.PlaceWidget(ctx, username, "news", 0, 1, false); err != nil {
+			t.Fatal(err)
+		}
+		if widgets, err = c.GetDashboard(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if len(widgets) != 2 || widgets[1].ID != "news" || widgets[1].Column != 0 || widgets[1].Collapsed {
+			t.Errorf("unexpected widgets after moving one: %+v", widgets)
+		}
+
+		if err = c.RemoveWidget(ctx, username, "news"); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.RemoveWidget(ctx, username, "news"); !client.IsNotFound(err) {
+			t.Errorf("removing a removed widget returned %v", err)
+		}
+		if err = c.ResetDashboard(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("consents", func(t *testing.T) {
+		if _, err := c.RecordConsent(ctx, username, "analytics", true, "signup-form"); err != nil {
+			t.Fatal(err)
+		}
+		withdrawn, err := c.RecordConsent(ctx, username, "analytics", false, "settings")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		consents, err := c.GetConsents(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(consents) != 1 || consents[0].Granted || consents[0].GrantedAt == nil ||
+			consents[0].WithdrawnAt == nil || !consents[0].WithdrawnAt.Equal(withdrawn.RecordedAt) {
+			t.Errorf("unexpected consents: %+v", consents)
+		}
+
+		records, total, err := c.GetConsentHistory(ctx, username, "analytics", 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 2 || len(records) != 2 || records[0].ID != withdrawn.ID {
+			t.Errorf("unexpected consent history: %d %+v", total, records)
+		}
+
+		if _, err = c.RecordConsent(ctx, username, "research", true, "settings"); err == nil {
+			t.Error("recording consent to an unknown purpose succeeded")
+		}
+	})
+
+	t.Run("deactivation", func(t *testing.T) {
+		purgeAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		deactivation, err := c.DeactivateUser(ctx, username, "integration test", &purgeAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !deactivation.Deactivated || deactivation.DeactivatedAt == nil {
+			t.Errorf("unexpected deactivation: %+v", deactivation)
+		}
+
+		if err = c.SavePreferences(ctx, username, client.Document{"theme": "dark"}); !client.IsDeactivated(err) {
+			t.Errorf("saving the preferences of a deactivated user returned %v", err)
+		}
+		if _, err = c.GetPreferences(ctx, username); err != nil {
+			t.Errorf("error getting the preferences of a deactivated user: %s", err)
+		}
+		if _, err = c.DeactivateUser(ctx, username, "", nil); err == nil {
+			t.Error("deactivating a deactivated user succeeded")
+		}
+
+		if deactivation, err = c.GetDeactivation(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if !deactivation.Deactivated || deactivation.Reason != "integration test" || deactivation.PurgeAt == nil || !deactivation.PurgeAt.Equal(purgeAt) {
+			t.Errorf("unexpected deactivation: %+v", deactivation)
+		}
+
+		if err = c.ReactivateUser(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if deactivation, err = c.GetDeactivation(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if deactivation.Deactivated || deactivation.PurgeAt != nil {
+			t.Errorf("unexpected deactivation after reactivating: %+v", deactivation)
+		}
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		subject := fmt.Sprintf("f:integration:%d", time.Now().UnixNano())
+		identity, err := c.MapSubject(ctx, username, subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity.Username != qualified {
+			t.Errorf("unexpected identity: %+v", identity)
+		}
+
+		if identity, err = c.GetIdentityBySubject(ctx, subject); err != nil {
+			t.Fatal(err)
+		}
+		if identity.Username != qualified {
+			t.Errorf("subject was mapped to %s instead of %s", identity.Username, qualified)
+		}
+
+		identities, err := c.GetIdentities(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(identities) != 1 || identities[0].Subject != subject {
+			t.Errorf("unexpected identities: %+v", identities)
+		}
+
+		if err = c.UnmapSubject(ctx, username, subject); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.GetIdentityBySubject(ctx, subject); !client.IsNotFound(err) {
+			t.Errorf("looking up an unmapped subject returned %v", err)
+		}
+	})
+
+	t.Run("digests", func(t *testing.T) {
+		if _, err := c.GetDigestSchedule(ctx, username); !client.IsNotFound(err) {
+			t.Errorf("getting a missing digest schedule returned %v", err)
+		}
+
+		schedule, err := c.SaveDigestSchedule(ctx, username, &client.DigestSchedule{
+			Frequency: "daily",
+			Hour:      9,
+			Timezone:  "America/Phoenix",
+			Channels:  []string{"email"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schedule.Username != qualified || schedule.LastSentAt != nil {
+			t.Errorf("unexpected schedule: %+v", schedule)
+		}
+
+		// 16:30 UTC is 9:30 in Phoenix, which doesn't observe daylight
+		// saving time.
+		at := time.Date(2030, 1, 2, 16, 30, 0, 0, time.UTC)
+		isDue := func() bool {
+			schedules, _, err := c.DueDigests(ctx, at, 1000, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, due := range schedules {
+				if due.Username == qualified {
+					return true
+				}
+			}
+			return false
+		}
+		if !isDue() {
+			t.Error("the digest wasn't due")
+		}
+
+		updated, err := c.MarkDigestsSent(ctx, []string{qualified}, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated != 1 {
+			t.Errorf("%d schedules were marked as sent instead of 1", updated)
+		}
+		if isDue() {
+			t.Error("the digest was still due after it was sent")
+		}
+
+		if schedule, err = c.GetDigestSchedule(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if schedule.LastSentAt == nil || !schedule.LastSentAt.Equal(at) {
+			t.Errorf("unexpected schedule: %+v", schedule)
+		}
+
+		if err = c.DeleteDigestSchedule(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("locale", func(t *testing.T) {
+		locale, err := c.GetLocale(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locale.Timezone != "UTC" || locale.Locale != "en-US" || locale.UpdatedAt != nil {
+			t.Errorf("unexpected default locale: %+v", locale)
+		}
+
+		if locale, err = c.SaveLocale(ctx, username, "America/Phoenix", "es_mx"); err != nil {
+			t.Fatal(err)
+		}
+		if locale.Username != qualified || locale.Locale != "es-MX" || locale.UpdatedAt == nil {
+			t.Errorf("unexpected saved locale: %+v", locale)
+		}
+
+		if locale, err = c.GetLocale(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if locale.Timezone != "America/Phoenix" || locale.Locale != "es-MX" {
+			t.Errorf("unexpected locale: %+v", locale)
+		}
+	})
+
+	t.Run("activity", func(t *testing.T) {
+		// The audit log is written in the background, so the preference
+		// changes above may take a moment to show up.
+		var (
+			entries []client.ActivityEntry
+			err     error
+		)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if entries, _, err = c.GetActivity(ctx, username, "preferences", 10, 0); err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 {
+				break
+			}
+		}
+		if len(entries) == 0 || entries[0].Module != "preferences" {
+			t.Errorf("unexpected activity: %+v", entries)
+		}
+	})
+
+	t.Run("impersonation", func(t *testing.T) {
+		// Support staff act on the user's data under their own username.
+		impersonating := client.Impersonating(ctx, username)
+		if err := c.SavePreferences(impersonating, "support-user", client.Document{"theme": "dark"}); err != nil {
+			t.Fatal(err)
+		}
+
+		prefs, err := c.GetPreferences(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefs["theme"] != "dark" {
+			t.Errorf("preferences were %v", prefs)
+		}
+	})
+
+	t.Run("feedback", func(t *testing.T) {
+		feedback, err := c.SubmitFeedback(ctx, username, "integration-survey", client.Document{"score": 9, "comment": "great"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		submissions, total, err := c.ListFeedback(ctx, username, "integration-survey", 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(submissions) != 1 || submissions[0].ID != feedback.ID {
+			t.Errorf("unexpected submissions: %d %+v", total, submissions)
+		}
+
+		integrationRequest(t, server, http.MethodGet, "/admin/feedback?form_id=integration-survey", "", nil, http.StatusOK)
+		export := integrationRequest(t, server, http.MethodGet, "/admin/feedback/export?form_id=integration-survey", "", nil, http.StatusOK)
+		if !strings.HasPrefix(string(export), "id,username,form_id,submitted_at,comment,score\n") {
+			t.Errorf("unexpected export: %s", export)
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		body := integrationRequest(t, server, http.MethodPost, "/admin/webhooks", "application/json",
+			strings.NewReader(`{"url":"http://localhost:1/hook","secret":"s"}`), http.StatusCreated)
+		var sub struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(body, &sub); err != nil {
+			t.Fatal(err)
+		}
+
+		integrationRequest(t, server, http.MethodGet, "/admin/webhooks", "", nil, http.StatusOK)
+		integrationRequest(t, server, http.MethodGet, "/admin/webhooks/dead-letters", "", nil, http.StatusOK)
+		integrationRequest(t, server, http.MethodDelete, "/admin/webhooks/"+sub.ID, "", nil, http.StatusOK)
+		integrationRequest(t, server, http.MethodGet, "/admin/audit?username="+qualified, "", nil, http.StatusOK)
+
+		// Usage counts are flushed in the background.
+		var usage UserUsage
+		for deadline := time.Now().Add(5 * time.Second); usage.Requests == 0 && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			body = integrationRequest(t, server, http.MethodGet, "/admin/usage/"+qualified, "", nil, http.StatusOK)
+			if err := json.Unmarshal(body, &usage); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if usage.Requests == 0 || len(usage.Routes) == 0 || len(usage.Days) != 1 {
+			t.Errorf("unexpected usage: %+v", usage)
+		}
+		integrationRequest(t, server, http.MethodGet, "/admin/usage?limit=5", "", nil, http.StatusOK)
+
+		backup := integrationRequest(t, server, http.MethodGet, "/admin/backup?username="+url.QueryEscape(qualified), "", nil, http.StatusOK)
+		body = integrationRequest(t, server, http.MethodPost, "/admin/restore", "application/json", bytes.NewReader(backup), http.StatusOK)
+		var restored struct {
+			Restored map[string]int64 `json:"restored"`
+		}
+		if err := json.Unmarshal(body, &restored); err != nil {
+			t.Fatal(err)
+		}
+		if restored.Restored["users"] != 1 {
+			t.Errorf("restored %v", restored.Restored)
+		}
+	})
+
+	t.Run("deletes", func(t *testing.T) {
+		for _, del := range []func(context.Context, string) error{c.DeletePreferences, c.DeleteSession, c.DeleteSavedSearches, c.DeleteUser} {
+			if err := del(ctx, username); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := c.GetPreferences(ctx, username); err != nil {
+			t.Errorf("error getting the preferences of a purged user: %s", err)
+		}
+	})
+
+	var missing []string
+	for key := range apiOperations {
+		if !routes.routes[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Errorf("routes not exercised by the integration tests: %s", strings.Join(missing, ", "))
+	}
+}
+
+func TestIntegrationSchema(t *testing.T) {
+	if integrationDB == nil {
+		t.Skip("no database for the integration tests")
+	}
+
+	if err := verifySchema(context.Background(), integrationDB); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,65 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonKind returns the name of the kind of JSON value that v was decoded from.
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// ReadObject decodes a request body that must be a JSON object, which is what
+// every module stores. It responds with a 400 and returns false if the body
+// isn't valid JSON or is some other kind of value, such as an array or null.
+// The kind of value that was received is in the received member of the body.
+func ReadObject(writer http.ResponseWriter, body []byte) (map[string]interface{}, bool) {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		BadRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		return nil, false
+	}
+
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		kind := jsonKind(v)
+		msg := fmt.Sprintf("the request body must be a JSON object, not %s", withArticle(kind))
+		WriteProblem(writer, http.StatusBadRequest, CodeBodyNotObject, msg, map[string]interface{}{
+			"received": kind,
+		})
+		log.Error(msg)
+		return nil, false
+	}
+
+	return obj, true
+}
+
+// withArticle prefixes the name of a kind of JSON value with an indefinite
+// article, except for null.
+func withArticle(kind string) string {
+	switch kind {
+	case "null":
+		return kind
+	case "array", "object":
+		return "an " + kind
+	default:
+		return "a " + kind
+	}
+}
@@ -0,0 +1,61 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadObject(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	obj, ok := ReadObject(recorder, []byte(`{"foo":"bar"}`))
+	if !ok {
+		t.Fatalf("an object was rejected with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if obj["foo"] != "bar" {
+		t.Errorf("unexpected object: %v", obj)
+	}
+}
+
+func TestReadObjectRejectsOtherKinds(t *testing.T) {
+	tests := map[string]string{
+		`"string"`: "string",
+		`[1,2,3]`:  "array",
+		`null`:     "null",
+		`42`:       "number",
+		`true`:     "boolean",
+	}
+
+	for body, kind := range tests {
+		recorder := httptest.NewRecorder()
+		if _, ok := ReadObject(recorder, []byte(body)); ok {
+			t.Errorf("%s was accepted", body)
+			continue
+		}
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status for %s was %d", body, recorder.Code)
+		}
+
+		var actual struct {
+			Code     string `json:"code"`
+			Received string `json:"received"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+			t.Fatal(err)
+		}
+		if actual.Code != CodeBodyNotObject || actual.Received != kind {
+			t.Errorf("unexpected problem for %s: %s", body, recorder.Body.String())
+		}
+	}
+}
+
+func TestReadObjectInvalidJSON(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	if _, ok := ReadObject(recorder, []byte(`{"foo":`)); ok {
+		t.Fatal("invalid JSON was accepted")
+	}
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status was %d", recorder.Code)
+	}
+}
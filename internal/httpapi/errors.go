@@ -0,0 +1,90 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header used to accept and return request IDs.
+const RequestIDHeader = "X-Request-ID"
+
+// BadRequest responds with a 400 and logs the message.
+func BadRequest(writer http.ResponseWriter, msg string) {
+	Error(writer, msg, http.StatusBadRequest)
+	log.Error(msg)
+}
+
+// Errored responds with a 500 and logs the message.
+func Errored(writer http.ResponseWriter, msg string) {
+	Error(writer, msg, http.StatusInternalServerError)
+	log.Error(msg)
+}
+
+// NotFound responds with a 404 and logs the message.
+func NotFound(writer http.ResponseWriter, msg string) {
+	Error(writer, msg, http.StatusNotFound)
+	log.Error(msg)
+}
+
+// InvalidFields responds with a 400 for a body whose fields failed
+// validation. fields maps the path of each invalid field, e.g.
+// "channels.sms", to what's wrong with it, and is returned in the fields
+// member of the body.
+func InvalidFields(writer http.ResponseWriter, fields map[string]string) {
+	msg := fmt.Sprintf("%d fields in the request body are not valid", len(fields))
+	if len(fields) == 1 {
+		msg = "a field in the request body is not valid"
+	}
+	WriteProblem(writer, http.StatusBadRequest, CodeInvalidFields, msg, map[string]interface{}{
+		"fields": fields,
+	})
+	log.Errorf("%s: %v", msg, fields)
+}
+
+// RequestTooLarge responds with a 413 if err came from reading past the
+// request body size limit. Returns whether it responded.
+func RequestTooLarge(writer http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+
+	msg := fmt.Sprintf("request body is larger than the limit of %d bytes", tooLarge.Limit)
+	WriteProblem(writer, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, msg, map[string]interface{}{
+		"limit": tooLarge.Limit,
+	})
+	log.Error(msg)
+
+	return true
+}
+
+// ReadBodyError responds to an error that occurred while reading a request
+// body.
+func ReadBodyError(writer http.ResponseWriter, err error) {
+	if !RequestTooLarge(writer, err) {
+		Errored(writer, fmt.Sprintf("error reading body: %s", err))
+	}
+}
+
+// WriteJSON responds with the status and v encoded as JSON.
+func WriteJSON(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+// UserNotFound responds with a 404 for a user that doesn't exist. The
+// username is included in the user member of the body.
+func UserNotFound(writer http.ResponseWriter, username string) {
+	msg := fmt.Sprintf("user %s does not exist", username)
+	WriteProblem(writer, http.StatusNotFound, CodeUserNotFound, msg, map[string]interface{}{
+		"user": username,
+	})
+	log.Error(msg)
+}
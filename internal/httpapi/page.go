@@ -0,0 +1,85 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// TotalCountHeader is the header that paginated listings return the total
+// number of matching items in.
+const TotalCountHeader = "X-Total-Count"
+
+// Page is the part of a listing selected by the limit and offset query
+// parameters.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// ParsePage reads the page from the request's limit and offset query
+// parameters. The limit defaults to defaultLimit and can't be more than
+// maxLimit, unless maxLimit isn't positive.
+func ParsePage(r *http.Request, defaultLimit, maxLimit int) (Page, error) {
+	var (
+		err    error
+		params = r.URL.Query()
+		page   = Page{Limit: defaultLimit}
+	)
+
+	if value := params.Get("limit"); value != "" {
+		page.Limit, err = strconv.Atoi(value)
+		switch {
+		case maxLimit > 0 && (err != nil || page.Limit < 1 || page.Limit > maxLimit):
+			return page, fmt.Errorf("limit must be an integer from 1 to %d: %s", maxLimit, value)
+		case err != nil || page.Limit < 1:
+			return page, fmt.Errorf("limit must be a positive integer: %s", value)
+		}
+	}
+
+	if value := params.Get("offset"); value != "" {
+		if page.Offset, err = strconv.Atoi(value); err != nil || page.Offset < 0 {
+			return page, fmt.Errorf("offset must be a non-negative integer: %s", value)
+		}
+	}
+
+	return page, nil
+}
+
+// PageEnvelope is the response body of every paginated listing. Next is the
+// URL of the following page, relative to the host, or null on the last page.
+type PageEnvelope struct {
+	Items  interface{} `json:"items"`
+	Total  int64       `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Next   *string     `json:"next"`
+}
+
+// nextPage returns the URL of the page after the given one, or nil if there
+// isn't one. Query parameters other than limit and offset are kept.
+func nextPage(r *http.Request, page Page, total int64) *string {
+	if int64(page.Offset)+int64(page.Limit) >= total {
+		return nil
+	}
+
+	params := r.URL.Query()
+	params.Set("limit", strconv.Itoa(page.Limit))
+	params.Set("offset", strconv.Itoa(page.Offset+page.Limit))
+
+	next := r.URL.Path + "?" + params.Encode()
+	return &next
+}
+
+// WritePage responds with a 200 and the page of items in a PageEnvelope. The
+// total number of matching items is also returned in the X-Total-Count header.
+func WritePage(writer http.ResponseWriter, r *http.Request, page Page, items interface{}, total int64) {
+	writer.Header().Set(TotalCountHeader, strconv.FormatInt(total, 10))
+	WriteJSON(writer, http.StatusOK, PageEnvelope{
+		Items:  items,
+		Total:  total,
+		Limit:  page.Limit,
+		Offset: page.Offset,
+		Next:   nextPage(r, page, total),
+	})
+}
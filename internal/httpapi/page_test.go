@@ -0,0 +1,85 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	tests := map[string]Page{
+		"":                     {Limit: 10},
+		"?limit=5":             {Limit: 5},
+		"?offset=20":           {Limit: 10, Offset: 20},
+		"?limit=50&offset=100": {Limit: 50, Offset: 100},
+	}
+
+	for query, expected := range tests {
+		page, err := ParsePage(httptest.NewRequest(http.MethodGet, "/items"+query, nil), 10, 50)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", query, err)
+			continue
+		}
+		if page != expected {
+			t.Errorf("page for %q was %+v instead of %+v", query, page, expected)
+		}
+	}
+}
+
+func TestParsePageRejectsBadValues(t *testing.T) {
+	for _, query := range []string{"?limit=0", "?limit=51", "?limit=ten", "?offset=-1", "?offset=x"} {
+		if _, err := ParsePage(httptest.NewRequest(http.MethodGet, "/items"+query, nil), 10, 50); err == nil {
+			t.Errorf("%q was accepted", query)
+		}
+	}
+
+	page, err := ParsePage(httptest.NewRequest(http.MethodGet, "/items?limit=5000", nil), 10, 0)
+	if err != nil || page.Limit != 5000 {
+		t.Errorf("a limit without a maximum was parsed as %+v, %v", page, err)
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	tests := []struct {
+		page  Page
+		total int64
+		next  string
+	}{
+		{Page{Limit: 2}, 5, "/items?filter=a&limit=2&offset=2"},
+		{Page{Limit: 2, Offset: 2}, 5, "/items?filter=a&limit=2&offset=4"},
+		{Page{Limit: 2, Offset: 4}, 5, ""},
+		{Page{Limit: 2}, 0, ""},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		WritePage(recorder, httptest.NewRequest(http.MethodGet, "/items?filter=a&offset=9", nil), test.page, []string{"x"}, test.total)
+
+		if count := recorder.Header().Get(TotalCountHeader); count != strconv.FormatInt(test.total, 10) {
+			t.Errorf("%s was %q instead of %d", TotalCountHeader, count, test.total)
+		}
+
+		var envelope struct {
+			Items  []string `json:"items"`
+			Total  int64    `json:"total"`
+			Limit  int      `json:"limit"`
+			Offset int      `json:"offset"`
+			Next   *string  `json:"next"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("error decoding %s: %s", recorder.Body.String(), err)
+		}
+
+		if envelope.Total != test.total || envelope.Limit != test.page.Limit || envelope.Offset != test.page.Offset || len(envelope.Items) != 1 {
+			t.Errorf("unexpected envelope for %+v: %s", test.page, recorder.Body.String())
+		}
+		switch {
+		case test.next == "" && envelope.Next != nil:
+			t.Errorf("the last page for %+v linked to %s", test.page, *envelope.Next)
+		case test.next != "" && (envelope.Next == nil || *envelope.Next != test.next):
+			t.Errorf("the next page for %+v was %v instead of %s", test.page, envelope.Next, test.next)
+		}
+	}
+}
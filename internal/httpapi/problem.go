@@ -0,0 +1,132 @@
+// Package httpapi has the helpers that every module of the HTTP API uses to
+// respond to requests, so that errors are reported the same way everywhere.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem details.
+const ProblemContentType = "application/problem+json"
+
+// Machine-readable error codes returned in the code member of problem details.
+const (
+	CodeBadRequest            = "bad_request"
+	CodeUnauthorized          = "unauthorized"
+	CodeForbidden             = "forbidden"
+	CodeNotFound              = "not_found"
+	CodeUserNotFound          = "user_not_found"
+	CodeUserDeactivated       = "user_deactivated"
+	CodeMethodNotAllowed      = "method_not_allowed"
+	CodeConflict              = "conflict"
+	CodeBodyNotObject         = "body_not_object"
+	CodeInvalidBagItems       = "invalid_bag_items"
+	CodeInvalidImportRows     = "invalid_import_rows"
+	CodeUnknownUserDomain     = "unknown_user_domain"
+	CodeRequestTooLarge       = "request_too_large"
+	CodeUnsupportedMediaType  = "unsupported_media_type"
+	CodeRateLimited           = "rate_limited"
+	CodeIdempotencyInProgress = "idempotency_in_progress"
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeInternal              = "internal_error"
+	CodeUnavailable           = "unavailable"
+	CodeOverloaded            = "overloaded"
+	CodeModuleDisabled        = "module_disabled"
+	CodeUpstreamError         = "upstream_error"
+	CodeInvalidFields         = "invalid_fields"
+	CodeLimitReached          = "limit_reached"
+)
+
+// statusCodes maps HTTP statuses to the error code used when a response doesn't
+// have a more specific one. Every module uses the same statuses for the same
+// kinds of failure:
+//   - 400 for requests that fail validation, such as malformed JSON bodies.
+//   - 403 for writes to the data of users whose accounts are deactivated.
+//   - 404 for users, and data belonging to them, that don't exist, including
+//     deletes of data that was never stored.
+//   - 409 for writes that conflict with data that's already stored.
+//   - 415 for request bodies that aren't the media type the route accepts.
+//   - 500 for everything else, including failed database queries.
+//   - 502 when a service that the request depends on, such as the identity
+//     provider, fails.
+//   - 503 while the database circuit breaker is open, while too many requests
+//     are in flight, or while a module is offline.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodeRequestTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusBadGateway:            CodeUpstreamError,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// Problem is the body of an error response, as described by RFC 7807. Code is
+// a machine-readable identifier for the error and RequestID matches the
+// X-Request-ID response header.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteProblem responds with a problem details body. Any extra members are
+// added to the body alongside the standard ones.
+func WriteProblem(writer http.ResponseWriter, status int, code, detail string, extra map[string]interface{}) {
+	p := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		RequestID: writer.Header().Get(RequestIDHeader),
+	}
+
+	var body interface{} = p
+	if len(extra) > 0 {
+		members := map[string]interface{}{
+			"type":   p.Type,
+			"title":  p.Title,
+			"status": p.Status,
+			"code":   p.Code,
+		}
+		if p.Detail != "" {
+			members["detail"] = p.Detail
+		}
+		if p.RequestID != "" {
+			members["request_id"] = p.RequestID
+		}
+		for k, v := range extra {
+			members[k] = v
+		}
+		body = members
+	}
+
+	writer.Header().Set("Content-Type", ProblemContentType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		log.Error(err)
+	}
+}
+
+// Error is the problem details version of http.Error. The error code is
+// the default one for the status.
+func Error(writer http.ResponseWriter, msg string, status int) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+	}
+	WriteProblem(writer, status, code, msg, nil)
+}
@@ -0,0 +1,94 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBadRequest(t *testing.T) {
+	expected := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(http.StatusBadRequest),
+		Status:    http.StatusBadRequest,
+		Code:      CodeBadRequest,
+		Detail:    "test message",
+		RequestID: "request-1",
+	}
+
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set(RequestIDHeader, "request-1")
+	BadRequest(recorder, "test message")
+	actualStatus := recorder.Code
+
+	if actualStatus != expected.Status {
+		t.Errorf("Status code was %d but should have been %d", actualStatus, expected.Status)
+	}
+
+	if ct := recorder.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Errorf("Content-Type was '%s' instead of '%s'", ct, ProblemContentType)
+	}
+
+	var actual Problem
+	if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual != expected {
+		t.Errorf("Problem was %+v but should have been %+v", actual, expected)
+	}
+}
+
+func TestErrored(t *testing.T) {
+	expected := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(http.StatusInternalServerError),
+		Status:    http.StatusInternalServerError,
+		Code:      CodeInternal,
+		Detail:    "test message",
+		RequestID: "request-1",
+	}
+
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set(RequestIDHeader, "request-1")
+	Errored(recorder, "test message")
+	actualStatus := recorder.Code
+
+	if actualStatus != expected.Status {
+		t.Errorf("Status code was %d but should have been %d", actualStatus, expected.Status)
+	}
+
+	if ct := recorder.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Errorf("Content-Type was '%s' instead of '%s'", ct, ProblemContentType)
+	}
+
+	var actual Problem
+	if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual != expected {
+		t.Errorf("Problem was %+v but should have been %+v", actual, expected)
+	}
+}
+
+func TestInvalidFields(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	InvalidFields(recorder, map[string]string{"channels.sms": "unknown channel"})
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Status code was %d but should have been %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	var actual struct {
+		Code   string            `json:"code"`
+		Fields map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+	if actual.Code != CodeInvalidFields || actual.Fields["channels.sms"] != "unknown channel" {
+		t.Errorf("unexpected problem: %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// JobFunc runs a background job once. It returns the number of rows that it
+// processed.
+type JobFunc func(ctx context.Context) (int64, error)
+
+// scheduledJob is a job that the Scheduler runs every interval.
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	run      JobFunc
+
+	vars      *expvar.Map
+	runs      *expvar.Int
+	failures  *expvar.Int
+	processed *expvar.Int
+	duration  *expvar.Float
+	lastRun   *expvar.String
+}
+
+// runOnce runs the job and records its metrics.
+func (j *scheduledJob) runOnce(ctx context.Context) {
+	start := time.Now()
+	count, err := j.run(ctx)
+	j.runs.Add(1)
+	j.duration.Set(time.Since(start).Seconds())
+	j.lastRun.Set(start.UTC().Format(time.RFC3339))
+
+	if err != nil {
+		j.failures.Add(1)
+		log.WithContext(ctx).WithField("job", j.name).Error(err)
+		return
+	}
+
+	j.processed.Add(count)
+	if count > 0 {
+		log.WithContext(ctx).WithField("job", j.name).Infof("%s processed %d rows", j.name, count)
+	}
+}
+
+// Scheduler runs periodic background jobs, such as purging expired rows, on
+// exactly one replica of the service. The replicas elect a leader by taking a
+// Postgres advisory lock on a dedicated connection; the one holding the lock
+// runs every job, and the others try to take it over every election interval
+// in case the leader goes away. The lock is released when the leader's
+// connection closes, so a replica that dies gives up leadership with it.
+type Scheduler struct {
+	db       *sql.DB
+	lockKey  int64
+	election time.Duration
+	jobs     []*scheduledJob
+
+	leader    atomic.Bool
+	elections *expvar.Int
+	vars      *expvar.Map
+	jobVars   *expvar.Map
+}
+
+// NewScheduler returns a new *Scheduler that elects a leader with the advisory
+// lock identified by lockKey, trying to become the leader every election
+// interval.
+func NewScheduler(db *sql.DB, lockKey int64, election time.Duration) *Scheduler {
+	s := &Scheduler{
+		db:        db,
+		lockKey:   lockKey,
+		election:  election,
+		elections: new(expvar.Int),
+		vars:      new(expvar.Map).Init(),
+		jobVars:   new(expvar.Map).Init(),
+	}
+
+	s.vars.Set("leader", expvar.Func(func() interface{} {
+		return s.leader.Load()
+	}))
+	s.vars.Set("elections_won", s.elections)
+	s.vars.Set("jobs", s.jobVars)
+	return s
+}
+
+// Add schedules the job to run every interval while this replica is the
+// leader. Jobs must be added before Run is called.
+func (s *Scheduler) Add(name string, interval time.Duration, run JobFunc) {
+	j := &scheduledJob{
+		name:      name,
+		interval:  interval,
+		run:       run,
+		vars:      new(expvar.Map).Init(),
+		runs:      new(expvar.Int),
+		failures:  new(expvar.Int),
+		processed: new(expvar.Int),
+		duration:  new(expvar.Float),
+		lastRun:   new(expvar.String),
+	}
+	j.vars.Set("runs", j.runs)
+	j.vars.Set("failures", j.failures)
+	j.vars.Set("rows_processed", j.processed)
+	j.vars.Set("last_duration_seconds", j.duration)
+	j.vars.Set("last_run", j.lastRun)
+
+	s.jobs = append(s.jobs, j)
+	s.jobVars.Set(name, j.vars)
+}
+
+// Publish adds the scheduler's state and the metrics of its jobs to the expvar
+// variables under the name. It panics if the name is already in use, like
+// expvar.Publish.
+func (s *Scheduler) Publish(name string) {
+	expvar.Publish(name, s.vars)
+}
+
+// IsLeader returns true while this replica is the one running the jobs.
+func (s *Scheduler) IsLeader() bool {
+	return s.leader.Load()
+}
+
+// Run takes part in leader elections and runs the jobs while this replica is
+// the leader, until the context is canceled.
+func (s *Scheduler) Run(ctx context.Context) {
+	if len(s.jobs) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.election)
+	defer ticker.Stop()
+
+	for {
+		if err := s.lead(ctx); err != nil {
+			log.WithContext(ctx).Errorf("error electing the background job leader: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead tries to take the advisory lock. If it gets it, it runs the jobs until
+// the context is canceled or the lock's connection fails, then releases the
+// lock.
+func (s *Scheduler) lead(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, s.lockKey).Scan(&locked); err != nil {
+		conn.Close()
+		return err
+	}
+	if !locked {
+		return conn.Close()
+	}
+
+	s.leader.Store(true)
+	s.elections.Add(1)
+	log.WithContext(ctx).Info("became the background job leader")
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, j := range s.jobs {
+		wg.Add(1)
+		go func(j *scheduledJob) {
+			defer wg.Done()
+			runEvery(leaderCtx, j.interval, j.runOnce)
+		}(j)
+	}
+
+	// The lock is only held while the connection is alive, so leadership is
+	// given up as soon as it fails.
+	runEvery(leaderCtx, s.election, func(ctx context.Context) {
+		if err := conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+			log.WithContext(ctx).Errorf("lost the background job leader's connection: %s", err)
+			cancel()
+		}
+	})
+	cancel()
+	wg.Wait()
+
+	s.leader.Store(false)
+	log.WithContext(ctx).Info("stopped being the background job leader")
+	return s.unlock(conn)
+}
+
+// unlock releases the advisory lock held on the connection and returns the
+// connection to the pool. If the lock can't be released, the connection is
+// closed instead so that the lock goes with it.
+func (s *Scheduler) unlock(conn *sql.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.election)
+	defer cancel()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, s.lockKey); err != nil {
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		conn.Close()
+		return fmt.Errorf("error releasing the background job lock: %w", err)
+	}
+	return conn.Close()
+}
+
+// runEvery calls f every interval until the context is canceled.
+func runEvery(ctx context.Context, interval time.Duration, f func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f(ctx)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	log "github.com/sirupsen/logrus"
+)
+
+// The names of the listeners that the HTTP API is served on.
+const (
+	publicListener = "public"
+	adminListener  = "admin"
+)
+
+type listenerKey struct{}
+
+// onListener returns a handler that marks the requests passed to next as having
+// arrived on the named listener.
+func onListener(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), listenerKey{}, name)))
+	})
+}
+
+// requestListener returns the name of the listener that the request arrived
+// on, or an empty string if it wasn't marked by onListener.
+func requestListener(r *http.Request) string {
+	name, _ := r.Context().Value(listenerKey{}).(string)
+	return name
+}
+
+// adminOnly returns whether the request is for a privileged route: the routes
+// under /admin, the expvar metrics, purges of everything stored for a user, and
+// deactivating and reactivating accounts.
+func adminOnly(r *http.Request) bool {
+	route := requestRoute(r)
+	switch {
+	case route == "/admin" || strings.HasPrefix(route, "/admin/"):
+		return true
+	case route == "/debug/vars":
+		return true
+	case route == "/users/{username}" && r.Method == http.MethodDelete:
+		return true
+	case route == "/users/{username}/deactivate" || route == "/users/{username}/reactivate":
+		return true
+	default:
+		return false
+	}
+}
+
+// restrictPublicListener is middleware that responds with a 404 to requests
+// for privileged routes that arrive on the public listener, so that they're
+// only reachable on the admin listener. It's only used while admin.port is
+// set.
+func restrictPublicListener(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if requestListener(r) == publicListener && adminOnly(r) {
+			httpapi.Error(writer, fmt.Sprintf("no route for %s", r.URL.Path), http.StatusNotFound)
+			log.WithContext(r.Context()).Errorf("%s %s is only served on the admin listener", r.Method, r.URL.Path)
+			return
+		}
+		next.ServeHTTP(writer, r)
+	})
+}
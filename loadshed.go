@@ -0,0 +1,172 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// inFlightLimit counts the requests being handled against a limit.
+type inFlightLimit struct {
+	limit    int64
+	inFlight atomic.Int64
+	shed     *expvar.Int
+	vars     *expvar.Map
+}
+
+func newInFlightLimit(limit int) *inFlightLimit {
+	l := &inFlightLimit{
+		limit: int64(limit),
+		shed:  new(expvar.Int),
+		vars:  new(expvar.Map).Init(),
+	}
+
+	limitVar := new(expvar.Int)
+	limitVar.Set(l.limit)
+	l.vars.Set("limit", limitVar)
+	l.vars.Set("in_flight", expvar.Func(func() interface{} {
+		return l.inFlight.Load()
+	}))
+	l.vars.Set("shed", l.shed)
+	return l
+}
+
+// acquire counts a request if there's room for it under the limit. If it
+// returns true, release must be called once the request has been handled.
+func (l *inFlightLimit) acquire() bool {
+	if l.inFlight.Add(1) > l.limit {
+		l.inFlight.Add(-1)
+		l.shed.Add(1)
+		return false
+	}
+	return true
+}
+
+// release stops counting a request that was acquired.
+func (l *inFlightLimit) release() {
+	l.inFlight.Add(-1)
+}
+
+// ConcurrencyLimiter sheds load by rejecting requests once too many are being
+// handled at the same time, either overall or within a route group, so that
+// traffic spikes get quick 503s instead of exhausting the database connection
+// pool and memory. A route's group is the first segment of its path template,
+// e.g. bags for /bags/{username}. Requests that don't use the database, such
+// as the status endpoints, are never shed.
+type ConcurrencyLimiter struct {
+	overall *inFlightLimit
+	groups  map[string]*inFlightLimit
+	vars    *expvar.Map
+}
+
+// NewConcurrencyLimiter returns a new *ConcurrencyLimiter that allows up to
+// maxInFlight requests at once, and up to the limit in groups for the requests
+// in each route group. Non-positive limits disable the matching check.
+func NewConcurrencyLimiter(maxInFlight int, groups map[string]int) *ConcurrencyLimiter {
+	c := &ConcurrencyLimiter{
+		groups: make(map[string]*inFlightLimit),
+		vars:   new(expvar.Map).Init(),
+	}
+
+	if maxInFlight > 0 {
+		c.overall = newInFlightLimit(maxInFlight)
+		c.vars.Set("overall", c.overall.vars)
+	}
+
+	groupVars := new(expvar.Map).Init()
+	for group, limit := range groups {
+		if limit > 0 {
+			c.groups[group] = newInFlightLimit(limit)
+			groupVars.Set(group, c.groups[group].vars)
+		}
+	}
+	c.vars.Set("groups", groupVars)
+
+	return c
+}
+
+// Publish adds the limiter's counters to the expvar variables under the name.
+// It panics if the name is already in use, like expvar.Publish.
+func (c *ConcurrencyLimiter) Publish(name string) {
+	expvar.Publish(name, c.vars)
+}
+
+// concurrencyLimiterFromConfig returns a *ConcurrencyLimiter configured from
+// the http.concurrency settings.
+func concurrencyLimiterFromConfig(cfg *viper.Viper) (*ConcurrencyLimiter, error) {
+	maxInFlight := cfg.GetInt("http.concurrency.max_in_flight")
+	if maxInFlight < 0 {
+		return nil, fmt.Errorf("invalid http.concurrency.max_in_flight: %d is negative", maxInFlight)
+	}
+
+	groups := make(map[string]int)
+	for group, value := range cfg.GetStringMapString("http.concurrency.groups") {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid http.concurrency.groups.%s: %q is not a non-negative integer", group, value)
+		}
+		groups[group] = limit
+	}
+
+	return NewConcurrencyLimiter(maxInFlight, groups), nil
+}
+
+// routeGroup returns the group that the request's route belongs to.
+func routeGroup(r *http.Request) string {
+	path := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			path = tmpl
+		}
+	}
+	group, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return group
+}
+
+// shed responds with a 503 to a request that was rejected by the named limit.
+func shed(writer http.ResponseWriter, r *http.Request, limit string) {
+	writer.Header().Set("Retry-After", "1")
+	msg := "the service is handling too many requests"
+	httpapi.WriteProblem(writer, http.StatusServiceUnavailable, httpapi.CodeOverloaded, msg, map[string]interface{}{
+		"limit": limit,
+	})
+	log.WithContext(r.Context()).Errorf("shed %s %s: too many requests in flight for the %s limit", r.Method, r.URL.Path, limit)
+}
+
+// Middleware rejects requests with a 503 and a Retry-After header while the
+// limit for their route group, or the overall limit, has been reached.
+func (c *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if breakerExempt(r) {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		group := routeGroup(r)
+		if l, ok := c.groups[group]; ok {
+			if !l.acquire() {
+				shed(writer, r, group)
+				return
+			}
+			defer l.release()
+		}
+
+		if c.overall != nil {
+			if !c.overall.acquire() {
+				shed(writer, r, "overall")
+				return
+			}
+			defer c.overall.release()
+		}
+
+		next.ServeHTTP(writer, r)
+	})
+}
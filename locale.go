@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	// The timezone database is embedded so that timezones are validated the
+	// same way whether or not the host has one installed.
+	_ "time/tzdata"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	"golang.org/x/text/language"
+)
+
+// validTimezone returns whether the name is an IANA timezone, e.g.
+// "America/Phoenix" or "UTC".
+func validTimezone(name string) bool {
+	if name == "" || name == "Local" || len(name) > 64 {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// canonicalLocale returns the canonical form of the BCP 47 language tag, e.g.
+// "en-US" for "en_us", and whether it's a valid tag for a known language.
+func canonicalLocale(name string) (string, bool) {
+	if len(name) > 64 {
+		return "", false
+	}
+	tag, err := language.Parse(name)
+	if err != nil || tag == language.Und {
+		return "", false
+	}
+	return tag.String(), true
+}
+
+// LocaleApp manages users' timezones and locales, so that other services can
+// format dates, times, and messages for them without parsing free-form values
+// out of their preferences.
+type LocaleApp struct {
+	locales         *LocaleDB
+	defaultTimezone string
+	defaultLocale   string
+	router          *mux.Router
+}
+
+// NewLocaleApp returns a new *LocaleApp. Users who haven't set their timezone
+// and locale get defaultTimezone and defaultLocale.
+func NewLocaleApp(db *LocaleDB, defaultTimezone, defaultLocale string, router *mux.Router) *LocaleApp {
+	l := &LocaleApp{
+		locales:         db,
+		defaultTimezone: defaultTimezone,
+		defaultLocale:   defaultLocale,
+		router:          moduleRouter(router, "locale", "/locale"),
+	}
+	l.router.HandleFunc("/{username}", l.GetRequest).Methods(http.MethodGet)
+	l.router.HandleFunc("/{username}", l.PutRequest).Methods(http.MethodPut)
+	return l
+}
+
+// GetRequest returns the user's timezone and locale, or the defaults with a
+// null updated_at if they haven't set them.
+func (l *LocaleApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, l.locales.isUser)
+	if !ok {
+		return
+	}
+
+	locale, err := l.locales.getLocale(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the locale of user %s: %s", username, err))
+		return
+	}
+	if locale == nil {
+		locale = &Locale{Username: username, Timezone: l.defaultTimezone, Locale: l.defaultLocale}
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, locale)
+}
+
+// PutRequest replaces the user's timezone and locale and responds with them,
+// with a 201 if the user hadn't set them before. The body is {"timezone": ...,
+// "locale": ...}; the locale is stored in its canonical form.
+func (l *LocaleApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, l.locales.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Timezone string `json:"timezone"`
+		Locale   string `json:"locale"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+
+	invalid := make(map[string]string)
+	if !validTimezone(body.Timezone) {
+		invalid["timezone"] = "must be an IANA timezone, e.g. America/Phoenix"
+	}
+	canonical, valid := canonicalLocale(body.Locale)
+	if !valid {
+		invalid["locale"] = "must be a BCP 47 language tag, e.g. en-US"
+	}
+	if len(invalid) > 0 {
+		httpapi.InvalidFields(writer, invalid)
+		return
+	}
+
+	locale := &Locale{Timezone: body.Timezone, Locale: canonical}
+	created, err := l.locales.setLocale(r.Context(), username, locale)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error storing the locale of user %s: %s", username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, locale)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/queries"
+)
+
+// Locale is a user's IANA timezone and BCP 47 locale. UpdatedAt is nil if the
+// user hasn't set them, and the defaults are returned instead.
+type Locale struct {
+	Username  string     `json:"username"`
+	Timezone  string     `json:"timezone"`
+	Locale    string     `json:"locale"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// LocaleDB handles interacting with the user_locales table.
+type LocaleDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewLocaleDB returns a newly created *LocaleDB. Reads of a single user's
+// locale are cached in cache, which may be nil to disable caching.
+func NewLocaleDB(db *sql.DB, cache Cache) *LocaleDB {
+	return &LocaleDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func localeKey(username string) string {
+	return cacheKey("locale", "settings", username)
+}
+
+// isUser returns whether or not the user is present in the database.
+func (l *LocaleDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, l.cache, l.db, username)
+}
+
+// getLocale returns the locale stored for the user, or nil if nothing is
+// stored.
+func (l *LocaleDB) getLocale(ctx context.Context, username string) (*Locale, error) {
+	if locale, ok := cacheGet[*Locale](ctx, l.cache, localeKey(username)); ok {
+		return locale, nil
+	}
+
+	query, args := userRows("user_locales", "l", username, "u.username", "l.timezone", "l.locale", "l.updated_at").SQL()
+
+	locale := &Locale{}
+	err := l.db.QueryRowContext(ctx, query, args...).Scan(&locale.Username, &locale.Timezone, &locale.Locale, &locale.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		locale, err = nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	cacheSet(ctx, l.cache, localeKey(username), locale)
+	return locale, nil
+}
+
+// setLocale stores the user's locale, filling in when it was updated. Returns
+// whether the user had no locale stored before.
+func (l *LocaleDB) setLocale(ctx context.Context, username string, locale *Locale) (bool, error) {
+	defer cacheInvalidate(ctx, l.cache, localeKey(username))
+
+	query := `INSERT INTO user_locales (user_id, timezone, locale)
+                   VALUES ($1, $2, $3)
+              ON CONFLICT (user_id) DO UPDATE
+                      SET timezone = EXCLUDED.timezone,
+                          locale = EXCLUDED.locale,
+                          updated_at = now()
+                RETURNING (xmax = 0) AS created, updated_at`
+
+	userID, err := queries.UserID(ctx, l.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	var created bool
+	if err = l.db.QueryRowContext(ctx, query, userID, locale.Timezone, locale.Locale).Scan(&created, &locale.UpdatedAt); err != nil {
+		return false, dbError(err)
+	}
+	locale.Username = username
+
+	action := actionUpdated
+	if created {
+		action = actionCreated
+	}
+	l.notify(ctx, Mutation{Module: "locale", Action: action, Username: username})
+	return created, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The log fields that describe the request an entry was logged for.
+var requestLogFields = []string{"request_id", "client_ip", "module", "route", "username", "impersonator"}
+
+// logFormatter returns the logrus formatter for the log.format setting, which
+// is text or json.
+func logFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &log.TextFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported log format '%s'; use text or json", format)
+	}
+}
+
+// standardFieldsHook adds the standard fields to every log entry: the name of
+// the service and, for entries logged with the context of a request, the
+// fields that requestLogger collects for it. Entries logged with a context
+// that has a span, which is the case while tracing is enabled, also get its
+// trace_id and span_id so that they can be matched to the trace.
+type standardFieldsHook struct {
+	service string
+}
+
+// Levels returns every level, so that the hook fires for all entries.
+func (h *standardFieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds the standard fields that the entry doesn't already have.
+func (h *standardFieldsHook) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data["service"]; !ok {
+		entry.Data["service"] = h.service
+	}
+
+	if entry.Context == nil {
+		return nil
+	}
+
+	if sc := trace.SpanContextFromContext(entry.Context); sc.IsValid() {
+		entry.Data["trace_id"] = sc.TraceID().String()
+		entry.Data["span_id"] = sc.SpanID().String()
+	}
+
+	fields, ok := entry.Context.Value(logFieldsKey{}).(log.Fields)
+	if !ok {
+		return nil
+	}
+	for _, key := range requestLogFields {
+		if _, ok := entry.Data[key]; !ok && fields[key] != nil {
+			entry.Data[key] = fields[key]
+		}
+	}
+	return nil
+}
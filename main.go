@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"database/sql"
 	_ "expvar"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
-	"strings"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/cyverse-de/configurate"
 	"github.com/cyverse-de/dbutil"
-	"github.com/cyverse-de/go-mod/otelutils"
+	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -25,11 +30,17 @@ func main() {
 	var (
 		showVersion = flag.Bool("version", false, "Print the version information")
 		cfgPath     = flag.String("config", "/etc/iplant/de/jobservices.yml", "The path to the config file")
-		port        = flag.String("port", "60000", "The port number to listen on")
+		port        = flag.String("port", "60000", "The port number to listen on, or unix:<path> for a Unix domain socket")
+		migrateDB   = flag.Bool("migrate", false, "Apply any pending database migrations before starting")
 		err         error
 		cfg         *viper.Viper
 	)
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command] [args]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), commandsUsage)
+	}
 	flag.Parse()
 
 	if *showVersion {
@@ -41,23 +52,72 @@ func main() {
 		log.Fatal("--config must be set")
 	}
 
+	command, args := "serve", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if command != "serve" && !maintenanceCommands[command] {
+		flag.Usage()
+		log.Fatalf("unknown command: %s", command)
+	}
+
 	var tracerCtx, cancel = context.WithCancel(context.Background())
 	defer cancel()
-	shutdown := otelutils.TracerProviderFromEnv(tracerCtx, serviceName, func(e error) { log.Fatal(e) })
+	shutdown := tracerProviderFromEnv(tracerCtx, serviceName, func(e error) { log.Fatal(e) })
 	defer shutdown()
 
 	if cfg, err = configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	dburi := cfg.GetString("db.uri")
+	setConfigDefaults(cfg)
+
+	settings, err := loadTunables(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(settings.logLevel)
+	log.SetFormatter(settings.logFormatter)
+	log.AddHook(&standardFieldsHook{service: serviceName})
+
+	if dbRetrier, err = dbRetrierFromConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if dbBreaker, err = circuitBreakerFromConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	schema := cfg.GetString("db.schema")
+	dburi, err := withSearchPath(cfg.GetString("db.uri"), schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Migrations may run for a long time, so they aren't subject to the
+	// statement timeout.
+	if command != "migrate" && !*migrateDB {
+		var statementTimeout time.Duration
+		if s := cfg.GetString("db.statement_timeout"); s != "" {
+			if statementTimeout, err = time.ParseDuration(s); err != nil {
+				log.Fatalf("invalid db.statement_timeout: %s", err)
+			}
+		}
+		if dburi, err = withStatementTimeout(dburi, statementTimeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	driverName, err := dbDriverName(cfg.GetString("db.driver"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	connector, err := dbutil.NewDefaultConnector("1m")
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	log.Info("Connecting to the database...")
-	db, err := connector.Connect("postgres", dburi)
+	db, err := connector.Connect(driverName, dburi)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -69,29 +129,463 @@ func main() {
 	}
 	log.Info("Successfully pinged the database")
 
-	userDomain := strings.Trim(cfg.GetString("users.domain"), "@")
-	if userDomain == "" {
-		userDomain = IplantSuffix
+	if schema != "" && (command == "migrate" || *migrateDB) {
+		if err = createSchema(tracerCtx, db, schema); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if command != "serve" {
+		if err = runCommand(tracerCtx, command, args, cfg, settings, db, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *migrateDB {
+		if err = migrateUp(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.GetBool("db.verify_schema") {
+		if err = verifySchema(tracerCtx, db); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("verified the database schema")
+	}
+
+	serve(tracerCtx, cfg, settings, db, *cfgPath, *port)
+}
+
+// serve serves the API on the port until the server fails.
+func serve(tracerCtx context.Context, cfg *viper.Viper, settings *tunables, db *sql.DB, cfgPath, port string) {
+	var err error
+
+	apiKeys := cfg.GetStringMapString("auth.api_keys")
+	if cfg.GetBool("auth.require_api_key") && len(apiKeys) == 0 {
+		log.Fatal("auth.api_keys must be set when auth.require_api_key is enabled")
+	}
+	apiKeyAuth := NewAPIKeyAuth(apiKeys, cfg.GetBool("auth.require_api_key"))
+
+	bodySize := NewBodySizeLimit(settings.maxBodySize)
+	queryTimeout := NewQueryTimeout(settings.queryTimeout)
+	rateLimiter := NewRateLimiter(settings.rateLimit, settings.rateLimitBurst)
+
+	routeMetrics := NewRouteMetrics()
+	routeMetrics.Publish("http_routes")
+	dbBreaker.Publish("db_circuit_breaker")
+
+	concurrency, err := concurrencyLimiterFromConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	concurrency.Publish("http_concurrency")
+
+	trustedProxies, err := NewTrustedProxies(cfg.GetStringSlice("http.trusted_proxies"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	usernames := NewUsernameNormalizer(settings.userDomain, settings.userDomains)
+	usernames.AllowDomainOverride(cfg.GetStringSlice("users.domain_override_keys"))
+	usernames.AllowImpersonation(cfg.GetStringSlice("auth.admin_keys"))
+	middleware := []mux.MiddlewareFunc{trustedProxies.Middleware, routeMetrics.Middleware, concurrency.Middleware, apiKeyAuth.Middleware, dbBreaker.Middleware, queryTimeout.Middleware, bodySize.Middleware, usernames.Middleware}
+
+	// Usage is counted before rate limiting so that rejected requests from
+	// clients that hammer the service are counted too.
+	usageDB := NewUsageDB(db)
+	var usageRecorder *UsageRecorder
+	if cfg.GetBool("usage.enabled") {
+		usageRecorder = NewUsageRecorder(usageDB)
+		middleware = append(middleware, usageRecorder.Middleware)
+	}
+	middleware = append(middleware, rateLimiter.Middleware)
+
+	// With an admin listener, the privileged routes are hidden from the public
+	// one before anything else looks at the request.
+	adminPort := cfg.GetString("admin.port")
+	if adminPort != "" {
+		middleware = append([]mux.MiddlewareFunc{restrictPublicListener}, middleware...)
+	}
+
+	// Legacy clients that don't send a Content-Type can turn the check off.
+	if cfg.GetBool("http.require_content_type") {
+		middleware = append(middleware, requireContentType)
+	}
+
+	var idempotency *Idempotency
+	if cfg.GetBool("idempotency.enabled") {
+		idempotencyWindow, err := time.ParseDuration(cfg.GetString("idempotency.window"))
+		if err != nil {
+			log.Fatalf("invalid idempotency.window: %s", err)
+		}
+		idempotency = NewIdempotency(NewIdempotencyDB(db), idempotencyWindow)
+		middleware = append(middleware, idempotency.Middleware)
 	}
 
-	router := makeRouter()
+	router := makeRouter(middleware...)
 
-	prefsDB := NewPrefsDB(db)
+	cache, err := cacheFromConfig(cfg, settings.cacheTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	prefsDB := NewPrefsDB(db, cache)
 	prefsApp := NewPrefsApp(prefsDB, router)
 
-	sessionsDB := NewSessionsDB(db)
+	sessionsDB := NewSessionsDB(db, cache)
 	sessionsApp := NewSessionsApp(sessionsDB, router)
 
-	searchesDB := NewSearchesDB(db)
+	searchesDB := NewSearchesDB(db, cache)
 	searchesApp := NewSearchesApp(searchesDB, router)
 
-	bagsApp := NewBagsApp(db, router, userDomain)
+	var bagPaths pathChecker
+	if cfg.GetBool("bags.validate_paths") {
+		if cfg.GetString("data_info.base") == "" {
+			log.Fatal("data_info.base must be set when bags.validate_paths is enabled")
+		}
+
+		dataInfoTimeout, err := time.ParseDuration(cfg.GetString("data_info.timeout"))
+		if err != nil {
+			log.Fatalf("invalid data_info.timeout: %s", err)
+		}
+
+		dataInfo, err := NewDataInfoClient(cfg.GetString("data_info.base"), dataInfoTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bagPaths = dataInfo
+	}
+
+	bagsApp := NewBagsApp(db, router, settings.userDomain, cfg.GetBool("bags.auto_create_default"), cache, bagPaths)
+	bagsApp.SetUserDomains(settings.userDomain, settings.userDomains)
+
+	summaryApp := NewUserSummaryApp(prefsApp, sessionsApp, searchesApp, bagsApp, router)
+	usersDB := NewUsersDB(db, cache)
+	usersApp := NewUsersApp(usersDB, bagsApp, router)
+
+	// Added after the rest of the middleware, since it needs the normalized
+	// username.
+	router.Use(usersApp.RejectDeactivated)
+
+	avatarMaxAge, err := time.ParseDuration(cfg.GetString("avatars.cache_max_age"))
+	if err != nil {
+		log.Fatalf("invalid avatars.cache_max_age: %s", err)
+	}
+	avatarsDB := NewAvatarsDB(db, cache)
+	NewAvatarsApp(avatarsDB, int64(cfg.GetSizeInBytes("avatars.max_size")), avatarMaxAge, router)
+
+	toursDB := NewToursDB(db, cache)
+	NewToursApp(toursDB, router)
+
+	notificationChannels := cfg.GetStringSlice("notification_prefs.channels")
+	defaultChannels := cfg.GetStringSlice("notification_prefs.default_channels")
+	for _, channel := range defaultChannels {
+		if !slices.Contains(notificationChannels, channel) {
+			log.Fatalf("notification_prefs.default_channels has %s, which isn't in notification_prefs.channels", channel)
+		}
+	}
+	notificationPrefsDB := NewNotificationPrefsDB(db, cache)
+	NewNotificationPrefsApp(notificationPrefsDB, notificationChannels, defaultChannels, cfg.GetStringSlice("notification_prefs.event_types"), router)
+
+	feedbackDB := NewFeedbackDB(db, cache)
+
+	pinLimits := make(map[string]int)
+	for itemType, value := range cfg.GetStringMapString("pins.limits") {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			log.Fatalf("pins.limits.%s must be a positive integer, not %s", itemType, value)
+		}
+		pinLimits[itemType] = limit
+	}
+	pinsDB := NewPinsDB(db, cache)
+	NewPinsApp(pinsDB, pinLimits, router)
+
+	tagsDB := NewTagsDB(db, cache)
+	NewTagsApp(tagsDB, router)
+
+	var tokenLifetime time.Duration
+	if s := cfg.GetString("tokens.max_lifetime"); s != "" {
+		if tokenLifetime, err = time.ParseDuration(s); err != nil || tokenLifetime < 0 {
+			log.Fatalf("invalid tokens.max_lifetime: %s", s)
+		}
+	}
+	NewTeamPrefsApp(NewTeamPrefsDB(db, cache), prefsDB, router)
+
+	tokensDB := NewTokensDB(db, cache)
+	NewTokensApp(tokensDB, cfg.GetStringSlice("tokens.scopes"), tokenLifetime, router)
+
+	userWebhookTimeout, err := time.ParseDuration(cfg.GetString("user_webhooks.timeout"))
+	if err != nil {
+		log.Fatalf("invalid user_webhooks.timeout: %s", err)
+	}
+	userWebhooksDB := NewUserWebhooksDB(db, cache)
+	userWebhookClient := newUserWebhookClient(userWebhookTimeout, cfg.GetBool("user_webhooks.allow_private_addresses"))
+	NewUserWebhooksApp(userWebhooksDB, cfg.GetStringSlice("user_webhooks.types"), cfg.GetStringSlice("user_webhooks.topics"), userWebhookClient, router)
+
+	dashboardColumns := cfg.GetInt("dashboard.columns")
+	if dashboardColumns < 1 {
+		log.Fatalf("invalid dashboard.columns: %d", dashboardColumns)
+	}
+	dashboardDB := NewDashboardDB(db, cache)
+	NewDashboardApp(dashboardDB, cfg.GetStringSlice("dashboard.widgets"), dashboardColumns, router)
+	consentsDB := NewConsentsDB(db, cache)
+
+	identityDB := NewIdentityDB(db, cache)
+	NewIdentityApp(identityDB, router)
+
+	digestsDB := NewDigestsDB(db, cache)
+	NewDigestsApp(digestsDB, notificationChannels, router)
+
+	defaultTimezone := cfg.GetString("locale.default_timezone")
+	if !validTimezone(defaultTimezone) {
+		log.Fatalf("locale.default_timezone is %q, which isn't an IANA timezone", defaultTimezone)
+	}
+	defaultLocale, ok := canonicalLocale(cfg.GetString("locale.default_locale"))
+	if !ok {
+		log.Fatalf("locale.default_locale is %q, which isn't a BCP 47 language tag", cfg.GetString("locale.default_locale"))
+	}
+	localeDB := NewLocaleDB(db, cache)
+	NewLocaleApp(localeDB, defaultTimezone, defaultLocale, router)
+
+	// Every observer is registered with each of the types that write users'
+	// data.
+	mutationSources := []mutationSource{prefsDB, sessionsDB, searchesDB, bagsApp.api, usersDB, avatarsDB, toursDB, notificationPrefsDB, feedbackDB, pinsDB, tagsDB, tokensDB, userWebhooksDB, dashboardDB, consentsDB, identityDB, digestsDB, localeDB}
+	addObserver := func(o MutationObserver) {
+		for _, source := range mutationSources {
+			source.AddObserver(o)
+		}
+	}
+
+	changesDB := NewChangesDB(db)
+	addObserver(changesDB)
+	changesApp := NewChangesApp(changesDB, bagsApp, router)
+
+	profiles, err := profileSourceFromConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	profileCacheTTL, err := time.ParseDuration(cfg.GetString("profile.cache_ttl"))
+	if err != nil {
+		log.Fatalf("invalid profile.cache_ttl: %s", err)
+	}
+	profileCache, err := cacheFromConfig(cfg, profileCacheTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	NewProfileApp(db, profiles, profileCache, router)
+
+	adminRouter := newAdminRouter(router, cfg.GetStringSlice("auth.admin_keys"))
+	webhooksDB := NewWebhooksDB(db)
+	webhooksApp := NewWebhooksApp(webhooksDB, adminRouter)
+
+	if cfg.GetBool("debug.pprof.enabled") {
+		if pprofPort := cfg.GetString("debug.pprof.port"); pprofPort != "" {
+			go servePprof(pprofPort)
+		} else {
+			registerPprof(adminRouter)
+		}
+	}
+
+	auditDB := NewAuditDB(db)
+	auditApp := NewAuditApp(auditDB, adminRouter)
+	NewActivityApp(auditDB, usersDB, bagsApp, router)
+	NewUsageApp(usageDB, adminRouter)
+	backupApp := NewBackupApp(NewBackupDB(db, cache), adminRouter)
+	NewFeedbackApp(feedbackDB, router, adminRouter)
+	NewConsentsApp(consentsDB, cfg.GetStringSlice("consents.purposes"), router, adminRouter)
+
+	if cfg.GetBool("audit.enabled") {
+		auditLogger := NewAuditLogger(auditDB, cfg.GetInt("audit.queue_size"))
+		addObserver(auditLogger)
+		go auditLogger.Run(tracerCtx)
+	}
+
+	if usageRecorder != nil {
+		usageFlushInterval, err := time.ParseDuration(cfg.GetString("usage.flush_interval"))
+		if err != nil || usageFlushInterval <= 0 {
+			log.Fatalf("invalid usage.flush_interval: %s", cfg.GetString("usage.flush_interval"))
+		}
+		go usageRecorder.Run(tracerCtx, usageFlushInterval)
+	}
+
+	if cfg.GetBool("webhooks.enabled") {
+		webhookTimeout, err := time.ParseDuration(cfg.GetString("webhooks.timeout"))
+		if err != nil {
+			log.Fatalf("invalid webhooks.timeout: %s", err)
+		}
+
+		webhookBackoff, err := time.ParseDuration(cfg.GetString("webhooks.backoff"))
+		if err != nil {
+			log.Fatalf("invalid webhooks.backoff: %s", err)
+		}
+
+		dispatcher := NewWebhookDispatcher(webhooksDB, webhookTimeout, cfg.GetInt("webhooks.attempts"), webhookBackoff, cfg.GetInt("webhooks.queue_size"))
+		addObserver(dispatcher)
+		go dispatcher.Run(tracerCtx)
+	}
+
+	registerOpenAPI(router, cfg.GetBool("openapi.swagger_ui"))
+
+	// The modules' routers have all been registered by now, so misspelled
+	// module names can be reported.
+	moduleFlags.SetStates(settings.moduleStates)
+
+	reloader := NewReloader(cfgPath, bagsApp, cache, rateLimiter, bodySize, usernames, queryTimeout)
+	reloader.WatchSIGHUP(tracerCtx)
+	if s := cfg.GetString("config.watch_interval"); s != "" {
+		watchInterval, err := time.ParseDuration(s)
+		if err != nil || watchInterval <= 0 {
+			log.Fatalf("invalid config.watch_interval: %s", s)
+		}
+		go reloader.WatchFile(tracerCtx, watchInterval)
+	}
+
+	jobElection, err := time.ParseDuration(cfg.GetString("jobs.election_interval"))
+	if err != nil {
+		log.Fatalf("invalid jobs.election_interval: %s", err)
+	}
+	scheduler := NewScheduler(db, cfg.GetInt64("jobs.lock_key"), jobElection)
+	scheduler.Publish("jobs")
+
+	bagsPurgeInterval, err := time.ParseDuration(cfg.GetString("bags.purge_interval"))
+	if err != nil {
+		log.Fatalf("invalid bags.purge_interval: %s", err)
+	}
+	if bagsPurgeInterval > 0 {
+		scheduler.Add("purge_expired_bags", bagsPurgeInterval, bagsApp.api.PurgeExpiredBags)
+	}
+
+	if idempotency != nil {
+		idempotencyPurgeInterval, err := time.ParseDuration(cfg.GetString("idempotency.purge_interval"))
+		if err != nil {
+			log.Fatalf("invalid idempotency.purge_interval: %s", err)
+		}
+		if idempotencyPurgeInterval > 0 {
+			scheduler.Add("purge_idempotency_keys", idempotencyPurgeInterval, idempotency.purgeExpired)
+		}
+	}
+
+	// Sessions are only pruned on a schedule if sessions.prune_after is set;
+	// otherwise the prune-sessions command can be run by hand.
+	if cfg.GetString("sessions.prune_after") != "" {
+		sessionsPruneAfter, err := time.ParseDuration(cfg.GetString("sessions.prune_after"))
+		if err != nil {
+			log.Fatalf("invalid sessions.prune_after: %s", err)
+		}
+		sessionsPruneInterval, err := time.ParseDuration(cfg.GetString("sessions.prune_interval"))
+		if err != nil {
+			log.Fatalf("invalid sessions.prune_interval: %s", err)
+		}
+		if sessionsPruneInterval > 0 {
+			scheduler.Add("prune_sessions", sessionsPruneInterval, func(ctx context.Context) (int64, error) {
+				usernames, err := sessionsDB.pruneSessions(ctx, time.Now().Add(-sessionsPruneAfter))
+				return int64(len(usernames)), err
+			})
+		}
+	}
+
+	deactivatedPurgeInterval, err := time.ParseDuration(cfg.GetString("users.purge_interval"))
+	if err != nil {
+		log.Fatalf("invalid users.purge_interval: %s", err)
+	}
+	if deactivatedPurgeInterval > 0 {
+		scheduler.Add("purge_deactivated_users", deactivatedPurgeInterval, usersApp.PurgeDeactivatedUsers)
+	}
+
+	usageRetention, err := time.ParseDuration(cfg.GetString("usage.retention"))
+	if err != nil {
+		log.Fatalf("invalid usage.retention: %s", err)
+	}
+	usagePurgeInterval, err := time.ParseDuration(cfg.GetString("usage.purge_interval"))
+	if err != nil {
+		log.Fatalf("invalid usage.purge_interval: %s", err)
+	}
+	if usageRetention > 0 && usagePurgeInterval > 0 {
+		scheduler.Add("purge_usage", usagePurgeInterval, func(ctx context.Context) (int64, error) {
+			return usageDB.purge(ctx, time.Now().Add(-usageRetention))
+		})
+	}
+
+	go scheduler.Run(tracerCtx)
 
 	log.Debug(prefsApp)
 	log.Debug(sessionsApp)
 	log.Debug(searchesApp)
 	log.Debug(bagsApp)
+	log.Debug(summaryApp)
+	log.Debug(usersApp)
+	log.Debug(changesApp)
+	log.Debug(webhooksApp)
+	log.Debug(auditApp)
+	log.Debug(backupApp)
+
+	var handler http.Handler = router
+	if origins := cfg.GetStringSlice("cors.allowed_origins"); len(origins) > 0 {
+		handler = corsHandler(origins, cfg.GetStringSlice("cors.allowed_methods"), cfg.GetStringSlice("cors.allowed_headers"))(handler)
+	}
+
+	server := &http.Server{
+		Handler: onListener(publicListener, handler),
+	}
+
+	certFile := cfg.GetString("tls.cert_file")
+	keyFile := cfg.GetString("tls.key_file")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			log.Fatal("tls.cert_file and tls.key_file must both be set to enable TLS")
+		}
+
+		server.TLSConfig, err = newTLSConfig(cfg.GetString("tls.client_ca_file"), cfg.GetBool("tls.require_client_cert"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if grpcPort := cfg.GetString("grpc.port"); grpcPort != "" {
+		grpcListener, err := listen(grpcPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		grpcServer := newGRPCServer(NewGRPCServer(prefsApp, sessionsApp, searchesApp, bagsApp), apiKeyAuth, usernames, queryTimeout, server.TLSConfig)
+		log.Info("Serving gRPC on ", grpcListener.Addr())
+		go func() {
+			log.Fatal(grpcServer.Serve(grpcListener))
+		}()
+	}
+
+	if adminPort != "" {
+		adminServer := &http.Server{
+			Handler:   onListener(adminListener, router),
+			TLSConfig: server.TLSConfig,
+		}
+		go serveListener(adminServer, adminListener, adminPort)
+	}
+
+	serveListener(server, publicListener, port)
+}
+
+// serveListener serves the server on the port, with TLS if the server has a
+// TLS config, until the listener fails.
+func serveListener(server *http.Server, name, port string) {
+	listener, err := listen(port)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if server.TLSConfig != nil {
+		log.Infof("Listening with TLS on %s for the %s listener", listener.Addr(), name)
+		log.Fatal(server.ServeTLS(listener, "", ""))
+	}
 
-	log.Info("Listening on port ", *port)
-	log.Fatal(http.ListenAndServe(fixAddr(*port), router))
+	log.Infof("Listening on %s for the %s listener", listener.Addr(), name)
+	log.Fatal(server.Serve(listener))
 }
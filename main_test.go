@@ -2,19 +2,56 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cyverse-de/queries"
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/cyverse-de/user-info/userinfopb"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type MockDB struct {
@@ -146,22 +183,27 @@ func TestConvertNormalPreferences(t *testing.T) {
 }
 
 func TestHandleNonUser(t *testing.T) {
-	var (
-		expectedMsg    = "{\"user\":\"test-user\"}\n"
-		expectedStatus = http.StatusNotFound
-	)
+	expectedStatus := http.StatusNotFound
 
 	recorder := httptest.NewRecorder()
-	handleNonUser(recorder, "test-user")
-	actualMsg := recorder.Body.String()
+	httpapi.UserNotFound(recorder, "test-user")
 	actualStatus := recorder.Code
 
 	if actualStatus != expectedStatus {
 		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
 	}
 
-	if actualMsg != expectedMsg {
-		t.Errorf("Message was '%s' but should have been '%s'", actualMsg, expectedMsg)
+	if ct := recorder.Header().Get("Content-Type"); ct != httpapi.ProblemContentType {
+		t.Errorf("Content-Type was '%s' instead of '%s'", ct, httpapi.ProblemContentType)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["user"] != "test-user" || parsed["code"] != httpapi.CodeUserNotFound || parsed["status"] != float64(expectedStatus) {
+		t.Errorf("unexpected problem %v", parsed)
 	}
 }
 
@@ -428,12 +470,12 @@ func TestNewPrefsDB(t *testing.T) {
 	}
 	defer db.Close()
 
-	prefs := NewPrefsDB(db)
+	prefs := NewPrefsDB(db, nil)
 	if prefs == nil {
 		t.Fatal("NewPrefsDB() returned nil")
 	}
 
-	if prefs.db != db {
+	if prefs.db.DB != db {
 		t.Error("dbs did not match")
 	}
 }
@@ -445,12 +487,12 @@ func TestPreferencesIsUser(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewPrefsDB(db)
+	p := NewPrefsDB(db, nil)
 	if p == nil {
 		t.Error("NewPrefsDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").ExpectQuery().
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
 
@@ -475,7 +517,7 @@ func TestHasPreferences(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewPrefsDB(db)
+	p := NewPrefsDB(db, nil)
 	if p == nil {
 		t.Error("NewPrefsDB returned nil")
 	}
@@ -505,12 +547,12 @@ func TestGetPreferences(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewPrefsDB(db)
+	p := NewPrefsDB(db, nil)
 	if p == nil {
 		t.Error("NewPrefsDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT p.id AS id, p.user_id AS user_id, p.preferences AS preferences FROM user_preferences p, users u WHERE p.user_id = u.id AND u.username =").
+	mock.ExpectPrepare("SELECT p.id AS id, p.user_id AS user_id, p.preferences AS preferences FROM user_preferences p, users u WHERE p.user_id = u.id AND u.username =").ExpectQuery().
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences"}).AddRow("1", "2", "{}"))
 
@@ -541,6 +583,53 @@ func TestGetPreferences(t *testing.T) {
 	}
 }
 
+func TestGetPreferencesCached(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db, newMemoryCache(time.Minute))
+	ctx := context.Background()
+
+	mock.ExpectPrepare("SELECT p.id AS id, p.user_id AS user_id, p.preferences AS preferences FROM user_preferences p, users u WHERE p.user_id = u.id AND u.username =").ExpectQuery().
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences"}).AddRow("1", "2", "{}"))
+
+	for i := 0; i < 2; i++ {
+		records, err := p.getPreferences(ctx, "test-user")
+		if err != nil || len(records) != 1 || records[0].Preferences != "{}" {
+			t.Errorf("getPreferences returned %v, %v", records, err)
+		}
+	}
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("2"))
+
+	mock.ExpectExec("UPDATE ONLY user_preferences SET preferences =").
+		WithArgs("2", `{"a":1}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = p.updatePreferences(ctx, "test-user", `{"a":1}`); err != nil {
+		t.Errorf("error updating preferences: %s", err)
+	}
+
+	mock.ExpectQuery("SELECT p.id AS id, p.user_id AS user_id, p.preferences AS preferences FROM user_preferences p, users u WHERE p.user_id = u.id AND u.username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences"}).AddRow("1", "2", `{"a":1}`))
+
+	records, err := p.getPreferences(ctx, "test-user")
+	if err != nil || len(records) != 1 || records[0].Preferences != `{"a":1}` {
+		t.Errorf("getPreferences returned %v, %v after an update", records, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
 func TestInsertPreferences(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -548,7 +637,7 @@ func TestInsertPreferences(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewPrefsDB(db)
+	p := NewPrefsDB(db, nil)
 	if p == nil {
 		t.Error("NewPrefsDB returned nil")
 	}
@@ -577,7 +666,7 @@ func TestUpdatePreferences(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewPrefsDB(db)
+	p := NewPrefsDB(db, nil)
 	if p == nil {
 		t.Error("NewPrefsDB returned nil")
 	}
@@ -606,7 +695,7 @@ func TestDeletePreferences(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewPrefsDB(db)
+	p := NewPrefsDB(db, nil)
 	if p == nil {
 		t.Error("NewPrefsDB returned nil")
 	}
@@ -1005,12 +1094,12 @@ func TestNewSessionsDB(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSessionsDB(db)
+	p := NewSessionsDB(db, nil)
 	if p == nil {
 		t.Fatal("NewSessionsDB returned nil")
 	}
 
-	if db != p.db {
+	if db != p.db.DB {
 		t.Error("dbs did not match")
 	}
 }
@@ -1022,12 +1111,12 @@ func TestSessionsIsUser(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSessionsDB(db)
+	p := NewSessionsDB(db, nil)
 	if p == nil {
 		t.Error("NewSessionsDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").ExpectQuery().
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
 
@@ -1052,7 +1141,7 @@ func TestHasSessions(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSessionsDB(db)
+	p := NewSessionsDB(db, nil)
 	if p == nil {
 		t.Error("NewSessionsDB returned nil")
 	}
@@ -1082,12 +1171,12 @@ func TestGetSessions(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSessionsDB(db)
+	p := NewSessionsDB(db, nil)
 	if p == nil {
 		t.Error("NewSessionsDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT s.id AS id, s.user_id AS user_id, s.session AS session FROM user_sessions s, users u WHERE s.user_id = u.id AND u.username =").
+	mock.ExpectPrepare("SELECT s.id AS id, s.user_id AS user_id, s.session AS session FROM user_sessions s, users u WHERE s.user_id = u.id AND u.username =").ExpectQuery().
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "session"}).AddRow("1", "2", "{}"))
 
@@ -1125,7 +1214,7 @@ func TestInsertSession(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSessionsDB(db)
+	p := NewSessionsDB(db, nil)
 	if p == nil {
 		t.Error("NewSessionsDB returned nil")
 	}
@@ -1154,7 +1243,7 @@ func TestUpdateSession(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSessionsDB(db)
+	p := NewSessionsDB(db, nil)
 	if p == nil {
 		t.Error("NewSessionsDB returned nil")
 	}
@@ -1183,7 +1272,7 @@ func TestDeleteSession(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSessionsDB(db)
+	p := NewSessionsDB(db, nil)
 	if p == nil {
 		t.Error("NewSessionsDB returned nil")
 	}
@@ -1571,12 +1660,12 @@ func TestNewSearchesDB(t *testing.T) {
 	}
 	defer db.Close()
 
-	prefs := NewSearchesDB(db)
+	prefs := NewSearchesDB(db, nil)
 	if prefs == nil {
 		t.Fatal("NewSearchesDB() returned nil")
 	}
 
-	if prefs.db != db {
+	if prefs.db.DB != db {
 		t.Error("dbs did not match")
 	}
 }
@@ -1588,12 +1677,12 @@ func TestSavedSearchesIsUser(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSearchesDB(db)
+	p := NewSearchesDB(db, nil)
 	if p == nil {
 		t.Error("NewSearchesDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").ExpectQuery().
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
 
@@ -1614,12 +1703,12 @@ func TestHasSavedSearches(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSearchesDB(db)
+	p := NewSearchesDB(db, nil)
 	if p == nil {
 		t.Error("NewSearchesDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT EXISTS\\( SELECT 1 FROM user_saved_searches s").
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM user_saved_searches s").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
 
@@ -1644,7 +1733,7 @@ func TestGetSavedSearches(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSearchesDB(db)
+	p := NewSearchesDB(db, nil)
 	if p == nil {
 		t.Error("NewSearchesDB returned nil")
 	}
@@ -1678,7 +1767,7 @@ func TestInsertSavedSearches(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSearchesDB(db)
+	p := NewSearchesDB(db, nil)
 	if p == nil {
 		t.Error("NewSearchesDB returned nil")
 	}
@@ -1707,7 +1796,7 @@ func TestUpdateSavedSearches(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSearchesDB(db)
+	p := NewSearchesDB(db, nil)
 	if p == nil {
 		t.Error("NewSearchesDB returned nil")
 	}
@@ -1736,7 +1825,7 @@ func TestDeleteSavedSearches(t *testing.T) {
 	}
 	defer db.Close()
 
-	p := NewSearchesDB(db)
+	p := NewSearchesDB(db, nil)
 	if p == nil {
 		t.Error("NewSearchesDB returned nil")
 	}
@@ -1776,43 +1865,53 @@ func TestFixAddrWithPrefix(t *testing.T) {
 	}
 }
 
-func TestBadRequest(t *testing.T) {
-	var (
-		expectedMsg    = "test message\n"
-		expectedStatus = http.StatusBadRequest
-	)
+func TestListenTCP(t *testing.T) {
+	listener, err := listen("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
 
-	recorder := httptest.NewRecorder()
-	badRequest(recorder, "test message")
-	actualMsg := recorder.Body.String()
-	actualStatus := recorder.Code
+	if listener.Addr().Network() != "tcp" {
+		t.Errorf("network was %s instead of tcp", listener.Addr().Network())
+	}
+}
 
-	if actualStatus != expectedStatus {
-		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user-info.sock")
+
+	// A stale socket file shouldn't stop the listener from starting.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
 	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
 
-	if actualMsg != expectedMsg {
-		t.Errorf("Message was '%s' but should have been '%s'", actualMsg, expectedMsg)
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
+	defer listener.Close()
 
-func TestErrored(t *testing.T) {
-	var (
-		expectedMsg    = "test message\n"
-		expectedStatus = http.StatusInternalServerError
-	)
+	if listener.Addr().Network() != "unix" || listener.Addr().String() != path {
+		t.Errorf("listener address was %s:%s", listener.Addr().Network(), listener.Addr())
+	}
+}
 
-	recorder := httptest.NewRecorder()
-	errored(recorder, "test message")
-	actualMsg := recorder.Body.String()
-	actualStatus := recorder.Code
+func TestListenUnixKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user-info.conf")
+	if err := os.WriteFile(path, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
 
-	if actualStatus != expectedStatus {
-		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
+	if listener, err := listen("unix:" + path); err == nil {
+		listener.Close()
+		t.Fatal("listening on a regular file succeeded")
 	}
 
-	if actualMsg != expectedMsg {
-		t.Errorf("Message was '%s' but should have been '%s'", actualMsg, expectedMsg)
+	if contents, err := os.ReadFile(path); err != nil || string(contents) != "keep" {
+		t.Errorf("the file was changed: %q, %v", contents, err)
 	}
 }
 
@@ -1880,17 +1979,16 @@ func TestDeleteUnstored(t *testing.T) {
 	}
 	resSearches.Body.Close()
 
-	if len(bodyPrefs) > 0 {
-		t.Errorf("DELETE returned a body: %s", bodyPrefs)
-	}
-	if len(bodySessions) > 0 {
-		t.Errorf("DELETE returned a body: %s", bodySessions)
-	}
-	if len(bodySearches) > 0 {
-		t.Errorf("DELETE returned a body: %s", bodySearches)
+	for _, body := range [][]byte{bodyPrefs, bodySessions, bodySearches} {
+		var problem httpapi.Problem
+		if err := json.Unmarshal(body, &problem); err != nil {
+			t.Errorf("DELETE didn't return a problem: %s", body)
+		} else if problem.Code != httpapi.CodeNotFound {
+			t.Errorf("DELETE returned code %q instead of %q", problem.Code, httpapi.CodeNotFound)
+		}
 	}
 
-	expectedStatus := http.StatusOK
+	expectedStatus := http.StatusNotFound
 	actualStatusPrefs := resPrefs.StatusCode
 	actualStatusSessions := resSessions.StatusCode
 	actualStatusSearches := resSearches.StatusCode
@@ -1940,3 +2038,9651 @@ func TestRootGreeting(t *testing.T) {
 		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
 	}
 }
+
+// -------- Start Bags --------
+
+func TestDiffBagContents(t *testing.T) {
+	stored := BagContents{
+		"name": "my bag",
+		"items": []interface{}{
+			map[string]interface{}{"id": "one", "label": "first"},
+			map[string]interface{}{"id": "two", "label": "second"},
+			map[string]interface{}{"path": "/iplant/home/test-user/three"},
+		},
+	}
+	candidate := BagContents{
+		"name": "renamed bag",
+		"items": []interface{}{
+			map[string]interface{}{"id": "one", "label": "first"},
+			map[string]interface{}{"id": "two", "label": "changed"},
+			map[string]interface{}{"id": "four", "label": "fourth"},
+		},
+	}
+
+	diff := diffBagContents(stored, candidate)
+
+	if len(diff.Added) != 1 || diff.Added[0].Field != "items" || diff.Added[0].Key != "id:four" {
+		t.Errorf("added values were %#v", diff.Added)
+	}
+
+	if len(diff.Removed) != 1 || diff.Removed[0].Key != "path:/iplant/home/test-user/three" {
+		t.Errorf("removed values were %#v", diff.Removed)
+	}
+
+	if len(diff.Changed) != 2 {
+		t.Fatalf("changed values were %#v", diff.Changed)
+	}
+
+	if diff.Changed[0].Field != "items" || diff.Changed[0].Key != "id:two" {
+		t.Errorf("first change was %#v", diff.Changed[0])
+	}
+
+	if diff.Changed[1].Field != "name" || diff.Changed[1].Key != "" {
+		t.Errorf("second change was %#v", diff.Changed[1])
+	}
+}
+
+func TestDiffBagContentsEmpty(t *testing.T) {
+	diff := diffBagContents(BagContents{}, BagContents{})
+
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 || len(diff.Changed) != 0 {
+		t.Errorf("diff of empty bags was not empty: %#v", diff)
+	}
+}
+
+func TestDiffBagContentsWithoutItems(t *testing.T) {
+	stored := BagContents{"foo": "bar", "baz": "quux"}
+	candidate := BagContents{"foo": "bar", "other": true}
+
+	diff := diffBagContents(stored, candidate)
+
+	if len(diff.Added) != 1 || diff.Added[0].Field != "other" || diff.Added[0].Key != "" {
+		t.Errorf("added values were %#v", diff.Added)
+	}
+
+	if len(diff.Removed) != 1 || diff.Removed[0].Field != "baz" {
+		t.Errorf("removed values were %#v", diff.Removed)
+	}
+
+	if len(diff.Changed) != 0 {
+		t.Errorf("changed values were %#v", diff.Changed)
+	}
+}
+
+func TestDiffBagContentsDuplicates(t *testing.T) {
+	item := map[string]interface{}{"id": "one"}
+	stored := BagContents{"items": []interface{}{item, item}}
+	candidate := BagContents{"items": []interface{}{item}}
+
+	diff := diffBagContents(stored, candidate)
+
+	if len(diff.Removed) != 1 || diff.Removed[0].Key != "id:one" {
+		t.Errorf("removed values were %#v", diff.Removed)
+	}
+
+	if len(diff.Added) != 0 || len(diff.Changed) != 0 {
+		t.Errorf("unexpected additions or changes: %#v", diff)
+	}
+}
+
+func TestDiffBagContentsKeySources(t *testing.T) {
+	stored := BagContents{"items": []interface{}{map[string]interface{}{"id": "/a"}}}
+	candidate := BagContents{"items": []interface{}{map[string]interface{}{"path": "/a"}}}
+
+	diff := diffBagContents(stored, candidate)
+
+	if len(diff.Changed) != 0 {
+		t.Errorf("items from different key sources were matched: %#v", diff.Changed)
+	}
+
+	if len(diff.Added) != 1 || len(diff.Removed) != 1 {
+		t.Errorf("diff was %#v", diff)
+	}
+}
+
+func newDiffBagTestServer(t *testing.T) (*httptest.Server, sqlmock.Sqlmock, func()) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+
+	router := mux.NewRouter()
+	NewBagsApp(db, router, IplantSuffix, true, nil, nil)
+	server := httptest.NewServer(router)
+
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").ExpectQuery().
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
+
+	return server, mock, func() {
+		server.Close()
+		db.Close()
+	}
+}
+
+func TestDiffBag(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	username := "test-user@" + IplantSuffix
+
+	mock.ExpectPrepare("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id").ExpectQuery().
+		WithArgs(username, "bag-id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	mock.ExpectQuery("SELECT b.id, b.contents, b.user_id, b.expires_at FROM bags b, users u WHERE b.user_id = u.id").
+		WithArgs(username, "bag-id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "contents", "user_id", "expires_at"}).
+			AddRow("bag-id", []byte(`{"items":[{"id":"one"}]}`), "user-id", nil))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user/bag-id/diff")
+	res, err := http.Post(url, "application/json", strings.NewReader(`{"items":[{"id":"two"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusOK
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type was '%s' instead of 'application/json'", contentType)
+	}
+
+	var diff BagDiff
+	if err = json.Unmarshal(body, &diff); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diff.Added) != 1 || diff.Added[0].Key != "id:two" {
+		t.Errorf("added values were %#v", diff.Added)
+	}
+
+	if len(diff.Removed) != 1 || diff.Removed[0].Key != "id:one" {
+		t.Errorf("removed values were %#v", diff.Removed)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDiffBagNotFound(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectPrepare("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id").ExpectQuery().
+		WithArgs("test-user@"+IplantSuffix, "bag-id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user/bag-id/diff")
+	res, err := http.Post(url, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusNotFound
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDiffBagBadJSON(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectPrepare("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id").ExpectQuery().
+		WithArgs("test-user@"+IplantSuffix, "bag-id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user/bag-id/diff")
+	res, err := http.Post(url, "application/json", strings.NewReader(`[1,2,3]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusBadRequest
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetDefaultBagWithoutCreate(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM default_bags d, users u WHERE d.user_id = u.id").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user/default?create=false")
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusNotFound
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetDefaultBagExpired(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM default_bags d, users u WHERE d.user_id = u.id").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT b.id, b.contents, b.user_id, b.expires_at FROM bags b JOIN default_bags d ON b.id = d.bag_id JOIN users u ON d.user_id = u.id WHERE u.username = \\$1 AND \\(b.expires_at IS NULL OR b.expires_at > now\\(\\)\\)").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "contents", "user_id", "expires_at"}))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user/default?create=false")
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusNotFound
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetDefaultBagInvalidCreate(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user/default?create=maybe")
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusBadRequest
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAddBagExpiredInPast(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user")
+	body := strings.NewReader(`{"items":[],"expires_at":"2000-01-01T00:00:00Z"}`)
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusBadRequest
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAddBagWithExpiration(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-id"))
+
+	mock.ExpectQuery("INSERT INTO bags \\(contents, user_id, expires_at\\) VALUES").
+		WithArgs(`{"items":[]}`, "user-id", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("bag-id"))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user")
+	body := strings.NewReader(`{"items":[],"expires_at":"2999-01-01T00:00:00Z"}`)
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusOK
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPurgeExpiredBags(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	api := &BagsAPI{db: withRetries(db)}
+
+	mock.ExpectExec("DELETE FROM ONLY bags WHERE expires_at IS NOT NULL AND expires_at <= now\\(\\)").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	count, err := api.PurgeExpiredBags(context.Background())
+	if err != nil {
+		t.Errorf("error purging expired bags: %s", err)
+	}
+
+	if count != 3 {
+		t.Errorf("purged %d bags instead of 3", count)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestParseCSVItems(t *testing.T) {
+	input := "id,label\none,first\n,missing\ntwo\n"
+
+	items, rowErrors, err := parseCSVItems(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 {
+		t.Errorf("parsed %d items instead of 1", len(items))
+	}
+
+	if len(rowErrors) != 2 {
+		t.Fatalf("row errors were %#v", rowErrors)
+	}
+
+	if rowErrors[0].Row != 2 || rowErrors[1].Row != 3 {
+		t.Errorf("row errors were %#v", rowErrors)
+	}
+}
+
+func TestParseJSONItems(t *testing.T) {
+	inputs := []string{
+		`[{"id":"one"},{"path":"/two"}]`,
+		`{"items":[{"id":"one"},{"path":"/two"}]}`,
+	}
+
+	for _, input := range inputs {
+		items, rowErrors, err := parseJSONItems(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) != 2 || len(rowErrors) != 0 {
+			t.Errorf("parsing %s returned %#v and %#v", input, items, rowErrors)
+		}
+	}
+
+	_, rowErrors, err := parseJSONItems(strings.NewReader(`[{"id":"one"}, "two", {}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rowErrors) != 2 || rowErrors[0].Row != 2 || rowErrors[1].Row != 3 {
+		t.Errorf("row errors were %#v", rowErrors)
+	}
+
+	if _, _, err = parseJSONItems(strings.NewReader(`"items"`)); err == nil {
+		t.Error("parsing a JSON string did not return an error")
+	}
+}
+
+func TestImportBag(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-id"))
+
+	mock.ExpectQuery("INSERT INTO bags \\(contents, user_id, expires_at\\) VALUES").
+		WithArgs(`{"items":[{"id":"one","label":"first"}]}`, "user-id", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("bag-id"))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "items.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(part, "id,label\none,first\n")
+	form.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user/import")
+	res, err := http.Post(url, form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actualBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusOK
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	expectedBody := []byte(`{"id":"bag-id"}`)
+	if !bytes.Equal(actualBody, expectedBody) {
+		t.Errorf("Message was '%s' but should have been '%s'", actualBody, expectedBody)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetBags(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectQuery("SELECT b.id, b.contents, b.user_id, b.expires_at FROM bags b, users u WHERE b.user_id = u.id").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "contents", "user_id", "expires_at"}).
+			AddRow("one", []byte(`{"items":[]}`), "user-id", nil).
+			AddRow("two", []byte(`{"items":[]}`), "user-id", nil))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user")
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	res.Body.Close()
+
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type was '%s' instead of 'application/json'", contentType)
+	}
+
+	var parsed map[string][]BagRecord
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		t.Fatalf("error parsing '%s': %s", body, err)
+	}
+
+	if len(parsed["bags"]) != 2 || parsed["bags"][0].ID != "one" || parsed["bags"][1].ID != "two" {
+		t.Errorf("bags were %#v", parsed["bags"])
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetBagsEmpty(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectQuery("SELECT b.id, b.contents, b.user_id, b.expires_at FROM bags b, users u WHERE b.user_id = u.id").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "contents", "user_id", "expires_at"}))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user")
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	res.Body.Close()
+
+	expectedBody := []byte(`{"bags":[]}`)
+	if !bytes.Equal(body, expectedBody) {
+		t.Errorf("Message was '%s' but should have been '%s'", body, expectedBody)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestHasBagsHeaders(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	username := "test-user@" + IplantSuffix
+
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id").
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	mock.ExpectQuery("SELECT d.bag_id FROM default_bags d JOIN users u").
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"bag_id"}).AddRow("bag-id"))
+
+	url := fmt.Sprintf("%s/%s", server.URL, "bags/test-user")
+	res, err := http.Head(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expectedStatus := http.StatusOK
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, expectedStatus)
+	}
+
+	if count := res.Header.Get("X-Total-Count"); count != "3" {
+		t.Errorf("X-Total-Count was '%s' instead of '3'", count)
+	}
+
+	if bagID := res.Header.Get("X-Default-Bag-ID"); bagID != "bag-id" {
+		t.Errorf("X-Default-Bag-ID was '%s' instead of 'bag-id'", bagID)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestCountBagsCached(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	api := NewBagsAPI(db, newMemoryCache(time.Minute))
+	ctx := context.Background()
+
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	for i := 0; i < 2; i++ {
+		if hasBags, err := api.HasBags(ctx, "test-user"); err != nil || hasBags {
+			t.Errorf("HasBags returned %t, %v", hasBags, err)
+		}
+	}
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-id"))
+
+	mock.ExpectQuery("INSERT INTO bags").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("bag-id"))
+
+	if _, err = api.AddBag(ctx, "test-user", "{}", nil); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	if hasBags, err := api.HasBags(ctx, "test-user"); err != nil || !hasBags {
+		t.Errorf("HasBags returned %t, %v after adding a bag", hasBags, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestMemoryCacheExpiration(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache(time.Millisecond)
+	cacheSet(ctx, cache, "key", true)
+
+	if value, ok := cacheGet[bool](ctx, cache, "key"); !ok || !value {
+		t.Error("value was not cached")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := cacheGet[bool](ctx, cache, "key"); ok {
+		t.Error("value did not expire")
+	}
+
+	disabled := newMemoryCache(0)
+	cacheSet(ctx, disabled, "key", true)
+	if _, ok := cacheGet[bool](ctx, disabled, "key"); ok {
+		t.Error("disabled cache returned a value")
+	}
+
+	cacheSet(ctx, nil, "key", true)
+	if _, ok := cacheGet[bool](ctx, nil, "key"); ok {
+		t.Error("nil cache returned a value")
+	}
+}
+
+func TestMemoryCacheDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache(time.Minute)
+	cacheSet(ctx, cache, cacheKey("bags", "count", "a"), 1)
+	cacheSet(ctx, cache, cacheKey("bags", "count", "b"), 2)
+	cacheSet(ctx, cache, cacheKey("prefs", "has", "a"), true)
+
+	cacheInvalidatePrefix(ctx, cache, cacheKey("bags", ""))
+
+	if _, ok := cacheGet[int](ctx, cache, cacheKey("bags", "count", "a")); ok {
+		t.Error("bags entry was not removed")
+	}
+	if _, ok := cacheGet[bool](ctx, cache, cacheKey("prefs", "has", "a")); !ok {
+		t.Error("prefs entry was removed")
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	cache := newRedisCache(client, "user-info:", time.Minute)
+	cacheSet(ctx, cache, cacheKey("bags", "count", "a"), 1)
+	cacheSet(ctx, cache, cacheKey("bags", "count", "b"), 2)
+	cacheSet(ctx, cache, cacheKey("prefs", "has", "a"), true)
+
+	if !mr.Exists("user-info:bags:count:a") {
+		t.Error("entry was not stored under the namespace")
+	}
+
+	if value, ok := cacheGet[int](ctx, cache, cacheKey("bags", "count", "b")); !ok || value != 2 {
+		t.Errorf("cached value was %d, %t", value, ok)
+	}
+
+	cacheInvalidate(ctx, cache, cacheKey("bags", "count", "b"))
+	if _, ok := cacheGet[int](ctx, cache, cacheKey("bags", "count", "b")); ok {
+		t.Error("entry was not deleted")
+	}
+
+	cacheInvalidatePrefix(ctx, cache, cacheKey("bags", ""))
+	if _, ok := cacheGet[int](ctx, cache, cacheKey("bags", "count", "a")); ok {
+		t.Error("entry was not deleted by prefix")
+	}
+	if _, ok := cacheGet[bool](ctx, cache, cacheKey("prefs", "has", "a")); !ok {
+		t.Error("unrelated entry was deleted by prefix")
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if _, ok := cacheGet[bool](ctx, cache, cacheKey("prefs", "has", "a")); ok {
+		t.Error("entry did not expire")
+	}
+}
+
+type mockPathChecker map[string]bool
+
+func (m mockPathChecker) pathsExist(ctx context.Context, username string, paths []string) (map[string]bool, error) {
+	return m, nil
+}
+
+func TestValidateBagContents(t *testing.T) {
+	checker := mockPathChecker{"/iplant/home/test-user/exists": true}
+	contents := BagContents{
+		"items": []interface{}{
+			map[string]interface{}{"id": "one", "path": "/iplant/home/test-user/exists"},
+			map[string]interface{}{"id": "two", "path": "/iplant/home/test-user/missing"},
+			map[string]interface{}{"id": "three"},
+		},
+	}
+
+	report, valid, err := validateBagContents(context.Background(), checker, "test-user", contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if valid {
+		t.Error("contents with a missing path were reported as valid")
+	}
+
+	if len(report) != 2 {
+		t.Fatalf("report was %#v", report)
+	}
+
+	if !report[0].Exists || report[1].Exists || report[1].Index != 1 {
+		t.Errorf("report was %#v", report)
+	}
+}
+
+func TestBagItemPathsOrder(t *testing.T) {
+	contents := BagContents{
+		"items":   []interface{}{map[string]interface{}{"path": "/c"}, map[string]interface{}{"path": "/d"}},
+		"archive": []interface{}{map[string]interface{}{"path": "/a"}},
+		"recent":  []interface{}{map[string]interface{}{"path": "/e"}},
+		"folders": []interface{}{map[string]interface{}{"path": "/b"}},
+	}
+
+	expected := []BagItemValidation{
+		{Field: "archive", Index: 0, Path: "/a"},
+		{Field: "folders", Index: 0, Path: "/b"},
+		{Field: "items", Index: 0, Path: "/c"},
+		{Field: "items", Index: 1, Path: "/d"},
+		{Field: "recent", Index: 0, Path: "/e"},
+	}
+	for i := 0; i < 10; i++ {
+		if actual := bagItemPaths(contents); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("paths were %#v instead of %#v", actual, expected)
+		}
+	}
+}
+
+func TestDataInfoClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/existence-marker" || r.URL.Query().Get("user") != "test-user" {
+			t.Errorf("unexpected request to %s", r.URL)
+		}
+
+		var body map[string][]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		paths := make(map[string]bool)
+		for _, path := range body["paths"] {
+			paths[path] = path == "/exists"
+		}
+		json.NewEncoder(writer).Encode(map[string]map[string]bool{"paths": paths})
+	}))
+	defer server.Close()
+
+	client, err := NewDataInfoClient(server.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := client.pathsExist(context.Background(), "test-user@"+IplantSuffix, []string{"/exists", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists["/exists"] || exists["/missing"] {
+		t.Errorf("existence map was %#v", exists)
+	}
+}
+
+const benchmarkBagCount = 5000
+
+func benchmarkBagRows() *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "contents", "user_id", "expires_at"})
+	for i := 0; i < benchmarkBagCount; i++ {
+		contents := fmt.Sprintf(`{"items":[{"id":"item-%d","path":"/iplant/home/test-user/file-%d"}]}`, i, i)
+		rows.AddRow(fmt.Sprintf("bag-%d", i), []byte(contents), "user-id", nil)
+	}
+	return rows
+}
+
+// BenchmarkGetBagsBuffered measures collecting every bag before marshaling the
+// listing, which is how GetBags used to build its response.
+func BenchmarkGetBagsBuffered(b *testing.B) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	api := &BagsAPI{db: withRetries(db)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mock.ExpectQuery("SELECT b.id").WillReturnRows(benchmarkBagRows())
+		b.StartTimer()
+
+		bags, err := api.GetBags(context.Background(), "test-user")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		jsonBytes, err := json.Marshal(map[string][]BagRecord{"bags": bags})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err = ioutil.Discard.Write(jsonBytes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetBagsStreamed measures encoding each bag as it's read, which is how
+// GetBags builds its response.
+func BenchmarkGetBagsStreamed(b *testing.B) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	api := &BagsAPI{db: withRetries(db)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mock.ExpectQuery("SELECT b.id").WillReturnRows(benchmarkBagRows())
+		b.StartTimer()
+
+		encoder := json.NewEncoder(ioutil.Discard)
+		err := api.EachBag(context.Background(), "test-user", func(record BagRecord) error {
+			return encoder.Encode(record)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// -------- End Bags --------
+
+// -------- Start Middleware --------
+
+func TestRequestLoggerAssignsID(t *testing.T) {
+	var seen string
+	router := mux.NewRouter()
+	router.Use(requestLogger)
+	router.HandleFunc("/test/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/test/test-user", nil))
+
+	returned := recorder.Header().Get(httpapi.RequestIDHeader)
+	if returned == "" {
+		t.Error("no request ID was returned")
+	}
+
+	if seen != returned {
+		t.Errorf("handler saw request ID '%s' but '%s' was returned", seen, returned)
+	}
+}
+
+func TestRequestLoggerPropagatesID(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(requestLogger)
+	router.HandleFunc("/test", func(writer http.ResponseWriter, r *http.Request) {
+		writer.WriteHeader(http.StatusTeapot)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set(httpapi.RequestIDHeader, "existing-id")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if id := recorder.Header().Get(httpapi.RequestIDHeader); id != "existing-id" {
+		t.Errorf("request ID was '%s' instead of 'existing-id'", id)
+	}
+
+	if recorder.Code != http.StatusTeapot {
+		t.Errorf("Status code was %d but should have been %d", recorder.Code, http.StatusTeapot)
+	}
+}
+
+// -------- End Middleware --------
+
+// -------- Start Tracing --------
+
+func TestOTLPProtocol(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "")
+	if p := otlpProtocol(); p != "grpc" {
+		t.Errorf("protocol was %s rather than grpc", p)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+	if p := otlpProtocol(); p != "http/protobuf" {
+		t.Errorf("protocol was %s rather than http/protobuf", p)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "grpc")
+	if p := otlpProtocol(); p != "grpc" {
+		t.Errorf("traces protocol did not take precedence, got %s", p)
+	}
+}
+
+func TestTracerProviderFromEnvUnsupportedProtocol(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "otlp")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "http/json")
+
+	var got error
+	shutdown := tracerProviderFromEnv(context.Background(), "user-info", func(e error) { got = e })
+	shutdown()
+
+	if got == nil {
+		t.Error("no error was reported for an unsupported protocol")
+	}
+}
+
+// withSpanRecorder makes a TracerProvider that records the spans it ends the
+// global one for the rest of the test.
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracesdk.NewTracerProvider(tracesdk.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+// spanAttributeMap returns the attributes of the span as strings.
+func spanAttributeMap(span tracesdk.ReadOnlySpan) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestSpanAttributes(t *testing.T) {
+	spans := withSpanRecorder(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+	mock.ExpectExec("UPDATE bags").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM bags").WillReturnError(errors.New("failed"))
+
+	rdb := withRetries(db)
+	router := makeRouter(NewUsernameNormalizer(IplantSuffix, nil).Middleware)
+	moduleRouter(router, "bags", "/bags").HandleFunc("/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		rdb.ExecContext(r.Context(), "UPDATE bags SET contents = '{}'") // nolint:errcheck
+		rdb.ExecContext(r.Context(), "DELETE FROM bags")                // nolint:errcheck
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bags/test-user", nil))
+
+	ended := spans.Ended()
+	if len(ended) != 3 {
+		t.Fatalf("%d spans were recorded instead of 3", len(ended))
+	}
+	update, del, server := ended[0], ended[1], ended[2]
+
+	expected := map[string]string{
+		"http.route":       "/bags/{username}",
+		"enduser.id":       "test-user@" + IplantSuffix,
+		"user_info.module": "bags",
+	}
+	attrs := spanAttributeMap(server)
+	for key, value := range expected {
+		if attrs[key] != value {
+			t.Errorf("server span attribute %s was %q instead of %q", key, attrs[key], value)
+		}
+	}
+
+	if update.Name() != "db.exec" || update.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("unexpected DB span %s with parent %s", update.Name(), update.Parent().SpanID())
+	}
+	attrs = spanAttributeMap(update)
+	if attrs["db.statement"] != "UPDATE bags SET contents = '{}'" || attrs["db.system"] != "postgresql" || attrs["db.attempts"] != "1" {
+		t.Errorf("unexpected DB span attributes %v", attrs)
+	}
+	if update.Status().Code != otelcodes.Unset {
+		t.Errorf("successful DB span status was %v", update.Status())
+	}
+	if del.Status().Code != otelcodes.Error {
+		t.Errorf("failed DB span status was %v", del.Status())
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Tracing --------
+
+// -------- Start Auth --------
+
+func newAPIKeyTestRouter(required bool, seen *string) *mux.Router {
+	auth := NewAPIKeyAuth(map[string]string{"apps": "apps-key", "terrain": "terrain-key"}, required)
+	router := makeRouter(auth.Middleware)
+	router.HandleFunc("/test", func(writer http.ResponseWriter, r *http.Request) {
+		*seen = apiKeyName(r.Context())
+	})
+	return router
+}
+
+func TestAPIKeyAuthValidKey(t *testing.T) {
+	var seen string
+	router := newAPIKeyTestRouter(true, &seen)
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("Authorization", "ApiKey terrain-key")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Status code was %d but should have been %d", recorder.Code, http.StatusOK)
+	}
+
+	if seen != "terrain" {
+		t.Errorf("API key name was '%s' instead of 'terrain'", seen)
+	}
+}
+
+func TestAPIKeyAuthInvalidKey(t *testing.T) {
+	var seen string
+	router := newAPIKeyTestRouter(false, &seen)
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("Authorization", "ApiKey wrong-key")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Status code was %d but should have been %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	if recorder.Header().Get("WWW-Authenticate") != apiKeyScheme {
+		t.Errorf("WWW-Authenticate was '%s'", recorder.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestAPIKeyAuthMissingKey(t *testing.T) {
+	var seen string
+
+	recorder := httptest.NewRecorder()
+	newAPIKeyTestRouter(false, &seen).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Status code was %d but should have been %d when keys are optional", recorder.Code, http.StatusOK)
+	}
+
+	recorder = httptest.NewRecorder()
+	newAPIKeyTestRouter(true, &seen).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Status code was %d but should have been %d when keys are required", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+// -------- End Auth --------
+
+// -------- Start Rate Limiting --------
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1, 2)
+	router := mux.NewRouter()
+	router.Use(limiter.Middleware)
+	router.HandleFunc("/test/{username}", func(writer http.ResponseWriter, r *http.Request) {})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	for i := 0; i < 2; i++ {
+		if recorder := get("/test/test-user"); recorder.Code != http.StatusOK {
+			t.Errorf("request %d: status code was %d but should have been %d", i, recorder.Code, http.StatusOK)
+		}
+	}
+
+	recorder := get("/test/test-user")
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Status code was %d but should have been %d", recorder.Code, http.StatusTooManyRequests)
+	}
+	if recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After was '%s' instead of '1'", recorder.Header().Get("Retry-After"))
+	}
+
+	if recorder := get("/test/other-user"); recorder.Code != http.StatusOK {
+		t.Errorf("other user was limited: status code was %d", recorder.Code)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.0.0.1:12345"
+	if key := rateLimitKey(request); key != "ip:10.0.0.1" {
+		t.Errorf("key was '%s' instead of 'ip:10.0.0.1'", key)
+	}
+
+	request = mux.SetURLVars(request, map[string]string{"username": "test-user"})
+	if key := rateLimitKey(request); key != "user:test-user" {
+		t.Errorf("key was '%s' instead of 'user:test-user'", key)
+	}
+}
+
+// -------- End Rate Limiting --------
+
+// -------- Start Client IPs --------
+
+func TestTrustedProxiesClientAddr(t *testing.T) {
+	proxies, err := NewTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remote    string
+		forwarded []string
+		realIP    string
+		expected  string
+	}{
+		{remote: "203.0.113.5:1234", expected: "203.0.113.5"},
+		{remote: "203.0.113.5:1234", forwarded: []string{"198.51.100.1"}, expected: "203.0.113.5"},
+		{remote: "10.0.0.1:1234", expected: "10.0.0.1"},
+		{remote: "10.0.0.1:1234", forwarded: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{remote: "10.0.0.1:1234", forwarded: []string{"1.2.3.4, 198.51.100.1, 10.0.0.2"}, expected: "198.51.100.1"},
+		{remote: "10.0.0.1:1234", forwarded: []string{"1.2.3.4", "198.51.100.1"}, expected: "198.51.100.1"},
+		{remote: "192.168.1.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{remote: "10.0.0.1:1234", forwarded: []string{"bogus, 10.0.0.2"}, expected: "10.0.0.2"},
+		{remote: "10.0.0.1:1234", realIP: "198.51.100.2", expected: "198.51.100.2"},
+		{remote: "[fd00::1]:1234", realIP: "2001:db8::1", expected: "2001:db8::1"},
+		{remote: "192.168.1.2:1234", realIP: "198.51.100.2", expected: "192.168.1.2"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = tc.remote
+		for _, value := range tc.forwarded {
+			request.Header.Add(forwardedForHeader, value)
+		}
+		if tc.realIP != "" {
+			request.Header.Set(realIPHeader, tc.realIP)
+		}
+
+		if addr := proxies.clientAddr(request); addr != tc.expected {
+			t.Errorf("client address for %s %v %q was %s instead of %s", tc.remote, tc.forwarded, tc.realIP, addr, tc.expected)
+		}
+	}
+}
+
+func TestNewTrustedProxiesInvalid(t *testing.T) {
+	for _, network := range []string{"bogus", "10.0.0.0/33"} {
+		if _, err := NewTrustedProxies([]string{network}); err == nil {
+			t.Errorf("%s was accepted", network)
+		}
+	}
+}
+
+func TestTrustedProxiesMiddleware(t *testing.T) {
+	proxies, err := NewTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var addr, logged string
+	router := makeRouter(proxies.Middleware)
+	router.HandleFunc("/test", func(writer http.ResponseWriter, r *http.Request) {
+		addr = clientIP(r)
+		if fields, ok := r.Context().Value(logFieldsKey{}).(log.Fields); ok {
+			logged, _ = fields["client_ip"].(string)
+		}
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set(forwardedForHeader, "198.51.100.1")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	if addr != "198.51.100.1" || logged != "198.51.100.1" {
+		t.Errorf("client address was %q and logged as %q", addr, logged)
+	}
+	if key := rateLimitKey(request.WithContext(context.WithValue(request.Context(), clientIPKey{}, addr))); key != "ip:198.51.100.1" {
+		t.Errorf("rate limit key was %s", key)
+	}
+}
+
+// -------- End Client IPs --------
+
+// -------- Start CORS --------
+
+func TestCORSPreflight(t *testing.T) {
+	router := makeRouter()
+	router.HandleFunc("/test", func(writer http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+	handler := corsHandler([]string{"http://localhost:3000"}, nil, nil)(router)
+
+	request := httptest.NewRequest(http.MethodOptions, "/test", nil)
+	request.Header.Set("Origin", "http://localhost:3000")
+	request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Status code was %d but should have been %d", recorder.Code, http.StatusOK)
+	}
+
+	if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != "http://localhost:3000" {
+		t.Errorf("Access-Control-Allow-Origin was '%s'", origin)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	router := makeRouter()
+	router.HandleFunc("/test", func(writer http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+	handler := corsHandler([]string{"http://localhost:3000"}, nil, nil)(router)
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("Origin", "http://example.com")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Access-Control-Allow-Origin was '%s' for a disallowed origin", origin)
+	}
+}
+
+// -------- End CORS --------
+
+// -------- Start Body Limits --------
+
+func TestSessionsPutTooLarge(t *testing.T) {
+	mock := NewMockDB()
+	router := mux.NewRouter()
+	router.Use(NewBodySizeLimit(16).Middleware)
+	NewSessionsApp(mock, router)
+
+	username := "test-user"
+	mock.users[username] = true
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, "sessions/"+username)
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(`{"one":"two","three":"four"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Status code was %d but should have been %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	if ct := res.Header.Get("Content-Type"); ct != httpapi.ProblemContentType {
+		t.Errorf("Content-Type was '%s' instead of '%s'", ct, httpapi.ProblemContentType)
+	}
+
+	var parsed map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["code"] != httpapi.CodeRequestTooLarge {
+		t.Errorf("code was %v instead of %s", parsed["code"], httpapi.CodeRequestTooLarge)
+	}
+
+	if parsed["limit"] != float64(16) {
+		t.Errorf("limit was %v instead of 16", parsed["limit"])
+	}
+
+	if _, ok := mock.storage[username]; ok {
+		t.Error("session was stored despite the body being too large")
+	}
+}
+
+// -------- End Body Limits --------
+
+// -------- Start Content Types --------
+
+func TestRequireContentType(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	router := makeRouter(requireContentType)
+	NewPrefsApp(mock, router)
+
+	request := httptest.NewRequest(http.MethodPost, "/preferences/test-user", strings.NewReader("theme=dark"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusUnsupportedMediaType)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed["code"] != httpapi.CodeUnsupportedMediaType || parsed["expected"] != "application/json" {
+		t.Errorf("unexpected problem %v", parsed)
+	}
+	if len(mock.storage) != 0 {
+		t.Errorf("the form-encoded body was stored: %v", mock.storage)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/preferences/test-user", strings.NewReader(`{"theme":"dark"}`))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status code without a Content-Type was %d", recorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/preferences/test-user", strings.NewReader(`{"theme":"dark"}`))
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code for JSON was %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestRequireContentTypeDocumentedMediaType(t *testing.T) {
+	router := makeRouter(requireContentType)
+	handler := func(writer http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/bags/{username}/import", handler).Methods(http.MethodPost)
+	router.HandleFunc("/users/{username}", handler).Methods(http.MethodDelete)
+
+	tests := []struct {
+		method, path, contentType string
+		status                    int
+	}{
+		{http.MethodPost, "/bags/test-user/import", "multipart/form-data; boundary=xyz", http.StatusOK},
+		{http.MethodPost, "/bags/test-user/import", "application/json", http.StatusUnsupportedMediaType},
+		{http.MethodDelete, "/users/test-user", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, strings.NewReader(""))
+		if test.contentType != "" {
+			request.Header.Set("Content-Type", test.contentType)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("status code for %s %s with %q was %d instead of %d", test.method, test.path, test.contentType, recorder.Code, test.status)
+		}
+	}
+}
+
+// -------- End Content Types --------
+
+// -------- Start Concurrency Limits --------
+
+// blockingRouter returns a router with the limiter whose handlers for the given
+// paths block until release is closed. entered receives a value once each
+// request is being handled.
+func blockingRouter(c *ConcurrencyLimiter, release chan struct{}, entered chan struct{}) *mux.Router {
+	router := makeRouter(c.Middleware)
+	handler := func(writer http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}
+	router.HandleFunc("/bags/{username}", handler)
+	router.HandleFunc("/preferences/{username}", handler)
+	return router
+}
+
+func TestConcurrencyLimiterShedsGroup(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 10)
+	router := blockingRouter(NewConcurrencyLimiter(0, map[string]int{"bags": 1}), release, entered)
+
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bags/test-user", nil))
+		close(done)
+	}()
+	<-entered
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/bags/other-user", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code over the bags limit was %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After was not set")
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed["code"] != httpapi.CodeOverloaded || parsed["limit"] != "bags" {
+		t.Errorf("unexpected problem %v", parsed)
+	}
+
+	// Other groups aren't affected by the bags limit.
+	go router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil))
+	<-entered
+
+	close(release)
+	<-done
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/bags/other-user", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code after the first request finished was %d", recorder.Code)
+	}
+}
+
+func TestConcurrencyLimiterShedsOverall(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 10)
+	router := blockingRouter(NewConcurrencyLimiter(1, nil), release, entered)
+	defer close(release)
+
+	go router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bags/test-user", nil))
+	<-entered
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code over the overall limit was %d", recorder.Code)
+	}
+
+	// The status endpoints are never shed.
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code for the greeting over the limit was %d", recorder.Code)
+	}
+}
+
+func TestConcurrencyLimiterFromConfig(t *testing.T) {
+	cfg := viper.New()
+	setConfigDefaults(cfg)
+	cfg.Set("http.concurrency.max_in_flight", 100)
+	cfg.Set("http.concurrency.groups", map[string]interface{}{"bags": 10, "admin": 0})
+
+	c, err := concurrencyLimiterFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.overall == nil || c.overall.limit != 100 {
+		t.Errorf("overall limit was %v", c.overall)
+	}
+	if len(c.groups) != 1 || c.groups["bags"].limit != 10 {
+		t.Errorf("group limits were %v", c.groups)
+	}
+
+	cfg.Set("http.concurrency.groups", map[string]interface{}{"bags": "lots"})
+	if _, err = concurrencyLimiterFromConfig(cfg); err == nil {
+		t.Error("expected an error for an invalid group limit")
+	}
+}
+
+// -------- End Concurrency Limits --------
+
+// -------- Start Modules --------
+
+func TestModuleRoutesKeepTheirPaths(t *testing.T) {
+	routes, err := registeredRoutes(newDocumentedRouter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[route.key()] = true
+	}
+
+	for key := range apiOperations {
+		if !registered[key] {
+			t.Errorf("%s is documented but not registered", key)
+		}
+	}
+}
+
+func TestModuleRouterMiddleware(t *testing.T) {
+	var calls []string
+	record := func(name string) mux.MiddlewareFunc {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(writer, r)
+			})
+		}
+	}
+
+	var module string
+	router := makeRouter(record("router"))
+	bags := moduleRouter(router, "bags", "/bags", record("first"), record("second"))
+	bags.Use(record("third"))
+	bags.HandleFunc("/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		if fields, ok := r.Context().Value(logFieldsKey{}).(log.Fields); ok {
+			module, _ = fields["module"].(string)
+		}
+	})
+	moduleRouter(router, "preferences", "/preferences").HandleFunc("/{username}", func(writer http.ResponseWriter, r *http.Request) {})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bags/test-user", nil))
+	if expected := []string{"router", "first", "second", "third"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("middleware ran as %v instead of %v", calls, expected)
+	}
+	if module != "bags" {
+		t.Errorf("module log field was %q", module)
+	}
+
+	calls = nil
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code for another module was %d", recorder.Code)
+	}
+	if expected := []string{"router"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("middleware for another module ran as %v instead of %v", calls, expected)
+	}
+}
+
+// -------- End Modules --------
+
+// -------- Start Feature Flags --------
+
+func TestModuleFlags(t *testing.T) {
+	t.Cleanup(func() { moduleFlags.SetStates(nil) })
+
+	router := makeRouter()
+	ok := func(writer http.ResponseWriter, r *http.Request) {}
+	moduleRouter(router, "bags", "/bags").HandleFunc("/{username}", ok)
+	moduleRouter(router, "preferences", "/preferences").HandleFunc("/{username}", ok)
+	admin := moduleRouter(router, "admin", "/admin")
+	moduleRouter(admin, "webhooks", "/webhooks").HandleFunc("", ok)
+
+	get := func(path string) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		var parsed map[string]interface{}
+		if recorder.Code != http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, parsed
+	}
+
+	for _, path := range []string{"/bags/test-user", "/preferences/test-user", "/admin/webhooks"} {
+		if status, _ := get(path); status != http.StatusOK {
+			t.Errorf("status code for %s was %d while every module was enabled", path, status)
+		}
+	}
+
+	moduleFlags.SetStates(map[string]string{"bags": moduleDisabled, "preferences": moduleEnabled})
+	status, parsed := get("/bags/test-user")
+	if status != http.StatusNotFound {
+		t.Errorf("status code for a disabled module was %d", status)
+	}
+	if parsed["code"] != httpapi.CodeModuleDisabled || parsed["module"] != "bags" {
+		t.Errorf("unexpected problem %v", parsed)
+	}
+	if status, _ = get("/preferences/test-user"); status != http.StatusOK {
+		t.Errorf("status code for an enabled module was %d", status)
+	}
+
+	moduleFlags.SetStates(map[string]string{"bags": moduleOffline})
+	if status, _ = get("/bags/test-user"); status != http.StatusServiceUnavailable {
+		t.Errorf("status code for an offline module was %d", status)
+	}
+
+	moduleFlags.SetStates(map[string]string{"admin": moduleDisabled})
+	if status, parsed = get("/admin/webhooks"); status != http.StatusNotFound || parsed["module"] != "admin" {
+		t.Errorf("nested module of a disabled module returned %d %v", status, parsed)
+	}
+
+	moduleFlags.SetStates(nil)
+	if status, _ = get("/bags/test-user"); status != http.StatusOK {
+		t.Errorf("status code for a re-enabled module was %d", status)
+	}
+}
+
+func TestModuleStatesFromConfig(t *testing.T) {
+	cfg := viper.New()
+	setConfigDefaults(cfg)
+	cfg.Set("modules", map[string]interface{}{"bags": "Disabled", "webhooks": " offline "})
+
+	settings, err := loadTunables(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"bags": moduleDisabled, "webhooks": moduleOffline}
+	if !reflect.DeepEqual(settings.moduleStates, expected) {
+		t.Errorf("module states were %v instead of %v", settings.moduleStates, expected)
+	}
+
+	cfg.Set("modules", map[string]interface{}{"bags": "off"})
+	if _, err = loadTunables(cfg); err == nil {
+		t.Error("an invalid module state was accepted")
+	}
+}
+
+// -------- End Feature Flags --------
+
+// -------- Start Logging --------
+
+func TestLogFormatter(t *testing.T) {
+	if f, err := logFormatter("json"); err != nil {
+		t.Error(err)
+	} else if _, ok := f.(*log.JSONFormatter); !ok {
+		t.Errorf("formatter for json was %T", f)
+	}
+
+	if f, err := logFormatter("text"); err != nil {
+		t.Error(err)
+	} else if _, ok := f.(*log.TextFormatter); !ok {
+		t.Errorf("formatter for text was %T", f)
+	}
+
+	cfg := viper.New()
+	setConfigDefaults(cfg)
+	cfg.Set("log.format", "xml")
+	if _, err := loadTunables(cfg); err == nil {
+		t.Error("expected an error for an unsupported log.format")
+	}
+}
+
+func TestStandardLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(&standardFieldsHook{service: serviceName})
+
+	router := makeRouter()
+	moduleRouter(router, "bags", "/bags").HandleFunc("/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		logger.WithContext(r.Context()).Error("test entry")
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bags/test-user", nil))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%s: %s", err, buf.String())
+	}
+
+	expected := map[string]string{
+		"service":  serviceName,
+		"module":   "bags",
+		"route":    "/bags/{username}",
+		"username": "test-user",
+		"msg":      "test entry",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("%s was %v instead of %s", key, entry[key], value)
+		}
+	}
+	if entry["request_id"] == "" || entry["request_id"] == nil {
+		t.Error("request_id was not set")
+	}
+
+	buf.Reset()
+	logger.Info("outside of a request")
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["service"] != serviceName {
+		t.Errorf("service was %v for an entry outside of a request", entry["service"])
+	}
+}
+
+func TestLogTraceIDs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(&standardFieldsHook{service: serviceName})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	logger.WithContext(ctx).Error("traced entry")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["trace_id"] != traceID.String() || entry["span_id"] != spanID.String() {
+		t.Errorf("unexpected trace fields: %v", entry)
+	}
+
+	buf.Reset()
+	logger.WithContext(context.Background()).Error("untraced entry")
+	entry = nil
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entry["trace_id"]; ok {
+		t.Errorf("trace_id was set without a span: %v", entry)
+	}
+}
+
+// -------- End Logging --------
+
+// -------- Start TLS --------
+
+func TestNewTLSConfig(t *testing.T) {
+	config, err := newTLSConfig("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		t.Errorf("ClientAuth was %v without a client CA", config.ClientAuth)
+	}
+
+	if _, err = newTLSConfig("", true); err == nil {
+		t.Error("no error requiring client certs without a client CA")
+	}
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err = os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err = newTLSConfig(caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth was %v instead of RequireAndVerifyClientCert", config.ClientAuth)
+	}
+	if config.ClientCAs == nil {
+		t.Error("ClientCAs was not set")
+	}
+
+	config, err = newTLSConfig(caFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("ClientAuth was %v instead of VerifyClientCertIfGiven", config.ClientAuth)
+	}
+}
+
+// -------- End TLS --------
+
+// -------- Start Reload --------
+
+func TestReloaderReload(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+
+	cache := newMemoryCache(0)
+	bagsApp := NewBagsApp(db, mux.NewRouter(), IplantSuffix, true, cache, nil)
+	rateLimiter := NewRateLimiter(0, 20)
+	bodySize := NewBodySizeLimit(0)
+
+	cfgPath := filepath.Join(t.TempDir(), "user-info.yml")
+	cfgYAML := `
+log:
+  level: warn
+users:
+  domain: "@example.org"
+  domains:
+    - example.com
+bags:
+  cache_ttl: 1m
+rate_limit:
+  requests_per_second: 5
+  burst: 2
+http:
+  max_body_size: 1kb
+db:
+  query_timeout: 5s
+`
+	if err = os.WriteFile(cfgPath, []byte(cfgYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	usernames := NewUsernameNormalizer(IplantSuffix, nil)
+	queryTimeout := NewQueryTimeout(0)
+	reloader := NewReloader(cfgPath, bagsApp, cache, rateLimiter, bodySize, usernames, queryTimeout)
+	if err = reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log.GetLevel() != log.WarnLevel {
+		t.Errorf("log level was %s instead of warn", log.GetLevel())
+	}
+
+	if actual := bagsApp.AddUsernameSuffix(context.Background(), "test-user"); actual != "test-user@example.org" {
+		t.Errorf("username was %s instead of test-user@example.org", actual)
+	}
+
+	if actual, _ := usernames.Normalize("test-user"); actual != "test-user@example.org" {
+		t.Errorf("normalized username was %s instead of test-user@example.org", actual)
+	}
+
+	if actual, err := usernames.Normalize("test-user@example.com"); err != nil || actual != "test-user@example.com" {
+		t.Errorf("username in an accepted domain was normalized to %s: %v", actual, err)
+	}
+
+	if actual := bagsApp.AddUsernameSuffix(context.Background(), "test-user@example.com"); actual != "test-user@example.com" {
+		t.Errorf("bags username in an accepted domain was %s", actual)
+	}
+
+	if !rateLimiter.enabled() || rateLimiter.burst != 2 {
+		t.Errorf("rate limit was %v with a burst of %d", rateLimiter.limit, rateLimiter.burst)
+	}
+
+	if bodySize.limit.Load() != 1024 {
+		t.Errorf("body size limit was %d instead of 1024", bodySize.limit.Load())
+	}
+
+	if cache.ttl != time.Minute {
+		t.Errorf("cache TTL was %s instead of 1m", cache.ttl)
+	}
+
+	if actual := time.Duration(queryTimeout.timeout.Load()); actual != 5*time.Second {
+		t.Errorf("query timeout was %s instead of 5s", actual)
+	}
+}
+
+func TestReloaderReloadInvalid(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	bagsApp := NewBagsApp(db, mux.NewRouter(), IplantSuffix, true, nil, nil)
+
+	cfgPath := filepath.Join(t.TempDir(), "user-info.yml")
+	cfgYAML := `
+users:
+  domain: example.org
+bags:
+  cache_ttl: soon
+`
+	if err = os.WriteFile(cfgPath, []byte(cfgYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloader := NewReloader(cfgPath, bagsApp, nil, NewRateLimiter(0, 20), NewBodySizeLimit(0), NewUsernameNormalizer(IplantSuffix, nil), NewQueryTimeout(0))
+	if err = reloader.Reload(); err == nil {
+		t.Error("no error was returned for an invalid cache TTL")
+	}
+
+	if actual := bagsApp.AddUsernameSuffix(context.Background(), "test-user"); actual != "test-user@"+IplantSuffix {
+		t.Errorf("user domain was changed by an invalid configuration: %s", actual)
+	}
+}
+
+func TestReloaderWatchFile(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	bagsApp := NewBagsApp(db, mux.NewRouter(), IplantSuffix, true, nil, nil)
+	rateLimiter := NewRateLimiter(0, 20)
+
+	// Kubernetes updates mounted ConfigMaps by pointing a symlink at a new
+	// directory.
+	dir := t.TempDir()
+	writeVersion := func(version, cfgYAML string) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "user-info.yml"), []byte(cfgYAML), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(dir, version, "user-info.yml"), filepath.Join(dir, "next.yml")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "next.yml"), filepath.Join(dir, "user-info.yml")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("v1", "rate_limit:\n  requests_per_second: 5\n  burst: 2\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader := NewReloader(filepath.Join(dir, "user-info.yml"), bagsApp, nil, rateLimiter, NewBodySizeLimit(0), NewUsernameNormalizer(IplantSuffix, nil), NewQueryTimeout(0))
+	go reloader.WatchFile(ctx, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	if rateLimiter.enabled() {
+		t.Error("the configuration was reloaded before it changed")
+	}
+
+	writeVersion("v2", "rate_limit:\n  requests_per_second: 5\n  burst: 3\n")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rateLimiter.mu.Lock()
+		burst := rateLimiter.burst
+		rateLimiter.mu.Unlock()
+		if burst == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the changed configuration wasn't reloaded; the burst is %d", burst)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloaderWatchSIGHUP(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	bagsApp := NewBagsApp(db, mux.NewRouter(), IplantSuffix, true, nil, nil)
+	rateLimiter := NewRateLimiter(0, 20)
+
+	cfgPath := filepath.Join(t.TempDir(), "user-info.yml")
+	if err = os.WriteFile(cfgPath, []byte("rate_limit:\n  requests_per_second: 5\n  burst: 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader := NewReloader(cfgPath, bagsApp, nil, rateLimiter, NewBodySizeLimit(0), NewUsernameNormalizer(IplantSuffix, nil), NewQueryTimeout(0))
+	reloader.WatchSIGHUP(ctx)
+
+	// The handler is registered by the time WatchSIGHUP returns, so the signal
+	// is sent right away.
+	if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rateLimiter.mu.Lock()
+		burst := rateLimiter.burst
+		rateLimiter.mu.Unlock()
+		if burst == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the configuration wasn't reloaded on SIGHUP; the burst is %d", burst)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := NewRateLimiter(0, 0)
+	router := mux.NewRouter()
+	router.Use(limiter.Middleware)
+	router.HandleFunc("/test/{username}", func(writer http.ResponseWriter, r *http.Request) {})
+
+	for i := 0; i < 5; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/test/test-user", nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("request %d: status code was %d but should have been %d", i, recorder.Code, http.StatusOK)
+		}
+	}
+}
+
+// -------- End Reload --------
+
+// -------- Start Statements --------
+
+func TestStmtCacheReusesStatements(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db, nil)
+
+	// The query is prepared once and then executed for each call.
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").ExpectQuery().
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("other-user").
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(0))
+
+	if ok, err := p.isUser(context.Background(), "test-user"); err != nil || !ok {
+		t.Errorf("isUser returned %t, %v for test-user", ok, err)
+	}
+	if ok, err := p.isUser(context.Background(), "other-user"); err != nil || ok {
+		t.Errorf("isUser returned %t, %v for other-user", ok, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// parseCountingConn wraps a driver connection and counts the statements the
+// database would parse: every one that's prepared, and every query or exec
+// that isn't run through a prepared statement.
+type parseCountingConn struct {
+	driver.Conn
+	parses *atomic.Int64
+}
+
+func (c *parseCountingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.parses.Add(1)
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *parseCountingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.parses.Add(1)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *parseCountingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.parses.Add(1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+// parseCountingConnector opens parseCountingConns to the sqlmock database
+// registered under dsn.
+type parseCountingConnector struct {
+	driver driver.Driver
+	dsn    string
+	parses atomic.Int64
+}
+
+func (c *parseCountingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &parseCountingConn{Conn: conn, parses: &c.parses}, nil
+}
+
+func (c *parseCountingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// benchmarkIsUser runs isUser b.N times and reports the number of statements
+// parsed per call. The mock expects a Prepare only when prepared is true, so
+// the benchmark fails if statements aren't reused.
+func benchmarkIsUser(b *testing.B, prepared bool, newIsUser func(*sql.DB) func(context.Context, string) (bool, error)) {
+	dsn := b.Name()
+	mockDB, mock, err := sqlmock.NewWithDSN(dsn)
+	if err != nil {
+		b.Fatalf("error creating the mock db: %s", err)
+	}
+	defer mockDB.Close()
+
+	connector := &parseCountingConnector{driver: mockDB.Driver(), dsn: dsn}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	query := "SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users"
+	if prepared {
+		mock.ExpectPrepare(query)
+	}
+	for i := 0; i < b.N; i++ {
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
+	}
+
+	isUser := newIsUser(db)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := isUser(context.Background(), "test-user"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		b.Error(err)
+	}
+
+	b.ReportMetric(float64(connector.parses.Load())/float64(b.N), "parses/op")
+}
+
+func BenchmarkIsUserUnprepared(b *testing.B) {
+	benchmarkIsUser(b, false, func(db *sql.DB) func(context.Context, string) (bool, error) {
+		return func(ctx context.Context, username string) (bool, error) {
+			return queries.IsUser(ctx, db, username)
+		}
+	})
+}
+
+func BenchmarkIsUserPrepared(b *testing.B) {
+	benchmarkIsUser(b, true, func(db *sql.DB) func(context.Context, string) (bool, error) {
+		return NewPrefsDB(db, nil).isUser
+	})
+}
+
+// -------- End Statements --------
+
+// -------- Start DB --------
+
+func TestDBDriverName(t *testing.T) {
+	for driver, expected := range map[string]string{"": "postgres", "pq": "postgres", "pgx": "pgx", "PGX": "pgx"} {
+		actual, err := dbDriverName(driver)
+		if err != nil {
+			t.Errorf("error for driver '%s': %s", driver, err)
+		}
+		if actual != expected {
+			t.Errorf("driver name for '%s' was '%s' instead of '%s'", driver, actual, expected)
+		}
+	}
+
+	if _, err := dbDriverName("mysql"); err == nil {
+		t.Error("no error for an unsupported driver")
+	}
+}
+
+func TestDBError(t *testing.T) {
+	pgErr := &pgconn.PgError{Message: "duplicate key", Detail: "Key (user_id) already exists.", ConstraintName: "default_bags_pkey"}
+	err := dbError(fmt.Errorf("wrapped: %w", pgErr))
+	if !strings.Contains(err.Error(), "detail: Key (user_id) already exists.; constraint: default_bags_pkey") {
+		t.Errorf("error was '%s'", err)
+	}
+	if !errors.As(err, &pgErr) {
+		t.Error("the original error can no longer be unwrapped")
+	}
+
+	pqErr := &pq.Error{Message: "bad input", Hint: "check the JSON"}
+	if err = dbError(pqErr); !strings.Contains(err.Error(), "hint: check the JSON") {
+		t.Errorf("error was '%s'", err)
+	}
+
+	plain := errors.New("plain")
+	if dbError(plain) != plain {
+		t.Error("errors without details should be returned as they are")
+	}
+}
+
+func TestWithSearchPath(t *testing.T) {
+	tests := []struct {
+		uri      string
+		schema   string
+		expected string
+	}{
+		{"postgres://de@localhost/de?sslmode=disable", "", "postgres://de@localhost/de?sslmode=disable"},
+		{"postgres://de@localhost/de?sslmode=disable", "de", "postgres://de@localhost/de?search_path=de&sslmode=disable"},
+		{"host=localhost dbname=de", "user_info", "host=localhost dbname=de search_path=user_info"},
+	}
+
+	for _, tt := range tests {
+		actual, err := withSearchPath(tt.uri, tt.schema)
+		if err != nil {
+			t.Errorf("error adding the search path to %s: %s", tt.uri, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("URI was %s, expected %s", actual, tt.expected)
+		}
+	}
+
+	for _, schema := range []string{"De", "de,public", "de; DROP TABLE users", "1de"} {
+		if _, err := withSearchPath("host=localhost", schema); err == nil {
+			t.Errorf("schema %q was accepted", schema)
+		}
+	}
+}
+
+func TestCreateSchema(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE SCHEMA IF NOT EXISTS de").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err = createSchema(context.Background(), db, "de"); err != nil {
+		t.Errorf("error creating the schema: %s", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End DB --------
+
+// -------- Start Query Builder --------
+
+func TestSelectQuery(t *testing.T) {
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	q := userRows("bags", "b", "test-user", "b.id", "b.contents").
+		Where("b.id = ?", "bag-id").
+		Where(notExpired).
+		Where("b.created_at >= ? AND b.created_at < ?", since, since.Add(time.Hour))
+
+	query, args := q.SQL()
+	expected := "SELECT b.id, b.contents FROM bags b, users u WHERE b.user_id = u.id AND u.username = $1 AND b.id = $2 AND " +
+		notExpired + " AND b.created_at >= $3 AND b.created_at < $4"
+	if query != expected {
+		t.Errorf("query was %q instead of %q", query, expected)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"test-user", "bag-id", since, since.Add(time.Hour)}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	query, args = q.Count().SQL()
+	if !strings.HasPrefix(query, "SELECT COUNT(*) FROM bags b, users u WHERE") || len(args) != 4 {
+		t.Errorf("unexpected count query %q with arguments %v", query, args)
+	}
+
+	query, args = q.OrderBy("b.created_at DESC", "b.id").Page(httpapi.Page{Limit: 10, Offset: 20}).SQL()
+	if !strings.HasSuffix(query, " ORDER BY b.created_at DESC, b.id LIMIT $5 OFFSET $6") || len(args) != 6 || args[4] != 10 || args[5] != 20 {
+		t.Errorf("unexpected page query %q with arguments %v", query, args)
+	}
+
+	// Building the query again doesn't add the page's arguments twice.
+	if _, args = q.SQL(); len(args) != 6 {
+		t.Errorf("the query had %d arguments after being paged", len(args))
+	}
+	if _, args = q.Count().SQL(); len(args) != 4 {
+		t.Errorf("the count query had %d arguments", len(args))
+	}
+}
+
+func TestSelectQueryJoin(t *testing.T) {
+	query, args := selectFrom("bags b", "b.id").
+		Join("default_bags d", "b.id = d.bag_id").
+		Join("users u", "d.user_id = u.id").
+		Where("u.username = ?", "test-user").
+		SQL()
+
+	expected := "SELECT b.id FROM bags b JOIN default_bags d ON b.id = d.bag_id JOIN users u ON d.user_id = u.id WHERE u.username = $1"
+	if query != expected || len(args) != 1 {
+		t.Errorf("query was %q with arguments %v", query, args)
+	}
+}
+
+func TestSelectQueryGroupBy(t *testing.T) {
+	q := selectFrom("user_usage", "username", "SUM(requests) AS requests").
+		Where("day >= ?", "2024-01-02").
+		GroupBy("username")
+
+	query, args := q.OrderBy("requests DESC").Page(httpapi.Page{Limit: 10}).SQL()
+	expected := "SELECT username, SUM(requests) AS requests FROM user_usage WHERE day >= $1 GROUP BY username ORDER BY requests DESC LIMIT $2 OFFSET $3"
+	if query != expected || len(args) != 3 {
+		t.Errorf("query was %q with arguments %v", query, args)
+	}
+
+	query, args = q.Count().SQL()
+	expected = "SELECT COUNT(*) FROM (SELECT username, SUM(requests) AS requests FROM user_usage WHERE day >= $1 GROUP BY username) AS grouped"
+	if query != expected || !reflect.DeepEqual(args, []interface{}{"2024-01-02"}) {
+		t.Errorf("count query was %q with arguments %v", query, args)
+	}
+}
+
+func TestSelectQueryExists(t *testing.T) {
+	query, args := userRows("user_saved_searches", "s", "test-user").ExistsSQL()
+
+	expected := "SELECT EXISTS(SELECT 1 FROM user_saved_searches s, users u WHERE s.user_id = u.id AND u.username = $1) AS exists"
+	if query != expected || !reflect.DeepEqual(args, []interface{}{"test-user"}) {
+		t.Errorf("query was %q with arguments %v", query, args)
+	}
+}
+
+// -------- End Query Builder --------
+
+// -------- Start Migrations --------
+
+func TestEmbeddedMigrations(t *testing.T) {
+	source, err := iofs.New(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		for _, read := range []func(uint) (io.ReadCloser, string, error){source.ReadUp, source.ReadDown} {
+			r, _, err := read(version)
+			if err != nil {
+				t.Errorf("migration %d: %s", version, err)
+				continue
+			}
+			r.Close()
+		}
+
+		next, err := source.Next(version)
+		if err != nil {
+			break
+		}
+		version = next
+	}
+
+	if version != 24 {
+		t.Errorf("the last migration was %d instead of 24", version)
+	}
+}
+
+func TestRunMigrateCommandUnknown(t *testing.T) {
+	if err := runMigrateCommand(nil, []string{"sideways"}); err == nil {
+		t.Error("no error for an unknown migrate command")
+	}
+}
+
+// schemaRows returns the rows that information_schema.columns has for the
+// required columns, leaving out any in skip.
+func schemaRows(skip ...string) *sqlmock.Rows {
+	skipped := make(map[string]bool, len(skip))
+	for _, s := range skip {
+		skipped[s] = true
+	}
+
+	rows := sqlmock.NewRows([]string{"table_name", "column_name"})
+	for table, columns := range requiredColumns {
+		if skipped[table] {
+			continue
+		}
+		for _, column := range columns {
+			if !skipped[table+"."+column] {
+				rows.AddRow(table, column)
+			}
+		}
+	}
+	return rows
+}
+
+func TestVerifySchema(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT table_name, column_name FROM information_schema.columns").WillReturnRows(schemaRows())
+	if err = verifySchema(context.Background(), db); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery("SELECT table_name, column_name FROM information_schema.columns").
+		WillReturnRows(schemaRows("default_bags", "bags.expires_at"))
+	err = verifySchema(context.Background(), db)
+
+	var schemaErr *schemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("expected a *schemaError, got %v", err)
+	}
+	if expected := []string{"column bags.expires_at", "table default_bags"}; !reflect.DeepEqual(schemaErr.missing, expected) {
+		t.Errorf("missing was %v instead of %v", schemaErr.missing, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequiredTablesAreMigrated(t *testing.T) {
+	var migrations strings.Builder
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".up.sql") {
+			b, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			migrations.Write(b)
+		}
+	}
+
+	for table := range requiredColumns {
+		if !strings.Contains(migrations.String(), "CREATE TABLE IF NOT EXISTS "+table+" (") {
+			t.Errorf("no migration creates %s", table)
+		}
+	}
+}
+
+// -------- End Migrations --------
+
+// -------- Start OpenAPI --------
+
+func newDocumentedRouter(t *testing.T) *mux.Router {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	router := makeRouter()
+	NewPrefsApp(NewPrefsDB(db, nil), router)
+	NewSessionsApp(NewSessionsDB(db, nil), router)
+	NewSearchesApp(NewSearchesDB(db, nil), router)
+	bagsApp := NewBagsApp(db, router, IplantSuffix, true, nil, nil)
+	NewUserSummaryApp(nil, nil, nil, bagsApp, router)
+	NewUsersApp(NewUsersDB(db, nil), bagsApp, router)
+	NewChangesApp(NewChangesDB(db), bagsApp, router)
+	NewProfileApp(db, nil, nil, router)
+	NewAvatarsApp(NewAvatarsDB(db, nil), 1024, time.Minute, router)
+	NewToursApp(NewToursDB(db, nil), router)
+	NewNotificationPrefsApp(NewNotificationPrefsDB(db, nil), []string{"email"}, nil, nil, router)
+	NewPinsApp(NewPinsDB(db, nil), map[string]int{"app": 1}, router)
+	NewTagsApp(NewTagsDB(db, nil), router)
+	NewTokensApp(NewTokensDB(db, nil), nil, 0, router)
+	NewTeamPrefsApp(NewTeamPrefsDB(db, nil), NewPrefsDB(db, nil), router)
+	NewUserWebhooksApp(NewUserWebhooksDB(db, nil), nil, nil, nil, router)
+	NewDashboardApp(NewDashboardDB(db, nil), nil, 3, router)
+	NewIdentityApp(NewIdentityDB(db, nil), router)
+	NewDigestsApp(NewDigestsDB(db, nil), nil, router)
+	NewLocaleApp(NewLocaleDB(db, nil), "UTC", "en-US", router)
+	NewActivityApp(NewAuditDB(db), NewUsersDB(db, nil), bagsApp, router)
+	adminRouter := newAdminRouter(router, nil)
+	NewWebhooksApp(NewWebhooksDB(db), adminRouter)
+	NewAuditApp(NewAuditDB(db), adminRouter)
+	NewUsageApp(NewUsageDB(db), adminRouter)
+	NewBackupApp(NewBackupDB(db, nil), adminRouter)
+	NewFeedbackApp(NewFeedbackDB(db, nil), router, adminRouter)
+	NewConsentsApp(NewConsentsDB(db, nil), nil, router, adminRouter)
+	registerPprof(adminRouter)
+	registerOpenAPI(router, true)
+	return router
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	missing, err := undocumentedRoutes(newDocumentedRouter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missing) > 0 {
+		t.Errorf("routes missing from apiOperations: %s", strings.Join(missing, ", "))
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	server := httptest.NewServer(newDocumentedRouter(t))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d", res.StatusCode, http.StatusOK)
+	}
+
+	var spec openAPISpec
+	if err = json.NewDecoder(res.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("openapi was %s instead of 3.0.3", spec.OpenAPI)
+	}
+
+	op, ok := spec.Paths["/bags/{username}/{bagID}"]["post"]
+	if !ok {
+		t.Fatal("POST /bags/{username}/{bagID} is missing from the specification")
+	}
+
+	var params []string
+	for _, param := range op.Parameters {
+		if param.In == "header" {
+			if (param.Name != idempotencyKeyHeader && param.Name != userDomainHeader && param.Name != impersonateUserHeader) || param.Required {
+				t.Errorf("unexpected header parameter %+v", param)
+			}
+			continue
+		}
+		if param.In == "query" {
+			if param.Name != normalizeUsernameParam || param.Required {
+				t.Errorf("unexpected query parameter %+v", param)
+			}
+			continue
+		}
+		if param.In != "path" || !param.Required {
+			t.Errorf("parameter %s was not a required path parameter", param.Name)
+		}
+		params = append(params, param.Name)
+	}
+	if !reflect.DeepEqual(params, []string{"username", "bagID"}) {
+		t.Errorf("path parameters were %v", params)
+	}
+
+	if op.RequestBody == nil || op.RequestBody.Content["application/json"].Schema.Type != "object" {
+		t.Errorf("request body was %+v", op.RequestBody)
+	}
+
+	if _, ok = op.Responses["404"]; !ok {
+		t.Error("404 response was not documented")
+	}
+
+	op = spec.Paths["/bags/{username}/default"]["get"]
+	if len(op.Parameters) != 5 || op.Parameters[1].In != "query" || op.Parameters[1].Name != "create" || op.Parameters[2].Name != normalizeUsernameParam || op.Parameters[3].Name != userDomainHeader || op.Parameters[4].Name != impersonateUserHeader {
+		t.Errorf("parameters were %+v", op.Parameters)
+	}
+
+	res, err = http.Get(server.URL + "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("content type of /docs was %s", ct)
+	}
+}
+
+func TestOpenAPIPathTemplates(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/things/{id:[0-9]+}", func(http.ResponseWriter, *http.Request) {}).Methods(http.MethodGet)
+
+	spec, err := buildOpenAPISpec(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op, ok := spec.Paths["/things/{id}"]["get"]
+	if !ok {
+		t.Fatalf("paths were %v", spec.Paths)
+	}
+	if _, ok = op.Responses["default"]; !ok {
+		t.Error("an undocumented route had no default response")
+	}
+}
+
+// -------- End OpenAPI --------
+
+// -------- Start gRPC --------
+
+func newGRPCTestClient(t *testing.T, srv *GRPCServer, auth *APIKeyAuth) userinfopb.UserInfoClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(srv, auth, nil, nil, nil)
+	go server.Serve(listener) // nolint:errcheck
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return userinfopb.NewUserInfoClient(conn)
+}
+
+func newGRPCTestServer(t *testing.T, mock *MockDB) (*GRPCServer, sqlmock.Sqlmock) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	router := mux.NewRouter()
+	return NewGRPCServer(
+		NewPrefsApp(mock, router),
+		NewSessionsApp(mock, router),
+		NewSearchesApp(mock, router),
+		NewBagsApp(db, router, IplantSuffix, true, nil, nil),
+	), sqlMock
+}
+
+func TestGRPCPreferences(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	srv, _ := newGRPCTestServer(t, mock)
+	client := newGRPCTestClient(t, srv, NewAPIKeyAuth(nil, false))
+	ctx := context.Background()
+
+	_, err := client.GetPreferences(ctx, &userinfopb.UserRequest{Username: "nobody"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("error for a missing user was %v", err)
+	}
+
+	content, err := structpb.NewValue(map[string]interface{}{"theme": "dark"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := client.SetPreferences(ctx, &userinfopb.Document{Username: "test-user", Content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme := doc.GetContent().GetStructValue().GetFields()["theme"].GetStringValue(); theme != "dark" {
+		t.Errorf("theme was %q instead of dark", theme)
+	}
+
+	doc, err = client.GetPreferences(ctx, &userinfopb.UserRequest{Username: "test-user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme := doc.GetContent().GetStructValue().GetFields()["theme"].GetStringValue(); theme != "dark" {
+		t.Errorf("theme was %q instead of dark", theme)
+	}
+
+	_, err = client.SetPreferences(ctx, &userinfopb.Document{Username: "test-user", Content: structpb.NewStringValue("dark")})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("error for a non-object document was %v", err)
+	}
+}
+
+func TestGRPCSavedSearches(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	srv, _ := newGRPCTestServer(t, mock)
+	client := newGRPCTestClient(t, srv, NewAPIKeyAuth(nil, false))
+	ctx := context.Background()
+
+	content, err := structpb.NewValue(map[string]interface{}{"searches": []interface{}{"one", "two"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.SetSavedSearches(ctx, &userinfopb.Document{Username: "test-user", Content: content}); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := client.GetSavedSearches(ctx, &userinfopb.UserRequest{Username: "test-user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := doc.GetContent().GetStructValue().GetFields()["searches"].GetListValue().GetValues(); len(values) != 2 {
+		t.Errorf("saved searches were %v", doc.GetContent())
+	}
+
+	list, err := structpb.NewValue([]interface{}{"one", "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.SetSavedSearches(ctx, &userinfopb.Document{Username: "test-user", Content: list})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("error for a non-object document was %v", err)
+	}
+}
+
+func TestGRPCGetBag(t *testing.T) {
+	srv, sqlMock := newGRPCTestServer(t, NewMockDB())
+	client := newGRPCTestClient(t, srv, NewAPIKeyAuth(nil, false))
+	username := "test-user@" + IplantSuffix
+
+	sqlMock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").ExpectQuery().
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	sqlMock.ExpectPrepare("SELECT count\\(\\*\\) FROM bags b, users u").ExpectQuery().
+		WithArgs(username, "bag-id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	sqlMock.ExpectQuery("SELECT b.id, b.contents, b.user_id, b.expires_at FROM bags b").
+		WithArgs(username, "bag-id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "contents", "user_id", "expires_at"}).
+			AddRow("bag-id", []byte(`{"items":[{"id":"one"}]}`), "user-id", nil))
+
+	bag, err := client.GetBag(context.Background(), &userinfopb.BagRequest{Username: "test-user", Id: "bag-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bag.GetId() != "bag-id" || bag.GetUserId() != "user-id" {
+		t.Errorf("bag was %v", bag)
+	}
+	if items := bag.GetContents().GetFields()["items"].GetListValue().GetValues(); len(items) != 1 {
+		t.Errorf("bag contents were %v", bag.GetContents())
+	}
+	if bag.GetExpiresAt() != nil {
+		t.Errorf("expires_at was %v", bag.GetExpiresAt())
+	}
+
+	if err = sqlMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGRPCAPIKeys(t *testing.T) {
+	mock := NewMockDB()
+	srv, _ := newGRPCTestServer(t, mock)
+	client := newGRPCTestClient(t, srv, NewAPIKeyAuth(map[string]string{"terrain": "secret"}, true))
+
+	_, err := client.GetPreferences(context.Background(), &userinfopb.UserRequest{Username: "nobody"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("error without an API key was %v", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "ApiKey wrong")
+	_, err = client.GetPreferences(ctx, &userinfopb.UserRequest{Username: "nobody"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("error with an invalid API key was %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "ApiKey secret")
+	_, err = client.GetPreferences(ctx, &userinfopb.UserRequest{Username: "nobody"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("error with a valid API key was %v", err)
+	}
+}
+
+// -------- End gRPC --------
+
+// -------- Start Summary --------
+
+func TestGetSummary(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+	sqlMock.MatchExpectationsInOrder(false)
+
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.storage["test-user"] = map[string]interface{}{
+		"user-prefs":     `{"theme":"dark"}`,
+		"user-sessions":  `{"page":"data"}`,
+		"saved_searches": `["one"]`,
+	}
+
+	router := mux.NewRouter()
+	NewUserSummaryApp(
+		NewPrefsApp(mock, router),
+		NewSessionsApp(mock, router),
+		NewSearchesApp(mock, router),
+		NewBagsApp(db, router, IplantSuffix, true, nil, nil),
+		router,
+	)
+
+	username := "test-user@" + IplantSuffix
+	sqlMock.ExpectQuery("SELECT count\\(\\*\\) FROM bags b, users u").
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	sqlMock.ExpectQuery("SELECT d.bag_id FROM default_bags d").
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"bag_id"}).AddRow("bag-id"))
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/users/test-user/summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d", res.StatusCode, http.StatusOK)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"user":"test-user","preferences":{"theme":"dark"},"session":{"page":"data"},"saved_searches":["one"],"bags":{"count":2,"default_bag_id":"bag-id"}}`
+	if actual := strings.TrimSpace(string(body)); actual != expected {
+		t.Errorf("summary was %s instead of %s", actual, expected)
+	}
+
+	if err = sqlMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetSummaryNonUser(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock := NewMockDB()
+	router := mux.NewRouter()
+	NewUserSummaryApp(
+		NewPrefsApp(mock, router),
+		NewSessionsApp(mock, router),
+		NewSearchesApp(mock, router),
+		NewBagsApp(db, router, IplantSuffix, true, nil, nil),
+		router,
+	)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/users/nobody/summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+// -------- End Summary --------
+
+// -------- Start Users --------
+
+func TestPurgeUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, hasPreferencesKey("test-user"), true)
+	cacheSet(context.Background(), cache, toursKey("test-user"), []CompletedTour{})
+	cacheSet(context.Background(), cache, notificationPrefsKey("test-user"), newNotificationPrefs())
+	cacheSet(context.Background(), cache, pinsKey("test-user"), map[string][]Pin{})
+	cacheSet(context.Background(), cache, userWebhooksKey("test-user"), []UserWebhook{})
+	cacheSet(context.Background(), cache, dashboardKey("test-user"), []DashboardWidget{})
+
+	router := mux.NewRouter()
+	NewUsersApp(NewUsersDB(db, cache), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+
+	username := "test-user@" + IplantSuffix
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_preferences WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_sessions WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_saved_searches WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM default_bags WHERE user_id =").WithArgs(username).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM bags WHERE user_id =").WithArgs(username).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM user_avatars WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tours WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_notification_prefs WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_feedback WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_pins WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tag_resources WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tags WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tokens WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_webhooks WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_dashboard_widgets WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_consents WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_identities WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_digest_schedules WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_locales WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_usage WHERE username = ANY").WithArgs(`{"test-user","` + username + `"}`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_changes WHERE username = ANY").WithArgs(`{"test-user","` + username + `"}`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	request := httptest.NewRequest(http.MethodDelete, "/users/test-user", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	expected := `{"deleted":{"bags":3,"default_bags":1,"user_avatars":0,"user_changes":0,"user_consents":0,"user_dashboard_widgets":0,"user_digest_schedules":0,"user_feedback":0,"user_identities":0,"user_locales":0,"user_notification_prefs":0,"user_pins":0,"user_preferences":1,"user_saved_searches":0,"user_sessions":1,"user_tag_resources":0,"user_tags":0,"user_tokens":0,"user_tours":0,"user_usage":0,"user_webhooks":0},"user":"test-user"}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if _, ok := cacheGet[bool](context.Background(), cache, hasPreferencesKey("test-user")); ok {
+		t.Error("cached preferences were not invalidated")
+	}
+	if _, ok := cacheGet[[]CompletedTour](context.Background(), cache, toursKey("test-user")); ok {
+		t.Error("cached tours were not invalidated")
+	}
+	if _, ok := cacheGet[*NotificationPrefs](context.Background(), cache, notificationPrefsKey("test-user")); ok {
+		t.Error("cached notification settings were not invalidated")
+	}
+	if _, ok := cacheGet[map[string][]Pin](context.Background(), cache, pinsKey("test-user")); ok {
+		t.Error("cached pins were not invalidated")
+	}
+	if _, ok := cacheGet[[]UserWebhook](context.Background(), cache, userWebhooksKey("test-user")); ok {
+		t.Error("cached webhooks were not invalidated")
+	}
+	if _, ok := cacheGet[[]DashboardWidget](context.Background(), cache, dashboardKey("test-user")); ok {
+		t.Error("cached dashboard layout was not invalidated")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPurgeUserRollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsersApp(NewUsersDB(db, nil), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_preferences WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_sessions WHERE user_id =").WithArgs("test-user").WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	request := httptest.NewRequest(http.MethodDelete, "/users/test-user", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusInternalServerError)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPurgeUserNonUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsersApp(NewUsersDB(db, nil), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	request := httptest.NewRequest(http.MethodDelete, "/users/nobody", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func expectExport(mock sqlmock.Sqlmock) {
+	username := "test-user@" + IplantSuffix
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM users t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}).AddRow([]byte(`{"id":"1","username":"test-user"}`)))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_preferences t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}).AddRow([]byte(`{"preferences":"{}"}`)))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_sessions t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_saved_searches t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM default_bags t").WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM bags t").WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}).
+			AddRow([]byte(`{"id":"a"}`)).
+			AddRow([]byte(`{"id":"b"}`)))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_avatars t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_tours t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_notification_prefs t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_feedback t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_pins t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_tag_resources t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_tags t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_tokens t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_webhooks t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_dashboard_widgets t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_consents t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_identities t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_digest_schedules t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_locales t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_usage t WHERE t.username = ANY").WithArgs(`{"test-user","` + username + `"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_changes t WHERE t.username = ANY").WithArgs(`{"test-user","` + username + `"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}))
+	mock.ExpectCommit()
+}
+
+func TestExportUserZip(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsersApp(NewUsersDB(db, nil), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+	expectExport(mock)
+
+	request := httptest.NewRequest(http.MethodGet, "/users/test-user/export", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("content type was %s", ct)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(contents)
+	}
+
+	expected := map[string]string{
+		"users.json":                   `[{"id":"1","username":"test-user"}]`,
+		"user_preferences.json":        `[{"preferences":"{}"}]`,
+		"user_sessions.json":           `[]`,
+		"user_saved_searches.json":     `[]`,
+		"default_bags.json":            `[]`,
+		"bags.json":                    `[{"id":"a"},{"id":"b"}]`,
+		"user_avatars.json":            `[]`,
+		"user_tours.json":              `[]`,
+		"user_notification_prefs.json": `[]`,
+		"user_feedback.json":           `[]`,
+		"user_pins.json":               `[]`,
+		"user_tag_resources.json":      `[]`,
+		"user_tags.json":               `[]`,
+		"user_tokens.json":             `[]`,
+		"user_webhooks.json":           `[]`,
+		"user_dashboard_widgets.json":  `[]`,
+		"user_consents.json":           `[]`,
+		"user_identities.json":         `[]`,
+		"user_digest_schedules.json":   `[]`,
+		"user_locales.json":            `[]`,
+		"user_usage.json":              `[]`,
+		"user_changes.json":            `[]`,
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("archive contained %v instead of %v", files, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestExportUserJSON(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsersApp(NewUsersDB(db, nil), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+	expectExport(mock)
+
+	request := httptest.NewRequest(http.MethodGet, "/users/test-user/export?format=json", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	expected := `{"users":[{"id":"1","username":"test-user"}],"user_preferences":[{"preferences":"{}"}],"user_sessions":[],"user_saved_searches":[],"default_bags":[],"bags":[{"id":"a"},{"id":"b"}],"user_avatars":[],"user_tours":[],"user_notification_prefs":[],"user_feedback":[],"user_pins":[],"user_tag_resources":[],"user_tags":[],"user_tokens":[],"user_webhooks":[],"user_dashboard_widgets":[],"user_consents":[],"user_identities":[],"user_digest_schedules":[],"user_locales":[],"user_usage":[],"user_changes":[]}`
+	if actual := recorder.Body.String(); actual != expected {
+		t.Errorf("export was %s instead of %s", actual, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestExportUserBadFormat(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsersApp(NewUsersDB(db, nil), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+
+	request := httptest.NewRequest(http.MethodGet, "/users/test-user/export?format=xml", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+// newDeactivationTestRouter returns a router serving the users module from
+// the mock db, with the users' deactivations checked on every write. The user
+// test-user is cached as existing, and the returned observer records the
+// mutations.
+func newDeactivationTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, Cache, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	usersDB := NewUsersDB(db, cache)
+	observer := &recordingObserver{}
+	usersDB.AddObserver(observer)
+
+	router := makeRouter()
+	usersApp := NewUsersApp(usersDB, NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+	router.Use(usersApp.RejectDeactivated)
+	return router, mock, cache, observer
+}
+
+func TestDeactivateUser(t *testing.T) {
+	router, mock, cache, observer := newDeactivationTestRouter(t)
+	cacheSet(context.Background(), cache, deactivationKey("test-user"), Deactivation{Username: "test-user"})
+
+	deactivatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	purgeAt := time.Now().Add(30 * 24 * time.Hour).UTC().Truncate(time.Second)
+	mock.ExpectQuery("UPDATE users SET deactivated_at = now\\(\\), deactivation_reason = \\$2, purge_at = \\$3 WHERE username = \\$1 AND deactivated_at IS NULL RETURNING deactivated_at, purge_at").
+		WithArgs("test-user", "left the project", purgeAt).
+		WillReturnRows(sqlmock.NewRows([]string{"deactivated_at", "purge_at"}).AddRow(deactivatedAt, purgeAt))
+
+	body := fmt.Sprintf(`{"reason":"left the project","purge_at":%q}`, purgeAt.Format(time.RFC3339))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/users/test-user/deactivate", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	var deactivation Deactivation
+	if err := json.Unmarshal(recorder.Body.Bytes(), &deactivation); err != nil {
+		t.Fatal(err)
+	}
+	if !deactivation.Deactivated || deactivation.Reason != "left the project" || deactivation.PurgeAt == nil || !deactivation.PurgeAt.Equal(purgeAt) {
+		t.Errorf("unexpected response: %s", recorder.Body.String())
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].EventType() != "users.deactivated" {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+	if _, ok := cacheGet[Deactivation](context.Background(), cache, deactivationKey("test-user")); ok {
+		t.Error("cached deactivation was not invalidated")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeactivateUserTwice(t *testing.T) {
+	router, mock, _, observer := newDeactivationTestRouter(t)
+	mock.ExpectQuery("UPDATE users SET deactivated_at = now\\(\\)").
+		WithArgs("test-user", "", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"deactivated_at", "purge_at"}))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/users/test-user/deactivate", strings.NewReader(`{}`)))
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusConflict, recorder.Body.String())
+	}
+	if len(observer.mutations) != 0 {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeactivateUserInvalid(t *testing.T) {
+	router, mock, _, _ := newDeactivationTestRouter(t)
+
+	body := fmt.Sprintf(`{"reason":%q,"purge_at":"2020-01-01T00:00:00Z"}`, strings.Repeat("x", maxDeactivationReason+1))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/users/test-user/deactivate", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status code was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+	var problem struct {
+		Fields map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if len(problem.Fields) != 2 || problem.Fields["reason"] == "" || problem.Fields["purge_at"] == "" {
+		t.Errorf("unexpected problems: %v", problem.Fields)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestReactivateUser(t *testing.T) {
+	router, mock, _, observer := newDeactivationTestRouter(t)
+	query := "UPDATE users SET deactivated_at = NULL, deactivation_reason = '', purge_at = NULL WHERE username = \\$1 AND deactivated_at IS NOT NULL"
+	mock.ExpectExec(query).WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/users/test-user/reactivate", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"username":"test-user","deactivated":false,"deactivated_at":null,"reason":"","purge_at":null}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].EventType() != "users.reactivated" {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/users/test-user/reactivate", nil))
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code for an active user was %d instead of %d", recorder.Code, http.StatusConflict)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRejectDeactivated(t *testing.T) {
+	router, mock, cache, _ := newDeactivationTestRouter(t)
+	deactivatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cacheSet(context.Background(), cache, deactivationKey("test-user"), Deactivation{Username: "test-user", Deactivated: true, DeactivatedAt: &deactivatedAt})
+	mock.ExpectQuery("SELECT deactivated_at, deactivation_reason, purge_at FROM users WHERE username = \\$1").
+		WithArgs("other-user").
+		WillReturnRows(sqlmock.NewRows([]string{"deactivated_at", "deactivation_reason", "purge_at"}).AddRow(nil, "", nil))
+
+	ok := func(writer http.ResponseWriter, r *http.Request) {}
+	prefs := moduleRouter(router, "preferences", "/preferences")
+	prefs.HandleFunc("/{username}", ok).Methods(http.MethodGet, http.MethodPut)
+	newAdminRouter(router, nil).HandleFunc("/preferences/{username}", ok).Methods(http.MethodPut)
+
+	for _, tc := range []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{http.MethodPut, "/preferences/test-user", http.StatusForbidden},
+		{http.MethodGet, "/preferences/test-user", http.StatusOK},
+		{http.MethodPut, "/admin/preferences/test-user", http.StatusOK},
+		{http.MethodPut, "/preferences/other-user", http.StatusOK},
+		{http.MethodPut, "/preferences/other-user", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.path, nil))
+		if recorder.Code != tc.expected {
+			t.Errorf("status code for %s %s was %d instead of %d", tc.method, tc.path, recorder.Code, tc.expected)
+		}
+		if recorder.Code == http.StatusForbidden && !strings.Contains(recorder.Body.String(), `"code":"user_deactivated"`) {
+			t.Errorf("unexpected response for %s %s: %s", tc.method, tc.path, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPurgeDeactivatedUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	usersApp := NewUsersApp(NewUsersDB(db, nil), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+
+	mock.ExpectQuery("SELECT username FROM users WHERE deactivated_at IS NOT NULL AND purge_at <= \\$1 ORDER BY purge_at").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("test-user"))
+	mock.ExpectBegin()
+	for _, table := range userTables {
+		name := "test-user"
+		if table.bags {
+			name = "test-user@" + IplantSuffix
+		}
+		mock.ExpectExec("DELETE FROM " + table.name + " WHERE user_id =").WithArgs(name).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	for _, table := range usernameTables {
+		mock.ExpectExec("DELETE FROM " + table + " WHERE username = ANY").
+			WithArgs(`{"test-user","test-user@` + IplantSuffix + `"}`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE users SET purge_at = NULL WHERE username = \\$1").
+		WithArgs("test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	purged, err := usersApp.PurgeDeactivatedUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("%d users were purged instead of 1", purged)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Users --------
+
+// -------- Start Changes --------
+
+func TestChangesObserve(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO user_changes \\(username, module\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT").
+		WithArgs("test-user", "preferences").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	NewChangesDB(db).Observe(context.Background(), Mutation{Module: "preferences", Action: actionUpdated, Username: "test-user"})
+	NewChangesDB(db).Observe(context.Background(), Mutation{Module: "users", Action: actionPurged, Username: "test-user"})
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetChanges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewChangesApp(NewChangesDB(db), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+
+	changedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	changeRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"module", "version", "changed_at"}).
+			AddRow("preferences", 3, changedAt).
+			AddRow("bags", 7, changedAt.Add(time.Hour))
+	}
+
+	for _, tc := range []struct {
+		since    string
+		expected string
+	}{
+		{"", `{"changed":["bags","preferences"],"token":"7","user":"test-user"}`},
+		{"3", `{"changed":["bags"],"token":"7","user":"test-user"}`},
+		{"7", `{"changed":[],"token":"7","user":"test-user"}`},
+		{"9", `{"changed":[],"token":"9","user":"test-user"}`},
+		{"2026-01-02T03:30:00Z", `{"changed":["bags"],"token":"7","user":"test-user"}`},
+	} {
+		mock.ExpectQuery("SELECT module, version, changed_at FROM user_changes WHERE username = ANY").
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(changeRows())
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/users/test-user/changes?since="+url.QueryEscape(tc.since), nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d: %s", recorder.Code, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != tc.expected {
+			t.Errorf("changes since %q were %s instead of %s", tc.since, actual, tc.expected)
+		}
+	}
+
+	// A purge changes everything.
+	mock.ExpectQuery("SELECT module, version, changed_at FROM user_changes").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"module", "version", "changed_at"}).AddRow("users", 10, changedAt))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/users/test-user/changes?since=7", nil))
+	expected := `{"changed":["bags","preferences","searches","sessions"],"token":"10","user":"test-user"}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("changes after a purge were %s instead of %s", actual, expected)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/users/test-user/changes?since=yesterday", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code for an invalid since was %d", recorder.Code)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Changes --------
+
+// -------- Start Profiles --------
+
+// newProfileTestServer returns a server that stands in for Keycloak's token
+// endpoint and user search, along with counts of the requests made to each.
+func newProfileTestServer(t *testing.T, status int) (*httptest.Server, *int, *int) {
+	var tokens, lookups int
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokens++
+			if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("client_secret") != "secret" {
+				t.Errorf("unexpected token request: %v", r.PostForm)
+			}
+			writer.Write([]byte(`{"access_token":"token-1","expires_in":300}`)) // nolint:errcheck
+		case "/users":
+			lookups++
+			if auth := r.Header.Get("Authorization"); auth != "Bearer token-1" {
+				t.Errorf("Authorization was %q", auth)
+			}
+			if status != http.StatusOK {
+				writer.WriteHeader(status)
+				return
+			}
+			if r.URL.Query().Get("username") != "test-user" {
+				writer.Write([]byte(`[]`)) // nolint:errcheck
+				return
+			}
+			writer.Write([]byte(`[{"username":"test-user","firstName":"Test","lastName":"User","email":"test@example.org","attributes":{"institution":["CyVerse"]}}]`)) // nolint:errcheck
+		default:
+			t.Errorf("unexpected request for %s", r.URL)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &tokens, &lookups
+}
+
+// newProfileTestSource returns a profile source configured for a Keycloak
+// user search at the server.
+func newProfileTestSource(t *testing.T, server *httptest.Server) profileSource {
+	cfg := viper.New()
+	setConfigDefaults(cfg)
+	cfg.Set("profile.url", server.URL+"/users?username={username}&exact=true")
+	cfg.Set("profile.token_url", server.URL+"/token")
+	cfg.Set("profile.client_id", "user-info")
+	cfg.Set("profile.client_secret", "secret")
+	cfg.Set("profile.attributes.name", "firstName lastName")
+	cfg.Set("profile.attributes.institution", "attributes.institution")
+
+	source, err := profileSourceFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestGetProfile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	server, tokens, lookups := newProfileTestServer(t, http.StatusOK)
+	router := makeRouter()
+	NewProfileApp(db, newProfileTestSource(t, server), newMemoryCache(time.Minute), router)
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user@" + IplantSuffix).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/profile/test-user@"+IplantSuffix, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d: %s", recorder.Code, recorder.Body.String())
+		}
+
+		var profile UserProfile
+		if err = json.Unmarshal(recorder.Body.Bytes(), &profile); err != nil {
+			t.Fatal(err)
+		}
+		expected := UserProfile{
+			User:              "test-user@" + IplantSuffix,
+			ID:                "user-1",
+			ProfileAttributes: ProfileAttributes{Name: "Test User", Email: "test@example.org", Institution: "CyVerse"},
+		}
+		if profile != expected {
+			t.Errorf("profile was %+v instead of %+v", profile, expected)
+		}
+	}
+
+	if *tokens != 1 || *lookups != 1 {
+		t.Errorf("%d tokens were requested and the user was looked up %d times", *tokens, *lookups)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetProfileUnknownUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	server, _, _ := newProfileTestServer(t, http.StatusOK)
+	router := makeRouter()
+	NewProfileApp(db, newProfileTestSource(t, server), nil, router)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("nobody").
+		WillReturnError(sql.ErrNoRows)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/profile/nobody", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusNotFound)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetProfileWithoutSource(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := makeRouter()
+	NewProfileApp(db, nil, nil, router)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/profile/test-user", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if body := strings.TrimSpace(recorder.Body.String()); body != `{"user":"test-user","id":"user-1"}` {
+		t.Errorf("body was %s", body)
+	}
+}
+
+func TestGetProfileSourceError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	server, _, _ := newProfileTestServer(t, http.StatusInternalServerError)
+	router := makeRouter()
+	NewProfileApp(db, newProfileTestSource(t, server), nil, router)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/profile/test-user", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusBadGateway)
+	}
+	var problem httpapi.Problem
+	if err = json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != httpapi.CodeUpstreamError {
+		t.Errorf("code was %q instead of %q", problem.Code, httpapi.CodeUpstreamError)
+	}
+}
+
+func TestJSONPathValue(t *testing.T) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(`{"name":"Test","emails":["a@example.org","b@example.org"],"attributes":{"staff":[true],"age":42,"empty":[]}}`), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"name":             "Test",
+		"emails":           "a@example.org",
+		"emails.1":         "b@example.org",
+		"emails.2":         "",
+		"attributes.staff": "true",
+		"attributes.age":   "42",
+		"attributes.empty": "",
+		"attributes":       "",
+		"missing.path":     "",
+		"name.first":       "",
+	}
+	for path, expected := range tests {
+		if actual := jsonPathValue(v, path); actual != expected {
+			t.Errorf("value at %s was %q instead of %q", path, actual, expected)
+		}
+	}
+}
+
+func TestNewHTTPProfileSourceRequiresUsername(t *testing.T) {
+	if _, err := NewHTTPProfileSource("https://ldap.example.org/users", time.Second, nil, nil); err == nil {
+		t.Error("a URL without {username} was accepted")
+	}
+}
+
+// -------- End Profiles --------
+
+// -------- Start Avatars --------
+
+// avatarPNG is enough of a PNG for http.DetectContentType to recognize it.
+var avatarPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+
+// newAvatarsTestRouter returns a router serving avatars from the mock db. The
+// user test-user is cached as existing, so the handlers don't look them up.
+func newAvatarsTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	avatarsDB := NewAvatarsDB(db, cache)
+	observer := &recordingObserver{}
+	avatarsDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewAvatarsApp(avatarsDB, 64, time.Minute, router)
+	return router, mock, observer
+}
+
+func expectAvatar(mock sqlmock.Sqlmock, image []byte, avatarURL string, updatedAt time.Time) {
+	rows := sqlmock.NewRows([]string{"content_type", "image", "url", "updated_at"})
+	if avatarURL != "" {
+		rows.AddRow(nil, nil, avatarURL, updatedAt)
+	} else {
+		rows.AddRow("image/png", image, nil, updatedAt)
+	}
+	mock.ExpectQuery("SELECT a.content_type, a.image, a.url, a.updated_at FROM user_avatars a, users u WHERE a.user_id = u.id AND u.username = \\$1").
+		WithArgs("test-user").
+		WillReturnRows(rows)
+}
+
+func TestGetAvatarImage(t *testing.T) {
+	router, mock, _ := newAvatarsTestRouter(t)
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectAvatar(mock, avatarPNG, "", updatedAt)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/avatars/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if !bytes.Equal(recorder.Body.Bytes(), avatarPNG) {
+		t.Errorf("body was %q instead of %q", recorder.Body.Bytes(), avatarPNG)
+	}
+	headers := map[string]string{
+		"Content-Type":  "image/png",
+		"Cache-Control": "private, max-age=60",
+		"ETag":          avatarETag(avatarPNG),
+		"Last-Modified": updatedAt.Format(http.TimeFormat),
+	}
+	for name, expected := range headers {
+		if actual := recorder.Header().Get(name); actual != expected {
+			t.Errorf("%s was %q instead of %q", name, actual, expected)
+		}
+	}
+
+	// A client with the current image doesn't get it again.
+	expectAvatar(mock, avatarPNG, "", updatedAt)
+	request := httptest.NewRequest(http.MethodGet, "/avatars/test-user", nil)
+	request.Header.Set("If-None-Match", avatarETag(avatarPNG))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusNotModified)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetAvatarURL(t *testing.T) {
+	router, mock, _ := newAvatarsTestRouter(t)
+	expectAvatar(mock, nil, "https://example.org/avatar.png", time.Now())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/avatars/test-user", nil))
+
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("status code was %d instead of %d", recorder.Code, http.StatusFound)
+	}
+	if location := recorder.Header().Get("Location"); location != "https://example.org/avatar.png" {
+		t.Errorf("Location was %q", location)
+	}
+}
+
+func TestGetAvatarMissing(t *testing.T) {
+	router, mock, _ := newAvatarsTestRouter(t)
+	mock.ExpectQuery("SELECT a.content_type, a.image, a.url, a.updated_at FROM user_avatars a").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"content_type", "image", "url", "updated_at"}))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/avatars/test-user", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestGetAvatarUnknownUser(t *testing.T) {
+	router, mock, _ := newAvatarsTestRouter(t)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/avatars/nobody", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestPutAvatarImage(t *testing.T) {
+	router, mock, observer := newAvatarsTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_avatars \\(user_id, content_type, image, url\\)").
+		WithArgs("user-1", "image/png", avatarPNG, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"created", "updated_at"}).AddRow(true, time.Now()))
+
+	request := httptest.NewRequest(http.MethodPut, "/avatars/test-user", bytes.NewReader(avatarPNG))
+	request.Header.Set("Content-Type", "image/png")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+	var avatar Avatar
+	if err := json.Unmarshal(recorder.Body.Bytes(), &avatar); err != nil {
+		t.Fatal(err)
+	}
+	if avatar.User != "test-user" || avatar.ContentType != "image/png" || avatar.Size != len(avatarPNG) || avatar.URL != "" {
+		t.Errorf("unexpected avatar: %s", recorder.Body.String())
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "avatars" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutAvatarURL(t *testing.T) {
+	router, mock, observer := newAvatarsTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_avatars \\(user_id, content_type, image, url\\)").
+		WithArgs("user-1", nil, nil, "https://example.org/avatar.png").
+		WillReturnRows(sqlmock.NewRows([]string{"created", "updated_at"}).AddRow(false, time.Now()))
+
+	request := httptest.NewRequest(http.MethodPut, "/avatars/test-user", strings.NewReader(`{"url":"https://example.org/avatar.png"}`))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionUpdated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutAvatarRejectsInvalidBodies(t *testing.T) {
+	router, mock, _ := newAvatarsTestRouter(t)
+
+	tests := []struct {
+		contentType string
+		body        []byte
+		status      int
+		code        string
+	}{
+		{"image/png", nil, http.StatusBadRequest, httpapi.CodeBadRequest},
+		{"image/png", []byte("not an image"), http.StatusUnsupportedMediaType, httpapi.CodeUnsupportedMediaType},
+		{"image/png", append(append([]byte{}, avatarPNG...), make([]byte, 64)...), http.StatusRequestEntityTooLarge, httpapi.CodeRequestTooLarge},
+		{"application/json", []byte(`{"url":"ftp://example.org/avatar.png"}`), http.StatusBadRequest, httpapi.CodeBadRequest},
+		{"application/json", []byte(`{"url":"/avatar.png"}`), http.StatusBadRequest, httpapi.CodeBadRequest},
+		{"application/json", []byte(`{"url":`), http.StatusBadRequest, httpapi.CodeBadRequest},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPut, "/avatars/test-user", bytes.NewReader(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("status code for %q was %d instead of %d", test.body, recorder.Code, test.status)
+			continue
+		}
+		var problem httpapi.Problem
+		if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if problem.Code != test.code {
+			t.Errorf("code for %q was %q instead of %q", test.body, problem.Code, test.code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteAvatar(t *testing.T) {
+	router, mock, observer := newAvatarsTestRouter(t)
+	for _, deleted := range []int64{1, 0} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectExec("DELETE FROM ONLY user_avatars WHERE user_id = \\$1").
+			WithArgs("user-1").
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+	}
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/avatars/test-user", nil))
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d", recorder.Code, expected)
+		}
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionDeleted {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Avatars --------
+
+// -------- Start Tours --------
+
+// newToursTestRouter returns a router serving tours from the mock db. The user
+// test-user is cached as existing, so the handlers don't look them up.
+func newToursTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, Cache) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	router := makeRouter()
+	NewToursApp(NewToursDB(db, cache), router)
+	return router, mock, cache
+}
+
+func TestGetTours(t *testing.T) {
+	router, mock, _ := newToursTestRouter(t)
+	completedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT t.tour_id, t.completed_at FROM user_tours t, users u WHERE t.user_id = u.id AND u.username = \\$1 ORDER BY t.completed_at, t.tour_id").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"tour_id", "completed_at"}).AddRow("data-window", completedAt))
+
+	// The second request is served from the cache.
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tours/test-user", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		expected := `{"tours":[{"tour_id":"data-window","completed_at":"2024-01-02T03:04:05Z"}]}`
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+			t.Errorf("response was %s instead of %s", actual, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetToursEmpty(t *testing.T) {
+	router, mock, _ := newToursTestRouter(t)
+	mock.ExpectQuery("SELECT t.tour_id, t.completed_at FROM user_tours t").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"tour_id", "completed_at"}))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tours/test-user", nil))
+
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != `{"tours":[]}` {
+		t.Errorf("response was %s", actual)
+	}
+}
+
+func TestPutTour(t *testing.T) {
+	router, mock, cache := newToursTestRouter(t)
+	cacheSet(context.Background(), cache, toursKey("test-user"), []CompletedTour{})
+
+	completedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, created := range []bool{true, false} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectQuery("INSERT INTO user_tours \\(user_id, tour_id\\)").
+			WithArgs("user-1", "onboarding.step-2").
+			WillReturnRows(sqlmock.NewRows([]string{"created", "completed_at"}).AddRow(created, completedAt))
+	}
+
+	for _, expected := range []int{http.StatusCreated, http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/tours/test-user/onboarding.step-2", nil))
+
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+		var tour CompletedTour
+		if err := json.Unmarshal(recorder.Body.Bytes(), &tour); err != nil {
+			t.Fatal(err)
+		}
+		if tour.TourID != "onboarding.step-2" || !tour.CompletedAt.Equal(completedAt) {
+			t.Errorf("unexpected tour: %s", recorder.Body.String())
+		}
+	}
+
+	if _, ok := cacheGet[[]CompletedTour](context.Background(), cache, toursKey("test-user")); ok {
+		t.Error("the cached tours weren't invalidated")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutTourInvalidID(t *testing.T) {
+	router, mock, _ := newToursTestRouter(t)
+
+	for _, id := range []string{"-leading-hyphen", "has%20space", strings.Repeat("a", 129)} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/tours/test-user/"+id, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %q was %d instead of %d", id, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteTour(t *testing.T) {
+	router, mock, _ := newToursTestRouter(t)
+	for _, deleted := range []int64{1, 0} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectExec("DELETE FROM ONLY user_tours WHERE user_id = \\$1 AND tour_id = \\$2").
+			WithArgs("user-1", "data-window").
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+	}
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/tours/test-user/data-window", nil))
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d", recorder.Code, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteAllTours(t *testing.T) {
+	router, mock, _ := newToursTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectExec("DELETE FROM ONLY user_tours WHERE user_id = \\$1$").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/tours/test-user", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusOK)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Tours --------
+
+// -------- Start Notification Prefs --------
+
+// newNotificationPrefsTestRouter returns a router serving notification
+// settings from the mock db, with the channels email, in_app, and webhook, of
+// which email and in_app are on by default. The user test-user is cached as
+// existing.
+func newNotificationPrefsTestRouter(t *testing.T, eventTypes ...string) (*mux.Router, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	router := makeRouter()
+	NewNotificationPrefsApp(NewNotificationPrefsDB(db, cache), []string{"email", "in_app", "webhook"}, []string{"email", "in_app"}, eventTypes, router)
+	return router, mock
+}
+
+func notificationPrefsRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"username", "scope", "name", "enabled"})
+}
+
+func TestGetNotificationPrefs(t *testing.T) {
+	router, mock := newNotificationPrefsTestRouter(t)
+	mock.ExpectQuery("SELECT u.username, p.scope, p.name, p.enabled FROM user_notification_prefs p JOIN users u ON p.user_id = u.id WHERE u.username = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(notificationPrefsRows().
+			AddRow("test-user", "channel", "email", false).
+			AddRow("test-user", "event", "analysis.completed", false))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notification-prefs/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"channels":{"email":false,"in_app":true,"webhook":false},"events":{"analysis.completed":false}}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetNotificationPrefsDefaults(t *testing.T) {
+	router, mock := newNotificationPrefsTestRouter(t)
+	mock.ExpectQuery("SELECT u.username, p.scope, p.name, p.enabled FROM user_notification_prefs p").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(notificationPrefsRows())
+
+	// The second request is served from the cache.
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notification-prefs/test-user", nil))
+
+		expected := `{"channels":{"email":true,"in_app":true,"webhook":false},"events":{}}`
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+			t.Errorf("response was %s instead of %s", actual, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutNotificationPrefs(t *testing.T) {
+	router, mock := newNotificationPrefsTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM ONLY user_notification_prefs WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_notification_prefs \\(user_id, scope, name, enabled\\) SELECT \\$1, s.scope, s.name, s.enabled FROM unnest").
+		WithArgs("user-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	body := `{"channels":{"webhook":true},"events":{"data.shared":false}}`
+	request := httptest.NewRequest(http.MethodPut, "/notification-prefs/test-user", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+	expected := `{"channels":{"email":true,"in_app":true,"webhook":true},"events":{"data.shared":false}}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutNotificationPrefsInvalid(t *testing.T) {
+	router, mock := newNotificationPrefsTestRouter(t, "analysis.completed")
+
+	// Only analysis.completed can be turned off, so data.shared is invalid
+	// even though it's well-formed.
+	body := `{"channels":{"sms":true,"email":true},"events":{"Analysis Completed":true,"data.shared":false,"analysis.completed":false}}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/notification-prefs/test-user", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status code was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+	var problem struct {
+		Code   string            `json:"code"`
+		Fields map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	fields := []string{"channels.sms", "events.Analysis Completed", "events.data.shared"}
+	if problem.Code != httpapi.CodeInvalidFields || len(problem.Fields) != len(fields) {
+		t.Errorf("unexpected problem: %s", recorder.Body.String())
+	}
+	for _, field := range fields {
+		if problem.Fields[field] == "" {
+			t.Errorf("%s wasn't reported as invalid", field)
+		}
+	}
+
+	// Bodies that aren't settings at all are rejected before validation.
+	for _, body := range []string{`{"channel":{}}`, `[]`, `{"channels":{"email":"yes"}}`} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/notification-prefs/test-user", strings.NewReader(body)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteNotificationPrefs(t *testing.T) {
+	router, mock := newNotificationPrefsTestRouter(t)
+	for _, deleted := range []int64{2, 0} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectExec("DELETE FROM ONLY user_notification_prefs WHERE user_id = \\$1").
+			WithArgs("user-1").
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+	}
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/notification-prefs/test-user", nil))
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d", recorder.Code, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestQueryNotificationPrefs(t *testing.T) {
+	router, mock := newNotificationPrefsTestRouter(t)
+	mock.ExpectQuery("SELECT u.username, p.scope, p.name, p.enabled FROM user_notification_prefs p").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(notificationPrefsRows().
+			AddRow("a@example.org", "channel", "webhook", true).
+			AddRow("b@example.org", "event", "analysis.completed", false))
+
+	body := `{"usernames":["a@example.org","b@example.org","c@example.org"],"event_type":"analysis.completed"}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/notification-prefs/query", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	var result struct {
+		Users map[string]struct {
+			Deliver []string `json:"deliver"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"a@example.org": {"email", "in_app", "webhook"},
+		"b@example.org": {},
+		"c@example.org": {"email", "in_app"},
+	}
+	for username, channels := range expected {
+		user, ok := result.Users[username]
+		if !ok || !reflect.DeepEqual(user.Deliver, channels) {
+			t.Errorf("%s would get the notification through %v instead of %v", username, user.Deliver, channels)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestQueryNotificationPrefsInvalid(t *testing.T) {
+	router, mock := newNotificationPrefsTestRouter(t)
+
+	tooMany := make([]string, maxNotificationQueryUsers+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("user-%d@example.org", i)
+	}
+	encoded, err := json.Marshal(map[string]interface{}{"usernames": tooMany})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{`{"usernames":[]}`, `{"usernames":["a@example.org"],"event_type":"Bad Type"}`, string(encoded)} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/notification-prefs/query", strings.NewReader(body)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Notification Prefs --------
+
+// -------- Start Feedback --------
+
+// newFeedbackTestRouter returns a router serving feedback from the mock db,
+// with the admin routes unprotected. The user test-user is cached as existing,
+// and the returned observer records the mutations.
+func newFeedbackTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	feedbackDB := NewFeedbackDB(db, cache)
+	observer := &recordingObserver{}
+	feedbackDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewFeedbackApp(feedbackDB, router, newAdminRouter(router, nil))
+	return router, mock, observer
+}
+
+func feedbackRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "username", "form_id", "answers", "submitted_at"})
+}
+
+func TestPostFeedback(t *testing.T) {
+	router, mock, observer := newFeedbackTestRouter(t)
+	submittedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_feedback \\(user_id, form_id, answers\\) VALUES \\(\\$1, \\$2, \\$3\\) RETURNING id, submitted_at").
+		WithArgs("user-1", "nps-2024", `{"score":9,"comment":"great"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "submitted_at"}).AddRow("feedback-1", submittedAt))
+
+	body := `{"form_id":"nps-2024","answers":{"score":9,"comment":"great"}}`
+	request := httptest.NewRequest(http.MethodPost, "/feedback/test-user", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+	expected := `{"id":"feedback-1","username":"test-user","form_id":"nps-2024","answers":{"score":9,"comment":"great"},"submitted_at":"2024-01-02T03:04:05Z"}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "feedback" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostFeedbackInvalid(t *testing.T) {
+	router, mock, _ := newFeedbackTestRouter(t)
+
+	body := `{"form_id":"-nps","answers":[1,2]}`
+	request := httptest.NewRequest(http.MethodPost, "/feedback/test-user", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body.String())
+	}
+	var problem struct {
+		Fields map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Fields["form_id"] == "" || problem.Fields["answers"] == "" {
+		t.Errorf("unexpected fields: %v", problem.Fields)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetFeedback(t *testing.T) {
+	router, mock, _ := newFeedbackTestRouter(t)
+	submittedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_feedback f JOIN users u ON f.user_id = u.id WHERE u.username = \\$1 AND f.form_id = \\$2").
+		WithArgs("test-user", "nps-2024").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT f.id, u.username, f.form_id, f.answers, f.submitted_at FROM user_feedback f JOIN users u ON f.user_id = u.id WHERE u.username = \\$1 AND f.form_id = \\$2 ORDER BY f.submitted_at DESC, f.id LIMIT \\$3 OFFSET \\$4").
+		WithArgs("test-user", "nps-2024", 100, 0).
+		WillReturnRows(feedbackRows().AddRow("feedback-1", "test-user", "nps-2024", []byte(`{"score": 9}`), submittedAt))
+
+	// The username query parameter can't be used to list another user's
+	// submissions.
+	request := httptest.NewRequest(http.MethodGet, "/feedback/test-user?form_id=nps-2024&username=other-user", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	var parsed struct {
+		Items []Feedback `json:"items"`
+		Total int64      `json:"total"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Total != 1 || len(parsed.Items) != 1 || parsed.Items[0].ID != "feedback-1" || string(parsed.Items[0].Answers) != `{"score":9}` {
+		t.Errorf("unexpected response: %s", recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestListFeedback(t *testing.T) {
+	router, mock, _ := newFeedbackTestRouter(t)
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_feedback f JOIN users u ON f.user_id = u.id WHERE f.form_id = \\$1 AND f.submitted_at >= \\$2").
+		WithArgs("nps-2024", since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT f.id, u.username, f.form_id, f.answers, f.submitted_at FROM user_feedback f JOIN users u ON f.user_id = u.id WHERE f.form_id = \\$1 AND f.submitted_at >= \\$2 ORDER BY f.submitted_at DESC, f.id LIMIT \\$3 OFFSET \\$4").
+		WithArgs("nps-2024", since, 10, 0).
+		WillReturnRows(feedbackRows())
+
+	request := httptest.NewRequest(http.MethodGet, "/admin/feedback?form_id=nps-2024&since=2024-01-01T00:00:00Z&limit=10", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"items":[],"total":0,"limit":10,"offset":0,"next":null}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestListFeedbackBadParams(t *testing.T) {
+	router, _, _ := newFeedbackTestRouter(t)
+
+	for _, path := range []string{"/admin/feedback?since=yesterday", "/admin/feedback?limit=1001", "/admin/feedback/export?until=2024-01-02", "/feedback/test-user?offset=-1"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", path, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestExportFeedback(t *testing.T) {
+	router, mock, _ := newFeedbackTestRouter(t)
+	submittedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT f.id, u.username, f.form_id, f.answers, f.submitted_at FROM user_feedback f JOIN users u ON f.user_id = u.id WHERE f.form_id = \\$1 ORDER BY f.submitted_at, f.id$").
+		WithArgs("nps-2024").
+		WillReturnRows(feedbackRows().
+			AddRow("feedback-1", "test-user", "nps-2024", []byte(`{"score": 9, "comment": "great, thanks"}`), submittedAt).
+			AddRow("feedback-2", "other-user", "nps-2024", []byte(`{"score": 3, "tags": ["slow"], "comment": null}`), submittedAt.Add(time.Hour)))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/feedback/export?form_id=nps-2024", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type was %q", contentType)
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); !strings.Contains(disposition, "feedback-") {
+		t.Errorf("Content-Disposition was %q", disposition)
+	}
+
+	expected := "id,username,form_id,submitted_at,comment,score,tags\n" +
+		"feedback-1,test-user,nps-2024,2024-01-02T03:04:05Z,\"great, thanks\",9,\n" +
+		"feedback-2,other-user,nps-2024,2024-01-02T04:04:05Z,,3,\"[\"\"slow\"\"]\"\n"
+	if actual := recorder.Body.String(); actual != expected {
+		t.Errorf("export was\n%s\ninstead of\n%s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Feedback --------
+
+// -------- Start Pins --------
+
+// newPinsTestRouter returns a router serving pins from the mock db, where up
+// to two apps and two folders can be pinned. The user test-user is cached as
+// existing, and the returned observer records the mutations.
+func newPinsTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	pinsDB := NewPinsDB(db, cache)
+	observer := &recordingObserver{}
+	pinsDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewPinsApp(pinsDB, map[string]int{"app": 2, "folder": 2}, router)
+	return router, mock, observer
+}
+
+// expectPinsLock expects the transaction that locks test-user's pins, and the
+// query for their pinned items of the type.
+func expectPinsLock(mock sqlmock.Sqlmock, itemType string, pins *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1 FOR NO KEY UPDATE").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	if pins != nil {
+		mock.ExpectQuery("SELECT item_id, position, pinned_at FROM user_pins WHERE user_id = \\$1 AND item_type = \\$2 ORDER BY position").
+			WithArgs("user-1", itemType).
+			WillReturnRows(pins)
+	}
+}
+
+func pinRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"item_id", "position", "pinned_at"})
+}
+
+func TestGetPins(t *testing.T) {
+	router, mock, _ := newPinsTestRouter(t)
+	pinnedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT p.item_type, p.item_id, p.position, p.pinned_at FROM user_pins p, users u WHERE p.user_id = u.id AND u.username = \\$1 ORDER BY p.item_type, p.position").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"item_type", "item_id", "position", "pinned_at"}).
+			AddRow("folder", "/iplant/home/test-user", 0, pinnedAt).
+			AddRow("folder", "/iplant/home/shared", 1, pinnedAt))
+
+	// The second request is served from the cache.
+	for _, test := range []struct {
+		path     string
+		expected string
+	}{
+		{"/pins/test-user", `{"pins":{"app":[],"folder":[{"id":"/iplant/home/test-user","position":0,"pinned_at":"2024-01-02T03:04:05Z"},{"id":"/iplant/home/shared","position":1,"pinned_at":"2024-01-02T03:04:05Z"}]}}`},
+		{"/pins/test-user/app", `{"pins":[]}`},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code for %s was %d instead of %d: %s", test.path, recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != test.expected {
+			t.Errorf("response for %s was %s instead of %s", test.path, actual, test.expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPinsUnknownType(t *testing.T) {
+	router, mock, _ := newPinsTestRouter(t)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, "/pins/test-user/notebook?id=1", strings.NewReader(`{"id":"1"}`)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", method, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostPin(t *testing.T) {
+	router, mock, observer := newPinsTestRouter(t)
+	pinnedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	expectPinsLock(mock, "app", pinRows().AddRow("app-1", 0, pinnedAt))
+	mock.ExpectQuery("INSERT INTO user_pins \\(user_id, item_type, item_id, position\\) VALUES \\(\\$1, \\$2, \\$3, \\$4\\) RETURNING pinned_at").
+		WithArgs("user-1", "app", "app-2", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"pinned_at"}).AddRow(pinnedAt))
+	mock.ExpectCommit()
+
+	// Pinning an item again doesn't move it.
+	expectPinsLock(mock, "app", pinRows().AddRow("app-1", 0, pinnedAt).AddRow("app-2", 1, pinnedAt))
+	mock.ExpectRollback()
+
+	for _, test := range []struct {
+		status   int
+		expected string
+	}{
+		{http.StatusCreated, `{"id":"app-2","position":1,"pinned_at":"2024-01-02T03:04:05Z"}`},
+		{http.StatusOK, `{"id":"app-2","position":1,"pinned_at":"2024-01-02T03:04:05Z"}`},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/pins/test-user/app", strings.NewReader(`{"id":"app-2"}`)))
+
+		if recorder.Code != test.status {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, test.status, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != test.expected {
+			t.Errorf("response was %s instead of %s", actual, test.expected)
+		}
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "pins" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostPinLimitReached(t *testing.T) {
+	router, mock, _ := newPinsTestRouter(t)
+	pinnedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectPinsLock(mock, "app", pinRows().AddRow("app-1", 0, pinnedAt).AddRow("app-2", 1, pinnedAt))
+	mock.ExpectRollback()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/pins/test-user/app", strings.NewReader(`{"id":"app-3"}`)))
+
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusConflict, recorder.Body.String())
+	}
+	var problem struct {
+		Code  string `json:"code"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != httpapi.CodeLimitReached || problem.Limit != 2 {
+		t.Errorf("unexpected problem: %s", recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostPinInvalid(t *testing.T) {
+	router, mock, _ := newPinsTestRouter(t)
+
+	for _, body := range []string{`{"id":""}`, `{"id":"` + strings.Repeat("a", maxResourceIDLength+1) + `"}`, `{"id":"app-1","position":2}`} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/pins/test-user/app", strings.NewReader(body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %.40s was %d instead of %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestReorderPins(t *testing.T) {
+	router, mock, observer := newPinsTestRouter(t)
+	pinnedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectPinsLock(mock, "folder", pinRows().AddRow("/a", 0, pinnedAt).AddRow("/b", 1, pinnedAt))
+	mock.ExpectExec("UPDATE user_pins p SET position = o.position - 1 FROM unnest\\(\\$3::text\\[\\]\\) WITH ORDINALITY AS o\\(item_id, position\\)").
+		WithArgs("user-1", "folder", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/pins/test-user/folder", strings.NewReader(`{"ids":["/b","/a"]}`)))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"pins":[{"id":"/b","position":0,"pinned_at":"2024-01-02T03:04:05Z"},{"id":"/a","position":1,"pinned_at":"2024-01-02T03:04:05Z"}]}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionUpdated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestReorderPinsMismatch(t *testing.T) {
+	router, mock, _ := newPinsTestRouter(t)
+	pinnedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	bodies := []string{`{"ids":["/a"]}`, `{"ids":["/a","/a"]}`, `{"ids":["/a","/c"]}`}
+	for range bodies {
+		expectPinsLock(mock, "folder", pinRows().AddRow("/a", 0, pinnedAt).AddRow("/b", 1, pinnedAt))
+		mock.ExpectRollback()
+	}
+
+	for _, body := range bodies {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/pins/test-user/folder", strings.NewReader(body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeletePin(t *testing.T) {
+	router, mock, _ := newPinsTestRouter(t)
+
+	expectPinsLock(mock, "folder", nil)
+	mock.ExpectQuery("DELETE FROM ONLY user_pins WHERE user_id = \\$1 AND item_type = \\$2 AND item_id = \\$3 RETURNING position").
+		WithArgs("user-1", "folder", "/iplant/home/test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"position"}).AddRow(1))
+	mock.ExpectExec("UPDATE user_pins SET position = position - 1 WHERE user_id = \\$1 AND item_type = \\$2 AND position > \\$3").
+		WithArgs("user-1", "folder", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	expectPinsLock(mock, "folder", nil)
+	mock.ExpectQuery("DELETE FROM ONLY user_pins").
+		WithArgs("user-1", "folder", "/iplant/home/test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"position"}))
+	mock.ExpectRollback()
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/pins/test-user/folder?id=%2Fiplant%2Fhome%2Ftest-user", nil))
+
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/pins/test-user/folder", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code without an id was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeletePins(t *testing.T) {
+	router, mock, _ := newPinsTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectExec("DELETE FROM ONLY user_pins WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/pins/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Pins --------
+
+// -------- Start Tags --------
+
+const testTagID = "6f1d2c3b-4a5e-4f60-8a7b-9c0d1e2f3a4b"
+
+// newTagsTestRouter returns a router serving tags from the mock db. The user
+// test-user is cached as existing, and the returned observer records the
+// mutations.
+func newTagsTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	tagsDB := NewTagsDB(db, cache)
+	observer := &recordingObserver{}
+	tagsDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewTagsApp(tagsDB, router)
+	return router, mock, observer
+}
+
+// expectTagOwner expects the lookup of the owner of test-user's tag, which is
+// found if found is true.
+func expectTagOwner(mock sqlmock.Sqlmock, found bool) {
+	rows := sqlmock.NewRows([]string{"user_id"})
+	if found {
+		rows.AddRow("user-1")
+	}
+	mock.ExpectQuery("SELECT t.user_id FROM user_tags t, users u WHERE t.user_id = u.id AND u.username = \\$1 AND t.id = \\$2").
+		WithArgs("test-user", testTagID).
+		WillReturnRows(rows)
+}
+
+func TestGetTags(t *testing.T) {
+	router, mock, _ := newTagsTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT t.id, t.name, t.created_at FROM user_tags t, users u WHERE t.user_id = u.id AND u.username = \\$1 ORDER BY t.name").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_at"}).AddRow(testTagID, "project", createdAt))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tags/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"tags":[{"id":"` + testTagID + `","name":"project","created_at":"2024-01-02T03:04:05Z"}]}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostTag(t *testing.T) {
+	router, mock, observer := newTagsTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, err := range []error{nil, &pq.Error{Code: "23505", Constraint: "user_tags_user_id_name_key"}} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		insert := mock.ExpectQuery("INSERT INTO user_tags \\(user_id, name\\) VALUES \\(\\$1, \\$2\\) RETURNING id, created_at").
+			WithArgs("user-1", "project")
+		if err != nil {
+			insert.WillReturnError(err)
+		} else {
+			insert.WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(testTagID, createdAt))
+		}
+	}
+
+	// The second request creates a tag with a name the user already has.
+	for _, status := range []int{http.StatusCreated, http.StatusConflict} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tags/test-user", strings.NewReader(`{"name":"project"}`)))
+
+		if recorder.Code != status {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, status, recorder.Body.String())
+		}
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "tags" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostTagInvalid(t *testing.T) {
+	router, mock, _ := newTagsTestRouter(t)
+
+	for _, body := range []string{
+		`{"name":""}`,
+		`{"name":" project"}`,
+		`{"name":"pro\u0000ject"}`,
+		`{"name":"` + strings.Repeat("x", maxNameLength+1) + `"}`,
+		`{"name":"project","color":"red"}`,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tags/test-user", strings.NewReader(body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteTag(t *testing.T) {
+	router, mock, observer := newTagsTestRouter(t)
+	for _, deleted := range []int64{1, 0} {
+		mock.ExpectExec("DELETE FROM ONLY user_tags t USING users u WHERE t.user_id = u.id AND t.id = \\$1 AND u.username = \\$2").
+			WithArgs(testTagID, "test-user").
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/tags/test-user/"+testTagID, nil))
+
+		if recorder.Code != status {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, status, recorder.Body.String())
+		}
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionDeleted {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestInvalidTagID(t *testing.T) {
+	router, mock, _ := newTagsTestRouter(t)
+
+	for _, test := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodDelete, "/tags/test-user/project"},
+		{http.MethodGet, "/tags/test-user/project/resources"},
+		{http.MethodPost, "/tags/test-user/project/resources"},
+		{http.MethodDelete, "/tags/test-user/project/resources?id=a"},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, strings.NewReader(`{"ids":["a"]}`)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s %s was %d instead of %d", test.method, test.path, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetTaggedResources(t *testing.T) {
+	router, mock, _ := newTagsTestRouter(t)
+	attachedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectTagOwner(mock, true)
+	mock.ExpectQuery("SELECT resource_id, attached_at FROM user_tag_resources WHERE tag_id = \\$1 ORDER BY attached_at, resource_id").
+		WithArgs(testTagID).
+		WillReturnRows(sqlmock.NewRows([]string{"resource_id", "attached_at"}).AddRow("/iplant/home/test-user/a", attachedAt))
+	expectTagOwner(mock, false)
+
+	for _, test := range []struct {
+		status   int
+		expected string
+	}{
+		{http.StatusOK, `{"resources":[{"id":"/iplant/home/test-user/a","attached_at":"2024-01-02T03:04:05Z"}]}`},
+		{http.StatusNotFound, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tags/test-user/"+testTagID+"/resources", nil))
+
+		if recorder.Code != test.status {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, test.status, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); test.expected != "" && actual != test.expected {
+			t.Errorf("response was %s instead of %s", actual, test.expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostTaggedResources(t *testing.T) {
+	router, mock, observer := newTagsTestRouter(t)
+	expectTagOwner(mock, true)
+	mock.ExpectExec("INSERT INTO user_tag_resources \\(user_id, tag_id, resource_id\\) SELECT \\$1, \\$2, r.id FROM unnest\\(\\$3::text\\[\\]\\) AS r\\(id\\) ON CONFLICT \\(tag_id, resource_id\\) DO NOTHING").
+		WithArgs("user-1", testTagID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectTagOwner(mock, false)
+
+	for _, test := range []struct {
+		status   int
+		expected string
+	}{
+		{http.StatusOK, `{"attached":1}`},
+		{http.StatusNotFound, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tags/test-user/"+testTagID+"/resources",
+			strings.NewReader(`{"ids":["/iplant/home/test-user/a","/iplant/home/test-user/b"]}`)))
+
+		if recorder.Code != test.status {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, test.status, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); test.expected != "" && actual != test.expected {
+			t.Errorf("response was %s instead of %s", actual, test.expected)
+		}
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "tags" || observer.mutations[0].Action != actionUpdated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostTaggedResourcesInvalid(t *testing.T) {
+	router, mock, _ := newTagsTestRouter(t)
+
+	tooMany, _ := json.Marshal(map[string][]string{"ids": make([]string, maxTagResources+1)})
+	for _, body := range []string{
+		`{"ids":[]}`,
+		`{"ids":[""]}`,
+		`{"ids":["` + strings.Repeat("x", maxResourceIDLength+1) + `"]}`,
+		string(tooMany),
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tags/test-user/"+testTagID+"/resources", strings.NewReader(body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteTaggedResources(t *testing.T) {
+	router, mock, observer := newTagsTestRouter(t)
+	expectTagOwner(mock, true)
+	mock.ExpectExec("DELETE FROM ONLY user_tag_resources WHERE tag_id = \\$1 AND resource_id = ANY\\(\\$2\\)").
+		WithArgs(testTagID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete,
+		"/tags/test-user/"+testTagID+"/resources?id=%2Fiplant%2Fhome%2Ftest-user%2Fa&id=%2Fiplant%2Fhome%2Ftest-user%2Fb", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != `{"detached":2}` {
+		t.Errorf("response was %s instead of %s", actual, `{"detached":2}`)
+	}
+
+	// Without any IDs to detach, nothing is queried.
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/tags/test-user/"+testTagID+"/resources", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code without IDs was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionUpdated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Tags --------
+
+// -------- Start Tokens --------
+
+const testTokenID = "0b5e9c8d-7f6a-4b3c-9d2e-1f0a9b8c7d6e"
+
+// newTokensTestRouter returns a router serving tokens from the mock db, where
+// tokens can have the read and write scopes and live for up to a day. The user
+// test-user is cached as existing, and the returned observer records the
+// mutations.
+func newTokensTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	tokensDB := NewTokensDB(db, cache)
+	observer := &recordingObserver{}
+	tokensDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewTokensApp(tokensDB, []string{"read", "write"}, 24*time.Hour, router)
+	return router, mock, observer
+}
+
+// capturedArg matches any query argument, and records the last one matched.
+type capturedArg struct {
+	value driver.Value
+}
+
+func (a *capturedArg) Match(v driver.Value) bool {
+	a.value = v
+	return true
+}
+
+func TestGetTokens(t *testing.T) {
+	router, mock, _ := newTokensTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT t.id, t.name, t.scopes, t.created_at, t.expires_at, t.last_used_at FROM user_tokens t, users u WHERE t.user_id = u.id AND u.username = \\$1 ORDER BY t.created_at, t.name").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "scopes", "created_at", "expires_at", "last_used_at"}).
+			AddRow(testTokenID, "script", "{read,write}", createdAt, nil, createdAt))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tokens/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"tokens":[{"id":"` + testTokenID + `","name":"script","scopes":["read","write"],"created_at":"2024-01-02T03:04:05Z","expires_at":null,"last_used_at":"2024-01-02T03:04:05Z"}]}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostToken(t *testing.T) {
+	router, mock, observer := newTokensTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	hash := &capturedArg{}
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_tokens \\(user_id, name, token_hash, scopes, expires_at\\) VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5\\) RETURNING id, created_at").
+		WithArgs("user-1", "script", hash, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(testTokenID, createdAt))
+
+	before := time.Now()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tokens/test-user", strings.NewReader(`{"name":"script","scopes":["write","read","write"]}`)))
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+	var token struct {
+		ID        string    `json:"id"`
+		Secret    string    `json:"token"`
+		Scopes    []string  `json:"scopes"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &token); err != nil {
+		t.Fatal(err)
+	}
+	if token.ID != testTokenID || !strings.HasPrefix(token.Secret, tokenPrefix) || strings.Join(token.Scopes, ",") != "read,write" {
+		t.Errorf("unexpected token: %s", recorder.Body.String())
+	}
+	if hash.value != hashTokenSecret(token.Secret) {
+		t.Errorf("the stored hash %v isn't the hash of the secret", hash.value)
+	}
+
+	// Tokens expire after the longest lifetime by default.
+	if expected := before.Add(24 * time.Hour).Truncate(time.Second); token.ExpiresAt.Before(expected) || token.ExpiresAt.After(expected.Add(time.Minute)) {
+		t.Errorf("the token expires at %s instead of about %s", token.ExpiresAt, expected)
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "tokens" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostTokenConflict(t *testing.T) {
+	router, mock, _ := newTokensTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_tokens").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "user_tokens_user_id_name_key"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tokens/test-user", strings.NewReader(`{"name":"script","scopes":["read"]}`)))
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusConflict, recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostTokenInvalid(t *testing.T) {
+	router, mock, _ := newTokensTestRouter(t)
+	tomorrow := time.Now().Add(25 * time.Hour).UTC().Format(time.RFC3339)
+
+	for _, test := range []struct {
+		body  string
+		field string
+	}{
+		{`{"name":"","scopes":["read"]}`, "name"},
+		{`{"name":"script","scopes":[]}`, "scopes"},
+		{`{"name":"script","scopes":["admin"]}`, "scopes"},
+		{`{"name":"script","scopes":["read all"]}`, "scopes"},
+		{`{"name":"script","scopes":["read"],"expires_at":"2020-01-01T00:00:00Z"}`, "expires_at"},
+		{`{"name":"script","scopes":["read"],"expires_at":"` + tomorrow + `"}`, "expires_at"},
+		{`{"name":"script","scopes":["read"],"token":"deut_chosen"}`, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tokens/test-user", strings.NewReader(test.body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", test.body, recorder.Code, http.StatusBadRequest)
+			continue
+		}
+		if test.field != "" && !strings.Contains(recorder.Body.String(), `"`+test.field+`"`) {
+			t.Errorf("response for %s doesn't mention %s: %s", test.body, test.field, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteToken(t *testing.T) {
+	router, mock, observer := newTokensTestRouter(t)
+	for _, deleted := range []int64{1, 0} {
+		mock.ExpectExec("DELETE FROM ONLY user_tokens t USING users u WHERE t.user_id = u.id AND t.id = \\$1 AND u.username = \\$2").
+			WithArgs(testTokenID, "test-user").
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+	}
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/tokens/test-user/" + testTokenID, http.StatusOK},
+		{"/tokens/test-user/" + testTokenID, http.StatusNotFound},
+		{"/tokens/test-user/script", http.StatusBadRequest},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, test.path, nil))
+
+		if recorder.Code != test.status {
+			t.Errorf("status code for %s was %d instead of %d: %s", test.path, recorder.Code, test.status, recorder.Body.String())
+		}
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionDeleted {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteTokens(t *testing.T) {
+	router, mock, observer := newTokensTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectExec("DELETE FROM ONLY user_tokens WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/tokens/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionDeleted {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	router, mock, _ := newTokensTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expiredAt := time.Date(2024, 1, 3, 3, 4, 5, 0, time.UTC)
+	secret := tokenPrefix + "secret"
+	columns := []string{"id", "username", "name", "scopes", "created_at", "expires_at", "last_used_at", "deactivated"}
+	expectLookup := func(rows *sqlmock.Rows) {
+		mock.ExpectQuery("SELECT t.id, u.username, t.name, t.scopes, t.created_at, t.expires_at, t.last_used_at, u.deactivated_at IS NOT NULL FROM user_tokens t JOIN users u ON t.user_id = u.id WHERE t.token_hash = \\$1").
+			WithArgs(hashTokenSecret(secret)).
+			WillReturnRows(rows)
+	}
+
+	expectLookup(sqlmock.NewRows(columns).AddRow(testTokenID, "test-user", "script", "{read}", createdAt, nil, nil, false))
+	mock.ExpectExec("UPDATE user_tokens SET last_used_at = now\\(\\) WHERE id = \\$1 AND \\(last_used_at IS NULL OR last_used_at < \\$2\\)").
+		WithArgs(testTokenID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLookup(sqlmock.NewRows(columns).AddRow(testTokenID, "test-user", "script", "{read}", createdAt, nil, nil, false))
+	expectLookup(sqlmock.NewRows(columns).AddRow(testTokenID, "test-user", "script", "{read}", createdAt, expiredAt, nil, false))
+	expectLookup(sqlmock.NewRows(columns).AddRow(testTokenID, "test-user", "script", "{read}", createdAt, nil, nil, true))
+	expectLookup(sqlmock.NewRows(columns))
+
+	for _, test := range []struct {
+		body     string
+		expected string
+	}{
+		{`{"token":"` + secret + `","scope":"read"}`, `{"active":true,"username":"test-user","id":"` + testTokenID + `","name":"script","scopes":["read"],"created_at":"2024-01-02T03:04:05Z","expires_at":null,"last_used_at":null}`},
+		{`{"token":"` + secret + `","scope":"write"}`, `{"active":false,"reason":"insufficient_scope"}`},
+		{`{"token":"` + secret + `"}`, `{"active":false,"reason":"expired"}`},
+		// The tokens of deactivated users aren't active, even if they're
+		// otherwise valid.
+		{`{"token":"` + secret + `","scope":"read"}`, `{"active":false,"reason":"deactivated"}`},
+		{`{"token":"` + secret + `"}`, `{"active":false,"reason":"unknown"}`},
+		// Secrets without the prefix aren't looked up.
+		{`{"token":"secret"}`, `{"active":false,"reason":"unknown"}`},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tokens/verify", strings.NewReader(test.body)))
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("status code for %s was %d instead of %d: %s", test.body, recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != test.expected {
+			t.Errorf("response for %s was %s instead of %s", test.body, actual, test.expected)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tokens/verify", strings.NewReader(`{}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code without a token was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Tokens --------
+
+// -------- Start Team Preferences --------
+
+// newTeamPrefsTestRouter returns a router serving team preferences from the
+// mock db, along with the cache, in which test-user is cached as existing.
+func newTeamPrefsTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, Cache) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	router := makeRouter()
+	NewTeamPrefsApp(NewTeamPrefsDB(db, cache), NewPrefsDB(db, cache), router)
+	return router, mock, cache
+}
+
+func TestMergePrefs(t *testing.T) {
+	for _, test := range []struct {
+		base      string
+		overrides string
+		expected  string
+	}{
+		{`{}`, `{}`, `{}`},
+		{`{"lang":"en","theme":"dark"}`, `{"theme":"light"}`, `{"lang":"en","theme":"light"}`},
+		{`{"data":{"size":50,"view":"grid"}}`, `{"data":{"view":"list"}}`, `{"data":{"size":50,"view":"list"}}`},
+		{`{"data":{"view":"grid"}}`, `{"data":"none"}`, `{"data":"none"}`},
+		{`{"tools":["a","b"]}`, `{"tools":["c"]}`, `{"tools":["c"]}`},
+		{`{"theme":"dark"}`, `{"theme":null}`, `{"theme":null}`},
+	} {
+		var base, overrides map[string]interface{}
+		if err := json.Unmarshal([]byte(test.base), &base); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(test.overrides), &overrides); err != nil {
+			t.Fatal(err)
+		}
+
+		merged, err := json.Marshal(mergePrefs(base, overrides))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(merged) != test.expected {
+			t.Errorf("merging %s over %s returned %s instead of %s", test.overrides, test.base, merged, test.expected)
+		}
+		if rebased, _ := json.Marshal(base); string(rebased) != test.base {
+			t.Errorf("merging changed the base preferences to %s", rebased)
+		}
+	}
+}
+
+func TestGetTeamPrefs(t *testing.T) {
+	router, mock, _ := newTeamPrefsTestRouter(t)
+	mock.ExpectQuery("SELECT preferences FROM team_preferences WHERE team_id = \\$1").
+		WithArgs("iplant:labs:test").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow(`{"theme": "dark"}`))
+	mock.ExpectQuery("SELECT preferences FROM team_preferences WHERE team_id = \\$1").
+		WithArgs("other").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}))
+
+	// The second request is served from the cache.
+	for _, test := range []struct {
+		path     string
+		expected string
+	}{
+		{"/team-preferences/iplant:labs:test", `{"theme":"dark"}`},
+		{"/team-preferences/iplant:labs:test", `{"theme":"dark"}`},
+		{"/team-preferences/other", `{}`},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code for %s was %d instead of %d: %s", test.path, recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != test.expected {
+			t.Errorf("response for %s was %s instead of %s", test.path, actual, test.expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutTeamPrefs(t *testing.T) {
+	router, mock, _ := newTeamPrefsTestRouter(t)
+	for _, created := range []bool{true, false} {
+		mock.ExpectQuery("INSERT INTO team_preferences \\(team_id, preferences\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT \\(team_id\\) DO UPDATE SET preferences = EXCLUDED.preferences, updated_at = now\\(\\) RETURNING \\(xmax = 0\\) AS created").
+			WithArgs("lab", `{"theme":"dark"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"created"}).AddRow(created))
+	}
+
+	for _, test := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/team-preferences/lab", `{"theme":"dark"}`, http.StatusCreated},
+		{"/team-preferences/lab", `{"theme":"dark"}`, http.StatusOK},
+		{"/team-preferences/lab", `["theme"]`, http.StatusBadRequest},
+		{"/team-preferences/-lab", `{"theme":"dark"}`, http.StatusBadRequest},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, test.path, strings.NewReader(test.body)))
+
+		if recorder.Code != test.status {
+			t.Errorf("status code for %s was %d instead of %d: %s", test.body, recorder.Code, test.status, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteTeamPrefs(t *testing.T) {
+	router, mock, _ := newTeamPrefsTestRouter(t)
+	for _, deleted := range []int64{1, 0} {
+		mock.ExpectExec("DELETE FROM ONLY team_preferences WHERE team_id = \\$1").
+			WithArgs("lab").
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/team-preferences/lab", nil))
+
+		if recorder.Code != status {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, status, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestResolvedTeamPrefs(t *testing.T) {
+	router, mock, cache := newTeamPrefsTestRouter(t)
+	cacheSet(context.Background(), cache, preferencesKey("test-user"), []UserPreferencesRecord{
+		{Preferences: `{"preferences":{"theme":"light","data":{"view":"list"}}}`},
+	})
+	mock.ExpectQuery("SELECT preferences FROM team_preferences WHERE team_id = \\$1").
+		WithArgs("lab").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow(`{"theme":"dark","lang":"en","data":{"view":"grid","size":50}}`))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/team-preferences/lab/resolved/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"data":{"size":50,"view":"list"},"lang":"en","theme":"light"}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Team Preferences --------
+
+// -------- Start User Webhooks --------
+
+const testUserWebhookID = "6f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0"
+
+// newUserWebhooksTestRouter returns a router serving webhooks from the mock db,
+// sending test notifications with client. Webhooks can have the slack and
+// custom types and any topic. The user test-user is cached as existing, and
+// the returned observer records the mutations.
+func newUserWebhooksTestRouter(t *testing.T, client *http.Client) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	webhooksDB := NewUserWebhooksDB(db, cache)
+	observer := &recordingObserver{}
+	webhooksDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewUserWebhooksApp(webhooksDB, []string{"slack", "custom"}, nil, client, router)
+	return router, mock, observer
+}
+
+// expectUserWebhooks expects the user's webhooks to be listed, returning a
+// webhook with the URL and type that receives notifications on every topic,
+// and one for analyses only.
+func expectUserWebhooks(mock sqlmock.Sqlmock, url, webhookType string) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT w.id, w.url, w.type, w.topics, w.created_at, w.updated_at FROM user_webhooks w, users u WHERE w.user_id = u.id AND u.username = \\$1 ORDER BY w.created_at, w.id").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "type", "topics", "created_at", "updated_at"}).
+			AddRow(testUserWebhookID, url, webhookType, "{}", createdAt, createdAt).
+			AddRow("7a2b3c4d-5e6f-4a1b-8c2d-3e4f5a6b7c8d", "https://example.com/analyses", "custom", "{analysis.completed}", createdAt, createdAt))
+}
+
+func TestPublicIP(t *testing.T) {
+	for _, test := range []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::248", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	} {
+		if actual := publicIP(net.ParseIP(test.ip)); actual != test.public {
+			t.Errorf("publicIP(%s) was %t instead of %t", test.ip, actual, test.public)
+		}
+	}
+}
+
+func TestUserWebhookClientPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+
+	if _, err := newUserWebhookClient(time.Second, false).Get(server.URL); err == nil {
+		t.Error("a request to a loopback address was allowed")
+	}
+
+	resp, err := newUserWebhookClient(time.Second, true).Get(server.URL)
+	if err != nil {
+		t.Fatalf("a request to a loopback address failed when private addresses are allowed: %s", err)
+	}
+	resp.Body.Close()
+}
+
+func TestGetUserWebhooks(t *testing.T) {
+	router, mock, _ := newUserWebhooksTestRouter(t, nil)
+	expectUserWebhooks(mock, "https://hooks.slack.com/services/T0/B0/x", "slack")
+
+	// The second request is served from the cache.
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{testUserWebhookID, "7a2b3c4d-5e6f-4a1b-8c2d-3e4f5a6b7c8d"}},
+		{"?topic=analysis.completed", []string{testUserWebhookID, "7a2b3c4d-5e6f-4a1b-8c2d-3e4f5a6b7c8d"}},
+		{"?topic=data.shared", []string{testUserWebhookID}},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/webhooks/test-user"+test.query, nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		var response struct {
+			Webhooks []UserWebhook `json:"webhooks"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, webhook := range response.Webhooks {
+			ids = append(ids, webhook.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("webhooks for %q were %v instead of %v", test.query, ids, test.expected)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/webhooks/test-user?topic=not+a+topic", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostUserWebhook(t *testing.T) {
+	router, mock, observer := newUserWebhooksTestRouter(t, nil)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	topics := &capturedArg{}
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_webhooks \\(user_id, url, type, topics\\) VALUES \\(\\$1, \\$2, \\$3, \\$4\\) RETURNING id, created_at, updated_at").
+		WithArgs("user-1", "https://example.com/hook", "custom", topics).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(testUserWebhookID, createdAt, createdAt))
+
+	body := `{"url":"https://example.com/hook","type":"custom","topics":["data.shared","analysis.completed","data.shared"]}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhooks/test-user", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+	expected := `{"id":"` + testUserWebhookID + `","url":"https://example.com/hook","type":"custom","topics":["analysis.completed","data.shared"],"created_at":"2024-01-02T03:04:05Z","updated_at":"2024-01-02T03:04:05Z"}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+	if topics.value != `{"analysis.completed","data.shared"}` {
+		t.Errorf("the stored topics were %v", topics.value)
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "user-webhooks" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostUserWebhookConflict(t *testing.T) {
+	router, mock, _ := newUserWebhooksTestRouter(t, nil)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_webhooks").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "user_webhooks_user_id_url_key"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhooks/test-user", strings.NewReader(`{"url":"https://example.com/hook","type":"custom"}`)))
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusConflict, recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostUserWebhookInvalid(t *testing.T) {
+	router, mock, _ := newUserWebhooksTestRouter(t, nil)
+
+	for _, test := range []struct {
+		body  string
+		field string
+	}{
+		{`{"url":"","type":"custom"}`, "url"},
+		{`{"url":"ftp://example.com/hook","type":"custom"}`, "url"},
+		{`{"url":"/hook","type":"custom"}`, "url"},
+		{`{"url":"https://example.com/hook","type":"zapier"}`, "type"},
+		{`{"url":"https://example.com/hook","type":"custom","topics":["Not a topic"]}`, "topics"},
+		{`{"url":"https://example.com/hook","type":"custom","secret":"s"}`, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhooks/test-user", strings.NewReader(test.body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", test.body, recorder.Code, http.StatusBadRequest)
+			continue
+		}
+		if test.field != "" && !strings.Contains(recorder.Body.String(), `"`+test.field+`"`) {
+			t.Errorf("response for %s doesn't mention %s: %s", test.body, test.field, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutUserWebhook(t *testing.T) {
+	router, mock, observer := newUserWebhooksTestRouter(t, nil)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	updatedAt := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+	mock.ExpectQuery("UPDATE ONLY user_webhooks w SET url = \\$3, type = \\$4, topics = \\$5, updated_at = now\\(\\) FROM users u WHERE w.user_id = u.id AND w.id = \\$1 AND u.username = \\$2").
+		WithArgs(testUserWebhookID, "test-user", "https://hooks.slack.com/services/T0/B0/x", "slack", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at"}).AddRow(createdAt, updatedAt))
+	mock.ExpectQuery("UPDATE ONLY user_webhooks w").
+		WillReturnError(sql.ErrNoRows)
+
+	body := `{"url":"https://hooks.slack.com/services/T0/B0/x","type":"slack"}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/webhooks/test-user/"+testUserWebhookID, strings.NewReader(body)))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"id":"` + testUserWebhookID + `","url":"https://hooks.slack.com/services/T0/B0/x","type":"slack","topics":[],"created_at":"2024-01-02T03:04:05Z","updated_at":"2024-02-03T04:05:06Z"}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionUpdated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/webhooks/test-user/"+testUserWebhookID, strings.NewReader(body)))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusNotFound, recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteUserWebhook(t *testing.T) {
+	router, mock, observer := newUserWebhooksTestRouter(t, nil)
+	mock.ExpectExec("DELETE FROM ONLY user_webhooks w USING users u WHERE w.user_id = u.id AND w.id = \\$1 AND u.username = \\$2").
+		WithArgs(testUserWebhookID, "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM ONLY user_webhooks w").
+		WithArgs(testUserWebhookID, "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/webhooks/test-user/"+testUserWebhookID, nil))
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/webhooks/test-user/not-a-uuid", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body.String())
+	}
+
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionDeleted {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteUserWebhooks(t *testing.T) {
+	router, mock, observer := newUserWebhooksTestRouter(t, nil)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectExec("DELETE FROM ONLY user_webhooks WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/webhooks/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionDeleted {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestUserWebhookTest(t *testing.T) {
+	var (
+		received []byte
+		headers  http.Header
+		status   = http.StatusOK
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		headers = r.Header
+		writer.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		webhookType string
+		status      int
+		expected    string
+	}{
+		{"custom", http.StatusOK, `{"delivered":true,"status":200}`},
+		{"slack", http.StatusOK, `{"delivered":true,"status":200}`},
+		{"custom", http.StatusGone, `{"delivered":false,"status":410,"error":"unexpected status 410 Gone"}`},
+	} {
+		router, mock, _ := newUserWebhooksTestRouter(t, server.Client())
+		expectUserWebhooks(mock, server.URL, test.webhookType)
+		status = test.status
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhooks/test-user/"+testUserWebhookID+"/test", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != test.expected {
+			t.Errorf("response for a %s webhook was %s instead of %s", test.webhookType, actual, test.expected)
+		}
+
+		var notification map[string]interface{}
+		if err := json.Unmarshal(received, &notification); err != nil {
+			t.Fatalf("the webhook received %s: %s", received, err)
+		}
+		if test.webhookType == "slack" {
+			if _, ok := notification["text"].(string); !ok || len(notification) != 1 {
+				t.Errorf("the Slack webhook received %s", received)
+			}
+		} else if notification["topic"] != testTopic || notification["username"] != "test-user" || headers.Get(webhookEventHeader) != testTopic {
+			t.Errorf("the webhook received %s", received)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("expectations were not met: %s", err)
+		}
+	}
+}
+
+func TestUserWebhookTestNotFound(t *testing.T) {
+	router, mock, _ := newUserWebhooksTestRouter(t, nil)
+	expectUserWebhooks(mock, "https://example.com/hook", "custom")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhooks/test-user/"+testTokenID+"/test", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusNotFound, recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End User Webhooks --------
+
+// -------- Start Dashboard --------
+
+// newDashboardTestRouter returns a router serving dashboards from the mock db,
+// with two columns and any widgets. The user test-user is cached as existing,
+// and the returned observer records the mutations.
+func newDashboardTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	dashboardDB := NewDashboardDB(db, cache)
+	observer := &recordingObserver{}
+	dashboardDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewDashboardApp(dashboardDB, nil, 2, router)
+	return router, mock, observer
+}
+
+// expectDashboard expects the user's dashboard layout to be read, returning
+// the widgets as (id, column, row, collapsed) tuples.
+func expectDashboard(mock sqlmock.Sqlmock, widgets ...[]driver.Value) {
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"widget_id", "grid_column", "grid_row", "collapsed", "updated_at"})
+	for _, widget := range widgets {
+		rows.AddRow(append(widget, updatedAt)...)
+	}
+	mock.ExpectQuery("SELECT w.widget_id, w.grid_column, w.grid_row, w.collapsed, w.updated_at FROM user_dashboard_widgets w, users u WHERE w.user_id = u.id AND u.username = \\$1 ORDER BY w.grid_column, w.grid_row").
+		WithArgs("test-user").
+		WillReturnRows(rows)
+}
+
+func TestGetDashboard(t *testing.T) {
+	router, mock, _ := newDashboardTestRouter(t)
+	expectDashboard(mock,
+		[]driver.Value{"recent-analyses", 0, 0, false},
+		[]driver.Value{"news", 1, 0, true},
+	)
+
+	// The second request is served from the cache.
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/dashboard/test-user", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		expected := `{"widgets":[{"id":"recent-analyses","column":0,"row":0,"collapsed":false,"updated_at":"2024-01-02T03:04:05Z"},{"id":"news","column":1,"row":0,"collapsed":true,"updated_at":"2024-01-02T03:04:05Z"}]}`
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+			t.Errorf("response was %s instead of %s", actual, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutDashboard(t *testing.T) {
+	router, mock, observer := newDashboardTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM ONLY user_dashboard_widgets WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_dashboard_widgets \\(user_id, widget_id, grid_column, grid_row, collapsed\\) SELECT \\$1, w.widget_id, w.grid_column, w.grid_row, w.collapsed FROM unnest\\(\\$2::text\\[\\], \\$3::integer\\[\\], \\$4::integer\\[\\], \\$5::boolean\\[\\]\\)").
+		WithArgs("user-1", "{\"news\",\"recent-analyses\"}", "{1,0}", "{0,0}", "{t,f}").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	expectDashboard(mock,
+		[]driver.Value{"recent-analyses", 0, 0, false},
+		[]driver.Value{"news", 1, 0, true},
+	)
+
+	body := `{"widgets":[{"id":"news","column":1,"row":0,"collapsed":true},{"id":"recent-analyses","column":0,"row":0}]}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/dashboard/test-user", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+	if !strings.HasPrefix(recorder.Body.String(), `{"widgets":[{"id":"recent-analyses",`) {
+		t.Errorf("unexpected response: %s", recorder.Body.String())
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "dashboard" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutDashboardInvalid(t *testing.T) {
+	router, mock, _ := newDashboardTestRouter(t)
+
+	for _, test := range []struct {
+		body   string
+		fields []string
+	}{
+		{`{}`, []string{"widgets"}},
+		{`{"widgets":[{"id":"news"}]}`, []string{"widgets[0].column", "widgets[0].row"}},
+		{`{"widgets":[{"id":"news","column":2,"row":0}]}`, []string{"widgets[0].column"}},
+		{`{"widgets":[{"id":"news","column":0,"row":-1}]}`, []string{"widgets[0].row"}},
+		{`{"widgets":[{"id":"not a widget","column":0,"row":0}]}`, []string{"widgets[0].id"}},
+		{`{"widgets":[{"id":"news","column":0,"row":0},{"id":"news","column":0,"row":1}]}`, []string{"widgets[1].id"}},
+		{`{"widgets":[{"id":"news","column":0,"row":0},{"id":"apps","column":0,"row":0}]}`, []string{"widgets[1]"}},
+		{`{"widgets":[{"id":"news","column":0,"row":0,"width":2}]}`, nil},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/dashboard/test-user", strings.NewReader(test.body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", test.body, recorder.Code, http.StatusBadRequest)
+			continue
+		}
+		if test.fields == nil {
+			continue
+		}
+		var problem struct {
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if len(problem.Fields) != len(test.fields) {
+			t.Errorf("problems for %s were %v instead of %v", test.body, problem.Fields, test.fields)
+		}
+		for _, field := range test.fields {
+			if _, ok := problem.Fields[field]; !ok {
+				t.Errorf("problems for %s were %v instead of %v", test.body, problem.Fields, test.fields)
+			}
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutDashboardWidget(t *testing.T) {
+	router, mock, observer := newDashboardTestRouter(t)
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, created := range []bool{true, false} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectQuery("INSERT INTO user_dashboard_widgets \\(user_id, widget_id, grid_column, grid_row, collapsed\\) VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5\\) ON CONFLICT \\(user_id, widget_id\\) DO UPDATE").
+			WithArgs("user-1", "news", 1, 3, true).
+			WillReturnRows(sqlmock.NewRows([]string{"created", "updated_at"}).AddRow(created, updatedAt))
+	}
+
+	for _, expected := range []int{http.StatusCreated, http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/dashboard/test-user/news", strings.NewReader(`{"column":1,"row":3,"collapsed":true}`)))
+
+		if recorder.Code != expected {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+		if body := `{"id":"news","column":1,"row":3,"collapsed":true,"updated_at":"2024-01-02T03:04:05Z"}`; strings.TrimSpace(recorder.Body.String()) != body {
+			t.Errorf("response was %s instead of %s", recorder.Body.String(), body)
+		}
+	}
+	if len(observer.mutations) != 2 || observer.mutations[0].Action != actionCreated || observer.mutations[1].Action != actionUpdated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutDashboardWidgetConflict(t *testing.T) {
+	router, mock, _ := newDashboardTestRouter(t)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_dashboard_widgets").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "user_dashboard_widgets_user_id_grid_column_grid_row_key"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/dashboard/test-user/news", strings.NewReader(`{"column":0,"row":0}`)))
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusConflict, recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), "another widget is in column 0, row 0") {
+		t.Errorf("unexpected response: %s", recorder.Body.String())
+	}
+
+	for _, body := range []string{`{"column":0}`, `{"column":5,"row":0}`, `{"column":0,"row":0,"id":"apps"}`} {
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/dashboard/test-user/news", strings.NewReader(body)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteDashboardWidget(t *testing.T) {
+	router, mock, observer := newDashboardTestRouter(t)
+	mock.ExpectExec("DELETE FROM ONLY user_dashboard_widgets w USING users u WHERE w.user_id = u.id AND w.widget_id = \\$1 AND u.username = \\$2").
+		WithArgs("news", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM ONLY user_dashboard_widgets w").
+		WithArgs("news", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/dashboard/test-user/news", nil))
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Action != actionDeleted {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteDashboard(t *testing.T) {
+	router, mock, _ := newDashboardTestRouter(t)
+	for _, deleted := range []int64{3, 0} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectExec("DELETE FROM ONLY user_dashboard_widgets WHERE user_id = \\$1").
+			WithArgs("user-1").
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+	}
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/dashboard/test-user", nil))
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Dashboard --------
+
+// -------- Start Consents --------
+
+// newConsentsTestRouter returns a router serving consents from the mock db,
+// where consent can be recorded for the analytics and marketing-email
+// purposes. The user test-user is cached as existing, and the returned
+// observer records the mutations.
+func newConsentsTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	consentsDB := NewConsentsDB(db, cache)
+	observer := &recordingObserver{}
+	consentsDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewConsentsApp(consentsDB, []string{"analytics", "marketing-email"}, router, newAdminRouter(router, nil))
+	return router, mock, observer
+}
+
+func consentRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "username", "purpose", "granted", "source", "recorded_at"})
+}
+
+func TestCurrentConsents(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	records := []ConsentRecord{
+		{Purpose: "marketing-email", Granted: true, Source: "signup-form", RecordedAt: day(1)},
+		{Purpose: "analytics", Granted: true, Source: "signup-form", RecordedAt: day(1)},
+		{Purpose: "marketing-email", Granted: false, Source: "settings", RecordedAt: day(2)},
+		{Purpose: "analytics", Granted: false, Source: "settings", RecordedAt: day(3)},
+		{Purpose: "analytics", Granted: true, Source: "banner", RecordedAt: day(4)},
+		{Purpose: "research", Granted: false, Source: "settings", RecordedAt: day(5)},
+	}
+
+	actual, err := json.Marshal(currentConsents(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[` +
+		`{"purpose":"analytics","granted":true,"granted_at":"2024-01-04T00:00:00Z","withdrawn_at":null,"source":"banner"},` +
+		`{"purpose":"marketing-email","granted":false,"granted_at":"2024-01-01T00:00:00Z","withdrawn_at":"2024-01-02T00:00:00Z","source":"settings"},` +
+		`{"purpose":"research","granted":false,"granted_at":null,"withdrawn_at":"2024-01-05T00:00:00Z","source":"settings"}` +
+		`]`
+	if string(actual) != expected {
+		t.Errorf("current consents were %s instead of %s", actual, expected)
+	}
+}
+
+func TestGetConsents(t *testing.T) {
+	router, mock, _ := newConsentsTestRouter(t)
+	mock.ExpectQuery("SELECT c.id, u.username, c.purpose, c.granted, c.source, c.recorded_at FROM user_consents c JOIN users u ON c.user_id = u.id WHERE u.username = \\$1 ORDER BY c.recorded_at, c.id").
+		WithArgs("test-user").
+		WillReturnRows(consentRows().
+			AddRow("record-1", "test-user", "analytics", true, "signup-form", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)).
+			AddRow("record-2", "test-user", "analytics", false, "settings", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/consents/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"consents":[{"purpose":"analytics","granted":false,"granted_at":"2024-01-01T00:00:00Z","withdrawn_at":"2024-01-02T00:00:00Z","source":"settings"}]}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostConsent(t *testing.T) {
+	router, mock, observer := newConsentsTestRouter(t)
+	recordedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectQuery("INSERT INTO user_consents \\(user_id, purpose, granted, source\\) VALUES \\(\\$1, \\$2, \\$3, \\$4\\) RETURNING id, recorded_at").
+		WithArgs("user-1", "marketing-email", false, "settings").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "recorded_at"}).AddRow("record-1", recordedAt))
+
+	body := `{"purpose":"marketing-email","granted":false,"source":"settings"}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/consents/test-user", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+	expected := `{"id":"record-1","username":"test-user","purpose":"marketing-email","granted":false,"source":"settings","recorded_at":"2024-01-02T03:04:05Z"}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].Module != "consents" || observer.mutations[0].Action != actionCreated {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPostConsentInvalid(t *testing.T) {
+	router, mock, _ := newConsentsTestRouter(t)
+
+	for _, test := range []struct {
+		body   string
+		fields []string
+	}{
+		{`{"purpose":"research","granted":true,"source":"settings"}`, []string{"purpose"}},
+		{`{"purpose":"analytics","source":"settings"}`, []string{"granted"}},
+		{`{"purpose":"","granted":true,"source":""}`, []string{"purpose", "source"}},
+		{`{"purpose":"analytics","granted":true,"source":"settings","recorded_at":"2020-01-01T00:00:00Z"}`, nil},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/consents/test-user", strings.NewReader(test.body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", test.body, recorder.Code, http.StatusBadRequest)
+			continue
+		}
+		var problem struct {
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if len(problem.Fields) != len(test.fields) {
+			t.Errorf("problems for %s were %v instead of %v", test.body, problem.Fields, test.fields)
+		}
+		for _, field := range test.fields {
+			if problem.Fields[field] == "" {
+				t.Errorf("problems for %s were %v instead of %v", test.body, problem.Fields, test.fields)
+			}
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestConsentHistory(t *testing.T) {
+	router, mock, _ := newConsentsTestRouter(t)
+	recordedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_consents c JOIN users u ON c.user_id = u.id WHERE u.username = \\$1 AND c.purpose = \\$2").
+		WithArgs("test-user", "analytics").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("SELECT c.id, u.username, c.purpose, c.granted, c.source, c.recorded_at FROM user_consents c JOIN users u ON c.user_id = u.id WHERE u.username = \\$1 AND c.purpose = \\$2 ORDER BY c.recorded_at DESC, c.id LIMIT \\$3 OFFSET \\$4").
+		WithArgs("test-user", "analytics", 2, 0).
+		WillReturnRows(consentRows().
+			AddRow("record-3", "test-user", "analytics", true, "banner", recordedAt).
+			AddRow("record-2", "test-user", "analytics", false, "settings", recordedAt.Add(-time.Hour)))
+
+	// The username query parameter can't be used to list another user's
+	// records.
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/consents/test-user/history?purpose=analytics&limit=2&username=other-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	var page struct {
+		Items []ConsentRecord `json:"items"`
+		Total int64           `json:"total"`
+		Next  *string         `json:"next"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Items) != 2 || page.Items[0].ID != "record-3" || page.Next == nil {
+		t.Errorf("unexpected page: %s", recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestListConsents(t *testing.T) {
+	router, mock, _ := newConsentsTestRouter(t)
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_consents c JOIN users u ON c.user_id = u.id WHERE c.purpose = \\$1 AND c.recorded_at >= \\$2").
+		WithArgs("marketing-email", since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT c.id, u.username, c.purpose, c.granted, c.source, c.recorded_at FROM user_consents c JOIN users u ON c.user_id = u.id WHERE c.purpose = \\$1 AND c.recorded_at >= \\$2 ORDER BY c.recorded_at DESC, c.id LIMIT \\$3 OFFSET \\$4").
+		WithArgs("marketing-email", since, 100, 0).
+		WillReturnRows(consentRows())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/consents?purpose=marketing-email&since=2024-01-01T00:00:00Z", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"items":[],"total":0,"limit":100,"offset":0,"next":null}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Consents --------
+
+// -------- Start Identity --------
+
+// newIdentityTestRouter returns a router serving OIDC subject mappings from
+// the mock db. The user test-user is cached as existing, and the returned
+// observer records the mutations.
+func newIdentityTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	identityDB := NewIdentityDB(db, cache)
+	observer := &recordingObserver{}
+	identityDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewIdentityApp(identityDB, router)
+	return router, mock, observer
+}
+
+func TestIdentityBySubject(t *testing.T) {
+	router, mock, _ := newIdentityTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	query := "SELECT i.subject, u.username, i.created_at FROM user_identities i JOIN users u ON i.user_id = u.id WHERE i.subject = \\$1"
+	mock.ExpectQuery(query).
+		WithArgs("f:realm:0a1b2c").
+		WillReturnRows(sqlmock.NewRows([]string{"subject", "username", "created_at"}).AddRow("f:realm:0a1b2c", "test-user", createdAt))
+	mock.ExpectQuery(query).
+		WithArgs("unknown").
+		WillReturnRows(sqlmock.NewRows([]string{"subject", "username", "created_at"}))
+
+	for _, tc := range []struct {
+		path     string
+		expected int
+		body     string
+	}{
+		{"/identity/by-subject/f:realm:0a1b2c", http.StatusOK, `{"subject":"f:realm:0a1b2c","username":"test-user","created_at":"2024-01-02T03:04:05Z"}`},
+		{"/identity/by-subject/unknown", http.StatusNotFound, ""},
+		{"/identity/by-subject/has%20space", http.StatusBadRequest, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+		if recorder.Code != tc.expected {
+			t.Errorf("status code for %s was %d instead of %d: %s", tc.path, recorder.Code, tc.expected, recorder.Body.String())
+			continue
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); tc.body != "" && actual != tc.body {
+			t.Errorf("response for %s was %s instead of %s", tc.path, actual, tc.body)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetIdentities(t *testing.T) {
+	router, mock, _ := newIdentityTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT i.subject, u.username, i.created_at FROM user_identities i, users u WHERE i.user_id = u.id AND u.username = \\$1 ORDER BY i.created_at, i.subject").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"subject", "username", "created_at"}).AddRow("subject-1", "test-user", createdAt))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/identity/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"identities":[{"subject":"subject-1","username":"test-user","created_at":"2024-01-02T03:04:05Z"}]}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutIdentity(t *testing.T) {
+	router, mock, observer := newIdentityTestRouter(t)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	query := "INSERT INTO user_identities \\(subject, user_id\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT \\(subject\\) DO UPDATE SET subject = EXCLUDED.subject RETURNING"
+	for _, row := range []struct {
+		username string
+		created  bool
+	}{
+		{"test-user", true},
+		{"test-user", false},
+		{"other-user", false},
+	} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectQuery(query).
+			WithArgs("subject-1", "user-1").
+			WillReturnRows(sqlmock.NewRows([]string{"username", "created_at", "created"}).AddRow(row.username, createdAt, row.created))
+	}
+
+	for _, expected := range []int{http.StatusCreated, http.StatusOK, http.StatusConflict} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/identity/test-user/subject-1", nil))
+
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].EventType() != "identity.created" {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteIdentity(t *testing.T) {
+	router, mock, observer := newIdentityTestRouter(t)
+	query := "DELETE FROM ONLY user_identities i USING users u WHERE i.user_id = u.id AND i.subject = \\$1 AND u.username = \\$2"
+	mock.ExpectExec(query).WithArgs("subject-1", "test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs("subject-1", "test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/identity/test-user/subject-1", nil))
+
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].EventType() != "identity.deleted" {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Identity --------
+
+// -------- Start Digests --------
+
+// newDigestsTestRouter returns a router serving digest schedules from the mock
+// db, with the email and in_app channels. The user test-user is cached as
+// existing, and the returned observer records the mutations.
+func newDigestsTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	digestsDB := NewDigestsDB(db, cache)
+	observer := &recordingObserver{}
+	digestsDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewDigestsApp(digestsDB, []string{"email", "in_app"}, router)
+	return router, mock, observer
+}
+
+var digestScheduleColumns = []string{"username", "frequency", "day", "hour", "timezone", "channels", "last_sent_at", "updated_at"}
+
+func TestGetDigestSchedule(t *testing.T) {
+	router, mock, _ := newDigestsTestRouter(t)
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT u.username, d.frequency, d.day, d.hour, d.timezone, d.channels, d.last_sent_at, d.updated_at FROM user_digest_schedules d, users u WHERE d.user_id = u.id AND u.username = \\$1").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows(digestScheduleColumns).AddRow("test-user", "weekly", 1, 9, "America/Phoenix", "{email,in_app}", nil, updatedAt))
+
+	// The second request is served from the cache.
+	expected := `{"username":"test-user","frequency":"weekly","day":1,"hour":9,"timezone":"America/Phoenix","channels":["email","in_app"],"last_sent_at":null,"updated_at":"2024-01-02T03:04:05Z"}`
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/digests/test-user", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+			t.Errorf("response was %s instead of %s", actual, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetDigestScheduleMissing(t *testing.T) {
+	router, mock, _ := newDigestsTestRouter(t)
+	mock.ExpectQuery("SELECT u.username, d.frequency, .* FROM user_digest_schedules d, users u").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows(digestScheduleColumns))
+
+	// Not having a schedule is cached too.
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/digests/test-user", nil))
+
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusNotFound, recorder.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutDigestSchedule(t *testing.T) {
+	router, mock, observer := newDigestsTestRouter(t)
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	query := "INSERT INTO user_digest_schedules \\(user_id, frequency, day, hour, timezone, channels\\) VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6\\) ON CONFLICT \\(user_id\\) DO UPDATE"
+	for _, created := range []bool{true, false} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectQuery(query).
+			WithArgs("user-1", "monthly", sql.NullInt64{Int64: 15, Valid: true}, 9, "Europe/Berlin", "{\"email\"}").
+			WillReturnRows(sqlmock.NewRows([]string{"created", "last_sent_at", "updated_at"}).AddRow(created, nil, updatedAt))
+	}
+
+	body := `{"frequency":"monthly","day":15,"hour":9,"timezone":"Europe/Berlin","channels":["email"]}`
+	for _, expected := range []int{http.StatusCreated, http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/digests/test-user", strings.NewReader(body)))
+
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+	if len(observer.mutations) != 2 || observer.mutations[0].EventType() != "digests.created" || observer.mutations[1].EventType() != "digests.updated" {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutDigestScheduleInvalid(t *testing.T) {
+	router, mock, _ := newDigestsTestRouter(t)
+
+	for _, tc := range []struct {
+		body  string
+		field string
+	}{
+		{`{"frequency":"hourly","hour":9,"timezone":"UTC","channels":["email"]}`, "frequency"},
+		{`{"frequency":"daily","day":1,"hour":9,"timezone":"UTC","channels":["email"]}`, "day"},
+		{`{"frequency":"weekly","hour":9,"timezone":"UTC","channels":["email"]}`, "day"},
+		{`{"frequency":"weekly","day":7,"hour":9,"timezone":"UTC","channels":["email"]}`, "day"},
+		{`{"frequency":"monthly","day":31,"hour":9,"timezone":"UTC","channels":["email"]}`, "day"},
+		{`{"frequency":"daily","timezone":"UTC","channels":["email"]}`, "hour"},
+		{`{"frequency":"daily","hour":24,"timezone":"UTC","channels":["email"]}`, "hour"},
+		{`{"frequency":"daily","hour":9,"timezone":"Mars/Olympus","channels":["email"]}`, "timezone"},
+		{`{"frequency":"daily","hour":9,"timezone":"UTC","channels":[]}`, "channels"},
+		{`{"frequency":"daily","hour":9,"timezone":"UTC","channels":["sms"]}`, "channels"},
+		{`{"frequency":"daily","hour":9,"timezone":"UTC","channels":["email","email"]}`, "channels"},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/digests/test-user", strings.NewReader(tc.body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", tc.body, recorder.Code, http.StatusBadRequest)
+			continue
+		}
+		var problem struct {
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := problem.Fields[tc.field]; !ok || len(problem.Fields) != 1 {
+			t.Errorf("unexpected fields for %s: %+v", tc.body, problem.Fields)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteDigestSchedule(t *testing.T) {
+	router, mock, observer := newDigestsTestRouter(t)
+	query := "DELETE FROM ONLY user_digest_schedules d USING users u WHERE d.user_id = u.id AND u.username = \\$1"
+	mock.ExpectExec(query).WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/digests/test-user", nil))
+
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+	}
+	if len(observer.mutations) != 1 || observer.mutations[0].EventType() != "digests.deleted" {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDueDigests(t *testing.T) {
+	router, mock, _ := newDigestsTestRouter(t)
+	at := time.Date(2024, 1, 2, 16, 30, 0, 0, time.UTC)
+	where := "FROM user_digest_schedules d JOIN users u ON d.user_id = u.id" +
+		" WHERE d.hour = extract\\(hour FROM \\$1::timestamptz AT TIME ZONE d.timezone\\)" +
+		" AND \\(d.frequency = 'daily'" +
+		" OR \\(d.frequency = 'weekly' AND d.day = extract\\(dow FROM \\$2::timestamptz AT TIME ZONE d.timezone\\)\\)" +
+		" OR \\(d.frequency = 'monthly' AND d.day = extract\\(day FROM \\$3::timestamptz AT TIME ZONE d.timezone\\)\\)\\)" +
+		" AND \\(d.last_sent_at IS NULL OR d.last_sent_at AT TIME ZONE d.timezone < date_trunc\\('hour', \\$4::timestamptz AT TIME ZONE d.timezone\\)\\)"
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) "+where).
+		WithArgs(at, at, at, at).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("SELECT u.username, d.frequency, d.day, d.hour, d.timezone, d.channels, d.last_sent_at, d.updated_at "+where+" ORDER BY u.username LIMIT \\$5 OFFSET \\$6").
+		WithArgs(at, at, at, at, 2, 0).
+		WillReturnRows(sqlmock.NewRows(digestScheduleColumns).
+			AddRow("a-user", "daily", nil, 9, "America/Phoenix", "{email}", nil, at).
+			AddRow("b-user", "weekly", 2, 9, "America/Phoenix", "{in_app}", nil, at))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/digests/due?at=2024-01-02T16:30:00Z&limit=2", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	var page struct {
+		Items []DigestSchedule `json:"items"`
+		Total int64            `json:"total"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Items) != 2 || page.Items[0].Day != nil || page.Items[1].Day == nil || *page.Items[1].Day != 2 {
+		t.Errorf("unexpected page: %s", recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDueDigestsBadTime(t *testing.T) {
+	router, _, _ := newDigestsTestRouter(t)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/digests/due?at=tomorrow", nil))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body.String())
+	}
+}
+
+func TestDigestsSent(t *testing.T) {
+	router, mock, observer := newDigestsTestRouter(t)
+	sentAt := time.Date(2024, 1, 2, 16, 30, 0, 0, time.UTC)
+	mock.ExpectExec("UPDATE ONLY user_digest_schedules d SET last_sent_at = \\$1 FROM users u WHERE d.user_id = u.id AND u.username = ANY\\(\\$2\\)").
+		WithArgs(sentAt, "{\"a-user\",\"b-user\"}").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	for _, tc := range []struct {
+		body     string
+		expected int
+	}{
+		{`{"usernames":["a-user","b-user"],"sent_at":"2024-01-02T16:30:00Z"}`, http.StatusOK},
+		{`{"usernames":[]}`, http.StatusBadRequest},
+		{`{"usernames":["a-user"],"sent_at":"yesterday"}`, http.StatusBadRequest},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/digests/sent", strings.NewReader(tc.body)))
+
+		if recorder.Code != tc.expected {
+			t.Errorf("status code for %s was %d instead of %d: %s", tc.body, recorder.Code, tc.expected, recorder.Body.String())
+			continue
+		}
+		if expected := `{"updated":1}`; tc.expected == http.StatusOK && strings.TrimSpace(recorder.Body.String()) != expected {
+			t.Errorf("response was %s instead of %s", recorder.Body.String(), expected)
+		}
+	}
+	if len(observer.mutations) != 0 {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Digests --------
+
+// -------- Start Locale --------
+
+// newLocaleTestRouter returns a router serving locales from the mock db, with
+// UTC and en-US as the defaults. The user test-user is cached as existing, and
+// the returned observer records the mutations.
+func newLocaleTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock, *recordingObserver) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	localeDB := NewLocaleDB(db, cache)
+	observer := &recordingObserver{}
+	localeDB.AddObserver(observer)
+
+	router := makeRouter()
+	NewLocaleApp(localeDB, "UTC", "en-US", router)
+	return router, mock, observer
+}
+
+func TestValidTimezone(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"UTC":             true,
+		"America/Phoenix": true,
+		"Europe/Berlin":   true,
+		"":                false,
+		"Local":           false,
+		"Mars/Olympus":    false,
+		"../etc/passwd":   false,
+	} {
+		if actual := validTimezone(name); actual != expected {
+			t.Errorf("validTimezone(%q) was %t instead of %t", name, actual, expected)
+		}
+	}
+}
+
+func TestCanonicalLocale(t *testing.T) {
+	for name, expected := range map[string]string{
+		"en-US":      "en-US",
+		"en_us":      "en-US",
+		"pt-br":      "pt-BR",
+		"zh-Hant-TW": "zh-Hant-TW",
+		"de":         "de",
+		"":           "",
+		"und":        "",
+		"english":    "",
+		"en-US!":     "",
+	} {
+		actual, ok := canonicalLocale(name)
+		if actual != expected || ok != (expected != "") {
+			t.Errorf("canonicalLocale(%q) was %q, %t instead of %q", name, actual, ok, expected)
+		}
+	}
+}
+
+func TestGetLocale(t *testing.T) {
+	router, mock, _ := newLocaleTestRouter(t)
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT u.username, l.timezone, l.locale, l.updated_at FROM user_locales l, users u WHERE l.user_id = u.id AND u.username = \\$1").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "timezone", "locale", "updated_at"}).AddRow("test-user", "America/Phoenix", "es-MX", updatedAt))
+
+	// The second request is served from the cache.
+	expected := `{"username":"test-user","timezone":"America/Phoenix","locale":"es-MX","updated_at":"2024-01-02T03:04:05Z"}`
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/locale/test-user", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+		}
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+			t.Errorf("response was %s instead of %s", actual, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetLocaleDefaults(t *testing.T) {
+	router, mock, _ := newLocaleTestRouter(t)
+	mock.ExpectQuery("SELECT u.username, l.timezone, l.locale, l.updated_at FROM user_locales l").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "timezone", "locale", "updated_at"}))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/locale/test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	expected := `{"username":"test-user","timezone":"UTC","locale":"en-US","updated_at":null}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Errorf("response was %s instead of %s", actual, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutLocale(t *testing.T) {
+	router, mock, observer := newLocaleTestRouter(t)
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	query := "INSERT INTO user_locales \\(user_id, timezone, locale\\) VALUES \\(\\$1, \\$2, \\$3\\) ON CONFLICT \\(user_id\\) DO UPDATE"
+	for _, created := range []bool{true, false} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectQuery(query).
+			WithArgs("user-1", "Europe/Berlin", "de-DE").
+			WillReturnRows(sqlmock.NewRows([]string{"created", "updated_at"}).AddRow(created, updatedAt))
+	}
+
+	body := `{"timezone":"Europe/Berlin","locale":"de_de"}`
+	for _, expected := range []int{http.StatusCreated, http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/locale/test-user", strings.NewReader(body)))
+
+		if recorder.Code != expected {
+			t.Errorf("status code was %d instead of %d: %s", recorder.Code, expected, recorder.Body.String())
+		}
+		response := `{"username":"test-user","timezone":"Europe/Berlin","locale":"de-DE","updated_at":"2024-01-02T03:04:05Z"}`
+		if actual := strings.TrimSpace(recorder.Body.String()); actual != response {
+			t.Errorf("response was %s instead of %s", actual, response)
+		}
+	}
+	if len(observer.mutations) != 2 || observer.mutations[0].EventType() != "locale.created" || observer.mutations[1].EventType() != "locale.updated" {
+		t.Errorf("unexpected mutations: %+v", observer.mutations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPutLocaleInvalid(t *testing.T) {
+	router, mock, _ := newLocaleTestRouter(t)
+
+	for _, tc := range []struct {
+		body   string
+		fields []string
+	}{
+		{`{"timezone":"Mars/Olympus","locale":"en-US"}`, []string{"timezone"}},
+		{`{"timezone":"Local","locale":"en-US"}`, []string{"timezone"}},
+		{`{"timezone":"UTC","locale":"english"}`, []string{"locale"}},
+		{`{}`, []string{"locale", "timezone"}},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/locale/test-user", strings.NewReader(tc.body)))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", tc.body, recorder.Code, http.StatusBadRequest)
+			continue
+		}
+		var problem struct {
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if len(problem.Fields) != len(tc.fields) {
+			t.Errorf("unexpected fields for %s: %+v", tc.body, problem.Fields)
+		}
+		for _, field := range tc.fields {
+			if _, ok := problem.Fields[field]; !ok {
+				t.Errorf("field %s wasn't reported for %s: %+v", field, tc.body, problem.Fields)
+			}
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Locale --------
+
+// -------- Start Webhooks --------
+
+type recordingObserver struct {
+	mutations []Mutation
+}
+
+func (o *recordingObserver) Observe(_ context.Context, m Mutation) {
+	o.mutations = append(o.mutations, m)
+}
+
+func TestMutationNotifier(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db, nil)
+	observer := &recordingObserver{}
+	p.AddObserver(observer)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectExec("INSERT INTO user_preferences").
+		WithArgs("1", "{}").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectQuery("SELECT preferences FROM ONLY user_preferences WHERE user_id =").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow(`{"a":1}`))
+	mock.ExpectExec("UPDATE ONLY user_preferences").
+		WithArgs("1", "{}").
+		WillReturnError(errors.New("update failed"))
+
+	if err = p.insertPreferences(context.Background(), "test-user", "{}"); err != nil {
+		t.Errorf("error inserting preferences: %s", err)
+	}
+	if err = p.updatePreferences(context.Background(), "test-user", "{}"); err == nil {
+		t.Error("expected the update to fail")
+	}
+
+	expected := []Mutation{{Module: "preferences", Action: actionCreated, Username: "test-user", After: &DocumentSummary{Bytes: 2}}}
+	if !reflect.DeepEqual(observer.mutations, expected) {
+		t.Errorf("mutations were %+v instead of %+v", observer.mutations, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestWebhookSubscriptionWants(t *testing.T) {
+	tests := []struct {
+		eventTypes []string
+		eventType  string
+		expected   bool
+	}{
+		{nil, "bags.created", true},
+		{[]string{"bags.created"}, "bags.created", true},
+		{[]string{"bags.created"}, "bags.deleted", false},
+		{[]string{"bags.*"}, "bags.deleted", true},
+		{[]string{"bags.*"}, "preferences.updated", false},
+		{[]string{"*"}, "sessions.deleted", true},
+	}
+
+	for _, test := range tests {
+		sub := WebhookSubscription{EventTypes: test.eventTypes}
+		if actual := sub.wants(test.eventType); actual != test.expected {
+			t.Errorf("wants(%q) with %v was %t instead of %t", test.eventType, test.eventTypes, actual, test.expected)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	received := make(chan *http.Request, 1)
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer server.Close()
+
+	mock.ExpectQuery("SELECT id, url, secret, event_types, created_at FROM webhook_subscriptions").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "secret", "event_types", "created_at"}).
+			AddRow("sub-1", server.URL, "s3cret", "{bags.*}", time.Now()).
+			AddRow("sub-2", server.URL, "other", "{preferences.updated}", time.Now()))
+
+	dispatcher := NewWebhookDispatcher(NewWebhooksDB(db), time.Second, 3, time.Millisecond, 10)
+	dispatcher.Observe(context.Background(), Mutation{Module: "bags", Action: actionCreated, Username: "test-user", BagID: "bag-1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+
+	var r *http.Request
+	select {
+	case r = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was not delivered")
+	}
+
+	if actual := r.Header.Get(webhookSignatureHeader); actual != webhookSignature("s3cret", body) {
+		t.Errorf("signature was %q instead of %q", actual, webhookSignature("s3cret", body))
+	}
+	if actual := r.Header.Get(webhookEventHeader); actual != "bags.created" {
+		t.Errorf("event header was %q instead of bags.created", actual)
+	}
+
+	var event WebhookEvent
+	if err = json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("error decoding the event: %s", err)
+	}
+	if event.Type != "bags.created" || event.Username != "test-user" || event.BagID != "bag-1" || event.ID != r.Header.Get(webhookIDHeader) {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	select {
+	case r = <-received:
+		t.Errorf("the event was delivered to a subscription that didn't want it: %s", r.Header.Get(webhookSignatureHeader))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		attempts++
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	mock.ExpectExec("INSERT INTO webhook_dead_letters").
+		WithArgs("sub-1", sqlmock.AnyArg(), "unexpected status 500 Internal Server Error", 3).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	dispatcher := NewWebhookDispatcher(NewWebhooksDB(db), time.Second, 3, time.Millisecond, 10)
+	sub := WebhookSubscription{ID: "sub-1", URL: server.URL, Secret: "s3cret"}
+	dispatcher.deliver(context.Background(), sub, WebhookEvent{ID: "event-1", Type: "sessions.deleted", Username: "test-user"})
+
+	if attempts != 3 {
+		t.Errorf("delivery was attempted %d times instead of 3", attempts)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAddWebhookSubscription(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewWebhooksApp(NewWebhooksDB(db), newAdminRouter(router, nil))
+
+	mock.ExpectQuery("INSERT INTO webhook_subscriptions").
+		WithArgs("https://example.org/hook", "s3cret", "{\"bags.*\"}").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow("sub-1", time.Now()))
+
+	body := `{"url":"https://example.org/hook","secret":"s3cret","event_types":["bags.*"]}`
+	request := httptest.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+	}
+
+	if strings.Contains(recorder.Body.String(), "s3cret") {
+		t.Errorf("the response included the secret: %s", recorder.Body.String())
+	}
+
+	var sub WebhookSubscription
+	if err = json.Unmarshal(recorder.Body.Bytes(), &sub); err != nil {
+		t.Fatalf("error decoding the response: %s", err)
+	}
+	if sub.ID != "sub-1" || sub.URL != "https://example.org/hook" || !reflect.DeepEqual(sub.EventTypes, []string{"bags.*"}) {
+		t.Errorf("unexpected subscription %+v", sub)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAddWebhookSubscriptionInvalid(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewWebhooksApp(NewWebhooksDB(db), newAdminRouter(router, nil))
+
+	bodies := []string{
+		`{"url":"ftp://example.org/hook","secret":"s3cret"}`,
+		`{"url":"/hook","secret":"s3cret"}`,
+		`{"url":"https://example.org/hook"}`,
+		`{"url":"https://example.org/hook","secret":"s3cret","event_types":[""]}`,
+	}
+
+	for _, body := range bodies {
+		request := httptest.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListWebhookDeadLetters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewWebhooksApp(NewWebhooksDB(db), newAdminRouter(router, nil))
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM webhook_dead_letters").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+	mock.ExpectQuery("SELECT id, subscription_id, event, error, attempts, created_at FROM webhook_dead_letters ORDER BY created_at DESC, id LIMIT \\$1 OFFSET \\$2").
+		WithArgs(5, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "subscription_id", "event", "error", "attempts", "created_at"}).
+			AddRow("dl-1", "sub-1", []byte(`{"id":"event-1"}`), "unexpected status 500 Internal Server Error", 5, time.Now()))
+
+	request := httptest.NewRequest(http.MethodGet, "/admin/webhooks/dead-letters?limit=5", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	var parsed struct {
+		Items []WebhookDeadLetter `json:"items"`
+		Total int64               `json:"total"`
+		Next  *string             `json:"next"`
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatalf("error decoding the response: %s", err)
+	}
+	if len(parsed.Items) != 1 || string(parsed.Items[0].Event) != `{"id":"event-1"}` {
+		t.Errorf("unexpected dead letters %+v", parsed.Items)
+	}
+	if parsed.Total != 7 || parsed.Next == nil || *parsed.Next != "/admin/webhooks/dead-letters?limit=5&offset=5" {
+		t.Errorf("unexpected total %d and next page %v", parsed.Total, parsed.Next)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/admin/webhooks/dead-letters?limit=0", nil)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAdminRouterRequiresAdminKey(t *testing.T) {
+	auth := NewAPIKeyAuth(map[string]string{"admin": "admin-key", "service": "service-key"}, false)
+	router := makeRouter(auth.Middleware)
+	newAdminRouter(router, []string{"admin"}).HandleFunc("/ping", func(writer http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		key      string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"service-key", http.StatusForbidden},
+		{"admin-key", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/admin/ping", nil)
+		if test.key != "" {
+			request.Header.Set("Authorization", "ApiKey "+test.key)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expected {
+			t.Errorf("status code with key %q was %d instead of %d", test.key, recorder.Code, test.expected)
+		}
+	}
+}
+
+// -------- End Webhooks --------
+
+// -------- Start Audit --------
+
+func TestSummarizeDocument(t *testing.T) {
+	if summary := summarizeDocument(""); summary != nil {
+		t.Errorf("summary of an empty document was %+v instead of nil", summary)
+	}
+
+	expected := &DocumentSummary{Bytes: 15, Keys: []string{"a", "b"}}
+	if summary := summarizeDocument(`{"b":1,"a":[2]}`); !reflect.DeepEqual(summary, expected) {
+		t.Errorf("summary was %+v instead of %+v", summary, expected)
+	}
+
+	expected = &DocumentSummary{Bytes: 5}
+	if summary := summarizeDocument(`[1,2]`); !reflect.DeepEqual(summary, expected) {
+		t.Errorf("summary was %+v instead of %+v", summary, expected)
+	}
+}
+
+func TestBagMutationSummaries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	b := NewBagsAPI(db, nil)
+	observer := &recordingObserver{}
+	b.AddObserver(observer)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectQuery("SELECT contents FROM ONLY bags WHERE id =").
+		WithArgs("bag-1", "1").
+		WillReturnRows(sqlmock.NewRows([]string{"contents"}).AddRow(`{"items":[]}`))
+	mock.ExpectExec("UPDATE ONLY bags SET contents").
+		WithArgs(`{"a":1}`, "bag-1", "1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = b.UpdateBag(context.Background(), "test-user", "bag-1", `{"a":1}`); err != nil {
+		t.Fatalf("error updating the bag: %s", err)
+	}
+
+	expected := []Mutation{{
+		Module:   "bags",
+		Action:   actionUpdated,
+		Username: "test-user",
+		BagID:    "bag-1",
+		Before:   &DocumentSummary{Bytes: 12, Keys: []string{"items"}},
+		After:    &DocumentSummary{Bytes: 7, Keys: []string{"a"}},
+	}}
+	if !reflect.DeepEqual(observer.mutations, expected) {
+		t.Errorf("mutations were %+v instead of %+v", observer.mutations, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAuditLogger(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(sqlmock.AnyArg(), "sessions", actionUpdated, "test-user", nil, "service", "support", "request-1", `{"bytes":2}`, `{"bytes":7,"keys":["a"]}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	logger := NewAuditLogger(NewAuditDB(db), 10)
+
+	ctx := context.WithValue(context.Background(), apiKeyNameKey{}, "service")
+	ctx = context.WithValue(ctx, requestIDKey{}, "request-1")
+	ctx = withImpersonator(ctx, "support")
+	logger.Observe(ctx, Mutation{
+		Module:   "sessions",
+		Action:   actionUpdated,
+		Username: "test-user",
+		Before:   &DocumentSummary{Bytes: 2},
+		After:    &DocumentSummary{Bytes: 7, Keys: []string{"a"}},
+	})
+
+	// The entry is written the way Run writes it, but on this goroutine,
+	// since the mock db can't be used from two at once.
+	select {
+	case entry := <-logger.queue:
+		if err = logger.audit.addEntry(context.Background(), &entry); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("the mutation wasn't queued")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestListAuditEntries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewAuditApp(NewAuditDB(db), newAdminRouter(router, nil))
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	created := since.Add(time.Hour)
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM audit_log WHERE username = \\$1 AND module = \\$2 AND created_at >= \\$3").
+		WithArgs("test-user", "bags", since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("SELECT id, created_at, module, action, username, bag_id, actor, impersonator, request_id, before, after FROM audit_log WHERE username = \\$1 AND module = \\$2 AND created_at >= \\$3 ORDER BY created_at DESC, id LIMIT \\$4 OFFSET \\$5").
+		WithArgs("test-user", "bags", since, 1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "module", "action", "username", "bag_id", "actor", "impersonator", "request_id", "before", "after"}).
+			AddRow("entry-1", created, "bags", actionDeleted, "test-user", "bag-1", "service", "support", nil, []byte(`{"bytes":2}`), nil))
+
+	request := httptest.NewRequest(http.MethodGet, "/admin/audit?username=test-user&module=bags&since=2024-01-02T03:04:05Z&limit=1&offset=2", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	if total := recorder.Header().Get("X-Total-Count"); total != "3" {
+		t.Errorf("X-Total-Count was %q instead of 3", total)
+	}
+
+	var parsed struct {
+		Items []AuditEntry `json:"items"`
+		Total int64        `json:"total"`
+		Next  *string      `json:"next"`
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatalf("error decoding the response: %s", err)
+	}
+
+	expected := []AuditEntry{{
+		ID:           "entry-1",
+		Time:         created,
+		Module:       "bags",
+		Action:       actionDeleted,
+		Username:     "test-user",
+		BagID:        "bag-1",
+		Actor:        "service",
+		Impersonator: "support",
+		Before:       &DocumentSummary{Bytes: 2},
+	}}
+	if parsed.Total != 3 || !reflect.DeepEqual(parsed.Items, expected) {
+		t.Errorf("response was %+v instead of %+v", parsed.Items, expected)
+	}
+	if parsed.Next != nil {
+		t.Errorf("the last page linked to %s", *parsed.Next)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestListAuditEntriesBadParams(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewAuditApp(NewAuditDB(db), newAdminRouter(router, nil))
+
+	for _, query := range []string{"since=yesterday", "until=2024-01-02", "limit=0", "limit=1001", "offset=-1"} {
+		request := httptest.NewRequest(http.MethodGet, "/admin/audit?"+query, nil)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", query, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// -------- End Audit --------
+
+// -------- Start Activity --------
+
+// newActivityTestRouter returns a router serving activity feeds from the mock
+// db. The user test-user is cached as existing.
+func newActivityTestRouter(t *testing.T) (*mux.Router, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	router := makeRouter()
+	NewActivityApp(NewAuditDB(db), NewUsersDB(db, cache), NewBagsApp(db, router, IplantSuffix, true, nil, nil), router)
+	return router, mock
+}
+
+func TestGetActivity(t *testing.T) {
+	router, mock := newActivityTestRouter(t)
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	created := since.Add(time.Hour)
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM audit_log WHERE username = ANY\\(\\$1\\) AND created_at >= \\$2").
+		WithArgs(sqlmock.AnyArg(), since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery("SELECT id, created_at, module, action, username, bag_id, actor, impersonator, request_id, before, after FROM audit_log WHERE username = ANY\\(\\$1\\) AND created_at >= \\$2 ORDER BY created_at DESC, id LIMIT \\$3 OFFSET \\$4").
+		WithArgs(sqlmock.AnyArg(), since, defaultActivityLimit, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "module", "action", "username", "bag_id", "actor", "impersonator", "request_id", "before", "after"}).
+			AddRow("entry-2", created, "bags", actionDeleted, "test-user"+IplantSuffix, "bag-1", "service", nil, "request-2", []byte(`{"bytes":12,"keys":["apps"]}`), nil).
+			AddRow("entry-1", since, "preferences", actionUpdated, "test-user", nil, "service", nil, "request-1", []byte(`{"bytes":2}`), []byte(`{"bytes":14,"keys":["theme"]}`)))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/activity/test-user?since=2024-01-02T03:04:05Z", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	var parsed struct {
+		Items []ActivityEntry `json:"items"`
+		Total int64           `json:"total"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatalf("error decoding the response: %s", err)
+	}
+
+	expected := []ActivityEntry{
+		{ID: "entry-2", Time: created, Module: "bags", Action: actionDeleted, BagID: "bag-1", Keys: []string{"apps"}},
+		{ID: "entry-1", Time: since, Module: "preferences", Action: actionUpdated, Keys: []string{"theme"}},
+	}
+	if parsed.Total != 2 || !reflect.DeepEqual(parsed.Items, expected) {
+		t.Errorf("response was %+v instead of %+v", parsed.Items, expected)
+	}
+	if strings.Contains(recorder.Body.String(), "request-") || strings.Contains(recorder.Body.String(), "service") {
+		t.Errorf("the response included administrative details: %s", recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetActivityByModule(t *testing.T) {
+	router, mock := newActivityTestRouter(t)
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM audit_log WHERE module = \\$1 AND username = ANY\\(\\$2\\)").
+		WithArgs("sessions", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT id, created_at, module, action, username, bag_id, actor, impersonator, request_id, before, after FROM audit_log WHERE module = \\$1 AND username = ANY\\(\\$2\\) ORDER BY created_at DESC, id LIMIT \\$3 OFFSET \\$4").
+		WithArgs("sessions", sqlmock.AnyArg(), 5, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "module", "action", "username", "bag_id", "actor", "impersonator", "request_id", "before", "after"}))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/activity/test-user?module=sessions&limit=5&offset=10", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), `"items":[]`) {
+		t.Errorf("an empty feed wasn't an empty list: %s", recorder.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetActivityBadParams(t *testing.T) {
+	router, _ := newActivityTestRouter(t)
+
+	for _, query := range []string{"since=yesterday", "until=2024-01-02", "limit=0", "limit=101", "offset=-1"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/activity/test-user?"+query, nil))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", query, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetActivityUnknownUser(t *testing.T) {
+	router, mock := newActivityTestRouter(t)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("other-user").
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(0))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/activity/other-user", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+// -------- End Activity --------
+
+// -------- Start Usage --------
+
+func TestUsageRecorderMiddleware(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	recorder := NewUsageRecorder(NewUsageDB(db))
+	recorder.now = func() time.Time { return time.Date(2024, 1, 2, 23, 59, 0, 0, time.UTC) }
+
+	router := makeRouter(recorder.Middleware)
+	router.HandleFunc("/things/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			httpapi.NotFound(writer, "no such thing")
+		}
+	})
+	router.HandleFunc("/things", func(http.ResponseWriter, *http.Request) {})
+	router.HandleFunc("/admin/things/{username}", func(http.ResponseWriter, *http.Request) {})
+
+	for _, path := range []string{"/things/test-user", "/things/test-user?fail=1", "/things/other-user", "/things", "/admin/things/test-user"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	expected := map[usageKey]*usageCount{
+		{username: "test-user", route: "GET /things/{username}", day: "2024-01-02"}:  {requests: 2, errors: 1},
+		{username: "other-user", route: "GET /things/{username}", day: "2024-01-02"}: {requests: 1},
+	}
+	if !reflect.DeepEqual(recorder.pending, expected) {
+		t.Errorf("pending counts were %v instead of %v", recorder.pending, expected)
+	}
+
+	mock.ExpectExec("INSERT INTO user_usage \\(username, route, day, requests, errors\\) SELECT .* FROM unnest\\(\\$1::text\\[\\], \\$2::text\\[\\], \\$3::date\\[\\], \\$4::bigint\\[\\], \\$5::bigint\\[\\]\\)").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err = recorder.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.pending) != 0 {
+		t.Errorf("%d counts were still pending after a flush", len(recorder.pending))
+	}
+
+	// Nothing is written when nothing is pending.
+	if err = recorder.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestUsageRecorderLimit(t *testing.T) {
+	recorder := NewUsageRecorder(nil)
+	recorder.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	for i := 0; i < maxPendingUsage; i++ {
+		recorder.pending[usageKey{username: fmt.Sprint(i), route: "GET /things/{username}", day: "2024-01-02"}] = &usageCount{requests: 1}
+	}
+
+	// Existing counts are still added to.
+	recorder.record("0", "GET /things/{username}", http.StatusOK)
+	recorder.record("test-user", "GET /things/{username}", http.StatusOK)
+
+	counted := recorder.pending[usageKey{username: "0", route: "GET /things/{username}", day: "2024-01-02"}]
+	if len(recorder.pending) != maxPendingUsage || recorder.dropped != 1 || counted.requests != 2 {
+		t.Errorf("%d counts were pending and %d requests were dropped", len(recorder.pending), recorder.dropped)
+	}
+}
+
+func TestUsageDays(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		query       string
+		first, last string
+	}{
+		{"", "2024-02-10", "2024-03-10"},
+		{"since=2024-03-01T23:00:00-02:00", "2024-03-02", "2024-03-10"},
+		{"since=2024-03-01T00:00:00Z&until=2024-03-03T00:00:00Z", "2024-03-01", "2024-03-02"},
+		{"until=2024-03-03T00:00:01Z", "2024-02-03", "2024-03-03"},
+	}
+
+	for _, test := range tests {
+		first, last, err := usageDays(httptest.NewRequest(http.MethodGet, "/admin/usage?"+test.query, nil), now)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.query, err)
+			continue
+		}
+		if first.Format(usageDayLayout) != test.first || last.Format(usageDayLayout) != test.last {
+			t.Errorf("days for %q were %s to %s instead of %s to %s", test.query, first.Format(usageDayLayout), last.Format(usageDayLayout), test.first, test.last)
+		}
+	}
+
+	for _, query := range []string{"since=yesterday", "since=2024-03-02T00:00:00Z&until=2024-03-02T00:00:00Z"} {
+		if _, _, err := usageDays(httptest.NewRequest(http.MethodGet, "/admin/usage?"+query, nil), now); err == nil {
+			t.Errorf("%q was accepted", query)
+		}
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsageApp(NewUsageDB(db), newAdminRouter(router, nil))
+
+	mock.ExpectQuery("SELECT route, SUM\\(requests\\) AS requests, SUM\\(errors\\) AS errors FROM user_usage WHERE day >= \\$1::date AND day <= \\$2::date AND username = \\$3 GROUP BY route ORDER BY requests DESC, route").
+		WithArgs("2024-01-01", "2024-01-02", "test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"route", "requests", "errors"}).
+			AddRow("GET /bags/{username}", 9, 1).
+			AddRow("PUT /preferences/{username}", 3, 0))
+	mock.ExpectQuery("SELECT day, SUM\\(requests\\), SUM\\(errors\\) FROM user_usage WHERE day >= \\$1::date AND day <= \\$2::date AND username = \\$3 GROUP BY day ORDER BY day").
+		WithArgs("2024-01-01", "2024-01-02", "test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"day", "sum", "sum"}).
+			AddRow(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 5, 0).
+			AddRow(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), 7, 1))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/usage/test-user?since=2024-01-01T00:00:00Z&until=2024-01-03T00:00:00Z", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	var usage UserUsage
+	if err = json.Unmarshal(recorder.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("error decoding the response: %s", err)
+	}
+	expected := UserUsage{
+		Username: "test-user",
+		First:    "2024-01-01",
+		Last:     "2024-01-02",
+		Requests: 12,
+		Errors:   1,
+		Routes: []RouteUsage{
+			{Route: "GET /bags/{username}", Requests: 9, Errors: 1},
+			{Route: "PUT /preferences/{username}", Requests: 3},
+		},
+		Days: []DayUsage{
+			{Day: "2024-01-01", Requests: 5},
+			{Day: "2024-01-02", Requests: 7, Errors: 1},
+		},
+	}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("usage was %+v instead of %+v", usage, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestTopConsumers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsageApp(NewUsageDB(db), newAdminRouter(router, nil))
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\(SELECT username, SUM\\(requests\\) AS requests, SUM\\(errors\\) AS errors FROM user_usage WHERE day >= \\$1::date AND day <= \\$2::date GROUP BY username\\) AS grouped").
+		WithArgs("2024-01-01", "2024-01-31").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("SELECT username, SUM\\(requests\\) AS requests, SUM\\(errors\\) AS errors FROM user_usage WHERE day >= \\$1::date AND day <= \\$2::date GROUP BY username ORDER BY requests DESC, username LIMIT \\$3 OFFSET \\$4").
+		WithArgs("2024-01-01", "2024-01-31", 2, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "requests", "errors"}).
+			AddRow("busy-user", 1000, 900).
+			AddRow("test-user", 12, 1))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/usage?since=2024-01-01T00:00:00Z&until=2024-02-01T00:00:00Z&limit=2", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	var parsed struct {
+		Items []ConsumerUsage `json:"items"`
+		Total int64           `json:"total"`
+		Next  *string         `json:"next"`
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatalf("error decoding the response: %s", err)
+	}
+	expected := []ConsumerUsage{{Username: "busy-user", Requests: 1000, Errors: 900}, {Username: "test-user", Requests: 12, Errors: 1}}
+	if parsed.Total != 3 || !reflect.DeepEqual(parsed.Items, expected) {
+		t.Errorf("response was %d %+v instead of 3 %+v", parsed.Total, parsed.Items, expected)
+	}
+	if parsed.Next == nil {
+		t.Error("the first page didn't link to the next")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestTopConsumersBadParams(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewUsageApp(NewUsageDB(db), newAdminRouter(router, nil))
+
+	for _, query := range []string{"since=yesterday", "until=2024-01-02", "limit=0", "limit=1001", "offset=-1"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/usage?"+query, nil))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", query, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPurgeUsage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM ONLY user_usage WHERE day < \\$1::date").
+		WithArgs("2024-01-02").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	purged, err := NewUsageDB(db).purge(context.Background(), time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 4 {
+		t.Errorf("%d rows were purged instead of 4", purged)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Usage --------
+
+// -------- Start Backups --------
+
+func TestBackupRequest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := makeRouter()
+	NewBackupApp(NewBackupDB(db, nil), newAdminRouter(router, nil))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM users t WHERE t.username = ANY\\(\\$1\\)").WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}).AddRow([]byte(`{"id":"1","username":"test-user"}`)))
+	for _, table := range userTables {
+		rows := sqlmock.NewRows([]string{"row_to_json"})
+		if table.name == "user_preferences" {
+			rows.AddRow([]byte(`{"id":"2","user_id":"1","preferences":"{}"}`))
+		}
+		mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM " + table.name + " t WHERE t.user_id IN").WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(rows)
+	}
+	mock.ExpectCommit()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/backup?username=test-user", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); !strings.Contains(disposition, "user-info-backup-") {
+		t.Errorf("Content-Disposition was %q", disposition)
+	}
+
+	expected := `{"users":[{"id":"1","username":"test-user"}],"user_preferences":[{"id":"2","user_id":"1","preferences":"{}"}],"user_sessions":[],"user_saved_searches":[],"default_bags":[],"bags":[],"user_avatars":[],"user_tours":[],"user_notification_prefs":[],"user_feedback":[],"user_pins":[],"user_tag_resources":[],"user_tags":[],"user_tokens":[],"user_webhooks":[],"user_dashboard_widgets":[],"user_consents":[],"user_identities":[],"user_digest_schedules":[],"user_locales":[]}`
+	if actual := recorder.Body.String(); actual != expected {
+		t.Errorf("backup was %s instead of %s", actual, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestBackupQuery(t *testing.T) {
+	if query := backupQuery("users", false); strings.Contains(query, "WHERE") {
+		t.Errorf("unfiltered query has a WHERE clause: %s", query)
+	}
+	if query := backupQuery("bags", true); !strings.Contains(query, "FROM bags t WHERE t.user_id IN") {
+		t.Errorf("unexpected filtered query: %s", query)
+	}
+}
+
+func TestRestoreRequest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := makeRouter()
+	NewBackupApp(NewBackupDB(db, nil), newAdminRouter(router, nil))
+
+	// The user already exists with another ID, so the restored rows are moved
+	// to it. Rows for users that aren't being restored are skipped.
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO users \\(id, username\\) VALUES").
+		WithArgs("1", "test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("9"))
+	for _, table := range userTables {
+		mock.ExpectExec("DELETE FROM " + table.name + " WHERE user_id = ANY").
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec("INSERT INTO bags SELECT \\* FROM json_populate_recordset\\(NULL::bags, \\$1\\)").
+		WithArgs(`[{"contents":{},"id":"b","user_id":"9"}]`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO default_bags SELECT \\* FROM json_populate_recordset\\(NULL::default_bags, \\$1\\)").
+		WithArgs(`[{"bag_id":"b","user_id":"9"}]`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body := `{
+		"users": [{"id": "1", "username": "test-user"}, {"id": "2", "username": "other-user"}],
+		"bags": [{"id": "b", "user_id": "1", "contents": {}}, {"id": "c", "user_id": "2", "contents": {}}],
+		"default_bags": [{"user_id": "1", "bag_id": "b"}]
+	}`
+	request := httptest.NewRequest(http.MethodPost, "/admin/restore?username=test-user", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+
+	var parsed struct {
+		Restored map[string]int64 `json:"restored"`
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"users": 1, "bags": 1, "default_bags": 1}
+	if !reflect.DeepEqual(parsed.Restored, expected) {
+		t.Errorf("restored %v instead of %v", parsed.Restored, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRestoreRequestInvalid(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := makeRouter()
+	NewBackupApp(NewBackupDB(db, nil), newAdminRouter(router, nil))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("1", "test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	for _, table := range userTables {
+		mock.ExpectExec("DELETE FROM " + table.name).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectRollback()
+
+	for _, body := range []string{
+		`[]`,
+		`{"users": {}}`,
+		`{"alerts": []}`,
+		`{"users": [{"username": "test-user"}]}`,
+		`{"users": [{"id": "1", "username": "test-user"}], "bags": [{"id": "b", "user_id": "2"}]}`,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/admin/restore", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Backups --------
+
+// -------- Start Problems --------
+
+func TestProblemIncludesRequestID(t *testing.T) {
+	router := makeRouter()
+	router.HandleFunc("/fail", func(writer http.ResponseWriter, r *http.Request) {
+		httpapi.BadRequest(writer, "bad input")
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/fail", nil)
+	request.Header.Set(httpapi.RequestIDHeader, "request-1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var actual httpapi.Problem
+	if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual.RequestID != "request-1" || actual.Code != httpapi.CodeBadRequest || actual.Detail != "bad input" {
+		t.Errorf("unexpected problem %+v", actual)
+	}
+}
+
+func TestUnknownRouteProblems(t *testing.T) {
+	router := makeRouter()
+	router.HandleFunc("/only-get", func(writer http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+
+	tests := []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodGet, "/missing", http.StatusNotFound, httpapi.CodeNotFound},
+		{http.MethodPost, "/only-get", http.StatusMethodNotAllowed, httpapi.CodeMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, nil))
+
+		if recorder.Code != test.status {
+			t.Errorf("status code for %s %s was %d instead of %d", test.method, test.path, recorder.Code, test.status)
+		}
+
+		var actual httpapi.Problem
+		if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+			t.Fatal(err)
+		}
+		if actual.Code != test.code {
+			t.Errorf("code for %s %s was %q instead of %q", test.method, test.path, actual.Code, test.code)
+		}
+	}
+}
+
+func TestBagImportRowErrorsProblem(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	httpapi.WriteProblem(recorder, http.StatusBadRequest, httpapi.CodeInvalidImportRows, "bag.csv has invalid rows", map[string]interface{}{
+		"errors": []ImportRowError{{Row: 2, Error: "missing path"}},
+	})
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["code"] != httpapi.CodeInvalidImportRows || parsed["detail"] != "bag.csv has invalid rows" || parsed["type"] != "about:blank" {
+		t.Errorf("unexpected problem %v", parsed)
+	}
+	if errs, ok := parsed["errors"].([]interface{}); !ok || len(errs) != 1 {
+		t.Errorf("errors were %v instead of one row error", parsed["errors"])
+	}
+}
+
+func TestNonObjectBodiesRejected(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	router := mux.NewRouter()
+	NewPrefsApp(mock, router)
+	NewSessionsApp(mock, router)
+	NewSearchesApp(mock, router)
+
+	for _, prefix := range []string{"/preferences/", "/sessions/", "/searches/"} {
+		for body, kind := range map[string]string{`"string"`: "string", `[1,2,3]`: "array", `null`: "null"} {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, prefix+"test-user", strings.NewReader(body)))
+
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("status code for %s to %s was %d", body, prefix, recorder.Code)
+			}
+
+			var parsed map[string]interface{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+				t.Fatal(err)
+			}
+			if parsed["code"] != httpapi.CodeBodyNotObject || parsed["received"] != kind {
+				t.Errorf("unexpected problem for %s to %s: %v", body, prefix, parsed)
+			}
+		}
+	}
+
+	if len(mock.storage) != 0 {
+		t.Errorf("rejected bodies were stored: %v", mock.storage)
+	}
+}
+
+// -------- End Problems --------
+
+// -------- Start Status Codes --------
+
+func TestIsConflict(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&pq.Error{Code: "23505"}, true},
+		{fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "23505"}), true},
+		{&pgconn.PgError{Code: "23P01"}, true},
+		{&pq.Error{Code: "23503"}, false},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		if actual := isConflict(test.err); actual != test.expected {
+			t.Errorf("isConflict(%v) was %t instead of %t", test.err, actual, test.expected)
+		}
+	}
+}
+
+func TestWriteFailed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeFailed(recorder, dbError(&pq.Error{Code: "23505", Constraint: "default_bags_pkey"}), "conflict")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code for a unique violation was %d instead of %d", recorder.Code, http.StatusConflict)
+	}
+
+	recorder = httptest.NewRecorder()
+	writeFailed(recorder, errors.New("connection refused"), "failed")
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status code for another error was %d instead of %d", recorder.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestSessionsNonUserNotFound(t *testing.T) {
+	router := mux.NewRouter()
+	NewSessionsApp(NewMockDB(), router)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		request := httptest.NewRequest(method, "/sessions/nobody", strings.NewReader(`{}`))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s status code was %d instead of %d", method, recorder.Code, http.StatusNotFound)
+		}
+
+		var problem httpapi.Problem
+		if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil || problem.Code != httpapi.CodeUserNotFound {
+			t.Errorf("%s returned %s instead of a %s problem", method, recorder.Body.String(), httpapi.CodeUserNotFound)
+		}
+	}
+}
+
+func TestPreferencesInvalidJSON(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+
+	router := mux.NewRouter()
+	NewPrefsApp(mock, router)
+
+	request := httptest.NewRequest(http.MethodPost, "/preferences/test-user", strings.NewReader(`{"one":`))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteMissingBag(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectPrepare("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id").ExpectQuery().
+		WithArgs("test-user@"+IplantSuffix, "bag-id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/bags/test-user/bag-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteAllBagsWithoutBags(t *testing.T) {
+	server, mock, cleanup := newDiffBagTestServer(t)
+	defer cleanup()
+
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM bags b, users u WHERE b.user_id = u.id AND u.username = \\$1").
+		WithArgs("test-user@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/bags/test-user", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestBagsNonUserNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	NewBagsApp(db, router, IplantSuffix, true, nil, nil)
+
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").ExpectQuery().
+		WithArgs("nobody@" + IplantSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(0))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/bags/nobody", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusNotFound)
+	}
+
+	var parsed map[string]interface{}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed["code"] != httpapi.CodeUserNotFound || parsed["user"] != "nobody" {
+		t.Errorf("unexpected problem %v", parsed)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Status Codes --------
+
+// -------- Start Idempotency --------
+
+// newIdempotentRouter returns a router with the idempotency middleware and a
+// handler that counts how many times it's called.
+func newIdempotentRouter(db *sql.DB, calls *int) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(NewIdempotency(NewIdempotencyDB(db), time.Hour).Middleware)
+	router.HandleFunc("/bags/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		*calls++
+		body, _ := io.ReadAll(r.Body)
+		writer.Header().Set(httpapi.RequestIDHeader, "request-1")
+		httpapi.WriteJSON(writer, http.StatusOK, map[string]string{"echo": string(body)})
+	}).Methods(http.MethodPut, http.MethodGet)
+	return router
+}
+
+func TestIdempotencyStoresResponse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO idempotency_keys").
+		WithArgs("key-1", "", http.MethodPut, "/bags/test-user", fingerprint([]byte(`{"a":1}`))).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE ONLY idempotency_keys").
+		WithArgs("key-1", "", http.StatusOK, `{"Content-Type":["application/json"]}`, []byte(`{"echo":"{\"a\":1}"}`+"\n")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	var calls int
+	router := newIdempotentRouter(db, &calls)
+
+	request := httptest.NewRequest(http.MethodPut, "/bags/test-user", strings.NewReader(`{"a":1}`))
+	request.Header.Set(idempotencyKeyHeader, "key-1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusOK)
+	}
+	if calls != 1 {
+		t.Errorf("handler was called %d times instead of once", calls)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"method", "path", "fingerprint", "status", "headers", "body", "created_at"}
+	row := []driver.Value{http.MethodPut, "/bags/test-user", fingerprint([]byte(`{"a":1}`)), http.StatusCreated, []byte(`{"Content-Type":["application/json"]}`), []byte(`{"id":"1"}`), time.Now()}
+
+	mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT method, path, fingerprint, status, headers, body, created_at").
+		WithArgs("key-1", "").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(row...))
+	mock.ExpectQuery("SELECT method, path, fingerprint, status, headers, body, created_at").
+		WithArgs("key-1", "").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(row...))
+
+	var calls int
+	router := newIdempotentRouter(db, &calls)
+
+	request := httptest.NewRequest(http.MethodPut, "/bags/test-user", strings.NewReader(`{"a":1}`))
+	request.Header.Set(idempotencyKeyHeader, "key-1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusCreated)
+	}
+	if recorder.Body.String() != `{"id":"1"}` {
+		t.Errorf("body was %q", recorder.Body.String())
+	}
+	if recorder.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Errorf("%s header was %q", idempotencyReplayedHeader, recorder.Header().Get(idempotencyReplayedHeader))
+	}
+	if calls != 0 {
+		t.Errorf("handler was called %d times for a replayed request", calls)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestIdempotencyRejectsReusedKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"method", "path", "fingerprint", "status", "headers", "body", "created_at"}
+	row := []driver.Value{http.MethodPut, "/bags/test-user", fingerprint([]byte(`{"a":1}`)), nil, nil, nil, time.Now()}
+
+	mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT method, path, fingerprint").WillReturnRows(sqlmock.NewRows(columns).AddRow(row...))
+	}
+
+	var calls int
+	router := newIdempotentRouter(db, &calls)
+
+	request := httptest.NewRequest(http.MethodPut, "/bags/test-user", strings.NewReader(`{"a":2}`))
+	request.Header.Set(idempotencyKeyHeader, "key-1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusUnprocessableEntity)
+	}
+	if !strings.Contains(recorder.Body.String(), httpapi.CodeIdempotencyKeyReused) {
+		t.Errorf("body didn't include the %s code: %s", httpapi.CodeIdempotencyKeyReused, recorder.Body.String())
+	}
+
+	// The same request is still being handled.
+	mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT method, path, fingerprint").WillReturnRows(sqlmock.NewRows(columns).AddRow(row...))
+	}
+
+	request = httptest.NewRequest(http.MethodPut, "/bags/test-user", strings.NewReader(`{"a":1}`))
+	request.Header.Set(idempotencyKeyHeader, "key-1")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusConflict)
+	}
+	if calls != 0 {
+		t.Errorf("handler was called %d times", calls)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestIdempotencyReleasesExpiredKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"method", "path", "fingerprint", "status", "headers", "body", "created_at"}
+
+	mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT method, path, fingerprint").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(http.MethodPost, "/other", "x", 200, nil, nil, time.Now().Add(-2*time.Hour)))
+	mock.ExpectExec("DELETE FROM ONLY idempotency_keys").WithArgs("key-1", "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE ONLY idempotency_keys").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	var calls int
+	router := newIdempotentRouter(db, &calls)
+
+	request := httptest.NewRequest(http.MethodPut, "/bags/test-user", strings.NewReader(`{}`))
+	request.Header.Set(idempotencyKeyHeader, "key-1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusOK)
+	}
+	if calls != 1 {
+		t.Errorf("handler was called %d times instead of once", calls)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestIdempotencyIgnoresOtherRequests(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var calls int
+	router := newIdempotentRouter(db, &calls)
+
+	// GET requests and requests without a key don't touch the database.
+	request := httptest.NewRequest(http.MethodGet, "/bags/test-user", nil)
+	request.Header.Set(idempotencyKeyHeader, "key-1")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/bags/test-user", strings.NewReader(`{}`)))
+
+	if calls != 2 {
+		t.Errorf("handler was called %d times instead of twice", calls)
+	}
+
+	request = httptest.NewRequest(http.MethodPut, "/bags/test-user", strings.NewReader(`{}`))
+	request.Header.Set(idempotencyKeyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestIdempotencySkipsTokenCreation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, userExistsKey("test-user"), true)
+
+	router := makeRouter()
+	router.Use(NewIdempotency(NewIdempotencyDB(db), time.Hour).Middleware)
+	NewTokensApp(NewTokensDB(db, cache), nil, 0, router)
+
+	// Nothing is recorded in idempotency_keys, so the secret isn't stored and
+	// a retry creates another token rather than replaying it.
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectQuery("INSERT INTO user_tokens").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(fmt.Sprintf("token-%d", i), time.Now()))
+	}
+
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodPost, "/tokens/test-user", strings.NewReader(`{"name":"ci","scopes":["read"]}`))
+		request.Header.Set(idempotencyKeyHeader, "key-1")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("status code was %d instead of %d: %s", recorder.Code, http.StatusCreated, recorder.Body.String())
+		}
+		if recorder.Header().Get(idempotencyReplayedHeader) != "" {
+			t.Error("the token creation was replayed")
+		}
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Idempotency --------
+
+// -------- Start Commands --------
+
+func TestPurgeUserCommand(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	username := "test-user@" + IplantSuffix
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_preferences WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_sessions WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_saved_searches WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM default_bags WHERE user_id =").WithArgs(username).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM bags WHERE user_id =").WithArgs(username).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM user_avatars WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tours WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_notification_prefs WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_feedback WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_pins WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tag_resources WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tags WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_tokens WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_webhooks WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_dashboard_widgets WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_consents WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_identities WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_digest_schedules WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_locales WHERE user_id =").WithArgs("test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_usage WHERE username = ANY").WithArgs(`{"test-user","` + username + `"}`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_changes WHERE username = ANY").WithArgs(`{"test-user","` + username + `"}`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	var stdout bytes.Buffer
+	if err = runPurgeUserCommand(context.Background(), NewUsersDB(db, nil), newUserDomains(IplantSuffix, nil), []string{"test-user"}, &stdout); err != nil {
+		t.Fatalf("error running purge-user: %s", err)
+	}
+
+	expected := `{"deleted":{"bags":2,"default_bags":0,"user_avatars":0,"user_changes":0,"user_consents":0,"user_dashboard_widgets":0,"user_digest_schedules":0,"user_feedback":0,"user_identities":0,"user_locales":0,"user_notification_prefs":0,"user_pins":0,"user_preferences":1,"user_saved_searches":0,"user_sessions":0,"user_tag_resources":0,"user_tags":0,"user_tokens":0,"user_tours":0,"user_usage":0,"user_webhooks":0},"user":"test-user"}`
+	if actual := strings.TrimSpace(stdout.String()); actual != expected {
+		t.Errorf("output was %s instead of %s", actual, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPurgeUserCommandErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	users := NewUsersDB(db, nil)
+
+	for _, args := range [][]string{{}, {"a", "b"}} {
+		if err = runPurgeUserCommand(context.Background(), users, newUserDomains(IplantSuffix, nil), args, io.Discard); err == nil {
+			t.Errorf("purge-user with %v didn't fail", args)
+		}
+	}
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	if err = runPurgeUserCommand(context.Background(), users, newUserDomains(IplantSuffix, nil), []string{"nobody"}, io.Discard); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("error for a nonexistent user was %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestExportUserCommand(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	expectExport(mock)
+
+	output := filepath.Join(t.TempDir(), "export.json")
+	args := []string{"-format", "json", "-output", output, "test-user"}
+	if err = runExportUserCommand(context.Background(), NewUsersDB(db, nil), newUserDomains(IplantSuffix, nil), args, io.Discard); err != nil {
+		t.Fatalf("error running export-user: %s", err)
+	}
+
+	contents, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"users":[{"id":"1","username":"test-user"}],"user_preferences":[{"preferences":"{}"}],"user_sessions":[],"user_saved_searches":[],"default_bags":[],"bags":[{"id":"a"},{"id":"b"}],"user_avatars":[],"user_tours":[],"user_notification_prefs":[],"user_feedback":[],"user_pins":[],"user_tag_resources":[],"user_tags":[],"user_tokens":[],"user_webhooks":[],"user_dashboard_widgets":[],"user_consents":[],"user_identities":[],"user_digest_schedules":[],"user_locales":[],"user_usage":[],"user_changes":[]}`
+	if string(contents) != expected {
+		t.Errorf("export was %s instead of %s", contents, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestExportUserCommandRemovesFailedOutput(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM users t").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"row_to_json"}).AddRow([]byte(`{"id":"1"}`)))
+	mock.ExpectQuery("SELECT row_to_json\\(t\\) FROM user_preferences t").WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	output := filepath.Join(t.TempDir(), "export.zip")
+	if err = runExportUserCommand(context.Background(), NewUsersDB(db, nil), newUserDomains(IplantSuffix, nil), []string{"-output", output, "test-user"}, io.Discard); err == nil {
+		t.Fatal("export-user didn't fail")
+	}
+
+	if _, err = os.Stat(output); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the output file was not removed: %v", err)
+	}
+
+	if err = runExportUserCommand(context.Background(), NewUsersDB(db, nil), newUserDomains(IplantSuffix, nil), []string{"-format", "xml", "test-user"}, io.Discard); err == nil {
+		t.Error("export-user with an unsupported format didn't fail")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPruneSessionsCommand(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	cache := newMemoryCache(time.Minute)
+	cacheSet(context.Background(), cache, hasSessionsKey("test-user"), true)
+
+	mock.ExpectQuery("DELETE FROM ONLY user_sessions s USING users u").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("test-user").AddRow("other-user"))
+
+	var stdout bytes.Buffer
+	if err = runPruneSessionsCommand(context.Background(), NewSessionsDB(db, cache), []string{"-older-than", "720h"}, &stdout); err != nil {
+		t.Fatalf("error running prune-sessions: %s", err)
+	}
+
+	if stdout.String() != "pruned 2 sessions\n" {
+		t.Errorf("output was %q", stdout.String())
+	}
+
+	if _, ok := cacheGet[bool](context.Background(), cache, hasSessionsKey("test-user")); ok {
+		t.Error("cached sessions were not invalidated")
+	}
+
+	for _, args := range [][]string{{}, {"-older-than", "-1h"}, {"-older-than", "1h", "extra"}} {
+		if err = runPruneSessionsCommand(context.Background(), NewSessionsDB(db, cache), args, io.Discard); err == nil {
+			t.Errorf("prune-sessions with %v didn't fail", args)
+		}
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// -------- End Commands --------
+
+// -------- Start Pprof --------
+
+func TestRegisterPprof(t *testing.T) {
+	router := makeRouter(NewAPIKeyAuth(map[string]string{"admin": "admin-key", "service": "service-key"}, false).Middleware)
+	registerPprof(newAdminRouter(router, []string{"admin"}))
+
+	get := func(path, key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			request.Header.Set("Authorization", apiKeyScheme+" "+key)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := get("/admin/debug/pprof/heap?debug=1", "admin-key")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusOK)
+	}
+	if !strings.Contains(recorder.Body.String(), "heap profile") {
+		t.Errorf("response wasn't a heap profile: %.100s", recorder.Body.String())
+	}
+
+	if recorder = get("/admin/debug/pprof/", "admin-key"); !strings.Contains(recorder.Body.String(), "goroutine") {
+		t.Errorf("index didn't list the goroutine profile: %.100s", recorder.Body.String())
+	}
+
+	if recorder = get("/admin/debug/pprof/heap", "service-key"); recorder.Code != http.StatusForbidden {
+		t.Errorf("status code for a non-admin key was %d instead of %d", recorder.Code, http.StatusForbidden)
+	}
+
+	if recorder = get("/admin/debug/pprof/heap", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("status code without a key was %d instead of %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+// -------- End Pprof --------
+
+// -------- Start Listeners --------
+
+func TestRestrictPublicListener(t *testing.T) {
+	router := makeRouter(restrictPublicListener)
+	ok := func(writer http.ResponseWriter, r *http.Request) {}
+	newAdminRouter(router, nil).HandleFunc("/webhooks", ok)
+	users := moduleRouter(router, "users", "/users")
+	users.HandleFunc("/{username}", ok).Methods(http.MethodDelete)
+	users.HandleFunc("/{username}/summary", ok).Methods(http.MethodGet)
+	users.HandleFunc("/{username}/deactivate", ok).Methods(http.MethodPost)
+
+	for _, tc := range []struct {
+		listener string
+		method   string
+		path     string
+		expected int
+	}{
+		{publicListener, http.MethodGet, "/users/test-user/summary", http.StatusOK},
+		{publicListener, http.MethodGet, "/", http.StatusOK},
+		{publicListener, http.MethodGet, "/admin/webhooks", http.StatusNotFound},
+		{publicListener, http.MethodGet, "/debug/vars", http.StatusNotFound},
+		{publicListener, http.MethodDelete, "/users/test-user", http.StatusNotFound},
+		{publicListener, http.MethodPost, "/users/test-user/deactivate", http.StatusNotFound},
+		{adminListener, http.MethodGet, "/admin/webhooks", http.StatusOK},
+		{adminListener, http.MethodGet, "/debug/vars", http.StatusOK},
+		{adminListener, http.MethodDelete, "/users/test-user", http.StatusOK},
+		{adminListener, http.MethodPost, "/users/test-user/deactivate", http.StatusOK},
+		{"", http.MethodGet, "/admin/webhooks", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		onListener(tc.listener, router).ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.path, nil))
+		if recorder.Code != tc.expected {
+			t.Errorf("status code for %s %s on the %q listener was %d instead of %d", tc.method, tc.path, tc.listener, recorder.Code, tc.expected)
+		}
+	}
+}
+
+// -------- End Listeners --------
+
+// -------- Start Usernames --------
+
+func TestUserDomainsQualify(t *testing.T) {
+	domains := newUserDomains("@"+IplantSuffix, []string{"example.org"})
+
+	tests := []struct {
+		username string
+		expected string
+		valid    bool
+	}{
+		{"test-user", "test-user@" + IplantSuffix, true},
+		{"test-user@" + IplantSuffix, "test-user@" + IplantSuffix, true},
+		{"test-user@example.org", "test-user@example.org", true},
+		{"test-user@example.com", "", false},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		actual, err := domains.qualify(test.username)
+		if actual != test.expected || (err == nil) != test.valid {
+			t.Errorf("%q was qualified as %q (error %v) instead of %q", test.username, actual, err, test.expected)
+		}
+	}
+}
+
+func TestUserDomainsBagsUsername(t *testing.T) {
+	domains := newUserDomains(IplantSuffix, []string{"example.org"})
+
+	tests := map[string]string{
+		"test-user":                 "test-user@" + IplantSuffix,
+		"test-user@example.org":     "test-user@example.org",
+		"test-user@example.com":     "test-user@" + IplantSuffix,
+		"test-user@" + IplantSuffix: "test-user@" + IplantSuffix,
+	}
+
+	for username, expected := range tests {
+		if actual := domains.bagsUsername(username); actual != expected {
+			t.Errorf("bags username for %s was %s instead of %s", username, actual, expected)
+		}
+	}
+}
+
+func TestUsernameNormalizerMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(NewUsernameNormalizer(IplantSuffix, []string{"example.org"}).Middleware)
+	router.HandleFunc("/things/{username}/{id}", func(writer http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		fmt.Fprintf(writer, "%s %s", v["username"], v["id"])
+	})
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/things/test-user/1", "test-user@" + IplantSuffix + " 1"},
+		{"/things/test-user@example.org/1", "test-user@example.org 1"},
+		{"/things/test-user/1?normalize_username=false", "test-user 1"},
+		{"/things/test-user@example.com/1?normalize_username=false", "test-user@example.com 1"},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if actual := recorder.Body.String(); actual != test.expected {
+			t.Errorf("%s: vars were %q instead of %q", test.path, actual, test.expected)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/things/test-user@example.com/1", nil))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), httpapi.CodeUnknownUserDomain) {
+		t.Errorf("response for an unknown domain was %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestUserDomainOverride(t *testing.T) {
+	normalizer := NewUsernameNormalizer(IplantSuffix, nil)
+	normalizer.AllowDomainOverride([]string{"gateway"})
+
+	router := mux.NewRouter()
+	router.Use(NewAPIKeyAuth(map[string]string{"gateway": "gateway-key", "other": "other-key"}, true).Middleware, normalizer.Middleware)
+	router.HandleFunc("/things/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		bags := newUserDomains(IplantSuffix, nil).forContext(r.Context())
+		fmt.Fprintf(writer, "%s %s", mux.Vars(r)["username"], bags.bagsUsername("test-user"))
+	})
+
+	tests := []struct {
+		key, domain string
+		status      int
+		expected    string
+	}{
+		{"gateway-key", "example.net", http.StatusOK, "test-user@example.net test-user@example.net"},
+		{"gateway-key", "", http.StatusOK, "test-user@" + IplantSuffix + " test-user@" + IplantSuffix},
+		{"gateway-key", "bad@example.net", http.StatusBadRequest, ""},
+		{"other-key", "example.net", http.StatusForbidden, ""},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/things/test-user", nil)
+		request.Header.Set("Authorization", apiKeyScheme+" "+test.key)
+		if test.domain != "" {
+			request.Header.Set(userDomainHeader, test.domain)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("status code for %s with %q was %d instead of %d", test.key, test.domain, recorder.Code, test.status)
+		}
+		if test.status == http.StatusOK && recorder.Body.String() != test.expected {
+			t.Errorf("usernames for %s with %q were %q instead of %q", test.key, test.domain, recorder.Body.String(), test.expected)
+		}
+	}
+}
+
+func TestUserDomainOverrideUnaryInterceptor(t *testing.T) {
+	normalizer := NewUsernameNormalizer(IplantSuffix, nil)
+	normalizer.AllowDomainOverride([]string{"gateway"})
+
+	var seen string
+	handler := func(_ context.Context, req interface{}) (interface{}, error) {
+		seen = req.(*userinfopb.UserRequest).GetUsername()
+		return nil, nil
+	}
+
+	md := metadata.Pairs(strings.ToLower(userDomainHeader), "example.net")
+	ctx := context.WithValue(metadata.NewIncomingContext(context.Background(), md), apiKeyNameKey{}, "gateway")
+	if _, err := normalizer.UnaryInterceptor(ctx, &userinfopb.UserRequest{Username: "test-user"}, &grpc.UnaryServerInfo{}, handler); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "test-user@example.net" {
+		t.Errorf("username was %s", seen)
+	}
+
+	ctx = context.WithValue(metadata.NewIncomingContext(context.Background(), md), apiKeyNameKey{}, "other")
+	_, err := normalizer.UnaryInterceptor(ctx, &userinfopb.UserRequest{Username: "test-user"}, &grpc.UnaryServerInfo{}, handler)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("error for an untrusted caller was %v", err)
+	}
+}
+
+func TestImpersonateUser(t *testing.T) {
+	normalizer := NewUsernameNormalizer(IplantSuffix, nil)
+	normalizer.AllowImpersonation([]string{"admin"})
+
+	router := mux.NewRouter()
+	router.Use(NewAPIKeyAuth(map[string]string{"admin": "admin-key", "other": "other-key"}, true).Middleware, normalizer.Middleware)
+	router.HandleFunc("/things/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(writer, "%s %s", mux.Vars(r)["username"], impersonator(r.Context()))
+	})
+
+	tests := []struct {
+		key, impersonate string
+		status           int
+		expected         string
+	}{
+		{"admin-key", "other-user", http.StatusOK, "other-user@" + IplantSuffix + " support@" + IplantSuffix},
+		{"admin-key", "", http.StatusOK, "support@" + IplantSuffix + " "},
+		{"admin-key", "other user", http.StatusBadRequest, ""},
+		{"admin-key", "other-user@example.com", http.StatusBadRequest, ""},
+		{"other-key", "other-user", http.StatusForbidden, ""},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/things/support", nil)
+		request.Header.Set("Authorization", apiKeyScheme+" "+test.key)
+		if test.impersonate != "" {
+			request.Header.Set(impersonateUserHeader, test.impersonate)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("status code for %s impersonating %q was %d instead of %d", test.key, test.impersonate, recorder.Code, test.status)
+		}
+		if test.status == http.StatusOK && recorder.Body.String() != test.expected {
+			t.Errorf("usernames for %s impersonating %q were %q instead of %q", test.key, test.impersonate, recorder.Body.String(), test.expected)
+		}
+	}
+}
+
+func TestImpersonateUserWithoutKeys(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(NewAPIKeyAuth(map[string]string{"admin": "admin-key"}, true).Middleware, NewUsernameNormalizer(IplantSuffix, nil).Middleware)
+	router.HandleFunc("/things/{username}", func(http.ResponseWriter, *http.Request) {
+		t.Error("the request was handled")
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/things/support", nil)
+	request.Header.Set("Authorization", apiKeyScheme+" admin-key")
+	request.Header.Set(impersonateUserHeader, "other-user")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusForbidden)
+	}
+}
+
+func TestImpersonateUserUnaryInterceptor(t *testing.T) {
+	normalizer := NewUsernameNormalizer(IplantSuffix, nil)
+	normalizer.AllowImpersonation([]string{"admin"})
+
+	var seen, seenImpersonator string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen, seenImpersonator = req.(*userinfopb.UserRequest).GetUsername(), impersonator(ctx)
+		return nil, nil
+	}
+
+	md := metadata.Pairs(strings.ToLower(impersonateUserHeader), "other-user")
+	ctx := context.WithValue(metadata.NewIncomingContext(context.Background(), md), apiKeyNameKey{}, "admin")
+	if _, err := normalizer.UnaryInterceptor(ctx, &userinfopb.UserRequest{Username: "support"}, &grpc.UnaryServerInfo{}, handler); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "other-user@"+IplantSuffix || seenImpersonator != "support@"+IplantSuffix {
+		t.Errorf("username was %s and impersonator was %s", seen, seenImpersonator)
+	}
+
+	ctx = context.WithValue(metadata.NewIncomingContext(context.Background(), md), apiKeyNameKey{}, "other")
+	_, err := normalizer.UnaryInterceptor(ctx, &userinfopb.UserRequest{Username: "support"}, &grpc.UnaryServerInfo{}, handler)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("error for an untrusted caller was %v", err)
+	}
+}
+
+func TestUsernameNormalizerUnaryInterceptor(t *testing.T) {
+	normalizer := NewUsernameNormalizer(IplantSuffix, nil)
+
+	var seen string
+	handler := func(_ context.Context, req interface{}) (interface{}, error) {
+		seen = req.(*userinfopb.UserRequest).GetUsername()
+		return nil, nil
+	}
+
+	if _, err := normalizer.UnaryInterceptor(context.Background(), &userinfopb.UserRequest{Username: "test-user"}, &grpc.UnaryServerInfo{}, handler); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "test-user@"+IplantSuffix {
+		t.Errorf("username was %s instead of test-user@%s", seen, IplantSuffix)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(normalizeUsernameParam, "false"))
+	if _, err := normalizer.UnaryInterceptor(ctx, &userinfopb.UserRequest{Username: "test-user"}, &grpc.UnaryServerInfo{}, handler); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "test-user" {
+		t.Errorf("username was normalized to %s when normalization was turned off", seen)
+	}
+
+	_, err := normalizer.UnaryInterceptor(context.Background(), &userinfopb.UserRequest{Username: "test-user@example.com"}, &grpc.UnaryServerInfo{}, handler)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("error for an unknown domain was %v", err)
+	}
+}
+
+// -------- End Usernames --------
+
+// -------- Start Metrics --------
+
+func TestRouteMetrics(t *testing.T) {
+	metrics := NewRouteMetrics()
+	router := mux.NewRouter()
+	router.Use(metrics.Middleware)
+	router.HandleFunc("/things/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["username"] == "nobody" {
+			httpapi.NotFound(writer, "no such user")
+		}
+	}).Methods(http.MethodGet)
+
+	for _, path := range []string{"/things/a", "/things/b", "/things/nobody"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	var parsed map[string]struct {
+		Requests     int64            `json:"requests"`
+		InFlight     int64            `json:"in_flight"`
+		Status       map[string]int64 `json:"status"`
+		Latency      map[string]int64 `json:"latency_ms"`
+		LatencySumMS float64          `json:"latency_ms_sum"`
+	}
+	if err := json.Unmarshal([]byte(metrics.vars.String()), &parsed); err != nil {
+		t.Fatalf("error parsing %s: %s", metrics.vars.String(), err)
+	}
+
+	stats, ok := parsed["GET /things/{username}"]
+	if !ok {
+		t.Fatalf("the route wasn't in the metrics: %s", metrics.vars.String())
+	}
+	if stats.Requests != 3 || stats.InFlight != 0 {
+		t.Errorf("requests were %d with %d in flight", stats.Requests, stats.InFlight)
+	}
+	if stats.Status["2xx"] != 2 || stats.Status["4xx"] != 1 {
+		t.Errorf("statuses were %v", stats.Status)
+	}
+	if stats.Latency["le_inf"] != 3 || stats.Latency["le_10000"] != 3 {
+		t.Errorf("latency histogram was %v", stats.Latency)
+	}
+}
+
+// -------- End Metrics --------
+
+// -------- Start Retries --------
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true},
+		{"connection failure", &pq.Error{Code: "08006"}, true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"bad connection", fmt.Errorf("querying: %w", driver.ErrBadConn), true},
+		{"no rows", sql.ErrNoRows, false},
+	}
+
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("%s: isTransient returned %t, expected %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// withDBRetrier replaces dbRetrier for the duration of a test.
+func withDBRetrier(t *testing.T, r *DBRetrier) {
+	saved := dbRetrier
+	dbRetrier = r
+	t.Cleanup(func() { dbRetrier = saved })
+}
+
+func TestRetryingDBRetriesTransientErrors(t *testing.T) {
+	withDBRetrier(t, NewDBRetrier(3, 0, 0, 0.1, 10))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM user_sessions").WillReturnError(&pq.Error{Code: "40001"})
+	mock.ExpectExec("DELETE FROM user_sessions").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err = withRetries(db).ExecContext(context.Background(), "DELETE FROM user_sessions"); err != nil {
+		t.Errorf("error running the statement: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRetryingDBDoesNotRetryOtherErrors(t *testing.T) {
+	withDBRetrier(t, NewDBRetrier(3, 0, 0, 0.1, 10))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO users").WillReturnError(&pq.Error{Code: "23505"})
+
+	_, err = withRetries(db).ExecContext(context.Background(), "INSERT INTO users")
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		t.Errorf("expected the unique violation, got %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRetryingDBGivesUpAfterAttempts(t *testing.T) {
+	withDBRetrier(t, NewDBRetrier(2, 0, 0, 0.1, 10))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT 1").WillReturnError(&pq.Error{Code: "40P01"})
+	mock.ExpectQuery("SELECT 1").WillReturnError(&pq.Error{Code: "40P01"})
+
+	var n int
+	if err = withRetries(db).QueryRowContext(context.Background(), "SELECT 1").Scan(&n); !isTransient(err) {
+		t.Errorf("expected the deadlock error, got %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	withDBRetrier(t, NewDBRetrier(3, 0, 0, 0, 1))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	// The budget allows a single retry, so the second statement fails without
+	// being retried.
+	mock.ExpectExec("UPDATE users").WillReturnError(&pq.Error{Code: "40001"})
+	mock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users").WillReturnError(&pq.Error{Code: "40001"})
+
+	rdb := withRetries(db)
+	if _, err = rdb.ExecContext(context.Background(), "UPDATE users"); err != nil {
+		t.Errorf("error running the first statement: %s", err)
+	}
+	if _, err = rdb.ExecContext(context.Background(), "UPDATE users"); !isTransient(err) {
+		t.Errorf("expected the serialization failure, got %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDBRetrierFromConfig(t *testing.T) {
+	cfg := viper.New()
+	setConfigDefaults(cfg)
+
+	r, err := dbRetrierFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("error creating the retrier: %s", err)
+	}
+	if r.attempts != 3 || r.backoff != 25*time.Millisecond || r.maxBackoff != time.Second {
+		t.Errorf("unexpected retrier settings: %+v", r)
+	}
+
+	cfg.Set("db.retry.backoff", "soon")
+	if _, err = dbRetrierFromConfig(cfg); err == nil {
+		t.Error("expected an error for an invalid backoff")
+	}
+}
+
+// -------- End Retries --------
+
+// -------- Start Circuit Breaker --------
+
+// withDBBreaker replaces dbBreaker for the duration of a test.
+func withDBBreaker(t *testing.T, b *CircuitBreaker) {
+	saved := dbBreaker
+	dbBreaker = b
+	t.Cleanup(func() { dbBreaker = saved })
+}
+
+func TestCircuitBreakerOpensAfterFailures(t *testing.T) {
+	b := NewCircuitBreaker(2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("call %d was rejected: %s", i, err)
+		}
+		b.record(&pq.Error{Code: "57P03"})
+	}
+
+	var openErr circuitOpenError
+	if err := b.allow(); !errors.As(err, &openErr) {
+		t.Fatalf("expected a circuitOpenError, got %v", err)
+	}
+	if openErr.retryAfter <= 0 || openErr.retryAfter > time.Minute {
+		t.Errorf("unexpected retry after: %s", openErr.retryAfter)
+	}
+	if b.trips.Value() != 1 || b.rejected.Value() != 1 {
+		t.Errorf("unexpected counters: trips %d, rejected %d", b.trips.Value(), b.rejected.Value())
+	}
+}
+
+func TestCircuitBreakerIgnoresOtherErrors(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Minute)
+
+	for _, err := range []error{sql.ErrNoRows, &pq.Error{Code: "23505"}, context.Canceled} {
+		if err := b.allow(); err != nil {
+			t.Fatalf("call was rejected: %s", err)
+		}
+		b.record(err)
+	}
+
+	if b.state != breakerClosed {
+		t.Errorf("expected the breaker to be closed, got %s", b.state)
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Minute)
+	b.allow() // nolint:errcheck
+	b.record(driver.ErrBadConn)
+
+	// Pretend the cooldown has passed.
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+
+	if err := b.allow(); err != nil {
+		t.Fatalf("the probe was rejected: %s", err)
+	}
+	if err := b.allow(); err == nil {
+		t.Error("a second call was allowed during the probe")
+	}
+
+	b.record(driver.ErrBadConn)
+	if b.state != breakerOpen {
+		t.Fatalf("expected the breaker to open again, got %s", b.state)
+	}
+
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("the probe was rejected: %s", err)
+	}
+	b.record(nil)
+	if b.state != breakerClosed {
+		t.Errorf("expected the breaker to close, got %s", b.state)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := NewCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("call %d was rejected: %s", i, err)
+		}
+		b.record(driver.ErrBadConn)
+	}
+}
+
+func TestCircuitBreakerRejectsQueries(t *testing.T) {
+	withDBRetrier(t, NewDBRetrier(1, 0, 0, 0.1, 10))
+	withDBBreaker(t, NewCircuitBreaker(1, time.Minute))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT 1").WillReturnError(&pq.Error{Code: "08006"})
+
+	rdb := withRetries(db)
+	var n int
+	if err = rdb.QueryRowContext(context.Background(), "SELECT 1").Scan(&n); !isTransient(err) {
+		t.Errorf("expected a connection failure, got %v", err)
+	}
+
+	// The breaker is open, so neither query reaches the database.
+	if err = rdb.QueryRowContext(context.Background(), "SELECT 1").Scan(&n); err == nil {
+		t.Error("expected an error from the rejected query")
+	}
+	if _, err = rdb.ExecContext(context.Background(), "SELECT 1"); !errors.As(err, &circuitOpenError{}) {
+		t.Errorf("expected a circuitOpenError, got %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	b := NewCircuitBreaker(1, 30*time.Second)
+
+	router := makeRouter(b.Middleware)
+	router.HandleFunc("/users/{username}", func(writer http.ResponseWriter, r *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/users/test", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("status code was %d, expected %d", recorder.Code, http.StatusNoContent)
+	}
+
+	b.allow() // nolint:errcheck
+	b.record(&pq.Error{Code: "08006"})
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code was %d, expected %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After was %q, expected 30", got)
+	}
+
+	var problem httpapi.Problem
+	if err := json.NewDecoder(recorder.Body).Decode(&problem); err != nil {
+		t.Fatalf("error decoding the response: %s", err)
+	}
+	if problem.Code != httpapi.CodeUnavailable {
+		t.Errorf("code was %s, expected %s", problem.Code, httpapi.CodeUnavailable)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status code for / was %d, expected %d", recorder.Code, http.StatusOK)
+	}
+}
+
+// -------- End Circuit Breaker --------
+
+// -------- Start Timeouts --------
+
+func TestQueryTimeoutMiddleware(t *testing.T) {
+	q := NewQueryTimeout(time.Minute)
+
+	var deadline time.Time
+	var ok bool
+	handler := q.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		deadline, ok = r.Context().Deadline()
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !ok {
+		t.Fatal("the request had no deadline")
+	}
+	if remaining := time.Until(deadline); remaining <= 0 || remaining > time.Minute {
+		t.Errorf("unexpected time remaining: %s", remaining)
+	}
+
+	// An earlier deadline is kept.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if remaining := time.Until(deadline); remaining > time.Second {
+		t.Errorf("the earlier deadline wasn't kept: %s remaining", remaining)
+	}
+
+	q.SetTimeout(0)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if ok {
+		t.Error("the request had a deadline with the timeout disabled")
+	}
+}
+
+func TestQueryTimeoutCancelsQueries(t *testing.T) {
+	withDBRetrier(t, NewDBRetrier(1, 0, 0, 0.1, 10))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE users").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var execErr error
+	handler := NewQueryTimeout(10 * time.Millisecond).Middleware(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		_, execErr = withRetries(db).ExecContext(r.Context(), "UPDATE users")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+	if execErr == nil {
+		t.Error("expected the statement to be canceled")
+	}
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	tests := []struct {
+		uri      string
+		timeout  time.Duration
+		expected string
+	}{
+		{"postgres://de@localhost/de?sslmode=disable", 0, "postgres://de@localhost/de?sslmode=disable"},
+		{"postgres://de@localhost/de?sslmode=disable", 15 * time.Second, "postgres://de@localhost/de?sslmode=disable&statement_timeout=15000"},
+		{"host=localhost dbname=de", 500 * time.Millisecond, "host=localhost dbname=de statement_timeout=500"},
+	}
+
+	for _, tt := range tests {
+		actual, err := withStatementTimeout(tt.uri, tt.timeout)
+		if err != nil {
+			t.Errorf("error adding the statement timeout to %s: %s", tt.uri, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("URI was %s, expected %s", actual, tt.expected)
+		}
+	}
+}
+
+// -------- End Timeouts --------
+
+// -------- Start Jobs --------
+
+func TestSchedulerRunsJobsWhileLeader(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(42).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewScheduler(db, 42, time.Hour)
+	var runs int
+	var leader bool
+	s.Add("test", time.Millisecond, func(ctx context.Context) (int64, error) {
+		runs++
+		leader = s.IsLeader()
+		if runs == 2 {
+			cancel()
+		}
+		return 3, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scheduler didn't stop")
+	}
+
+	if runs != 2 {
+		t.Errorf("the job ran %d times", runs)
+	}
+	if !leader {
+		t.Error("the scheduler wasn't the leader while the job ran")
+	}
+	if s.IsLeader() {
+		t.Error("the scheduler was still the leader after it stopped")
+	}
+	if s.elections.Value() != 1 {
+		t.Errorf("the scheduler won %d elections", s.elections.Value())
+	}
+	if processed := s.jobs[0].processed.Value(); processed != 6 {
+		t.Errorf("the job processed %d rows", processed)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestSchedulerFollowerDoesNotRunJobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	s := NewScheduler(db, 42, time.Hour)
+	var runs int
+	s.Add("test", time.Millisecond, func(ctx context.Context) (int64, error) {
+		runs++
+		return 0, nil
+	})
+	s.Run(ctx)
+
+	if runs != 0 {
+		t.Errorf("the job ran %d times on a follower", runs)
+	}
+	if s.IsLeader() {
+		t.Error("the scheduler became the leader without the lock")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestScheduledJobMetrics(t *testing.T) {
+	s := NewScheduler(nil, 42, time.Hour)
+	s.Add("failing", time.Hour, func(ctx context.Context) (int64, error) {
+		return 0, errors.New("failed")
+	})
+
+	j := s.jobs[0]
+	j.runOnce(context.Background())
+	j.runOnce(context.Background())
+
+	if j.runs.Value() != 2 || j.failures.Value() != 2 || j.processed.Value() != 0 {
+		t.Errorf("unexpected metrics %s", s.vars.String())
+	}
+	if j.lastRun.Value() == "" {
+		t.Error("the time of the last run wasn't recorded")
+	}
+}
+
+// -------- End Jobs --------
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in milliseconds, of the latency
+// histogram buckets. Like Prometheus histograms, the buckets are cumulative,
+// and le_inf counts every request.
+var latencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// routeStats are the expvar metrics for a single route.
+type routeStats struct {
+	requests  *expvar.Int
+	inFlight  *expvar.Int
+	statuses  *expvar.Map
+	latency   *expvar.Map
+	latencyMS *expvar.Float
+}
+
+// newRouteStats returns the stats for a route, published in vars as
+//
+//	{"requests": n, "in_flight": n, "status": {"2xx": n, ...},
+//	 "latency_ms": {"le_5": n, ..., "le_inf": n}, "latency_ms_sum": n}
+func newRouteStats(vars *expvar.Map) *routeStats {
+	s := &routeStats{
+		requests:  new(expvar.Int),
+		inFlight:  new(expvar.Int),
+		statuses:  new(expvar.Map).Init(),
+		latency:   new(expvar.Map).Init(),
+		latencyMS: new(expvar.Float),
+	}
+
+	for _, bound := range latencyBuckets {
+		s.latency.Set(bucketName(bound), new(expvar.Int))
+	}
+	s.latency.Set("le_inf", new(expvar.Int))
+
+	vars.Set("requests", s.requests)
+	vars.Set("in_flight", s.inFlight)
+	vars.Set("status", s.statuses)
+	vars.Set("latency_ms", s.latency)
+	vars.Set("latency_ms_sum", s.latencyMS)
+	return s
+}
+
+// bucketName returns the name of the latency bucket with the upper bound.
+func bucketName(bound float64) string {
+	return "le_" + strconv.FormatFloat(bound, 'f', -1, 64)
+}
+
+// observe records a request that finished with the status after the elapsed
+// time.
+func (s *routeStats) observe(status int, elapsed time.Duration) {
+	s.statuses.Add(fmt.Sprintf("%dxx", status/100), 1)
+
+	ms := float64(elapsed) / float64(time.Millisecond)
+	s.latencyMS.Add(ms)
+	for _, bound := range latencyBuckets {
+		if ms <= bound {
+			s.latency.Add(bucketName(bound), 1)
+		}
+	}
+	s.latency.Add("le_inf", 1)
+}
+
+// RouteMetrics counts the requests to each route and how long they take,
+// keyed by the method and path template, e.g. "GET /bags/{username}".
+type RouteMetrics struct {
+	vars   *expvar.Map
+	mu     sync.Mutex
+	routes map[string]*routeStats
+}
+
+// NewRouteMetrics returns a new *RouteMetrics. The metrics aren't visible in
+// /debug/vars until they're published.
+func NewRouteMetrics() *RouteMetrics {
+	return &RouteMetrics{
+		vars:   new(expvar.Map).Init(),
+		routes: make(map[string]*routeStats),
+	}
+}
+
+// Publish adds the metrics to the expvar variables under the name. It panics
+// if the name is already in use, like expvar.Publish.
+func (m *RouteMetrics) Publish(name string) {
+	expvar.Publish(name, m.vars)
+}
+
+// route returns the stats for the route, creating them if necessary.
+func (m *RouteMetrics) route(key string) *routeStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.routes[key]
+	if !ok {
+		vars := new(expvar.Map).Init()
+		s = newRouteStats(vars)
+		m.routes[key] = s
+		m.vars.Set(key, vars)
+	}
+	return s
+}
+
+// routeKey returns the key that the request's route is counted under.
+func routeKey(r *http.Request) string {
+	return r.Method + " " + requestRoute(r)
+}
+
+// Middleware records the metrics for each request.
+func (m *RouteMetrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		s := m.route(routeKey(r))
+		s.requests.Add(1)
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		s.observe(recorder.status, time.Since(start))
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+type requestIDKey struct{}
+
+type logFieldsKey struct{}
+
+// requestID returns the ID assigned to the request that the context belongs to,
+// or an empty string if there isn't one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// setLogField adds a field to the summary that requestLogger logs for the
+// request. It does nothing if the request isn't going through requestLogger.
+func setLogField(ctx context.Context, key string, value interface{}) {
+	if fields, ok := ctx.Value(logFieldsKey{}).(log.Fields); ok {
+		fields[key] = value
+	}
+}
+
+// statusRecorder wraps an http.ResponseWriter to remember the status code that
+// was sent to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before sending it.
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 status if no status was sent yet.
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through so that streamed responses still work.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// BodySizeLimit limits the size of request bodies. Reading past the limit fails
+// with an *http.MaxBytesError. A non-positive limit disables the check.
+type BodySizeLimit struct {
+	limit atomic.Int64
+}
+
+// NewBodySizeLimit returns a new *BodySizeLimit for the given number of bytes.
+func NewBodySizeLimit(limit int64) *BodySizeLimit {
+	b := &BodySizeLimit{}
+	b.limit.Store(limit)
+	return b
+}
+
+// SetLimit changes the maximum number of bytes allowed in request bodies.
+func (b *BodySizeLimit) SetLimit(limit int64) {
+	b.limit.Store(limit)
+}
+
+// Middleware wraps request bodies in an http.MaxBytesReader.
+func (b *BodySizeLimit) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if limit := b.limit.Load(); limit > 0 {
+			r.Body = http.MaxBytesReader(writer, r.Body, limit)
+		}
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// requireContentType is middleware that responds with a 415 to POST, PUT, and
+// PATCH requests whose Content-Type doesn't match the media type of the request
+// body documented for the route in apiOperations, e.g. form-encoded bodies
+// sent to routes that store JSON. Routes without a documented request body are
+// left alone.
+func requireContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		expected := apiOperations[routeKey(r)].RequestBody
+		if expected == "" {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != expected {
+			msg := fmt.Sprintf("%s %s requires a Content-Type of %s, not %q", r.Method, r.URL.Path, expected, contentType)
+			httpapi.WriteProblem(writer, http.StatusUnsupportedMediaType, httpapi.CodeUnsupportedMediaType, msg, map[string]interface{}{
+				"expected": expected,
+			})
+			log.WithContext(r.Context()).Error(msg)
+			return
+		}
+
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// requestRoute returns the path template of the route that matched the request,
+// or its path if no route matched.
+func requestRoute(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return pathVarRE.ReplaceAllString(tmpl, "{$1}")
+		}
+	}
+	return r.URL.Path
+}
+
+// requestLogger is middleware that assigns each request an ID, or reuses the
+// one in the X-Request-ID header, returns it in the response, and logs a
+// summary of the request once it has been handled. The summary includes the
+// route, the module that handled the request, and the username.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(httpapi.RequestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		writer.Header().Set(httpapi.RequestIDHeader, id)
+
+		// The fields that identify the request are set up front, so that
+		// entries logged with the request's context can include them.
+		fields := log.Fields{
+			"request_id": id,
+			"route":      requestRoute(r),
+			"username":   mux.Vars(r)["username"],
+		}
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, logFieldsKey{}, fields)
+
+		recorder := &statusRecorder{ResponseWriter: writer}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		fields["method"] = r.Method
+		fields["path"] = r.URL.Path
+		fields["status"] = recorder.status
+		fields["latency"] = time.Since(start).String()
+
+		log.WithContext(ctx).WithFields(fields).Info("handled request")
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationFiles contains the SQL migrations for the service's schema.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// newMigrator returns a *migrate.Migrate that applies the embedded migrations
+// to the database.
+func newMigrator(db *sql.DB) (*migrate.Migrate, error) {
+	source, err := iofs.New(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading the embedded migrations: %w", err)
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the migration driver: %w", err)
+	}
+
+	return migrate.NewWithInstance("iofs", source, "postgres", driver)
+}
+
+// migrateUp applies any migrations that haven't been applied to the database.
+func migrateUp(db *sql.DB) error {
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("error applying migrations: %w", err)
+	}
+
+	version, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+	log.Infof("database schema is at version %d (dirty: %t)", version, dirty)
+
+	return nil
+}
+
+// runMigrateCommand runs the migrate subcommand. With no arguments, or "up",
+// it applies all pending migrations. "down" rolls back the most recent one and
+// "version" reports the current schema version.
+func runMigrateCommand(db *sql.DB, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		return migrateUp(db)
+
+	case "down":
+		m, err := newMigrator(db)
+		if err != nil {
+			return err
+		}
+		return m.Steps(-1)
+
+	case "version":
+		m, err := newMigrator(db)
+		if err != nil {
+			return err
+		}
+		version, dirty, err := m.Version()
+		if errors.Is(err, migrate.ErrNilVersion) {
+			fmt.Println("no migrations have been applied")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version: %d, dirty: %t\n", version, dirty)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate command: %s", command)
+	}
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS default_bags;
+DROP TABLE IF EXISTS bags;
+DROP TABLE IF EXISTS user_saved_searches;
+DROP TABLE IF EXISTS user_sessions;
+DROP TABLE IF EXISTS user_preferences;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,44 @@
+CREATE TABLE IF NOT EXISTS users (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    username varchar(512) NOT NULL UNIQUE,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS user_preferences (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    preferences text NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    session text NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS user_saved_searches (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    saved_searches text NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS bags (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    contents json NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS default_bags (
+    user_id uuid NOT NULL REFERENCES users (id),
+    bag_id uuid NOT NULL REFERENCES bags (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_user_id_idx ON user_preferences (user_id);
+CREATE INDEX IF NOT EXISTS user_sessions_user_id_idx ON user_sessions (user_id);
+CREATE INDEX IF NOT EXISTS user_saved_searches_user_id_idx ON user_saved_searches (user_id);
+CREATE INDEX IF NOT EXISTS bags_user_id_idx ON bags (user_id);
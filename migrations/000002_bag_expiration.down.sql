@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS bags_expires_at_idx;
+
+ALTER TABLE bags DROP COLUMN IF EXISTS expires_at;
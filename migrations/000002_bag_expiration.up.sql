@@ -0,0 +1,3 @@
+ALTER TABLE bags ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS bags_expires_at_idx ON bags (expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    url text NOT NULL,
+    secret text NOT NULL,
+    event_types text[] NOT NULL DEFAULT '{}',
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    subscription_id uuid NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    event jsonb NOT NULL,
+    error text NOT NULL,
+    attempts integer NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_dead_letters_created_at_idx ON webhook_dead_letters (created_at);
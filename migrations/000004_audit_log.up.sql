@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    module text NOT NULL,
+    action text NOT NULL,
+    username text NOT NULL,
+    bag_id text,
+    actor text,
+    request_id text,
+    before jsonb,
+    after jsonb,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+
+CREATE INDEX IF NOT EXISTS audit_log_username_created_at_idx ON audit_log (username, created_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS user_sessions_updated_at_idx;
+
+ALTER TABLE user_sessions DROP COLUMN IF EXISTS updated_at;
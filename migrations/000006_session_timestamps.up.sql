@@ -0,0 +1,3 @@
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS user_sessions_updated_at_idx ON user_sessions (updated_at);
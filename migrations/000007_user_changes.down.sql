@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_changes;
+
+DROP SEQUENCE IF EXISTS user_changes_version_seq;
@@ -0,0 +1,9 @@
+CREATE SEQUENCE IF NOT EXISTS user_changes_version_seq;
+
+CREATE TABLE IF NOT EXISTS user_changes (
+    username varchar(512) NOT NULL,
+    module text NOT NULL,
+    version bigint NOT NULL DEFAULT nextval('user_changes_version_seq'),
+    changed_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, module)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_avatars (
+    user_id uuid NOT NULL REFERENCES users (id),
+    content_type text,
+    image bytea,
+    url text,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id),
+    CHECK ((image IS NULL) <> (url IS NULL))
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_tours (
+    user_id uuid NOT NULL REFERENCES users (id),
+    tour_id text NOT NULL,
+    completed_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, tour_id)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_notification_prefs (
+    user_id uuid NOT NULL REFERENCES users (id),
+    scope text NOT NULL CHECK (scope IN ('channel', 'event')),
+    name text NOT NULL,
+    enabled boolean NOT NULL,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, scope, name)
+);
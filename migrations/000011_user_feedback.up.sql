@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_feedback (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    form_id text NOT NULL,
+    answers jsonb NOT NULL,
+    submitted_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS user_feedback_form_id_idx ON user_feedback (form_id, submitted_at);
+CREATE INDEX IF NOT EXISTS user_feedback_user_id_idx ON user_feedback (user_id, submitted_at);
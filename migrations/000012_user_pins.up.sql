@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_pins (
+    user_id uuid NOT NULL REFERENCES users (id),
+    item_type text NOT NULL,
+    item_id text NOT NULL,
+    position integer NOT NULL,
+    pinned_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, item_type, item_id)
+);
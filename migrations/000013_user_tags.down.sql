@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_tag_resources;
+DROP TABLE IF EXISTS user_tags;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS user_tags (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    name text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS user_tag_resources (
+    user_id uuid NOT NULL REFERENCES users (id),
+    tag_id uuid NOT NULL REFERENCES user_tags (id) ON DELETE CASCADE,
+    resource_id text NOT NULL,
+    attached_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (tag_id, resource_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_tag_resources_user_id_idx ON user_tag_resources (user_id, resource_id);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS team_preferences (
+    team_id text NOT NULL,
+    preferences jsonb NOT NULL,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (team_id)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_webhooks (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    url text NOT NULL,
+    type text NOT NULL,
+    topics text[] NOT NULL DEFAULT '{}',
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    UNIQUE (user_id, url)
+);
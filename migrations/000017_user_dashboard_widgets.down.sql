@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_dashboard_widgets;
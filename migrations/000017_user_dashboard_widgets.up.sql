@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS user_dashboard_widgets (
+    user_id uuid NOT NULL REFERENCES users (id),
+    widget_id text NOT NULL,
+    grid_column integer NOT NULL,
+    grid_row integer NOT NULL,
+    collapsed boolean NOT NULL DEFAULT false,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, widget_id),
+    UNIQUE (user_id, grid_column, grid_row)
+);
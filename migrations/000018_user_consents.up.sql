@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_consents (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id),
+    purpose text NOT NULL,
+    granted boolean NOT NULL,
+    source text NOT NULL,
+    recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS user_consents_user_id_idx ON user_consents (user_id, recorded_at);
+CREATE INDEX IF NOT EXISTS user_consents_purpose_idx ON user_consents (purpose, recorded_at);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS users_purge_at_idx;
+
+ALTER TABLE users DROP COLUMN IF EXISTS purge_at;
+ALTER TABLE users DROP COLUMN IF EXISTS deactivation_reason;
+ALTER TABLE users DROP COLUMN IF EXISTS deactivated_at;
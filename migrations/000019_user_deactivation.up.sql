@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at timestamp with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivation_reason text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS purge_at timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS users_purge_at_idx ON users (purge_at) WHERE purge_at IS NOT NULL;
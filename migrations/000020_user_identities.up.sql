@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+    subject text NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id),
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS audit_log_impersonator_created_at_idx;
+
+ALTER TABLE audit_log DROP COLUMN IF EXISTS impersonator;
@@ -0,0 +1,3 @@
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS impersonator text;
+
+CREATE INDEX IF NOT EXISTS audit_log_impersonator_created_at_idx ON audit_log (impersonator, created_at) WHERE impersonator IS NOT NULL;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS user_usage (
+    username text NOT NULL,
+    route text NOT NULL,
+    day date NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    errors bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (username, day, route)
+);
+
+CREATE INDEX IF NOT EXISTS user_usage_day_idx ON user_usage (day);
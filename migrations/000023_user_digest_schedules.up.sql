@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS user_digest_schedules (
+    user_id uuid NOT NULL REFERENCES users (id),
+    frequency text NOT NULL,
+    day smallint,
+    hour smallint NOT NULL,
+    timezone text NOT NULL,
+    channels text[] NOT NULL,
+    last_sent_at timestamp with time zone,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_digest_schedules_hour_idx ON user_digest_schedules (hour);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS user_locales (
+    user_id uuid NOT NULL REFERENCES users (id),
+    timezone text NOT NULL,
+    locale text NOT NULL,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id)
+);
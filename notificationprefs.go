@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// maxNotificationQueryUsers is the most users whose notification settings can
+// be looked up in one request.
+const maxNotificationQueryUsers = 1000
+
+// eventTypePattern matches notification event types, e.g. "analysis.completed".
+var eventTypePattern = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// notificationPrefsResult is a user's settings in the response to a bulk
+// query. Deliver lists the channels that the queried event type should be sent
+// through, and is only included when the query has an event type.
+type notificationPrefsResult struct {
+	*NotificationPrefs
+	Deliver *[]string `json:"deliver,omitempty"`
+}
+
+// NotificationPrefsApp manages users' notification settings, which the
+// notifications service reads to decide how to deliver each notification.
+type NotificationPrefsApp struct {
+	prefs           *NotificationPrefsDB
+	channels        []string
+	defaultChannels map[string]bool
+	eventTypes      map[string]bool
+	router          *mux.Router
+}
+
+// NewNotificationPrefsApp returns a new *NotificationPrefsApp. channels are the
+// delivery channels users can opt in to, of which users are opted in to
+// defaultChannels until they say otherwise. If eventTypes isn't empty, only
+// those event types can be turned on or off.
+func NewNotificationPrefsApp(db *NotificationPrefsDB, channels, defaultChannels, eventTypes []string, router *mux.Router) *NotificationPrefsApp {
+	n := &NotificationPrefsApp{
+		prefs:           db,
+		channels:        channels,
+		defaultChannels: make(map[string]bool, len(defaultChannels)),
+		eventTypes:      make(map[string]bool, len(eventTypes)),
+		router:          moduleRouter(router, "notification-prefs", "/notification-prefs"),
+	}
+	for _, channel := range defaultChannels {
+		n.defaultChannels[channel] = true
+	}
+	for _, eventType := range eventTypes {
+		n.eventTypes[eventType] = true
+	}
+
+	n.router.HandleFunc("/query", n.QueryRequest).Methods(http.MethodPost)
+	n.router.HandleFunc("/{username}", n.GetRequest).Methods(http.MethodGet)
+	n.router.HandleFunc("/{username}", n.PutRequest).Methods(http.MethodPut)
+	n.router.HandleFunc("/{username}", n.DeleteRequest).Methods(http.MethodDelete)
+	return n
+}
+
+// effective returns the user's settings with the defaults filled in for the
+// channels they haven't chosen. stored may be nil.
+func (n *NotificationPrefsApp) effective(stored *NotificationPrefs) *NotificationPrefs {
+	prefs := newNotificationPrefs()
+	for _, channel := range n.channels {
+		prefs.Channels[channel] = n.defaultChannels[channel]
+	}
+	if stored != nil {
+		for channel, enabled := range stored.Channels {
+			prefs.Channels[channel] = enabled
+		}
+		for eventType, enabled := range stored.Events {
+			prefs.Events[eventType] = enabled
+		}
+	}
+	return prefs
+}
+
+// deliver returns the channels that notifications of the event type should be
+// sent through according to the settings.
+func (n *NotificationPrefsApp) deliver(prefs *NotificationPrefs, eventType string) []string {
+	channels := []string{}
+	if enabled, ok := prefs.Events[eventType]; ok && !enabled {
+		return channels
+	}
+	for _, channel := range n.channels {
+		if prefs.Channels[channel] {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// validEventType returns what's wrong with the event type, or "" if nothing is.
+func (n *NotificationPrefsApp) validEventType(eventType string) string {
+	switch {
+	case len(eventType) > 128 || !eventTypePattern.MatchString(eventType):
+		return "event types are lowercase words separated by dots, e.g. analysis.completed"
+	case len(n.eventTypes) > 0 && !n.eventTypes[eventType]:
+		return "unknown event type"
+	}
+	return ""
+}
+
+// validate returns what's wrong with each invalid field in the settings.
+func (n *NotificationPrefsApp) validate(prefs *NotificationPrefs) map[string]string {
+	invalid := make(map[string]string)
+	for channel := range prefs.Channels {
+		if !slices.Contains(n.channels, channel) {
+			invalid["channels."+channel] = fmt.Sprintf("unknown channel; expected one of %s", strings.Join(n.channels, ", "))
+		}
+	}
+	for eventType := range prefs.Events {
+		if problem := n.validEventType(eventType); problem != "" {
+			invalid["events."+eventType] = problem
+		}
+	}
+	return invalid
+}
+
+// decodeStrict decodes the request body into v, responding with a 400 and
+// returning false if it isn't valid JSON or has fields that v doesn't.
+func decodeStrict(writer http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpapi.ReadBodyError(writer, err)
+		return false
+	}
+	if _, ok := httpapi.ReadObject(writer, body); !ok {
+		return false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(v); err != nil {
+		httpapi.BadRequest(writer, fmt.Sprintf("error parsing the request body: %s", err))
+		return false
+	}
+	return true
+}
+
+// GetRequest returns the user's notification settings, with the defaults
+// filled in.
+func (n *NotificationPrefsApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, n.prefs.isUser)
+	if !ok {
+		return
+	}
+
+	stored, err := n.prefs.getPrefs(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the notification settings for user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, n.effective(stored))
+}
+
+// PutRequest replaces the user's notification settings and responds with them,
+// with a 201 if the user had none before.
+func (n *NotificationPrefsApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, n.prefs.isUser)
+	if !ok {
+		return
+	}
+
+	prefs := newNotificationPrefs()
+	if !decodeStrict(writer, r, prefs) {
+		return
+	}
+	if invalid := n.validate(prefs); len(invalid) > 0 {
+		httpapi.InvalidFields(writer, invalid)
+		return
+	}
+
+	created, err := n.prefs.setPrefs(r.Context(), username, prefs)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error storing the notification settings for user %s: %s", username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, n.effective(prefs))
+}
+
+// DeleteRequest deletes the user's notification settings, so that the
+// defaults apply again.
+func (n *NotificationPrefsApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, n.prefs.isUser)
+	if !ok {
+		return
+	}
+
+	deleted, err := n.prefs.deletePrefs(r.Context(), username)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting the notification settings for user %s: %s", username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("no notification settings are stored for user %s", username))
+	}
+}
+
+// QueryRequest returns the notification settings of many users at once, keyed
+// by username. The body lists the usernames as they're stored, with their user
+// domains, and may include an event type to also get the channels that a
+// notification of that type should be sent to each user through. Users with
+// nothing stored get the defaults.
+func (n *NotificationPrefsApp) QueryRequest(writer http.ResponseWriter, r *http.Request) {
+	var query struct {
+		Usernames []string `json:"usernames"`
+		EventType string   `json:"event_type"`
+	}
+	if !decodeStrict(writer, r, &query) {
+		return
+	}
+
+	invalid := make(map[string]string)
+	if len(query.Usernames) == 0 || len(query.Usernames) > maxNotificationQueryUsers {
+		invalid["usernames"] = fmt.Sprintf("from 1 to %d usernames are required", maxNotificationQueryUsers)
+	}
+	if query.EventType != "" {
+		if problem := n.validEventType(query.EventType); problem != "" {
+			invalid["event_type"] = problem
+		}
+	}
+	if len(invalid) > 0 {
+		httpapi.InvalidFields(writer, invalid)
+		return
+	}
+
+	stored, err := n.prefs.getPrefsFor(r.Context(), query.Usernames)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting notification settings: %s", err))
+		return
+	}
+
+	users := make(map[string]notificationPrefsResult, len(query.Usernames))
+	for _, username := range query.Usernames {
+		result := notificationPrefsResult{NotificationPrefs: n.effective(stored[username])}
+		if query.EventType != "" {
+			deliver := n.deliver(result.NotificationPrefs, query.EventType)
+			result.Deliver = &deliver
+		}
+		users[username] = result
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"users": users})
+}
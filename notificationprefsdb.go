@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cyverse-de/queries"
+	"github.com/lib/pq"
+)
+
+// The scopes of the rows in the user_notification_prefs table.
+const (
+	notificationScopeChannel = "channel"
+	notificationScopeEvent   = "event"
+)
+
+// NotificationPrefs are a user's notification settings. Channels says whether
+// the user opted in to each delivery channel, e.g. "email", and Events turns
+// notifications of each event type, e.g. "analysis.completed", on or off.
+// Event types that aren't listed are on.
+type NotificationPrefs struct {
+	Channels map[string]bool `json:"channels"`
+	Events   map[string]bool `json:"events"`
+}
+
+// newNotificationPrefs returns empty notification settings.
+func newNotificationPrefs() *NotificationPrefs {
+	return &NotificationPrefs{
+		Channels: make(map[string]bool),
+		Events:   make(map[string]bool),
+	}
+}
+
+// set stores a row of the user_notification_prefs table in the settings.
+func (p *NotificationPrefs) set(scope, name string, enabled bool) {
+	switch scope {
+	case notificationScopeChannel:
+		p.Channels[name] = enabled
+	case notificationScopeEvent:
+		p.Events[name] = enabled
+	}
+}
+
+// NotificationPrefsDB handles interacting with the user_notification_prefs
+// table.
+type NotificationPrefsDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewNotificationPrefsDB returns a newly created *NotificationPrefsDB. Reads of
+// a single user's settings are cached in cache, which may be nil to disable
+// caching.
+func NewNotificationPrefsDB(db *sql.DB, cache Cache) *NotificationPrefsDB {
+	return &NotificationPrefsDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func notificationPrefsKey(username string) string {
+	return cacheKey("notification-prefs", "settings", username)
+}
+
+// isUser returns whether or not the user is present in the database.
+func (n *NotificationPrefsDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, n.cache, n.db, username)
+}
+
+// getPrefs returns the settings stored for the user, or nil if nothing is
+// stored.
+func (n *NotificationPrefsDB) getPrefs(ctx context.Context, username string) (*NotificationPrefs, error) {
+	if prefs, ok := cacheGet[*NotificationPrefs](ctx, n.cache, notificationPrefsKey(username)); ok {
+		return prefs, nil
+	}
+
+	all, err := n.getPrefsFor(ctx, []string{username})
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := all[username]
+	cacheSet(ctx, n.cache, notificationPrefsKey(username), prefs)
+	return prefs, nil
+}
+
+// getPrefsFor returns the settings stored for each of the users, keyed by
+// username. Users with nothing stored are left out.
+func (n *NotificationPrefsDB) getPrefsFor(ctx context.Context, usernames []string) (map[string]*NotificationPrefs, error) {
+	query, args := selectFrom("user_notification_prefs p", "u.username", "p.scope", "p.name", "p.enabled").
+		Join("users u", "p.user_id = u.id").
+		Where("u.username = ANY(?)", pq.Array(usernames)).
+		SQL()
+
+	rows, err := n.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make(map[string]*NotificationPrefs)
+	for rows.Next() {
+		var (
+			username, scope, name string
+			enabled               bool
+		)
+		if err = rows.Scan(&username, &scope, &name, &enabled); err != nil {
+			return nil, err
+		}
+		if all[username] == nil {
+			all[username] = newNotificationPrefs()
+		}
+		all[username].set(scope, name, enabled)
+	}
+
+	return all, rows.Err()
+}
+
+// setPrefs replaces the user's settings. Returns whether the user had no
+// settings before.
+func (n *NotificationPrefsDB) setPrefs(ctx context.Context, username string, prefs *NotificationPrefs) (bool, error) {
+	defer cacheInvalidate(ctx, n.cache, notificationPrefsKey(username))
+
+	userID, err := queries.UserID(ctx, n.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	var scopes, names []string
+	var enabled []bool
+	for name, on := range prefs.Channels {
+		scopes, names, enabled = append(scopes, notificationScopeChannel), append(names, name), append(enabled, on)
+	}
+	for name, on := range prefs.Events {
+		scopes, names, enabled = append(scopes, notificationScopeEvent), append(names, name), append(enabled, on)
+	}
+
+	tx, err := n.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, dbError(err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM ONLY user_notification_prefs WHERE user_id = $1`, userID)
+	if err != nil {
+		return false, dbError(err)
+	}
+	replaced, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	query := `INSERT INTO user_notification_prefs (user_id, scope, name, enabled)
+                   SELECT $1, s.scope, s.name, s.enabled
+                     FROM unnest($2::text[], $3::text[], $4::boolean[]) AS s(scope, name, enabled)`
+	if _, err = tx.ExecContext(ctx, query, userID, pq.Array(scopes), pq.Array(names), pq.Array(enabled)); err != nil {
+		return false, dbError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, dbError(err)
+	}
+
+	action := actionUpdated
+	if replaced == 0 {
+		action = actionCreated
+	}
+	n.notify(ctx, Mutation{Module: "notification-prefs", Action: action, Username: username})
+	return replaced == 0, nil
+}
+
+// deletePrefs deletes the user's settings, so that the defaults apply again.
+// Returns whether the user had any settings.
+func (n *NotificationPrefsDB) deletePrefs(ctx context.Context, username string) (bool, error) {
+	defer cacheInvalidate(ctx, n.cache, notificationPrefsKey(username))
+
+	userID, err := queries.UserID(ctx, n.db, username)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := n.db.ExecContext(ctx, `DELETE FROM ONLY user_notification_prefs WHERE user_id = $1`, userID)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		n.notify(ctx, Mutation{Module: "notification-prefs", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
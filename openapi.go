@@ -0,0 +1,1063 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiParam documents a query parameter accepted by a route.
+type apiParam struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// apiOperation documents a single route for the OpenAPI specification.
+// RequestBody is the media type of the request body, or empty if the route
+// doesn't read one.
+type apiOperation struct {
+	Summary     string
+	Tag         string
+	Query       []apiParam
+	RequestBody string
+	Responses   map[int]string
+}
+
+// Common sets of responses shared by the routes.
+var (
+	userResponses = map[int]string{
+		http.StatusOK:                  "Success.",
+		http.StatusBadRequest:          "The request was invalid.",
+		http.StatusNotFound:            "The user, or the data being deleted, does not exist.",
+		http.StatusConflict:            "The write conflicts with data that's already stored.",
+		http.StatusInternalServerError: "The request could not be completed.",
+	}
+	bagResponses = map[int]string{
+		http.StatusOK:                  "Success.",
+		http.StatusBadRequest:          "The request was invalid.",
+		http.StatusNotFound:            "The user or bag does not exist.",
+		http.StatusConflict:            "The write conflicts with data that's already stored.",
+		http.StatusInternalServerError: "The request could not be completed.",
+	}
+	teamResponses = map[int]string{
+		http.StatusOK:                  "Success.",
+		http.StatusBadRequest:          "The request was invalid.",
+		http.StatusNotFound:            "The team's preferences being deleted do not exist.",
+		http.StatusInternalServerError: "The request could not be completed.",
+	}
+	adminResponses = map[int]string{
+		http.StatusOK:                  "Success.",
+		http.StatusBadRequest:          "The request was invalid.",
+		http.StatusUnauthorized:        "An admin API key is required.",
+		http.StatusForbidden:           "The API key is not an admin key.",
+		http.StatusNotFound:            "The subscription does not exist.",
+		http.StatusInternalServerError: "The request could not be completed.",
+	}
+	greetingResponses = map[int]string{
+		http.StatusOK: "A plain text greeting.",
+	}
+)
+
+// apiOperations documents every route registered on the router, keyed by the
+// method and path template. Add an entry here when adding a route;
+// TestOpenAPIDocumentsEveryRoute fails for routes that are missing one.
+var apiOperations = map[string]apiOperation{
+	"GET /":             {Summary: "Returns a greeting.", Tag: "status", Responses: greetingResponses},
+	"GET /debug/vars":   {Summary: "Returns the service's expvar metrics, including per-route request counts and latency histograms under http_routes.", Tag: "status", Responses: map[int]string{http.StatusOK: "The metrics as JSON."}},
+	"GET /openapi.json": {Summary: "Returns this OpenAPI specification.", Tag: "status", Responses: map[int]string{http.StatusOK: "The specification."}},
+	"GET /docs":         {Summary: "Serves Swagger UI for this specification.", Tag: "status", Responses: map[int]string{http.StatusOK: "An HTML page."}},
+
+	"GET /preferences/":              {Summary: "Returns a greeting.", Tag: "preferences", Responses: greetingResponses},
+	"GET /preferences/{username}":    {Summary: "Returns the user's preferences.", Tag: "preferences", Responses: userResponses},
+	"PUT /preferences/{username}":    {Summary: "Sets the user's preferences.", Tag: "preferences", RequestBody: "application/json", Responses: userResponses},
+	"POST /preferences/{username}":   {Summary: "Sets the user's preferences.", Tag: "preferences", RequestBody: "application/json", Responses: userResponses},
+	"DELETE /preferences/{username}": {Summary: "Deletes the user's preferences.", Tag: "preferences", Responses: userResponses},
+
+	"GET /team-preferences/{teamID}": {Summary: "Returns the preferences shared by the team, or an empty object if it has none.", Tag: "team-preferences", Responses: teamResponses},
+	"PUT /team-preferences/{teamID}": {
+		Summary:     "Replaces the preferences shared by the team with the JSON object in the body.",
+		Tag:         "team-preferences",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The team's preferences were replaced.",
+			http.StatusCreated:             "The team had no preferences before.",
+			http.StatusBadRequest:          "The team ID or body is invalid.",
+			http.StatusInternalServerError: "The preferences could not be stored.",
+		},
+	},
+	"DELETE /team-preferences/{teamID}": {Summary: "Deletes the preferences shared by the team.", Tag: "team-preferences", Responses: teamResponses},
+	"GET /team-preferences/{teamID}/resolved/{username}": {
+		Summary:   "Returns the preferences that apply to the user as a member of the team: the team's preferences, with the user's own merged over them. Objects are merged key by key; other values the user set replace the team's.",
+		Tag:       "team-preferences",
+		Responses: userResponses,
+	},
+
+	"GET /sessions/":              {Summary: "Returns a greeting.", Tag: "sessions", Responses: greetingResponses},
+	"GET /sessions/{username}":    {Summary: "Returns the user's session.", Tag: "sessions", Responses: userResponses},
+	"PUT /sessions/{username}":    {Summary: "Sets the user's session.", Tag: "sessions", RequestBody: "application/json", Responses: userResponses},
+	"POST /sessions/{username}":   {Summary: "Sets the user's session.", Tag: "sessions", RequestBody: "application/json", Responses: userResponses},
+	"DELETE /sessions/{username}": {Summary: "Deletes the user's session.", Tag: "sessions", Responses: userResponses},
+
+	"GET /searches/":              {Summary: "Returns a greeting.", Tag: "searches", Responses: greetingResponses},
+	"GET /searches/{username}":    {Summary: "Returns the user's saved searches.", Tag: "searches", Responses: userResponses},
+	"PUT /searches/{username}":    {Summary: "Sets the user's saved searches.", Tag: "searches", RequestBody: "application/json", Responses: userResponses},
+	"POST /searches/{username}":   {Summary: "Sets the user's saved searches.", Tag: "searches", RequestBody: "application/json", Responses: userResponses},
+	"DELETE /searches/{username}": {Summary: "Deletes the user's saved searches.", Tag: "searches", Responses: userResponses},
+
+	"GET /users/{username}/summary": {
+		Summary: "Returns the user's preferences, session, saved searches, and bag counts in one response.",
+		Tag:     "users",
+		Responses: map[int]string{
+			http.StatusOK:                  "The summary.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The summary could not be gathered.",
+		},
+	},
+	"DELETE /users/{username}": {
+		Summary: "Deletes the user's preferences, session, saved searches, and bags in one transaction.",
+		Tag:     "users",
+		Responses: map[int]string{
+			http.StatusOK:                  "The number of rows deleted from each table.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "Nothing was deleted because an error occurred.",
+		},
+	},
+	"GET /users/{username}/changes": {
+		Summary: "Lists which of the user's preferences, session, searches, and bags have changed since the since parameter, with a token to pass as since next time.",
+		Tag:     "users",
+		Query: []apiParam{
+			{Name: "since", Type: "string", Description: "A token returned by an earlier request, or an RFC 3339 timestamp. Without it, everything that has ever changed is listed."},
+		},
+		Responses: map[int]string{
+			http.StatusOK:                  "The kinds of data that have changed and the new token.",
+			http.StatusBadRequest:          "The since parameter is invalid.",
+			http.StatusInternalServerError: "The changes could not be listed.",
+		},
+	},
+	"GET /profile/{username}": {
+		Summary: "Returns the user's ID in this service along with their name, email address, and institution from the identity provider configured in profile.url. Attributes are cached for profile.cache_ttl.",
+		Tag:     "users",
+		Responses: map[int]string{
+			http.StatusOK:                  "The user's profile.",
+			http.StatusNotFound:            "Neither this service nor the identity provider knows the user.",
+			http.StatusInternalServerError: "The user could not be looked up.",
+			http.StatusBadGateway:          "The identity provider could not be reached or returned an error.",
+		},
+	},
+	"GET /avatars/{username}": {
+		Summary: "Returns the user's avatar image, or redirects to it if the avatar is an external URL. Responses can be cached for avatars.cache_max_age, and conditional requests get a 304 when the image hasn't changed.",
+		Tag:     "avatars",
+		Responses: map[int]string{
+			http.StatusOK:                  "The image.",
+			http.StatusFound:               "The avatar is stored elsewhere.",
+			http.StatusNotModified:         "The client's copy of the image is current.",
+			http.StatusNotFound:            "The user or avatar does not exist.",
+			http.StatusInternalServerError: "The avatar could not be read.",
+		},
+	},
+	"PUT /avatars/{username}": {
+		Summary: "Sets the user's avatar. The body is either a PNG, JPEG, GIF, or WebP image no larger than avatars.max_size, or a JSON object with the url of an image stored elsewhere, e.g. {\"url\": \"https://example.org/me.png\"}.",
+		Tag:     "avatars",
+		Responses: map[int]string{
+			http.StatusOK:                    "The avatar was replaced.",
+			http.StatusCreated:               "The avatar was stored.",
+			http.StatusBadRequest:            "The body was empty or the URL was invalid.",
+			http.StatusNotFound:              "The user does not exist.",
+			http.StatusRequestEntityTooLarge: "The image is larger than avatars.max_size.",
+			http.StatusUnsupportedMediaType:  "The image isn't one of the supported types.",
+			http.StatusInternalServerError:   "The avatar could not be stored.",
+		},
+	},
+	"DELETE /avatars/{username}": {Summary: "Deletes the user's avatar.", Tag: "avatars", Responses: userResponses},
+	"GET /tours/{username}": {
+		Summary:   "Lists the product tours and onboarding steps the user has completed, oldest first, as {\"tours\": [{\"tour_id\": ..., \"completed_at\": ...}]}.",
+		Tag:       "tours",
+		Responses: userResponses,
+	},
+	"DELETE /tours/{username}": {Summary: "Forgets every tour the user has completed, so that they're all shown again.", Tag: "tours", Responses: userResponses},
+	"PUT /tours/{username}/{tourID}": {
+		Summary: "Records that the user completed the tour. Tour IDs are up to 128 letters, digits, dots, colons, underscores, and hyphens. Completing a tour again keeps the original completion time.",
+		Tag:     "tours",
+		Responses: map[int]string{
+			http.StatusOK:                  "The tour was already completed.",
+			http.StatusCreated:             "The tour was recorded as completed.",
+			http.StatusBadRequest:          "The tour ID is invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The tour could not be recorded.",
+		},
+	},
+	"DELETE /tours/{username}/{tourID}": {Summary: "Forgets that the user completed the tour, so that it's shown again.", Tag: "tours", Responses: userResponses},
+	"GET /notification-prefs/{username}": {
+		Summary:   "Returns the user's notification settings as {\"channels\": {...}, \"events\": {...}}. Channels maps each channel in notification_prefs.channels to whether the user opted in to it, defaulting to whether it's in notification_prefs.default_channels. Events turns event types on or off; event types that aren't listed are on.",
+		Tag:       "notification-prefs",
+		Responses: userResponses,
+	},
+	"PUT /notification-prefs/{username}": {
+		Summary:     "Replaces the user's notification settings. Channels must be in notification_prefs.channels, and event types are lowercase words separated by dots that must be in notification_prefs.event_types if it's set.",
+		Tag:         "notification-prefs",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The settings were replaced.",
+			http.StatusCreated:             "The settings were stored.",
+			http.StatusBadRequest:          "The settings are invalid; the fields member says what's wrong with each field.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The settings could not be stored.",
+		},
+	},
+	"DELETE /notification-prefs/{username}": {Summary: "Deletes the user's notification settings, so that the defaults apply again.", Tag: "notification-prefs", Responses: userResponses},
+	"POST /notification-prefs/query": {
+		Summary:     "Returns the notification settings of up to 1000 users, as {\"users\": {username: settings}}. The body is {\"usernames\": [...], \"event_type\": ...}, with the usernames as they're stored, including the user domain. With an event type, each user's settings include deliver, the channels to send a notification of that type through. Users with nothing stored get the defaults.",
+		Tag:         "notification-prefs",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The users' settings.",
+			http.StatusBadRequest:          "The query is invalid.",
+			http.StatusInternalServerError: "The settings could not be read.",
+		},
+	},
+	"GET /pins/{username}": {
+		Summary:   "Lists the user's pinned items of every type in pins.limits, in order, as {\"pins\": {type: [{\"id\": ..., \"position\": ..., \"pinned_at\": ...}]}}.",
+		Tag:       "pins",
+		Responses: userResponses,
+	},
+	"DELETE /pins/{username}": {Summary: "Unpins all of the user's items.", Tag: "pins", Responses: userResponses},
+	"GET /pins/{username}/{type}": {
+		Summary:   "Lists the user's pinned items of the type, in order, as {\"pins\": [...]}.",
+		Tag:       "pins",
+		Responses: userResponses,
+	},
+	"POST /pins/{username}/{type}": {
+		Summary:     "Pins the item with the id in the body, {\"id\": ...}, after the user's other pinned items of the type. An item that's already pinned keeps its place.",
+		Tag:         "pins",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The item was already pinned.",
+			http.StatusCreated:             "The item was pinned.",
+			http.StatusBadRequest:          "The type or ID is invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "The user already has as many pinned items of the type as pins.limits allows; the limit member has the limit.",
+			http.StatusInternalServerError: "The item could not be pinned.",
+		},
+	},
+	"PUT /pins/{username}/{type}": {
+		Summary:     "Reorders the user's pinned items of the type. The body is {\"ids\": [...]}, listing each pinned item of the type once, in the new order.",
+		Tag:         "pins",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The reordered pins.",
+			http.StatusBadRequest:          "The type is invalid, or the IDs aren't the pinned items.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The pins could not be reordered.",
+		},
+	},
+	"DELETE /pins/{username}/{type}": {
+		Summary: "Unpins an item, moving the user's pinned items after it up.",
+		Tag:     "pins",
+		Query: []apiParam{
+			{Name: "id", Type: "string", Description: "The ID of the item to unpin. Required."},
+		},
+		Responses: userResponses,
+	},
+	"GET /tags/{username}": {
+		Summary:   "Lists the user's tags, sorted by name, as {\"tags\": [{\"id\": ..., \"name\": ..., \"created_at\": ...}]}.",
+		Tag:       "tags",
+		Responses: userResponses,
+	},
+	"POST /tags/{username}": {
+		Summary:     "Creates a tag with the name in the body, {\"name\": ...}. Names are up to 128 characters, without leading or trailing spaces or control characters.",
+		Tag:         "tags",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusCreated:             "The new tag.",
+			http.StatusBadRequest:          "The name is invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "The user already has a tag with the name.",
+			http.StatusInternalServerError: "The tag could not be created.",
+		},
+	},
+	"DELETE /tags/{username}/{tagID}": {Summary: "Deletes a tag, detaching it from every resource.", Tag: "tags", Responses: userResponses},
+	"GET /tags/{username}/{tagID}/resources": {
+		Summary:   "Lists the resources the tag is attached to, oldest first, as {\"resources\": [{\"id\": ..., \"attached_at\": ...}]}.",
+		Tag:       "tags",
+		Responses: userResponses,
+	},
+	"POST /tags/{username}/{tagID}/resources": {
+		Summary:     "Attaches the tag to up to 1000 resources, {\"ids\": [...]}, responding with the number it was newly attached to as {\"attached\": n}.",
+		Tag:         "tags",
+		RequestBody: "application/json",
+		Responses:   userResponses,
+	},
+	"DELETE /tags/{username}/{tagID}/resources": {
+		Summary: "Detaches the tag from resources, responding with the number it was detached from as {\"detached\": n}.",
+		Tag:     "tags",
+		Query: []apiParam{
+			{Name: "id", Type: "string", Description: "The ID of a resource to detach the tag from. Required, and may be repeated up to 1000 times."},
+		},
+		Responses: userResponses,
+	},
+	"GET /tokens/{username}": {
+		Summary:   "Lists the user's personal access tokens, oldest first and without their secrets, as {\"tokens\": [...]}.",
+		Tag:       "tokens",
+		Responses: userResponses,
+	},
+	"POST /tokens/{username}": {
+		Summary:     "Creates a personal access token from {\"name\": ..., \"scopes\": [...], \"expires_at\": ...}, where expires_at is optional and limited by the configured maximum lifetime. The response has the token's secret in the token field, which is only ever returned here.",
+		Tag:         "tokens",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusCreated:             "The new token, with its secret.",
+			http.StatusBadRequest:          "The name, scopes, or expiration are invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "The user already has a token with the name.",
+			http.StatusInternalServerError: "The token could not be created.",
+		},
+	},
+	"DELETE /tokens/{username}":           {Summary: "Revokes all of the user's personal access tokens.", Tag: "tokens", Responses: userResponses},
+	"DELETE /tokens/{username}/{tokenID}": {Summary: "Revokes one of the user's personal access tokens.", Tag: "tokens", Responses: userResponses},
+	"POST /tokens/verify": {
+		Summary:     "Verifies a personal access token secret for the service it was presented to, from {\"token\": ..., \"scope\": ...}, where scope is optional. The response is {\"active\": true} with the token and its owner's username, or {\"active\": false} with a reason of unknown, deactivated, expired, or insufficient_scope.",
+		Tag:         "tokens",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "Whether the token is active.",
+			http.StatusBadRequest:          "The body is invalid.",
+			http.StatusInternalServerError: "The token could not be verified.",
+		},
+	},
+	"GET /webhooks/{username}": {
+		Summary:   "Lists the user's notification webhooks, oldest first, as {\"webhooks\": [...]}. If the topic query parameter is set, only the webhooks that receive notifications on that topic are listed.",
+		Tag:       "user-webhooks",
+		Responses: userResponses,
+	},
+	"POST /webhooks/{username}": {
+		Summary:     "Registers a webhook that receives the user's notifications from {\"url\": ..., \"type\": ..., \"topics\": [...]}, where the type is one of the configured webhook types and an empty or missing list of topics receives every topic.",
+		Tag:         "user-webhooks",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusCreated:             "The new webhook.",
+			http.StatusBadRequest:          "The URL, type, or topics are invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "The user already registered the URL.",
+			http.StatusInternalServerError: "The webhook could not be registered.",
+		},
+	},
+	"DELETE /webhooks/{username}": {Summary: "Deletes all of the user's notification webhooks.", Tag: "user-webhooks", Responses: userResponses},
+	"PUT /webhooks/{username}/{webhookID}": {
+		Summary:     "Replaces the URL, type, and topics of one of the user's webhooks, from a body shaped like the one used to register it.",
+		Tag:         "user-webhooks",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The updated webhook.",
+			http.StatusBadRequest:          "The URL, type, or topics are invalid.",
+			http.StatusNotFound:            "The user or the webhook does not exist.",
+			http.StatusConflict:            "The user already registered the URL.",
+			http.StatusInternalServerError: "The webhook could not be updated.",
+		},
+	},
+	"DELETE /webhooks/{username}/{webhookID}": {Summary: "Deletes one of the user's notification webhooks.", Tag: "user-webhooks", Responses: userResponses},
+	"POST /webhooks/{username}/{webhookID}/test": {
+		Summary: "Sends a test notification to one of the user's webhooks. The response is {\"delivered\": ..., \"status\": ..., \"error\": ...}, with the webhook's response status if it responded and what went wrong if the notification wasn't delivered.",
+		Tag:     "user-webhooks",
+		Responses: map[int]string{
+			http.StatusOK:                  "Whether the test notification was delivered.",
+			http.StatusBadRequest:          "The webhook ID is invalid.",
+			http.StatusNotFound:            "The user or the webhook does not exist.",
+			http.StatusInternalServerError: "The webhook could not be looked up.",
+		},
+	},
+	"GET /dashboard/{username}": {
+		Summary:   "Returns the widgets on the user's dashboard, by column and then by row, as {\"widgets\": [{\"id\": ..., \"column\": ..., \"row\": ..., \"collapsed\": ...}]}. The list is empty if the user hasn't laid out their dashboard.",
+		Tag:       "dashboard",
+		Responses: userResponses,
+	},
+	"PUT /dashboard/{username}": {
+		Summary:     "Replaces the layout of the user's dashboard with {\"widgets\": [...]}. Widget IDs must be unique, columns must be within the configured number of columns, and no two widgets can be in the same cell.",
+		Tag:         "dashboard",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The layout was replaced.",
+			http.StatusCreated:             "The user had no layout before.",
+			http.StatusBadRequest:          "The layout is invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The layout could not be stored.",
+		},
+	},
+	"DELETE /dashboard/{username}": {Summary: "Removes every widget from the user's dashboard, so that the default layout applies again.", Tag: "dashboard", Responses: userResponses},
+	"PUT /dashboard/{username}/{widgetID}": {
+		Summary:     "Places a widget on the user's dashboard from {\"column\": ..., \"row\": ..., \"collapsed\": ...}, moving it if it's already there, without changing the other widgets.",
+		Tag:         "dashboard",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The widget was moved or updated.",
+			http.StatusCreated:             "The widget was added to the dashboard.",
+			http.StatusBadRequest:          "The widget ID or placement is invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "Another widget is in the cell.",
+			http.StatusInternalServerError: "The widget could not be placed.",
+		},
+	},
+	"DELETE /dashboard/{username}/{widgetID}": {Summary: "Removes a widget from the user's dashboard.", Tag: "dashboard", Responses: userResponses},
+	"GET /consents/{username}": {
+		Summary:   "Returns the current state of the user's consents, by purpose, as {\"consents\": [{\"purpose\": ..., \"granted\": ..., \"granted_at\": ..., \"withdrawn_at\": ..., \"source\": ...}]}, derived from the user's latest consent record for each purpose.",
+		Tag:       "consents",
+		Responses: userResponses,
+	},
+	"POST /consents/{username}": {
+		Summary:     "Records that the user granted or withdrew their consent, from {\"purpose\": ..., \"granted\": ..., \"source\": ...}, where source says where the user made the choice. Records can't be changed or deleted afterward.",
+		Tag:         "consents",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusCreated:             "The stored record.",
+			http.StatusBadRequest:          "The purpose, granted flag, or source is invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The record could not be stored.",
+		},
+	},
+	"GET /consents/{username}/history": {
+		Summary: "Lists a page of the user's consent records, newest first, in the standard page envelope.",
+		Tag:     "consents",
+		Query: []apiParam{
+			{Name: "purpose", Type: "string", Description: "Only list the records for this purpose."},
+			{Name: "since", Type: "string", Description: "Only list records at or after this RFC 3339 time."},
+			{Name: "until", Type: "string", Description: "Only list records before this RFC 3339 time."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of records to list, up to 1000. Defaults to 100."},
+			{Name: "offset", Type: "integer", Description: "The number of records to skip."},
+		},
+		Responses: userResponses,
+	},
+	"GET /identity/by-subject/{subject}": {
+		Summary: "Returns the user that the subject of an OIDC token, its sub claim, is mapped to, as {\"subject\": ..., \"username\": ..., \"created_at\": ...}.",
+		Tag:     "identity",
+		Responses: map[int]string{
+			http.StatusOK:                  "The mapping.",
+			http.StatusBadRequest:          "The subject is invalid.",
+			http.StatusNotFound:            "The subject isn't mapped to a user.",
+			http.StatusInternalServerError: "The subject could not be looked up.",
+		},
+	},
+	"GET /identity/{username}": {
+		Summary:   "Lists the OIDC subjects mapped to the user, oldest first, as {\"identities\": [...]}.",
+		Tag:       "identity",
+		Responses: userResponses,
+	},
+	"PUT /identity/{username}/{subject}": {
+		Summary: "Maps the OIDC subject to the user. A subject can only be mapped to one user, but a user can have several subjects.",
+		Tag:     "identity",
+		Responses: map[int]string{
+			http.StatusOK:                  "The subject was already mapped to the user.",
+			http.StatusCreated:             "The subject was mapped to the user.",
+			http.StatusBadRequest:          "The subject is invalid.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "The subject is mapped to another user.",
+			http.StatusInternalServerError: "The subject could not be mapped.",
+		},
+	},
+	"DELETE /identity/{username}/{subject}": {Summary: "Removes the mapping of the OIDC subject to the user.", Tag: "identity", Responses: userResponses},
+	"GET /activity/{username}": {
+		Summary: "Lists a page of the writes to the user's data recorded in the audit log, such as preference changes, bag edits, and logins, newest first, in the standard page envelope. Writes made while auditing is disabled aren't listed.",
+		Tag:     "activity",
+		Query: []apiParam{
+			{Name: "module", Type: "string", Description: "Only list writes to this kind of data, e.g. bags."},
+			{Name: "since", Type: "string", Description: "Only list writes at or after this RFC 3339 time."},
+			{Name: "until", Type: "string", Description: "Only list writes before this RFC 3339 time."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of entries to list, up to 100. Defaults to 20."},
+			{Name: "offset", Type: "integer", Description: "The number of entries to skip."},
+		},
+		Responses: userResponses,
+	},
+	"GET /digests/due": {
+		Summary: "Lists a page of the digest schedules that are due, by username, in the standard page envelope. A schedule is due during its hour on its days, in its timezone, until it's marked as sent.",
+		Tag:     "digests",
+		Query: []apiParam{
+			{Name: "at", Type: "string", Description: "List the schedules due at this RFC 3339 time instead of now."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of schedules to list, up to 1000. Defaults to 100."},
+			{Name: "offset", Type: "integer", Description: "The number of schedules to skip."},
+		},
+		Responses: map[int]string{
+			http.StatusOK:                  "The page of due schedules.",
+			http.StatusBadRequest:          "The query parameters are invalid.",
+			http.StatusInternalServerError: "The schedules could not be listed.",
+		},
+	},
+	"POST /digests/sent": {
+		Summary:     "Marks the digests of up to 1000 users as sent, so that they're no longer due, and returns {\"updated\": n}. The body is {\"usernames\": [...], \"sent_at\": ...}, with the usernames as they're stored, including the user domain. sent_at defaults to now.",
+		Tag:         "digests",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The digests were marked as sent.",
+			http.StatusBadRequest:          "The body is invalid.",
+			http.StatusInternalServerError: "The digests could not be marked as sent.",
+		},
+	},
+	"GET /digests/{username}": {
+		Summary: "Returns the user's digest schedule.",
+		Tag:     "digests",
+		Responses: map[int]string{
+			http.StatusOK:                  "The user's schedule.",
+			http.StatusNotFound:            "The user does not exist or doesn't have a schedule.",
+			http.StatusInternalServerError: "The schedule could not be read.",
+		},
+	},
+	"PUT /digests/{username}": {
+		Summary:     "Replaces the user's digest schedule. The body is {\"frequency\": ..., \"day\": ..., \"hour\": ..., \"timezone\": ..., \"channels\": [...]}. Frequency is daily, weekly, or monthly; day is null for daily digests, the day of the week from 0 (Sunday) to 6 for weekly ones, and the day of the month from 1 to 28 for monthly ones. The hour is from 0 to 23 in the IANA timezone, and channels must be in notification_prefs.channels.",
+		Tag:         "digests",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The schedule was replaced.",
+			http.StatusCreated:             "The schedule was stored.",
+			http.StatusBadRequest:          "The schedule is invalid; the fields member says what's wrong with each field.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The schedule could not be stored.",
+		},
+	},
+	"DELETE /digests/{username}": {
+		Summary: "Deletes the user's digest schedule, so that they're no longer sent digests.",
+		Tag:     "digests",
+		Responses: map[int]string{
+			http.StatusOK:                  "The schedule was deleted.",
+			http.StatusNotFound:            "The user does not exist or doesn't have a schedule.",
+			http.StatusInternalServerError: "The schedule could not be deleted.",
+		},
+	},
+	"GET /locale/{username}": {
+		Summary:   "Returns the user's IANA timezone and BCP 47 locale, as {\"username\": ..., \"timezone\": ..., \"locale\": ..., \"updated_at\": ...}. Users who haven't set them get locale.default_timezone and locale.default_locale, with a null updated_at.",
+		Tag:       "locale",
+		Responses: userResponses,
+	},
+	"PUT /locale/{username}": {
+		Summary:     "Replaces the user's timezone and locale. The body is {\"timezone\": ..., \"locale\": ...}, where the timezone is an IANA name such as America/Phoenix and the locale is a BCP 47 language tag such as en-US. The locale is stored in its canonical form.",
+		Tag:         "locale",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The timezone and locale were replaced.",
+			http.StatusCreated:             "The timezone and locale were stored.",
+			http.StatusBadRequest:          "The timezone or locale is invalid; the fields member says what's wrong with each field.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The timezone and locale could not be stored.",
+		},
+	},
+	"GET /feedback/{username}": {
+		Summary: "Lists a page of the user's feedback and survey submissions, newest first, in the standard page envelope.",
+		Tag:     "feedback",
+		Query: []apiParam{
+			{Name: "form_id", Type: "string", Description: "Only list the responses to this form."},
+			{Name: "since", Type: "string", Description: "Only list submissions at or after this RFC 3339 time."},
+			{Name: "until", Type: "string", Description: "Only list submissions before this RFC 3339 time."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of submissions to list, up to 1000. Defaults to 100."},
+			{Name: "offset", Type: "integer", Description: "The number of submissions to skip."},
+		},
+		Responses: userResponses,
+	},
+	"POST /feedback/{username}": {
+		Summary:     "Stores a feedback or survey submission from the user. The body is {\"form_id\": ..., \"answers\": {...}}, where form IDs are up to 128 letters, digits, dots, colons, underscores, and hyphens, and the answers are any JSON object.",
+		Tag:         "feedback",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusCreated:             "The stored submission, with its id and submitted_at.",
+			http.StatusBadRequest:          "The submission is invalid; the fields member says what's wrong with each field.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The submission could not be stored.",
+		},
+	},
+	"GET /users/{username}/export": {
+		Summary: "Exports everything stored for the user.",
+		Tag:     "users",
+		Query: []apiParam{
+			{Name: "format", Type: "string", Description: "zip for a zip archive with a JSON file for each table (the default), or json for a single JSON object."},
+		},
+		Responses: map[int]string{
+			http.StatusOK:                  "The exported data.",
+			http.StatusBadRequest:          "The format is not supported.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The export could not be started.",
+		},
+	},
+	"GET /users/{username}/deactivation": {
+		Summary: "Returns whether the user's account is deactivated, why, and when its data is scheduled to be purged.",
+		Tag:     "users",
+		Responses: map[int]string{
+			http.StatusOK:                  "Whether the account is deactivated.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusInternalServerError: "The account could not be checked.",
+		},
+	},
+	"POST /users/{username}/deactivate": {
+		Summary:     "Deactivates the user's account with an optional reason, so that writes to the user's data are rejected with a 403. If purge_at is set, everything stored for the user is purged at that time unless the account is reactivated first.",
+		Tag:         "users",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusOK:                  "The deactivated account.",
+			http.StatusBadRequest:          "The reason is too long or purge_at isn't in the future.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "The account is already deactivated.",
+			http.StatusInternalServerError: "The account could not be deactivated.",
+		},
+	},
+	"POST /users/{username}/reactivate": {
+		Summary: "Reactivates the user's account and cancels any scheduled purge of their data.",
+		Tag:     "users",
+		Responses: map[int]string{
+			http.StatusOK:                  "The reactivated account.",
+			http.StatusNotFound:            "The user does not exist.",
+			http.StatusConflict:            "The account isn't deactivated.",
+			http.StatusInternalServerError: "The account could not be reactivated.",
+		},
+	},
+
+	"GET /bags/": {Summary: "Returns a greeting.", Tag: "bags", Responses: greetingResponses},
+	"HEAD /bags/{username}": {Summary: "Returns whether the user has any bags.", Tag: "bags", Responses: map[int]string{
+		http.StatusOK:       "The user has at least one bag.",
+		http.StatusNotFound: "The user has no bags.",
+	}},
+	"GET /bags/{username}":    {Summary: "Lists the user's bags.", Tag: "bags", Responses: userResponses},
+	"PUT /bags/{username}":    {Summary: "Adds a bag for the user.", Tag: "bags", RequestBody: "application/json", Responses: userResponses},
+	"DELETE /bags/{username}": {Summary: "Deletes all of the user's bags.", Tag: "bags", Responses: userResponses},
+	"GET /bags/{username}/default": {
+		Summary: "Returns the user's default bag.",
+		Tag:     "bags",
+		Query: []apiParam{
+			{Name: "create", Type: "boolean", Description: "Whether to create the default bag if it doesn't exist."},
+		},
+		Responses: bagResponses,
+	},
+	"POST /bags/{username}/default":   {Summary: "Updates the user's default bag.", Tag: "bags", RequestBody: "application/json", Responses: userResponses},
+	"DELETE /bags/{username}/default": {Summary: "Deletes the user's default bag.", Tag: "bags", Responses: userResponses},
+	"POST /bags/{username}/import": {
+		Summary: "Creates a bag from an uploaded CSV or JSON file in the \"file\" form field.",
+		Tag:     "bags",
+		Query: []apiParam{
+			{Name: "format", Type: "string", Description: "The format of the file, csv or json. Defaults to the file's extension."},
+		},
+		RequestBody: "multipart/form-data",
+		Responses:   userResponses,
+	},
+	"GET /bags/{username}/{bagID}":       {Summary: "Returns a bag.", Tag: "bags", Responses: bagResponses},
+	"POST /bags/{username}/{bagID}":      {Summary: "Updates a bag.", Tag: "bags", RequestBody: "application/json", Responses: bagResponses},
+	"DELETE /bags/{username}/{bagID}":    {Summary: "Deletes a bag.", Tag: "bags", Responses: bagResponses},
+	"POST /bags/{username}/{bagID}/diff": {Summary: "Compares a bag with the contents in the request body.", Tag: "bags", RequestBody: "application/json", Responses: bagResponses},
+
+	"GET /admin/webhooks": {Summary: "Lists the webhook subscriptions, without their secrets.", Tag: "admin", Responses: adminResponses},
+	"POST /admin/webhooks": {
+		Summary:     "Adds a webhook subscription with a url, a secret used to sign deliveries, and optional event_types.",
+		Tag:         "admin",
+		RequestBody: "application/json",
+		Responses: map[int]string{
+			http.StatusCreated:             "The new subscription.",
+			http.StatusBadRequest:          "The url, secret, or event types are invalid.",
+			http.StatusUnauthorized:        "An admin API key is required.",
+			http.StatusForbidden:           "The API key is not an admin key.",
+			http.StatusInternalServerError: "The subscription could not be added.",
+		},
+	},
+	"DELETE /admin/webhooks/{id}": {Summary: "Deletes a webhook subscription.", Tag: "admin", Responses: adminResponses},
+	"GET /admin/audit": {
+		Summary: "Lists a page of the audit log entries for writes to users' data, newest first, in the standard page envelope.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "username", Type: "string", Description: "Only list writes to this user's data."},
+			{Name: "module", Type: "string", Description: "Only list writes to this kind of data, e.g. bags."},
+			{Name: "action", Type: "string", Description: "Only list this action: created, updated, deleted, purged, deactivated, or reactivated."},
+			{Name: "actor", Type: "string", Description: "Only list writes made with this API key name."},
+			{Name: "impersonator", Type: "string", Description: "Only list writes made by this user while impersonating another with the X-Impersonate-User header."},
+			{Name: "request_id", Type: "string", Description: "Only list writes made by this request."},
+			{Name: "since", Type: "string", Description: "Only list writes at or after this RFC 3339 time."},
+			{Name: "until", Type: "string", Description: "Only list writes before this RFC 3339 time."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of entries to list, up to 1000. Defaults to 100."},
+			{Name: "offset", Type: "integer", Description: "The number of entries to skip."},
+		},
+		Responses: adminResponses,
+	},
+	"GET /admin/usage": {
+		Summary: "Lists a page of the users that the most requests were made for over a range of UTC days, busiest first, in the standard page envelope.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "since", Type: "string", Description: "Start from the day this RFC 3339 time falls on. Defaults to 29 days before the last day."},
+			{Name: "until", Type: "string", Description: "End with the day before this RFC 3339 time. Defaults to ending today."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of users to list, up to 1000. Defaults to 10."},
+			{Name: "offset", Type: "integer", Description: "The number of users to skip."},
+		},
+		Responses: adminResponses,
+	},
+	"GET /admin/usage/{username}": {
+		Summary: "Returns the number of requests made for the user over a range of UTC days, and how many failed, in total, by route, and by day. Requests for users that don't exist are counted too.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "since", Type: "string", Description: "Start from the day this RFC 3339 time falls on. Defaults to 29 days before the last day."},
+			{Name: "until", Type: "string", Description: "End with the day before this RFC 3339 time. Defaults to ending today."},
+		},
+		Responses: adminResponses,
+	},
+	"GET /admin/consents": {
+		Summary: "Lists a page of the consent records of every user, newest first, in the standard page envelope.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "purpose", Type: "string", Description: "Only list the records for this purpose."},
+			{Name: "username", Type: "string", Description: "Only list this user's records."},
+			{Name: "since", Type: "string", Description: "Only list records at or after this RFC 3339 time."},
+			{Name: "until", Type: "string", Description: "Only list records before this RFC 3339 time."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of records to list, up to 1000. Defaults to 100."},
+			{Name: "offset", Type: "integer", Description: "The number of records to skip."},
+		},
+		Responses: adminResponses,
+	},
+	"GET /admin/feedback": {
+		Summary: "Lists a page of the feedback and survey submissions from every user, newest first, in the standard page envelope.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "form_id", Type: "string", Description: "Only list the responses to this form."},
+			{Name: "username", Type: "string", Description: "Only list this user's submissions."},
+			{Name: "since", Type: "string", Description: "Only list submissions at or after this RFC 3339 time."},
+			{Name: "until", Type: "string", Description: "Only list submissions before this RFC 3339 time."},
+			{Name: "limit", Type: "integer", Description: "The maximum number of submissions to list, up to 1000. Defaults to 100."},
+			{Name: "offset", Type: "integer", Description: "The number of submissions to skip."},
+		},
+		Responses: adminResponses,
+	},
+	"GET /admin/feedback/export": {
+		Summary: "Exports every matching feedback and survey submission as a CSV file, oldest first. After the id, username, form_id, and submitted_at columns, each top-level answer gets a column, sorted by name. String answers are written as is and other answers as JSON.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "form_id", Type: "string", Description: "Only export the responses to this form."},
+			{Name: "username", Type: "string", Description: "Only export this user's submissions."},
+			{Name: "since", Type: "string", Description: "Only export submissions at or after this RFC 3339 time."},
+			{Name: "until", Type: "string", Description: "Only export submissions before this RFC 3339 time."},
+		},
+		Responses: map[int]string{
+			http.StatusOK:                  "The CSV file.",
+			http.StatusBadRequest:          "The filter is invalid.",
+			http.StatusUnauthorized:        "An admin API key is required.",
+			http.StatusForbidden:           "The API key is not an admin key.",
+			http.StatusInternalServerError: "The export could not be completed.",
+		},
+	},
+	"GET /admin/debug/pprof/": {
+		Summary: "Serves the net/http/pprof runtime profiles, e.g. /admin/debug/pprof/heap, when debug.pprof.enabled is set and debug.pprof.port isn't.",
+		Tag:     "admin",
+		Responses: map[int]string{
+			http.StatusOK:           "The profile, or an index of the profiles.",
+			http.StatusUnauthorized: "An admin API key is required.",
+			http.StatusForbidden:    "The API key is not an admin key.",
+		},
+	},
+	"GET /admin/backup": {
+		Summary: "Backs up the users' data as a JSON object with the rows of each table, read in one transaction. Webhooks, the audit log, and idempotency keys aren't included.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "username", Type: "string", Description: "Only back up the rows of the user with this stored username, which for bags includes the user domain. May be repeated."},
+		},
+		Responses: map[int]string{
+			http.StatusOK:                  "The backup.",
+			http.StatusUnauthorized:        "An admin API key is required.",
+			http.StatusForbidden:           "The API key is not an admin key.",
+			http.StatusInternalServerError: "The backup could not be started.",
+		},
+	},
+	"POST /admin/restore": {
+		Summary:     "Restores a backup, or a user data export in JSON, replacing everything stored for each user in it in one transaction.",
+		Tag:         "admin",
+		RequestBody: "application/json",
+		Query: []apiParam{
+			{Name: "username", Type: "string", Description: "Only restore the rows of the user with this stored username, which for bags includes the user domain. May be repeated."},
+		},
+		Responses: map[int]string{
+			http.StatusOK:                  "The number of rows restored to each table.",
+			http.StatusBadRequest:          "The backup is malformed.",
+			http.StatusUnauthorized:        "An admin API key is required.",
+			http.StatusForbidden:           "The API key is not an admin key.",
+			http.StatusConflict:            "A restored row conflicts with another user's data, such as a bag with the same ID.",
+			http.StatusInternalServerError: "Nothing was restored because an error occurred.",
+		},
+	},
+	"GET /admin/webhooks/dead-letters": {
+		Summary: "Lists a page of the events that couldn't be delivered, newest first, in the standard page envelope.",
+		Tag:     "admin",
+		Query: []apiParam{
+			{Name: "limit", Type: "integer", Description: "The maximum number of events to list. Defaults to 100."},
+			{Name: "offset", Type: "integer", Description: "The number of events to skip."},
+		},
+		Responses: adminResponses,
+	},
+}
+
+// The types below are the subset of the OpenAPI 3 document structure that the
+// service uses.
+
+type openAPISpec struct {
+	OpenAPI string                                 `json:"openapi"`
+	Info    openAPIInfo                            `json:"info"`
+	Paths   map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required"`
+	Schema      openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Type string `json:"type"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+// pathVarRE matches the variables in a mux path template, including any
+// regular expression after the name.
+var pathVarRE = regexp.MustCompile(`\{([^}:]+)(?::[^}]*)?\}`)
+
+// apiRoute is a method and path template registered on the router.
+type apiRoute struct {
+	method string
+	path   string
+}
+
+// key returns the key for the route in apiOperations.
+func (r apiRoute) key() string {
+	return r.method + " " + r.path
+}
+
+// registeredRoutes returns every method and path template registered on the
+// router. Routes that don't restrict their methods are listed as GET routes.
+func registeredRoutes(router *mux.Router) ([]apiRoute, error) {
+	var routes []apiRoute
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		// Subrouters are walked separately; their own prefix routes have no handler.
+		if route.GetHandler() == nil {
+			return nil
+		}
+
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		path := pathVarRE.ReplaceAllString(tmpl, "{$1}")
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+
+		for _, method := range methods {
+			routes = append(routes, apiRoute{method: method, path: path})
+		}
+		return nil
+	})
+
+	return routes, err
+}
+
+// buildOpenAPISpec returns an OpenAPI 3 specification describing the routes
+// registered on the router, using apiOperations for the details.
+func buildOpenAPISpec(router *mux.Router) (*openAPISpec, error) {
+	version := appver
+	if version == "" {
+		version = "dev"
+	}
+
+	spec := &openAPISpec{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: serviceName, Version: version},
+		Paths:   make(map[string]map[string]openAPIOperation),
+	}
+
+	routes, err := registeredRoutes(router)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		op := apiOperations[route.key()]
+
+		operation := openAPIOperation{
+			Summary:   op.Summary,
+			Responses: make(map[string]openAPIResponse),
+		}
+		if op.Tag != "" {
+			operation.Tags = []string{op.Tag}
+		}
+
+		for _, match := range pathVarRE.FindAllStringSubmatch(route.path, -1) {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:     match[1],
+				In:       "path",
+				Required: true,
+				Schema:   openAPISchema{Type: "string"},
+			})
+		}
+
+		for _, param := range op.Query {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        param.Name,
+				In:          "query",
+				Description: param.Description,
+				Schema:      openAPISchema{Type: param.Type},
+			})
+		}
+
+		if strings.Contains(route.path, "{username}") {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        normalizeUsernameParam,
+				In:          "query",
+				Description: "Set to false to keep a short username from having the user domain appended.",
+				Schema:      openAPISchema{Type: "boolean"},
+			})
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        userDomainHeader,
+				In:          "header",
+				Description: "Overrides the user domain appended to a short username. Only callers with one of the API keys in users.domain_override_keys may send it.",
+				Schema:      openAPISchema{Type: "string"},
+			})
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        impersonateUserHeader,
+				In:          "header",
+				Description: "Acts on the data of this user instead of the one in the path, which is recorded in the audit log as the impersonator. Only callers with one of the API keys in auth.admin_keys may send it.",
+				Schema:      openAPISchema{Type: "string"},
+			})
+		}
+
+		if route.method == http.MethodPost || route.method == http.MethodPut {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        idempotencyKeyHeader,
+				In:          "header",
+				Description: "Replays the original response when the request is retried with the same key.",
+				Schema:      openAPISchema{Type: "string"},
+			})
+		}
+
+		if op.RequestBody != "" {
+			operation.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content: map[string]openAPIMediaType{
+					op.RequestBody: {Schema: openAPISchema{Type: "object"}},
+				},
+			}
+		}
+
+		responses := op.Responses
+		if op.RequestBody != "" {
+			responses = make(map[int]string, len(op.Responses)+1)
+			for status, description := range op.Responses {
+				responses[status] = description
+			}
+			responses[http.StatusUnsupportedMediaType] = "The request body is not " + op.RequestBody + "."
+		}
+
+		for status, description := range responses {
+			response := openAPIResponse{Description: description}
+			if status >= http.StatusBadRequest {
+				response.Content = map[string]openAPIMediaType{httpapi.ProblemContentType: {Schema: openAPISchema{Type: "object"}}}
+			}
+			operation.Responses[strconv.Itoa(status)] = response
+		}
+		if len(operation.Responses) == 0 {
+			operation.Responses["default"] = openAPIResponse{Description: "The response."}
+		}
+
+		if spec.Paths[route.path] == nil {
+			spec.Paths[route.path] = make(map[string]openAPIOperation)
+		}
+		spec.Paths[route.path][strings.ToLower(route.method)] = operation
+	}
+
+	return spec, nil
+}
+
+// undocumentedRoutes returns the keys of the routes on the router that don't
+// have an entry in apiOperations, sorted.
+func undocumentedRoutes(router *mux.Router) ([]string, error) {
+	routes, err := registeredRoutes(router)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, route := range routes {
+		if _, ok := apiOperations[route.key()]; !ok {
+			missing = append(missing, route.key())
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at /openapi.json.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>user-info API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = function() {
+      window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+    };
+  </script>
+</body>
+</html>
+`
+
+// registerOpenAPI adds the /openapi.json route to the router, along with
+// Swagger UI at /docs if swaggerUI is true. The specification is built from the
+// router when it's requested, so it always lists the routes that are
+// registered.
+func registerOpenAPI(router *mux.Router, swaggerUI bool) {
+	router.HandleFunc("/openapi.json", func(writer http.ResponseWriter, r *http.Request) {
+		spec, err := buildOpenAPISpec(router)
+		if err != nil {
+			httpapi.Errored(writer, fmt.Sprintf("error building the OpenAPI specification: %s", err))
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(writer).Encode(spec); err != nil {
+			log.Error(err)
+		}
+	}).Methods(http.MethodGet)
+
+	if swaggerUI {
+		router.HandleFunc("/docs", func(writer http.ResponseWriter, r *http.Request) {
+			writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(writer, swaggerUIPage)
+		}).Methods(http.MethodGet)
+	}
+}
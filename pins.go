@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// PinsApp manages the items users pin, such as apps, folders, and analyses,
+// which are kept in the order the user chooses. Unlike favorites, only a few
+// items of each type can be pinned.
+type PinsApp struct {
+	pins   *PinsDB
+	limits map[string]int
+	types  []string
+	router *mux.Router
+}
+
+// NewPinsApp returns a new *PinsApp. limits has the types of item that can be
+// pinned, with the most items of each type a user can pin.
+func NewPinsApp(db *PinsDB, limits map[string]int, router *mux.Router) *PinsApp {
+	pinsApp := &PinsApp{
+		pins:   db,
+		limits: limits,
+		router: moduleRouter(router, "pins", "/pins"),
+	}
+	for itemType := range limits {
+		pinsApp.types = append(pinsApp.types, itemType)
+	}
+	sort.Strings(pinsApp.types)
+
+	pinsApp.router.HandleFunc("/{username}", pinsApp.GetRequest).Methods(http.MethodGet)
+	pinsApp.router.HandleFunc("/{username}", pinsApp.DeleteRequest).Methods(http.MethodDelete)
+	pinsApp.router.HandleFunc("/{username}/{type}", pinsApp.GetTypeRequest).Methods(http.MethodGet)
+	pinsApp.router.HandleFunc("/{username}/{type}", pinsApp.PostTypeRequest).Methods(http.MethodPost)
+	pinsApp.router.HandleFunc("/{username}/{type}", pinsApp.PutTypeRequest).Methods(http.MethodPut)
+	pinsApp.router.HandleFunc("/{username}/{type}", pinsApp.DeleteTypeRequest).Methods(http.MethodDelete)
+	return pinsApp
+}
+
+// pinType returns the item type in the request's URL, responding with a 400
+// and returning false if items of that type can't be pinned.
+func (p *PinsApp) pinType(writer http.ResponseWriter, r *http.Request) (string, bool) {
+	itemType := mux.Vars(r)["type"]
+	if _, ok := p.limits[itemType]; !ok {
+		httpapi.BadRequest(writer, fmt.Sprintf("items of type %q can't be pinned; expected one of %s", itemType, strings.Join(p.types, ", ")))
+		return "", false
+	}
+	return itemType, true
+}
+
+// GetRequest lists the user's pinned items of every type, in order, as
+// {"pins": {type: [...]}}.
+func (p *PinsApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, p.pins.isUser)
+	if !ok {
+		return
+	}
+
+	pins, err := p.pins.getPins(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the pinned items of user %s: %s", username, err))
+		return
+	}
+
+	byType := make(map[string][]Pin, len(p.types))
+	for _, itemType := range p.types {
+		byType[itemType] = []Pin{}
+		if pins[itemType] != nil {
+			byType[itemType] = pins[itemType]
+		}
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"pins": byType})
+}
+
+// GetTypeRequest lists the user's pinned items of the type, in order, as
+// {"pins": [...]}.
+func (p *PinsApp) GetTypeRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, p.pins.isUser)
+	if !ok {
+		return
+	}
+	itemType, ok := p.pinType(writer, r)
+	if !ok {
+		return
+	}
+
+	pins, err := p.pins.getPins(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the pinned items of user %s: %s", username, err))
+		return
+	}
+
+	ofType := pins[itemType]
+	if ofType == nil {
+		ofType = []Pin{}
+	}
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"pins": ofType})
+}
+
+// PostTypeRequest pins the item with the id in the body after the user's other
+// pinned items of the type. The response is the pin, with a 201 if the item
+// wasn't already pinned. Pinning more items than the type's limit is a 409.
+func (p *PinsApp) PostTypeRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, p.pins.isUser)
+	if !ok {
+		return
+	}
+	itemType, ok := p.pinType(writer, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID string `json:"id"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+	if problem := validResourceID(body.ID); problem != "" {
+		httpapi.InvalidFields(writer, map[string]string{"id": problem})
+		return
+	}
+
+	limit := p.limits[itemType]
+	pin, created, err := p.pins.addPin(r.Context(), username, itemType, body.ID, limit)
+	if errors.Is(err, errPinLimitReached) {
+		msg := fmt.Sprintf("user %s already has %d pinned items of type %s", username, limit, itemType)
+		httpapi.WriteProblem(writer, http.StatusConflict, httpapi.CodeLimitReached, msg, map[string]interface{}{
+			"limit": limit,
+		})
+		return
+	}
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error pinning %s %s for user %s: %s", itemType, body.ID, username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, pin)
+}
+
+// PutTypeRequest reorders the user's pinned items of the type. The body is
+// {"ids": [...]}, listing each of the pinned items once in their new order.
+// The response lists the reordered pins as {"pins": [...]}.
+func (p *PinsApp) PutTypeRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, p.pins.isUser)
+	if !ok {
+		return
+	}
+	itemType, ok := p.pinType(writer, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+
+	pins, err := p.pins.reorderPins(r.Context(), username, itemType, body.IDs)
+	if errors.Is(err, errPinOrderMismatch) {
+		httpapi.InvalidFields(writer, map[string]string{"ids": fmt.Sprintf("must list each pinned item of type %s once", itemType)})
+		return
+	}
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error reordering the pinned items of type %s for user %s: %s", itemType, username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"pins": pins})
+}
+
+// DeleteTypeRequest unpins the item with the ID in the id query parameter,
+// moving the user's pinned items after it up.
+func (p *PinsApp) DeleteTypeRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, p.pins.isUser)
+	if !ok {
+		return
+	}
+	itemType, ok := p.pinType(writer, r)
+	if !ok {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if problem := validResourceID(id); problem != "" {
+		httpapi.BadRequest(writer, problem)
+		return
+	}
+
+	deleted, err := p.pins.removePin(r.Context(), username, itemType, id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error unpinning %s %s for user %s: %s", itemType, id, username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has not pinned %s %s", username, itemType, id))
+	}
+}
+
+// DeleteRequest unpins all of the user's items.
+func (p *PinsApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, p.pins.isUser)
+	if !ok {
+		return
+	}
+
+	if _, err := p.pins.deletePins(r.Context(), username); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error unpinning the items of user %s: %s", username, err))
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/lib/pq"
+)
+
+// Errors returned when pins can't be changed as requested.
+var (
+	errPinLimitReached  = errors.New("the most items of the type are already pinned")
+	errPinOrderMismatch = errors.New("the reordered IDs aren't the pinned IDs")
+)
+
+// Pin is an item that a user pinned, such as an app, folder, or analysis.
+// Position is the item's place among the pinned items of its type, from 0.
+type Pin struct {
+	ID       string    `json:"id"`
+	Position int       `json:"position"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// PinsDB handles interacting with the user_pins table.
+type PinsDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewPinsDB returns a newly created *PinsDB. Reads are cached in cache, which
+// may be nil to disable caching.
+func NewPinsDB(db *sql.DB, cache Cache) *PinsDB {
+	return &PinsDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func pinsKey(username string) string {
+	return cacheKey("pins", "pinned", username)
+}
+
+// isUser returns whether or not the user is present in the database.
+func (p *PinsDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, p.cache, p.db, username)
+}
+
+// getPins returns the user's pinned items keyed by type, in order.
+func (p *PinsDB) getPins(ctx context.Context, username string) (map[string][]Pin, error) {
+	if pins, ok := cacheGet[map[string][]Pin](ctx, p.cache, pinsKey(username)); ok {
+		return pins, nil
+	}
+
+	query, args := userRows("user_pins", "p", username, "p.item_type", "p.item_id", "p.position", "p.pinned_at").
+		OrderBy("p.item_type", "p.position").
+		SQL()
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := make(map[string][]Pin)
+	for rows.Next() {
+		var (
+			itemType string
+			pin      Pin
+		)
+		if err = rows.Scan(&itemType, &pin.ID, &pin.Position, &pin.PinnedAt); err != nil {
+			return nil, err
+		}
+		pins[itemType] = append(pins[itemType], pin)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cacheSet(ctx, p.cache, pinsKey(username), pins)
+	return pins, nil
+}
+
+// lockPins starts a transaction in which the user's pins can't be changed by
+// anyone else, and returns it with the user's ID. Locking the user's row
+// rather than their pins also covers users with nothing pinned yet.
+func (p *PinsDB) lockPins(ctx context.Context, username string) (*sql.Tx, string, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", dbError(err)
+	}
+
+	var userID string
+	if err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = $1 FOR NO KEY UPDATE`, username).Scan(&userID); err != nil {
+		tx.Rollback() // nolint:errcheck
+		return nil, "", dbError(err)
+	}
+
+	return tx, userID, nil
+}
+
+// pinsOfType returns the user's pinned items of the type, in order.
+func pinsOfType(ctx context.Context, tx *sql.Tx, userID, itemType string) ([]Pin, error) {
+	query := `SELECT item_id, position, pinned_at
+                FROM user_pins
+               WHERE user_id = $1 AND item_type = $2
+            ORDER BY position`
+
+	rows, err := tx.QueryContext(ctx, query, userID, itemType)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	pins := []Pin{}
+	for rows.Next() {
+		var pin Pin
+		if err = rows.Scan(&pin.ID, &pin.Position, &pin.PinnedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+
+	return pins, dbError(rows.Err())
+}
+
+// addPin pins the item after the user's other pinned items of its type, unless
+// limit items of the type are already pinned. An item that's already pinned
+// keeps its place. Returns the pin and whether it's new.
+func (p *PinsDB) addPin(ctx context.Context, username, itemType, itemID string, limit int) (*Pin, bool, error) {
+	defer cacheInvalidate(ctx, p.cache, pinsKey(username))
+
+	tx, userID, err := p.lockPins(ctx, username)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	pins, err := pinsOfType(ctx, tx, userID, itemType)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, pin := range pins {
+		if pin.ID == itemID {
+			return &pin, false, nil
+		}
+	}
+	if len(pins) >= limit {
+		return nil, false, errPinLimitReached
+	}
+
+	query := `INSERT INTO user_pins (user_id, item_type, item_id, position)
+                   VALUES ($1, $2, $3, $4)
+                RETURNING pinned_at`
+
+	pin := Pin{ID: itemID, Position: len(pins)}
+	if err = tx.QueryRowContext(ctx, query, userID, itemType, itemID, pin.Position).Scan(&pin.PinnedAt); err != nil {
+		return nil, false, dbError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, false, dbError(err)
+	}
+
+	p.notify(ctx, Mutation{Module: "pins", Action: actionCreated, Username: username})
+	return &pin, true, nil
+}
+
+// removePin unpins the item, moving the items after it up. Returns whether the
+// item was pinned.
+func (p *PinsDB) removePin(ctx context.Context, username, itemType, itemID string) (bool, error) {
+	defer cacheInvalidate(ctx, p.cache, pinsKey(username))
+
+	tx, userID, err := p.lockPins(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	var position int
+	err = tx.QueryRowContext(ctx, `DELETE FROM ONLY user_pins WHERE user_id = $1 AND item_type = $2 AND item_id = $3 RETURNING position`,
+		userID, itemType, itemID).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, dbError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE user_pins SET position = position - 1 WHERE user_id = $1 AND item_type = $2 AND position > $3`,
+		userID, itemType, position); err != nil {
+		return false, dbError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return false, dbError(err)
+	}
+
+	p.notify(ctx, Mutation{Module: "pins", Action: actionDeleted, Username: username})
+	return true, nil
+}
+
+// reorderPins puts the user's pinned items of the type in the order of
+// itemIDs, which must list each of them once. Returns the reordered pins.
+func (p *PinsDB) reorderPins(ctx context.Context, username, itemType string, itemIDs []string) ([]Pin, error) {
+	defer cacheInvalidate(ctx, p.cache, pinsKey(username))
+
+	tx, userID, err := p.lockPins(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	pins, err := pinsOfType(ctx, tx, userID, itemType)
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) != len(itemIDs) {
+		return nil, errPinOrderMismatch
+	}
+	byID := make(map[string]Pin, len(pins))
+	for _, pin := range pins {
+		byID[pin.ID] = pin
+	}
+
+	reordered := make([]Pin, len(itemIDs))
+	for i, id := range itemIDs {
+		pin, ok := byID[id]
+		if !ok {
+			return nil, errPinOrderMismatch
+		}
+		delete(byID, id)
+		pin.Position = i
+		reordered[i] = pin
+	}
+
+	query := `UPDATE user_pins p
+                 SET position = o.position - 1
+                FROM unnest($3::text[]) WITH ORDINALITY AS o(item_id, position)
+               WHERE p.user_id = $1 AND p.item_type = $2 AND p.item_id = o.item_id`
+	if _, err = tx.ExecContext(ctx, query, userID, itemType, pq.Array(itemIDs)); err != nil {
+		return nil, dbError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, dbError(err)
+	}
+
+	p.notify(ctx, Mutation{Module: "pins", Action: actionUpdated, Username: username})
+	return reordered, nil
+}
+
+// deletePins unpins all of the user's items. Returns the number unpinned.
+func (p *PinsDB) deletePins(ctx context.Context, username string) (int64, error) {
+	defer cacheInvalidate(ctx, p.cache, pinsKey(username))
+
+	userID, err := queries.UserID(ctx, p.db, username)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := p.db.ExecContext(ctx, `DELETE FROM ONLY user_pins WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		p.notify(ctx, Mutation{Module: "pins", Action: actionDeleted, Username: username})
+	}
+	return deleted, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// pprofPrefix is the path the profiling endpoints are served under. The
+// net/http/pprof index expects to find profile names after it.
+const pprofPrefix = "/debug/pprof/"
+
+// pprofHandler returns a handler for the runtime profiling endpoints under
+// pprofPrefix.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pprofPrefix, pprof.Index)
+	mux.HandleFunc(pprofPrefix+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(pprofPrefix+"profile", pprof.Profile)
+	mux.HandleFunc(pprofPrefix+"symbol", pprof.Symbol)
+	mux.HandleFunc(pprofPrefix+"trace", pprof.Trace)
+	return mux
+}
+
+// registerPprof serves the profiling endpoints under /admin/debug/pprof/ on the
+// admin router returned by newAdminRouter, so they require an admin API key.
+func registerPprof(adminRouter *mux.Router) {
+	adminRouter.PathPrefix(pprofPrefix).Handler(http.StripPrefix("/admin", pprofHandler()))
+}
+
+// servePprof serves the profiling endpoints on their own port, which shouldn't
+// be exposed outside the cluster. It runs until the listener fails.
+func servePprof(port string) {
+	listener, err := listen(port)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Info("Serving pprof on ", listener.Addr())
+	log.Fatal(http.Serve(listener, pprofHandler()))
+}
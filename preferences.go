@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/cyverse-de/user-info/internal/httpapi"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
@@ -60,13 +61,13 @@ type UserPreferencesApp struct {
 func NewPrefsApp(db pDB, router *mux.Router) *UserPreferencesApp {
 	prefsApp := &UserPreferencesApp{
 		prefs:  db,
-		router: router,
+		router: moduleRouter(router, "preferences", "/preferences"),
 	}
-	prefsApp.router.HandleFunc("/preferences/", prefsApp.Greeting).Methods("GET")
-	prefsApp.router.HandleFunc("/preferences/{username}", prefsApp.GetRequest).Methods("GET")
-	prefsApp.router.HandleFunc("/preferences/{username}", prefsApp.PutRequest).Methods("PUT")
-	prefsApp.router.HandleFunc("/preferences/{username}", prefsApp.PostRequest).Methods("POST")
-	prefsApp.router.HandleFunc("/preferences/{username}", prefsApp.DeleteRequest).Methods("DELETE")
+	prefsApp.router.HandleFunc("/", prefsApp.Greeting).Methods("GET")
+	prefsApp.router.HandleFunc("/{username}", prefsApp.GetRequest).Methods("GET")
+	prefsApp.router.HandleFunc("/{username}", prefsApp.PutRequest).Methods("PUT")
+	prefsApp.router.HandleFunc("/{username}", prefsApp.PostRequest).Methods("POST")
+	prefsApp.router.HandleFunc("/{username}", prefsApp.DeleteRequest).Methods("DELETE")
 	return prefsApp
 }
 
@@ -117,7 +118,7 @@ func (u *UserPreferencesApp) GetRequest(writer http.ResponseWriter, r *http.Requ
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
@@ -125,18 +126,19 @@ func (u *UserPreferencesApp) GetRequest(writer http.ResponseWriter, r *http.Requ
 		"service": "preferences",
 	}).Info("Getting user preferences for ", username)
 	if userExists, err = u.prefs.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	jsoned, err := u.getUserPreferencesForRequest(ctx, username, false)
 	if err != nil {
-		errored(writer, err.Error())
+		httpapi.Errored(writer, err.Error())
+		return
 	}
 
 	writer.Write(jsoned) // nolint:errcheck
@@ -160,53 +162,51 @@ func (u *UserPreferencesApp) PostRequest(writer http.ResponseWriter, r *http.Req
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
 	if userExists, err = u.prefs.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	if hasPrefs, err = u.prefs.hasPreferences(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
 		return
 	}
 
-	var checked map[string]interface{}
 	bodyBuffer, err := io.ReadAll(r.Body)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error reading body: %s", err))
+		httpapi.ReadBodyError(writer, err)
 		return
 	}
 
-	if err = json.Unmarshal(bodyBuffer, &checked); err != nil {
-		errored(writer, fmt.Sprintf("Error parsing request body: %s", err))
+	if _, ok := httpapi.ReadObject(writer, bodyBuffer); !ok {
 		return
 	}
 
 	bodyString := string(bodyBuffer)
 	if !hasPrefs {
 		if err = u.prefs.insertPreferences(ctx, username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error inserting preferences for user %s: %s", username, err))
+			writeFailed(writer, err, fmt.Sprintf("Error inserting preferences for user %s: %s", username, err))
 			return
 		}
 	} else {
 		if err = u.prefs.updatePreferences(ctx, username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
+			writeFailed(writer, err, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
 			return
 		}
 	}
 
 	jsoned, err := u.getUserPreferencesForRequest(ctx, username, true)
 	if err != nil {
-		errored(writer, err.Error())
+		httpapi.Errored(writer, err.Error())
 		return
 	}
 
@@ -226,30 +226,31 @@ func (u *UserPreferencesApp) DeleteRequest(writer http.ResponseWriter, r *http.R
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
 	if userExists, err = u.prefs.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	if hasPrefs, err = u.prefs.hasPreferences(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
 		return
 	}
 
 	if !hasPrefs {
+		httpapi.NotFound(writer, fmt.Sprintf("No preferences are stored for user %s", username))
 		return
 	}
 
 	if err = u.prefs.deletePreferences(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("Error deleting preferences for user %s: %s", username, err))
+		writeFailed(writer, err, fmt.Sprintf("Error deleting preferences for user %s: %s", username, err))
 	}
 }
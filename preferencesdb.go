@@ -21,47 +21,61 @@ type pDB interface {
 // PrefsDB implements the DB interface for interacting with the user-preferences
 // database.
 type PrefsDB struct {
-	db *sql.DB
+	mutationNotifier
+
+	db    *retryingDB
+	stmts *stmtCache
+	cache Cache
 }
 
-// NewPrefsDB returns a newly created *PrefsDB.
-func NewPrefsDB(db *sql.DB) *PrefsDB {
+// NewPrefsDB returns a newly created *PrefsDB. Reads are cached in cache, which
+// may be nil to disable caching.
+func NewPrefsDB(db *sql.DB, cache Cache) *PrefsDB {
 	return &PrefsDB{
-		db: db,
+		db:    withRetries(db),
+		stmts: newStmtCache(withRetries(db)),
+		cache: cache,
 	}
 }
 
+func hasPreferencesKey(username string) string {
+	return cacheKey("prefs", "has", username)
+}
+
+func preferencesKey(username string) string {
+	return cacheKey("prefs", "records", username)
+}
+
 // isUser returns whether or not the user exists in the database preferences.
 func (p *PrefsDB) isUser(ctx context.Context, username string) (bool, error) {
-	return queries.IsUser(ctx, p.db, username)
+	return cachedIsUser(ctx, p.cache, p.stmts, username)
 }
 
 // hasPreferences returns whether or not the given user has preferences already.
 func (p *PrefsDB) hasPreferences(ctx context.Context, username string) (bool, error) {
-	query := `SELECT COUNT(p.*)
-              FROM user_preferences p,
-                   users u
-             WHERE p.user_id = u.id
-               AND u.username = $1`
+	if has, ok := cacheGet[bool](ctx, p.cache, hasPreferencesKey(username)); ok {
+		return has, nil
+	}
+
+	query, args := userRows("user_preferences", "p", username, "COUNT(p.*)").SQL()
 	var count int64
-	if err := p.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
+	if err := p.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
 		return false, err
 	}
+	cacheSet(ctx, p.cache, hasPreferencesKey(username), count > 0)
 	return count > 0, nil
 }
 
 // getPreferences returns a []UserPreferencesRecord of all of the preferences associated
 // with the provided username.
 func (p *PrefsDB) getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error) {
-	query := `SELECT p.id AS id,
-                   p.user_id AS user_id,
-                   p.preferences AS preferences
-              FROM user_preferences p,
-                   users u
-             WHERE p.user_id = u.id
-               AND u.username = $1`
-
-	rows, err := p.db.QueryContext(ctx, query, username)
+	if prefs, ok := cacheGet[[]UserPreferencesRecord](ctx, p.cache, preferencesKey(username)); ok {
+		return prefs, nil
+	}
+
+	query, args := userRows("user_preferences", "p", username, "p.id AS id", "p.user_id AS user_id", "p.preferences AS preferences").SQL()
+
+	rows, err := p.stmts.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -80,24 +94,53 @@ func (p *PrefsDB) getPreferences(ctx context.Context, username string) ([]UserPr
 		return prefs, err
 	}
 
+	cacheSet(ctx, p.cache, preferencesKey(username), prefs)
 	return prefs, nil
 }
 
-func (p *PrefsDB) mutation(ctx context.Context, query, username string, args ...interface{}) error {
+// mutation runs a write query for the user with the user's ID as the first
+// argument, then notifies the observers of the action.
+func (p *PrefsDB) mutation(ctx context.Context, action, query, username string, args ...interface{}) error {
+	defer cacheInvalidate(ctx, p.cache, hasPreferencesKey(username), preferencesKey(username))
+
 	userID, err := queries.UserID(ctx, p.db, username)
 	if err != nil {
 		return err
 	}
+
+	m := Mutation{Module: "preferences", Action: action, Username: username}
+	if action != actionCreated {
+		m.Before = p.previous(ctx, userID)
+	}
+
 	allargs := append([]interface{}{userID}, args...)
-	_, err = p.db.ExecContext(ctx, query, allargs...)
-	return err
+	if _, err = p.db.ExecContext(ctx, query, allargs...); err != nil {
+		return dbError(err)
+	}
+
+	if action != actionDeleted && len(args) > 0 {
+		if prefs, ok := args[0].(string); ok {
+			m.After = summarizeDocument(prefs)
+		}
+	}
+	p.notify(ctx, m)
+	return nil
+}
+
+// previous summarizes the preferences about to be replaced if anything is
+// observing the writes.
+func (p *PrefsDB) previous(ctx context.Context, userID string) *DocumentSummary {
+	if !p.observed() {
+		return nil
+	}
+	return readSummary(ctx, p.db, `SELECT preferences FROM ONLY user_preferences WHERE user_id = $1`, userID)
 }
 
 // insertPreferences adds new preferences to the database for the user.
 func (p *PrefsDB) insertPreferences(ctx context.Context, username, prefs string) error {
 	query := `INSERT INTO user_preferences (user_id, preferences)
                  VALUES ($1, $2)`
-	return p.mutation(ctx, query, username, prefs)
+	return p.mutation(ctx, actionCreated, query, username, prefs)
 }
 
 // updatePreferences updates the preferences in the database for the user.
@@ -105,11 +148,11 @@ func (p *PrefsDB) updatePreferences(ctx context.Context, username, prefs string)
 	query := `UPDATE ONLY user_preferences
                     SET preferences = $2
                   WHERE user_id = $1`
-	return p.mutation(ctx, query, username, prefs)
+	return p.mutation(ctx, actionUpdated, query, username, prefs)
 }
 
 // deletePreferences deletes the user's preferences from the database.
 func (p *PrefsDB) deletePreferences(ctx context.Context, username string) error {
 	query := `DELETE FROM ONLY user_preferences WHERE user_id = $1`
-	return p.mutation(ctx, query, username)
+	return p.mutation(ctx, actionDeleted, query, username)
 }
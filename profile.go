@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// profileFields are the attributes that a profile source provides.
+var profileFields = []string{"name", "email", "institution"}
+
+// ProfileAttributes are the attributes of a user kept by the identity
+// provider.
+type ProfileAttributes struct {
+	Name        string `json:"name,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Institution string `json:"institution,omitempty"`
+}
+
+// UserProfile combines the user's row in the users table with their
+// attributes from the identity provider. ID is empty if nothing is stored for
+// the user in this service.
+type UserProfile struct {
+	User string `json:"user"`
+	ID   string `json:"id,omitempty"`
+	ProfileAttributes
+}
+
+// profileSource looks up users' attributes in an identity provider. It returns
+// nil if the provider doesn't know the user.
+type profileSource interface {
+	profileAttributes(ctx context.Context, username string) (*ProfileAttributes, error)
+}
+
+// clientCredentials gets access tokens with the OAuth 2 client credentials
+// grant, such as for a Keycloak service account, and keeps them until shortly
+// before they expire.
+type clientCredentials struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// accessToken returns a current access token, requesting a new one if needed.
+func (c *clientCredentials) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{c.clientID},
+		"client_secret": []string{c.clientSecret},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("error requesting an access token: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the token endpoint returned status %d", response.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error decoding the access token: %w", err)
+	}
+
+	// Tokens are renewed 30 seconds early so that they don't expire in
+	// flight.
+	c.token = result.AccessToken
+	c.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - 30*time.Second)
+	return c.token, nil
+}
+
+// HTTPProfileSource looks up users' attributes with an HTTP GET that returns
+// JSON, such as an OIDC provider's admin API or an LDAP REST gateway. The
+// response may be an object or an array of objects, in which case the first
+// one is used, and an empty array or a 404 means the user isn't known.
+type HTTPProfileSource struct {
+	urlTemplate string
+	client      *http.Client
+	credentials *clientCredentials
+	paths       map[string][]string
+}
+
+// NewHTTPProfileSource returns a new *HTTPProfileSource that sends requests to
+// urlTemplate with {username} replaced by the username without its domain.
+// paths maps each of the profile fields to the dotted paths of the values in
+// the response that make it up, which are joined with spaces, e.g.
+// "firstName lastName". credentials may be nil if no access token is needed.
+func NewHTTPProfileSource(urlTemplate string, timeout time.Duration, credentials *clientCredentials, paths map[string][]string) (*HTTPProfileSource, error) {
+	if !strings.Contains(urlTemplate, "{username}") {
+		return nil, fmt.Errorf("profile.url must contain {username}: %s", urlTemplate)
+	}
+	if _, err := url.Parse(strings.ReplaceAll(urlTemplate, "{username}", "username")); err != nil {
+		return nil, fmt.Errorf("invalid profile.url: %w", err)
+	}
+
+	return &HTTPProfileSource{
+		urlTemplate: urlTemplate,
+		client:      &http.Client{Timeout: timeout},
+		credentials: credentials,
+		paths:       paths,
+	}, nil
+}
+
+// profileSourceFromConfig returns the profile source described by the
+// profile.* settings, or nil if profile.url isn't set.
+func profileSourceFromConfig(cfg *viper.Viper) (profileSource, error) {
+	urlTemplate := cfg.GetString("profile.url")
+	if urlTemplate == "" {
+		return nil, nil
+	}
+
+	timeout, err := time.ParseDuration(cfg.GetString("profile.timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid profile.timeout: %w", err)
+	}
+
+	var credentials *clientCredentials
+	if tokenURL := cfg.GetString("profile.token_url"); tokenURL != "" {
+		credentials = &clientCredentials{
+			tokenURL:     tokenURL,
+			clientID:     cfg.GetString("profile.client_id"),
+			clientSecret: cfg.GetString("profile.client_secret"),
+			client:       &http.Client{Timeout: timeout},
+		}
+	}
+
+	paths := make(map[string][]string, len(profileFields))
+	for _, field := range profileFields {
+		paths[field] = cfg.GetStringSlice("profile.attributes." + field)
+	}
+
+	return NewHTTPProfileSource(urlTemplate, timeout, credentials, paths)
+}
+
+// jsonPathValue returns the string form of the value at the dotted path in v.
+// Numeric path elements index arrays, and an array at the end of the path
+// gives its first element, since identity providers often return every
+// attribute as a list.
+func jsonPathValue(v interface{}, path string) string {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+
+	if list, ok := v.([]interface{}); ok {
+		if len(list) == 0 {
+			return ""
+		}
+		v = list[0]
+	}
+
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64, bool:
+		return fmt.Sprint(value)
+	default:
+		return ""
+	}
+}
+
+// attribute returns the value of the profile field in the response.
+func (h *HTTPProfileSource) attribute(v interface{}, field string) string {
+	var parts []string
+	for _, path := range h.paths[field] {
+		if value := jsonPathValue(v, path); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// profileAttributes looks up the user's attributes.
+func (h *HTTPProfileSource) profileAttributes(ctx context.Context, username string) (*ProfileAttributes, error) {
+	bare := regexp.MustCompile(`@.*$`).ReplaceAllString(username, "")
+	endpoint := strings.ReplaceAll(h.urlTemplate, "{username}", url.QueryEscape(bare))
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	if h.credentials != nil {
+		token, err := h.credentials.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up the profile for %s: %w", username, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the profile source returned status %d for %s", response.StatusCode, username)
+	}
+
+	var result interface{}
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding the profile for %s: %w", username, err)
+	}
+	if list, ok := result.([]interface{}); ok {
+		if len(list) == 0 {
+			return nil, nil
+		}
+		result = list[0]
+	}
+
+	return &ProfileAttributes{
+		Name:        h.attribute(result, "name"),
+		Email:       h.attribute(result, "email"),
+		Institution: h.attribute(result, "institution"),
+	}, nil
+}
+
+func profileKey(username string) string {
+	return cacheKey("profile", "attributes", username)
+}
+
+// ProfileApp serves user profiles, so that other services don't each have to
+// look users up in the identity provider.
+type ProfileApp struct {
+	db     *retryingDB
+	source profileSource
+	cache  Cache
+	router *mux.Router
+}
+
+// NewProfileApp returns a new *ProfileApp. source may be nil, in which case
+// profiles only have what's stored in this service. Attributes are cached in
+// cache, which may be nil to disable caching.
+func NewProfileApp(db *sql.DB, source profileSource, cache Cache, router *mux.Router) *ProfileApp {
+	profileApp := &ProfileApp{
+		db:     withRetries(db),
+		source: source,
+		cache:  cache,
+		router: moduleRouter(router, "profile", "/profile"),
+	}
+	profileApp.router.HandleFunc("/{username}", profileApp.GetProfile).Methods(http.MethodGet)
+	return profileApp
+}
+
+// attributes returns the user's attributes from the profile source, using
+// cached attributes if there are any. Users that the source doesn't know are
+// cached too, so that lookups of them don't all reach the source.
+func (p *ProfileApp) attributes(ctx context.Context, username string) (*ProfileAttributes, error) {
+	if p.source == nil {
+		return nil, nil
+	}
+	if attrs, ok := cacheGet[*ProfileAttributes](ctx, p.cache, profileKey(username)); ok {
+		return attrs, nil
+	}
+
+	attrs, err := p.source.profileAttributes(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	cacheSet(ctx, p.cache, profileKey(username), attrs)
+	return attrs, nil
+}
+
+// GetProfile returns the user's ID in this service along with their name,
+// email address, and institution from the identity provider. Users that
+// neither this service nor the identity provider know get a 404.
+func (p *ProfileApp) GetProfile(writer http.ResponseWriter, r *http.Request) {
+	var (
+		username string
+		ok       bool
+		v        = mux.Vars(r)
+		ctx      = r.Context()
+	)
+
+	if username, ok = v["username"]; !ok {
+		httpapi.BadRequest(writer, "Missing username in URL")
+		return
+	}
+
+	profile := UserProfile{User: username}
+
+	userID, err := queries.UserID(ctx, p.db, username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		httpapi.Errored(writer, fmt.Sprintf("Error looking up user %s: %s", username, err))
+		return
+	}
+	profile.ID = userID
+
+	attrs, err := p.attributes(ctx, username)
+	if err != nil {
+		httpapi.Error(writer, fmt.Sprintf("Error looking up the profile for %s: %s", username, err), http.StatusBadGateway)
+		log.WithContext(ctx).Error(err)
+		return
+	}
+
+	if attrs == nil && profile.ID == "" {
+		httpapi.UserNotFound(writer, username)
+		return
+	}
+	if attrs != nil {
+		profile.ProfileAttributes = *attrs
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, profile)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+)
+
+// selectQuery builds a SELECT statement from its clauses, so that filters,
+// sorting, and pagination can be added to a query without renumbering its
+// placeholders by hand. Conditions use ? for their arguments, which are
+// numbered in the order they're added, e.g. Where("b.id = ?", bagID). Since
+// every ? is a placeholder, conditions can't use the jsonb ? operators.
+type selectQuery struct {
+	columns []string
+	from    []string
+	where   []string
+	args    []interface{}
+	groupBy []string
+	orderBy []string
+	page    *httpapi.Page
+}
+
+// selectFrom starts a query for the columns of the table, which may include an
+// alias, e.g. "bags b".
+func selectFrom(table string, columns ...string) *selectQuery {
+	return &selectQuery{
+		columns: columns,
+		from:    []string{table},
+	}
+}
+
+// userRows starts a query for the columns of the rows in the table that
+// belong to the user. The table is aliased as alias and joined to the users
+// table, aliased as u.
+func userRows(table, alias, username string, columns ...string) *selectQuery {
+	return selectFrom(table+" "+alias, columns...).forUser(alias, username)
+}
+
+// forUser limits the query to the rows of the table aliased as alias that
+// belong to the user, by adding the users table to the FROM list as u.
+func (q *selectQuery) forUser(alias, username string) *selectQuery {
+	q.from = append(q.from, "users u")
+	return q.Where(alias+".user_id = u.id").Where("u.username = ?", username)
+}
+
+// Join joins another table to the last one in the FROM list.
+func (q *selectQuery) Join(table, on string) *selectQuery {
+	last := len(q.from) - 1
+	q.from[last] = fmt.Sprintf("%s JOIN %s ON %s", q.from[last], table, on)
+	return q
+}
+
+// Where adds a condition that the rows must meet, replacing each ? in it with
+// a placeholder for the matching argument.
+func (q *selectQuery) Where(condition string, args ...interface{}) *selectQuery {
+	var b strings.Builder
+	next := 0
+	for _, r := range condition {
+		if r == '?' && next < len(args) {
+			q.args = append(q.args, args[next])
+			fmt.Fprintf(&b, "$%d", len(q.args))
+			next++
+			continue
+		}
+		b.WriteRune(r)
+	}
+	q.where = append(q.where, b.String())
+	return q
+}
+
+// GroupBy groups the rows by the columns, so that the others can be
+// aggregated, e.g. "SUM(requests)".
+func (q *selectQuery) GroupBy(columns ...string) *selectQuery {
+	q.groupBy = columns
+	return q
+}
+
+// OrderBy sets the sort order of the rows.
+func (q *selectQuery) OrderBy(columns ...string) *selectQuery {
+	q.orderBy = columns
+	return q
+}
+
+// Page limits the query to a page of the rows.
+func (q *selectQuery) Page(page httpapi.Page) *selectQuery {
+	q.page = &page
+	return q
+}
+
+// Count returns a query for the number of rows the query matches, ignoring
+// its sort order and page. The rows of a grouped query are its groups.
+func (q *selectQuery) Count() *selectQuery {
+	if len(q.groupBy) > 0 {
+		inner := *q
+		inner.orderBy, inner.page = nil, nil
+		query, args := inner.SQL()
+		return &selectQuery{
+			columns: []string{"COUNT(*)"},
+			from:    []string{"(" + query + ") AS grouped"},
+			args:    args,
+		}
+	}
+
+	return &selectQuery{
+		columns: []string{"COUNT(*)"},
+		from:    append([]string{}, q.from...),
+		where:   append([]string{}, q.where...),
+		args:    append([]interface{}{}, q.args...),
+	}
+}
+
+// SQL returns the statement and its arguments.
+func (q *selectQuery) SQL() (string, []interface{}) {
+	var b strings.Builder
+	args := q.args
+
+	fmt.Fprintf(&b, "SELECT %s FROM %s", strings.Join(q.columns, ", "), strings.Join(q.from, ", "))
+	if len(q.where) > 0 {
+		b.WriteString(" WHERE " + strings.Join(q.where, " AND "))
+	}
+	if len(q.groupBy) > 0 {
+		b.WriteString(" GROUP BY " + strings.Join(q.groupBy, ", "))
+	}
+	if len(q.orderBy) > 0 {
+		b.WriteString(" ORDER BY " + strings.Join(q.orderBy, ", "))
+	}
+	if q.page != nil {
+		args = append(args[:len(args):len(args)], q.page.Limit, q.page.Offset)
+		fmt.Fprintf(&b, " LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	return b.String(), args
+}
+
+// ExistsSQL returns a statement that selects whether the query matches any
+// rows, and its arguments.
+func (q *selectQuery) ExistsSQL() (string, []interface{}) {
+	inner := *q
+	inner.columns = []string{"1"}
+	query, args := inner.SQL()
+	return "SELECT EXISTS(" + query + ") AS exists", args
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle is how long a client's limiter is kept around after its last
+// request.
+const rateLimitIdle = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter limits how often each client may make requests, using a token
+// bucket per username, or per client IP address for requests that aren't for
+// a particular user. Client addresses come from TrustedProxies when the service
+// is behind a proxy. A RateLimiter with a non-positive limit lets every request
+// through.
+type RateLimiter struct {
+	limit     rate.Limit
+	burst     int
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns a new *RateLimiter that allows each client
+// requestsPerSecond requests per second on average, with bursts of up to burst
+// requests.
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		limit:     rate.Limit(requestsPerSecond),
+		burst:     burst,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetLimit changes the rate and burst size allowed for each client, including
+// clients that have already made requests.
+func (l *RateLimiter) SetLimit(requestsPerSecond float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = rate.Limit(requestsPerSecond)
+	l.burst = burst
+
+	now := time.Now()
+	for _, c := range l.clients {
+		c.limiter.SetLimitAt(now, l.limit)
+		c.limiter.SetBurstAt(now, l.burst)
+	}
+}
+
+// enabled returns whether requests are being limited.
+func (l *RateLimiter) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit > 0
+}
+
+// rateLimitKey returns the key that a request is rate limited under.
+func rateLimitKey(r *http.Request) string {
+	if username := mux.Vars(r)["username"]; username != "" {
+		return "user:" + username
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+// limiter returns the limiter for the given key, creating it if necessary.
+// Limiters that haven't been used for a while are dropped.
+func (l *RateLimiter) limiter(key string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+
+	return c.limiter
+}
+
+// Middleware rejects requests from clients that have gone over their limit with
+// a 429 and a Retry-After header saying how many seconds to wait.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if !l.enabled() {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		now := time.Now()
+		key := rateLimitKey(r)
+
+		reservation := l.limiter(key, now).ReserveN(now, 1)
+		if !reservation.OK() {
+			httpapi.Error(writer, "rate limit exceeded", http.StatusTooManyRequests)
+			log.WithContext(r.Context()).Errorf("rate limit exceeded for %s", key)
+			return
+		}
+
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			httpapi.Error(writer, "rate limit exceeded", http.StatusTooManyRequests)
+			log.WithContext(r.Context()).Errorf("rate limit exceeded for %s", key)
+			return
+		}
+
+		next.ServeHTTP(writer, r)
+	})
+}
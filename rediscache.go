@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisCache is a Cache backed by Redis, so that every instance of the service
+// sees the same entries and invalidations.
+type redisCache struct {
+	client    redis.UniversalClient
+	namespace string
+	ttl       atomic.Int64
+}
+
+// newRedisCache returns a new *redisCache that stores its entries in Redis
+// under keys beginning with namespace.
+func newRedisCache(client redis.UniversalClient, namespace string, ttl time.Duration) *redisCache {
+	c := &redisCache{
+		client:    client,
+		namespace: namespace,
+	}
+	c.ttl.Store(int64(ttl))
+	return c
+}
+
+func (c *redisCache) key(key string) string {
+	return c.namespace + key
+}
+
+// Get returns the value stored under key.
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if c.ttl.Load() <= 0 {
+		return nil, false, nil
+	}
+
+	value, err := c.client.Get(ctx, c.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set stores value under key with the cache's TTL.
+func (c *redisCache) Set(ctx context.Context, key string, value []byte) error {
+	ttl := time.Duration(c.ttl.Load())
+	if ttl <= 0 {
+		return nil
+	}
+	return c.client.Set(ctx, c.key(key), value, ttl).Err()
+}
+
+// Delete removes the entries for the keys.
+func (c *redisCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	namespaced := make([]string, len(keys))
+	for i, key := range keys {
+		namespaced[i] = c.key(key)
+	}
+	return c.client.Del(ctx, namespaced...).Err()
+}
+
+// DeletePrefix removes every entry whose key starts with prefix.
+func (c *redisCache) DeletePrefix(ctx context.Context, prefix string) error {
+	iter := c.client.Scan(ctx, 0, c.key(prefix)+"*", 100).Iterator()
+
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.client.Del(ctx, keys...).Err()
+}
+
+// SetTTL changes how long new entries live. Entries that are already stored
+// keep their original expiration.
+func (c *redisCache) SetTTL(ttl time.Duration) {
+	c.ttl.Store(int64(ttl))
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cyverse-de/configurate"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// defaultCacheTTL is used when neither cache.ttl nor bags.cache_ttl is set.
+const defaultCacheTTL = "5s"
+
+// defaultJobsLockKey identifies the advisory lock that the replicas use to elect
+// the background job leader. It's "userinfo" in ASCII.
+const defaultJobsLockKey int64 = 0x75736572696e666f
+
+// setConfigDefaults sets the defaults for the service's settings.
+func setConfigDefaults(cfg *viper.Viper) {
+	cfg.SetDefault("log.level", "info")
+	cfg.SetDefault("log.format", "text")
+	cfg.SetDefault("bags.auto_create_default", true)
+	cfg.SetDefault("bags.purge_interval", "1h")
+	cfg.SetDefault("users.purge_interval", "1h")
+	cfg.SetDefault("sessions.prune_after", "")
+	cfg.SetDefault("sessions.prune_interval", "1h")
+	cfg.SetDefault("jobs.election_interval", "15s")
+	cfg.SetDefault("jobs.lock_key", defaultJobsLockKey)
+	cfg.SetDefault("cache.type", "memory")
+	cfg.SetDefault("cache.redis.namespace", "user-info:")
+	cfg.SetDefault("bags.validate_paths", false)
+	cfg.SetDefault("data_info.timeout", "10s")
+	cfg.SetDefault("profile.url", "")
+	cfg.SetDefault("profile.timeout", "10s")
+	cfg.SetDefault("profile.cache_ttl", "10m")
+	cfg.SetDefault("profile.token_url", "")
+	cfg.SetDefault("profile.attributes.name", "name")
+	cfg.SetDefault("profile.attributes.email", "email")
+	cfg.SetDefault("profile.attributes.institution", "institution")
+	cfg.SetDefault("avatars.max_size", "1mb")
+	cfg.SetDefault("avatars.cache_max_age", "5m")
+	cfg.SetDefault("notification_prefs.channels", []string{"email", "in_app", "webhook"})
+	cfg.SetDefault("notification_prefs.default_channels", []string{"email", "in_app"})
+	cfg.SetDefault("notification_prefs.event_types", []string{})
+	cfg.SetDefault("pins.limits", map[string]interface{}{"app": 25, "folder": 25, "analysis": 25})
+	cfg.SetDefault("tokens.scopes", []string{})
+	cfg.SetDefault("tokens.max_lifetime", "8760h")
+	cfg.SetDefault("user_webhooks.types", []string{"slack", "zapier", "custom"})
+	cfg.SetDefault("user_webhooks.topics", []string{})
+	cfg.SetDefault("user_webhooks.timeout", "10s")
+	cfg.SetDefault("user_webhooks.allow_private_addresses", false)
+	cfg.SetDefault("dashboard.widgets", []string{})
+	cfg.SetDefault("dashboard.columns", 3)
+	cfg.SetDefault("consents.purposes", []string{})
+	cfg.SetDefault("locale.default_timezone", "UTC")
+	cfg.SetDefault("locale.default_locale", "en-US")
+	cfg.SetDefault("auth.require_api_key", false)
+	cfg.SetDefault("openapi.swagger_ui", false)
+	cfg.SetDefault("rate_limit.requests_per_second", 0)
+	cfg.SetDefault("rate_limit.burst", 20)
+	cfg.SetDefault("http.max_body_size", "10mb")
+	cfg.SetDefault("http.require_content_type", true)
+	cfg.SetDefault("http.concurrency.max_in_flight", 0)
+	cfg.SetDefault("audit.enabled", true)
+	cfg.SetDefault("audit.queue_size", 1000)
+	cfg.SetDefault("usage.enabled", true)
+	cfg.SetDefault("usage.flush_interval", "1m")
+	cfg.SetDefault("usage.retention", "2160h")
+	cfg.SetDefault("usage.purge_interval", "1h")
+	cfg.SetDefault("webhooks.enabled", false)
+	cfg.SetDefault("webhooks.attempts", 5)
+	cfg.SetDefault("webhooks.backoff", "1s")
+	cfg.SetDefault("webhooks.timeout", "10s")
+	cfg.SetDefault("webhooks.queue_size", 1000)
+	cfg.SetDefault("idempotency.enabled", true)
+	cfg.SetDefault("idempotency.window", "24h")
+	cfg.SetDefault("idempotency.purge_interval", "1h")
+	cfg.SetDefault("debug.pprof.enabled", false)
+	cfg.SetDefault("debug.pprof.port", "")
+	cfg.SetDefault("admin.port", "")
+	cfg.SetDefault("db.retry.attempts", 3)
+	cfg.SetDefault("db.retry.backoff", "25ms")
+	cfg.SetDefault("db.retry.max_backoff", "1s")
+	cfg.SetDefault("db.retry.budget_ratio", 0.1)
+	cfg.SetDefault("db.retry.budget_burst", 10)
+	cfg.SetDefault("db.circuit_breaker.enabled", true)
+	cfg.SetDefault("db.circuit_breaker.failure_threshold", 5)
+	cfg.SetDefault("db.circuit_breaker.cooldown", "10s")
+	cfg.SetDefault("db.query_timeout", "30s")
+	cfg.SetDefault("db.statement_timeout", "")
+	cfg.SetDefault("db.schema", "")
+	cfg.SetDefault("config.watch_interval", "")
+	cfg.SetDefault("db.verify_schema", true)
+}
+
+// tunables are the settings that can be changed without restarting the service.
+type tunables struct {
+	logLevel       log.Level
+	logFormatter   log.Formatter
+	userDomain     string
+	userDomains    []string
+	cacheTTL       time.Duration
+	rateLimit      float64
+	rateLimitBurst int
+	maxBodySize    int64
+	queryTimeout   time.Duration
+	moduleStates   map[string]string
+}
+
+// loadTunables reads the tunable settings from the configuration.
+func loadTunables(cfg *viper.Viper) (*tunables, error) {
+	var (
+		t   tunables
+		err error
+	)
+
+	if t.logLevel, err = log.ParseLevel(cfg.GetString("log.level")); err != nil {
+		return nil, fmt.Errorf("invalid log.level: %w", err)
+	}
+	if t.logFormatter, err = logFormatter(cfg.GetString("log.format")); err != nil {
+		return nil, fmt.Errorf("invalid log.format: %w", err)
+	}
+
+	for _, domain := range cfg.GetStringSlice("users.domains") {
+		if domain = strings.Trim(domain, "@"); domain != "" {
+			t.userDomains = append(t.userDomains, domain)
+		}
+	}
+
+	// users.domain is the default domain. It falls back to the first of the
+	// accepted users.domains.
+	t.userDomain = strings.Trim(cfg.GetString("users.domain"), "@")
+	if t.userDomain == "" && len(t.userDomains) > 0 {
+		t.userDomain = t.userDomains[0]
+	}
+	if t.userDomain == "" {
+		t.userDomain = IplantSuffix
+	}
+
+	// bags.cache_ttl is the name used before every *DB type shared the cache.
+	// cache.ttl has no viper default because IsSet would always report it.
+	cacheTTLKey := "cache.ttl"
+	if !cfg.IsSet("cache.ttl") && cfg.IsSet("bags.cache_ttl") {
+		cacheTTLKey = "bags.cache_ttl"
+	}
+	cacheTTL := cfg.GetString(cacheTTLKey)
+	if cacheTTL == "" {
+		cacheTTL = defaultCacheTTL
+	}
+	if t.cacheTTL, err = time.ParseDuration(cacheTTL); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", cacheTTLKey, err)
+	}
+
+	t.rateLimit = cfg.GetFloat64("rate_limit.requests_per_second")
+	t.rateLimitBurst = cfg.GetInt("rate_limit.burst")
+	t.maxBodySize = int64(cfg.GetSizeInBytes("http.max_body_size"))
+
+	if t.queryTimeout, err = time.ParseDuration(cfg.GetString("db.query_timeout")); err != nil {
+		return nil, fmt.Errorf("invalid db.query_timeout: %w", err)
+	}
+
+	if t.moduleStates, err = moduleStatesFromConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Reloader applies changes to the tunable settings in the config file to the
+// running service.
+type Reloader struct {
+	mu          sync.Mutex
+	cfgPath     string
+	bags        *BagsApp
+	cache       Cache
+	rateLimiter *RateLimiter
+	bodySize    *BodySizeLimit
+	usernames   *UsernameNormalizer
+	timeout     *QueryTimeout
+}
+
+// NewReloader returns a new *Reloader that reads the config file at cfgPath
+// and applies the tunable settings in it to the given components. cache may be
+// nil if caching is disabled.
+func NewReloader(cfgPath string, bags *BagsApp, cache Cache, rateLimiter *RateLimiter, bodySize *BodySizeLimit, usernames *UsernameNormalizer, timeout *QueryTimeout) *Reloader {
+	return &Reloader{
+		cfgPath:     cfgPath,
+		bags:        bags,
+		cache:       cache,
+		rateLimiter: rateLimiter,
+		bodySize:    bodySize,
+		usernames:   usernames,
+		timeout:     timeout,
+	}
+}
+
+// apply applies the tunable settings. Settings that aren't tunable, such as
+// the database connection, are left alone.
+func (r *Reloader) apply(t *tunables) {
+	log.SetLevel(t.logLevel)
+	log.SetFormatter(t.logFormatter)
+	r.bags.SetUserDomains(t.userDomain, t.userDomains)
+	r.usernames.SetUserDomains(t.userDomain, t.userDomains)
+	if r.cache != nil {
+		r.cache.SetTTL(t.cacheTTL)
+	}
+	r.rateLimiter.SetLimit(t.rateLimit, t.rateLimitBurst)
+	r.bodySize.SetLimit(t.maxBodySize)
+	r.timeout.SetTimeout(t.queryTimeout)
+	moduleFlags.SetStates(t.moduleStates)
+}
+
+// Reload re-reads the config file and applies its tunable settings. Nothing is
+// changed if any of the settings are invalid.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := configurate.InitDefaults(r.cfgPath, configurate.JobServicesDefaults)
+	if err != nil {
+		return err
+	}
+	setConfigDefaults(cfg)
+
+	t, err := loadTunables(cfg)
+	if err != nil {
+		return err
+	}
+
+	r.apply(t)
+	return nil
+}
+
+// WatchSIGHUP reloads the configuration every time the process receives a
+// SIGHUP, until the context is cancelled. The signal handler is registered
+// before it returns, so a SIGHUP sent after that doesn't terminate the process.
+func (r *Reloader) WatchSIGHUP(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				log.Infof("reloading configuration from %s", r.cfgPath)
+				if err := r.Reload(); err != nil {
+					log.Errorf("unable to reload configuration: %s", err)
+					continue
+				}
+				log.Info("configuration reloaded")
+			}
+		}
+	}()
+}
+
+// fileChecksum returns the SHA-256 checksum of the config file's contents.
+func (r *Reloader) fileChecksum() ([]byte, error) {
+	contents, err := os.ReadFile(r.cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(contents)
+	return sum[:], nil
+}
+
+// WatchFile reloads the configuration whenever the contents of the config file
+// change, checking every interval until the context is cancelled. The file is
+// polled rather than watched with inotify because Kubernetes updates mounted
+// ConfigMaps and Secrets by swapping a symlink to a new directory, which a
+// watch on the file itself never sees. A change that can't be applied is
+// logged and skipped until the file changes again.
+func (r *Reloader) WatchFile(ctx context.Context, interval time.Duration) {
+	last, err := r.fileChecksum()
+	if err != nil {
+		log.Errorf("unable to read %s: %s", r.cfgPath, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sum, err := r.fileChecksum()
+			if err != nil {
+				log.Errorf("unable to read %s: %s", r.cfgPath, err)
+				continue
+			}
+			if bytes.Equal(sum, last) {
+				continue
+			}
+			last = sum
+
+			log.Infof("%s changed, reloading configuration", r.cfgPath)
+			if err = r.Reload(); err != nil {
+				log.Errorf("unable to reload configuration: %s", err)
+				continue
+			}
+			log.Info("configuration reloaded")
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Counters for the database retries, published in /debug/vars.
+var (
+	dbRetryCount     = expvar.NewInt("db_retries")
+	dbRetryExhausted = expvar.NewInt("db_retry_budget_exhausted")
+)
+
+// isTransient returns whether err is a database error that's likely to go
+// away if the statement is run again: serialization failures, deadlocks, the
+// server shutting down or starting up, and lost connections.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var code string
+
+	var pgErr *pgconn.PgError
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pgErr):
+		code = pgErr.Code
+	case errors.As(err, &pqErr):
+		code = string(pqErr.Code)
+	}
+
+	switch {
+	case code == "40001", code == "40P01": // serialization_failure, deadlock_detected
+		return true
+	case code == "57P01", code == "57P02", code == "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+		return true
+	case strings.HasPrefix(code, "08"): // connection_exception
+		return true
+	case code != "":
+		return false
+	}
+
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryBudget limits retries to a fraction of the calls made, so that retries
+// don't multiply the load on a database that's struggling. It holds up to max
+// tokens; every call adds ratio tokens and every retry takes one.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+// deposit records a call.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.max, b.tokens+b.ratio)
+}
+
+// withdraw takes a token for a retry. Returns false if there aren't any left.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// DBRetrier runs database calls again when they fail with transient errors,
+// waiting a random time of up to backoff before the first retry and doubling
+// the limit, up to maxBackoff, before each one after that.
+type DBRetrier struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	budget     *retryBudget
+}
+
+// NewDBRetrier returns a new *DBRetrier that tries each call up to attempts
+// times. Retries are limited to budgetRatio of the calls made, with bursts of
+// up to budgetBurst retries.
+func NewDBRetrier(attempts int, backoff, maxBackoff time.Duration, budgetRatio float64, budgetBurst int) *DBRetrier {
+	return &DBRetrier{
+		attempts:   attempts,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		budget: &retryBudget{
+			tokens: float64(budgetBurst),
+			max:    float64(budgetBurst),
+			ratio:  budgetRatio,
+		},
+	}
+}
+
+// dbRetrier is used by every retryingDB. main replaces it with one configured
+// from the db.retry settings.
+var dbRetrier = NewDBRetrier(3, 25*time.Millisecond, time.Second, 0.1, 10)
+
+// dbRetrierFromConfig returns a *DBRetrier configured from the db.retry
+// settings.
+func dbRetrierFromConfig(cfg *viper.Viper) (*DBRetrier, error) {
+	backoff, err := time.ParseDuration(cfg.GetString("db.retry.backoff"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid db.retry.backoff: %w", err)
+	}
+
+	maxBackoff, err := time.ParseDuration(cfg.GetString("db.retry.max_backoff"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid db.retry.max_backoff: %w", err)
+	}
+
+	attempts := cfg.GetInt("db.retry.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("db.retry.attempts must be at least 1")
+	}
+
+	return NewDBRetrier(attempts, backoff, maxBackoff, cfg.GetFloat64("db.retry.budget_ratio"), cfg.GetInt("db.retry.budget_burst")), nil
+}
+
+// do calls op until it succeeds, fails with an error that isn't transient,
+// runs out of attempts or retry budget, or the context is done. Calls aren't
+// made while dbBreaker is open.
+func (r *DBRetrier) do(ctx context.Context, op func() error) error {
+	r.budget.deposit()
+
+	limit := r.backoff
+	for attempt := 1; ; attempt++ {
+		if err := dbBreaker.allow(); err != nil {
+			return err
+		}
+		err := op()
+		dbBreaker.record(err)
+		if attempt >= r.attempts || !isTransient(err) {
+			return err
+		}
+
+		if !r.budget.withdraw() {
+			dbRetryExhausted.Add(1)
+			return err
+		}
+
+		wait := time.Duration(0)
+		if limit > 0 {
+			wait = time.Duration(rand.Int63n(int64(limit)))
+		}
+		log.WithContext(ctx).Warnf("retrying database call in %s after attempt %d of %d failed: %s", wait, attempt, r.attempts, err)
+		dbRetryCount.Add(1)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		if limit = limit * 2; limit > r.maxBackoff {
+			limit = r.maxBackoff
+		}
+	}
+}
+
+// retryingDB is a *sql.DB whose statements are retried by dbRetrier when they
+// fail with transient errors. Statements run in transactions aren't retried,
+// since the whole transaction would have to be run again. A lost connection
+// may be reported after a statement has taken effect, so statements that
+// are retried should be safe to run twice. Each statement gets a span that
+// covers all of its attempts.
+type retryingDB struct {
+	*sql.DB
+}
+
+// withRetries wraps the database so that its statements are retried.
+func withRetries(db *sql.DB) *retryingDB {
+	return &retryingDB{DB: db}
+}
+
+// ExecContext runs a statement that doesn't return rows.
+func (d *retryingDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startDBSpan(ctx, "exec", query)
+	var (
+		result   sql.Result
+		attempts int
+	)
+	err := dbRetrier.do(ctx, func() error {
+		var err error
+		attempts++
+		result, err = d.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	endDBSpan(span, attempts, err)
+	return result, err
+}
+
+// QueryContext runs a query that returns rows. Errors that happen while the
+// rows are being read aren't retried.
+func (d *retryingDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startDBSpan(ctx, "query", query)
+	var (
+		rows     *sql.Rows
+		attempts int
+	)
+	err := dbRetrier.do(ctx, func() error {
+		var err error
+		attempts++
+		rows, err = d.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	endDBSpan(span, attempts, err)
+	return rows, err
+}
+
+// QueryRowContext runs a query that returns at most one row.
+func (d *retryingDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startDBSpan(ctx, "query_row", query)
+	var (
+		row      *sql.Row
+		attempts int
+	)
+	err := dbRetrier.do(ctx, func() error {
+		attempts++
+		row = d.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	endDBSpan(span, attempts, err)
+	if row == nil {
+		row = d.DB.QueryRowContext(rejectedContext(ctx), query, args...)
+	}
+	return row
+}
+
+// rejectedContext returns a canceled context for running a query that
+// dbBreaker rejected. A *sql.Row can't be created with an error, so the query
+// is run with a context that makes it fail before a connection is used.
+func rejectedContext(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	return ctx
+}
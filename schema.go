@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// requiredColumns are the tables and columns that the service queries, which
+// the embedded migrations create.
+var requiredColumns = map[string][]string{
+	"users":                   {"id", "username", "deactivated_at", "deactivation_reason", "purge_at"},
+	"user_preferences":        {"id", "user_id", "preferences"},
+	"user_sessions":           {"id", "user_id", "session", "updated_at"},
+	"user_saved_searches":     {"id", "user_id", "saved_searches"},
+	"bags":                    {"id", "user_id", "contents", "expires_at"},
+	"default_bags":            {"user_id", "bag_id"},
+	"webhook_subscriptions":   {"id", "url", "secret", "event_types", "created_at"},
+	"webhook_dead_letters":    {"id", "subscription_id", "event", "error", "attempts", "created_at"},
+	"audit_log":               {"id", "created_at", "module", "action", "username", "bag_id", "actor", "impersonator", "request_id", "before", "after"},
+	"idempotency_keys":        {"key", "actor", "method", "path", "fingerprint", "status", "headers", "body", "created_at"},
+	"user_changes":            {"username", "module", "version", "changed_at"},
+	"user_usage":              {"username", "route", "day", "requests", "errors"},
+	"user_avatars":            {"user_id", "content_type", "image", "url", "updated_at"},
+	"user_tours":              {"user_id", "tour_id", "completed_at"},
+	"user_notification_prefs": {"user_id", "scope", "name", "enabled", "updated_at"},
+	"user_feedback":           {"id", "user_id", "form_id", "answers", "submitted_at"},
+	"user_pins":               {"user_id", "item_type", "item_id", "position", "pinned_at"},
+	"user_tags":               {"id", "user_id", "name", "created_at"},
+	"user_tokens":             {"id", "user_id", "name", "token_hash", "scopes", "created_at", "expires_at", "last_used_at"},
+	"user_tag_resources":      {"user_id", "tag_id", "resource_id", "attached_at"},
+	"user_webhooks":           {"id", "user_id", "url", "type", "topics", "created_at", "updated_at"},
+	"user_dashboard_widgets":  {"user_id", "widget_id", "grid_column", "grid_row", "collapsed", "updated_at"},
+	"user_consents":           {"id", "user_id", "purpose", "granted", "source", "recorded_at"},
+	"user_identities":         {"subject", "user_id", "created_at"},
+	"user_digest_schedules":   {"user_id", "frequency", "day", "hour", "timezone", "channels", "last_sent_at", "updated_at"},
+	"user_locales":            {"user_id", "timezone", "locale", "updated_at"},
+	"team_preferences":        {"team_id", "preferences", "updated_at"},
+}
+
+// schemaError lists the tables and columns missing from the database.
+type schemaError struct {
+	missing []string
+}
+
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("the database schema is missing %s; run the migrate command or start with -migrate", strings.Join(e.missing, ", "))
+}
+
+// verifySchema checks that every table and column in requiredColumns exists in
+// the schemas on the search path. It returns a *schemaError listing whatever is
+// missing, so that the service can refuse to start rather than failing on the
+// first request that uses it.
+func verifySchema(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT table_name, column_name
+		  FROM information_schema.columns
+		 WHERE table_schema = ANY(current_schemas(false))`)
+	if err != nil {
+		return fmt.Errorf("error reading the database schema: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err = rows.Scan(&table, &column); err != nil {
+			return fmt.Errorf("error reading the database schema: %w", err)
+		}
+		if found[table] == nil {
+			found[table] = make(map[string]bool)
+		}
+		found[table][column] = true
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error reading the database schema: %w", err)
+	}
+
+	var missing []string
+	for table, columns := range requiredColumns {
+		if found[table] == nil {
+			missing = append(missing, "table "+table)
+			continue
+		}
+		for _, column := range columns {
+			if !found[table][column] {
+				missing = append(missing, "column "+table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &schemaError{missing: missing}
+	}
+	return nil
+}
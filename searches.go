@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/cyverse-de/user-info/internal/httpapi"
 	"github.com/gorilla/mux"
 )
 
@@ -21,14 +22,13 @@ type SavedSearchesApp struct {
 func NewSearchesApp(db seDB, router *mux.Router) *SavedSearchesApp {
 	searchesApp := &SavedSearchesApp{
 		searches: db,
-		router:   router,
-	}
-	router.HandleFunc("/searches/", searchesApp.Greeting).Methods("GET")
-	router.HandleFunc("/searches/{username}", searchesApp.GetRequest).Methods("GET")
-	router.HandleFunc("/searches/{username}", searchesApp.PutRequest).Methods("PUT")
-	router.HandleFunc("/searches/{username}", searchesApp.PostRequest).Methods("POST")
-	router.HandleFunc("/searches/{username}", searchesApp.DeleteRequest).Methods("DELETE")
-	router.Handle("/debug/vars", http.DefaultServeMux)
+		router:   moduleRouter(router, "searches", "/searches"),
+	}
+	searchesApp.router.HandleFunc("/", searchesApp.Greeting).Methods("GET")
+	searchesApp.router.HandleFunc("/{username}", searchesApp.GetRequest).Methods("GET")
+	searchesApp.router.HandleFunc("/{username}", searchesApp.PutRequest).Methods("PUT")
+	searchesApp.router.HandleFunc("/{username}", searchesApp.PostRequest).Methods("POST")
+	searchesApp.router.HandleFunc("/{username}", searchesApp.DeleteRequest).Methods("DELETE")
 	return searchesApp
 }
 
@@ -50,22 +50,22 @@ func (s *SavedSearchesApp) GetRequest(writer http.ResponseWriter, r *http.Reques
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
 	if userExists, err = s.searches.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	if searches, err = s.searches.getSavedSearches(ctx, username); err != nil {
-		errored(writer, err.Error())
+		httpapi.Errored(writer, err.Error())
 		return
 	}
 
@@ -95,37 +95,36 @@ func (s *SavedSearchesApp) PostRequest(writer http.ResponseWriter, r *http.Reque
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
 	bodyBuffer, err := io.ReadAll(r.Body)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error reading body: %s", err))
+		httpapi.ReadBodyError(writer, err)
 		return
 	}
 
-	// Make sure valid JSON was uploaded in the body.
-	var parsedBody interface{}
-	if err = json.Unmarshal(bodyBuffer, &parsedBody); err != nil {
-		badRequest(writer, fmt.Sprintf("Error parsing body: %s", err.Error()))
+	// Make sure a JSON object was uploaded in the body.
+	parsedBody, ok := httpapi.ReadObject(writer, bodyBuffer)
+	if !ok {
 		return
 	}
 
 	bodyString := string(bodyBuffer)
 
 	if userExists, err = s.searches.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	if hasSearches, err = s.searches.hasSavedSearches(ctx, username); err != nil {
-		errored(writer, err.Error())
+		httpapi.Errored(writer, err.Error())
 		return
 	}
 
@@ -136,7 +135,7 @@ func (s *SavedSearchesApp) PostRequest(writer http.ResponseWriter, r *http.Reque
 		upsert = s.searches.insertSavedSearches
 	}
 	if err = upsert(ctx, username, bodyString); err != nil {
-		errored(writer, err.Error())
+		writeFailed(writer, err, err.Error())
 		return
 	}
 
@@ -145,7 +144,7 @@ func (s *SavedSearchesApp) PostRequest(writer http.ResponseWriter, r *http.Reque
 	}
 	jsoned, err := json.Marshal(retval)
 	if err != nil {
-		errored(writer, err.Error())
+		httpapi.Errored(writer, err.Error())
 		return
 	}
 
@@ -155,29 +154,41 @@ func (s *SavedSearchesApp) PostRequest(writer http.ResponseWriter, r *http.Reque
 // DeleteRequest handles deleting a user's saved searches.
 func (s *SavedSearchesApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
-		err        error
-		ok         bool
-		userExists bool
-		username   string
-		v          = mux.Vars(r)
-		ctx        = r.Context()
+		err         error
+		ok          bool
+		userExists  bool
+		hasSearches bool
+		username    string
+		v           = mux.Vars(r)
+		ctx         = r.Context()
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
 	if userExists, err = s.searches.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
+		httpapi.UserNotFound(writer, username)
+		return
+	}
+
+	if hasSearches, err = s.searches.hasSavedSearches(ctx, username); err != nil {
+		httpapi.Errored(writer, err.Error())
+		return
+	}
+
+	if !hasSearches {
+		httpapi.NotFound(writer, fmt.Sprintf("No saved searches are stored for user %s", username))
 		return
 	}
 
 	if err = s.searches.deleteSavedSearches(ctx, username); err != nil {
-		errored(writer, err.Error())
+		writeFailed(writer, err, err.Error())
 	}
 }
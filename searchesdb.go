@@ -21,58 +21,78 @@ type seDB interface {
 // SearchesDB implements the DB interface for interacting with the saved-searches
 // database.
 type SearchesDB struct {
-	db *sql.DB
+	mutationNotifier
+
+	db    *retryingDB
+	stmts *stmtCache
+	cache Cache
 }
 
-// NewSearchesDB returns a new *SearchesDB.
-func NewSearchesDB(db *sql.DB) *SearchesDB {
+// NewSearchesDB returns a new *SearchesDB. Reads are cached in cache, which may
+// be nil to disable caching.
+func NewSearchesDB(db *sql.DB, cache Cache) *SearchesDB {
 	return &SearchesDB{
-		db: db,
+		db:    withRetries(db),
+		stmts: newStmtCache(withRetries(db)),
+		cache: cache,
 	}
 }
 
+func hasSavedSearchesKey(username string) string {
+	return cacheKey("searches", "has", username)
+}
+
+func savedSearchesKey(username string) string {
+	return cacheKey("searches", "records", username)
+}
+
+// invalidate clears the cached reads for the user.
+func (se *SearchesDB) invalidate(ctx context.Context, username string) {
+	cacheInvalidate(ctx, se.cache, hasSavedSearchesKey(username), savedSearchesKey(username))
+}
+
 // isUser returns whether or not the user exists in the saved searches database.
 func (se *SearchesDB) isUser(ctx context.Context, username string) (bool, error) {
-	return queries.IsUser(ctx, se.db, username)
+	return cachedIsUser(ctx, se.cache, se.stmts, username)
 }
 
 // hasSavedSearches returns whether or not the given user has saved searches already.
 func (se *SearchesDB) hasSavedSearches(ctx context.Context, username string) (bool, error) {
+	if has, ok := cacheGet[bool](ctx, se.cache, hasSavedSearchesKey(username)); ok {
+		return has, nil
+	}
+
 	var (
 		err    error
 		exists bool
 	)
 
-	query := `SELECT EXISTS(
-              SELECT 1
-                FROM user_saved_searches s,
-                     users u
-               WHERE s.user_id = u.id
-                 AND u.username = $1) AS exists`
+	query, args := userRows("user_saved_searches", "s", username).ExistsSQL()
 
-	if err = se.db.QueryRowContext(ctx, query, username).Scan(&exists); err != nil {
+	if err = se.db.QueryRowContext(ctx, query, args...).Scan(&exists); err != nil {
 		return false, err
 	}
 
+	cacheSet(ctx, se.cache, hasSavedSearchesKey(username), exists)
 	return exists, nil
 }
 
 // getSavedSearches returns all of the saved searches associated with the
 // provided username.
 func (se *SearchesDB) getSavedSearches(ctx context.Context, username string) ([]string, error) {
+	if searches, ok := cacheGet[[]string](ctx, se.cache, savedSearchesKey(username)); ok {
+		return searches, nil
+	}
+
 	var (
 		err    error
 		retval []string
 		rows   *sql.Rows
 	)
 
-	query := `SELECT s.saved_searches saved_searches
-              FROM user_saved_searches s,
-                   users u
-             WHERE s.user_id = u.id
-               AND u.username = $1`
+	query, args := userRows("user_saved_searches", "s", username, "s.saved_searches saved_searches").SQL()
 
-	if rows, err = se.db.QueryContext(ctx, query, username); err != nil {
+	if rows, err = se.db.QueryContext(ctx, query, args...); err != nil {
 		return nil, err
 	}
 	defer rows.Close()
@@ -89,11 +109,14 @@ func (se *SearchesDB) getSavedSearches(ctx context.Context, username string) ([]
 		return nil, err
 	}
 
+	cacheSet(ctx, se.cache, savedSearchesKey(username), retval)
 	return retval, nil
 }
 
 // insertSavedSearches adds new saved searches to the database for the user.
 func (se *SearchesDB) insertSavedSearches(ctx context.Context, username, searches string) error {
+	defer se.invalidate(ctx, username)
+
 	var (
 		err    error
 		userID string
@@ -106,11 +129,18 @@ func (se *SearchesDB) insertSavedSearches(ctx context.Context, username, searche
 	}
 
 	_, err = se.db.ExecContext(ctx, query, userID, searches)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+
+	se.notify(ctx, Mutation{Module: "searches", Action: actionCreated, Username: username, After: summarizeDocument(searches)})
+	return nil
 }
 
 // updateSavedSearches updates the saved searches in the database for the user.
 func (se *SearchesDB) updateSavedSearches(ctx context.Context, username, searches string) error {
+	defer se.invalidate(ctx, username)
+
 	var (
 		err    error
 		userID string
@@ -122,12 +152,20 @@ func (se *SearchesDB) updateSavedSearches(ctx context.Context, username, searche
 		return err
 	}
 
+	before := se.previous(ctx, userID)
 	_, err = se.db.ExecContext(ctx, query, userID, searches)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+
+	se.notify(ctx, Mutation{Module: "searches", Action: actionUpdated, Username: username, Before: before, After: summarizeDocument(searches)})
+	return nil
 }
 
 // deleteSavedSearches removes the user's saved sessions from the database.
 func (se *SearchesDB) deleteSavedSearches(ctx context.Context, username string) error {
+	defer se.invalidate(ctx, username)
+
 	var (
 		err    error
 		userID string
@@ -136,9 +174,24 @@ func (se *SearchesDB) deleteSavedSearches(ctx context.Context, username string)
 	query := `DELETE FROM ONLY user_saved_searches WHERE user_id = $1`
 
 	if userID, err = queries.UserID(ctx, se.db, username); err != nil {
-		return nil
+		return err
 	}
 
+	before := se.previous(ctx, userID)
 	_, err = se.db.ExecContext(ctx, query, userID)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+
+	se.notify(ctx, Mutation{Module: "searches", Action: actionDeleted, Username: username, Before: before})
+	return nil
+}
+
+// previous summarizes the saved searches about to be replaced if anything is
+// observing the writes.
+func (se *SearchesDB) previous(ctx context.Context, userID string) *DocumentSummary {
+	if !se.observed() {
+		return nil
+	}
+	return readSummary(ctx, se.db, `SELECT saved_searches FROM ONLY user_saved_searches WHERE user_id = $1`, userID)
 }
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/cyverse-de/user-info/internal/httpapi"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,13 +23,13 @@ type UserSessionsApp struct {
 func NewSessionsApp(db sDB, router *mux.Router) *UserSessionsApp {
 	sessionsApp := &UserSessionsApp{
 		sessions: db,
-		router:   router,
+		router:   moduleRouter(router, "sessions", "/sessions"),
 	}
-	sessionsApp.router.HandleFunc("/sessions/", sessionsApp.Greeting).Methods("GET")
-	sessionsApp.router.HandleFunc("/sessions/{username}", sessionsApp.GetRequest).Methods("GET")
-	sessionsApp.router.HandleFunc("/sessions/{username}", sessionsApp.PutRequest).Methods("PUT")
-	sessionsApp.router.HandleFunc("/sessions/{username}", sessionsApp.PostRequest).Methods("POST")
-	sessionsApp.router.HandleFunc("/sessions/{username}", sessionsApp.DeleteRequest).Methods("DELETE")
+	sessionsApp.router.HandleFunc("/", sessionsApp.Greeting).Methods("GET")
+	sessionsApp.router.HandleFunc("/{username}", sessionsApp.GetRequest).Methods("GET")
+	sessionsApp.router.HandleFunc("/{username}", sessionsApp.PutRequest).Methods("PUT")
+	sessionsApp.router.HandleFunc("/{username}", sessionsApp.PostRequest).Methods("POST")
+	sessionsApp.router.HandleFunc("/{username}", sessionsApp.DeleteRequest).Methods("DELETE")
 	return sessionsApp
 }
 
@@ -78,7 +79,7 @@ func (u *UserSessionsApp) GetRequest(writer http.ResponseWriter, r *http.Request
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
@@ -86,18 +87,19 @@ func (u *UserSessionsApp) GetRequest(writer http.ResponseWriter, r *http.Request
 		"service": "sessions",
 	}).Info("Getting user session for ", username)
 	if userExists, err = u.sessions.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		badRequest(writer, fmt.Sprintf("User %s does not exist", username))
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	jsoned, err := u.getUserSessionForRequest(ctx, username, false)
 	if err != nil {
-		errored(writer, err.Error())
+		httpapi.Errored(writer, err.Error())
+		return
 	}
 
 	writer.Write(jsoned) // nolint:errcheck
@@ -121,53 +123,51 @@ func (u *UserSessionsApp) PostRequest(writer http.ResponseWriter, r *http.Reques
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
 	if userExists, err = u.sessions.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		badRequest(writer, fmt.Sprintf("User %s does not exist", username))
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	if hasSession, err = u.sessions.hasSessions(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error checking session for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error checking session for user %s: %s", username, err))
 		return
 	}
 
-	var checked map[string]interface{}
 	bodyBuffer, err := io.ReadAll(r.Body)
 	if err != nil {
-		errored(writer, fmt.Sprintf("error reading body: %s", err))
+		httpapi.ReadBodyError(writer, err)
 		return
 	}
 
-	if err = json.Unmarshal(bodyBuffer, &checked); err != nil {
-		errored(writer, fmt.Sprintf("error parsing request body: %s", err))
+	if _, ok := httpapi.ReadObject(writer, bodyBuffer); !ok {
 		return
 	}
 
 	bodyString := string(bodyBuffer)
 	if !hasSession {
 		if err = u.sessions.insertSession(ctx, username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("error inserting session for user %s: %s", username, err))
+			writeFailed(writer, err, fmt.Sprintf("error inserting session for user %s: %s", username, err))
 			return
 		}
 	} else {
 		if err = u.sessions.updateSession(ctx, username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("error updating session for user %s: %s", username, err))
+			writeFailed(writer, err, fmt.Sprintf("error updating session for user %s: %s", username, err))
 			return
 		}
 	}
 
 	jsoned, err := u.getUserSessionForRequest(ctx, username, true)
 	if err != nil {
-		errored(writer, err.Error())
+		httpapi.Errored(writer, err.Error())
 		return
 	}
 
@@ -187,30 +187,31 @@ func (u *UserSessionsApp) DeleteRequest(writer http.ResponseWriter, r *http.Requ
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		httpapi.BadRequest(writer, "Missing username in URL")
 		return
 	}
 
 	if userExists, err = u.sessions.isUser(ctx, username); err != nil {
-		badRequest(writer, fmt.Sprintf("error checking for username %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		badRequest(writer, fmt.Sprintf("User %s does not exist", username))
+		httpapi.UserNotFound(writer, username)
 		return
 	}
 
 	if hasSession, err = u.sessions.hasSessions(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error checking session for user %s: %s", username, err))
+		httpapi.Errored(writer, fmt.Sprintf("error checking session for user %s: %s", username, err))
 		return
 	}
 
 	if !hasSession {
+		httpapi.NotFound(writer, fmt.Sprintf("no session is stored for user %s", username))
 		return
 	}
 
 	if err = u.sessions.deleteSession(ctx, username); err != nil {
-		errored(writer, fmt.Sprintf("error deleting session for user %s: %s", username, err))
+		writeFailed(writer, err, fmt.Sprintf("error deleting session for user %s: %s", username, err))
 	}
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/cyverse-de/queries"
 )
@@ -59,47 +61,66 @@ type sDB interface {
 
 // SessionsDB handles interacting with the sessions database.
 type SessionsDB struct {
-	db *sql.DB
+	mutationNotifier
+
+	db    *retryingDB
+	stmts *stmtCache
+	cache Cache
 }
 
-// NewSessionsDB returns a newly created *SessionsDB
-func NewSessionsDB(db *sql.DB) *SessionsDB {
+// NewSessionsDB returns a newly created *SessionsDB. Reads are cached in cache,
+// which may be nil to disable caching.
+func NewSessionsDB(db *sql.DB, cache Cache) *SessionsDB {
 	return &SessionsDB{
-		db: db,
+		db:    withRetries(db),
+		stmts: newStmtCache(withRetries(db)),
+		cache: cache,
 	}
 }
 
+func hasSessionsKey(username string) string {
+	return cacheKey("sessions", "has", username)
+}
+
+func sessionsKey(username string) string {
+	return cacheKey("sessions", "records", username)
+}
+
+// invalidate clears the cached reads for the user.
+func (s *SessionsDB) invalidate(ctx context.Context, username string) {
+	cacheInvalidate(ctx, s.cache, hasSessionsKey(username), sessionsKey(username))
+}
+
 // isUser returnes whether or not the user is present in the sessions database.
 func (s *SessionsDB) isUser(ctx context.Context, username string) (bool, error) {
-	return queries.IsUser(ctx, s.db, username)
+	return cachedIsUser(ctx, s.cache, s.stmts, username)
 }
 
 // hasSessions returns whether or not the given user has a session already.
 func (s *SessionsDB) hasSessions(ctx context.Context, username string) (bool, error) {
-	query := `SELECT COUNT(s.*)
-              FROM user_sessions s,
-                   users u
-             WHERE s.user_id = u.id
-               AND u.username = $1`
+	if has, ok := cacheGet[bool](ctx, s.cache, hasSessionsKey(username)); ok {
+		return has, nil
+	}
+
+	query, args := userRows("user_sessions", "s", username, "COUNT(s.*)").SQL()
 	var count int64
-	if err := s.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
 		return false, err
 	}
+	cacheSet(ctx, s.cache, hasSessionsKey(username), count > 0)
 	return count > 0, nil
 }
 
 // getSessions returns a []UserSessionRecord of all of the sessions associated
 // with the provided username.
 func (s *SessionsDB) getSessions(ctx context.Context, username string) ([]UserSessionRecord, error) {
-	query := `SELECT s.id AS id,
-                   s.user_id AS user_id,
-                   s.session AS session
-              FROM user_sessions s,
-                   users u
-             WHERE s.user_id = u.id
-               AND u.username = $1`
-
-	rows, err := s.db.QueryContext(ctx, query, username)
+	if sessions, ok := cacheGet[[]UserSessionRecord](ctx, s.cache, sessionsKey(username)); ok {
+		return sessions, nil
+	}
+
+	query, args := userRows("user_sessions", "s", username, "s.id AS id", "s.user_id AS user_id", "s.session AS session").SQL()
+
+	rows, err := s.stmts.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -118,11 +139,14 @@ func (s *SessionsDB) getSessions(ctx context.Context, username string) ([]UserSe
 		return sessions, err
 	}
 
+	cacheSet(ctx, s.cache, sessionsKey(username), sessions)
 	return sessions, nil
 }
 
 // insertSession adds a new session to the database for the user.
 func (s *SessionsDB) insertSession(ctx context.Context, username, session string) error {
+	defer s.invalidate(ctx, username)
+
 	query := `INSERT INTO user_sessions (user_id, session)
                  VALUES ($1, $2)`
 	userID, err := queries.UserID(ctx, s.db, username)
@@ -130,29 +154,94 @@ func (s *SessionsDB) insertSession(ctx context.Context, username, session string
 		return err
 	}
 	_, err = s.db.ExecContext(ctx, query, userID, session)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+
+	s.notify(ctx, Mutation{Module: "sessions", Action: actionCreated, Username: username, After: summarizeDocument(session)})
+	return nil
 }
 
 // updateSession updates the session in the database for the user.
 func (s *SessionsDB) updateSession(ctx context.Context, username, session string) error {
+	defer s.invalidate(ctx, username)
+
 	query := `UPDATE ONLY user_sessions
-                    SET session = $2
+                    SET session = $2, updated_at = now()
                   WHERE user_id = $1`
 	userID, err := queries.UserID(ctx, s.db, username)
 	if err != nil {
 		return err
 	}
+	before := s.previous(ctx, userID)
 	_, err = s.db.ExecContext(ctx, query, userID, session)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+
+	s.notify(ctx, Mutation{Module: "sessions", Action: actionUpdated, Username: username, Before: before, After: summarizeDocument(session)})
+	return nil
 }
 
 // deleteSession deletes the user's session from the database.
 func (s *SessionsDB) deleteSession(ctx context.Context, username string) error {
+	defer s.invalidate(ctx, username)
+
 	query := `DELETE FROM ONLY user_sessions WHERE user_id = $1`
 	userID, err := queries.UserID(ctx, s.db, username)
 	if err != nil {
 		return err
 	}
+	before := s.previous(ctx, userID)
 	_, err = s.db.ExecContext(ctx, query, userID)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+
+	s.notify(ctx, Mutation{Module: "sessions", Action: actionDeleted, Username: username, Before: before})
+	return nil
+}
+
+// pruneSessions deletes the sessions that haven't been updated since before.
+// Returns the names of the users whose sessions were deleted.
+func (s *SessionsDB) pruneSessions(ctx context.Context, before time.Time) ([]string, error) {
+	query := `DELETE FROM ONLY user_sessions s
+                   USING users u
+                   WHERE s.user_id = u.id
+                     AND s.updated_at < $1
+               RETURNING u.username`
+
+	rows, err := s.db.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, fmt.Errorf("error pruning sessions: %w", dbError(err))
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err = rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+
+	for _, username := range usernames {
+		s.invalidate(ctx, username)
+		s.notify(ctx, Mutation{Module: "sessions", Action: actionDeleted, Username: username})
+	}
+
+	return usernames, nil
+}
+
+// previous summarizes the session about to be replaced if anything is
+// observing the writes.
+func (s *SessionsDB) previous(ctx context.Context, userID string) *DocumentSummary {
+	if !s.observed() {
+		return nil
+	}
+	return readSummary(ctx, s.db, `SELECT session FROM ONLY user_sessions WHERE user_id = $1`, userID)
 }
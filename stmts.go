@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stmtCache prepares queries the first time they're run and reuses the
+// prepared statements afterwards, so that the database doesn't have to parse
+// and plan the hot queries on every request. Statements are keyed by their
+// query text. Queries are retried by dbRetrier when they fail with transient
+// errors.
+type stmtCache struct {
+	db    *retryingDB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// newStmtCache returns a new *stmtCache for the database.
+func newStmtCache(db *retryingDB) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// prepare returns the prepared statement for the query, preparing it if it
+// hasn't been already.
+func (c *stmtCache) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	// The statement outlives the request, so it isn't prepared with the
+	// request's context.
+	stmt, err := c.db.PrepareContext(context.WithoutCancel(ctx), query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+
+	return stmt, nil
+}
+
+// QueryRowContext runs a query that returns at most one row using a prepared
+// statement. If the statement can't be prepared the query is run directly so
+// that the error is reported when the row is scanned. This lets a *stmtCache
+// be passed to the functions in the queries package.
+func (c *stmtCache) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		log.WithContext(ctx).Errorf("unable to prepare statement: %s", err)
+		return c.db.QueryRowContext(ctx, query, args...)
+	}
+
+	ctx, span := startDBSpan(ctx, "query_row", query)
+	var (
+		row      *sql.Row
+		attempts int
+	)
+	err = dbRetrier.do(ctx, func() error {
+		attempts++
+		row = stmt.QueryRowContext(ctx, args...)
+		return row.Err()
+	})
+	endDBSpan(span, attempts, err)
+	if row == nil {
+		row = stmt.QueryRowContext(rejectedContext(ctx), args...)
+	}
+	return row
+}
+
+// QueryContext runs a query that returns rows using a prepared statement.
+func (c *stmtCache) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := startDBSpan(ctx, "query", query)
+	var (
+		rows     *sql.Rows
+		attempts int
+	)
+	err = dbRetrier.do(ctx, func() error {
+		var err error
+		attempts++
+		rows, err = stmt.QueryContext(ctx, args...)
+		return err
+	})
+	endDBSpan(span, attempts, err)
+	return rows, err
+}
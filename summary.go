@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// UserSummary is everything the DE needs about a user at login, gathered in
+// one response.
+type UserSummary struct {
+	User          string          `json:"user"`
+	Preferences   json.RawMessage `json:"preferences"`
+	Session       json.RawMessage `json:"session"`
+	SavedSearches json.RawMessage `json:"saved_searches"`
+	Bags          BagSummary      `json:"bags"`
+}
+
+// BagSummary describes a user's bags without their contents.
+type BagSummary struct {
+	Count        int64  `json:"count"`
+	DefaultBagID string `json:"default_bag_id,omitempty"`
+}
+
+// UserSummaryApp serves summaries of users' stored information.
+type UserSummaryApp struct {
+	prefs    *UserPreferencesApp
+	sessions *UserSessionsApp
+	searches *SavedSearchesApp
+	bags     *BagsApp
+	router   *mux.Router
+}
+
+// NewUserSummaryApp returns a new *UserSummaryApp that reads from the given
+// apps.
+func NewUserSummaryApp(prefs *UserPreferencesApp, sessions *UserSessionsApp, searches *SavedSearchesApp, bags *BagsApp, router *mux.Router) *UserSummaryApp {
+	summaryApp := &UserSummaryApp{
+		prefs:    prefs,
+		sessions: sessions,
+		searches: searches,
+		bags:     bags,
+		router:   moduleRouter(router, "users", "/users"),
+	}
+	summaryApp.router.HandleFunc("/{username}/summary", summaryApp.GetSummary).Methods(http.MethodGet)
+	return summaryApp
+}
+
+// GetSummary returns the user's preferences, session, saved searches, and bag
+// counts. Each of them is queried concurrently.
+func (s *UserSummaryApp) GetSummary(writer http.ResponseWriter, r *http.Request) {
+	var (
+		username   string
+		userExists bool
+		err        error
+		ok         bool
+		summary    UserSummary
+		v          = mux.Vars(r)
+		ctx        = r.Context()
+	)
+
+	if username, ok = v["username"]; !ok {
+		httpapi.BadRequest(writer, "Missing username in URL")
+		return
+	}
+
+	if userExists, err = s.prefs.prefs.isUser(ctx, username); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		return
+	}
+
+	if !userExists {
+		httpapi.UserNotFound(writer, username)
+		return
+	}
+
+	summary.User = username
+	bagsUser := s.bags.AddUsernameSuffix(ctx, username)
+
+	g, gctx := errgroup.WithContext(ctx)
+
+	g.Go(func() (err error) {
+		summary.Preferences, err = s.prefs.getUserPreferencesForRequest(gctx, username, false)
+		return err
+	})
+
+	g.Go(func() (err error) {
+		summary.Session, err = s.sessions.getUserSessionForRequest(gctx, username, false)
+		return err
+	})
+
+	g.Go(func() error {
+		searches, err := s.searches.searches.getSavedSearches(gctx, username)
+		if err != nil {
+			return fmt.Errorf("error getting saved searches for username %s: %s", username, err)
+		}
+
+		summary.SavedSearches = json.RawMessage("{}")
+		if len(searches) > 0 && searches[0] != "" {
+			summary.SavedSearches = json.RawMessage(searches[0])
+		}
+		return nil
+	})
+
+	g.Go(func() (err error) {
+		if summary.Bags.Count, err = s.bags.api.CountBags(gctx, bagsUser); err != nil {
+			return fmt.Errorf("error counting bags for %s: %s", bagsUser, err)
+		}
+		return nil
+	})
+
+	g.Go(func() (err error) {
+		if summary.Bags.DefaultBagID, err = s.bags.api.DefaultBagID(gctx, bagsUser); err != nil {
+			return fmt.Errorf("error looking for the default bag for %s: %s", bagsUser, err)
+		}
+		return nil
+	})
+
+	if err = g.Wait(); err != nil {
+		httpapi.Errored(writer, err.Error())
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(writer).Encode(summary); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// maxTagResources is the most resources that can be tagged or untagged per
+// request.
+const maxTagResources = 1000
+
+// TagsApp manages the tags users make and attach to resources elsewhere in the
+// DE, such as files, apps, and analyses.
+type TagsApp struct {
+	tags   *TagsDB
+	router *mux.Router
+}
+
+// NewTagsApp returns a new *TagsApp.
+func NewTagsApp(db *TagsDB, router *mux.Router) *TagsApp {
+	tagsApp := &TagsApp{
+		tags:   db,
+		router: moduleRouter(router, "tags", "/tags"),
+	}
+	tagsApp.router.HandleFunc("/{username}", tagsApp.GetRequest).Methods(http.MethodGet)
+	tagsApp.router.HandleFunc("/{username}", tagsApp.PostRequest).Methods(http.MethodPost)
+	tagsApp.router.HandleFunc("/{username}/{tagID}", tagsApp.DeleteTagRequest).Methods(http.MethodDelete)
+	tagsApp.router.HandleFunc("/{username}/{tagID}/resources", tagsApp.GetResourcesRequest).Methods(http.MethodGet)
+	tagsApp.router.HandleFunc("/{username}/{tagID}/resources", tagsApp.PostResourcesRequest).Methods(http.MethodPost)
+	tagsApp.router.HandleFunc("/{username}/{tagID}/resources", tagsApp.DeleteResourcesRequest).Methods(http.MethodDelete)
+	return tagsApp
+}
+
+// validResourceIDs returns what's wrong with the IDs of the resources to tag
+// or untag, or "" if nothing is.
+func validResourceIDs(ids []string) string {
+	if len(ids) == 0 || len(ids) > maxTagResources {
+		return fmt.Sprintf("from 1 to %d IDs are required", maxTagResources)
+	}
+	for _, id := range ids {
+		if problem := validResourceID(id); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+// GetRequest lists the user's tags, sorted by name, as {"tags": [...]}.
+func (t *TagsApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tags.isUser)
+	if !ok {
+		return
+	}
+
+	tags, err := t.tags.getTags(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the tags of user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"tags": tags})
+}
+
+// PostRequest creates a tag with the name in the body, {"name": ...}, and
+// responds with it. The user can't have two tags with the same name.
+func (t *TagsApp) PostRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tags.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+	if problem := validName(body.Name); problem != "" {
+		httpapi.InvalidFields(writer, map[string]string{"name": problem})
+		return
+	}
+
+	tag, err := t.tags.addTag(r.Context(), username, body.Name)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error creating tag %q for user %s: %s", body.Name, username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusCreated, tag)
+}
+
+// DeleteTagRequest deletes one of the user's tags, detaching it from every
+// resource.
+func (t *TagsApp) DeleteTagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tags.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "tagID", "tag")
+	if !ok {
+		return
+	}
+
+	deleted, err := t.tags.deleteTag(r.Context(), username, id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting tag %s for user %s: %s", id, username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no tag %s", username, id))
+	}
+}
+
+// GetResourcesRequest lists the resources the tag is attached to, oldest
+// first, as {"resources": [...]}.
+func (t *TagsApp) GetResourcesRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tags.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "tagID", "tag")
+	if !ok {
+		return
+	}
+
+	resources, found, err := t.tags.getTaggedResources(r.Context(), username, id)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the resources tagged %s for user %s: %s", id, username, err))
+		return
+	}
+	if !found {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no tag %s", username, id))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"resources": resources})
+}
+
+// PostResourcesRequest attaches the tag to the resources in the body,
+// {"ids": [...]}, responding with the number it was newly attached to as
+// {"attached": n}.
+func (t *TagsApp) PostResourcesRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tags.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "tagID", "tag")
+	if !ok {
+		return
+	}
+
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+	if problem := validResourceIDs(body.IDs); problem != "" {
+		httpapi.InvalidFields(writer, map[string]string{"ids": problem})
+		return
+	}
+
+	attached, found, err := t.tags.attachTag(r.Context(), username, id, body.IDs)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error attaching tag %s for user %s: %s", id, username, err))
+		return
+	}
+	if !found {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no tag %s", username, id))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"attached": attached})
+}
+
+// DeleteResourcesRequest detaches the tag from the resources in the id query
+// parameter, which may be repeated, responding with the number it was
+// detached from as {"detached": n}.
+func (t *TagsApp) DeleteResourcesRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tags.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "tagID", "tag")
+	if !ok {
+		return
+	}
+
+	ids := r.URL.Query()["id"]
+	if problem := validResourceIDs(ids); problem != "" {
+		httpapi.BadRequest(writer, problem)
+		return
+	}
+
+	detached, found, err := t.tags.detachTag(r.Context(), username, id, ids)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error detaching tag %s for user %s: %s", id, username, err))
+		return
+	}
+	if !found {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no tag %s", username, id))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"detached": detached})
+}
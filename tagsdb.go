@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/lib/pq"
+)
+
+// Tag is a label a user made for grouping resources elsewhere in the DE, such
+// as files, apps, or analyses.
+type Tag struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TaggedResource is a resource a tag is attached to.
+type TaggedResource struct {
+	ID         string    `json:"id"`
+	AttachedAt time.Time `json:"attached_at"`
+}
+
+// TagsDB handles interacting with the user_tags and user_tag_resources tables.
+type TagsDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewTagsDB returns a newly created *TagsDB. Only user lookups are cached in
+// cache, which may be nil to disable caching.
+func NewTagsDB(db *sql.DB, cache Cache) *TagsDB {
+	return &TagsDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// isUser returns whether or not the user is present in the database.
+func (t *TagsDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, t.cache, t.db, username)
+}
+
+// getTags returns the user's tags, sorted by name.
+func (t *TagsDB) getTags(ctx context.Context, username string) ([]Tag, error) {
+	query, args := userRows("user_tags", "t", username, "t.id", "t.name", "t.created_at").
+		OrderBy("t.name").
+		SQL()
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var tag Tag
+		if err = rows.Scan(&tag.ID, &tag.Name, &tag.CreatedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// addTag creates a tag for the user. A tag with the same name is a conflict.
+func (t *TagsDB) addTag(ctx context.Context, username, name string) (*Tag, error) {
+	query := `INSERT INTO user_tags (user_id, name)
+                   VALUES ($1, $2)
+                RETURNING id, created_at`
+
+	userID, err := queries.UserID(ctx, t.db, username)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := Tag{Name: name}
+	if err = t.db.QueryRowContext(ctx, query, userID, name).Scan(&tag.ID, &tag.CreatedAt); err != nil {
+		return nil, dbError(err)
+	}
+
+	t.notify(ctx, Mutation{Module: "tags", Action: actionCreated, Username: username})
+	return &tag, nil
+}
+
+// deleteTag deletes one of the user's tags, detaching it from its resources.
+// Returns whether the user had the tag.
+func (t *TagsDB) deleteTag(ctx context.Context, username, tagID string) (bool, error) {
+	query := `DELETE FROM ONLY user_tags t
+                    USING users u
+                    WHERE t.user_id = u.id AND t.id = $1 AND u.username = $2`
+
+	result, err := t.db.ExecContext(ctx, query, tagID, username)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		t.notify(ctx, Mutation{Module: "tags", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
+
+// tagOwner returns the ID of the user who owns the tag, or "" if the user
+// doesn't have the tag.
+func (t *TagsDB) tagOwner(ctx context.Context, username, tagID string) (string, error) {
+	query, args := userRows("user_tags", "t", username, "t.user_id").Where("t.id = ?", tagID).SQL()
+
+	var userID string
+	err := t.db.QueryRowContext(ctx, query, args...).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return userID, dbError(err)
+}
+
+// getTaggedResources returns the resources the user's tag is attached to,
+// oldest first. Returns false if the user doesn't have the tag.
+func (t *TagsDB) getTaggedResources(ctx context.Context, username, tagID string) ([]TaggedResource, bool, error) {
+	userID, err := t.tagOwner(ctx, username, tagID)
+	if err != nil || userID == "" {
+		return nil, false, err
+	}
+
+	query := `SELECT resource_id, attached_at
+                FROM user_tag_resources
+               WHERE tag_id = $1
+            ORDER BY attached_at, resource_id`
+
+	rows, err := t.db.QueryContext(ctx, query, tagID)
+	if err != nil {
+		return nil, false, dbError(err)
+	}
+	defer rows.Close()
+
+	resources := []TaggedResource{}
+	for rows.Next() {
+		var resource TaggedResource
+		if err = rows.Scan(&resource.ID, &resource.AttachedAt); err != nil {
+			return nil, false, err
+		}
+		resources = append(resources, resource)
+	}
+
+	return resources, true, dbError(rows.Err())
+}
+
+// attachTag attaches the user's tag to the resources. Resources it's already
+// attached to are skipped. Returns the number of resources it was newly
+// attached to, and false if the user doesn't have the tag.
+func (t *TagsDB) attachTag(ctx context.Context, username, tagID string, resourceIDs []string) (int64, bool, error) {
+	userID, err := t.tagOwner(ctx, username, tagID)
+	if err != nil || userID == "" {
+		return 0, false, err
+	}
+
+	query := `INSERT INTO user_tag_resources (user_id, tag_id, resource_id)
+                   SELECT $1, $2, r.id
+                     FROM unnest($3::text[]) AS r(id)
+              ON CONFLICT (tag_id, resource_id) DO NOTHING`
+
+	result, err := t.db.ExecContext(ctx, query, userID, tagID, pq.Array(resourceIDs))
+	if err != nil {
+		return 0, false, dbError(err)
+	}
+	attached, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if attached > 0 {
+		t.notify(ctx, Mutation{Module: "tags", Action: actionUpdated, Username: username})
+	}
+	return attached, true, nil
+}
+
+// detachTag detaches the user's tag from the resources. Returns the number of
+// resources it was detached from, and false if the user doesn't have the tag.
+func (t *TagsDB) detachTag(ctx context.Context, username, tagID string, resourceIDs []string) (int64, bool, error) {
+	userID, err := t.tagOwner(ctx, username, tagID)
+	if err != nil || userID == "" {
+		return 0, false, err
+	}
+
+	result, err := t.db.ExecContext(ctx, `DELETE FROM ONLY user_tag_resources WHERE tag_id = $1 AND resource_id = ANY($2)`,
+		tagID, pq.Array(resourceIDs))
+	if err != nil {
+		return 0, false, dbError(err)
+	}
+	detached, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if detached > 0 {
+		t.notify(ctx, Mutation{Module: "tags", Action: actionUpdated, Username: username})
+	}
+	return detached, true, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// TeamPrefsApp manages preferences shared by the members of a team, such as a
+// lab or collaboration, which give them a common default configuration. Which
+// users belong to a team is up to the caller.
+type TeamPrefsApp struct {
+	teamPrefs *TeamPrefsDB
+	prefs     pDB
+	router    *mux.Router
+}
+
+// NewTeamPrefsApp returns a new *TeamPrefsApp. Resolved preferences are read
+// from prefs.
+func NewTeamPrefsApp(db *TeamPrefsDB, prefs pDB, router *mux.Router) *TeamPrefsApp {
+	teamPrefsApp := &TeamPrefsApp{
+		teamPrefs: db,
+		prefs:     prefs,
+		router:    moduleRouter(router, "team-preferences", "/team-preferences"),
+	}
+	teamPrefsApp.router.HandleFunc("/{teamID}", teamPrefsApp.GetRequest).Methods(http.MethodGet)
+	teamPrefsApp.router.HandleFunc("/{teamID}", teamPrefsApp.PutRequest).Methods(http.MethodPut)
+	teamPrefsApp.router.HandleFunc("/{teamID}", teamPrefsApp.DeleteRequest).Methods(http.MethodDelete)
+	teamPrefsApp.router.HandleFunc("/{teamID}/resolved/{username}", teamPrefsApp.ResolvedRequest).Methods(http.MethodGet)
+	return teamPrefsApp
+}
+
+// teamID returns the team ID in the request's URL, responding with a 400 and
+// returning false if it isn't valid.
+func teamID(writer http.ResponseWriter, r *http.Request) (string, bool) {
+	id := mux.Vars(r)["teamID"]
+	if !identifierPattern.MatchString(id) {
+		httpapi.BadRequest(writer, fmt.Sprintf("invalid team ID: %q", id))
+		return "", false
+	}
+	return id, true
+}
+
+// mergePrefs returns the preferences in base overridden by the ones in
+// overrides. Objects present in both are merged the same way; any other value
+// in overrides replaces the one in base.
+func mergePrefs(base, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		baseObject, baseOK := merged[k].(map[string]interface{})
+		object, ok := v.(map[string]interface{})
+		if baseOK && ok {
+			merged[k] = mergePrefs(baseObject, object)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// GetRequest returns the team's preferences, or an empty object if it has
+// none.
+func (t *TeamPrefsApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	id, ok := teamID(writer, r)
+	if !ok {
+		return
+	}
+
+	prefs, err := t.teamPrefs.getTeamPrefs(r.Context(), id)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the preferences of team %s: %s", id, err))
+		return
+	}
+	if prefs == "" {
+		prefs = "{}"
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, json.RawMessage(prefs))
+}
+
+// PutRequest replaces the team's preferences with the JSON object in the body
+// and responds with them, with a 201 if the team had none before.
+func (t *TeamPrefsApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
+	id, ok := teamID(writer, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpapi.ReadBodyError(writer, err)
+		return
+	}
+	if _, ok = httpapi.ReadObject(writer, body); !ok {
+		return
+	}
+
+	created, err := t.teamPrefs.putTeamPrefs(r.Context(), id, string(body))
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error storing the preferences of team %s: %s", id, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, json.RawMessage(body))
+}
+
+// DeleteRequest deletes the team's preferences.
+func (t *TeamPrefsApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	id, ok := teamID(writer, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := t.teamPrefs.deleteTeamPrefs(r.Context(), id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting the preferences of team %s: %s", id, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("no preferences are stored for team %s", id))
+	}
+}
+
+// ResolvedRequest returns the preferences that apply to the user as a member
+// of the team: the team's preferences, overridden by the user's own.
+func (t *TeamPrefsApp) ResolvedRequest(writer http.ResponseWriter, r *http.Request) {
+	id, ok := teamID(writer, r)
+	if !ok {
+		return
+	}
+	username, ok := existingUser(writer, r, t.prefs.isUser)
+	if !ok {
+		return
+	}
+
+	stored, err := t.teamPrefs.getTeamPrefs(r.Context(), id)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the preferences of team %s: %s", id, err))
+		return
+	}
+	var teamPrefs map[string]interface{}
+	if stored != "" {
+		if err = json.Unmarshal([]byte(stored), &teamPrefs); err != nil {
+			httpapi.Errored(writer, fmt.Sprintf("error parsing the preferences of team %s: %s", id, err))
+			return
+		}
+	}
+
+	records, err := t.prefs.getPreferences(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting preferences for username %s: %s", username, err))
+		return
+	}
+	var record UserPreferencesRecord
+	if len(records) > 0 {
+		record = records[0]
+	}
+	userPrefs, err := convertPrefs(&record, false)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error parsing preferences for username %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, mergePrefs(teamPrefs, userPrefs))
+}
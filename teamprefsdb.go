@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// TeamPrefsDB handles interacting with the team_preferences table. Teams are
+// groups or collaborations managed elsewhere, so they're only known here by
+// their IDs.
+type TeamPrefsDB struct {
+	db    *retryingDB
+	cache Cache
+}
+
+// NewTeamPrefsDB returns a newly created *TeamPrefsDB. Reads are cached in
+// cache, which may be nil to disable caching.
+func NewTeamPrefsDB(db *sql.DB, cache Cache) *TeamPrefsDB {
+	return &TeamPrefsDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func teamPrefsKey(teamID string) string {
+	return cacheKey("team-preferences", "preferences", teamID)
+}
+
+// getTeamPrefs returns the team's preferences as a JSON object, or "" if none
+// are stored.
+func (t *TeamPrefsDB) getTeamPrefs(ctx context.Context, teamID string) (string, error) {
+	if prefs, ok := cacheGet[string](ctx, t.cache, teamPrefsKey(teamID)); ok {
+		return prefs, nil
+	}
+
+	var prefs string
+	err := t.db.QueryRowContext(ctx, `SELECT preferences FROM team_preferences WHERE team_id = $1`, teamID).Scan(&prefs)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", dbError(err)
+	}
+
+	cacheSet(ctx, t.cache, teamPrefsKey(teamID), prefs)
+	return prefs, nil
+}
+
+// putTeamPrefs stores the team's preferences, replacing any it had. Returns
+// whether the team had none before.
+func (t *TeamPrefsDB) putTeamPrefs(ctx context.Context, teamID, prefs string) (bool, error) {
+	defer cacheInvalidate(ctx, t.cache, teamPrefsKey(teamID))
+
+	query := `INSERT INTO team_preferences (team_id, preferences)
+                   VALUES ($1, $2)
+              ON CONFLICT (team_id) DO UPDATE
+                      SET preferences = EXCLUDED.preferences, updated_at = now()
+                RETURNING (xmax = 0) AS created`
+
+	var created bool
+	if err := t.db.QueryRowContext(ctx, query, teamID, prefs).Scan(&created); err != nil {
+		return false, dbError(err)
+	}
+	return created, nil
+}
+
+// deleteTeamPrefs deletes the team's preferences. Returns whether it had any.
+func (t *TeamPrefsDB) deleteTeamPrefs(ctx context.Context, teamID string) (bool, error) {
+	defer cacheInvalidate(ctx, t.cache, teamPrefsKey(teamID))
+
+	result, err := t.db.ExecContext(ctx, `DELETE FROM ONLY team_preferences WHERE team_id = $1`, teamID)
+	if err != nil {
+		return false, dbError(err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// QueryTimeout gives each request a deadline, so that the database calls made
+// while handling it are canceled if they take too long. Requests that already
+// have an earlier deadline, such as gRPC calls from clients that set one, keep
+// it. A non-positive timeout disables the deadline.
+type QueryTimeout struct {
+	timeout atomic.Int64
+}
+
+// NewQueryTimeout returns a new *QueryTimeout for the given timeout.
+func NewQueryTimeout(timeout time.Duration) *QueryTimeout {
+	q := &QueryTimeout{}
+	q.timeout.Store(int64(timeout))
+	return q
+}
+
+// SetTimeout changes the timeout given to new requests.
+func (q *QueryTimeout) SetTimeout(timeout time.Duration) {
+	q.timeout.Store(int64(timeout))
+}
+
+// withDeadline returns a copy of the context with the deadline for a request.
+func (q *QueryTimeout) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(q.timeout.Load())
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Middleware adds the deadline to the context of each request.
+func (q *QueryTimeout) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		ctx, cancel := q.withDeadline(r.Context())
+		defer cancel()
+		next.ServeHTTP(writer, r.WithContext(ctx))
+	})
+}
+
+// UnaryInterceptor is the gRPC equivalent of Middleware.
+func (q *QueryTimeout) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, cancel := q.withDeadline(ctx)
+	defer cancel()
+	return handler(ctx, req)
+}
+
+// withStatementTimeout adds the statement_timeout run-time parameter to the
+// database URI, so that PostgreSQL cancels statements that run for longer than
+// the timeout.
+func withStatementTimeout(uri string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return uri, nil
+	}
+	return withRuntimeParam(uri, "statement_timeout", strconv.FormatInt(timeout.Milliseconds(), 10))
+}
+
+// withRuntimeParam adds a run-time parameter to the database URI, in either the
+// URL or the key=value form. Both drivers pass parameters they don't recognize
+// to the server when they connect.
+func withRuntimeParam(uri, name, value string) (string, error) {
+	if !strings.Contains(uri, "://") {
+		return strings.TrimSpace(uri) + " " + name + "=" + value, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid db.uri: %w", err)
+	}
+	q := u.Query()
+	q.Set(name, value)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
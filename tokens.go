@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenPrefix starts the secret of every personal access token, so that
+// leaked tokens are easy to recognize.
+const tokenPrefix = "deut_"
+
+// maxTokenScopes is the most scopes a token can have.
+const maxTokenScopes = 100
+
+// Reasons a token that's presented for verification isn't active.
+const (
+	tokenUnknown           = "unknown"
+	tokenExpired           = "expired"
+	tokenInsufficientScope = "insufficient_scope"
+	tokenDeactivated       = "deactivated"
+)
+
+// newTokenSecret returns a new random token secret and its hash.
+func newTokenSecret() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return secret, hashTokenSecret(secret), nil
+}
+
+// hashTokenSecret returns the hash of the token secret that's stored in its
+// place. Secrets are random enough that a fast, unsalted hash is safe, and lets
+// tokens be looked up by it.
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createdToken is a token in the response to creating it, the only time its
+// secret is returned.
+type createdToken struct {
+	*Token
+	Secret string `json:"token"`
+}
+
+// tokenVerification is the response to verifying a token, which is shaped
+// like an OAuth 2.0 token introspection response. Reason says why a token
+// isn't active.
+type tokenVerification struct {
+	Active   bool   `json:"active"`
+	Reason   string `json:"reason,omitempty"`
+	Username string `json:"username,omitempty"`
+	*Token
+}
+
+// TokensApp manages users' personal access tokens, which they use to call DE
+// APIs from scripts. Other DE services verify the tokens presented to them
+// with the verification endpoint.
+type TokensApp struct {
+	tokens      *TokensDB
+	scopes      []string
+	maxLifetime time.Duration
+	router      *mux.Router
+}
+
+// NewTokensApp returns a new *TokensApp. If scopes isn't empty, tokens can
+// only have those scopes. If maxLifetime isn't 0, tokens expire at most that
+// long after they're created, and by default when it's up.
+func NewTokensApp(db *TokensDB, scopes []string, maxLifetime time.Duration, router *mux.Router) *TokensApp {
+	tokensApp := &TokensApp{
+		tokens:      db,
+		scopes:      scopes,
+		maxLifetime: maxLifetime,
+		router:      moduleRouter(router, "tokens", "/tokens"),
+	}
+	tokensApp.router.HandleFunc("/verify", tokensApp.VerifyRequest).Methods(http.MethodPost)
+	tokensApp.router.HandleFunc("/{username}", tokensApp.GetRequest).Methods(http.MethodGet)
+	tokensApp.router.HandleFunc("/{username}", tokensApp.PostRequest).Methods(http.MethodPost)
+	tokensApp.router.HandleFunc("/{username}", tokensApp.DeleteRequest).Methods(http.MethodDelete)
+	tokensApp.router.HandleFunc("/{username}/{tokenID}", tokensApp.DeleteTokenRequest).Methods(http.MethodDelete)
+	return tokensApp
+}
+
+// validScopes returns the scopes sorted without duplicates, and what's wrong
+// with them, if anything.
+func (t *TokensApp) validScopes(scopes []string) ([]string, string) {
+	if len(scopes) == 0 || len(scopes) > maxTokenScopes {
+		return nil, fmt.Sprintf("from 1 to %d scopes are required", maxTokenScopes)
+	}
+	for _, scope := range scopes {
+		if !identifierPattern.MatchString(scope) {
+			return nil, fmt.Sprintf("invalid scope: %q", scope)
+		}
+		if len(t.scopes) > 0 && !slices.Contains(t.scopes, scope) {
+			return nil, fmt.Sprintf("unknown scope %q; expected one of %s", scope, strings.Join(t.scopes, ", "))
+		}
+	}
+
+	sorted := slices.Clone(scopes)
+	slices.Sort(sorted)
+	return slices.Compact(sorted), ""
+}
+
+// expiry returns when a token created now should expire, given the expiration
+// the user asked for, which may be nil. The result is nil if the token
+// shouldn't expire. The returned string says what's wrong with the requested
+// expiration, if anything.
+func (t *TokensApp) expiry(requested *time.Time, now time.Time) (*time.Time, string) {
+	if requested == nil {
+		if t.maxLifetime == 0 {
+			return nil, ""
+		}
+		expiresAt := now.Add(t.maxLifetime).UTC().Truncate(time.Second)
+		return &expiresAt, ""
+	}
+
+	if !requested.After(now) {
+		return nil, "must be in the future"
+	}
+	if t.maxLifetime != 0 && requested.After(now.Add(t.maxLifetime)) {
+		return nil, fmt.Sprintf("must be within %s", t.maxLifetime)
+	}
+	expiresAt := requested.UTC().Truncate(time.Microsecond)
+	return &expiresAt, ""
+}
+
+// GetRequest lists the user's tokens, oldest first and without their secrets,
+// as {"tokens": [...]}.
+func (t *TokensApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tokens.isUser)
+	if !ok {
+		return
+	}
+
+	tokens, err := t.tokens.getTokens(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the tokens of user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"tokens": tokens})
+}
+
+// PostRequest creates a token for the user from the body,
+// {"name": ..., "scopes": [...], "expires_at": ...}, where expires_at is
+// optional. The response is the token with its secret in the token field,
+// which can't be retrieved again. The user can't have two tokens with the same
+// name.
+func (t *TokensApp) PostRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tokens.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+
+	problems := make(map[string]string)
+	if problem := validName(body.Name); problem != "" {
+		problems["name"] = problem
+	}
+	scopes, problem := t.validScopes(body.Scopes)
+	if problem != "" {
+		problems["scopes"] = problem
+	}
+	expiresAt, problem := t.expiry(body.ExpiresAt, time.Now())
+	if problem != "" {
+		problems["expires_at"] = problem
+	}
+	if len(problems) > 0 {
+		httpapi.InvalidFields(writer, problems)
+		return
+	}
+
+	secret, hash, err := newTokenSecret()
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error generating a token for user %s: %s", username, err))
+		return
+	}
+
+	token, err := t.tokens.addToken(r.Context(), username, body.Name, hash, scopes, expiresAt)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error creating token %q for user %s: %s", body.Name, username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusCreated, createdToken{Token: token, Secret: secret})
+}
+
+// DeleteTokenRequest revokes one of the user's tokens.
+func (t *TokensApp) DeleteTokenRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tokens.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "tokenID", "token")
+	if !ok {
+		return
+	}
+
+	deleted, err := t.tokens.deleteToken(r.Context(), username, id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error revoking token %s for user %s: %s", id, username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no token %s", username, id))
+	}
+}
+
+// DeleteRequest revokes all of the user's tokens.
+func (t *TokensApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tokens.isUser)
+	if !ok {
+		return
+	}
+
+	if _, err := t.tokens.deleteTokens(r.Context(), username); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error revoking the tokens of user %s: %s", username, err))
+	}
+}
+
+// VerifyRequest checks the token secret in the body, {"token": ...}, for the
+// services that tokens are presented to. If the body has a scope, the token
+// must have it. The response says whether the token is active, and if it is,
+// who it belongs to and what it's for. Tokens that aren't active are still a
+// 200, with the reason they aren't active. The tokens of deactivated users
+// aren't active, so that they're locked out of every service that checks.
+func (t *TokensApp) VerifyRequest(writer http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+		Scope string `json:"scope"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+	if body.Token == "" {
+		httpapi.InvalidFields(writer, map[string]string{"token": "a token is required"})
+		return
+	}
+
+	result := tokenVerification{Reason: tokenUnknown}
+	if strings.HasPrefix(body.Token, tokenPrefix) {
+		token, username, deactivated, err := t.tokens.tokenByHash(r.Context(), hashTokenSecret(body.Token))
+		if err != nil {
+			httpapi.Errored(writer, fmt.Sprintf("error verifying a token: %s", err))
+			return
+		}
+
+		switch {
+		case token == nil:
+		case deactivated:
+			result.Reason = tokenDeactivated
+		case token.expired(time.Now()):
+			result.Reason = tokenExpired
+		case body.Scope != "" && !slices.Contains(token.Scopes, body.Scope):
+			result.Reason = tokenInsufficientScope
+		default:
+			if err = t.tokens.touchToken(r.Context(), token.ID); err != nil {
+				log.WithContext(r.Context()).Errorf("error recording the use of token %s: %s", token.ID, err)
+			}
+			result = tokenVerification{Active: true, Username: username, Token: token}
+		}
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, result)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/lib/pq"
+)
+
+// tokenTouchInterval is how often the time a token was last used is updated,
+// so that services verifying a token on every request don't write to the
+// database on every request.
+const tokenTouchInterval = time.Minute
+
+// Token is a personal access token, without its secret. A nil ExpiresAt means
+// the token doesn't expire.
+type Token struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// expired returns whether the token has expired as of now.
+func (t *Token) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// TokensDB handles interacting with the user_tokens table. Tokens are looked
+// up by the hash of their secret, which is all that's stored.
+type TokensDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewTokensDB returns a newly created *TokensDB. Only user lookups are cached
+// in cache, which may be nil to disable caching; tokens aren't, so that
+// revoking one takes effect immediately.
+func NewTokensDB(db *sql.DB, cache Cache) *TokensDB {
+	return &TokensDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// isUser returns whether or not the user is present in the database.
+func (t *TokensDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, t.cache, t.db, username)
+}
+
+// getTokens returns the user's tokens, oldest first.
+func (t *TokensDB) getTokens(ctx context.Context, username string) ([]Token, error) {
+	query, args := userRows("user_tokens", "t", username, "t.id", "t.name", "t.scopes", "t.created_at", "t.expires_at", "t.last_used_at").
+		OrderBy("t.created_at", "t.name").
+		SQL()
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		var token Token
+		if err = rows.Scan(&token.ID, &token.Name, pq.Array(&token.Scopes), &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// addToken stores a token for the user with the hash of its secret. A token
+// with the same name is a conflict.
+func (t *TokensDB) addToken(ctx context.Context, username, name, hash string, scopes []string, expiresAt *time.Time) (*Token, error) {
+	query := `INSERT INTO user_tokens (user_id, name, token_hash, scopes, expires_at)
+                   VALUES ($1, $2, $3, $4, $5)
+                RETURNING id, created_at`
+
+	userID, err := queries.UserID(ctx, t.db, username)
+	if err != nil {
+		return nil, err
+	}
+
+	token := Token{Name: name, Scopes: scopes, ExpiresAt: expiresAt}
+	if err = t.db.QueryRowContext(ctx, query, userID, name, hash, pq.Array(scopes), expiresAt).Scan(&token.ID, &token.CreatedAt); err != nil {
+		return nil, dbError(err)
+	}
+
+	t.notify(ctx, Mutation{Module: "tokens", Action: actionCreated, Username: username})
+	return &token, nil
+}
+
+// deleteToken revokes one of the user's tokens. Returns whether the user had
+// the token.
+func (t *TokensDB) deleteToken(ctx context.Context, username, tokenID string) (bool, error) {
+	query := `DELETE FROM ONLY user_tokens t
+                    USING users u
+                    WHERE t.user_id = u.id AND t.id = $1 AND u.username = $2`
+
+	result, err := t.db.ExecContext(ctx, query, tokenID, username)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		t.notify(ctx, Mutation{Module: "tokens", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
+
+// deleteTokens revokes all of the user's tokens. Returns the number revoked.
+func (t *TokensDB) deleteTokens(ctx context.Context, username string) (int64, error) {
+	userID, err := queries.UserID(ctx, t.db, username)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := t.db.ExecContext(ctx, `DELETE FROM ONLY user_tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		t.notify(ctx, Mutation{Module: "tokens", Action: actionDeleted, Username: username})
+	}
+	return deleted, nil
+}
+
+// tokenByHash returns the token with the hash of its secret, the username of
+// its owner, and whether the owner's account is deactivated, or nil if there's
+// no such token.
+func (t *TokensDB) tokenByHash(ctx context.Context, hash string) (*Token, string, bool, error) {
+	query, args := selectFrom("user_tokens t", "t.id", "u.username", "t.name", "t.scopes", "t.created_at", "t.expires_at", "t.last_used_at",
+		"u.deactivated_at IS NOT NULL").
+		Join("users u", "t.user_id = u.id").
+		Where("t.token_hash = ?", hash).
+		SQL()
+
+	var (
+		token       Token
+		username    string
+		deactivated bool
+	)
+	err := t.db.QueryRowContext(ctx, query, args...).
+		Scan(&token.ID, &username, &token.Name, pq.Array(&token.Scopes), &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &deactivated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, dbError(err)
+	}
+	return &token, username, deactivated, nil
+}
+
+// touchToken records that the token was used, unless that was already
+// recorded within the last tokenTouchInterval.
+func (t *TokensDB) touchToken(ctx context.Context, tokenID string) error {
+	query := `UPDATE user_tokens
+                 SET last_used_at = now()
+               WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2)`
+
+	_, err := t.db.ExecContext(ctx, query, tokenID, time.Now().Add(-tokenTouchInterval))
+	return dbError(err)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+)
+
+// ToursApp records which product tours and onboarding steps users have
+// completed, so that they aren't shown again.
+type ToursApp struct {
+	tours  *ToursDB
+	router *mux.Router
+}
+
+// NewToursApp returns a new *ToursApp.
+func NewToursApp(db *ToursDB, router *mux.Router) *ToursApp {
+	toursApp := &ToursApp{
+		tours:  db,
+		router: moduleRouter(router, "tours", "/tours"),
+	}
+	toursApp.router.HandleFunc("/{username}", toursApp.GetRequest).Methods(http.MethodGet)
+	toursApp.router.HandleFunc("/{username}", toursApp.DeleteRequest).Methods(http.MethodDelete)
+	toursApp.router.HandleFunc("/{username}/{tourID}", toursApp.PutTourRequest).Methods(http.MethodPut)
+	toursApp.router.HandleFunc("/{username}/{tourID}", toursApp.DeleteTourRequest).Methods(http.MethodDelete)
+	return toursApp
+}
+
+// tourID returns the tour ID in the request's URL, responding with a 400 and
+// returning false if it isn't valid.
+func tourID(writer http.ResponseWriter, r *http.Request) (string, bool) {
+	id := mux.Vars(r)["tourID"]
+	if !identifierPattern.MatchString(id) {
+		httpapi.BadRequest(writer, fmt.Sprintf("invalid tour ID: %q", id))
+		return "", false
+	}
+	return id, true
+}
+
+// GetRequest lists the tours the user has completed, oldest first.
+func (t *ToursApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tours.isUser)
+	if !ok {
+		return
+	}
+
+	tours, err := t.tours.getTours(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the completed tours for user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"tours": tours})
+}
+
+// PutTourRequest records that the user completed the tour, responding with a
+// 201 the first time and a 200 with the original completion time after that.
+func (t *ToursApp) PutTourRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tours.isUser)
+	if !ok {
+		return
+	}
+	id, ok := tourID(writer, r)
+	if !ok {
+		return
+	}
+
+	tour, created, err := t.tours.completeTour(r.Context(), username, id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error recording tour %s for user %s: %s", id, username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	httpapi.WriteJSON(writer, status, tour)
+}
+
+// DeleteTourRequest forgets that the user completed the tour, so that it's
+// shown again.
+func (t *ToursApp) DeleteTourRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tours.isUser)
+	if !ok {
+		return
+	}
+	id, ok := tourID(writer, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := t.tours.resetTours(r.Context(), username, id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error resetting tour %s for user %s: %s", id, username, err))
+		return
+	}
+	if deleted == 0 {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has not completed tour %s", username, id))
+	}
+}
+
+// DeleteRequest forgets every tour the user completed.
+func (t *ToursApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, t.tours.isUser)
+	if !ok {
+		return
+	}
+
+	if _, err := t.tours.resetTours(r.Context(), username, ""); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error resetting the tours for user %s: %s", username, err))
+	}
+}
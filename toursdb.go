@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/queries"
+)
+
+// CompletedTour records that a user finished a product tour or onboarding
+// step.
+type CompletedTour struct {
+	TourID      string    `json:"tour_id"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// ToursDB handles interacting with the user_tours table.
+type ToursDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewToursDB returns a newly created *ToursDB. Reads are cached in cache, which
+// may be nil to disable caching.
+func NewToursDB(db *sql.DB, cache Cache) *ToursDB {
+	return &ToursDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func toursKey(username string) string {
+	return cacheKey("tours", "completed", username)
+}
+
+// isUser returns whether or not the user is present in the database.
+func (t *ToursDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, t.cache, t.db, username)
+}
+
+// getTours returns the tours the user has completed, oldest first.
+func (t *ToursDB) getTours(ctx context.Context, username string) ([]CompletedTour, error) {
+	if tours, ok := cacheGet[[]CompletedTour](ctx, t.cache, toursKey(username)); ok {
+		return tours, nil
+	}
+
+	query, args := userRows("user_tours", "t", username, "t.tour_id", "t.completed_at").
+		OrderBy("t.completed_at", "t.tour_id").
+		SQL()
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tours := []CompletedTour{}
+	for rows.Next() {
+		var tour CompletedTour
+		if err = rows.Scan(&tour.TourID, &tour.CompletedAt); err != nil {
+			return nil, err
+		}
+		tours = append(tours, tour)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cacheSet(ctx, t.cache, toursKey(username), tours)
+	return tours, nil
+}
+
+// completeTour records that the user completed the tour. A tour that was
+// already completed keeps its original completion time. Returns the record and
+// whether it's new.
+func (t *ToursDB) completeTour(ctx context.Context, username, tourID string) (*CompletedTour, bool, error) {
+	defer cacheInvalidate(ctx, t.cache, toursKey(username))
+
+	// The no-op update makes the existing row's completion time available to
+	// RETURNING.
+	query := `INSERT INTO user_tours (user_id, tour_id)
+                   VALUES ($1, $2)
+              ON CONFLICT (user_id, tour_id) DO UPDATE
+                      SET completed_at = user_tours.completed_at
+                RETURNING (xmax = 0) AS created, completed_at`
+
+	userID, err := queries.UserID(ctx, t.db, username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tour := CompletedTour{TourID: tourID}
+	var created bool
+	if err = t.db.QueryRowContext(ctx, query, userID, tourID).Scan(&created, &tour.CompletedAt); err != nil {
+		return nil, false, dbError(err)
+	}
+
+	if created {
+		t.notify(ctx, Mutation{Module: "tours", Action: actionCreated, Username: username})
+	}
+	return &tour, created, nil
+}
+
+// resetTours deletes the user's completion record for the tour, or all of them
+// if tourID is empty, so that the tours are shown again. Returns the number of
+// records deleted.
+func (t *ToursDB) resetTours(ctx context.Context, username, tourID string) (int64, error) {
+	defer cacheInvalidate(ctx, t.cache, toursKey(username))
+
+	userID, err := queries.UserID(ctx, t.db, username)
+	if err != nil {
+		return 0, err
+	}
+
+	var result sql.Result
+	if tourID == "" {
+		result, err = t.db.ExecContext(ctx, `DELETE FROM ONLY user_tours WHERE user_id = $1`, userID)
+	} else {
+		result, err = t.db.ExecContext(ctx, `DELETE FROM ONLY user_tours WHERE user_id = $1 AND tour_id = $2`, userID, tourID)
+	}
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		t.notify(ctx, Mutation{Module: "tours", Action: actionDeleted, Username: username})
+	}
+	return deleted, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/go-mod/otelutils"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes that the service adds to its spans.
+const (
+	moduleAttribute     = attribute.Key("user_info.module")
+	dbAttemptsAttribute = attribute.Key("db.attempts")
+)
+
+// otlpProtocol returns the OTLP protocol to use for traces, as set in the
+// standard OTEL_EXPORTER_OTLP_TRACES_PROTOCOL or OTEL_EXPORTER_OTLP_PROTOCOL
+// environment variables. Defaults to grpc.
+func otlpProtocol() string {
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if protocol := os.Getenv(name); protocol != "" {
+			return protocol
+		}
+	}
+	return "grpc"
+}
+
+// newOTLPExporter creates an OTLP trace exporter for the given protocol. The
+// exporters read their endpoint, headers, and TLS settings from the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func newOTLPExporter(ctx context.Context, protocol string) (*otlptrace.Exporter, error) {
+	switch protocol {
+	case "grpc":
+		return otlptracegrpc.New(ctx)
+	case "http/protobuf":
+		return otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol: %s", protocol)
+	}
+}
+
+// otlpTracerProvider returns a TracerProvider that exports traces over OTLP.
+func otlpTracerProvider(ctx context.Context, serviceName string) (*tracesdk.TracerProvider, error) {
+	exp, err := newOTLPExporter(ctx, otlpProtocol())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceNamespaceKey.String("org.cyverse"),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return tracesdk.NewTracerProvider(
+		tracesdk.WithBatcher(exp),
+		tracesdk.WithResource(res),
+	), nil
+}
+
+// tracerProviderFromEnv sets up tracing according to the OTEL_TRACES_EXPORTER
+// environment variable. "otlp" exports traces over OTLP. Every other value,
+// including "jaeger" and "none", is handled by otelutils. Returns a function
+// that shuts the TracerProvider down.
+func tracerProviderFromEnv(ctx context.Context, serviceName string, onErr func(error)) func() {
+	if strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER")) != "otlp" {
+		return otelutils.TracerProviderFromEnv(ctx, serviceName, onErr)
+	}
+
+	tracerProvider, err := otlpTracerProvider(ctx, serviceName)
+	if err != nil {
+		onErr(err)
+		return func() {}
+	}
+
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			onErr(err)
+		}
+	}
+}
+
+// tracer returns the tracer for the spans that the service creates itself. It's
+// looked up every time so that it comes from the current TracerProvider.
+func tracer() trace.Tracer {
+	return otel.Tracer(serviceName)
+}
+
+// spanAttributes is middleware that adds the username, route template, and
+// module of each request to its server span, so that traces can be filtered
+// by user. The attributes are added once the request has been handled, since
+// the username is normalized and the module is found along the way.
+func spanAttributes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(writer, r)
+
+		span := trace.SpanFromContext(r.Context())
+		if !span.IsRecording() {
+			return
+		}
+
+		attrs := []attribute.KeyValue{semconv.HTTPRouteKey.String(requestRoute(r))}
+		if fields, ok := r.Context().Value(logFieldsKey{}).(log.Fields); ok {
+			if username, ok := fields["username"].(string); ok && username != "" {
+				attrs = append(attrs, semconv.EnduserIDKey.String(username))
+			}
+			if module, ok := fields["module"].(string); ok && module != "" {
+				attrs = append(attrs, moduleAttribute.String(module))
+			}
+		}
+		span.SetAttributes(attrs...)
+	})
+}
+
+// startDBSpan starts a child span for a database call, e.g. "db.query", with
+// the query as its statement.
+func startDBSpan(ctx context.Context, operation, query string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "db."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBStatementKey.String(query)),
+	)
+}
+
+// endDBSpan records the number of attempts that the call took and its error,
+// if any, and ends the span. Queries that return no rows haven't failed.
+func endDBSpan(span trace.Span, attempts int, err error) {
+	span.SetAttributes(dbAttemptsAttribute.Int(attempts))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPendingUsage is the most usage counts that are kept between flushes.
+// Requests that would need a new count once there are this many aren't
+// counted, so that requests for lots of made-up usernames can't use up memory.
+const maxPendingUsage = 100000
+
+// defaultUsageDays is the number of days, up to and including today, that
+// usage is reported for if the request doesn't say.
+const defaultUsageDays = 30
+
+// Limits on the number of users listed per top consumers report.
+const (
+	defaultUsageLimit = 10
+	maxUsageLimit     = 1000
+)
+
+// UsageRecorder counts the requests made for each user by route and by day.
+// Counts are kept in memory by Middleware and added to the ones stored by
+// Run, so that counting doesn't slow requests down. Usage is only for finding
+// heavy or misbehaving clients, so counts that can't be stored are dropped
+// rather than retried.
+type UsageRecorder struct {
+	usage *UsageDB
+	now   func() time.Time
+
+	mu      sync.Mutex
+	pending map[usageKey]*usageCount
+	dropped int64
+}
+
+// NewUsageRecorder returns a new *UsageRecorder that stores counts in db.
+func NewUsageRecorder(db *UsageDB) *UsageRecorder {
+	return &UsageRecorder{
+		usage:   db,
+		now:     time.Now,
+		pending: make(map[usageKey]*usageCount),
+	}
+}
+
+// record counts a request for the user to the route that finished with the
+// status.
+func (u *UsageRecorder) record(username, route string, status int) {
+	key := usageKey{username: username, route: route, day: u.now().UTC().Format(usageDayLayout)}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	count, ok := u.pending[key]
+	if !ok {
+		if len(u.pending) >= maxPendingUsage {
+			u.dropped++
+			return
+		}
+		count = &usageCount{}
+		u.pending[key] = count
+	}
+	count.requests++
+	if status >= http.StatusBadRequest {
+		count.errors++
+	}
+}
+
+// Middleware counts the requests to routes with a {username} variable, apart
+// from the privileged ones, which administrators make about users rather than
+// for them. It must come after the username normalizer, so that requests are
+// counted for the normalized username.
+func (u *UsageRecorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		username, ok := mux.Vars(r)["username"]
+		if !ok || adminOnly(r) {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: writer}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		u.record(username, routeKey(r), recorder.status)
+	})
+}
+
+// flush adds the counts kept since the last flush to the ones stored.
+func (u *UsageRecorder) flush(ctx context.Context) error {
+	u.mu.Lock()
+	pending, dropped := u.pending, u.dropped
+	u.pending, u.dropped = make(map[usageKey]*usageCount), 0
+	u.mu.Unlock()
+
+	if dropped > 0 {
+		log.WithContext(ctx).Warnf("%d requests weren't counted because too many usage counts were pending", dropped)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return u.usage.addCounts(ctx, pending)
+}
+
+// Run flushes the counts every interval until the context is canceled, and
+// once more after that.
+func (u *UsageRecorder) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := u.flush(context.WithoutCancel(ctx)); err != nil {
+				log.Error(err)
+			}
+			return
+		case <-ticker.C:
+			if err := u.flush(ctx); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// UsageApp handles the admin requests for reading API usage statistics.
+type UsageApp struct {
+	usage  *UsageDB
+	router *mux.Router
+}
+
+// NewUsageApp returns a new *UsageApp. The router should be the admin router
+// returned by newAdminRouter.
+func NewUsageApp(db *UsageDB, router *mux.Router) *UsageApp {
+	usageApp := &UsageApp{
+		usage:  db,
+		router: moduleRouter(router, "usage", "/usage"),
+	}
+	usageApp.router.HandleFunc("", usageApp.TopRequest).Methods(http.MethodGet)
+	usageApp.router.HandleFunc("/{username}", usageApp.GetRequest).Methods(http.MethodGet)
+	return usageApp
+}
+
+// usageDays parses the range of days to report usage for from the since and
+// until query parameters. Usage is counted by UTC day, so the range covers
+// every day that the times fall in, up to but not including until. Without
+// since, the range starts defaultUsageDays before it ends; without until, it
+// ends today.
+func usageDays(r *http.Request, now time.Time) (time.Time, time.Time, error) {
+	var since, until time.Time
+	if err := parseTimeRange(r.URL.Query(), &since, &until); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	last := now.UTC().Truncate(24 * time.Hour)
+	if !until.IsZero() {
+		last = until.UTC().Add(-time.Nanosecond).Truncate(24 * time.Hour)
+	}
+	first := last.AddDate(0, 0, 1-defaultUsageDays)
+	if !since.IsZero() {
+		first = since.UTC().Truncate(24 * time.Hour)
+	}
+
+	if last.Before(first) {
+		return time.Time{}, time.Time{}, fmt.Errorf("until must be after since")
+	}
+	return first, last, nil
+}
+
+// GetRequest returns the API usage of the user over the range of days in the
+// query parameters: the number of requests made for them in total, by route,
+// and by day, along with how many failed. Requests for users that don't exist
+// are counted too, so there's no check that the user exists.
+func (u *UsageApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	first, last, err := usageDays(r, time.Now())
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	usage, err := u.usage.getUsage(r.Context(), username, first, last)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the API usage of user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, usage)
+}
+
+// TopRequest returns a page of the users who made the most requests over the
+// range of days in the query parameters, busiest first.
+func (u *UsageApp) TopRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		filter = &UsageFilter{}
+	)
+	if filter.First, filter.Last, err = usageDays(r, time.Now()); err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+	if filter.Page, err = httpapi.ParsePage(r, defaultUsageLimit, maxUsageLimit); err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	consumers, total, err := u.usage.topConsumers(r.Context(), filter)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing the top API consumers: %s", err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, filter.Page, consumers, total)
+}
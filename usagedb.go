@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/lib/pq"
+)
+
+// usageDayLayout is the format of the days that usage is counted by, which are
+// UTC days.
+const usageDayLayout = "2006-01-02"
+
+// usageKey identifies a count of a user's requests to a route on a day. The
+// route is the method and path template, e.g. "GET /bags/{username}".
+type usageKey struct {
+	username string
+	route    string
+	day      string
+}
+
+// usageCount is the number of requests counted under a usageKey, and how
+// many of them failed.
+type usageCount struct {
+	requests int64
+	errors   int64
+}
+
+// RouteUsage is the number of requests a user made to a route, and how many
+// of them failed with a 4xx or 5xx status.
+type RouteUsage struct {
+	Route    string `json:"route"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+// DayUsage is the number of requests a user made on a UTC day, and how many of
+// them failed.
+type DayUsage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+// UserUsage is the API usage of a user from the first day to the last, both
+// inclusive, in total, by route, and by day.
+type UserUsage struct {
+	Username string       `json:"username"`
+	First    string       `json:"first_day"`
+	Last     string       `json:"last_day"`
+	Requests int64        `json:"requests"`
+	Errors   int64        `json:"errors"`
+	Routes   []RouteUsage `json:"routes"`
+	Days     []DayUsage   `json:"days"`
+}
+
+// ConsumerUsage is the number of requests a user made over a range of days,
+// for the top consumers report.
+type ConsumerUsage struct {
+	Username string `json:"username"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+// UsageFilter selects the page of top consumers to list from a range of days,
+// both inclusive.
+type UsageFilter struct {
+	First time.Time
+	Last  time.Time
+	httpapi.Page
+}
+
+// UsageDB handles interacting with the user_usage table, which counts the
+// requests made for each user by route and by day. Rows are keyed by username
+// rather than user ID so that requests for users who don't exist, e.g. from a
+// misconfigured client, are counted too.
+type UsageDB struct {
+	db *retryingDB
+}
+
+// NewUsageDB returns a newly created *UsageDB.
+func NewUsageDB(db *sql.DB) *UsageDB {
+	return &UsageDB{db: withRetries(db)}
+}
+
+// addCounts adds the counts to the ones stored.
+func (u *UsageDB) addCounts(ctx context.Context, counts map[usageKey]*usageCount) error {
+	query := `INSERT INTO user_usage (username, route, day, requests, errors)
+                   SELECT c.username, c.route, c.day, c.requests, c.errors
+                     FROM unnest($1::text[], $2::text[], $3::date[], $4::bigint[], $5::bigint[]) AS c(username, route, day, requests, errors)
+              ON CONFLICT (username, day, route) DO UPDATE
+                      SET requests = user_usage.requests + EXCLUDED.requests,
+                          errors = user_usage.errors + EXCLUDED.errors`
+
+	var (
+		usernames = make([]string, 0, len(counts))
+		routes    = make([]string, 0, len(counts))
+		days      = make([]string, 0, len(counts))
+		requests  = make([]int64, 0, len(counts))
+		errors    = make([]int64, 0, len(counts))
+	)
+	for key, count := range counts {
+		usernames, routes, days = append(usernames, key.username), append(routes, key.route), append(days, key.day)
+		requests, errors = append(requests, count.requests), append(errors, count.errors)
+	}
+
+	if _, err := u.db.ExecContext(ctx, query, pq.Array(usernames), pq.Array(routes), pq.Array(days), pq.Array(requests), pq.Array(errors)); err != nil {
+		return fmt.Errorf("error recording the usage of %d routes: %w", len(counts), dbError(err))
+	}
+	return nil
+}
+
+// usageRows starts a query for the usage rows from the first day to the last.
+func usageRows(first, last time.Time, columns ...string) *selectQuery {
+	return selectFrom("user_usage", columns...).
+		Where("day >= ?::date", first.Format(usageDayLayout)).
+		Where("day <= ?::date", last.Format(usageDayLayout))
+}
+
+// getUsage returns the user's usage from the first day to the last. Routes
+// are listed from the most requested, and days from the earliest.
+func (u *UsageDB) getUsage(ctx context.Context, username string, first, last time.Time) (*UserUsage, error) {
+	usage := &UserUsage{
+		Username: username,
+		First:    first.Format(usageDayLayout),
+		Last:     last.Format(usageDayLayout),
+		Routes:   []RouteUsage{},
+		Days:     []DayUsage{},
+	}
+
+	query, args := usageRows(first, last, "route", "SUM(requests) AS requests", "SUM(errors) AS errors").
+		Where("username = ?", username).
+		GroupBy("route").
+		OrderBy("requests DESC", "route").
+		SQL()
+	rows, err := u.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var route RouteUsage
+		if err = rows.Scan(&route.Route, &route.Requests, &route.Errors); err != nil {
+			return nil, err
+		}
+		usage.Routes = append(usage.Routes, route)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+
+	query, args = usageRows(first, last, "day", "SUM(requests)", "SUM(errors)").
+		Where("username = ?", username).
+		GroupBy("day").
+		OrderBy("day").
+		SQL()
+	if rows, err = u.db.QueryContext(ctx, query, args...); err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			day   DayUsage
+			value time.Time
+		)
+		if err = rows.Scan(&value, &day.Requests, &day.Errors); err != nil {
+			return nil, err
+		}
+		day.Day = value.Format(usageDayLayout)
+		usage.Days = append(usage.Days, day)
+		usage.Requests += day.Requests
+		usage.Errors += day.Errors
+	}
+	return usage, dbError(rows.Err())
+}
+
+// topConsumers returns the page of the users who made the most requests over
+// the filter's range of days, along with the number of users who made any.
+func (u *UsageDB) topConsumers(ctx context.Context, filter *UsageFilter) ([]ConsumerUsage, int64, error) {
+	var total int64
+
+	q := usageRows(filter.First, filter.Last, "username", "SUM(requests) AS requests", "SUM(errors) AS errors").
+		GroupBy("username")
+
+	countQuery, countArgs := q.Count().SQL()
+	if err := u.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	query, args := q.OrderBy("requests DESC", "username").Page(filter.Page).SQL()
+	rows, err := u.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, dbError(err)
+	}
+	defer rows.Close()
+
+	consumers := []ConsumerUsage{}
+	for rows.Next() {
+		var consumer ConsumerUsage
+		if err = rows.Scan(&consumer.Username, &consumer.Requests, &consumer.Errors); err != nil {
+			return nil, 0, err
+		}
+		consumers = append(consumers, consumer)
+	}
+	return consumers, total, dbError(rows.Err())
+}
+
+// purge removes the counts for the days before the one that before falls on.
+// Returns the number of rows removed.
+func (u *UsageDB) purge(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM ONLY user_usage WHERE day < $1::date`
+
+	result, err := u.db.ExecContext(ctx, query, before.UTC().Format(usageDayLayout))
+	if err != nil {
+		return 0, fmt.Errorf("error purging usage counts: %w", dbError(err))
+	}
+	return result.RowsAffected()
+}
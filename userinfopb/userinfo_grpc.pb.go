@@ -0,0 +1,739 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: userinfopb/userinfo.proto
+
+package userinfopb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	UserInfo_GetPreferences_FullMethodName      = "/cyverse.userinfo.v1.UserInfo/GetPreferences"
+	UserInfo_SetPreferences_FullMethodName      = "/cyverse.userinfo.v1.UserInfo/SetPreferences"
+	UserInfo_DeletePreferences_FullMethodName   = "/cyverse.userinfo.v1.UserInfo/DeletePreferences"
+	UserInfo_GetSession_FullMethodName          = "/cyverse.userinfo.v1.UserInfo/GetSession"
+	UserInfo_SetSession_FullMethodName          = "/cyverse.userinfo.v1.UserInfo/SetSession"
+	UserInfo_DeleteSession_FullMethodName       = "/cyverse.userinfo.v1.UserInfo/DeleteSession"
+	UserInfo_GetSavedSearches_FullMethodName    = "/cyverse.userinfo.v1.UserInfo/GetSavedSearches"
+	UserInfo_SetSavedSearches_FullMethodName    = "/cyverse.userinfo.v1.UserInfo/SetSavedSearches"
+	UserInfo_DeleteSavedSearches_FullMethodName = "/cyverse.userinfo.v1.UserInfo/DeleteSavedSearches"
+	UserInfo_ListBags_FullMethodName            = "/cyverse.userinfo.v1.UserInfo/ListBags"
+	UserInfo_GetBag_FullMethodName              = "/cyverse.userinfo.v1.UserInfo/GetBag"
+	UserInfo_AddBag_FullMethodName              = "/cyverse.userinfo.v1.UserInfo/AddBag"
+	UserInfo_UpdateBag_FullMethodName           = "/cyverse.userinfo.v1.UserInfo/UpdateBag"
+	UserInfo_DeleteBag_FullMethodName           = "/cyverse.userinfo.v1.UserInfo/DeleteBag"
+	UserInfo_DeleteAllBags_FullMethodName       = "/cyverse.userinfo.v1.UserInfo/DeleteAllBags"
+	UserInfo_GetDefaultBag_FullMethodName       = "/cyverse.userinfo.v1.UserInfo/GetDefaultBag"
+	UserInfo_UpdateDefaultBag_FullMethodName    = "/cyverse.userinfo.v1.UserInfo/UpdateDefaultBag"
+	UserInfo_DeleteDefaultBag_FullMethodName    = "/cyverse.userinfo.v1.UserInfo/DeleteDefaultBag"
+)
+
+// UserInfoClient is the client API for UserInfo service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type UserInfoClient interface {
+	GetPreferences(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Document, error)
+	SetPreferences(ctx context.Context, in *Document, opts ...grpc.CallOption) (*Document, error)
+	DeletePreferences(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	GetSession(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Document, error)
+	SetSession(ctx context.Context, in *Document, opts ...grpc.CallOption) (*Document, error)
+	DeleteSession(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	GetSavedSearches(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Document, error)
+	SetSavedSearches(ctx context.Context, in *Document, opts ...grpc.CallOption) (*Document, error)
+	DeleteSavedSearches(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListBags(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*BagList, error)
+	GetBag(ctx context.Context, in *BagRequest, opts ...grpc.CallOption) (*Bag, error)
+	AddBag(ctx context.Context, in *AddBagRequest, opts ...grpc.CallOption) (*Bag, error)
+	UpdateBag(ctx context.Context, in *UpdateBagRequest, opts ...grpc.CallOption) (*Bag, error)
+	DeleteBag(ctx context.Context, in *BagRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	DeleteAllBags(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	GetDefaultBag(ctx context.Context, in *DefaultBagRequest, opts ...grpc.CallOption) (*Bag, error)
+	UpdateDefaultBag(ctx context.Context, in *UpdateDefaultBagRequest, opts ...grpc.CallOption) (*Bag, error)
+	DeleteDefaultBag(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+type userInfoClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUserInfoClient(cc grpc.ClientConnInterface) UserInfoClient {
+	return &userInfoClient{cc}
+}
+
+func (c *userInfoClient) GetPreferences(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Document, error) {
+	out := new(Document)
+	err := c.cc.Invoke(ctx, UserInfo_GetPreferences_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) SetPreferences(ctx context.Context, in *Document, opts ...grpc.CallOption) (*Document, error) {
+	out := new(Document)
+	err := c.cc.Invoke(ctx, UserInfo_SetPreferences_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) DeletePreferences(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, UserInfo_DeletePreferences_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) GetSession(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Document, error) {
+	out := new(Document)
+	err := c.cc.Invoke(ctx, UserInfo_GetSession_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) SetSession(ctx context.Context, in *Document, opts ...grpc.CallOption) (*Document, error) {
+	out := new(Document)
+	err := c.cc.Invoke(ctx, UserInfo_SetSession_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) DeleteSession(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, UserInfo_DeleteSession_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) GetSavedSearches(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Document, error) {
+	out := new(Document)
+	err := c.cc.Invoke(ctx, UserInfo_GetSavedSearches_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) SetSavedSearches(ctx context.Context, in *Document, opts ...grpc.CallOption) (*Document, error) {
+	out := new(Document)
+	err := c.cc.Invoke(ctx, UserInfo_SetSavedSearches_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) DeleteSavedSearches(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, UserInfo_DeleteSavedSearches_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) ListBags(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*BagList, error) {
+	out := new(BagList)
+	err := c.cc.Invoke(ctx, UserInfo_ListBags_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) GetBag(ctx context.Context, in *BagRequest, opts ...grpc.CallOption) (*Bag, error) {
+	out := new(Bag)
+	err := c.cc.Invoke(ctx, UserInfo_GetBag_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) AddBag(ctx context.Context, in *AddBagRequest, opts ...grpc.CallOption) (*Bag, error) {
+	out := new(Bag)
+	err := c.cc.Invoke(ctx, UserInfo_AddBag_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) UpdateBag(ctx context.Context, in *UpdateBagRequest, opts ...grpc.CallOption) (*Bag, error) {
+	out := new(Bag)
+	err := c.cc.Invoke(ctx, UserInfo_UpdateBag_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) DeleteBag(ctx context.Context, in *BagRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, UserInfo_DeleteBag_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) DeleteAllBags(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, UserInfo_DeleteAllBags_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) GetDefaultBag(ctx context.Context, in *DefaultBagRequest, opts ...grpc.CallOption) (*Bag, error) {
+	out := new(Bag)
+	err := c.cc.Invoke(ctx, UserInfo_GetDefaultBag_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) UpdateDefaultBag(ctx context.Context, in *UpdateDefaultBagRequest, opts ...grpc.CallOption) (*Bag, error) {
+	out := new(Bag)
+	err := c.cc.Invoke(ctx, UserInfo_UpdateDefaultBag_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userInfoClient) DeleteDefaultBag(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, UserInfo_DeleteDefaultBag_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UserInfoServer is the server API for UserInfo service.
+// All implementations must embed UnimplementedUserInfoServer
+// for forward compatibility
+type UserInfoServer interface {
+	GetPreferences(context.Context, *UserRequest) (*Document, error)
+	SetPreferences(context.Context, *Document) (*Document, error)
+	DeletePreferences(context.Context, *UserRequest) (*emptypb.Empty, error)
+	GetSession(context.Context, *UserRequest) (*Document, error)
+	SetSession(context.Context, *Document) (*Document, error)
+	DeleteSession(context.Context, *UserRequest) (*emptypb.Empty, error)
+	GetSavedSearches(context.Context, *UserRequest) (*Document, error)
+	SetSavedSearches(context.Context, *Document) (*Document, error)
+	DeleteSavedSearches(context.Context, *UserRequest) (*emptypb.Empty, error)
+	ListBags(context.Context, *UserRequest) (*BagList, error)
+	GetBag(context.Context, *BagRequest) (*Bag, error)
+	AddBag(context.Context, *AddBagRequest) (*Bag, error)
+	UpdateBag(context.Context, *UpdateBagRequest) (*Bag, error)
+	DeleteBag(context.Context, *BagRequest) (*emptypb.Empty, error)
+	DeleteAllBags(context.Context, *UserRequest) (*emptypb.Empty, error)
+	GetDefaultBag(context.Context, *DefaultBagRequest) (*Bag, error)
+	UpdateDefaultBag(context.Context, *UpdateDefaultBagRequest) (*Bag, error)
+	DeleteDefaultBag(context.Context, *UserRequest) (*emptypb.Empty, error)
+	mustEmbedUnimplementedUserInfoServer()
+}
+
+// UnimplementedUserInfoServer must be embedded to have forward compatible implementations.
+type UnimplementedUserInfoServer struct {
+}
+
+func (UnimplementedUserInfoServer) GetPreferences(context.Context, *UserRequest) (*Document, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPreferences not implemented")
+}
+func (UnimplementedUserInfoServer) SetPreferences(context.Context, *Document) (*Document, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPreferences not implemented")
+}
+func (UnimplementedUserInfoServer) DeletePreferences(context.Context, *UserRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeletePreferences not implemented")
+}
+func (UnimplementedUserInfoServer) GetSession(context.Context, *UserRequest) (*Document, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSession not implemented")
+}
+func (UnimplementedUserInfoServer) SetSession(context.Context, *Document) (*Document, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSession not implemented")
+}
+func (UnimplementedUserInfoServer) DeleteSession(context.Context, *UserRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSession not implemented")
+}
+func (UnimplementedUserInfoServer) GetSavedSearches(context.Context, *UserRequest) (*Document, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSavedSearches not implemented")
+}
+func (UnimplementedUserInfoServer) SetSavedSearches(context.Context, *Document) (*Document, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSavedSearches not implemented")
+}
+func (UnimplementedUserInfoServer) DeleteSavedSearches(context.Context, *UserRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSavedSearches not implemented")
+}
+func (UnimplementedUserInfoServer) ListBags(context.Context, *UserRequest) (*BagList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBags not implemented")
+}
+func (UnimplementedUserInfoServer) GetBag(context.Context, *BagRequest) (*Bag, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBag not implemented")
+}
+func (UnimplementedUserInfoServer) AddBag(context.Context, *AddBagRequest) (*Bag, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddBag not implemented")
+}
+func (UnimplementedUserInfoServer) UpdateBag(context.Context, *UpdateBagRequest) (*Bag, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateBag not implemented")
+}
+func (UnimplementedUserInfoServer) DeleteBag(context.Context, *BagRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteBag not implemented")
+}
+func (UnimplementedUserInfoServer) DeleteAllBags(context.Context, *UserRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteAllBags not implemented")
+}
+func (UnimplementedUserInfoServer) GetDefaultBag(context.Context, *DefaultBagRequest) (*Bag, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDefaultBag not implemented")
+}
+func (UnimplementedUserInfoServer) UpdateDefaultBag(context.Context, *UpdateDefaultBagRequest) (*Bag, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateDefaultBag not implemented")
+}
+func (UnimplementedUserInfoServer) DeleteDefaultBag(context.Context, *UserRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteDefaultBag not implemented")
+}
+func (UnimplementedUserInfoServer) mustEmbedUnimplementedUserInfoServer() {}
+
+// UnsafeUserInfoServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UserInfoServer will
+// result in compilation errors.
+type UnsafeUserInfoServer interface {
+	mustEmbedUnimplementedUserInfoServer()
+}
+
+func RegisterUserInfoServer(s grpc.ServiceRegistrar, srv UserInfoServer) {
+	s.RegisterService(&UserInfo_ServiceDesc, srv)
+}
+
+func _UserInfo_GetPreferences_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).GetPreferences(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_GetPreferences_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).GetPreferences(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_SetPreferences_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Document)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).SetPreferences(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_SetPreferences_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).SetPreferences(ctx, req.(*Document))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_DeletePreferences_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).DeletePreferences(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_DeletePreferences_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).DeletePreferences(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_GetSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).GetSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_GetSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).GetSession(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_SetSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Document)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).SetSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_SetSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).SetSession(ctx, req.(*Document))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_DeleteSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).DeleteSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_DeleteSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).DeleteSession(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_GetSavedSearches_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).GetSavedSearches(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_GetSavedSearches_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).GetSavedSearches(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_SetSavedSearches_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Document)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).SetSavedSearches(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_SetSavedSearches_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).SetSavedSearches(ctx, req.(*Document))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_DeleteSavedSearches_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).DeleteSavedSearches(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_DeleteSavedSearches_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).DeleteSavedSearches(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_ListBags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).ListBags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_ListBags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).ListBags(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_GetBag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).GetBag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_GetBag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).GetBag(ctx, req.(*BagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_AddBag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddBagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).AddBag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_AddBag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).AddBag(ctx, req.(*AddBagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_UpdateBag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateBagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).UpdateBag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_UpdateBag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).UpdateBag(ctx, req.(*UpdateBagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_DeleteBag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).DeleteBag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_DeleteBag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).DeleteBag(ctx, req.(*BagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_DeleteAllBags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).DeleteAllBags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_DeleteAllBags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).DeleteAllBags(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_GetDefaultBag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DefaultBagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).GetDefaultBag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_GetDefaultBag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).GetDefaultBag(ctx, req.(*DefaultBagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_UpdateDefaultBag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateDefaultBagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).UpdateDefaultBag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_UpdateDefaultBag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).UpdateDefaultBag(ctx, req.(*UpdateDefaultBagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserInfo_DeleteDefaultBag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserInfoServer).DeleteDefaultBag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserInfo_DeleteDefaultBag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserInfoServer).DeleteDefaultBag(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// UserInfo_ServiceDesc is the grpc.ServiceDesc for UserInfo service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var UserInfo_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cyverse.userinfo.v1.UserInfo",
+	HandlerType: (*UserInfoServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetPreferences",
+			Handler:    _UserInfo_GetPreferences_Handler,
+		},
+		{
+			MethodName: "SetPreferences",
+			Handler:    _UserInfo_SetPreferences_Handler,
+		},
+		{
+			MethodName: "DeletePreferences",
+			Handler:    _UserInfo_DeletePreferences_Handler,
+		},
+		{
+			MethodName: "GetSession",
+			Handler:    _UserInfo_GetSession_Handler,
+		},
+		{
+			MethodName: "SetSession",
+			Handler:    _UserInfo_SetSession_Handler,
+		},
+		{
+			MethodName: "DeleteSession",
+			Handler:    _UserInfo_DeleteSession_Handler,
+		},
+		{
+			MethodName: "GetSavedSearches",
+			Handler:    _UserInfo_GetSavedSearches_Handler,
+		},
+		{
+			MethodName: "SetSavedSearches",
+			Handler:    _UserInfo_SetSavedSearches_Handler,
+		},
+		{
+			MethodName: "DeleteSavedSearches",
+			Handler:    _UserInfo_DeleteSavedSearches_Handler,
+		},
+		{
+			MethodName: "ListBags",
+			Handler:    _UserInfo_ListBags_Handler,
+		},
+		{
+			MethodName: "GetBag",
+			Handler:    _UserInfo_GetBag_Handler,
+		},
+		{
+			MethodName: "AddBag",
+			Handler:    _UserInfo_AddBag_Handler,
+		},
+		{
+			MethodName: "UpdateBag",
+			Handler:    _UserInfo_UpdateBag_Handler,
+		},
+		{
+			MethodName: "DeleteBag",
+			Handler:    _UserInfo_DeleteBag_Handler,
+		},
+		{
+			MethodName: "DeleteAllBags",
+			Handler:    _UserInfo_DeleteAllBags_Handler,
+		},
+		{
+			MethodName: "GetDefaultBag",
+			Handler:    _UserInfo_GetDefaultBag_Handler,
+		},
+		{
+			MethodName: "UpdateDefaultBag",
+			Handler:    _UserInfo_UpdateDefaultBag_Handler,
+		},
+		{
+			MethodName: "DeleteDefaultBag",
+			Handler:    _UserInfo_DeleteDefaultBag_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "userinfopb/userinfo.proto",
+}
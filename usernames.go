@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// normalizeUsernameParam is the query parameter, and the gRPC metadata key,
+// that turns off username normalization for a request when set to false.
+const normalizeUsernameParam = "normalize_username"
+
+// userDomainHeader is the header, and the gRPC metadata key, that trusted
+// callers use to override the default user domain for a request.
+const userDomainHeader = "X-User-Domain"
+
+// impersonateUserHeader is the header, and the gRPC metadata key, that admin
+// callers use to act on another user's data for a request, e.g. so that support
+// staff can reproduce a problem a user is having.
+const impersonateUserHeader = "X-Impersonate-User"
+
+type userDomainKey struct{}
+
+type impersonatorKey struct{}
+
+// withImpersonator returns a copy of the context recording that the request
+// it belongs to was made by the user impersonating another.
+func withImpersonator(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, impersonatorKey{}, username)
+}
+
+// impersonator returns the user who made the request the context belongs to
+// while impersonating another user, or an empty string if nobody was.
+func impersonator(ctx context.Context) string {
+	username, _ := ctx.Value(impersonatorKey{}).(string)
+	return username
+}
+
+// withUserDomain returns a copy of the context in which short usernames get the
+// domain instead of the configured default domain.
+func withUserDomain(ctx context.Context, domain string) context.Context {
+	return context.WithValue(ctx, userDomainKey{}, domain)
+}
+
+// userDomainOverride returns the domain that overrides the default domain for
+// the request the context belongs to, or an empty string if there isn't one.
+func userDomainOverride(ctx context.Context) string {
+	domain, _ := ctx.Value(userDomainKey{}).(string)
+	return domain
+}
+
+// userDomains are the domains that usernames may have. Short usernames get
+// the default domain.
+type userDomains struct {
+	defaultDomain string
+	accepted      map[string]bool
+}
+
+// newUserDomains returns the userDomains for the default domain and the other
+// accepted domains. The default domain is always accepted.
+func newUserDomains(defaultDomain string, accepted []string) userDomains {
+	d := userDomains{
+		defaultDomain: strings.Trim(defaultDomain, "@"),
+		accepted:      make(map[string]bool, len(accepted)+1),
+	}
+	d.accepted[d.defaultDomain] = true
+	for _, domain := range accepted {
+		d.accepted[strings.Trim(domain, "@")] = true
+	}
+	return d
+}
+
+// forContext returns the domains to use for the request the context belongs
+// to. If the request overrides the default domain, the override is the default
+// and is accepted along with the configured domains.
+func (d userDomains) forContext(ctx context.Context) userDomains {
+	override := userDomainOverride(ctx)
+	if override == "" || override == d.defaultDomain {
+		return d
+	}
+
+	o := userDomains{
+		defaultDomain: override,
+		accepted:      make(map[string]bool, len(d.accepted)+1),
+	}
+	for domain := range d.accepted {
+		o.accepted[domain] = true
+	}
+	o.accepted[override] = true
+	return o
+}
+
+// parseUserDomain validates the domain sent in the X-User-Domain header.
+func parseUserDomain(value string) (string, error) {
+	domain := strings.Trim(strings.TrimSpace(value), "@")
+	if domain == "" || strings.ContainsAny(domain, "@/ \t") {
+		return "", fmt.Errorf("invalid %s: %q", userDomainHeader, value)
+	}
+	return domain, nil
+}
+
+// unknownDomainError is returned for usernames whose domain isn't accepted.
+type unknownDomainError struct {
+	username string
+	domain   string
+}
+
+func (e unknownDomainError) Error() string {
+	return fmt.Sprintf("the domain of username %s isn't one of the accepted user domains: %s", e.username, e.domain)
+}
+
+// qualify appends the default domain to a username that doesn't already have
+// a domain. Returns an unknownDomainError if the username's domain isn't
+// accepted.
+func (d userDomains) qualify(username string) (string, error) {
+	if username == "" {
+		return username, nil
+	}
+
+	_, domain, ok := strings.Cut(username, "@")
+	if !ok {
+		return username + "@" + d.defaultDomain, nil
+	}
+	if !d.accepted[domain] {
+		return "", unknownDomainError{username: username, domain: domain}
+	}
+	return username, nil
+}
+
+// bagsUsername returns the username that the bags tables use, which keeps an
+// accepted domain and replaces any other domain with the default one.
+func (d userDomains) bagsUsername(username string) string {
+	if _, domain, ok := strings.Cut(username, "@"); ok && d.accepted[domain] {
+		return username
+	}
+	return addUserDomain(username, d.defaultDomain)
+}
+
+// UsernameNormalizer adds the default user domain to the short usernames in
+// requests, so that every module accepts both short and fully-qualified
+// usernames, and rejects usernames with domains that aren't accepted.
+type UsernameNormalizer struct {
+	mu      sync.RWMutex
+	domains userDomains
+
+	// overrideKeys are the names of the API keys whose callers may send the
+	// X-User-Domain header.
+	overrideKeys map[string]bool
+
+	// impersonationKeys are the names of the API keys whose callers may send
+	// the X-Impersonate-User header.
+	impersonationKeys map[string]bool
+}
+
+// NewUsernameNormalizer returns a new *UsernameNormalizer that appends
+// userDomain to short usernames and accepts usernames in it or any of the
+// accepted domains.
+func NewUsernameNormalizer(userDomain string, accepted []string) *UsernameNormalizer {
+	return &UsernameNormalizer{domains: newUserDomains(userDomain, accepted)}
+}
+
+// SetUserDomains changes the default and accepted user domains.
+func (u *UsernameNormalizer) SetUserDomains(userDomain string, accepted []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.domains = newUserDomains(userDomain, accepted)
+}
+
+// AllowDomainOverride lets callers that authenticate with the named API keys
+// override the default user domain for their requests with the X-User-Domain
+// header. Requests from other callers that send the header are rejected.
+func (u *UsernameNormalizer) AllowDomainOverride(keyNames []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.overrideKeys = make(map[string]bool, len(keyNames))
+	for _, name := range keyNames {
+		u.overrideKeys[name] = true
+	}
+}
+
+// AllowImpersonation lets callers that authenticate with the named API keys,
+// which should be the admin keys, act on another user's data with the
+// X-Impersonate-User header. Requests from other callers that send the header
+// are rejected, so nobody may impersonate users if no keys are named.
+func (u *UsernameNormalizer) AllowImpersonation(keyNames []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.impersonationKeys = make(map[string]bool, len(keyNames))
+	for _, name := range keyNames {
+		u.impersonationKeys[name] = true
+	}
+}
+
+// Normalize returns the fully-qualified form of the username.
+func (u *UsernameNormalizer) Normalize(username string) (string, error) {
+	return u.NormalizeFor(context.Background(), username)
+}
+
+// NormalizeFor returns the fully-qualified form of the username for the
+// request the context belongs to, which may override the default domain.
+func (u *UsernameNormalizer) NormalizeFor(ctx context.Context, username string) (string, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.domains.forContext(ctx).qualify(username)
+}
+
+// domainOverride returns the context to handle a request with, given the value
+// of its X-User-Domain header. The header is only honored for callers with one
+// of the override keys; the returned status says why it was rejected otherwise.
+func (u *UsernameNormalizer) domainOverride(ctx context.Context, value string) (context.Context, int, error) {
+	if value == "" {
+		return ctx, 0, nil
+	}
+
+	u.mu.RLock()
+	trusted := u.overrideKeys[apiKeyName(ctx)]
+	u.mu.RUnlock()
+	if !trusted {
+		return nil, http.StatusForbidden, fmt.Errorf("the caller is not allowed to send %s", userDomainHeader)
+	}
+
+	domain, err := parseUserDomain(value)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return withUserDomain(ctx, domain), 0, nil
+}
+
+// impersonation returns the user that the request acts on instead of the one
+// it names, given the value of its X-Impersonate-User header, or an empty
+// string if it doesn't impersonate anyone. The header is only honored for
+// callers with one of the impersonation keys; the returned status says why it
+// was rejected otherwise.
+func (u *UsernameNormalizer) impersonation(ctx context.Context, value string) (string, int, error) {
+	if value == "" {
+		return "", 0, nil
+	}
+
+	u.mu.RLock()
+	trusted := u.impersonationKeys[apiKeyName(ctx)]
+	u.mu.RUnlock()
+	if !trusted {
+		return "", http.StatusForbidden, fmt.Errorf("the caller is not allowed to send %s", impersonateUserHeader)
+	}
+
+	username := strings.TrimSpace(value)
+	if username == "" || strings.ContainsAny(username, "/ \t") {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid %s: %q", impersonateUserHeader, value)
+	}
+	return username, 0, nil
+}
+
+// Middleware normalizes the {username} route variable unless the
+// normalize_username query parameter is false. Usernames in domains that
+// aren't accepted get a 400. The X-User-Domain header overrides the default
+// domain for trusted callers and gets a 403 from anyone else.
+//
+// The X-Impersonate-User header replaces the {username} route variable with
+// the user it names, so that the request acts on their data, and records the
+// user the route named as the impersonator in the request context. Like
+// X-User-Domain, it gets a 403 from callers that aren't allowed to send it.
+func (u *UsernameNormalizer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		ctx, status, err := u.domainOverride(r.Context(), r.Header.Get(userDomainHeader))
+		if err != nil {
+			httpapi.Error(writer, err.Error(), status)
+			log.WithContext(r.Context()).Error(err)
+			return
+		}
+		impersonated, status, err := u.impersonation(ctx, r.Header.Get(impersonateUserHeader))
+		if err != nil {
+			httpapi.Error(writer, err.Error(), status)
+			log.WithContext(r.Context()).Error(err)
+			return
+		}
+		r = r.WithContext(ctx)
+
+		vars := mux.Vars(r)
+		username, ok := vars["username"]
+		if !ok {
+			next.ServeHTTP(writer, r)
+			return
+		}
+		normalize := !strings.EqualFold(r.URL.Query().Get(normalizeUsernameParam), "false")
+		if !normalize && impersonated == "" {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		normalized := make(map[string]string, len(vars))
+		for k, v := range vars {
+			normalized[k] = v
+		}
+		for _, name := range []*string{&username, &impersonated} {
+			if !normalize || *name == "" {
+				continue
+			}
+			qualified, err := u.NormalizeFor(ctx, *name)
+			if err != nil {
+				httpapi.WriteProblem(writer, http.StatusBadRequest, httpapi.CodeUnknownUserDomain, err.Error(), map[string]interface{}{
+					"user": *name,
+				})
+				log.WithContext(r.Context()).Error(err)
+				return
+			}
+			*name = qualified
+		}
+
+		normalized["username"] = username
+		if impersonated != "" {
+			ctx = withImpersonator(ctx, username)
+			setLogField(ctx, "impersonator", username)
+			normalized["username"] = impersonated
+		}
+
+		setLogField(ctx, "username", normalized["username"])
+		next.ServeHTTP(writer, mux.SetURLVars(r.WithContext(ctx), normalized))
+	})
+}
+
+// UnaryInterceptor is the gRPC equivalent of Middleware. It normalizes the
+// username field of requests unless the normalize_username metadata is false.
+// Usernames in domains that aren't accepted fail with INVALID_ARGUMENT. The
+// x-user-domain and x-impersonate-user metadata are handled like the headers,
+// except that untrusted callers get PERMISSION_DENIED.
+func (u *UsernameNormalizer) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var override, impersonate string
+	normalize := true
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(userDomainHeader); len(values) > 0 {
+			override = values[0]
+		}
+		if values := md.Get(impersonateUserHeader); len(values) > 0 {
+			impersonate = values[0]
+		}
+		if values := md.Get(normalizeUsernameParam); len(values) > 0 && strings.EqualFold(values[0], "false") {
+			normalize = false
+		}
+	}
+	ctx, httpStatus, err := u.domainOverride(ctx, override)
+	if err == nil {
+		impersonate, httpStatus, err = u.impersonation(ctx, impersonate)
+	}
+	if err != nil {
+		if httpStatus == http.StatusForbidden {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	m, ok := req.(proto.Message)
+	if !ok {
+		return handler(ctx, req)
+	}
+	msg := m.ProtoReflect()
+	field := msg.Descriptor().Fields().ByName("username")
+	if field == nil || field.Kind() != protoreflect.StringKind {
+		return handler(ctx, req)
+	}
+
+	username := msg.Get(field).String()
+	for _, name := range []*string{&username, &impersonate} {
+		if !normalize || *name == "" {
+			continue
+		}
+		if *name, err = u.NormalizeFor(ctx, *name); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if impersonate != "" {
+		ctx = withImpersonator(ctx, username)
+		username = impersonate
+	}
+	msg.Set(field, protoreflect.ValueOfString(username))
+
+	return handler(ctx, req)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// UsersApp handles the requests that apply to all of the data stored for a
+// user.
+type UsersApp struct {
+	users  *UsersDB
+	bags   *BagsApp
+	router *mux.Router
+}
+
+// NewUsersApp returns a new *UsersApp. bags is used to add the user domain to
+// usernames for the bags tables.
+func NewUsersApp(db *UsersDB, bags *BagsApp, router *mux.Router) *UsersApp {
+	usersApp := &UsersApp{
+		users:  db,
+		bags:   bags,
+		router: moduleRouter(router, "users", "/users"),
+	}
+	usersApp.router.HandleFunc("/{username}", usersApp.DeleteRequest).Methods(http.MethodDelete)
+	usersApp.router.HandleFunc("/{username}/export", usersApp.ExportRequest).Methods(http.MethodGet)
+	usersApp.router.HandleFunc("/{username}/deactivation", usersApp.DeactivationRequest).Methods(http.MethodGet)
+	usersApp.router.HandleFunc("/{username}/deactivate", usersApp.DeactivateRequest).Methods(http.MethodPost)
+	usersApp.router.HandleFunc("/{username}/reactivate", usersApp.ReactivateRequest).Methods(http.MethodPost)
+	return usersApp
+}
+
+// DeleteRequest purges the user's preferences, sessions, saved searches, and
+// bags in one transaction. The response lists the number of rows deleted from
+// each table.
+func (u *UsersApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		username   string
+		userExists bool
+		report     map[string]int64
+		err        error
+		ok         bool
+		v          = mux.Vars(r)
+		ctx        = r.Context()
+	)
+
+	if username, ok = v["username"]; !ok {
+		httpapi.BadRequest(writer, "Missing username in URL")
+		return
+	}
+
+	if userExists, err = u.users.isUser(ctx, username); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		return
+	}
+
+	if !userExists {
+		httpapi.UserNotFound(writer, username)
+		return
+	}
+
+	if report, err = u.users.purgeUser(ctx, username, u.bags.AddUsernameSuffix(ctx, username)); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("Error purging data for user %s: %s", username, err))
+		return
+	}
+
+	log.WithContext(ctx).Infof("purged data for user %s: %v", username, report)
+
+	writer.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(writer).Encode(map[string]interface{}{
+		"user":    username,
+		"deleted": report,
+	}); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// maxDeactivationReason is the longest reason that can be given for
+// deactivating an account.
+const maxDeactivationReason = 1024
+
+// DeactivationRequest returns whether the user's account is deactivated.
+func (u *UsersApp) DeactivationRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.users.isUser)
+	if !ok {
+		return
+	}
+
+	deactivation, err := u.users.getDeactivation(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error checking whether user %s is deactivated: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, deactivation)
+}
+
+// DeactivateRequest deactivates the user's account, so that their data can be
+// read but not changed. The body is {"reason": ..., "purge_at": ...}, where
+// both fields are optional; if purge_at is set, everything stored for the user
+// is purged at that time unless the account is reactivated first. The
+// response is a 409 if the account is already deactivated.
+func (u *UsersApp) DeactivateRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.users.isUser)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Reason  string     `json:"reason"`
+		PurgeAt *time.Time `json:"purge_at"`
+	}
+	if !decodeStrict(writer, r, &body) {
+		return
+	}
+
+	invalid := make(map[string]string)
+	if len(body.Reason) > maxDeactivationReason {
+		invalid["reason"] = fmt.Sprintf("must be at most %d bytes", maxDeactivationReason)
+	}
+	if body.PurgeAt != nil && !body.PurgeAt.After(time.Now()) {
+		invalid["purge_at"] = "must be in the future"
+	}
+	if len(invalid) > 0 {
+		httpapi.InvalidFields(writer, invalid)
+		return
+	}
+
+	deactivation, err := u.users.deactivate(r.Context(), username, body.Reason, body.PurgeAt)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error deactivating user %s: %s", username, err))
+		return
+	}
+	if deactivation == nil {
+		httpapi.Error(writer, fmt.Sprintf("user %s is already deactivated", username), http.StatusConflict)
+		return
+	}
+
+	log.WithContext(r.Context()).Infof("deactivated user %s", username)
+	httpapi.WriteJSON(writer, http.StatusOK, deactivation)
+}
+
+// ReactivateRequest reactivates the user's account and cancels any scheduled
+// purge of their data. The response is a 409 if the account isn't
+// deactivated.
+func (u *UsersApp) ReactivateRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.users.isUser)
+	if !ok {
+		return
+	}
+
+	reactivated, err := u.users.reactivate(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error reactivating user %s: %s", username, err))
+		return
+	}
+	if !reactivated {
+		httpapi.Error(writer, fmt.Sprintf("user %s isn't deactivated", username), http.StatusConflict)
+		return
+	}
+
+	log.WithContext(r.Context()).Infof("reactivated user %s", username)
+	httpapi.WriteJSON(writer, http.StatusOK, &Deactivation{Username: username})
+}
+
+// deactivationExempt returns whether the request may write to a deactivated
+// user's data anyway: reads, admin routes, and the routes under /users, which
+// manage the account itself.
+func deactivationExempt(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	route := requestRoute(r)
+	return route == "/admin" || strings.HasPrefix(route, "/admin/") || strings.HasPrefix(route, "/users/")
+}
+
+// RejectDeactivated is middleware that responds with a 403 to requests that
+// would change the data of a user whose account is deactivated. The user is
+// the one in the {username} route variable, so it has to run after the
+// username normalizer.
+func (u *UsersApp) RejectDeactivated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		username, ok := mux.Vars(r)["username"]
+		if !ok || deactivationExempt(r) {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		deactivation, err := u.users.getDeactivation(r.Context(), username)
+		if err != nil {
+			httpapi.Errored(writer, fmt.Sprintf("error checking whether user %s is deactivated: %s", username, err))
+			return
+		}
+		if deactivation.Deactivated {
+			msg := fmt.Sprintf("the account of user %s is deactivated", username)
+			httpapi.WriteProblem(writer, http.StatusForbidden, httpapi.CodeUserDeactivated, msg, map[string]interface{}{
+				"user": username,
+			})
+			log.WithContext(r.Context()).Error(msg)
+			return
+		}
+
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// PurgeDeactivatedUsers purges everything stored for the deactivated users
+// whose scheduled purge is due. Their accounts stay deactivated. Returns the
+// number of users purged.
+func (u *UsersApp) PurgeDeactivatedUsers(ctx context.Context) (int64, error) {
+	usernames, err := u.users.duePurges(ctx, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("error listing the users due to be purged: %w", err)
+	}
+
+	var purged int64
+	for _, username := range usernames {
+		report, err := u.users.purgeUser(ctx, username, u.bags.AddUsernameSuffix(ctx, username))
+		if err != nil {
+			return purged, fmt.Errorf("error purging data for user %s: %w", username, err)
+		}
+		if err = u.users.purgeDone(ctx, username); err != nil {
+			return purged, fmt.Errorf("error clearing the scheduled purge of user %s: %w", username, err)
+		}
+
+		log.WithContext(ctx).Infof("purged data for deactivated user %s: %v", username, report)
+		purged++
+	}
+	return purged, nil
+}
+
+// exportWriter writes the tables of a user data export in one of the export
+// formats.
+type exportWriter interface {
+	// table returns the writer for the table's rows.
+	table(name string) (io.Writer, error)
+
+	// close finishes the export.
+	close() error
+}
+
+// zipExport writes each table to its own JSON file in a zip archive.
+type zipExport struct {
+	zw *zip.Writer
+}
+
+func (z *zipExport) table(name string) (io.Writer, error) {
+	return z.zw.Create(name + ".json")
+}
+
+func (z *zipExport) close() error {
+	return z.zw.Close()
+}
+
+// jsonExport writes the tables as the fields of a single JSON object.
+type jsonExport struct {
+	w       io.Writer
+	started bool
+}
+
+func (j *jsonExport) table(name string) (io.Writer, error) {
+	separator := ","
+	if !j.started {
+		separator = "{"
+		j.started = true
+	}
+	if _, err := fmt.Fprintf(j.w, "%s%q:", separator, name); err != nil {
+		return nil, err
+	}
+	return j.w, nil
+}
+
+func (j *jsonExport) close() error {
+	_, err := io.WriteString(j.w, "}")
+	return err
+}
+
+// ExportRequest streams everything stored for the user, for data-subject
+// access requests. By default the response is a zip archive with a JSON file
+// for each table; the format query parameter may be set to json to get a
+// single JSON object instead. If an error occurs after the response has
+// started, it's cut short, leaving an invalid archive or document.
+func (u *UsersApp) ExportRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		username   string
+		userExists bool
+		err        error
+		ok         bool
+		v          = mux.Vars(r)
+		ctx        = r.Context()
+	)
+
+	if username, ok = v["username"]; !ok {
+		httpapi.BadRequest(writer, "Missing username in URL")
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format != "" && format != "zip" && format != "json" {
+		httpapi.BadRequest(writer, fmt.Sprintf("unsupported export format '%s'; use zip or json", format))
+		return
+	}
+
+	if userExists, err = u.users.isUser(ctx, username); err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		return
+	}
+
+	if !userExists {
+		httpapi.UserNotFound(writer, username)
+		return
+	}
+
+	export, err := streamExport(ctx, u.users, username, u.bags.AddUsernameSuffix(ctx, username), func() exportWriter {
+		if format == "json" {
+			writer.Header().Set("Content-Type", "application/json")
+			return &jsonExport{w: writer}
+		}
+		writer.Header().Set("Content-Type", "application/zip")
+		writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-export.zip"`, username))
+		return &zipExport{zw: zip.NewWriter(writer)}
+	})
+
+	if err != nil {
+		if export == nil {
+			httpapi.Errored(writer, fmt.Sprintf("Error exporting data for user %s: %s", username, err))
+			return
+		}
+		log.WithContext(ctx).Errorf("error streaming the export for %s: %s", username, err)
+		return
+	}
+
+	if err = export.close(); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// streamExport writes everything stored for the user with the exportWriter
+// returned by start, which is called once the first table has been read so
+// that errors from starting the export can still be reported. The returned
+// writer is nil if the export failed before it started; otherwise the caller
+// must close it. bagsUsername is the username with the user domain that the
+// bags tables use.
+func streamExport(ctx context.Context, users *UsersDB, username, bagsUsername string, start func() exportWriter) (exportWriter, error) {
+	return writeExport(func(fn exportFunc) error {
+		return users.exportUser(ctx, username, bagsUsername, fn)
+	}, start)
+}
+
+// exportFunc is called with the name of each exported table and a function
+// that iterates over its rows as JSON.
+type exportFunc = func(table string, rows func(func(json.RawMessage) error) error) error
+
+// writeExport writes the tables that read passes to its exportFunc with the
+// exportWriter returned by start, which is called once the first table has
+// been read. The returned writer is nil if the export failed before it
+// started; otherwise the caller must close it.
+func writeExport(read func(exportFunc) error, start func() exportWriter) (exportWriter, error) {
+	var export exportWriter
+
+	err := read(func(table string, rows func(func(json.RawMessage) error) error) error {
+		if export == nil {
+			export = start()
+		}
+
+		w, err := export.table(table)
+		if err != nil {
+			return err
+		}
+
+		separator := "["
+		if err = rows(func(row json.RawMessage) error {
+			if _, err := io.WriteString(w, separator); err != nil {
+				return err
+			}
+			separator = ","
+			_, err := w.Write(row)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		if separator == "[" {
+			_, err = io.WriteString(w, "[]")
+		} else {
+			_, err = io.WriteString(w, "]")
+		}
+		return err
+	})
+
+	return export, err
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// UsersDB handles the operations that span every table holding data for a
+// user.
+type UsersDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewUsersDB returns a newly created *UsersDB. Entries for purged users are
+// removed from cache, which may be nil.
+func NewUsersDB(db *sql.DB, cache Cache) *UsersDB {
+	return &UsersDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+// isUser returns whether or not the user exists in the database.
+func (u *UsersDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, u.cache, u.db, username)
+}
+
+// userTable is a table holding data for users. bags is true for the tables
+// keyed by the username with the bags user domain.
+type userTable struct {
+	name string
+	bags bool
+}
+
+// userTables lists the tables purged for a user, in the order they're purged.
+var userTables = []userTable{
+	{name: "user_preferences"},
+	{name: "user_sessions"},
+	{name: "user_saved_searches"},
+	{name: "default_bags", bags: true},
+	{name: "bags", bags: true},
+	{name: "user_avatars"},
+	{name: "user_tours"},
+	{name: "user_notification_prefs"},
+	{name: "user_feedback"},
+	{name: "user_pins"},
+	{name: "user_tag_resources"},
+	{name: "user_tags"},
+	{name: "user_tokens"},
+	{name: "user_webhooks"},
+	{name: "user_dashboard_widgets"},
+	{name: "user_consents"},
+	{name: "user_identities"},
+	{name: "user_digest_schedules"},
+	{name: "user_locales"},
+}
+
+// usernameTables lists the tables that are keyed by username rather than user
+// ID, so that they can hold rows for users who don't exist. They're purged and
+// exported after userTables, with the rows for both the username and the
+// username with the bags user domain, but they aren't backed up.
+var usernameTables = []string{
+	"user_usage",
+	"user_changes",
+}
+
+// purgeUsernames returns the usernames whose rows in usernameTables belong to
+// the user.
+func purgeUsernames(username, bagsUsername string) []string {
+	if bagsUsername == username {
+		return []string{username}
+	}
+	return []string{username, bagsUsername}
+}
+
+// purgeUser deletes everything stored for the user in one transaction and
+// returns the number of rows deleted from each table. bagsUsername is the
+// username with the user domain that the bags tables use.
+func (u *UsersDB) purgeUser(ctx context.Context, username, bagsUsername string) (map[string]int64, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	report := make(map[string]int64, len(userTables))
+	for _, table := range userTables {
+		name := username
+		if table.bags {
+			name = bagsUsername
+		}
+
+		query := fmt.Sprintf(`DELETE FROM %s WHERE user_id = (SELECT id FROM users WHERE username = $1)`, table.name)
+		result, err := tx.ExecContext(ctx, query, name)
+		if err != nil {
+			return nil, fmt.Errorf("error deleting from %s for %s: %w", table.name, name, dbError(err))
+		}
+
+		if report[table.name], err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, table := range usernameTables {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE username = ANY($1)`, table)
+		result, err := tx.ExecContext(ctx, query, pq.Array(purgeUsernames(username, bagsUsername)))
+		if err != nil {
+			return nil, fmt.Errorf("error deleting from %s for %s: %w", table, username, dbError(err))
+		}
+
+		if report[table], err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, dbError(err)
+	}
+
+	cacheInvalidate(ctx, u.cache,
+		hasPreferencesKey(username), preferencesKey(username),
+		hasSessionsKey(username), sessionsKey(username),
+		hasSavedSearchesKey(username), savedSearchesKey(username),
+		bagCountKey(bagsUsername), hasDefaultBagKey(bagsUsername),
+		toursKey(username), notificationPrefsKey(username), pinsKey(username),
+		userWebhooksKey(username), dashboardKey(username), digestScheduleKey(username), localeKey(username),
+	)
+
+	u.notify(ctx, Mutation{Module: "users", Action: actionPurged, Username: username})
+
+	return report, nil
+}
+
+// Deactivation is whether a user's account is deactivated. Deactivated
+// accounts keep their data, but it can't be changed until the account is
+// reactivated. PurgeAt is when the data is scheduled to be purged, if it is.
+type Deactivation struct {
+	Username      string     `json:"username"`
+	Deactivated   bool       `json:"deactivated"`
+	DeactivatedAt *time.Time `json:"deactivated_at"`
+	Reason        string     `json:"reason"`
+	PurgeAt       *time.Time `json:"purge_at"`
+}
+
+func deactivationKey(username string) string {
+	return cacheKey("users", "deactivation", username)
+}
+
+// getDeactivation returns whether the user's account is deactivated. Users
+// that don't exist aren't deactivated.
+func (u *UsersDB) getDeactivation(ctx context.Context, username string) (*Deactivation, error) {
+	if deactivation, ok := cacheGet[Deactivation](ctx, u.cache, deactivationKey(username)); ok {
+		return &deactivation, nil
+	}
+
+	query := `SELECT deactivated_at, deactivation_reason, purge_at FROM users WHERE username = $1`
+
+	deactivation := Deactivation{Username: username}
+	err := u.db.QueryRowContext(ctx, query, username).Scan(&deactivation.DeactivatedAt, &deactivation.Reason, &deactivation.PurgeAt)
+	if err == sql.ErrNoRows {
+		return &deactivation, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	deactivation.Deactivated = deactivation.DeactivatedAt != nil
+
+	cacheSet(ctx, u.cache, deactivationKey(username), deactivation)
+	return &deactivation, nil
+}
+
+// deactivate deactivates the user's account, scheduling its data to be purged
+// at purgeAt unless it's nil. Returns nil if the account was already
+// deactivated.
+func (u *UsersDB) deactivate(ctx context.Context, username, reason string, purgeAt *time.Time) (*Deactivation, error) {
+	defer cacheInvalidate(ctx, u.cache, deactivationKey(username))
+
+	query := `UPDATE users
+                 SET deactivated_at = now(), deactivation_reason = $2, purge_at = $3
+               WHERE username = $1 AND deactivated_at IS NULL
+           RETURNING deactivated_at, purge_at`
+
+	deactivation := Deactivation{Username: username, Deactivated: true, Reason: reason}
+	err := u.db.QueryRowContext(ctx, query, username, reason, purgeAt).Scan(&deactivation.DeactivatedAt, &deactivation.PurgeAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	u.notify(ctx, Mutation{Module: "users", Action: actionDeactivated, Username: username})
+	return &deactivation, nil
+}
+
+// reactivate reactivates the user's account and cancels any scheduled purge.
+// Returns false if the account wasn't deactivated.
+func (u *UsersDB) reactivate(ctx context.Context, username string) (bool, error) {
+	defer cacheInvalidate(ctx, u.cache, deactivationKey(username))
+
+	query := `UPDATE users
+                 SET deactivated_at = NULL, deactivation_reason = '', purge_at = NULL
+               WHERE username = $1 AND deactivated_at IS NOT NULL`
+
+	result, err := u.db.ExecContext(ctx, query, username)
+	if err != nil {
+		return false, dbError(err)
+	}
+	reactivated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if reactivated > 0 {
+		u.notify(ctx, Mutation{Module: "users", Action: actionReactivated, Username: username})
+	}
+	return reactivated > 0, nil
+}
+
+// duePurges returns the names of the deactivated users whose data is due to
+// be purged by now.
+func (u *UsersDB) duePurges(ctx context.Context, now time.Time) ([]string, error) {
+	query := `SELECT username FROM users
+               WHERE deactivated_at IS NOT NULL AND purge_at <= $1
+            ORDER BY purge_at`
+
+	rows, err := u.db.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err = rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, dbError(rows.Err())
+}
+
+// purgeDone clears the scheduled purge of the user's data once it's been
+// purged. The account stays deactivated.
+func (u *UsersDB) purgeDone(ctx context.Context, username string) error {
+	defer cacheInvalidate(ctx, u.cache, deactivationKey(username))
+
+	if _, err := u.db.ExecContext(ctx, `UPDATE users SET purge_at = NULL WHERE username = $1`, username); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
+
+// exportTable is a table included in user data exports. bags is true for the
+// tables keyed by the username with the bags user domain, and byUsername for
+// the ones in usernameTables.
+type exportTable struct {
+	name       string
+	query      string
+	bags       bool
+	byUsername bool
+}
+
+// exportTables lists the tables included in exports, in the order they're
+// written. Every column of each row is exported.
+var exportTables = func() []exportTable {
+	tables := []exportTable{{
+		name:  "users",
+		query: `SELECT row_to_json(t) FROM users t WHERE t.username = $1`,
+	}}
+	for _, table := range userTables {
+		tables = append(tables, exportTable{
+			name:  table.name,
+			query: fmt.Sprintf(`SELECT row_to_json(t) FROM %s t WHERE t.user_id = (SELECT id FROM users WHERE username = $1)`, table.name),
+			bags:  table.bags,
+		})
+	}
+	for _, table := range usernameTables {
+		tables = append(tables, exportTable{
+			name:       table,
+			query:      fmt.Sprintf(`SELECT row_to_json(t) FROM %s t WHERE t.username = ANY($1)`, table),
+			byUsername: true,
+		})
+	}
+	return tables
+}()
+
+// exportUser calls fn for each table in exportTables with a function that
+// iterates over the user's rows in the table as JSON. The rows are read in a
+// single read-only transaction so that the export is consistent. bagsUsername
+// is the username with the user domain that the bags tables use.
+func (u *UsersDB) exportUser(ctx context.Context, username, bagsUsername string, fn func(table string, rows func(func(json.RawMessage) error) error) error) error {
+	tx, err := u.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	for _, table := range exportTables {
+		name := username
+		if table.bags {
+			name = bagsUsername
+		}
+
+		var arg interface{} = name
+		if table.byUsername {
+			arg = pq.Array(purgeUsernames(username, bagsUsername))
+		}
+
+		rows := queryRows(ctx, tx, table.query, arg)
+		if err = fn(table.name, rows); err != nil {
+			return fmt.Errorf("error exporting %s for %s: %w", table.name, name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// queryRows returns a function that runs the query in the transaction and
+// calls each with every row it returns, which must be a single JSON column.
+func queryRows(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) func(func(json.RawMessage) error) error {
+	return func(each func(json.RawMessage) error) error {
+		result, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return dbError(err)
+		}
+		defer result.Close()
+
+		for result.Next() {
+			var row []byte
+			if err = result.Scan(&row); err != nil {
+				return err
+			}
+			if err = each(row); err != nil {
+				return err
+			}
+		}
+		return dbError(result.Err())
+	}
+}
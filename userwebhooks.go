@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// slackWebhook is the type of webhook that posts to a Slack incoming webhook,
+// which expects a message rather than a notification.
+const slackWebhook = "slack"
+
+// testTopic is the topic of the notification sent to test a webhook.
+const testTopic = "test"
+
+// maxWebhookURLLength is the length of the longest URL a webhook can have.
+const maxWebhookURLLength = 2048
+
+// maxWebhookTopics is the most topics a webhook can be limited to.
+const maxWebhookTopics = 100
+
+// userNotification is the body POSTed to user webhooks that aren't Slack
+// webhooks.
+type userNotification struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Username  string    `json:"username"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookDelivery is the result of sending a notification to a webhook. Status
+// is the webhook's response status, if it responded.
+type webhookDelivery struct {
+	Delivered bool   `json:"delivered"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// publicIP returns whether the address is one that webhooks can be sent to
+// when private addresses aren't allowed.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// newUserWebhookClient returns the client used to send notifications to user
+// webhooks. Since users choose the URLs, the client won't connect to loopback,
+// private, or link-local addresses unless allowPrivate is set, which is
+// checked after the host name is resolved. It doesn't use a proxy or follow
+// redirects.
+func newUserWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("webhooks can't be sent to %s", host)
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// UserWebhooksApp manages the webhooks that users register to receive their
+// DE notifications in other services, such as Slack.
+type UserWebhooksApp struct {
+	webhooks *UserWebhooksDB
+	types    []string
+	topics   []string
+	client   *http.Client
+	router   *mux.Router
+}
+
+// NewUserWebhooksApp returns a new *UserWebhooksApp. Webhooks must have one of
+// the types, and if topics isn't empty, can only be limited to those topics.
+// Test notifications are sent with client.
+func NewUserWebhooksApp(db *UserWebhooksDB, types, topics []string, client *http.Client, router *mux.Router) *UserWebhooksApp {
+	userWebhooksApp := &UserWebhooksApp{
+		webhooks: db,
+		types:    types,
+		topics:   topics,
+		client:   client,
+		router:   moduleRouter(router, "user-webhooks", "/webhooks"),
+	}
+	userWebhooksApp.router.HandleFunc("/{username}", userWebhooksApp.GetRequest).Methods(http.MethodGet)
+	userWebhooksApp.router.HandleFunc("/{username}", userWebhooksApp.PostRequest).Methods(http.MethodPost)
+	userWebhooksApp.router.HandleFunc("/{username}", userWebhooksApp.DeleteRequest).Methods(http.MethodDelete)
+	userWebhooksApp.router.HandleFunc("/{username}/{webhookID}", userWebhooksApp.PutWebhookRequest).Methods(http.MethodPut)
+	userWebhooksApp.router.HandleFunc("/{username}/{webhookID}", userWebhooksApp.DeleteWebhookRequest).Methods(http.MethodDelete)
+	userWebhooksApp.router.HandleFunc("/{username}/{webhookID}/test", userWebhooksApp.TestRequest).Methods(http.MethodPost)
+	return userWebhooksApp
+}
+
+// userWebhookBody is the body of a request to register or update a webhook.
+type userWebhookBody struct {
+	URL    string   `json:"url"`
+	Type   string   `json:"type"`
+	Topics []string `json:"topics"`
+}
+
+// validTopic returns what's wrong with the topic, if anything.
+func (u *UserWebhooksApp) validTopic(topic string) string {
+	if len(topic) > 128 || !eventTypePattern.MatchString(topic) {
+		return fmt.Sprintf("invalid topic: %q", topic)
+	}
+	if len(u.topics) > 0 && !slices.Contains(u.topics, topic) {
+		return fmt.Sprintf("unknown topic %q; expected one of %s", topic, strings.Join(u.topics, ", "))
+	}
+	return ""
+}
+
+// validate checks the body, responding with a 400 and returning false if it
+// isn't valid. The body's topics are sorted without duplicates.
+func (u *UserWebhooksApp) validate(writer http.ResponseWriter, body *userWebhookBody) bool {
+	problems := make(map[string]string)
+
+	parsed, err := url.Parse(body.URL)
+	switch {
+	case err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "":
+		problems["url"] = "must be an absolute http or https URL"
+	case len(body.URL) > maxWebhookURLLength:
+		problems["url"] = fmt.Sprintf("must be at most %d characters long", maxWebhookURLLength)
+	}
+
+	if !slices.Contains(u.types, body.Type) {
+		problems["type"] = fmt.Sprintf("must be one of %s", strings.Join(u.types, ", "))
+	}
+
+	if len(body.Topics) > maxWebhookTopics {
+		problems["topics"] = fmt.Sprintf("at most %d topics are allowed", maxWebhookTopics)
+	} else {
+		for _, topic := range body.Topics {
+			if problem := u.validTopic(topic); problem != "" {
+				problems["topics"] = problem
+				break
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		httpapi.InvalidFields(writer, problems)
+		return false
+	}
+
+	topics := append([]string{}, body.Topics...)
+	slices.Sort(topics)
+	body.Topics = slices.Compact(topics)
+	return true
+}
+
+// GetRequest lists the user's webhooks, oldest first, as
+// {"webhooks": [...]}. If the topic query parameter is set, only the webhooks
+// that receive notifications on that topic are listed.
+func (u *UserWebhooksApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.webhooks.isUser)
+	if !ok {
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic != "" && !eventTypePattern.MatchString(topic) {
+		httpapi.BadRequest(writer, fmt.Sprintf("invalid topic: %q", topic))
+		return
+	}
+
+	webhooks, err := u.webhooks.getWebhooks(r.Context(), username)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting the webhooks of user %s: %s", username, err))
+		return
+	}
+	if topic != "" {
+		webhooks = slices.DeleteFunc(slices.Clone(webhooks), func(w UserWebhook) bool {
+			return !w.wants(topic)
+		})
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"webhooks": webhooks})
+}
+
+// PostRequest registers a webhook for the user from the body,
+// {"url": ..., "type": ..., "topics": [...]}, where an empty or missing list
+// of topics receives notifications on every topic. The user can't register
+// the same URL twice.
+func (u *UserWebhooksApp) PostRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.webhooks.isUser)
+	if !ok {
+		return
+	}
+
+	var body userWebhookBody
+	if !decodeStrict(writer, r, &body) || !u.validate(writer, &body) {
+		return
+	}
+
+	webhook, err := u.webhooks.addWebhook(r.Context(), username, body.URL, body.Type, body.Topics)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error registering a webhook for user %s: %s", username, err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusCreated, webhook)
+}
+
+// PutWebhookRequest replaces one of the user's webhooks with the one in the
+// body, which is shaped like the body of PostRequest.
+func (u *UserWebhooksApp) PutWebhookRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.webhooks.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "webhookID", "webhook")
+	if !ok {
+		return
+	}
+
+	var body userWebhookBody
+	if !decodeStrict(writer, r, &body) || !u.validate(writer, &body) {
+		return
+	}
+
+	webhook, err := u.webhooks.updateWebhook(r.Context(), username, id, body.URL, body.Type, body.Topics)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error updating webhook %s for user %s: %s", id, username, err))
+		return
+	}
+	if webhook == nil {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no webhook %s", username, id))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, webhook)
+}
+
+// DeleteWebhookRequest deletes one of the user's webhooks.
+func (u *UserWebhooksApp) DeleteWebhookRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.webhooks.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "webhookID", "webhook")
+	if !ok {
+		return
+	}
+
+	deleted, err := u.webhooks.deleteWebhook(r.Context(), username, id)
+	if err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting webhook %s for user %s: %s", id, username, err))
+		return
+	}
+	if !deleted {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no webhook %s", username, id))
+	}
+}
+
+// DeleteRequest deletes all of the user's webhooks.
+func (u *UserWebhooksApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.webhooks.isUser)
+	if !ok {
+		return
+	}
+
+	if _, err := u.webhooks.deleteWebhooks(r.Context(), username); err != nil {
+		writeFailed(writer, err, fmt.Sprintf("error deleting the webhooks of user %s: %s", username, err))
+	}
+}
+
+// TestRequest sends a test notification to one of the user's webhooks and
+// responds with whether it was delivered. A failed delivery is still a 200;
+// the response says what went wrong.
+func (u *UserWebhooksApp) TestRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := existingUser(writer, r, u.webhooks.isUser)
+	if !ok {
+		return
+	}
+	id, ok := uuidVar(writer, r, "webhookID", "webhook")
+	if !ok {
+		return
+	}
+
+	webhook, err := u.webhooks.getWebhook(r.Context(), username, id)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error getting webhook %s for user %s: %s", id, username, err))
+		return
+	}
+	if webhook == nil {
+		httpapi.NotFound(writer, fmt.Sprintf("user %s has no webhook %s", username, id))
+		return
+	}
+
+	notification := userNotification{
+		ID:        uuid.New().String(),
+		Topic:     testTopic,
+		Username:  username,
+		Message:   "This is a test notification from the Discovery Environment.",
+		Timestamp: time.Now().UTC(),
+	}
+	httpapi.WriteJSON(writer, http.StatusOK, u.send(r, webhook, notification))
+}
+
+// send delivers the notification to the webhook, formatted for its type.
+func (u *UserWebhooksApp) send(r *http.Request, webhook *UserWebhook, n userNotification) webhookDelivery {
+	var (
+		body []byte
+		err  error
+	)
+	if webhook.Type == slackWebhook {
+		body, err = json.Marshal(map[string]string{"text": n.Message})
+	} else {
+		body, err = json.Marshal(n)
+	}
+	if err != nil {
+		return webhookDelivery{Error: err.Error()}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return webhookDelivery{Error: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, n.Topic)
+	req.Header.Set(webhookIDHeader, n.ID)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return webhookDelivery{Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	delivery := webhookDelivery{Status: resp.StatusCode}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		delivery.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	} else {
+		delivery.Delivered = true
+	}
+	return delivery
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/cyverse-de/queries"
+	"github.com/lib/pq"
+)
+
+// UserWebhook is a URL that a user registered to receive their DE
+// notifications. Type is the kind of service behind the URL, such as Slack,
+// which decides how notifications are formatted. An empty Topics receives
+// notifications on every topic.
+type UserWebhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Type      string    `json:"type"`
+	Topics    []string  `json:"topics"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// wants returns whether the webhook receives notifications on the topic.
+func (w *UserWebhook) wants(topic string) bool {
+	return len(w.Topics) == 0 || slices.Contains(w.Topics, topic)
+}
+
+// UserWebhooksDB handles interacting with the user_webhooks table.
+type UserWebhooksDB struct {
+	mutationNotifier
+
+	db    *retryingDB
+	cache Cache
+}
+
+// NewUserWebhooksDB returns a newly created *UserWebhooksDB. Reads are cached
+// in cache, which may be nil to disable caching.
+func NewUserWebhooksDB(db *sql.DB, cache Cache) *UserWebhooksDB {
+	return &UserWebhooksDB{
+		db:    withRetries(db),
+		cache: cache,
+	}
+}
+
+func userWebhooksKey(username string) string {
+	return cacheKey("user-webhooks", "webhooks", username)
+}
+
+// isUser returns whether or not the user is present in the database.
+func (u *UserWebhooksDB) isUser(ctx context.Context, username string) (bool, error) {
+	return cachedIsUser(ctx, u.cache, u.db, username)
+}
+
+// getWebhooks returns the user's webhooks, oldest first.
+func (u *UserWebhooksDB) getWebhooks(ctx context.Context, username string) ([]UserWebhook, error) {
+	if webhooks, ok := cacheGet[[]UserWebhook](ctx, u.cache, userWebhooksKey(username)); ok {
+		return webhooks, nil
+	}
+
+	query, args := userRows("user_webhooks", "w", username, "w.id", "w.url", "w.type", "w.topics", "w.created_at", "w.updated_at").
+		OrderBy("w.created_at", "w.id").
+		SQL()
+
+	rows, err := u.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []UserWebhook{}
+	for rows.Next() {
+		var webhook UserWebhook
+		if err = rows.Scan(&webhook.ID, &webhook.URL, &webhook.Type, pq.Array(&webhook.Topics), &webhook.CreatedAt, &webhook.UpdatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cacheSet(ctx, u.cache, userWebhooksKey(username), webhooks)
+	return webhooks, nil
+}
+
+// getWebhook returns one of the user's webhooks, or nil if the user doesn't
+// have it.
+func (u *UserWebhooksDB) getWebhook(ctx context.Context, username, webhookID string) (*UserWebhook, error) {
+	webhooks, err := u.getWebhooks(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		if webhooks[i].ID == webhookID {
+			return &webhooks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// addWebhook registers a webhook for the user. Registering a URL the user
+// already registered is a conflict.
+func (u *UserWebhooksDB) addWebhook(ctx context.Context, username, url, webhookType string, topics []string) (*UserWebhook, error) {
+	defer cacheInvalidate(ctx, u.cache, userWebhooksKey(username))
+
+	query := `INSERT INTO user_webhooks (user_id, url, type, topics)
+                   VALUES ($1, $2, $3, $4)
+                RETURNING id, created_at, updated_at`
+
+	userID, err := queries.UserID(ctx, u.db, username)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook := UserWebhook{URL: url, Type: webhookType, Topics: topics}
+	if err = u.db.QueryRowContext(ctx, query, userID, url, webhookType, pq.Array(topics)).
+		Scan(&webhook.ID, &webhook.CreatedAt, &webhook.UpdatedAt); err != nil {
+		return nil, dbError(err)
+	}
+
+	u.notify(ctx, Mutation{Module: "user-webhooks", Action: actionCreated, Username: username})
+	return &webhook, nil
+}
+
+// updateWebhook replaces the URL, type, and topics of one of the user's
+// webhooks. Returns nil if the user doesn't have the webhook.
+func (u *UserWebhooksDB) updateWebhook(ctx context.Context, username, webhookID, url, webhookType string, topics []string) (*UserWebhook, error) {
+	defer cacheInvalidate(ctx, u.cache, userWebhooksKey(username))
+
+	query := `UPDATE ONLY user_webhooks w
+                 SET url = $3, type = $4, topics = $5, updated_at = now()
+                FROM users u
+               WHERE w.user_id = u.id AND w.id = $1 AND u.username = $2
+           RETURNING w.created_at, w.updated_at`
+
+	webhook := UserWebhook{ID: webhookID, URL: url, Type: webhookType, Topics: topics}
+	err := u.db.QueryRowContext(ctx, query, webhookID, username, url, webhookType, pq.Array(topics)).
+		Scan(&webhook.CreatedAt, &webhook.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	u.notify(ctx, Mutation{Module: "user-webhooks", Action: actionUpdated, Username: username})
+	return &webhook, nil
+}
+
+// deleteWebhook deletes one of the user's webhooks. Returns whether the user
+// had the webhook.
+func (u *UserWebhooksDB) deleteWebhook(ctx context.Context, username, webhookID string) (bool, error) {
+	defer cacheInvalidate(ctx, u.cache, userWebhooksKey(username))
+
+	query := `DELETE FROM ONLY user_webhooks w
+                    USING users u
+                    WHERE w.user_id = u.id AND w.id = $1 AND u.username = $2`
+
+	result, err := u.db.ExecContext(ctx, query, webhookID, username)
+	if err != nil {
+		return false, dbError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted > 0 {
+		u.notify(ctx, Mutation{Module: "user-webhooks", Action: actionDeleted, Username: username})
+	}
+	return deleted > 0, nil
+}
+
+// deleteWebhooks deletes all of the user's webhooks. Returns the number
+// deleted.
+func (u *UserWebhooksDB) deleteWebhooks(ctx context.Context, username string) (int64, error) {
+	defer cacheInvalidate(ctx, u.cache, userWebhooksKey(username))
+
+	userID, err := queries.UserID(ctx, u.db, username)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := u.db.ExecContext(ctx, `DELETE FROM ONLY user_webhooks WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		u.notify(ctx, Mutation{Module: "user-webhooks", Action: actionDeleted, Username: username})
+	}
+	return deleted, nil
+}
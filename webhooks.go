@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers sent with each webhook delivery. The signature is the hex-encoded
+// HMAC-SHA256 of the request body keyed with the subscription's secret, in the
+// form "sha256=<hex>".
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookIDHeader        = "X-Webhook-ID"
+)
+
+// defaultDeadLetterLimit is the number of dead letters listed when the request
+// doesn't include a limit.
+const defaultDeadLetterLimit = 100
+
+// WebhookEvent is the body POSTed to webhook subscribers.
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Username  string    `json:"username"`
+	BagID     string    `json:"bag_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookSignature returns the value of the signature header for the body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher delivers mutation events to webhook subscribers. Events are
+// queued by Observe and sent by Run, so writes aren't slowed by deliveries.
+type WebhookDispatcher struct {
+	webhooks *WebhooksDB
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	queue    chan WebhookEvent
+}
+
+// NewWebhookDispatcher returns a new *WebhookDispatcher. Each delivery is tried
+// up to attempts times, waiting backoff before the first retry and doubling
+// the wait after each one, before the event is recorded as a dead letter.
+func NewWebhookDispatcher(webhooks *WebhooksDB, timeout time.Duration, attempts int, backoff time.Duration, queueSize int) *WebhookDispatcher {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	return &WebhookDispatcher{
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: timeout},
+		attempts: attempts,
+		backoff:  backoff,
+		queue:    make(chan WebhookEvent, queueSize),
+	}
+}
+
+// Observe queues an event for the mutation. The event is dropped if the queue
+// is full.
+func (d *WebhookDispatcher) Observe(_ context.Context, m Mutation) {
+	event := WebhookEvent{
+		ID:        uuid.New().String(),
+		Type:      m.EventType(),
+		Username:  m.Username,
+		BagID:     m.BagID,
+		Timestamp: time.Now().UTC(),
+	}
+
+	select {
+	case d.queue <- event:
+	default:
+		log.Errorf("webhook queue is full, dropping %s event %s for %s", event.Type, event.ID, event.Username)
+	}
+}
+
+// Run sends queued events to their subscribers until the context is canceled.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.queue:
+			d.dispatch(ctx, event)
+		}
+	}
+}
+
+// dispatch starts delivering the event to each subscription that wants it.
+func (d *WebhookDispatcher) dispatch(ctx context.Context, event WebhookEvent) {
+	subs, err := d.webhooks.listSubscriptions(ctx)
+	if err != nil {
+		log.Errorf("error listing webhook subscriptions for event %s: %s", event.ID, err)
+		return
+	}
+
+	for i := range subs {
+		if subs[i].wants(event.Type) {
+			go d.deliver(ctx, subs[i], event)
+		}
+	}
+}
+
+// deliver sends the event to the subscription, retrying failed attempts. The
+// event is recorded as a dead letter if every attempt fails.
+func (d *WebhookDispatcher) deliver(ctx context.Context, sub WebhookSubscription, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("error encoding webhook event %s: %s", event.ID, err)
+		return
+	}
+
+	wait := d.backoff
+	for attempt := 1; ; attempt++ {
+		if err = d.post(ctx, sub, event, body); err == nil {
+			return
+		}
+		log.Warnf("attempt %d of %d to deliver event %s to %s failed: %s", attempt, d.attempts, event.ID, sub.URL, err)
+
+		if attempt == d.attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+
+	if err = d.webhooks.addDeadLetter(ctx, sub.ID, body, err.Error(), d.attempts); err != nil {
+		log.Error(err)
+	}
+}
+
+// post makes a single attempt to deliver the event.
+func (d *WebhookDispatcher) post(ctx context.Context, sub WebhookSubscription, event WebhookEvent, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event.Type)
+	req.Header.Set(webhookIDHeader, event.ID)
+	req.Header.Set(webhookSignatureHeader, webhookSignature(sub.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// WebhooksApp handles the admin requests for managing webhook subscriptions.
+type WebhooksApp struct {
+	webhooks *WebhooksDB
+	router   *mux.Router
+}
+
+// NewWebhooksApp returns a new *WebhooksApp. The router should be the admin
+// router returned by newAdminRouter.
+func NewWebhooksApp(db *WebhooksDB, router *mux.Router) *WebhooksApp {
+	webhooksApp := &WebhooksApp{
+		webhooks: db,
+		router:   moduleRouter(router, "webhooks", "/webhooks"),
+	}
+	webhooksApp.router.HandleFunc("", webhooksApp.ListSubscriptions).Methods(http.MethodGet)
+	webhooksApp.router.HandleFunc("", webhooksApp.AddSubscription).Methods(http.MethodPost)
+	webhooksApp.router.HandleFunc("/dead-letters", webhooksApp.ListDeadLetters).Methods(http.MethodGet)
+	webhooksApp.router.HandleFunc("/{id}", webhooksApp.DeleteSubscription).Methods(http.MethodDelete)
+	return webhooksApp
+}
+
+// ListSubscriptions returns every webhook subscription, without their secrets.
+func (w *WebhooksApp) ListSubscriptions(writer http.ResponseWriter, r *http.Request) {
+	subs, err := w.webhooks.listSubscriptions(r.Context())
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing webhook subscriptions: %s", err))
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusOK, map[string]interface{}{"webhooks": subs})
+}
+
+// AddSubscription adds a webhook subscription. The body must contain the url
+// and the secret used to sign deliveries, and may contain a list of
+// event_types.
+func (w *WebhooksApp) AddSubscription(writer http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			URL        string   `json:"url"`
+			Secret     string   `json:"secret"`
+			EventTypes []string `json:"event_types"`
+		}
+		body []byte
+		err  error
+	)
+
+	if body, err = io.ReadAll(r.Body); err != nil {
+		httpapi.ReadBodyError(writer, err)
+		return
+	}
+
+	if _, ok := httpapi.ReadObject(writer, body); !ok {
+		return
+	}
+
+	if err = json.Unmarshal(body, &req); err != nil {
+		httpapi.BadRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		httpapi.BadRequest(writer, fmt.Sprintf("url must be an absolute http or https URL: %q", req.URL))
+		return
+	}
+
+	if req.Secret == "" {
+		httpapi.BadRequest(writer, "secret must be set")
+		return
+	}
+
+	for _, t := range req.EventTypes {
+		if t == "" {
+			httpapi.BadRequest(writer, "event_types must not contain empty strings")
+			return
+		}
+	}
+
+	sub, err := w.webhooks.addSubscription(r.Context(), req.URL, req.Secret, req.EventTypes)
+	if err != nil {
+		httpapi.Errored(writer, err.Error())
+		return
+	}
+
+	httpapi.WriteJSON(writer, http.StatusCreated, sub)
+}
+
+// DeleteSubscription deletes a webhook subscription along with its dead
+// letters.
+func (w *WebhooksApp) DeleteSubscription(writer http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		httpapi.BadRequest(writer, fmt.Sprintf("invalid webhook subscription ID: %s", id))
+		return
+	}
+
+	found, err := w.webhooks.deleteSubscription(r.Context(), id)
+	if err != nil {
+		httpapi.Errored(writer, err.Error())
+		return
+	}
+
+	if !found {
+		httpapi.NotFound(writer, fmt.Sprintf("webhook subscription %s not found", id))
+	}
+}
+
+// ListDeadLetters returns a page of the events that couldn't be delivered,
+// newest first.
+func (w *WebhooksApp) ListDeadLetters(writer http.ResponseWriter, r *http.Request) {
+	page, err := httpapi.ParsePage(r, defaultDeadLetterLimit, 0)
+	if err != nil {
+		httpapi.BadRequest(writer, err.Error())
+		return
+	}
+
+	letters, total, err := w.webhooks.listDeadLetters(r.Context(), page)
+	if err != nil {
+		httpapi.Errored(writer, fmt.Sprintf("error listing webhook dead letters: %s", err))
+		return
+	}
+
+	httpapi.WritePage(writer, r, page, letters, total)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/user-info/internal/httpapi"
+	"github.com/lib/pq"
+)
+
+// WebhookSubscription is an endpoint that receives events for the mutations
+// it subscribes to. An empty EventTypes subscribes to every event. Event types
+// may end in ".*" to subscribe to every event for a module.
+type WebhookSubscription struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"`
+	EventTypes []string  `json:"event_types"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// wants returns whether the subscription includes the event type.
+func (s *WebhookSubscription) wants(eventType string) bool {
+	if len(s.EventTypes) == 0 {
+		return true
+	}
+
+	for _, t := range s.EventTypes {
+		if t == "*" || t == eventType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDeadLetter records an event that couldn't be delivered to a
+// subscription.
+type WebhookDeadLetter struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	Event          json.RawMessage `json:"event"`
+	Error          string          `json:"error"`
+	Attempts       int             `json:"attempts"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// WebhooksDB stores webhook subscriptions and undeliverable events.
+type WebhooksDB struct {
+	db *retryingDB
+}
+
+// NewWebhooksDB returns a newly created *WebhooksDB.
+func NewWebhooksDB(db *sql.DB) *WebhooksDB {
+	return &WebhooksDB{db: withRetries(db)}
+}
+
+// listSubscriptions returns every webhook subscription.
+func (w *WebhooksDB) listSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	query := `SELECT id, url, secret, event_types, created_at
+                FROM webhook_subscriptions
+            ORDER BY created_at`
+
+	rows, err := w.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var sub WebhookSubscription
+		if err = rows.Scan(&sub.ID, &sub.URL, &sub.Secret, pq.Array(&sub.EventTypes), &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, dbError(rows.Err())
+}
+
+// addSubscription stores a new webhook subscription.
+func (w *WebhooksDB) addSubscription(ctx context.Context, url, secret string, eventTypes []string) (WebhookSubscription, error) {
+	query := `INSERT INTO webhook_subscriptions (url, secret, event_types)
+                   VALUES ($1, $2, $3)
+                RETURNING id, created_at`
+
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+
+	sub := WebhookSubscription{URL: url, Secret: secret, EventTypes: eventTypes}
+	if err := w.db.QueryRowContext(ctx, query, url, secret, pq.Array(eventTypes)).Scan(&sub.ID, &sub.CreatedAt); err != nil {
+		return sub, fmt.Errorf("error adding webhook subscription for %s: %w", url, dbError(err))
+	}
+	return sub, nil
+}
+
+// deleteSubscription deletes a webhook subscription. Returns whether it
+// existed.
+func (w *WebhooksDB) deleteSubscription(ctx context.Context, id string) (bool, error) {
+	query := `DELETE FROM webhook_subscriptions WHERE id = $1`
+
+	result, err := w.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return false, fmt.Errorf("error deleting webhook subscription %s: %w", id, dbError(err))
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// addDeadLetter records an event that couldn't be delivered.
+func (w *WebhooksDB) addDeadLetter(ctx context.Context, subscriptionID string, event []byte, deliveryErr string, attempts int) error {
+	query := `INSERT INTO webhook_dead_letters (subscription_id, event, error, attempts)
+                   VALUES ($1, $2, $3, $4)`
+
+	if _, err := w.db.ExecContext(ctx, query, subscriptionID, string(event), deliveryErr, attempts); err != nil {
+		return fmt.Errorf("error recording undelivered event for subscription %s: %w", subscriptionID, dbError(err))
+	}
+	return nil
+}
+
+// listDeadLetters returns a page of the undeliverable events, newest first,
+// along with the total number of them.
+func (w *WebhooksDB) listDeadLetters(ctx context.Context, page httpapi.Page) ([]WebhookDeadLetter, int64, error) {
+	var total int64
+
+	q := selectFrom("webhook_dead_letters", "id", "subscription_id", "event", "error", "attempts", "created_at")
+
+	countQuery, countArgs := q.Count().SQL()
+	if err := w.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	query, args := q.OrderBy("created_at DESC", "id").Page(page).SQL()
+	rows, err := w.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, dbError(err)
+	}
+	defer rows.Close()
+
+	letters := []WebhookDeadLetter{}
+	for rows.Next() {
+		var letter WebhookDeadLetter
+		var event []byte
+		if err = rows.Scan(&letter.ID, &letter.SubscriptionID, &event, &letter.Error, &letter.Attempts, &letter.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		letter.Event = event
+		letters = append(letters, letter)
+	}
+
+	return letters, total, dbError(rows.Err())
+}